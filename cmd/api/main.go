@@ -3,25 +3,31 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"dispatch-and-delivery/internal/api"
+	apimiddleware "dispatch-and-delivery/internal/api/middleware"
+	"dispatch-and-delivery/internal/app"
 	"dispatch-and-delivery/internal/config"
-	"dispatch-and-delivery/internal/modules/logistics"
-	"dispatch-and-delivery/internal/modules/order"
-	"dispatch-and-delivery/internal/modules/user"
+	"dispatch-and-delivery/internal/database"
+	"dispatch-and-delivery/pkg/cache"
 	"dispatch-and-delivery/pkg/email"
+	"dispatch-and-delivery/pkg/errreport"
+	"dispatch-and-delivery/pkg/maps"
 	"dispatch-and-delivery/pkg/payment"
+	"dispatch-and-delivery/pkg/storage"
+	"dispatch-and-delivery/pkg/weather"
 
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/net/netutil"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
 )
 
 func main() {
@@ -32,39 +38,71 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	// Quotes and routing are unusable without a Maps key; fail at boot, not on the first quote.
+	if cfg.GoogleMapsAPIKey == "" {
+		log.Fatal("GOOGLE_MAPS_API_KEY is not set")
+	}
 
-	e := echo.New()
-	// e.Logger.Fatal(e.Start(":" + cfg.ServerPort))
-
-	// 2. --- Middleware ---
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{ // Configure CORS appropriately
-		AllowOrigins: []string{"http://localhost:5173", cfg.ClientOrigin}, // Your SvelteKit dev and prod origins
-		AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodOptions},
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
-	}))
+	// Panics and 5xx errors go to Sentry when a DSN is configured, otherwise to the log.
+	var reporter errreport.Reporter = errreport.NewLogReporter()
+	if cfg.SentryDSN != "" {
+		sentryReporter, err := errreport.NewSentryReporter(cfg.SentryDSN, cfg.AppEnv, cfg.Release)
+		if err != nil {
+			log.Fatalf("Failed to configure error reporting: %v", err)
+		}
+		reporter = sentryReporter
+	}
+	defer reporter.Flush(2 * time.Second)
 
-	// 3. --- Database Connection ---
+	// 2. --- Database Connection ---
 	// Initialize the PostgreSQL database connection pool.
 	// This connection will be shared across all parts of the application that need it.
-	dbConfig, err := pgxpool.ParseConfig(cfg.DatabaseURL)
-	if err != nil {
-		log.Fatalf("Unable to parse database configuration: %v", err)
-	}
+	poolSettings := database.PoolSettings{
+		MaxConns:          cfg.DBMaxConns,
+		MinConns:          cfg.DBMinConns,
+		MaxConnLifetime:   cfg.DBMaxConnLifetime,
+		MaxConnIdleTime:   cfg.DBMaxConnIdleTime,
+		HealthCheckPeriod: cfg.DBHealthCheckPeriod,
 
-	dbPool, err := pgxpool.NewWithConfig(context.Background(), dbConfig)
+		QueryExecMode:          cfg.DBQueryExecMode,
+		StatementCacheCapacity: cfg.DBStatementCacheCapacity,
+	}
+	dbPool, err := database.NewPool(context.Background(), "primary", cfg.DatabaseURL, poolSettings)
 	if err != nil {
-		log.Fatalf("Unable to create connection pool: %v\n", err)
+		log.Fatalf("Unable to connect to database: %v\n", err)
 	}
 	defer dbPool.Close()
+	log.Println("Successfully connected to the database!")
 
-	if err := dbPool.Ping(context.Background()); err != nil {
-		log.Fatalf("Unable to ping database: %v\n", err)
+	// Refuse to run against a schema this build does not understand, instead
+	// of failing later with scan errors on missing or extra columns.
+	var extraMiddleware []echo.MiddlewareFunc
+	if cfg.SchemaCheck != "off" {
+		st, err := database.CheckSchema(context.Background(), dbPool)
+		if err != nil {
+			if cfg.SchemaCheck != "degraded" {
+				log.Fatalf("Schema check failed: %v", err)
+			}
+			log.Printf("WARNING: schema check failed, starting in read-only mode: %v", err)
+			extraMiddleware = append(extraMiddleware, apimiddleware.ReadOnly())
+		} else {
+			log.Printf("Database schema at version %d (supported %d-%d)", st.Version, database.MinSchemaVersion, database.MaxSchemaVersion)
+		}
+	}
+
+	// Heavy read queries (admin lists, tracking history) go to the read replica
+	// when one is configured; otherwise they share the primary pool.
+	replicaPool := dbPool
+	if cfg.DatabaseReplicaURL != "" {
+		replicaPool, err = database.NewPool(context.Background(), "replica", cfg.DatabaseReplicaURL, poolSettings)
+		if err != nil {
+			log.Fatalf("Unable to connect to replica database: %v\n", err)
+		}
+		defer replicaPool.Close()
+		log.Println("Successfully connected to the read replica!")
 	}
-	e.Logger.Info("Successfully connected to the database!")
 
-	// 3. --- Dependency Injection (Wiring everything up) ---
+	// 4. --- External adapters ---
 	// Initialize Google OAuth Config
 	googleOAuthConfig := &oauth2.Config{
 		RedirectURL:  cfg.GoogleOAuthRedirectURL,
@@ -86,45 +124,160 @@ func main() {
 		log.Fatalf("Failed to parse email templates: %v", err)
 	}
 
-	paymentService := payment.NewStripeService(cfg.StripeAPIKey)
-
-	// --- Users Module ---
-	userRepo := user.NewRepository(dbPool)
-	userService := user.NewService(
-		userRepo,
-		sesSender,
-		templateManager,
-		cfg.JWTSecret,
-		cfg.ClientOrigin,
-		googleOAuthConfig,
-	)
-	userHandler := user.NewHandler(userService)
-
-	// --- Logistics Module ---
-	logisticsRepo := logistics.NewRepository(dbPool)
-	logisticsService := logistics.NewService(logisticsRepo, cfg.GoogleMapsAPIKey)
-	logisticsHandler := logistics.NewHandler(logisticsService)
-
-	// --- Orders Module ---
-	orderRepo := order.NewRepository(dbPool)
-	orderService := order.NewService(orderRepo, paymentService, logisticsService)
-	orderHandler := order.NewHandler(orderService)
-
-	// 4. --- Initialize Router ---
-	// Add more routes
-	api.SetupRoutes(e, cfg.JWTSecret,
-		userHandler,
-		orderHandler,
-		logisticsHandler,
-	)
+	// The fake payment provider keeps staging and integration tests off Stripe.
+	var paymentService payment.ServiceInterface
+	switch cfg.PaymentProvider {
+	case "stripe":
+		paymentService = payment.NewStripeService(cfg.StripeAPIKey)
+	case "fake":
+		// Allow-listed, so a mistyped or new APP_ENV never runs on the fake.
+		switch cfg.AppEnv {
+		case "development", "staging", "test":
+		default:
+			log.Fatalf("PAYMENT_PROVIDER=fake is only allowed with APP_ENV development, staging or test, not %q", cfg.AppEnv)
+		}
+		paymentService, err = payment.NewFakeService(payment.FakeMode(cfg.PaymentFakeMode), cfg.PaymentFakeDelay)
+		if err != nil {
+			log.Fatalf("Failed to configure payment provider: %v", err)
+		}
+		log.Printf("Using the fake payment provider (%s); no payment reaches Stripe", cfg.PaymentFakeMode)
+	default:
+		log.Fatalf("Unknown PAYMENT_PROVIDER %q", cfg.PaymentProvider)
+	}
+
+	var fileStorage storage.Storage
+	switch cfg.StorageDriver {
+	case "s3":
+		fileStorage, err = storage.NewS3Storage(context.Background(), cfg.AWSRegion, cfg.S3Bucket, cfg.S3Endpoint)
+	default:
+		fileStorage, err = storage.NewLocalStorage(cfg.StorageLocalDir, cfg.StoragePublicURL, cfg.JWTSecret)
+	}
+	if err != nil {
+		log.Fatalf("Failed to configure file storage: %v", err)
+	}
+
+	var routing maps.RoutingProvider
+	switch cfg.RoutingProvider {
+	case "google_routes":
+		routing = maps.NewGoogleRoutes(cfg.GoogleMapsAPIKey, "", nil)
+	case "mapbox":
+		routing = maps.NewMapbox(cfg.MapboxAccessToken, "", nil)
+	case "osrm":
+		routing, err = maps.NewOSRM(cfg.OSRMURL, nil)
+	default:
+		routing = maps.NewGoogle(cfg.GoogleMapsAPIKey, "", nil)
+	}
+	if err != nil {
+		log.Fatalf("Failed to configure routing provider: %v", err)
+	}
+
+	// Weather checks on drone (and robot) quotes are opt-in.
+	var weatherProvider weather.Provider
+	switch cfg.WeatherProvider {
+	case "":
+	case "open_meteo":
+		weatherProvider = weather.NewOpenMeteo(cfg.WeatherURL, nil)
+	default:
+		log.Fatalf("Unknown WEATHER_PROVIDER %q", cfg.WeatherProvider)
+	}
+
+	// Route quotes are cached in Redis when configured, so every instance
+	// shares them; an in-memory cache takes over while Redis is unreachable.
+	var quoteCache cache.Store
+	if cfg.RedisURL != "" {
+		redis, err := cache.NewRedis(cfg.RedisURL, "circuit:")
+		if err != nil {
+			log.Fatalf("Failed to configure Redis: %v", err)
+		}
+		quoteCache = cache.WithFallback(redis, cache.NewMemory(0))
+	}
+
+	// Cross-instance cache invalidation over LISTEN/NOTIFY; in-memory caches
+	// (tariffs, zones, fleet snapshots) subscribe, admin writes publish.
+	cacheBus := database.NewCacheBus(dbPool)
+	busCtx, stopBus := context.WithCancel(context.Background())
+	defer stopBus()
+	go cacheBus.Run(busCtx)
+
+	// --- Composition root: repositories, services, handlers and routes ---
+	application := app.New(cfg, app.Dependencies{
+		DB:          dbPool,
+		Replica:     replicaPool,
+		Email:       sesSender,
+		Templates:   templateManager,
+		Payments:    paymentService,
+		Storage:     fileStorage,
+		Routing:     routing,
+		QuoteCache:  quoteCache,
+		Weather:     weatherProvider,
+		GoogleOAuth: googleOAuthConfig,
+		Reporter:    reporter,
+		Cache:       cacheBus,
+	})
+	e := application.Echo(extraMiddleware...)
+
+	// Periodic jobs; an advisory lock per job keeps them to one instance at a time.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobs errgroup.Group
+	jobs.Go(func() error {
+		application.Scheduler.Run(jobsCtx)
+		return nil
+	})
+	// Paid orders are assigned off the request path.
+	jobs.Go(func() error {
+		application.Dispatcher.Run(jobsCtx)
+		return nil
+	})
+	jobsDone := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(jobsDone)
+	}()
+	// Machine telemetry over MQTT, when a broker is configured.
+	if application.Telemetry != nil {
+		go application.Telemetry.Run(jobsCtx)
+	}
 
 	// 5. --- Start Server with graceful shutdown logic ---
+	server := &http.Server{
+		Addr:              ":" + cfg.ServerPort,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+	}
+	if cfg.HTTPMaxConnections > 0 {
+		// Cap concurrent connections so idle or slow clients cannot exhaust file descriptors.
+		ln, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", server.Addr, err)
+		}
+		e.Listener = netutil.LimitListener(ln, cfg.HTTPMaxConnections)
+	}
+
 	go func() {
-		if err := e.Start(":" + cfg.ServerPort); err != nil && err != http.ErrServerClosed {
+		if err := e.StartServer(server); err != nil && err != http.ErrServerClosed {
 			e.Logger.Fatal("shutting down the server an error occurred:", err)
 		}
 	}()
 
+	// Onboard machine agents stream over gRPC on their own port.
+	var agentServer *grpc.Server
+	if application.Agent != nil {
+		ln, err := net.Listen("tcp", ":"+cfg.AgentGRPCPort)
+		if err != nil {
+			log.Fatalf("Failed to listen on :%s: %v", cfg.AgentGRPCPort, err)
+		}
+		agentServer = application.Agent.GRPCServer()
+		go func() {
+			if err := agentServer.Serve(ln); err != nil {
+				log.Fatalf("Agent gRPC server stopped: %v", err)
+			}
+		}()
+		log.Printf("Machine agent gRPC API listening on :%s", cfg.AgentGRPCPort)
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
@@ -135,5 +288,17 @@ func main() {
 	if err := e.Shutdown(ctx); err != nil {
 		e.Logger.Fatal("Server forced to shutdown:", err)
 	}
+	if agentServer != nil {
+		// Agent streams never end on their own, so a graceful stop would only
+		// wait out the deadline. Agents reconnect to another instance and are
+		// sent their open commands and assignments again.
+		agentServer.Stop()
+	}
+	stopJobs()
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		log.Println("Background jobs did not stop before the shutdown deadline")
+	}
 	log.Println("Server exiting")
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"dispatch-and-delivery/internal/database"
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/internal/modules/logistics"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// registerMachine is the CLI form of POST /logistics/fleet: it registers an
+// IDLE machine, issues its API key and tells running API instances to reload
+// their fleet cache.
+func registerMachine(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("register-machine", flag.ExitOnError)
+	dbURL := databaseFlag(fs)
+	machineType := fs.String("type", string(models.MachineTypeDrone), "DRONE or ROBOT")
+	lat := fs.Float64("lat", 0, "current latitude")
+	lon := fs.Float64("lon", 0, "current longitude")
+	battery := fs.Int("battery", 100, "battery level (0-100)")
+	maxWeight := fs.Float64("max-weight", 0, "payload limit in kg (default: the limit for the type)")
+	fs.Parse(args)
+
+	mt := models.MachineType(strings.ToUpper(*machineType))
+	if !mt.Valid() {
+		return fmt.Errorf("invalid -type %q: want DRONE or ROBOT", *machineType)
+	}
+	if *battery < 0 || *battery > 100 {
+		return errors.New("-battery must be between 0 and 100")
+	}
+	req := models.RegisterMachineRequest{
+		Type:         mt,
+		Location:     &models.GeoPoint{Latitude: *lat, Longitude: *lon},
+		BatteryLevel: battery,
+	}
+	if *maxWeight < 0 {
+		return errors.New("-max-weight must be positive")
+	}
+	if *maxWeight > 0 {
+		req.MaxWeightKG = maxWeight
+	}
+
+	pool, err := connect(ctx, *dbURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	// Through the logistics service, so capacity checks and key hashing match the API.
+	svc := logistics.NewService(logistics.NewRepository(pool, nil), "")
+	reg, err := svc.RegisterMachine(ctx, req)
+	if err != nil {
+		return err
+	}
+	// An empty key invalidates the whole fleet snapshot, which is how new machines are picked up.
+	if err := database.NewCacheBus(pool).Invalidate(ctx, logistics.FleetCacheName, ""); err != nil {
+		fmt.Printf("warning: could not notify API instances, the fleet cache refreshes on their next write: %v\n", err)
+	}
+
+	fmt.Printf("Registered %s %s\n", mt, reg.Machine.ID)
+	fmt.Printf("API key (shown once): %s\n", reg.APIKey)
+	return nil
+}
+
+// rotateMachineKey is the CLI form of POST /logistics/fleet/:machineId/credentials.
+func rotateMachineKey(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rotate-machine-key", flag.ExitOnError)
+	dbURL := databaseFlag(fs)
+	machineID := fs.String("machine", "", "machine ID (required)")
+	fs.Parse(args)
+	if *machineID == "" {
+		return errors.New("-machine is required")
+	}
+
+	pool, err := connect(ctx, *dbURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	apiKey, err := issueMachineKey(ctx, pool, *machineID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("API key for %s (shown once): %s\n", *machineID, apiKey)
+	return nil
+}
+
+// issueMachineKey goes through the logistics service so keys are generated
+// and hashed exactly as the API does it.
+func issueMachineKey(ctx context.Context, pool *pgxpool.Pool, machineID string) (string, error) {
+	svc := logistics.NewService(logistics.NewRepository(pool, nil), "")
+	return svc.RotateMachineKey(ctx, machineID)
+}
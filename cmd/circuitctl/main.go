@@ -0,0 +1,88 @@
+// Command circuitctl performs operational tasks against a Circuit deployment:
+// creating administrators, registering machines, running migrations, seeding
+// development data and simulating a machine reporting telemetry.
+//
+// Database commands read DATABASE_URL (or -database). Run `circuitctl help`
+// for the list of commands.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"create-admin", "Create an administrator account (or promote an existing user)", createAdmin},
+	{"hash-password", "Print the bcrypt hash of a password", hashPassword},
+	{"register-machine", "Register a drone or robot and print its API key", registerMachine},
+	{"rotate-machine-key", "Issue a new API key for a machine", rotateMachineKey},
+	{"migrate", "Apply or roll back database migrations (up | down [N] | status | force V)", migrate},
+	{"seed", "Load the development seed data: users, machines, a zone and tariffs", seed},
+	{"simulate", "Drive a machine along a straight line, reporting tracking events to a server", simulate},
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(ctx, os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "circuitctl %s: %v\n", c.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "circuitctl: unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: circuitctl <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run `circuitctl <command> -h` for the flags of a command.")
+}
+
+// databaseFlag registers -database on fs, defaulting to $DATABASE_URL.
+func databaseFlag(fs *flag.FlagSet) *string {
+	return fs.String("database", os.Getenv("DATABASE_URL"), "Postgres connection URL (default $DATABASE_URL)")
+}
+
+func connect(ctx context.Context, url string) (*pgxpool.Pool, error) {
+	if url == "" {
+		return nil, fmt.Errorf("no database URL: set DATABASE_URL or pass -database")
+	}
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"dispatch-and-delivery/internal/database"
+	"dispatch-and-delivery/internal/migrations"
+)
+
+// migrate applies the migrations embedded in the binary. It shares the
+// schema_migrations table with golang-migrate (`make migrate-up`).
+func migrate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbURL := databaseFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: circuitctl migrate [-database URL] up | down [N] | status | force VERSION")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing subcommand")
+	}
+
+	pool, err := connect(ctx, *dbURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	m, err := database.NewMigrator(pool, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, v := range applied {
+			fmt.Printf("applied %d\n", v)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no change")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if fs.NArg() > 1 {
+			if steps, err = strconv.Atoi(fs.Arg(1)); err != nil || steps < 1 {
+				return fmt.Errorf("invalid step count %q", fs.Arg(1))
+			}
+		}
+		reverted, err := m.Down(ctx, steps)
+		for _, v := range reverted {
+			fmt.Printf("reverted %d\n", v)
+		}
+		return err
+
+	case "status":
+		st, err := database.CurrentSchema(ctx, pool)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("version:   %d (dirty: %t)\n", st.Version, st.Dirty)
+		fmt.Printf("latest:    %d\n", m.Latest())
+		fmt.Printf("supported: %d..%d\n", database.MinSchemaVersion, database.MaxSchemaVersion)
+		if _, err := database.CheckSchema(ctx, pool); err != nil {
+			fmt.Printf("warning:   %v\n", err)
+		}
+		return nil
+
+	case "force":
+		v, err := strconv.ParseUint(fs.Arg(1), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", fs.Arg(1))
+		}
+		if err := m.Force(ctx, uint(v)); err != nil {
+			return err
+		}
+		fmt.Printf("forced version %d\n", v)
+		return nil
+	}
+	return fmt.Errorf("unknown migrate subcommand %q", fs.Arg(0))
+}
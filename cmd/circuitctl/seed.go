@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"dispatch-and-delivery/internal/migrations"
+)
+
+// seed loads internal/migrations/seed.sql (embedded in the binary). The seed
+// is idempotent, so it is safe to run repeatedly.
+func seed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	dbURL := databaseFlag(fs)
+	fs.Parse(args)
+
+	body, err := migrations.FS.ReadFile("seed.sql")
+	if err != nil {
+		return err
+	}
+	pool, err := connect(ctx, *dbURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	// No arguments: pgx sends the whole file with the simple protocol.
+	if _, err := pool.Exec(ctx, string(body)); err != nil {
+		return err
+	}
+	fmt.Println("seed data loaded")
+	return nil
+}
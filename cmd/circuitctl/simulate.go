@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	apimiddleware "dispatch-and-delivery/internal/api/middleware"
+	"dispatch-and-delivery/internal/models"
+)
+
+// simulate plays a machine flying or driving in a straight line from -from to
+// -to, posting tracking events for -order with the machine's API key. With
+// -machine it also reports IN_TRANSIT at the start and IDLE on arrival.
+func simulate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "API base URL")
+	apiKey := fs.String("key", os.Getenv("CIRCUIT_MACHINE_KEY"), "machine API key (default $CIRCUIT_MACHINE_KEY)")
+	machineID := fs.String("machine", "", "machine ID; when set, status updates are reported too")
+	orderID := fs.String("order", "", "order the machine is assigned to (required)")
+	from := fs.String("from", "37.7749,-122.4194", "start position as lat,lon")
+	to := fs.String("to", "37.7880,-122.4000", "end position as lat,lon")
+	steps := fs.Int("steps", 20, "number of tracking events")
+	interval := fs.Duration("interval", 2*time.Second, "delay between events")
+	fs.Parse(args)
+
+	if *orderID == "" || *apiKey == "" {
+		return errors.New("-order and -key are required")
+	}
+	if *steps < 1 {
+		return errors.New("-steps must be at least 1")
+	}
+	fromLat, fromLon, err := parseLatLon(*from)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	toLat, toLon, err := parseLatLon(*to)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+
+	c := &machineClient{base: strings.TrimRight(*server, "/"), apiKey: *apiKey, http: &http.Client{Timeout: 10 * time.Second}}
+	if *machineID != "" {
+		if err := c.setStatus(ctx, *machineID, models.StatusInTransit, fromLat, fromLon); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for i := 0; i <= *steps; i++ {
+		f := float64(i) / float64(*steps)
+		lat, lon := fromLat+(toLat-fromLat)*f, fromLon+(toLon-fromLon)*f
+		if err := c.track(ctx, *orderID, lat, lon); err != nil {
+			return err
+		}
+		fmt.Printf("[%d/%d] %.6f,%.6f\n", i, *steps, lat, lon)
+		if i == *steps {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	if *machineID != "" {
+		return c.setStatus(ctx, *machineID, models.StatusIdle, toLat, toLon)
+	}
+	return nil
+}
+
+type machineClient struct {
+	base   string
+	apiKey string
+	http   *http.Client
+}
+
+func (c *machineClient) track(ctx context.Context, orderID string, lat, lon float64) error {
+	return c.send(ctx, http.MethodPost, "/logistics/orders/"+orderID+"/track",
+		models.TrackingEventRequest{Latitude: lat, Longitude: lon})
+}
+
+func (c *machineClient) setStatus(ctx context.Context, machineID string, status models.MachineStatus, lat, lon float64) error {
+	return c.send(ctx, http.MethodPut, "/logistics/fleet/"+machineID+"/status",
+		models.MachineStatusUpdateRequest{Status: status, Latitude: lat, Longitude: lon})
+}
+
+func (c *machineClient) send(ctx context.Context, method, path string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(apimiddleware.MachineKeyHeader, c.apiKey)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func parseLatLon(s string) (float64, float64, error) {
+	latStr, lonStr, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("want lat,lon, got %q", s)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lon, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createAdmin creates an active ADMIN account, or promotes the user that
+// already owns the email (leaving their password untouched).
+func createAdmin(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	dbURL := databaseFlag(fs)
+	email := fs.String("email", "", "email address (required)")
+	nickname := fs.String("nickname", "admin", "nickname for a new account")
+	password := fs.String("password", os.Getenv("CIRCUIT_ADMIN_PASSWORD"), "password for a new account (default $CIRCUIT_ADMIN_PASSWORD, else read from stdin)")
+	fs.Parse(args)
+	if *email == "" {
+		return errors.New("-email is required")
+	}
+
+	pool, err := connect(ctx, *dbURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	var id string
+	err = pool.QueryRow(ctx, `UPDATE users SET role = $2, updated_at = now() WHERE email = $1 RETURNING id`,
+		*email, models.RoleAdmin).Scan(&id)
+	if err == nil {
+		fmt.Printf("Promoted existing user %s (%s) to %s\n", *email, id, models.RoleAdmin)
+		return nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if *password == "" {
+		if *password, err = readLine("Password: "); err != nil {
+			return err
+		}
+	}
+	if len(*password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	err = pool.QueryRow(ctx, `
+		INSERT INTO users (nickname, email, password_hash, auth_provider, role, is_active)
+		VALUES ($1, $2, $3, 'EMAIL', $4, TRUE)
+		RETURNING id`, *nickname, *email, string(hash), models.RoleAdmin).Scan(&id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created %s %s (%s)\n", models.RoleAdmin, *email, id)
+	return nil
+}
+
+// hashPassword replaces misc/hash-password: it prints a bcrypt hash for seed
+// data or manual fixes.
+func hashPassword(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: circuitctl hash-password [password]  (reads stdin when omitted)")
+	}
+	fs.Parse(args)
+
+	password := fs.Arg(0)
+	if password == "" {
+		var err error
+		if password, err = readLine("Password: "); err != nil {
+			return err
+		}
+	}
+	// bcrypt.DefaultCost (10) matches what the user service uses.
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
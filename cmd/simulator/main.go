@@ -0,0 +1,156 @@
+// Command simulator registers a fleet of virtual drones or robots and plays
+// them against a running API server, so orders can be placed, dispatched,
+// tracked and confirmed locally without hardware.
+//
+// Machines are registered directly in the database (DATABASE_URL or
+// -database), scattered around -center, and, unless -keep is set, deleted
+// again on exit. Everything else goes through the API with each machine's
+// key, exactly as firmware would:
+//
+//	simulator -n 5 -type DRONE -center 37.7749,-122.4194 -speedup 10
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"dispatch-and-delivery/internal/database"
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/internal/modules/logistics"
+	"dispatch-and-delivery/internal/simulator"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "API base URL")
+	dbURL := flag.String("database", os.Getenv("DATABASE_URL"), "Postgres connection URL (default $DATABASE_URL)")
+	n := flag.Int("n", 3, "number of machines")
+	machineType := flag.String("type", string(models.MachineTypeDrone), "DRONE, ROBOT or MIXED")
+	center := flag.String("center", "37.7749,-122.4194", "centre of the fleet as lat,lon")
+	radiusKM := flag.Float64("radius-km", 2, "machines start at random points within this distance of -center")
+	speedup := flag.Float64("speedup", 1, "simulated seconds per real second")
+	tick := flag.Duration("tick", 2*time.Second, "interval between tracking events")
+	poll := flag.Duration("poll", 5*time.Second, "how often idle machines ask for assignments")
+	keep := flag.Bool("keep", false, "keep the registered machines on exit")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, *server, *dbURL, *n, *machineType, *center, *radiusKM, *speedup, *tick, *poll, *keep); err != nil {
+		fmt.Fprintf(os.Stderr, "simulator: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, server, dbURL string, n int, machineType, center string, radiusKM, speedup float64, tick, poll time.Duration, keep bool) error {
+	if n < 1 {
+		return errors.New("-n must be at least 1")
+	}
+	types, err := parseTypes(machineType)
+	if err != nil {
+		return err
+	}
+	lat, lon, err := parseLatLon(center)
+	if err != nil {
+		return fmt.Errorf("-center: %w", err)
+	}
+	if dbURL == "" {
+		return errors.New("no database URL: set DATABASE_URL or pass -database")
+	}
+	pool, err := pgxpool.New(ctx, dbURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	// Through the logistics service, so capacity checks and key hashing match the API.
+	svc := logistics.NewService(logistics.NewRepository(pool, nil), "")
+	machines := make([]simulator.Machine, 0, n)
+	defer func() {
+		if keep {
+			return
+		}
+		// The run context is already cancelled when the simulator stops.
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, m := range machines {
+			if err := svc.DeleteMachine(cleanupCtx, m.ID); err != nil {
+				log.Printf("delete machine %s: %v", m.ID, err)
+			}
+		}
+		notifyFleetChanged(cleanupCtx, pool)
+		log.Printf("deleted %d simulated machines", len(machines))
+	}()
+
+	battery := 100
+	for i := range n {
+		pos := randomPoint(lat, lon, radiusKM)
+		mt := types[i%len(types)]
+		reg, err := svc.RegisterMachine(ctx, models.RegisterMachineRequest{Type: mt, Location: &pos, BatteryLevel: &battery})
+		if err != nil {
+			return fmt.Errorf("register machine: %w", err)
+		}
+		machines = append(machines, simulator.Machine{ID: reg.Machine.ID, APIKey: reg.APIKey, Type: mt, Position: pos})
+		log.Printf("registered %s %s at %.5f,%.5f", mt, reg.Machine.ID, pos.Latitude, pos.Longitude)
+	}
+	notifyFleetChanged(ctx, pool)
+
+	log.Printf("simulating %d machines against %s (speedup %gx); Ctrl-C to stop", n, server, speedup)
+	return simulator.Run(ctx, simulator.Config{Server: server, Tick: tick, Speedup: speedup, Poll: poll}, machines)
+}
+
+// notifyFleetChanged tells running API instances to reload their fleet cache,
+// as circuitctl register-machine does.
+func notifyFleetChanged(ctx context.Context, pool *pgxpool.Pool) {
+	if err := database.NewCacheBus(pool).Invalidate(ctx, logistics.FleetCacheName, ""); err != nil {
+		log.Printf("warning: could not notify API instances, the fleet cache refreshes on their next write: %v", err)
+	}
+}
+
+func parseTypes(s string) ([]models.MachineType, error) {
+	if strings.EqualFold(s, "MIXED") {
+		return []models.MachineType{models.MachineTypeDrone, models.MachineTypeRobot}, nil
+	}
+	mt := models.MachineType(strings.ToUpper(s))
+	if !mt.Valid() {
+		return nil, fmt.Errorf("invalid -type %q: want DRONE, ROBOT or MIXED", s)
+	}
+	return []models.MachineType{mt}, nil
+}
+
+// randomPoint returns a point uniformly distributed within radiusKM of (lat, lon).
+func randomPoint(lat, lon, radiusKM float64) models.GeoPoint {
+	d := radiusKM * math.Sqrt(rand.Float64())
+	bearing := rand.Float64() * 2 * math.Pi
+	dLat := d / 111.32 * math.Cos(bearing)
+	dLon := d / (111.32 * math.Cos(lat*math.Pi/180)) * math.Sin(bearing)
+	return models.GeoPoint{Latitude: lat + dLat, Longitude: lon + dLon}
+}
+
+func parseLatLon(s string) (float64, float64, error) {
+	latStr, lonStr, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("want lat,lon, got %q", s)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lon, nil
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// registerDebugRoutes mounts profiling and runtime diagnostics on g, which
+// must already be restricted to administrators:
+//
+//	/debug/pprof/...   net/http/pprof (heap, goroutine, profile, trace, ...)
+//	/debug/vars        expvar (resilience breakers, DB pool stats, memstats)
+//	/debug/runtime     goroutine, heap and GC summary
+//
+// pprof.Index derives profile names from the "/debug/pprof/" path prefix, so
+// g must be mounted at "/debug".
+func registerDebugRoutes(g *echo.Group) {
+	g.GET("/pprof", func(c echo.Context) error {
+		return c.Redirect(http.StatusMovedPermanently, "/debug/pprof/")
+	})
+	g.GET("/pprof/", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	g.GET("/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.POST("/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.GET("/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	g.GET("/pprof/:profile", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+
+	g.GET("/vars", echo.WrapHandler(expvar.Handler()))
+	g.GET("/runtime", runtimeStats)
+}
+
+var startedAt = time.Now()
+
+// runtimeStats returns a cheap summary of the Go runtime. It reads MemStats,
+// which briefly stops the world, so it is only exposed to administrators.
+func runtimeStats(c echo.Context) error {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	var lastGC time.Time
+	if m.LastGC > 0 {
+		lastGC = time.Unix(0, int64(m.LastGC))
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+		"go_version":     runtime.Version(),
+		"num_cpu":        runtime.NumCPU(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"goroutines":     runtime.NumGoroutine(),
+		"heap": map[string]uint64{
+			"alloc_bytes":    m.HeapAlloc,
+			"in_use_bytes":   m.HeapInuse,
+			"idle_bytes":     m.HeapIdle,
+			"released_bytes": m.HeapReleased,
+			"objects":        m.HeapObjects,
+			"sys_bytes":      m.Sys,
+		},
+		"gc": map[string]any{
+			"num_gc":          m.NumGC,
+			"pause_total_ms":  float64(m.PauseTotalNs) / 1e6,
+			"last_pause_ms":   float64(m.PauseNs[(m.NumGC+255)%256]) / 1e6,
+			"last_gc":         lastGC,
+			"next_gc_bytes":   m.NextGC,
+			"gc_cpu_fraction": m.GCCPUFraction,
+		},
+	})
+}
@@ -10,9 +10,33 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+// AccessTokenCookieName is where the access token lives in cookie auth mode.
+const AccessTokenCookieName = "access_token"
+
 // JWTMAuth configures and returns Echo's JWT middleware.
 // It uses the jwtSecretKey from the config file (.env).
-func JWTMAuth(jwtSecretKey string) echo.MiddlewareFunc {
+// In cookie auth mode the token may also come from the access_token cookie.
+func JWTMAuth(jwtSecretKey string, mode AuthMode) echo.MiddlewareFunc {
+	tokenLookup := "header:Authorization:Bearer "
+	if mode == AuthModeCookie {
+		tokenLookup += ",cookie:" + AccessTokenCookieName
+	}
+	return jwtAuth(jwtSecretKey, tokenLookup)
+}
+
+// JWTStreamAuth is JWTMAuth for WebSocket upgrades. Browsers cannot set the
+// Authorization header on a WebSocket handshake, so in bearer mode the token
+// may also be passed as ?access_token=. Use it only on stream routes: tokens
+// in URLs end up in access logs.
+func JWTStreamAuth(jwtSecretKey string, mode AuthMode) echo.MiddlewareFunc {
+	tokenLookup := "header:Authorization:Bearer ,query:" + AccessTokenCookieName
+	if mode == AuthModeCookie {
+		tokenLookup += ",cookie:" + AccessTokenCookieName
+	}
+	return jwtAuth(jwtSecretKey, tokenLookup)
+}
+
+func jwtAuth(jwtSecretKey, tokenLookup string) echo.MiddlewareFunc {
 	config := echojwt.Config{
 		// NewClaimsFunc is required to specify the type of claims object to expect.
 		// The middleware will use this to parse the claims from the token.
@@ -24,6 +48,7 @@ func JWTMAuth(jwtSecretKey string) echo.MiddlewareFunc {
 		// TokenLookup specifies where to look for the token.
 		// Default is "header:Authorization:Bearer <token>". Can customize it if needed.
 		// Example: "query:token,cookie:jwt"
+		TokenLookup: tokenLookup,
 
 		// SuccessHandler is called after a token is successfully validated.
 		// I use it here to extract our custom claims and put them into the context
@@ -35,6 +60,7 @@ func JWTMAuth(jwtSecretKey string) echo.MiddlewareFunc {
 
 			c.Set("userID", claims.UserID)
 			c.Set("userEmail", claims.Email)
+			c.Set("userRole", claims.Role)
 			c.Logger().Infof("JWT Auth successful for user: %s", claims.UserID)
 		},
 
@@ -45,19 +71,19 @@ func JWTMAuth(jwtSecretKey string) echo.MiddlewareFunc {
 
 			// Return a generic error message to the client
 			if errors.Is(err, echojwt.ErrJWTMissing) {
-				return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: "Missing or malformed JWT"})
+				return models.NewAPIError(http.StatusUnauthorized, models.CodeUnauthorized, "Missing or malformed JWT")
 			}
 			// Check for more specific errors from the golang-jwt library if wrapped
 			// For example, if err is of type *jwt.ValidationError
 			if errors.Is(err, jwt.ErrTokenMalformed) {
-				return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: "Token is malformed"})
+				return models.NewAPIError(http.StatusUnauthorized, models.CodeInvalidToken, "Token is malformed")
 			} else if errors.Is(err, jwt.ErrTokenExpired) {
-				return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: "Token has expired"})
+				return models.NewAPIError(http.StatusUnauthorized, models.CodeTokenExpired, "Token has expired")
 			} else if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
-				return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: "Invalid token signature"})
+				return models.NewAPIError(http.StatusUnauthorized, models.CodeInvalidToken, "Invalid token signature")
 			}
 
-			return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: "Invalid or expired JWT"})
+			return models.NewAPIError(http.StatusUnauthorized, models.CodeUnauthorized, "Invalid or expired JWT")
 		},
 		// ContextKey: "user", this is default
 	}
@@ -66,18 +92,14 @@ func JWTMAuth(jwtSecretKey string) echo.MiddlewareFunc {
 
 // AdminRequired checks if the authenticated user has the "ADMIN" role.
 // Run after JWTMAuth, because it depends on the claims fetched from the context.
+// Tokens without a role (issued before roles existed) are treated as customers.
 func AdminRequired() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			// The JWTMAuth middleware's SuccessHandler should have placed it here.
-			role, ok := c.Get("userRole").(string)
-			if !ok {
-				c.Logger().Error("Could not retrieve user role from context.")
-				return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Could not process user role"})
-			}
-
-			if role != "ADMIN" {
-				return c.JSON(http.StatusForbidden, models.ErrorResponse{Message: "Forbidden: Access is restricted to administrators"})
+			role, _ := c.Get("userRole").(string)
+			if role != models.RoleAdmin {
+				return models.NewAPIError(http.StatusForbidden, models.CodeForbidden, "Forbidden: Access is restricted to administrators")
 			}
 
 			return next(c)
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// BodyPolicy limits what a route accepts as a request body.
+type BodyPolicy struct {
+	MaxBytes     int64    // Requests with larger bodies are rejected with 413.
+	ContentTypes []string // Accepted media types; empty means any.
+}
+
+// DefaultBodyPolicy covers ordinary JSON endpoints.
+var DefaultBodyPolicy = BodyPolicy{
+	MaxBytes:     64 << 10,
+	ContentTypes: []string{echo.MIMEApplicationJSON},
+}
+
+// BodyPolicies enforces a per-route body size limit and Content-Type check on
+// requests that carry a body. routes is keyed by route template (c.Path(),
+// e.g. "/logistics/orders/:orderId/track"); unlisted routes use def.
+func BodyPolicies(def BodyPolicy, routes map[string]BodyPolicy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+				return next(c)
+			}
+
+			policy, ok := routes[c.Path()]
+			if !ok {
+				policy = def
+			}
+
+			if len(policy.ContentTypes) > 0 && !acceptsMediaType(req.Header.Get(echo.HeaderContentType), policy.ContentTypes) {
+				return models.NewAPIError(http.StatusUnsupportedMediaType, models.CodeUnsupportedMediaType,
+					fmt.Sprintf("Content-Type must be one of: %s", strings.Join(policy.ContentTypes, ", ")))
+			}
+
+			if policy.MaxBytes > 0 {
+				if req.ContentLength > policy.MaxBytes {
+					return payloadTooLarge(policy.MaxBytes)
+				}
+				// Also guards chunked bodies that do not declare a length.
+				req.Body = http.MaxBytesReader(c.Response(), req.Body, policy.MaxBytes)
+			}
+			return next(c)
+		}
+	}
+}
+
+func acceptsMediaType(header string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(mediaType, a) {
+			return true
+		}
+	}
+	return false
+}
+
+func payloadTooLarge(limit int64) *models.APIError {
+	return models.NewAPIError(http.StatusRequestEntityTooLarge, models.CodePayloadTooLarge,
+		fmt.Sprintf("request body exceeds the %d byte limit", limit))
+}
+
+const strictJSONKey = "strictJSON"
+
+// StrictJSON marks a route so that Binder rejects JSON bodies containing
+// fields the request struct does not declare. Use it on critical endpoints
+// (payments, order creation, machine telemetry) to catch client schema drift.
+func StrictJSON() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(strictJSONKey, true)
+			return next(c)
+		}
+	}
+}
+
+// Binder wraps Echo's DefaultBinder. It honors StrictJSON and turns body
+// limit violations into 413 responses instead of generic bind errors.
+type Binder struct {
+	echo.DefaultBinder
+}
+
+// NewBinder creates the application's request binder.
+func NewBinder() *Binder {
+	return &Binder{}
+}
+
+// Bind binds path params, query params (GET/DELETE) and the body into i.
+func (b *Binder) Bind(i interface{}, c echo.Context) error {
+	strict, _ := c.Get(strictJSONKey).(bool)
+	req := c.Request()
+	if !strict || req.ContentLength == 0 || !acceptsMediaType(req.Header.Get(echo.HeaderContentType), []string{echo.MIMEApplicationJSON}) {
+		return b.mapBodyErr(b.DefaultBinder.Bind(i, c))
+	}
+
+	if err := b.BindPathParams(c, i); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(i); err != nil {
+		if field, ok := unknownField(err); ok {
+			return models.ValidationFailed(models.FieldError{
+				Field:   field,
+				Rule:    "unknown",
+				Message: fmt.Sprintf("%s is not a recognized field", field),
+			})
+		}
+		return b.mapBodyErr(models.NewBindError(err))
+	}
+	return nil
+}
+
+// mapBodyErr surfaces http.MaxBytesReader failures as 413.
+func (b *Binder) mapBodyErr(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return payloadTooLarge(maxErr.Limit)
+	}
+	return err
+}
+
+// unknownField extracts the field name from encoding/json's
+// `json: unknown field "x"` error.
+func unknownField(err error) (string, bool) {
+	const prefix = "json: unknown field "
+	msg := err.Error()
+	if !strings.HasPrefix(msg, prefix) {
+		return "", false
+	}
+	return strings.Trim(strings.TrimPrefix(msg, prefix), `"`), true
+}
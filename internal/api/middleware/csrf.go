@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// AuthMode selects how clients send their access token.
+type AuthMode string
+
+const (
+	// AuthModeBearer: the token travels in the Authorization header. Browsers
+	// never attach it automatically, so CSRF protection is not needed.
+	AuthModeBearer AuthMode = "bearer"
+	// AuthModeCookie: the token is an httpOnly cookie, which the browser sends
+	// on cross-site requests too, so state-changing requests need a CSRF token.
+	AuthModeCookie AuthMode = "cookie"
+)
+
+const (
+	// CSRFCookieName is the cookie the frontend reads the CSRF token from.
+	CSRFCookieName = "_csrf"
+	// HeaderXCSRFToken is the header the frontend echoes the token back in.
+	HeaderXCSRFToken = "X-CSRF-Token"
+	// HeaderXAPIKey authenticates non-browser clients (machines, integrations).
+	HeaderXAPIKey = "X-API-Key"
+)
+
+// csrfExemptPaths are routes called server-to-server (e.g. payment provider
+// webhooks) that authenticate with signatures rather than cookies. They are
+// matched exactly, so routes added beside them stay protected.
+var csrfExemptPaths = []string{"/webhooks/stripe"}
+
+// CSRF returns double-submit-token CSRF protection for cookie auth mode: a random
+// token is set in a JS-readable cookie and must be echoed in the X-CSRF-Token
+// header on unsafe methods. In bearer mode it is a no-op.
+func CSRF(mode AuthMode, secureCookie bool) echo.MiddlewareFunc {
+	if mode != AuthModeCookie {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper:        csrfSkipper,
+		TokenLookup:    "header:" + HeaderXCSRFToken,
+		CookieName:     CSRFCookieName,
+		CookiePath:     "/",
+		CookieSecure:   secureCookie,
+		CookieHTTPOnly: false, // The frontend must read it to echo it back.
+		CookieSameSite: http.SameSiteLaxMode,
+		ErrorHandler: func(err error, c echo.Context) error {
+			return models.NewAPIError(http.StatusForbidden, models.CodeInvalidCSRFToken, "Missing or invalid CSRF token")
+		},
+	})
+}
+
+// csrfSkipper exempts requests that cannot be forged by a browser: API-key
+// clients, machines, explicit bearer tokens and signed webhooks.
+func csrfSkipper(c echo.Context) bool {
+	req := c.Request()
+	if req.Header.Get(HeaderXAPIKey) != "" || req.Header.Get(MachineKeyHeader) != "" {
+		return true
+	}
+	if strings.HasPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer ") {
+		return true
+	}
+	return slices.Contains(csrfExemptPaths, req.URL.Path)
+}
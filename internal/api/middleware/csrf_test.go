@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCSRFCookieMode(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.Use(CSRF(AuthModeCookie, false))
+	e.Any("/*", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		value  string
+		status int
+	}{
+		{"cookie session without token", http.MethodPost, "/orders", "", "", http.StatusForbidden},
+		{"machine key", http.MethodPost, "/logistics/fleet/m1/heartbeat", MachineKeyHeader, "mk_test", http.StatusNoContent},
+		{"API key", http.MethodPost, "/orders", HeaderXAPIKey, "key", http.StatusNoContent},
+		{"bearer token", http.MethodPost, "/orders", echo.HeaderAuthorization, "Bearer abc", http.StatusNoContent},
+		{"signed webhook", http.MethodPost, "/webhooks/stripe", "", "", http.StatusNoContent},
+		// Customers manage their own webhooks with their session cookie.
+		{"webhook registration", http.MethodPost, "/profile/webhooks", "", "", http.StatusForbidden},
+		{"webhook deletion", http.MethodDelete, "/profile/webhooks/wh1", "", "", http.StatusForbidden},
+		{"path beside the signed webhook", http.MethodDelete, "/webhooks/wh1", "", "", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d; want %d", tc.name, rec.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"dispatch-and-delivery/internal/i18n"
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// HTTPErrorHandler is registered as Echo's HTTPErrorHandler. Every error returned
+// by a handler or middleware ends up here and is rendered as a models.ErrorResponse
+// with a stable error code, so handlers never have to hand-craft error JSON.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	apiErr := classifyError(err)
+
+	// Only server-side failures are logged with their full cause chain;
+	// client errors are expected and would only add noise.
+	if apiErr.Status >= http.StatusInternalServerError {
+		c.Logger().Errorf("%s %s: %v", c.Request().Method, c.Path(), err)
+	}
+
+	// Codes stay stable; the message follows the caller's Accept-Language,
+	// so caches must key error responses on it too.
+	locale := i18n.Negotiate(c.Request().Header.Get("Accept-Language"))
+	apiErr = i18n.Localize(apiErr, locale)
+	c.Response().Header().Set("Content-Language", locale.String())
+	c.Response().Header().Add(echo.HeaderVary, "Accept-Language")
+
+	var writeErr error
+	if c.Request().Method == http.MethodHead {
+		writeErr = c.NoContent(apiErr.Status)
+	} else {
+		writeErr = c.JSON(apiErr.Status, apiErr.Response())
+	}
+	if writeErr != nil {
+		c.Logger().Errorf("failed to write error response: %v", writeErr)
+	}
+}
+
+// classifyError maps framework errors (*echo.HTTPError) onto the same taxonomy
+// as domain errors and delegates everything else to models.ToAPIError.
+func classifyError(err error) *models.APIError {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		message := http.StatusText(he.Code)
+		if m, ok := he.Message.(string); ok && m != "" {
+			message = m
+		}
+		return &models.APIError{
+			Status:  he.Code,
+			Code:    codeForStatus(he.Code),
+			Message: message,
+			Err:     fmt.Errorf("%w: %v", err, he.Internal),
+		}
+	}
+	return models.ToAPIError(err)
+}
+
+// codeForStatus picks a generic error code for errors that only carry a status.
+func codeForStatus(status int) models.ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return models.CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return models.CodeUnauthorized
+	case http.StatusForbidden:
+		return models.CodeForbidden
+	case http.StatusNotFound:
+		return models.CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return models.CodeMethodNotAllowed
+	case http.StatusConflict:
+		return models.CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return models.CodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return models.CodeUnsupportedMediaType
+	case http.StatusTooManyRequests:
+		return models.CodeTooManyRequests
+	case http.StatusServiceUnavailable:
+		return models.CodeUnavailable
+	case http.StatusGatewayTimeout:
+		return models.CodeTimeout
+	}
+	if status >= http.StatusInternalServerError {
+		return models.CodeInternal
+	}
+	return models.CodeInvalidRequest
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+)
+
+func runErrorHandler(t *testing.T, err error) (int, models.ErrorResponse) {
+	t.Helper()
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	HTTPErrorHandler(err, c)
+
+	var body models.ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	return rec.Code, body
+}
+
+func TestHTTPErrorHandlerMapsWrappedSentinels(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   models.ErrorCode
+	}{
+		{fmt.Errorf("service.GetOrderDetails: %w", models.ErrNotFound), http.StatusNotFound, models.CodeNotFound},
+		{fmt.Errorf("Handler.CancelOrder: %w", models.ErrOrderCannotBeCancelled), http.StatusConflict, models.CodeOrderCannotBeCancelled},
+		{fmt.Errorf("Handler.CancelOrder: %w", models.ErrForbidden), http.StatusForbidden, models.CodeForbidden},
+		{models.ErrPackageTooLarge, http.StatusBadRequest, models.CodePackageTooLarge},
+		{echo.ErrMethodNotAllowed, http.StatusMethodNotAllowed, models.CodeMethodNotAllowed},
+	}
+	for _, tt := range cases {
+		status, body := runErrorHandler(t, tt.err)
+		if status != tt.status || body.Code != tt.code {
+			t.Errorf("%v: got (%d, %s); want (%d, %s)", tt.err, status, body.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestHTTPErrorHandlerHidesInternalErrors(t *testing.T) {
+	status, body := runErrorHandler(t, errors.New("pq: connection refused to 10.0.0.3"))
+	if status != http.StatusInternalServerError || body.Code != models.CodeInternal {
+		t.Fatalf("got (%d, %s); want (500, %s)", status, body.Code, models.CodeInternal)
+	}
+	if body.Message != "internal server error" {
+		t.Errorf("internal error message leaked: %q", body.Message)
+	}
+}
+
+func TestHTTPErrorHandlerValidationFields(t *testing.T) {
+	err := utils.NewValidator().Struct(models.FeedbackRequest{Rating: 9})
+
+	status, body := runErrorHandler(t, models.NewValidationError(err))
+	if status != http.StatusBadRequest || body.Code != models.CodeValidationFailed {
+		t.Fatalf("got (%d, %s); want (400, %s)", status, body.Code, models.CodeValidationFailed)
+	}
+	if len(body.Fields) != 1 || body.Fields[0].Field != "rating" || body.Fields[0].Rule != "max" {
+		t.Errorf("fields = %+v; want a single max violation on rating", body.Fields)
+	}
+}
+
+func TestHTTPErrorHandlerLocalizes(t *testing.T) {
+	validation := models.NewValidationError(utils.NewValidator().Struct(models.FeedbackRequest{Rating: 9}))
+	cases := []struct {
+		acceptLanguage string
+		err            error
+		locale         string
+		message        string
+		field          string
+	}{
+		{"zh-CN,zh;q=0.9", models.ErrNotFound, "zh-Hans", "资源不存在", ""},
+		{"zh-CN,zh;q=0.9", validation, "zh-Hans", "请求参数校验失败", "rating 不能大于 5"},
+		{"es-ES", echo.ErrMethodNotAllowed, "es", "Método no permitido", ""},
+		{"es", validation, "es", "La validación de la solicitud falló", "rating debe ser como máximo 5"},
+		{"fr-FR", validation, "en", "validation failed", "rating must be at most 5"},
+		{";;q=bogus", models.ErrNotFound, "en", models.ErrNotFound.Error(), ""},
+		{"", models.ErrNotFound, "en", models.ErrNotFound.Error(), ""},
+	}
+	for _, tt := range cases {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.acceptLanguage != "" {
+			req.Header.Set("Accept-Language", tt.acceptLanguage)
+		}
+		rec := httptest.NewRecorder()
+		HTTPErrorHandler(tt.err, e.NewContext(req, rec))
+
+		var body models.ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%q: decode body: %v", tt.acceptLanguage, err)
+		}
+		if got := rec.Header().Get("Content-Language"); got != tt.locale {
+			t.Errorf("%q: Content-Language = %q; want %q", tt.acceptLanguage, got, tt.locale)
+		}
+		if got := rec.Header().Get(echo.HeaderVary); got != "Accept-Language" {
+			t.Errorf("%q: Vary = %q; want Accept-Language", tt.acceptLanguage, got)
+		}
+		if body.Message != tt.message {
+			t.Errorf("%q: message = %q; want %q", tt.acceptLanguage, body.Message, tt.message)
+		}
+		if tt.field != "" && (len(body.Fields) != 1 || body.Fields[0].Message != tt.field) {
+			t.Errorf("%q: fields = %+v; want the message %q", tt.acceptLanguage, body.Fields, tt.field)
+		}
+	}
+}
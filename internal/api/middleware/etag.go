@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// HeavyRead bundles gzip compression and ETag revalidation for large,
+// frequently polled GET endpoints (tracking histories, fleet snapshots).
+// ETag wraps the handler directly so the tag is computed on the uncompressed body.
+func HeavyRead() []echo.MiddlewareFunc {
+	return []echo.MiddlewareFunc{
+		middleware.GzipWithConfig(middleware.GzipConfig{MinLength: 1024}),
+		ETag(),
+	}
+}
+
+// ETag buffers successful GET responses, tags them with a hash of the body and
+// answers 304 Not Modified when the client's If-None-Match already matches.
+func ETag() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				return next(c)
+			}
+
+			res := c.Response()
+			original := res.Writer
+			buf := &etagBuffer{ResponseWriter: original}
+			res.Writer = buf
+			err := next(c)
+			res.Writer = original
+			if err != nil {
+				return err
+			}
+
+			// Only complete 200 responses are cacheable; pass everything else through.
+			if buf.status != http.StatusOK {
+				if buf.status != 0 {
+					original.WriteHeader(buf.status)
+				}
+				_, werr := original.Write(buf.body.Bytes())
+				return werr
+			}
+
+			sum := sha256.Sum256(buf.body.Bytes())
+			etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+			original.Header().Set("ETag", etag)
+			original.Header().Set(echo.HeaderVary, echo.HeaderAcceptEncoding)
+			// Clients must revalidate, but may reuse the body while it matches.
+			original.Header().Set("Cache-Control", "private, no-cache")
+
+			if etagMatches(req.Header.Get("If-None-Match"), etag) {
+				original.Header().Del(echo.HeaderContentLength)
+				original.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+			original.WriteHeader(http.StatusOK)
+			if req.Method == http.MethodHead {
+				return nil
+			}
+			_, werr := original.Write(buf.body.Bytes())
+			return werr
+		}
+	}
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagBuffer holds the status and body until the ETag is known.
+type etagBuffer struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *etagBuffer) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *etagBuffer) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// Flush is a no-op: the body is only sent once it is complete.
+func (w *etagBuffer) Flush() {}
+
+func (w *etagBuffer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
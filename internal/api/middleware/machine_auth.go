@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MachineKeyHeader carries a machine's API key on telemetry requests.
+const MachineKeyHeader = "X-Machine-Key"
+
+// MachineAuthenticator resolves an API key to the ID of the machine it belongs
+// to, returning models.ErrInvalidCredentials for unknown keys.
+type MachineAuthenticator func(ctx context.Context, apiKey string) (machineID string, err error)
+
+// MachineAuth authenticates delivery machines by API key instead of a user JWT,
+// so customers cannot post telemetry. On success the machine ID is stored in
+// the context as "machineID".
+func MachineAuth(authenticate MachineAuthenticator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			apiKey := c.Request().Header.Get(MachineKeyHeader)
+			if apiKey == "" {
+				return models.NewAPIError(http.StatusUnauthorized, models.CodeUnauthorized, "Missing machine API key")
+			}
+
+			machineID, err := authenticate(c.Request().Context(), apiKey)
+			if errors.Is(err, models.ErrInvalidCredentials) {
+				return models.NewAPIError(http.StatusUnauthorized, models.CodeInvalidCredentials, "Invalid machine API key")
+			}
+			if err != nil {
+				return err
+			}
+
+			c.Set("machineID", machineID)
+			return next(c)
+		}
+	}
+}
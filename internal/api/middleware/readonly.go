@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ReadOnly rejects every state-changing request with 503. It is installed
+// when the server starts in degraded mode (e.g. on a schema version mismatch),
+// so reads keep working while writes cannot corrupt data.
+func ReadOnly() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+			return models.NewAPIError(http.StatusServiceUnavailable, models.CodeUnavailable,
+				"The service is temporarily read-only; please retry later")
+		}
+	}
+}
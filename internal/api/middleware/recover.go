@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"dispatch-and-delivery/pkg/errreport"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Recover replaces Echo's built-in Recover middleware. Panics are turned into
+// 500 responses (rendered by HTTPErrorHandler), and both panics and any other
+// 5xx error are sent to the error reporter together with the request context.
+// Register it right after RequestID so reports carry the request ID.
+func Recover(reporter errreport.Reporter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				// Let net/http handle deliberate connection aborts.
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
+				panicErr, ok := r.(error)
+				if !ok {
+					panicErr = fmt.Errorf("%v", r)
+				}
+				err = fmt.Errorf("panic recovered: %w", panicErr)
+				reporter.Report(c.Request().Context(),
+					newReportEvent(c, err, http.StatusInternalServerError, true, debug.Stack()))
+			}()
+
+			err = next(c)
+			if err != nil {
+				if apiErr := classifyError(err); apiErr.Status >= http.StatusInternalServerError {
+					reporter.Report(c.Request().Context(), newReportEvent(c, err, apiErr.Status, false, nil))
+				}
+			}
+			return err
+		}
+	}
+}
+
+// newReportEvent collects request context for a report. User and order IDs are
+// pseudonymized; the raw URL and query string are never included because they
+// can carry tokens (e.g. activation links).
+func newReportEvent(c echo.Context, err error, status int, panicked bool, stack []byte) errreport.Event {
+	tags := map[string]string{}
+	if userID, ok := c.Get("userID").(string); ok && userID != "" {
+		tags["user_id"] = errreport.PseudonymizeID(userID)
+	}
+	if orderID := c.Param("orderId"); orderID != "" {
+		tags["order_id"] = errreport.PseudonymizeID(orderID)
+	}
+	if machineID := c.Param("machineId"); machineID != "" {
+		tags["machine_id"] = machineID
+	}
+
+	requestID := c.Response().Header().Get(echo.HeaderXRequestID)
+	if requestID == "" {
+		requestID = c.Request().Header.Get(echo.HeaderXRequestID)
+	}
+
+	return errreport.Event{
+		Err:       err,
+		Panic:     panicked,
+		Stack:     stack,
+		Method:    c.Request().Method,
+		Route:     c.Path(),
+		Status:    status,
+		RequestID: requestID,
+		Tags:      tags,
+	}
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/errreport"
+
+	"github.com/labstack/echo/v4"
+)
+
+// recordingReporter keeps the events reported to it.
+type recordingReporter struct{ events []errreport.Event }
+
+func (r *recordingReporter) Report(ctx context.Context, ev errreport.Event) {
+	r.events = append(r.events, ev)
+}
+
+func (r *recordingReporter) Flush(timeout time.Duration) {}
+
+func TestRecover(t *testing.T) {
+	reporter := &recordingReporter{}
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.Use(Recover(reporter))
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("userID", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11")
+			return next(c)
+		}
+	})
+	e.GET("/orders/:orderId", func(c echo.Context) error {
+		switch c.QueryParam("fail") {
+		case "panic":
+			panic("nil map write")
+		case "internal":
+			return fmt.Errorf("service.GetOrderDetails: %w", errors.New("connection refused"))
+		case "not-found":
+			return fmt.Errorf("service.GetOrderDetails: %w", models.ErrNotFound)
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+	e.GET("/abort", func(c echo.Context) error { panic(http.ErrAbortHandler) })
+	get := func(target string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(echo.HeaderXRequestID, "req-1")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A panic becomes a 500 and is reported with its stack.
+	if code := get("/orders/o-secret?fail=panic&token=abc"); code != http.StatusInternalServerError {
+		t.Fatalf("panicking handler answered %d; want 500", code)
+	}
+	if len(reporter.events) != 1 {
+		t.Fatalf("reported %d events; want 1", len(reporter.events))
+	}
+	ev := reporter.events[0]
+	if !ev.Panic || len(ev.Stack) == 0 || !strings.Contains(ev.Err.Error(), "nil map write") {
+		t.Errorf("panic event = %+v; want the panic with a stack", ev)
+	}
+	if ev.Method != http.MethodGet || ev.Route != "/orders/:orderId" || ev.Status != http.StatusInternalServerError || ev.RequestID != "req-1" {
+		t.Errorf("event request = %s %s %d %s; want GET /orders/:orderId 500 req-1", ev.Method, ev.Route, ev.Status, ev.RequestID)
+	}
+	// IDs are pseudonymized; the raw URL and its query are left out.
+	want := map[string]string{
+		"user_id":  errreport.PseudonymizeID("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"),
+		"order_id": errreport.PseudonymizeID("o-secret"),
+	}
+	if fmt.Sprint(ev.Tags) != fmt.Sprint(want) {
+		t.Errorf("tags = %v; want %v", ev.Tags, want)
+	}
+
+	// Server errors are reported too, client errors are not.
+	reporter.events = nil
+	if code := get("/orders/o1?fail=internal"); code != http.StatusInternalServerError {
+		t.Errorf("failing handler answered %d; want 500", code)
+	}
+	if code := get("/orders/o1?fail=not-found"); code != http.StatusNotFound {
+		t.Errorf("handler returning ErrNotFound answered %d; want 404", code)
+	}
+	if code := get("/orders/o1"); code != http.StatusNoContent {
+		t.Errorf("handler answered %d; want 204", code)
+	}
+	if len(reporter.events) != 1 || reporter.events[0].Panic || reporter.events[0].Status != http.StatusInternalServerError {
+		t.Errorf("events = %+v; want only the 500, not as a panic", reporter.events)
+	}
+
+	// A deliberate abort is left to net/http.
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("recovered %v; want http.ErrAbortHandler passed on", r)
+		}
+	}()
+	get("/abort")
+	t.Error("the abort did not panic")
+}
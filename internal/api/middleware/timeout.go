@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultRequestTimeout bounds ordinary API calls.
+const DefaultRequestTimeout = 10 * time.Second
+
+// Timeouts attaches a deadline to each request's context. Services pass that
+// context to pgx and outbound HTTP calls, so a slow dependency is abandoned
+// instead of pinning a connection. routes is keyed by route template
+// (c.Path()); unlisted routes use def. Like BodyPolicies, one middleware
+// resolves the limit so a route can be given more time than the default.
+func Timeouts(def time.Duration, routes map[string]time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			timeout, ok := routes[c.Path()]
+			if !ok {
+				timeout = def
+			}
+			if timeout <= 0 {
+				return next(c)
+			}
+
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			err := next(c)
+			if err != nil && errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+				return models.NewAPIError(http.StatusGatewayTimeout, models.CodeTimeout,
+					"the request took too long to complete").WithCause(err)
+			}
+			return err
+		}
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"net/http"
+	"time"
 
 	"dispatch-and-delivery/internal/api/middleware"
 	"dispatch-and-delivery/internal/modules/logistics"
@@ -15,14 +16,42 @@ import (
 func SetupRoutes(
 	e *echo.Echo,
 	jwtSecretKey string,
+	authMode middleware.AuthMode,
 	userHandler *user.Handler,
 	orderHandler *order.Handler,
 	logisticsHandler *logistics.Handler,
 ) {
 	// Initialize the JWT authentication middleware
-	authMiddleware := middleware.JWTMAuth(jwtSecretKey)
+	authMiddleware := middleware.JWTMAuth(jwtSecretKey, authMode)
+	// WebSocket handshakes may carry the token as ?access_token= instead.
+	streamAuth := middleware.JWTStreamAuth(jwtSecretKey, authMode)
 	// Initialize an Admin role authorization middleware
-	// adminRequired := middleware.AdminRequired()
+	adminRequired := middleware.AdminRequired()
+
+	// Body size and Content-Type limits; tracking reports may carry batches of points.
+	e.Use(middleware.BodyPolicies(middleware.DefaultBodyPolicy, map[string]middleware.BodyPolicy{
+		"/logistics/orders/:orderId/track":       {MaxBytes: 1 << 20, ContentTypes: []string{echo.MIMEApplicationJSON}},
+		"/logistics/orders/:orderId/track/batch": {MaxBytes: 1 << 20, ContentTypes: []string{echo.MIMEApplicationJSON}},
+		// Claim photos are up to 10 MB, plus the multipart envelope.
+		"/orders/:orderId/claim/photos": {MaxBytes: 11 << 20, ContentTypes: []string{echo.MIMEMultipartForm}},
+	}))
+	// Request deadlines: quotes must answer fast; everything else gets the default.
+	e.Use(middleware.Timeouts(middleware.DefaultRequestTimeout, map[string]time.Duration{
+		"/orders/quote":                    5 * time.Second,
+		"/logistics/orders/quote":          5 * time.Second,
+		"/logistics/orders/:orderId/route": 5 * time.Second,
+		// CPU profiles and traces run for ?seconds=N (keep N below HTTP_WRITE_TIMEOUT).
+		"/debug/pprof/profile": 60 * time.Second,
+		"/debug/pprof/trace":   60 * time.Second,
+		// Live tracking streams stay open for the whole delivery.
+		"/logistics/orders/:orderId/track/ws": 0,
+		// Order exports stream until the last row is written.
+		"/admin/orders/export": 0,
+	}))
+	// Critical endpoints reject unknown JSON fields to surface client schema drift.
+	strictJSON := middleware.StrictJSON()
+	// Large, frequently polled responses are compressed and revalidated with ETags.
+	heavyRead := middleware.HeavyRead()
 
 	// --- Public Routes ---
 	e.GET("/", func(c echo.Context) error {
@@ -31,7 +60,7 @@ func SetupRoutes(
 
 	authGroup := e.Group("/auth")
 	{
-		authGroup.POST("/signup", userHandler.Signup)
+		authGroup.POST("/signup", userHandler.Signup, strictJSON)
 		authGroup.POST("/login", userHandler.Login)
 		authGroup.POST("/activate", userHandler.ActivateAccount)
 		authGroup.POST("/resend-activation", userHandler.ResendActivation)
@@ -52,30 +81,137 @@ func SetupRoutes(
 		profileGroup.POST("/addresses", userHandler.AddAddress)
 		profileGroup.PUT("/addresses/:addressId", userHandler.UpdateAddress)
 		profileGroup.DELETE("/addresses/:addressId", userHandler.DeleteAddress)
+		// Cards saved with the payment provider, to pay by reference.
+		profileGroup.GET("/payment-methods", userHandler.ListPaymentMethods)
+		profileGroup.POST("/payment-methods", userHandler.AddPaymentMethod, strictJSON)
+		profileGroup.DELETE("/payment-methods/:paymentMethodId", userHandler.DeletePaymentMethod)
 	}
 
-	// --- Order Routes ---
+	// --- Order Routes (customers; staff see any order by ID) ---
 	orderGroup := e.Group("/orders", authMiddleware)
 	{
 		orderGroup.POST("/quote", orderHandler.GetDeliveryQuote) // Get route options and prices
-		orderGroup.POST("", orderHandler.CreateOrder)
+		orderGroup.POST("", orderHandler.CreateOrder, strictJSON)
 		orderGroup.GET("", orderHandler.ListMyOrders)
-		orderGroup.GET("", orderHandler.ListAllOrders)
+		orderGroup.GET("/messages/unread", orderHandler.UnreadMessages) // Unread message counts per order
 		orderGroup.GET("/:orderId", orderHandler.GetOrderDetails)
+		orderGroup.GET("/:orderId/history", orderHandler.GetOrderHistory) // Status changes with actor and reason
+		orderGroup.GET("/:orderId/payments", orderHandler.ListPayments)   // Charges and refunds, failed attempts included
+		orderGroup.GET("/:orderId/receipt", orderHandler.GetReceipt)      // PDF receipt once paid
+		orderGroup.GET("/:orderId/cancellation", orderHandler.CancellationQuote)
 		orderGroup.PUT("/:orderId/cancel", orderHandler.CancelOrder)
-		orderGroup.POST("/:orderId/pay", orderHandler.ConfirmAndPay)
+		orderGroup.POST("/:orderId/confirm-delivery", orderHandler.ConfirmDelivery, strictJSON) // Recipient confirms an ARRIVED order with its PIN
+		orderGroup.POST("/:orderId/pay", orderHandler.ConfirmAndPay, strictJSON)
+		orderGroup.POST("/:orderId/retry-payment", orderHandler.RetryPayment, strictJSON) // After PAYMENT_FAILED, e.g. with another card
+		orderGroup.POST("/:orderId/tip", orderHandler.AddTip, strictJSON)                 // Tip a delivered order, unless tipped when paying
+		orderGroup.POST("/:orderId/confirm-payment", orderHandler.ConfirmPayment)         // After authenticating a payment_action, e.g. 3-D Secure
 		orderGroup.POST("/:orderId/feedback", orderHandler.SubmitFeedback)
+		orderGroup.POST("/:orderId/return/quote", orderHandler.GetReturnQuote) // Options back from the dropoff; free within 7 days
+		orderGroup.POST("/:orderId/return", orderHandler.CreateReturn, strictJSON)
+		orderGroup.POST("/:orderId/reorder", orderHandler.Reorder) // Same addresses and package, freshly quoted
+		// Customer and staff notes on an order.
+		orderGroup.GET("/:orderId/messages", orderHandler.ListOrderMessages)
+		orderGroup.POST("/:orderId/messages", orderHandler.PostOrderMessage, strictJSON)
+		// Claims for lost or damaged packages.
+		orderGroup.POST("/:orderId/claim", orderHandler.FileClaim, strictJSON)
+		orderGroup.GET("/:orderId/claim", orderHandler.GetClaim)
+		orderGroup.POST("/:orderId/claim/photos", orderHandler.AddClaimPhoto)
+		orderGroup.GET("/wallet", orderHandler.GetWallet)
 	}
 
+	// --- Admin Order Routes ---
+	adminOrderGroup := e.Group("/admin/orders", authMiddleware, adminRequired)
+	{
+		adminOrderGroup.GET("", orderHandler.ListAllOrders)
+		adminOrderGroup.GET("/export", orderHandler.ExportOrders)              // CSV of orders created in ?from=&to=
+		adminOrderGroup.GET("/feedback", orderHandler.ListFeedback)            // All feedback, ?machine_id=&rating=
+		adminOrderGroup.GET("/feedback/machines", orderHandler.MachineRatings) // Average rating per machine
+		// Cancel with a reason; the machine is released and paid orders are refunded.
+		adminOrderGroup.POST("/:orderId/cancel", orderHandler.AdminCancelOrder, strictJSON)
+		adminOrderGroup.DELETE("/:orderId/messages/:messageId", orderHandler.HideOrderMessage) // Hide an abusive message
+		// Claims are paid out as refunds or wallet credit.
+		adminOrderGroup.GET("/claims", orderHandler.ListClaims)
+		adminOrderGroup.POST("/claims/:claimId/decision", orderHandler.DecideClaim, strictJSON)
+	}
+
+	// --- Admin Users: customers' records for support ---
+	adminUserGroup := e.Group("/admin/users", authMiddleware, adminRequired)
+	{
+		adminUserGroup.GET("/:userId/addresses", userHandler.AdminListAddresses) // ?include_deleted=true adds deleted ones
+	}
+
+	// --- Admin Promo Codes: discounts customers redeem when paying ---
+	adminPromoGroup := e.Group("/admin/promo-codes", authMiddleware, adminRequired)
+	{
+		adminPromoGroup.POST("", orderHandler.CreatePromoCode, strictJSON)
+		adminPromoGroup.GET("", orderHandler.ListPromoCodes)                   // Newest first, ?page=&limit=
+		adminPromoGroup.DELETE("/:promoCodeId", orderHandler.DisablePromoCode) // No further redemptions
+	}
+
+	// --- Webhooks: customers' URLs for order status changes ---
+	webhookGroup := e.Group("/profile/webhooks", authMiddleware)
+	{
+		webhookGroup.POST("", orderHandler.CreateWebhook, strictJSON)
+		webhookGroup.GET("", orderHandler.ListWebhooks)
+		webhookGroup.DELETE("/:webhookId", orderHandler.DeleteWebhook)
+		webhookGroup.GET("/:webhookId/deliveries", orderHandler.ListWebhookDeliveries) // Delivery log, newest first
+		webhookGroup.GET("/:webhookId/deliveries/:deliveryId", orderHandler.GetWebhookDelivery)
+	}
+
+	// --- Diagnostics (pprof, expvar, runtime stats); administrators only ---
+	debugGroup := e.Group("/debug", authMiddleware, adminRequired)
+	registerDebugRoutes(debugGroup)
+
 	// --- Logistics & Tracking Routes ---
 	logisticsGroup := e.Group("/logistics", authMiddleware)
 	{
-		logisticsGroup.GET("/fleet", logisticsHandler.GetFleet)
-		logisticsGroup.PUT("/fleet/:machineId/status", logisticsHandler.SetMachineStatus)
+		logisticsGroup.GET("/fleet", logisticsHandler.GetFleet, append([]echo.MiddlewareFunc{adminRequired}, heavyRead...)...)
+		logisticsGroup.GET("/fleet/stats", logisticsHandler.GetFleetStats, adminRequired)
+		logisticsGroup.POST("/fleet", logisticsHandler.RegisterMachine, adminRequired)
+		logisticsGroup.DELETE("/fleet/:machineId", logisticsHandler.DeleteMachine, adminRequired)
+		logisticsGroup.POST("/fleet/:machineId/credentials", logisticsHandler.RotateMachineKey, adminRequired)
+		logisticsGroup.GET("/fleet/:machineId/charge", logisticsHandler.GetChargeTrip, adminRequired)
+		logisticsGroup.GET("/fleet/:machineId/history", logisticsHandler.GetMachineHistory, adminRequired)
+		logisticsGroup.PUT("/fleet/:machineId/zone", logisticsHandler.SetMachineZone, adminRequired)
+		logisticsGroup.POST("/fleet/:machineId/commands", logisticsHandler.SendMachineCommand, adminRequired)
+		logisticsGroup.GET("/fleet/:machineId/commands", logisticsHandler.ListMachineCommands, adminRequired)
 		logisticsGroup.POST("/orders/quote", logisticsHandler.CalculateQuote)
-		logisticsGroup.POST("/orders/:orderId/route", logisticsHandler.ComputeRoute)
-		logisticsGroup.POST("/orders/:orderId/assign", logisticsHandler.ReassignOrder)
-		logisticsGroup.POST("/orders/:orderId/track", logisticsHandler.ReportTracking)
-		logisticsGroup.GET("orders/:orderId/track", logisticsHandler.GetTracking)
+		logisticsGroup.POST("/orders/:orderId/route", logisticsHandler.ComputeRoute, adminRequired)
+		logisticsGroup.POST("/orders/:orderId/assign", logisticsHandler.ReassignOrder, adminRequired)
+		logisticsGroup.POST("/runs", logisticsHandler.CreateRun, adminRequired)
+		logisticsGroup.GET("/runs/:runId", logisticsHandler.GetRun, adminRequired)
+		logisticsGroup.GET("/zones", logisticsHandler.ListZones, adminRequired)
+		logisticsGroup.POST("/zones", logisticsHandler.CreateZone, adminRequired)
+		logisticsGroup.PUT("/zones/:zoneId", logisticsHandler.UpdateZone, adminRequired)
+		logisticsGroup.DELETE("/zones/:zoneId", logisticsHandler.DeleteZone, adminRequired)
+		logisticsGroup.GET("/depots", logisticsHandler.ListDepots, adminRequired)
+		logisticsGroup.POST("/depots", logisticsHandler.CreateDepot, adminRequired)
+		logisticsGroup.DELETE("/depots/:depotId", logisticsHandler.DeleteDepot, adminRequired)
+		logisticsGroup.GET("/pricing-rules", logisticsHandler.ListPricingRules, adminRequired)
+		logisticsGroup.POST("/pricing-rules", logisticsHandler.CreatePricingRule, adminRequired)
+		logisticsGroup.PUT("/pricing-rules/:ruleId", logisticsHandler.UpdatePricingRule, adminRequired)
+		logisticsGroup.DELETE("/pricing-rules/:ruleId", logisticsHandler.DeletePricingRule, adminRequired)
+		logisticsGroup.GET("/reports/utilization", logisticsHandler.GetUtilizationReport, adminRequired)
+		logisticsGroup.GET("/reports/deliveries", logisticsHandler.GetDeliveriesReport, adminRequired)
+		logisticsGroup.GET("/reports/distance", logisticsHandler.GetDistanceReport, adminRequired)
+		logisticsGroup.GET("/reports/revenue", logisticsHandler.GetRevenueReport, adminRequired)
+		logisticsGroup.GET("/orders/:orderId/track", logisticsHandler.GetTracking, heavyRead...)
+		logisticsGroup.GET("/orders/:orderId/eta", logisticsHandler.GetETA)
+	}
+	e.GET("/logistics/orders/:orderId/track/ws", logisticsHandler.HandleTracking, streamAuth)
+
+	// --- Machine telemetry: authenticated by machine API key, not a user JWT ---
+	machineAuth := middleware.MachineAuth(logisticsHandler.AuthenticateMachine)
+	machineGroup := e.Group("/logistics")
+	{
+		machineGroup.PUT("/fleet/:machineId/status", logisticsHandler.SetMachineStatus, machineAuth, strictJSON)
+		machineGroup.POST("/fleet/:machineId/heartbeat", logisticsHandler.Heartbeat, machineAuth)
+		machineGroup.GET("/fleet/:machineId/assignments", logisticsHandler.GetMachineAssignments, machineAuth)
+		machineGroup.GET("/fleet/:machineId/commands/pending", logisticsHandler.PollMachineCommands, machineAuth)
+		machineGroup.POST("/fleet/:machineId/commands/:commandId/ack", logisticsHandler.AckMachineCommand, machineAuth, strictJSON)
+		machineGroup.GET("/orders/:orderId", orderHandler.MachineGetOrder, machineAuth)
+		machineGroup.POST("/orders/:orderId/track", logisticsHandler.ReportTracking, machineAuth, strictJSON)
+		machineGroup.POST("/orders/:orderId/track/batch", logisticsHandler.ReportTrackingBatch, machineAuth, strictJSON)
+		machineGroup.POST("/orders/:orderId/handoff", orderHandler.MachineHandoff, machineAuth, strictJSON) // Recipient's PIN completes delivery
 	}
 }
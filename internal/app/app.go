@@ -0,0 +1,403 @@
+// Package app is the composition root: it builds every repository, service and
+// handler from a Config plus a set of external Dependencies, and mounts them on
+// an Echo instance. cmd/api wires real adapters (Postgres, SES, Stripe);
+// integration tests can boot the same graph with fakes.
+package app
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"dispatch-and-delivery/internal/api"
+	apimiddleware "dispatch-and-delivery/internal/api/middleware"
+	"dispatch-and-delivery/internal/config"
+	"dispatch-and-delivery/internal/database"
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/internal/modules/logistics"
+	"dispatch-and-delivery/internal/modules/order"
+	"dispatch-and-delivery/internal/modules/user"
+	"dispatch-and-delivery/internal/scheduler"
+	"dispatch-and-delivery/pkg/cache"
+	"dispatch-and-delivery/pkg/email"
+	"dispatch-and-delivery/pkg/errreport"
+	"dispatch-and-delivery/pkg/maps"
+	"dispatch-and-delivery/pkg/mqtt"
+	"dispatch-and-delivery/pkg/payment"
+	"dispatch-and-delivery/pkg/storage"
+	"dispatch-and-delivery/pkg/weather"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/oauth2"
+)
+
+// Dependencies are the external systems the application talks to.
+type Dependencies struct {
+	DB      *pgxpool.Pool
+	Replica *pgxpool.Pool // Optional; heavy reads fall back to DB.
+
+	Email       email.ServiceInterface
+	Templates   *email.TemplateManager
+	Payments    payment.ServiceInterface
+	Storage     storage.Storage      // Photos, signatures, avatars, invoices, exports.
+	Routing     maps.RoutingProvider // Optional; defaults to Google Directions with GOOGLE_MAPS_API_KEY.
+	QuoteCache  cache.Store          // Optional; defaults to an in-memory cache per instance.
+	Weather     weather.Provider     // Optional; nil skips weather checks on quotes.
+	GoogleOAuth *oauth2.Config
+	Reporter    errreport.Reporter // Optional; defaults to the log reporter.
+	// Cache fans in-memory cache invalidations out to every instance.
+	// Optional; without it in-memory caches (e.g. the fleet snapshot) are
+	// disabled and live tracking streams only see events reported to this instance.
+	Cache *database.CacheBus
+
+	// Optional overrides. When nil, the Postgres-backed implementation is
+	// built from DB, so tests can swap in fakes without a database.
+	Tx            database.Transactor
+	UserRepo      user.RepositoryInterface
+	OrderRepo     order.RepositoryInterface
+	LogisticsRepo logistics.RepositoryInterface
+}
+
+// App holds the wired services and handlers.
+type App struct {
+	cfg  *config.Config
+	deps Dependencies
+
+	UserService      user.ServiceInterface
+	OrderService     order.ServiceInterface
+	LogisticsService logistics.ServiceInterface
+
+	UserHandler      *user.Handler
+	OrderHandler     *order.Handler
+	LogisticsHandler *logistics.Handler
+
+	// Scheduler holds the periodic jobs; the caller decides whether to Run it.
+	Scheduler *scheduler.Scheduler
+	// Telemetry ingests machine reports from MQTT. Nil unless MQTT_BROKER_URL
+	// is set; like Scheduler, the caller decides whether to Run it.
+	Telemetry *logistics.TelemetryIngester
+	// Agent serves the machine agent gRPC API. Nil unless AGENT_GRPC_PORT is
+	// set; the caller decides whether to serve it.
+	Agent *logistics.AgentServer
+	// Dispatcher assigns machines to paid orders; the caller decides whether to Run it.
+	Dispatcher *order.Dispatcher
+}
+
+// New wires the module graph. It does not open connections or start goroutines.
+func New(cfg *config.Config, deps Dependencies) *App {
+	if deps.Reporter == nil {
+		deps.Reporter = errreport.NewLogReporter()
+	}
+	if deps.Tx == nil {
+		deps.Tx = database.NewTxManager(deps.DB)
+	}
+	if deps.QuoteCache == nil {
+		deps.QuoteCache = cache.NewMemory(0)
+	}
+	if deps.UserRepo == nil {
+		deps.UserRepo = user.NewRepository(deps.DB)
+	}
+	if deps.OrderRepo == nil {
+		deps.OrderRepo = order.NewRepository(deps.DB, deps.Replica)
+	}
+	if deps.LogisticsRepo == nil {
+		deps.LogisticsRepo = logistics.NewRepository(deps.DB, deps.Replica)
+	}
+	if deps.Cache != nil {
+		deps.LogisticsRepo = logistics.NewCachedRepository(deps.LogisticsRepo, deps.Cache)
+	}
+
+	a := &App{cfg: cfg, deps: deps}
+
+	// --- Users Module ---
+	a.UserService = user.NewService(
+		deps.UserRepo,
+		deps.Email,
+		deps.Templates,
+		cfg.JWTSecret,
+		cfg.ClientOrigin,
+		deps.GoogleOAuth,
+		deps.Payments,
+	)
+	a.UserHandler = user.NewHandler(a.UserService)
+
+	// --- Logistics Module ---
+	logisticsOpts := []logistics.Option{
+		logistics.WithBatteryPolicy(batteryPolicy(cfg)),
+		logistics.WithChargePolicy(logistics.ChargePolicy{
+			LowPercent:    cfg.ChargeLowPercent,
+			ResumePercent: cfg.ChargeResumePercent,
+		}),
+		logistics.WithHeartbeatTimeout(cfg.HeartbeatTimeout),
+		logistics.WithTrackingPolicy(trackingPolicy(cfg)),
+		logistics.WithArrivalRadius(cfg.ArrivalRadiusM),
+		logistics.WithTelemetryRetention(cfg.TelemetryRetention),
+		logistics.WithSurgePolicy(surgePolicy(cfg)),
+		logistics.WithTaxRate(cfg.TaxRate),
+		logistics.WithQuoteCache(deps.QuoteCache, cfg.QuoteCacheTTL),
+		logistics.WithCommandTTL(cfg.MachineCommandTTL),
+		logistics.WithTxManager(deps.Tx),
+	}
+	if deps.Weather != nil {
+		logisticsOpts = append(logisticsOpts, logistics.WithWeather(deps.Weather, weatherPolicy(cfg)))
+	}
+	if deps.Routing != nil {
+		logisticsOpts = append(logisticsOpts, logistics.WithRoutingProvider(deps.Routing))
+	}
+	// Commands go to the machine's gRPC stream when it has one on this
+	// instance, then over MQTT; machines with neither poll for them.
+	var commandPublishers []logistics.CommandPublisher
+	var agentHub *logistics.AgentHub
+	if cfg.AgentGRPCPort != "" {
+		agentHub = logistics.NewAgentHub()
+		commandPublishers = append(commandPublishers, agentHub)
+	}
+	if cfg.MQTTBrokerURL != "" {
+		commandPublishers = append(commandPublishers, logistics.NewMQTTCommandPublisher(mqtt.Config{
+			BrokerURL:    cfg.MQTTBrokerURL,
+			ClientID:     mqttClientID(cfg) + "-commands",
+			Username:     cfg.MQTTUsername,
+			Password:     cfg.MQTTPassword,
+			CleanSession: true,
+		}, cfg.MQTTTopicPrefix))
+	}
+	if len(commandPublishers) > 0 {
+		logisticsOpts = append(logisticsOpts, logistics.WithCommandPublisher(logistics.CommandPublishers(commandPublishers...)))
+	}
+	if deps.Cache != nil {
+		// Tracking WebSockets are woken on whichever instance holds them.
+		logisticsOpts = append(logisticsOpts, logistics.WithTrackingHub(logistics.NewTrackingHub(deps.Cache)))
+	}
+	a.LogisticsService = logistics.NewService(deps.LogisticsRepo, cfg.GoogleMapsAPIKey, logisticsOpts...)
+	a.LogisticsHandler = logistics.NewHandler(a.LogisticsService, allowedOrigins(cfg)...)
+	if cfg.MQTTBrokerURL != "" {
+		a.Telemetry = logistics.NewTelemetryIngester(a.LogisticsService, mqtt.Config{
+			BrokerURL: cfg.MQTTBrokerURL,
+			ClientID:  mqttClientID(cfg),
+			Username:  cfg.MQTTUsername,
+			Password:  cfg.MQTTPassword,
+		}, cfg.MQTTTopicPrefix, cfg.MQTTShareGroup)
+	}
+	if agentHub != nil {
+		a.Agent = logistics.NewAgentServer(a.LogisticsService, agentHub, cfg.AgentSyncInterval)
+	}
+
+	// --- Orders Module ---
+	orderService := order.NewService(deps.OrderRepo, deps.Payments, a.LogisticsService, deps.Tx,
+		order.WithQuoteTTL(cfg.RouteQuoteTTL),
+		order.WithWebhookClient(order.NewWebhookClient(cfg.WebhookAllowPrivateNetworks)),
+		order.WithStorage(deps.Storage),
+		order.WithCancellationPolicy(models.CancellationPolicy{
+			QueuedFeeRate:     cfg.CancelFeeQueued,
+			InProgressFeeRate: cfg.CancelFeeInProgress,
+			MinFee:            cfg.CancelFeeMin,
+		}),
+		order.WithInsurancePolicy(models.InsurancePolicy{
+			Rate:             cfg.InsuranceRate,
+			MinPremium:       cfg.InsuranceMinPremium,
+			MaxDeclaredValue: cfg.InsuranceMaxValue,
+		}))
+	a.OrderService = orderService
+	a.OrderHandler = order.NewHandler(a.OrderService)
+	a.Dispatcher = order.NewDispatcher(orderService, cfg.DispatchPollInterval)
+
+	// --- Background jobs ---
+	a.Scheduler = scheduler.New(deps.DB)
+	a.Scheduler.Register(a.Scheduler.PruneHistory(30 * 24 * time.Hour))
+	a.Scheduler.Register(scheduler.Job{
+		// Low-battery idle machines head to a depot; recharged ones rejoin dispatch.
+		Name:  "logistics.return_to_charge",
+		Every: time.Minute,
+		Run:   a.LogisticsService.ReturnToCharge,
+	})
+	a.Scheduler.Register(scheduler.Job{
+		// Machines that stopped sending heartbeats go OFFLINE and admins are notified.
+		Name:  "logistics.mark_offline",
+		Every: time.Minute,
+		Run:   a.LogisticsService.MarkOfflineMachines,
+	})
+	a.Scheduler.Register(scheduler.Job{
+		// Paid scheduled orders join the assignment queue shortly before pickup.
+		Name:  "order.promote_scheduled",
+		Every: 30 * time.Second,
+		Run: func(ctx context.Context) error {
+			return orderService.PromoteScheduledOrders(ctx, cfg.ScheduledDispatchLead)
+		},
+	})
+	if cfg.UnpaidOrderTTL > 0 {
+		a.Scheduler.Register(scheduler.Job{
+			// Orders left in PENDING_PAYMENT are cancelled and their customers notified.
+			Name:  "order.cancel_unpaid",
+			Every: time.Minute,
+			Run: func(ctx context.Context) error {
+				return orderService.CancelUnpaidOrders(ctx, cfg.UnpaidOrderTTL)
+			},
+		})
+	}
+	a.Scheduler.Register(scheduler.Job{
+		// Idempotency keys are remembered for a day.
+		Name:  "order.purge_idempotency_keys",
+		Every: time.Hour,
+		Run:   orderService.PurgeIdempotencyKeys,
+	})
+	a.Scheduler.Register(scheduler.Job{
+		Name:  "order.purge_route_quotes",
+		Every: time.Hour,
+		Run:   orderService.PurgeRouteQuotes,
+	})
+	a.Scheduler.Register(scheduler.Job{
+		// Order status changes are POSTed to customers' webhooks, with retries.
+		Name:    "order.deliver_webhooks",
+		Every:   15 * time.Second,
+		Timeout: 2 * time.Minute,
+		Run:     orderService.DeliverWebhooks,
+	})
+	a.Scheduler.Register(scheduler.Job{
+		Name:  "order.prune_webhook_deliveries",
+		Every: 24 * time.Hour,
+		Run:   orderService.PruneWebhookDeliveries,
+	})
+	a.Scheduler.Register(scheduler.Job{
+		// Unacknowledged commands expire; ones the broker did not take are published again.
+		Name:  "logistics.sweep_commands",
+		Every: 30 * time.Second,
+		Run:   a.LogisticsService.SweepMachineCommands,
+	})
+	if cfg.TelemetrySnapshotInterval > 0 {
+		a.Scheduler.Register(scheduler.Job{
+			// Fleet snapshots for GET /logistics/fleet/:machineId/history.
+			Name:  "logistics.snapshot_fleet",
+			Every: cfg.TelemetrySnapshotInterval,
+			Run:   a.LogisticsService.SnapshotFleet,
+		})
+	}
+
+	return a
+}
+
+// Echo builds the HTTP stack: error rendering, global middleware and routes.
+// extra middleware (e.g. read-only mode) runs after the global chain.
+func (a *App) Echo(extra ...echo.MiddlewareFunc) *echo.Echo {
+	cfg := a.cfg
+	e := echo.New()
+	// All handler errors are rendered centrally with stable error codes.
+	e.HTTPErrorHandler = apimiddleware.HTTPErrorHandler
+	e.Binder = apimiddleware.NewBinder()
+
+	authMode := apimiddleware.AuthMode(cfg.AuthMode)
+
+	e.Use(middleware.RequestID())
+	e.Use(middleware.Logger())
+	e.Use(apimiddleware.Recover(a.deps.Reporter))
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{ // Configure CORS appropriately
+		AllowOrigins: allowedOrigins(cfg),
+		AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodOptions},
+		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, apimiddleware.HeaderXCSRFToken, order.HeaderIdempotencyKey},
+		// Pagination cursors travel in response headers.
+		ExposeHeaders: []string{"X-Next-Cursor", "X-Last-Cursor"},
+		// Cookie auth needs credentialed cross-origin requests.
+		AllowCredentials: authMode == apimiddleware.AuthModeCookie,
+	}))
+	// Double-submit CSRF tokens; a no-op unless AUTH_MODE=cookie.
+	e.Use(apimiddleware.CSRF(authMode, cfg.AppEnv != "development"))
+	e.Use(extra...)
+
+	// The local storage driver serves its own presigned download links.
+	if local, ok := a.deps.Storage.(*storage.LocalStorage); ok {
+		e.GET("/files/*", echo.WrapHandler(local.Handler("/files")))
+	}
+
+	api.SetupRoutes(e, cfg.JWTSecret, authMode,
+		a.UserHandler,
+		a.OrderHandler,
+		a.LogisticsHandler,
+	)
+	return e
+}
+
+// allowedOrigins are the browser origins allowed for CORS and WebSocket
+// handshakes: the SvelteKit dev server and the production client.
+func allowedOrigins(cfg *config.Config) []string {
+	return []string{"http://localhost:5173", cfg.ClientOrigin}
+}
+
+// mqttClientID keeps the broker session stable across restarts of the same
+// host, so QoS 1 telemetry published during a deploy is not lost.
+func mqttClientID(cfg *config.Config) string {
+	if cfg.MQTTClientID != "" {
+		return cfg.MQTTClientID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return "circuit-api-" + host
+}
+
+// batteryPolicy builds the dispatch battery constraints from config, keeping
+// the default detour factors for each machine type.
+func batteryPolicy(cfg *config.Config) logistics.BatteryPolicy {
+	p := logistics.DefaultBatteryPolicy()
+	drone := p.Models[models.MachineTypeDrone]
+	drone.PercentPerKM = cfg.DispatchDronePercentPerKM
+	robot := p.Models[models.MachineTypeRobot]
+	robot.PercentPerKM = cfg.DispatchRobotPercentPerKM
+	p.Models[models.MachineTypeDrone] = drone
+	p.Models[models.MachineTypeRobot] = robot
+	p.SafetyMargin = cfg.DispatchSafetyMargin
+	p.ReservePercent = cfg.DispatchReservePercent
+	return p
+}
+
+// weatherPolicy builds the per-machine-type weather limits for quotes from config.
+func weatherPolicy(cfg *config.Config) logistics.WeatherPolicy {
+	return logistics.WeatherPolicy{
+		models.MachineTypeDrone: {
+			MaxWindMS:                 cfg.WeatherDroneMaxWindMS,
+			MaxPrecipitationMMH:       cfg.WeatherDroneMaxPrecipMMH,
+			SurchargeWindMS:           cfg.WeatherDroneSurchargeWindMS,
+			SurchargePrecipitationMMH: cfg.WeatherDroneSurchargePrecipMMH,
+			Surcharge:                 cfg.WeatherDroneSurcharge,
+		},
+		models.MachineTypeRobot: {
+			MaxWindMS:                 cfg.WeatherRobotMaxWindMS,
+			MaxPrecipitationMMH:       cfg.WeatherRobotMaxPrecipMMH,
+			SurchargeWindMS:           cfg.WeatherRobotSurchargeWindMS,
+			SurchargePrecipitationMMH: cfg.WeatherRobotSurchargePrecipMMH,
+			Surcharge:                 cfg.WeatherRobotSurcharge,
+		},
+	}
+}
+
+// surgePolicy builds the two surge pricing tiers from config, or none when
+// surge pricing is off.
+func surgePolicy(cfg *config.Config) logistics.SurgePolicy {
+	if !cfg.SurgeEnabled {
+		return logistics.SurgePolicy{}
+	}
+	return logistics.SurgePolicy{
+		Tiers: []logistics.SurgeTier{
+			{BelowRatio: cfg.SurgeRatio, Multiplier: cfg.SurgeMultiplier},
+			{BelowRatio: cfg.SurgeHighRatio, Multiplier: cfg.SurgeHighMultiplier},
+		},
+	}
+}
+
+// trackingPolicy builds the per-machine-type tracking throttles from config.
+func trackingPolicy(cfg *config.Config) logistics.TrackingPolicy {
+	return logistics.TrackingPolicy{
+		models.MachineTypeDrone: {
+			MinInterval:       cfg.TrackingDroneMinInterval,
+			MinDistanceMeters: cfg.TrackingDroneMinDistanceM,
+			MaxGap:            cfg.TrackingMaxGap,
+		},
+		models.MachineTypeRobot: {
+			MinInterval:       cfg.TrackingRobotMinInterval,
+			MinDistanceMeters: cfg.TrackingRobotMinDistanceM,
+			MaxGap:            cfg.TrackingMaxGap,
+		},
+	}
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dispatch-and-delivery/internal/config"
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// The graph must be constructible without live infrastructure so integration
+// tests can substitute fakes for the adapters they care about.
+func TestEchoBootsWithoutInfrastructure(t *testing.T) {
+	e := New(&config.Config{JWTSecret: "test", AuthMode: "bearer", AppEnv: "development"}, Dependencies{}).Echo()
+
+	cases := []struct {
+		path string
+		want int
+	}{
+		{"/", http.StatusOK},
+		{"/profile", http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.path, rec.Code, tc.want)
+		}
+	}
+}
+
+func signToken(t *testing.T, secret, role string) string {
+	t.Helper()
+	claims := &models.JwtCustomClaims{
+		UserID: "00000000-0000-0000-0000-000000000001",
+		Email:  "user@example.com",
+		Role:   role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Admin routes are rejected before any handler (and therefore any database
+// access) runs, so this needs no infrastructure either.
+func TestAdminRoutesForbidCustomers(t *testing.T) {
+	e := New(&config.Config{JWTSecret: "test", AuthMode: "bearer", AppEnv: "development"}, Dependencies{}).Echo()
+
+	routes := []struct{ method, path string }{
+		{http.MethodGet, "/admin/orders"},
+		{http.MethodGet, "/admin/orders/export"},
+		{http.MethodGet, "/admin/orders/feedback"},
+		{http.MethodGet, "/admin/orders/feedback/machines"},
+		{http.MethodPost, "/admin/orders/o1/cancel"},
+		{http.MethodDelete, "/admin/orders/o1/messages/m1"},
+		{http.MethodGet, "/admin/orders/claims"},
+		{http.MethodPost, "/admin/orders/claims/c1/decision"},
+		{http.MethodGet, "/admin/users/u1/addresses"},
+		{http.MethodPost, "/admin/promo-codes"},
+		{http.MethodGet, "/admin/promo-codes"},
+		{http.MethodDelete, "/admin/promo-codes/p1"},
+		{http.MethodGet, "/logistics/fleet"},
+		{http.MethodGet, "/logistics/fleet/stats"},
+		{http.MethodDelete, "/logistics/fleet/m1"},
+		{http.MethodPost, "/logistics/fleet/m1/credentials"},
+		{http.MethodPost, "/logistics/fleet/m1/commands"},
+		{http.MethodGet, "/logistics/reports/utilization"},
+		{http.MethodGet, "/logistics/reports/revenue"},
+		{http.MethodPost, "/logistics/orders/o1/route"},
+		{http.MethodPost, "/logistics/orders/o1/assign"},
+		{http.MethodGet, "/debug/runtime"},
+	}
+	for _, role := range []string{models.RoleCustomer, ""} {
+		token := signToken(t, "test", role)
+		for _, r := range routes {
+			req := httptest.NewRequest(r.method, r.path, strings.NewReader("{}"))
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("role %q: %s %s = %d, want 403", role, r.method, r.path, rec.Code)
+			}
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/runtime", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+signToken(t, "test", models.RoleAdmin))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("admin: GET /debug/runtime = %d, want 200", rec.Code)
+	}
+}
+
+// Telemetry endpoints only accept machine API keys; a user JWT is not enough.
+func TestMachineRoutesRejectUserTokens(t *testing.T) {
+	e := New(&config.Config{JWTSecret: "test", AuthMode: "bearer", AppEnv: "development"}, Dependencies{}).Echo()
+	token := signToken(t, "test", models.RoleAdmin)
+
+	for _, r := range []struct{ method, path string }{
+		{http.MethodPut, "/logistics/fleet/m1/status"},
+		{http.MethodPost, "/logistics/fleet/m1/commands/c1/ack"},
+		{http.MethodPost, "/logistics/orders/o1/track"},
+		{http.MethodGet, "/logistics/orders/o1"},
+	} {
+		req := httptest.NewRequest(r.method, r.path, strings.NewReader("{}"))
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s with user JWT = %d, want 401", r.method, r.path, rec.Code)
+		}
+	}
+}
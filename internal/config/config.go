@@ -3,24 +3,148 @@ package config
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	ServerPort              string `mapstructure:"SERVER_PORT"`
-	DatabaseURL             string `mapstructure:"DATABASE_URL"`
-	JWTSecret               string `mapstructure:"JWT_SECRET"`
-	ClientOrigin            string `mapstructure:"CLIENT_ORIGIN"`
-	GoogleOAuthClientID     string `mapstructure:"GOOGLE_OAUTH_CLIENT_ID"`
-	GoogleOAuthClientSecret string `mapstructure:"GOOGLE_OAUTH_CLIENT_SECRET"`
-	GoogleOAuthRedirectURL  string `mapstructure:"GOOGLE_OAUTH_REDIRECT_URL"`
-	AWSRegion               string `mapstructure:"AWS_REGION"`
-	AWSAccessKeyID          string `mapstructure:"AWS_ACCESS_KEY_ID"`
-	AWSSecretAccessKey      string `mapstructure:"AWS_SECRET_ACCESS_KEY"`
-	EmailFromAddress        string `mapstructure:"EMAIL_FROM_ADDRESS"`
-	GoogleMapsAPIKey        string `mapstructure:"GOOGLE_MAPS_API_KEY"`
-	StripeAPIKey            string `mapstructure:"STRIPE_API_KEY"`
+	ServerPort string `mapstructure:"SERVER_PORT"`
+	// HTTP server hardening (slowloris and connection exhaustion protection).
+	HTTPReadTimeout          time.Duration `mapstructure:"HTTP_READ_TIMEOUT"`
+	HTTPReadHeaderTimeout    time.Duration `mapstructure:"HTTP_READ_HEADER_TIMEOUT"`
+	HTTPWriteTimeout         time.Duration `mapstructure:"HTTP_WRITE_TIMEOUT"`
+	HTTPIdleTimeout          time.Duration `mapstructure:"HTTP_IDLE_TIMEOUT"`
+	HTTPMaxHeaderBytes       int           `mapstructure:"HTTP_MAX_HEADER_BYTES"`
+	HTTPMaxConnections       int           `mapstructure:"HTTP_MAX_CONNECTIONS"` // 0 disables the limit
+	DatabaseURL              string        `mapstructure:"DATABASE_URL"`
+	DatabaseReplicaURL       string        `mapstructure:"DATABASE_REPLICA_URL"` // Optional read-only replica
+	DBMaxConns               int32         `mapstructure:"DB_MAX_CONNS"`         // Per pool; 0 keeps the pgx default
+	DBMinConns               int32         `mapstructure:"DB_MIN_CONNS"`
+	DBMaxConnLifetime        time.Duration `mapstructure:"DB_MAX_CONN_LIFETIME"`
+	DBMaxConnIdleTime        time.Duration `mapstructure:"DB_MAX_CONN_IDLE_TIME"`
+	DBHealthCheckPeriod      time.Duration `mapstructure:"DB_HEALTH_CHECK_PERIOD"`
+	DBQueryExecMode          string        `mapstructure:"DB_QUERY_EXEC_MODE"` // "cache_statement" (default); "exec" or "simple_protocol" behind pgbouncer
+	DBStatementCacheCapacity int           `mapstructure:"DB_STATEMENT_CACHE_CAPACITY"`
+	SchemaCheck              string        `mapstructure:"SCHEMA_CHECK"` // "strict" (default), "degraded" or "off"
+	JWTSecret                string        `mapstructure:"JWT_SECRET"`
+	AuthMode                 string        `mapstructure:"AUTH_MODE"` // "bearer" (default) or "cookie"
+	ClientOrigin             string        `mapstructure:"CLIENT_ORIGIN"`
+	GoogleOAuthClientID      string        `mapstructure:"GOOGLE_OAUTH_CLIENT_ID"`
+	GoogleOAuthClientSecret  string        `mapstructure:"GOOGLE_OAUTH_CLIENT_SECRET"`
+	GoogleOAuthRedirectURL   string        `mapstructure:"GOOGLE_OAUTH_REDIRECT_URL"`
+	AWSRegion                string        `mapstructure:"AWS_REGION"`
+	AWSAccessKeyID           string        `mapstructure:"AWS_ACCESS_KEY_ID"`
+	AWSSecretAccessKey       string        `mapstructure:"AWS_SECRET_ACCESS_KEY"`
+	EmailFromAddress         string        `mapstructure:"EMAIL_FROM_ADDRESS"`
+	StorageDriver            string        `mapstructure:"STORAGE_DRIVER"`     // "local" (default) or "s3"
+	StorageLocalDir          string        `mapstructure:"STORAGE_LOCAL_DIR"`  // local driver root
+	StoragePublicURL         string        `mapstructure:"STORAGE_PUBLIC_URL"` // local driver download base, served at /files
+	S3Bucket                 string        `mapstructure:"S3_BUCKET"`
+	S3Endpoint               string        `mapstructure:"S3_ENDPOINT"` // Optional, e.g. MinIO in development
+	GoogleMapsAPIKey         string        `mapstructure:"GOOGLE_MAPS_API_KEY"`
+	RoutingProvider          string        `mapstructure:"ROUTING_PROVIDER"` // "google" (legacy Directions, default), "google_routes", "mapbox" or "osrm"
+	MapboxAccessToken        string        `mapstructure:"MAPBOX_ACCESS_TOKEN"`
+	OSRMURL                  string        `mapstructure:"OSRM_URL"`        // Self-hosted osrm-routed, e.g. http://osrm:5000
+	RedisURL                 string        `mapstructure:"REDIS_URL"`       // Optional; empty keeps caches in memory per instance
+	QuoteCacheTTL            time.Duration `mapstructure:"QUOTE_CACHE_TTL"` // 0 disables the route quote cache
+	StripeAPIKey             string        `mapstructure:"STRIPE_API_KEY"`
+	PaymentProvider          string        `mapstructure:"PAYMENT_PROVIDER"`   // "stripe" (default) or "fake", which never reaches Stripe; not allowed in production
+	PaymentFakeMode          string        `mapstructure:"PAYMENT_FAKE_MODE"`  // "succeed" (default), "fail" or "delay"
+	PaymentFakeDelay         time.Duration `mapstructure:"PAYMENT_FAKE_DELAY"` // How long "delay" takes per call
+	MQTTBrokerURL            string        `mapstructure:"MQTT_BROKER_URL"`    // Empty disables MQTT telemetry ingestion
+	MQTTClientID             string        `mapstructure:"MQTT_CLIENT_ID"`     // Must be unique per instance; defaults to circuit-api-<hostname>
+	MQTTUsername             string        `mapstructure:"MQTT_USERNAME"`
+	MQTTPassword             string        `mapstructure:"MQTT_PASSWORD"`
+	MQTTTopicPrefix          string        `mapstructure:"MQTT_TOPIC_PREFIX"` // Machines publish to <prefix>/machines/<id>/telemetry
+	MQTTShareGroup           string        `mapstructure:"MQTT_SHARE_GROUP"`  // Shared subscription group; empty delivers every message to every instance
+	// Battery-aware dispatch: a machine is only assigned if its battery covers the trip.
+	DispatchDronePercentPerKM float64 `mapstructure:"DISPATCH_DRONE_PERCENT_PER_KM"`
+	DispatchRobotPercentPerKM float64 `mapstructure:"DISPATCH_ROBOT_PERCENT_PER_KM"`
+	DispatchSafetyMargin      float64 `mapstructure:"DISPATCH_SAFETY_MARGIN"`   // e.g. 0.2 adds 20% to the estimated consumption
+	DispatchReservePercent    float64 `mapstructure:"DISPATCH_RESERVE_PERCENT"` // battery left over at the end of a trip
+	// Paid orders are assigned by a background dispatcher, woken by payments on
+	// the same instance and otherwise polling the assignment queue this often.
+	DispatchPollInterval time.Duration `mapstructure:"DISPATCH_POLL_INTERVAL"`
+	// Paid scheduled orders are released to the dispatcher this long before
+	// their pickup time.
+	ScheduledDispatchLead time.Duration `mapstructure:"SCHEDULED_DISPATCH_LEAD"`
+	// A quoted route option can be ordered for this long.
+	RouteQuoteTTL time.Duration `mapstructure:"ROUTE_QUOTE_TTL"`
+	// Orders still unpaid this long after they were placed are cancelled;
+	// 0 keeps them.
+	UnpaidOrderTTL time.Duration `mapstructure:"UNPAID_ORDER_TTL"`
+	// Customers cancelling a paid order pay this fraction of its cost, more
+	// once a machine is carrying it, and at least CANCEL_FEE_MIN.
+	CancelFeeQueued     float64 `mapstructure:"CANCEL_FEE_QUEUED"`
+	CancelFeeInProgress float64 `mapstructure:"CANCEL_FEE_IN_PROGRESS"`
+	CancelFeeMin        float64 `mapstructure:"CANCEL_FEE_MIN"`
+	// Packages declared at up to INSURANCE_MAX_VALUE can be insured for
+	// INSURANCE_RATE of their value, at least INSURANCE_MIN_PREMIUM; 0 offers
+	// no insurance.
+	InsuranceRate       float64 `mapstructure:"INSURANCE_RATE"`
+	InsuranceMinPremium float64 `mapstructure:"INSURANCE_MIN_PREMIUM"`
+	InsuranceMaxValue   float64 `mapstructure:"INSURANCE_MAX_VALUE"`
+	// Webhooks may only reach public addresses unless this is set, e.g. to
+	// test against a receiver on localhost.
+	WebhookAllowPrivateNetworks bool `mapstructure:"WEBHOOK_ALLOW_PRIVATE_NETWORKS"`
+	// Idle machines below CHARGE_LOW_PERCENT return to the nearest depot and are
+	// not dispatched again until they reach CHARGE_RESUME_PERCENT.
+	ChargeLowPercent    float64       `mapstructure:"CHARGE_LOW_PERCENT"`
+	ChargeResumePercent float64       `mapstructure:"CHARGE_RESUME_PERCENT"`
+	HeartbeatTimeout    time.Duration `mapstructure:"HEARTBEAT_TIMEOUT"` // machines silent for longer are marked OFFLINE
+	// Operator commands (pause, resume, return to base, reboot) not acknowledged
+	// by the machine within MACHINE_COMMAND_TTL expire.
+	MachineCommandTTL time.Duration `mapstructure:"MACHINE_COMMAND_TTL"`
+	// Onboard agents can stream telemetry and receive commands over gRPC on
+	// AGENT_GRPC_PORT (empty disables it). Each stream re-checks for commands
+	// and assignment changes made on other instances every AGENT_SYNC_INTERVAL.
+	AgentGRPCPort     string        `mapstructure:"AGENT_GRPC_PORT"`
+	AgentSyncInterval time.Duration `mapstructure:"AGENT_SYNC_INTERVAL"`
+	// Tracking reports closer than the minimum interval or distance to the
+	// previous stored point are dropped; TRACKING_MAX_GAP always keeps one point
+	// after that long so stationary machines still report. Zero disables a check.
+	TrackingDroneMinInterval  time.Duration `mapstructure:"TRACKING_DRONE_MIN_INTERVAL"`
+	TrackingDroneMinDistanceM float64       `mapstructure:"TRACKING_DRONE_MIN_DISTANCE_M"`
+	TrackingRobotMinInterval  time.Duration `mapstructure:"TRACKING_ROBOT_MIN_INTERVAL"`
+	TrackingRobotMinDistanceM float64       `mapstructure:"TRACKING_ROBOT_MIN_DISTANCE_M"`
+	TrackingMaxGap            time.Duration `mapstructure:"TRACKING_MAX_GAP"`
+	ArrivalRadiusM            float64       `mapstructure:"ARRIVAL_RADIUS_M"` // orders become ARRIVED when tracking comes this close to the dropoff; 0 disables
+	// Every TELEMETRY_SNAPSHOT_INTERVAL the fleet's location, battery and status
+	// are recorded for history charts; snapshots older than TELEMETRY_RETENTION
+	// are deleted (0 keeps them forever).
+	TelemetrySnapshotInterval time.Duration `mapstructure:"TELEMETRY_SNAPSHOT_INTERVAL"`
+	TelemetryRetention        time.Duration `mapstructure:"TELEMETRY_RETENTION"`
+	// With WEATHER_PROVIDER set ("open_meteo"), quotes drop a machine type when
+	// wind (m/s, gusts included) or precipitation (mm/h) at the pickup or
+	// dropoff exceeds its MAX limit, and add its SURCHARGE fraction above the
+	// SURCHARGE limits. Zero disables a check.
+	WeatherProvider                string  `mapstructure:"WEATHER_PROVIDER"`
+	WeatherURL                     string  `mapstructure:"WEATHER_URL"` // Optional; defaults to the public Open-Meteo API
+	WeatherDroneMaxWindMS          float64 `mapstructure:"WEATHER_DRONE_MAX_WIND_MS"`
+	WeatherDroneMaxPrecipMMH       float64 `mapstructure:"WEATHER_DRONE_MAX_PRECIP_MMH"`
+	WeatherDroneSurchargeWindMS    float64 `mapstructure:"WEATHER_DRONE_SURCHARGE_WIND_MS"`
+	WeatherDroneSurchargePrecipMMH float64 `mapstructure:"WEATHER_DRONE_SURCHARGE_PRECIP_MMH"`
+	WeatherDroneSurcharge          float64 `mapstructure:"WEATHER_DRONE_SURCHARGE"`
+	WeatherRobotMaxWindMS          float64 `mapstructure:"WEATHER_ROBOT_MAX_WIND_MS"`
+	WeatherRobotMaxPrecipMMH       float64 `mapstructure:"WEATHER_ROBOT_MAX_PRECIP_MMH"`
+	WeatherRobotSurchargeWindMS    float64 `mapstructure:"WEATHER_ROBOT_SURCHARGE_WIND_MS"`
+	WeatherRobotSurchargePrecipMMH float64 `mapstructure:"WEATHER_ROBOT_SURCHARGE_PRECIP_MMH"`
+	WeatherRobotSurcharge          float64 `mapstructure:"WEATHER_ROBOT_SURCHARGE"`
+	// Quotes surge when the ratio of idle machines to orders waiting for one
+	// in the pickup's operational zone drops below SURGE_RATIO (price times
+	// SURGE_MULTIPLIER) or SURGE_HIGH_RATIO (SURGE_HIGH_MULTIPLIER).
+	// SURGE_ENABLED=false disables surge pricing.
+	SurgeEnabled        bool    `mapstructure:"SURGE_ENABLED"`
+	SurgeRatio          float64 `mapstructure:"SURGE_RATIO"`
+	SurgeMultiplier     float64 `mapstructure:"SURGE_MULTIPLIER"`
+	SurgeHighRatio      float64 `mapstructure:"SURGE_HIGH_RATIO"`
+	SurgeHighMultiplier float64 `mapstructure:"SURGE_HIGH_MULTIPLIER"`
+	// TaxRate is charged on quotes (0.08 means 8%) and shown as their tax item.
+	TaxRate   float64 `mapstructure:"TAX_RATE"`
+	SentryDSN string  `mapstructure:"SENTRY_DSN"`
+	AppEnv    string  `mapstructure:"APP_ENV"`
+	Release   string  `mapstructure:"RELEASE"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -30,6 +154,88 @@ func LoadConfig(path string) (*Config, error) {
 
 	viper.AutomaticEnv() // Read in environment variables that match
 
+	viper.SetDefault("HTTP_READ_TIMEOUT", "15s")
+	viper.SetDefault("HTTP_READ_HEADER_TIMEOUT", "5s")
+	viper.SetDefault("HTTP_WRITE_TIMEOUT", "30s")
+	viper.SetDefault("HTTP_IDLE_TIMEOUT", "60s")
+	viper.SetDefault("HTTP_MAX_HEADER_BYTES", 1<<20)
+	viper.SetDefault("HTTP_MAX_CONNECTIONS", 1000)
+	viper.SetDefault("DB_MAX_CONNS", 25)
+	viper.SetDefault("DB_MIN_CONNS", 2)
+	viper.SetDefault("DB_MAX_CONN_LIFETIME", "1h")
+	viper.SetDefault("DB_MAX_CONN_IDLE_TIME", "30m")
+	viper.SetDefault("DB_HEALTH_CHECK_PERIOD", "1m")
+	viper.SetDefault("DB_QUERY_EXEC_MODE", "cache_statement")
+	viper.SetDefault("DB_STATEMENT_CACHE_CAPACITY", 512)
+	viper.SetDefault("APP_ENV", "development")
+	viper.SetDefault("AUTH_MODE", "bearer")
+	viper.SetDefault("SCHEMA_CHECK", "strict")
+	viper.SetDefault("RELEASE", "dev")
+	viper.SetDefault("ROUTING_PROVIDER", "google")
+	viper.SetDefault("MAPBOX_ACCESS_TOKEN", "")
+	viper.SetDefault("OSRM_URL", "")
+	viper.SetDefault("REDIS_URL", "")
+	viper.SetDefault("QUOTE_CACHE_TTL", "15m")
+	viper.SetDefault("PAYMENT_PROVIDER", "stripe")
+	viper.SetDefault("PAYMENT_FAKE_MODE", "succeed")
+	viper.SetDefault("PAYMENT_FAKE_DELAY", "2s")
+	viper.SetDefault("STORAGE_DRIVER", "local")
+	viper.SetDefault("STORAGE_LOCAL_DIR", "./data/files")
+	viper.SetDefault("STORAGE_PUBLIC_URL", "http://localhost:8080/files")
+	viper.SetDefault("MQTT_BROKER_URL", "")
+	viper.SetDefault("MQTT_CLIENT_ID", "")
+	viper.SetDefault("MQTT_USERNAME", "")
+	viper.SetDefault("MQTT_PASSWORD", "")
+	viper.SetDefault("MQTT_TOPIC_PREFIX", "circuit")
+	viper.SetDefault("MQTT_SHARE_GROUP", "circuit-api")
+	viper.SetDefault("DISPATCH_DRONE_PERCENT_PER_KM", 4)
+	viper.SetDefault("DISPATCH_ROBOT_PERCENT_PER_KM", 1.5)
+	viper.SetDefault("DISPATCH_SAFETY_MARGIN", 0.2)
+	viper.SetDefault("DISPATCH_RESERVE_PERCENT", 10)
+	viper.SetDefault("DISPATCH_POLL_INTERVAL", "2s")
+	viper.SetDefault("SCHEDULED_DISPATCH_LEAD", "15m")
+	viper.SetDefault("ROUTE_QUOTE_TTL", "15m")
+	viper.SetDefault("UNPAID_ORDER_TTL", "1h")
+	viper.SetDefault("CANCEL_FEE_QUEUED", 0.1)
+	viper.SetDefault("CANCEL_FEE_IN_PROGRESS", 0.5)
+	viper.SetDefault("CANCEL_FEE_MIN", 0)
+	viper.SetDefault("INSURANCE_RATE", 0.01)
+	viper.SetDefault("INSURANCE_MIN_PREMIUM", 1)
+	viper.SetDefault("INSURANCE_MAX_VALUE", 5000)
+	viper.SetDefault("WEBHOOK_ALLOW_PRIVATE_NETWORKS", false)
+	viper.SetDefault("CHARGE_LOW_PERCENT", 20)
+	viper.SetDefault("CHARGE_RESUME_PERCENT", 90)
+	viper.SetDefault("HEARTBEAT_TIMEOUT", "5m")
+	viper.SetDefault("MACHINE_COMMAND_TTL", "10m")
+	viper.SetDefault("AGENT_GRPC_PORT", "")
+	viper.SetDefault("AGENT_SYNC_INTERVAL", "5s")
+	viper.SetDefault("TRACKING_DRONE_MIN_INTERVAL", "2s")
+	viper.SetDefault("TRACKING_DRONE_MIN_DISTANCE_M", 10)
+	viper.SetDefault("TRACKING_ROBOT_MIN_INTERVAL", "2s")
+	viper.SetDefault("TRACKING_ROBOT_MIN_DISTANCE_M", 5)
+	viper.SetDefault("TRACKING_MAX_GAP", "1m")
+	viper.SetDefault("ARRIVAL_RADIUS_M", 30)
+	viper.SetDefault("TELEMETRY_SNAPSHOT_INTERVAL", "1m")
+	viper.SetDefault("TELEMETRY_RETENTION", "720h")
+	viper.SetDefault("WEATHER_PROVIDER", "")
+	viper.SetDefault("WEATHER_URL", "")
+	viper.SetDefault("WEATHER_DRONE_MAX_WIND_MS", 12)
+	viper.SetDefault("WEATHER_DRONE_MAX_PRECIP_MMH", 4)
+	viper.SetDefault("WEATHER_DRONE_SURCHARGE_WIND_MS", 8)
+	viper.SetDefault("WEATHER_DRONE_SURCHARGE_PRECIP_MMH", 1)
+	viper.SetDefault("WEATHER_DRONE_SURCHARGE", 0.25)
+	viper.SetDefault("WEATHER_ROBOT_MAX_WIND_MS", 0)
+	viper.SetDefault("WEATHER_ROBOT_MAX_PRECIP_MMH", 20)
+	viper.SetDefault("WEATHER_ROBOT_SURCHARGE_WIND_MS", 0)
+	viper.SetDefault("WEATHER_ROBOT_SURCHARGE_PRECIP_MMH", 0)
+	viper.SetDefault("WEATHER_ROBOT_SURCHARGE", 0)
+	viper.SetDefault("SURGE_ENABLED", true)
+	viper.SetDefault("SURGE_RATIO", 1)
+	viper.SetDefault("SURGE_MULTIPLIER", 1.25)
+	viper.SetDefault("SURGE_HIGH_RATIO", 0.5)
+	viper.SetDefault("SURGE_HIGH_MULTIPLIER", 1.5)
+	viper.SetDefault("TAX_RATE", 0)
+
 	err := viper.ReadInConfig() // Find and read the config file
 	if err != nil {
 		// Handle errors reading the config file, but allow it if it's just "not found"
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// cacheInvalidationChannel is the Postgres NOTIFY channel shared by all instances.
+const cacheInvalidationChannel = "cache_invalidation"
+
+// CacheInvalidation is the NOTIFY payload. An empty Key flushes the whole cache.
+type CacheInvalidation struct {
+	Cache string `json:"cache"`
+	Key   string `json:"key,omitempty"`
+}
+
+// CacheBus fans cache invalidations out to every API instance through Postgres
+// LISTEN/NOTIFY. Admin writes call Invalidate; each instance's in-memory cache
+// registers a handler with Subscribe. Because NOTIFY is transactional, an
+// invalidation issued inside WithinTx is only delivered once the change commits.
+type CacheBus struct {
+	pool     *pgxpool.Pool
+	mu       sync.RWMutex
+	handlers map[string][]func(key string)
+}
+
+// NewCacheBus creates a bus on the primary pool. Call Run to start listening.
+func NewCacheBus(pool *pgxpool.Pool) *CacheBus {
+	return &CacheBus{pool: pool, handlers: make(map[string][]func(key string))}
+}
+
+// Subscribe registers fn to be called whenever cache is invalidated, on this
+// or any other instance. Handlers must be fast and must not block.
+func (b *CacheBus) Subscribe(cache string, fn func(key string)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[cache] = append(b.handlers[cache], fn)
+}
+
+// Invalidate notifies all instances (including this one) that key in cache is stale.
+func (b *CacheBus) Invalidate(ctx context.Context, cache, key string) error {
+	payload, err := json.Marshal(CacheInvalidation{Cache: cache, Key: key})
+	if err != nil {
+		return fmt.Errorf("database.Invalidate: %w", err)
+	}
+	if _, err := Conn(ctx, b.pool).Exec(ctx, `SELECT pg_notify($1, $2)`, cacheInvalidationChannel, string(payload)); err != nil {
+		return fmt.Errorf("database.Invalidate: %w", err)
+	}
+	return nil
+}
+
+// Run holds a dedicated connection listening for invalidations until ctx is
+// cancelled, reconnecting with backoff if the connection drops. Notifications
+// sent while disconnected are lost, so every cache is flushed after a reconnect.
+// The backoff starts over once a connection is listening again.
+func (b *CacheBus) Run(ctx context.Context) {
+	backoff := time.Second
+	reconnected := false
+	for ctx.Err() == nil {
+		listened, err := b.listen(ctx, reconnected)
+		if ctx.Err() != nil {
+			return
+		}
+		if listened {
+			backoff = time.Second
+		}
+		log.Printf("cache bus: listener stopped: %v; reconnecting in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+		reconnected = true
+	}
+}
+
+// listen subscribes a dedicated connection and dispatches its notifications
+// until it fails. It reports whether the subscription was established.
+func (b *CacheBus) listen(ctx context.Context, flushFirst bool) (bool, error) {
+	pooled, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	// The connection is dedicated to LISTEN; take it out of the pool so it is
+	// never handed to a query while subscribed.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+cacheInvalidationChannel); err != nil {
+		return false, err
+	}
+	if flushFirst {
+		b.flushAll()
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		var msg CacheInvalidation
+		if err := json.Unmarshal([]byte(n.Payload), &msg); err != nil {
+			log.Printf("cache bus: ignoring malformed payload %q: %v", n.Payload, err)
+			continue
+		}
+		b.dispatch(msg.Cache, msg.Key)
+	}
+}
+
+func (b *CacheBus) dispatch(cache, key string) {
+	b.mu.RLock()
+	handlers := b.handlers[cache]
+	b.mu.RUnlock()
+	for _, fn := range handlers {
+		fn(key)
+	}
+}
+
+func (b *CacheBus) flushAll() {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handlers := range b.handlers {
+		for _, fn := range handlers {
+			fn("")
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migration is one numbered step of internal/migrations.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// LoadMigrations reads NNN_name.up.sql / NNN_name.down.sql pairs from fsys,
+// ordered by version. Other files (seed.sql, README.md) are ignored.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("database.LoadMigrations: %w", err)
+	}
+	byVersion := map[uint]*Migration{}
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		v, err := strconv.ParseUint(m[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("database.LoadMigrations: %s: %w", e.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("database.LoadMigrations: %w", err)
+		}
+		mig, ok := byVersion[uint(v)]
+		if !ok {
+			mig = &Migration{Version: uint(v), Name: m[2]}
+			byVersion[uint(v)] = mig
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("database.LoadMigrations: migration %d has no up file", m.Version)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// ErrDirtySchema is returned when a previous migration failed half-way. Fix the
+// database by hand, then record the real version with Migrator.Force.
+var ErrDirtySchema = errors.New("database schema is dirty")
+
+// migrateLockKey serializes migrators across processes (pg_advisory_lock).
+const migrateLockKey = 7243013001
+
+// Migrator applies migrations using the same schema_migrations table as
+// golang-migrate, so `make migrate-up` and circuitctl can be mixed freely.
+// Each file runs as one simple-protocol batch, i.e. in an implicit transaction.
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// NewMigrator loads the migrations in fsys.
+func NewMigrator(pool *pgxpool.Pool, fsys fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+// Latest returns the highest migration version available.
+func (m *Migrator) Latest() uint {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration and returns the versions applied.
+func (m *Migrator) Up(ctx context.Context) ([]uint, error) {
+	var applied []uint
+	err := m.locked(ctx, func(st SchemaStatus) error {
+		for _, mig := range m.migrations {
+			if mig.Version <= st.Version {
+				continue
+			}
+			if err := m.run(ctx, mig.Version, mig.Up, mig.Version); err != nil {
+				return fmt.Errorf("migration %d_%s up: %w", mig.Version, mig.Name, err)
+			}
+			applied = append(applied, mig.Version)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down rolls back the last steps migrations and returns the versions reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]uint, error) {
+	var reverted []uint
+	err := m.locked(ctx, func(st SchemaStatus) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			mig := m.migrations[i]
+			if mig.Version > st.Version {
+				continue
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", mig.Version, mig.Name)
+			}
+			var prev uint
+			if i > 0 {
+				prev = m.migrations[i-1].Version
+			}
+			if err := m.run(ctx, mig.Version, mig.Down, prev); err != nil {
+				return fmt.Errorf("migration %d_%s down: %w", mig.Version, mig.Name, err)
+			}
+			reverted = append(reverted, mig.Version)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Force records version as applied and clean without running any SQL.
+func (m *Migrator) Force(ctx context.Context, version uint) error {
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+	return m.setVersion(ctx, version, false)
+}
+
+// locked runs fn holding the migration advisory lock, refusing dirty schemas.
+func (m *Migrator) locked(ctx context.Context, fn func(SchemaStatus) error) error {
+	if err := m.ensureTable(ctx); err != nil {
+		return err
+	}
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("database.Migrator: %w", err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, int64(migrateLockKey)); err != nil {
+		return fmt.Errorf("database.Migrator: lock: %w", err)
+	}
+	defer conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, int64(migrateLockKey))
+
+	st, err := CurrentSchema(ctx, m.pool)
+	if err != nil {
+		return err
+	}
+	if st.Dirty {
+		return fmt.Errorf("%w at version %d", ErrDirtySchema, st.Version)
+	}
+	return fn(st)
+}
+
+// run marks version dirty, executes sql and records next as the clean version.
+func (m *Migrator) run(ctx context.Context, version uint, sql string, next uint) error {
+	if err := m.setVersion(ctx, version, true); err != nil {
+		return err
+	}
+	if _, err := m.pool.Exec(ctx, sql); err != nil {
+		return err
+	}
+	return m.setVersion(ctx, next, false)
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("database.Migrator: %w", err)
+	}
+	return nil
+}
+
+// setVersion replaces the single schema_migrations row; version 0 leaves it
+// empty, which golang-migrate reads as "no migrations applied".
+func (m *Migrator) setVersion(ctx context.Context, version uint, dirty bool) error {
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database.Migrator: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `TRUNCATE schema_migrations`); err != nil {
+		return fmt.Errorf("database.Migrator: %w", err)
+	}
+	if version > 0 {
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, int64(version), dirty); err != nil {
+			return fmt.Errorf("database.Migrator: %w", err)
+		}
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"dispatch-and-delivery/internal/migrations"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestMigrationsHaveDownFiles(t *testing.T) {
+	migs, err := LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatalf("LoadMigrations error: %v", err)
+	}
+	for _, m := range migs {
+		if m.Down == "" {
+			t.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+		}
+	}
+	if last := migs[len(migs)-1].Version; last != MaxSchemaVersion {
+		t.Errorf("latest migration = %d; want MaxSchemaVersion %d", last, MaxSchemaVersion)
+	}
+}
+
+// TestMigrateUpDown runs every migration up, down and up again against the
+// database at TEST_DATABASE_URL, which must be empty and have PostGIS
+// available, e.g. a throwaway postgis/postgis container. It is skipped
+// without one.
+func TestMigrateUpDown(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer pool.Close()
+	m, err := NewMigrator(pool, migrations.FS)
+	if err != nil {
+		t.Fatalf("NewMigrator error: %v", err)
+	}
+	if err := m.ensureTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := CurrentSchema(ctx, pool); err != nil || st.Version != 0 {
+		t.Fatalf("schema version = %d, %v; want an empty database", st.Version, err)
+	}
+
+	// Up to the baseline payments table, with a charge on record.
+	until := func(version uint) *Migrator {
+		sub := &Migrator{pool: pool}
+		for _, mig := range m.migrations {
+			if mig.Version <= version {
+				sub.migrations = append(sub.migrations, mig)
+			}
+		}
+		return sub
+	}
+	if _, err := until(52).Up(ctx); err != nil {
+		t.Fatalf("Up to 52: %v", err)
+	}
+	seed := `
+		WITH u AS (
+			INSERT INTO users (nickname, email) VALUES ('mig', 'mig@example.com') RETURNING id
+		), a AS (
+			INSERT INTO addresses (user_id, street_address) SELECT id, '1 Main St' FROM u RETURNING id, user_id
+		), o AS (
+			INSERT INTO orders (user_id, pickup_address_id, dropoff_address_id, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost)
+			SELECT user_id, id, id, 10, 10, 10, 1, 12.50 FROM a RETURNING id
+		)
+		INSERT INTO payments (order_id, external_payment_id, amount, status) SELECT id, 'pi_1', 12.50, 'succeeded' FROM o`
+	if _, err := pool.Exec(ctx, seed); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	// 053 turns it into the first record of the payment log.
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	var kind, provider, ref, status string
+	err = pool.QueryRow(ctx, `SELECT kind, provider, provider_ref, status FROM payments`).Scan(&kind, &provider, &ref, &status)
+	if err != nil {
+		t.Fatalf("read payment: %v", err)
+	}
+	if kind != "CHARGE" || provider != "stripe" || ref != "pi_1" || status != "SUCCEEDED" {
+		t.Errorf("payment = %s %s %s %s; want a SUCCEEDED stripe CHARGE pi_1", kind, provider, ref, status)
+	}
+	// An order can now have several records.
+	_, err = pool.Exec(ctx, `
+		INSERT INTO payments (order_id, user_id, kind, amount, provider, provider_ref, status)
+		SELECT order_id, user_id, 'TIP', 2, 'stripe', 'pi_1', 'SUCCEEDED' FROM payments`)
+	if err != nil {
+		t.Fatalf("second payment of the order: %v", err)
+	}
+
+	if _, err := m.Down(ctx, len(m.migrations)); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	if st, err := CurrentSchema(ctx, pool); err != nil || st.Version != 0 {
+		t.Fatalf("schema version after Down = %d, %v; want 0", st.Version, err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("Up after Down: %v", err)
+	}
+
+	// The development seed loads, twice, and leaves enough to quote and
+	// dispatch: an operational zone serving the machines, and tariffs.
+	body, err := migrations.FS.ReadFile("seed.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, `DELETE FROM pricing_rules`); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := pool.Exec(ctx, string(body)); err != nil {
+			t.Fatalf("seed.sql: %v", err)
+		}
+	}
+	var zones, zoned, tariffs int
+	err = pool.QueryRow(ctx, `
+		SELECT (SELECT count(*) FROM zones WHERE kind = 'OPERATIONAL'),
+		       (SELECT count(*) FROM machines WHERE zone_id IS NOT NULL),
+		       (SELECT count(*) FROM pricing_rules)`).Scan(&zones, &zoned, &tariffs)
+	if err != nil {
+		t.Fatalf("read seed: %v", err)
+	}
+	if zones != 1 || zoned != 2 || tariffs != 2 {
+		t.Errorf("seed left %d zones, %d machines in one, %d tariffs; want 1, 2 and 2", zones, zoned, tariffs)
+	}
+	if _, err := m.Down(ctx, len(m.migrations)); err != nil {
+		t.Fatalf("second Down: %v", err)
+	}
+}
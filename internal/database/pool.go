@@ -0,0 +1,158 @@
+package database
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PoolSettings tunes a pgxpool. Zero values keep the pgx defaults
+// (MaxConns = max(4, NumCPU), which is far too small for quote spikes).
+type PoolSettings struct {
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+
+	// QueryExecMode selects how pgx sends queries: "cache_statement" (default;
+	// prepares and caches every statement per connection), "cache_describe",
+	// "describe_exec", "exec" or "simple_protocol". Behind pgbouncer in
+	// transaction mode, prepared statements do not survive between
+	// transactions, so use "exec" or "simple_protocol" there.
+	QueryExecMode string
+	// StatementCacheCapacity bounds the per-connection statement (or
+	// description) cache. Zero keeps the pgx default of 512.
+	StatementCacheCapacity int
+}
+
+var queryExecModes = map[string]pgx.QueryExecMode{
+	"cache_statement": pgx.QueryExecModeCacheStatement,
+	"cache_describe":  pgx.QueryExecModeCacheDescribe,
+	"describe_exec":   pgx.QueryExecModeDescribeExec,
+	"exec":            pgx.QueryExecModeExec,
+	"simple_protocol": pgx.QueryExecModeSimpleProtocol,
+}
+
+// NewPool parses url, applies settings, connects and pings. Stats for the pool
+// are published under the "db_pools" expvar as name.
+func NewPool(ctx context.Context, name, url string, settings PoolSettings) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("database.NewPool(%s): parse: %w", name, err)
+	}
+	if settings.MaxConns > 0 {
+		cfg.MaxConns = settings.MaxConns
+	}
+	if settings.MinConns > 0 {
+		cfg.MinConns = settings.MinConns
+	}
+	if settings.MaxConnLifetime > 0 {
+		cfg.MaxConnLifetime = settings.MaxConnLifetime
+	}
+	if settings.MaxConnIdleTime > 0 {
+		cfg.MaxConnIdleTime = settings.MaxConnIdleTime
+	}
+	if settings.HealthCheckPeriod > 0 {
+		cfg.HealthCheckPeriod = settings.HealthCheckPeriod
+	}
+	if settings.QueryExecMode != "" {
+		mode, ok := queryExecModes[settings.QueryExecMode]
+		if !ok {
+			return nil, fmt.Errorf("database.NewPool(%s): unknown query exec mode %q", name, settings.QueryExecMode)
+		}
+		cfg.ConnConfig.DefaultQueryExecMode = mode
+	}
+	if settings.StatementCacheCapacity > 0 {
+		cfg.ConnConfig.StatementCacheCapacity = settings.StatementCacheCapacity
+		cfg.ConnConfig.DescriptionCacheCapacity = settings.StatementCacheCapacity
+	}
+	timer := &queryTimer{}
+	cfg.ConnConfig.Tracer = timer
+
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("database.NewPool(%s): %w", name, err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("database.NewPool(%s): ping: %w", name, err)
+	}
+	publishPoolStats(name, pool, timer, cfg.ConnConfig.DefaultQueryExecMode.String())
+	return pool, nil
+}
+
+// PoolStats is the published view of pgxpool.Stat.
+type PoolStats struct {
+	MaxConns      int32 `json:"max_conns"`
+	TotalConns    int32 `json:"total_conns"`
+	InUseConns    int32 `json:"in_use_conns"`
+	IdleConns     int32 `json:"idle_conns"`
+	Constructing  int32 `json:"constructing_conns"`
+	AcquireCount  int64 `json:"acquire_count"`
+	AcquireWaitMs int64 `json:"acquire_wait_ms_total"` // Time spent waiting for a connection.
+	EmptyAcquires int64 `json:"empty_acquire_count"`   // Acquires that had to wait or dial.
+	CanceledWaits int64 `json:"canceled_acquire_count"`
+
+	// Query latency, to compare exec modes and statement cache settings.
+	QueryExecMode string `json:"query_exec_mode"`
+	QueryCount    int64  `json:"query_count"`
+	QueryTimeMs   int64  `json:"query_time_ms_total"`
+	QueryAvgUs    int64  `json:"query_avg_us"`
+}
+
+func poolStats(pool *pgxpool.Pool, timer *queryTimer, mode string) PoolStats {
+	s := pool.Stat()
+	count, total := timer.count.Load(), time.Duration(timer.totalNs.Load())
+	var avg int64
+	if count > 0 {
+		avg = total.Microseconds() / count
+	}
+	return PoolStats{
+		MaxConns:      s.MaxConns(),
+		TotalConns:    s.TotalConns(),
+		InUseConns:    s.AcquiredConns(),
+		IdleConns:     s.IdleConns(),
+		Constructing:  s.ConstructingConns(),
+		AcquireCount:  s.AcquireCount(),
+		AcquireWaitMs: s.AcquireDuration().Milliseconds(),
+		EmptyAcquires: s.EmptyAcquireCount(),
+		CanceledWaits: s.CanceledAcquireCount(),
+		QueryExecMode: mode,
+		QueryCount:    count,
+		QueryTimeMs:   total.Milliseconds(),
+		QueryAvgUs:    avg,
+	}
+}
+
+var publishedPools = expvar.NewMap("db_pools")
+
+func publishPoolStats(name string, pool *pgxpool.Pool, timer *queryTimer, mode string) {
+	publishedPools.Set(name, expvar.Func(func() any { return poolStats(pool, timer, mode) }))
+}
+
+// queryTimer is a pgx.QueryTracer that accumulates query count and latency.
+type queryTimer struct {
+	count   atomic.Int64
+	totalNs atomic.Int64
+}
+
+type queryStartKey struct{}
+
+func (t *queryTimer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, time.Now())
+}
+
+func (t *queryTimer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	t.count.Add(1)
+	t.totalNs.Add(int64(time.Since(start)))
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// BenchmarkQueryExecModes runs the same parameterized query through a pool in
+// every DB_QUERY_EXEC_MODE, against the database at TEST_DATABASE_URL. It is
+// skipped without one. Point it at pgbouncer as well as Postgres directly:
+// the statement-caching modes only pay off on a direct connection.
+//
+//	TEST_DATABASE_URL=postgres://... go test -run '^$' -bench QueryExecModes ./internal/database
+func BenchmarkQueryExecModes(b *testing.B) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		b.Skip("TEST_DATABASE_URL not set")
+	}
+	modes := make([]string, 0, len(queryExecModes))
+	for mode := range queryExecModes {
+		modes = append(modes, mode)
+	}
+	slices.Sort(modes)
+
+	ctx := context.Background()
+	for _, mode := range modes {
+		b.Run(mode, func(b *testing.B) {
+			pool, err := NewPool(ctx, "bench_"+mode, url, PoolSettings{QueryExecMode: mode})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer pool.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := benchQuery(ctx, pool); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// benchQuery is shaped like the order lookups: a few typed parameters and a
+// handful of rows to scan.
+func benchQuery(ctx context.Context, pool *pgxpool.Pool) error {
+	rows, err := pool.Query(ctx, `
+		SELECT n, md5(n::text), now() - make_interval(mins => n)
+		FROM generate_series(1, $1::int) AS n
+		WHERE n % $2::int = 0`, 20, 2)
+	if err != nil {
+		return err
+	}
+	_, err = pgx.CollectRows(rows, pgx.RowToMap)
+	return err
+}
+
+// BenchmarkQueryTimer measures what the latency tracer adds to every query.
+func BenchmarkQueryTimer(b *testing.B) {
+	timer := &queryTimer{}
+	ctx := context.Background()
+	b.ReportAllocs()
+	for b.Loop() {
+		qctx := timer.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{})
+		timer.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+	}
+}
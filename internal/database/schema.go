@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Schema versions (golang-migrate numbers in internal/migrations) this binary
+// can run against.
+//
+//   - MinSchemaVersion is the oldest schema containing every table and column
+//     the code reads or writes. Bump it when code starts using a new migration.
+//   - MaxSchemaVersion is the newest schema the code has been verified with.
+//     Expand-only migrations (new tables, nullable/defaulted columns) are safe
+//     for older binaries, so bump it together with the release that ships them.
+//
+// Columns are removed or renamed with expand/contract: release N adds the new
+// column and writes both, release N+1 reads only the new one, and the contract
+// migration that drops the old column ships only once no running binary has
+// MinSchemaVersion below it. See internal/migrations/README.md.
+const (
+	MinSchemaVersion = 58
+	MaxSchemaVersion = 58
+)
+
+// ErrSchemaMismatch is returned when the database schema is outside the range
+// supported by this binary, or a migration was left half-applied.
+var ErrSchemaMismatch = errors.New("database schema version mismatch")
+
+// SchemaStatus is the state recorded by golang-migrate in schema_migrations.
+type SchemaStatus struct {
+	Version uint
+	Dirty   bool
+}
+
+// CurrentSchema reads the applied migration version.
+func CurrentSchema(ctx context.Context, pool *pgxpool.Pool) (SchemaStatus, error) {
+	var st SchemaStatus
+	var version int64
+	err := pool.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &st.Dirty)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return st, nil // No migrations applied yet.
+		}
+		return st, fmt.Errorf("database.CurrentSchema: %w", err)
+	}
+	st.Version = uint(version)
+	return st, nil
+}
+
+// CheckSchema verifies that the applied schema falls within
+// [MinSchemaVersion, MaxSchemaVersion] and is not dirty.
+func CheckSchema(ctx context.Context, pool *pgxpool.Pool) (SchemaStatus, error) {
+	st, err := CurrentSchema(ctx, pool)
+	if err != nil {
+		return st, err
+	}
+	switch {
+	case st.Dirty:
+		return st, fmt.Errorf("%w: migration %d is dirty (partially applied)", ErrSchemaMismatch, st.Version)
+	case st.Version < MinSchemaVersion:
+		return st, fmt.Errorf("%w: schema is at %d, binary needs at least %d (run migrations first)",
+			ErrSchemaMismatch, st.Version, MinSchemaVersion)
+	case st.Version > MaxSchemaVersion:
+		return st, fmt.Errorf("%w: schema is at %d, binary supports at most %d (deploy a newer build)",
+			ErrSchemaMismatch, st.Version, MaxSchemaVersion)
+	}
+	return st, nil
+}
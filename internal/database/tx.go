@@ -0,0 +1,80 @@
+// Package database holds the pieces of Postgres plumbing shared by all modules,
+// most importantly the transaction manager that lets one service call span
+// several repositories (and modules) atomically.
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Executor represents anything that can execute a SQL query,
+// which includes both a connection pool and a transaction.
+type Executor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type txKey struct{}
+
+// Transactor runs a function inside a unit of work. Services depend on this
+// interface rather than on *TxManager so they can be tested without a database.
+type Transactor interface {
+	WithinTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// TxManager starts transactions on the primary pool and carries them through
+// the context, so every repository called with that context joins the same
+// transaction.
+type TxManager struct {
+	pool *pgxpool.Pool
+}
+
+// NewTxManager creates a transaction manager for the given (primary) pool.
+func NewTxManager(pool *pgxpool.Pool) *TxManager {
+	return &TxManager{pool: pool}
+}
+
+// WithinTx runs fn in a transaction. The transaction commits if fn returns nil
+// and rolls back otherwise (including on panic). Nested calls reuse the
+// outer transaction, so the outermost caller decides the commit.
+func (m *TxManager) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := TxFromContext(ctx); ok {
+		return fn(ctx)
+	}
+
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("database.WithinTx: begin: %w", err)
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback(ctx)
+
+	if err := fn(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("database.WithinTx: commit: %w", err)
+	}
+	return nil
+}
+
+// TxFromContext returns the transaction carried by ctx, if any.
+func TxFromContext(ctx context.Context) (pgx.Tx, bool) {
+	tx, ok := ctx.Value(txKey{}).(pgx.Tx)
+	return tx, ok
+}
+
+// Conn returns the transaction carried by ctx, or fallback when the call is
+// not part of a unit of work. Repositories use it for every primary-pool query.
+func Conn(ctx context.Context, fallback *pgxpool.Pool) Executor {
+	if tx, ok := TxFromContext(ctx); ok {
+		return tx
+	}
+	return fallback
+}
@@ -0,0 +1,201 @@
+// Package i18n localizes user-facing API error messages. Error codes stay
+// stable across languages; only the human-readable text changes with the
+// caller's Accept-Language header.
+package i18n
+
+import (
+	"strings"
+
+	"dispatch-and-delivery/internal/models"
+
+	"golang.org/x/text/language"
+)
+
+// Supported locales. English is the default and the language the code is
+// written in, so English messages are never replaced.
+var (
+	English           = language.English
+	SimplifiedChinese = language.SimplifiedChinese
+	Spanish           = language.Spanish
+
+	supported = []language.Tag{English, SimplifiedChinese, Spanish}
+	matcher   = language.NewMatcher(supported)
+)
+
+// Negotiate picks the best supported locale for an Accept-Language header.
+func Negotiate(acceptLanguage string) language.Tag {
+	if acceptLanguage == "" {
+		return English
+	}
+	_, idx, confidence := matcher.Match(parseAcceptLanguage(acceptLanguage)...)
+	if confidence == language.No {
+		return English
+	}
+	return supported[idx]
+}
+
+func parseAcceptLanguage(header string) []language.Tag {
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return nil
+	}
+	return tags
+}
+
+// Localize rewrites the message and field messages of apiErr for tag.
+// Text for codes missing from the catalog is left in English.
+func Localize(apiErr *models.APIError, tag language.Tag) *models.APIError {
+	if tag == English {
+		return apiErr
+	}
+	cat, ok := catalogs[tag]
+	if !ok {
+		return apiErr
+	}
+
+	out := *apiErr
+	if msg, ok := cat.codes[apiErr.Code]; ok {
+		out.Message = msg
+	}
+	if len(apiErr.Fields) > 0 {
+		out.Fields = make([]models.FieldError, len(apiErr.Fields))
+		for i, fe := range apiErr.Fields {
+			if tmpl, ok := cat.rules[fe.Rule]; ok {
+				fe.Message = renderRule(tmpl, fe)
+			}
+			out.Fields[i] = fe
+		}
+	}
+	return &out
+}
+
+// renderRule fills {field} and {param} placeholders in a rule template.
+func renderRule(tmpl string, fe models.FieldError) string {
+	param := fe.Param
+	if fe.Rule == "oneof" {
+		param = strings.ReplaceAll(param, " ", ", ")
+	}
+	return strings.NewReplacer("{field}", fe.Field, "{param}", param).Replace(tmpl)
+}
+
+type catalog struct {
+	codes map[models.ErrorCode]string
+	rules map[string]string // validation rule -> template with {field}/{param}
+}
+
+var catalogs = map[language.Tag]catalog{
+	SimplifiedChinese: {
+		codes: map[models.ErrorCode]string{
+			models.CodeInvalidRequest:           "请求无效",
+			models.CodeValidationFailed:         "请求参数校验失败",
+			models.CodeUnauthorized:             "未登录或登录已失效",
+			models.CodeForbidden:                "没有权限执行此操作",
+			models.CodeNotFound:                 "资源不存在",
+			models.CodeMethodNotAllowed:         "不支持该请求方法",
+			models.CodeConflict:                 "资源冲突",
+			models.CodeUnsupportedMediaType:     "不支持的 Content-Type",
+			models.CodePayloadTooLarge:          "请求体过大",
+			models.CodeTooManyRequests:          "请求过于频繁，请稍后再试",
+			models.CodeInternal:                 "服务器内部错误",
+			models.CodeTimeout:                  "请求处理超时",
+			models.CodeUnavailable:              "服务暂时不可用，请稍后再试",
+			models.CodeInactiveAccount:          "账户尚未激活",
+			models.CodeInvalidToken:             "令牌无效",
+			models.CodeTokenExpired:             "令牌已过期",
+			models.CodeInvalidCSRFToken:         "CSRF 令牌缺失或无效",
+			models.CodeInvalidCredentials:       "邮箱或密码错误",
+			models.CodeEmailTaken:               "该邮箱已被注册",
+			models.CodeNicknameTaken:            "该昵称已被使用",
+			models.CodeNoFieldsToUpdate:         "没有需要更新的字段",
+			models.CodeOrderCannotBeCancelled:   "订单当前状态无法取消",
+			models.CodeOrderCannotBePaid:        "订单当前状态无法支付",
+			models.CodeOrderStatusChanged:       "订单状态已变更，请刷新后重试",
+			models.CodeRouteOptionExpired:       "报价已过期，请重新获取报价",
+			models.CodeRouteOptionNotFound:      "报价不存在或已使用，请重新获取报价",
+			models.CodePromoCodeInvalid:         "优惠码无效或已过期",
+			models.CodePromoCodeExhausted:       "优惠码已达到使用次数上限",
+			models.CodePromoCodeAlreadyApplied:  "该订单已使用其他优惠码",
+			models.CodePaymentMethodNotFound:    "找不到已保存的支付方式",
+			models.CodePaymentFailed:            "支付失败，请更换支付方式后重试",
+			models.CodePaymentUnavailable:       "暂时无法处理支付，请稍后重试",
+			models.CodeNoPaymentAction:          "该订单没有待验证的支付",
+			models.CodePaymentActionPending:     "支付尚未完成验证",
+			models.CodeCannotTip:                "订单送达后才能添加小费",
+			models.CodeTipAlreadyAdded:          "该订单已添加小费",
+			models.CodeCannotSubmitFeedback:     "订单送达后才能评价",
+			models.CodeFeedbackAlreadySubmitted: "该订单已评价",
+			models.CodePackageTooLarge:          "包裹超出可配送的尺寸或重量",
+			models.CodeNoMachineAvailable:       "暂无可用的配送机器",
+		},
+		rules: map[string]string{
+			"required": "{field} 为必填项",
+			"email":    "{field} 必须是有效的邮箱地址",
+			"url":      "{field} 必须是有效的 URL",
+			"min":      "{field} 不能小于 {param}",
+			"max":      "{field} 不能大于 {param}",
+			"gt":       "{field} 必须大于 {param}",
+			"gte":      "{field} 必须大于或等于 {param}",
+			"lt":       "{field} 必须小于 {param}",
+			"lte":      "{field} 必须小于或等于 {param}",
+			"oneof":    "{field} 必须是 [{param}] 之一",
+			"unknown":  "{field} 不是可识别的字段",
+		},
+	},
+	Spanish: {
+		codes: map[models.ErrorCode]string{
+			models.CodeInvalidRequest:           "Solicitud no válida",
+			models.CodeValidationFailed:         "La validación de la solicitud falló",
+			models.CodeUnauthorized:             "No autenticado o sesión caducada",
+			models.CodeForbidden:                "No tienes permiso para realizar esta acción",
+			models.CodeNotFound:                 "Recurso no encontrado",
+			models.CodeMethodNotAllowed:         "Método no permitido",
+			models.CodeConflict:                 "Conflicto con el estado actual del recurso",
+			models.CodeUnsupportedMediaType:     "Content-Type no admitido",
+			models.CodePayloadTooLarge:          "El cuerpo de la solicitud es demasiado grande",
+			models.CodeTooManyRequests:          "Demasiadas solicitudes, inténtalo más tarde",
+			models.CodeInternal:                 "Error interno del servidor",
+			models.CodeTimeout:                  "La solicitud tardó demasiado",
+			models.CodeUnavailable:              "Servicio no disponible temporalmente, inténtalo más tarde",
+			models.CodeInactiveAccount:          "La cuenta no está activada",
+			models.CodeInvalidToken:             "Token no válido",
+			models.CodeTokenExpired:             "El token ha caducado",
+			models.CodeInvalidCSRFToken:         "Token CSRF ausente o no válido",
+			models.CodeInvalidCredentials:       "Correo electrónico o contraseña incorrectos",
+			models.CodeEmailTaken:               "El correo electrónico ya está en uso",
+			models.CodeNicknameTaken:            "El apodo ya está en uso",
+			models.CodeNoFieldsToUpdate:         "No hay campos para actualizar",
+			models.CodeOrderCannotBeCancelled:   "El pedido no se puede cancelar en su estado actual",
+			models.CodeOrderCannotBePaid:        "El pedido no se puede pagar en su estado actual",
+			models.CodeOrderStatusChanged:       "El estado del pedido ha cambiado; vuelve a cargarlo e inténtalo de nuevo",
+			models.CodeRouteOptionExpired:       "La cotización ha caducado; solicita una nueva",
+			models.CodeRouteOptionNotFound:      "La cotización no existe o ya se usó; solicita una nueva",
+			models.CodePromoCodeInvalid:         "El código promocional no es válido o ha caducado",
+			models.CodePromoCodeExhausted:       "El código promocional ya no tiene usos disponibles",
+			models.CodePromoCodeAlreadyApplied:  "Ya se aplicó otro código promocional a este pedido",
+			models.CodePaymentMethodNotFound:    "No se encontró el método de pago guardado",
+			models.CodePaymentFailed:            "El pago no se pudo realizar; inténtalo con otro método de pago",
+			models.CodePaymentUnavailable:       "No se pudo procesar el pago en este momento; inténtalo de nuevo",
+			models.CodeNoPaymentAction:          "El pedido no tiene ningún pago pendiente de autenticación",
+			models.CodePaymentActionPending:     "El pago aún no se ha autenticado",
+			models.CodeCannotTip:                "Solo puedes dejar propina en pedidos entregados",
+			models.CodeTipAlreadyAdded:          "Ya dejaste propina en este pedido",
+			models.CodeCannotSubmitFeedback:     "Solo puedes valorar pedidos entregados",
+			models.CodeFeedbackAlreadySubmitted: "Ya has valorado este pedido",
+			models.CodePackageTooLarge:          "El paquete supera el tamaño o peso permitido",
+			models.CodeNoMachineAvailable:       "No hay máquinas de reparto disponibles",
+		},
+		rules: map[string]string{
+			"required": "{field} es obligatorio",
+			"email":    "{field} debe ser un correo electrónico válido",
+			"url":      "{field} debe ser una URL válida",
+			"min":      "{field} debe ser al menos {param}",
+			"max":      "{field} debe ser como máximo {param}",
+			"gt":       "{field} debe ser mayor que {param}",
+			"gte":      "{field} debe ser mayor o igual que {param}",
+			"lt":       "{field} debe ser menor que {param}",
+			"lte":      "{field} debe ser menor o igual que {param}",
+			"oneof":    "{field} debe ser uno de [{param}]",
+			"unknown":  "{field} no es un campo reconocido",
+		},
+	},
+}
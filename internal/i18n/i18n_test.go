@@ -0,0 +1,79 @@
+package i18n
+
+import (
+	"net/http"
+	"testing"
+
+	"dispatch-and-delivery/internal/models"
+
+	"golang.org/x/text/language"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		header string
+		want   language.Tag
+	}{
+		{"", English},
+		{"en-US,en;q=0.9", English},
+		{"zh-CN,zh;q=0.9,en;q=0.8", SimplifiedChinese},
+		{"zh-Hans", SimplifiedChinese},
+		{"es", Spanish},
+		{"es-MX", Spanish},
+		{"fr-FR, es;q=0.5", Spanish},
+		{"fr-FR", English},
+		{"*", English},
+		{"en;q=0.1, zh-CN;q=0.9", SimplifiedChinese},
+		{";;q=bogus", English},
+		{"zh-CN;q=abc", English},
+	}
+	for _, tt := range cases {
+		if got := Negotiate(tt.header); got != tt.want {
+			t.Errorf("Negotiate(%q) = %s; want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	validation := models.ValidationFailed(
+		models.FieldError{Field: "rating", Rule: "max", Param: "5", Message: "rating must be at most 5"},
+		models.FieldError{Field: "size", Rule: "oneof", Param: "S M L", Message: "size must be one of [S, M, L]"},
+		models.FieldError{Field: "pickup", Rule: "future", Message: "pickup must be in the future"},
+	)
+	cases := []struct {
+		name   string
+		err    *models.APIError
+		tag    language.Tag
+		msg    string
+		fields []string
+	}{
+		{"english is untouched", validation, English, "validation failed",
+			[]string{"rating must be at most 5", "size must be one of [S, M, L]", "pickup must be in the future"}},
+		{"chinese", validation, SimplifiedChinese, "请求参数校验失败",
+			[]string{"rating 不能大于 5", "size 必须是 [S, M, L] 之一", "pickup must be in the future"}},
+		{"spanish", validation, Spanish, "La validación de la solicitud falló",
+			[]string{"rating debe ser como máximo 5", "size debe ser uno de [S, M, L]", "pickup must be in the future"}},
+		{"code without a translation", models.NewAPIError(http.StatusTeapot, "teapot", "short and stout"), Spanish, "short and stout", nil},
+		{"unsupported locale", models.NewAPIError(http.StatusNotFound, models.CodeNotFound, "not found"), language.French, "not found", nil},
+	}
+	for _, tt := range cases {
+		got := Localize(tt.err, tt.tag)
+		if got.Message != tt.msg {
+			t.Errorf("%s: message = %q; want %q", tt.name, got.Message, tt.msg)
+		}
+		if len(got.Fields) != len(tt.fields) {
+			t.Errorf("%s: %d fields; want %d", tt.name, len(got.Fields), len(tt.fields))
+			continue
+		}
+		for i, want := range tt.fields {
+			if got.Fields[i].Message != want {
+				t.Errorf("%s: field %d message = %q; want %q", tt.name, i, got.Fields[i].Message, want)
+			}
+		}
+	}
+
+	// The shared error is copied, not rewritten in place.
+	if validation.Message != "validation failed" || validation.Fields[0].Message != "rating must be at most 5" {
+		t.Errorf("Localize modified its argument: %+v", validation)
+	}
+}
@@ -0,0 +1,11 @@
+CREATE TABLE outbox_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    aggregate_type VARCHAR(50) NOT NULL, -- e.g. 'order'
+    aggregate_id UUID NOT NULL,
+    event_type VARCHAR(100) NOT NULL, -- e.g. 'order.confirmed'
+    payload JSONB NOT NULL DEFAULT '{}'::jsonb,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    published_at TIMESTAMPTZ -- NULL until a relay has delivered the event
+);
+
+CREATE INDEX idx_outbox_events_unpublished ON outbox_events(created_at) WHERE published_at IS NULL;
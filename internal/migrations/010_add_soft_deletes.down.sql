@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_machines_status_active;
+DROP INDEX IF EXISTS idx_addresses_user_id_active;
+ALTER TABLE machines DROP COLUMN deleted_at;
+ALTER TABLE addresses DROP COLUMN deleted_at;
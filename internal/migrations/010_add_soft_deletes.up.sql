@@ -0,0 +1,9 @@
+-- Soft deletes: rows are kept so historical orders can still resolve their
+-- addresses and machines. Promo codes (051) are not soft deleted: admins disable
+-- them with promo_codes.disabled_at, and disabled codes stay listed for admins.
+ALTER TABLE addresses ADD COLUMN deleted_at TIMESTAMPTZ;
+ALTER TABLE machines ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- Most queries only look at live rows.
+CREATE INDEX IF NOT EXISTS idx_addresses_user_id_active ON addresses(user_id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_machines_status_active ON machines(status) WHERE deleted_at IS NULL;
@@ -0,0 +1,11 @@
+CREATE TABLE job_runs (
+    id BIGSERIAL PRIMARY KEY,
+    job_name VARCHAR(100) NOT NULL, -- e.g. 'scheduler.prune_history'
+    instance VARCHAR(255) NOT NULL, -- host:pid of the API instance that ran it
+    status VARCHAR(20) NOT NULL DEFAULT 'running', -- running, succeeded, failed
+    error TEXT,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_job_runs_job_started ON job_runs(job_name, started_at DESC);
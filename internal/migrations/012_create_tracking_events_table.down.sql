@@ -0,0 +1 @@
+DROP TABLE tracking_events;
@@ -0,0 +1,12 @@
+-- tracking_events was queried by the logistics module but never created by a
+-- migration; IF NOT EXISTS keeps databases where it was created by hand intact.
+CREATE TABLE IF NOT EXISTS tracking_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    machine_id UUID REFERENCES machines(id) ON DELETE SET NULL,
+    location GEOGRAPHY(Point, 4326) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Keyset pagination reads (order_id, created_at, id) in order.
+CREATE INDEX IF NOT EXISTS idx_tracking_events_order_keyset ON tracking_events(order_id, created_at, id);
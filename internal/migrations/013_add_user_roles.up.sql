@@ -0,0 +1,5 @@
+-- RBAC: the role is copied into the JWT at login and checked by AdminRequired.
+-- Promote an operator with: UPDATE users SET role = 'ADMIN' WHERE email = '...';
+CREATE TYPE user_role AS ENUM ('CUSTOMER', 'ADMIN');
+
+ALTER TABLE users ADD COLUMN role user_role NOT NULL DEFAULT 'CUSTOMER';
@@ -0,0 +1,8 @@
+-- Enum values cannot be dropped; demote support users and rebuild the type.
+UPDATE users SET role = 'CUSTOMER' WHERE role = 'SUPPORT';
+ALTER TABLE users ALTER COLUMN role DROP DEFAULT;
+ALTER TYPE user_role RENAME TO user_role_old;
+CREATE TYPE user_role AS ENUM ('CUSTOMER', 'ADMIN');
+ALTER TABLE users ALTER COLUMN role TYPE user_role USING role::text::user_role;
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'CUSTOMER';
+DROP TYPE user_role_old;
@@ -0,0 +1,2 @@
+-- Support staff can read any order but cannot change it.
+ALTER TYPE user_role ADD VALUE IF NOT EXISTS 'SUPPORT';
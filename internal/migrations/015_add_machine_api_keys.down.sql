@@ -0,0 +1 @@
+ALTER TABLE machines DROP COLUMN api_key_hash;
@@ -0,0 +1,5 @@
+-- Machines authenticate telemetry with an API key. Only its SHA-256 hex digest
+-- is stored; the key itself is shown once when an administrator rotates it.
+ALTER TABLE machines ADD COLUMN api_key_hash CHAR(64);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_machines_api_key_hash ON machines(api_key_hash) WHERE api_key_hash IS NOT NULL;
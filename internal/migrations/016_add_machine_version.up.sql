@@ -0,0 +1,3 @@
+-- Optimistic concurrency: every machine write bumps version, and UpdateMachine
+-- only succeeds if the row still has the version the caller read.
+ALTER TABLE machines ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_machines_idle_location;
+ALTER TABLE addresses DROP COLUMN location;
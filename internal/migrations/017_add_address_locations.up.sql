@@ -0,0 +1,7 @@
+-- Optional coordinates for addresses. Dispatch sends the idle machine nearest
+-- to the pickup point (KNN on current_location) when the point is known.
+ALTER TABLE addresses ADD COLUMN location GEOGRAPHY(Point, 4326);
+
+-- Nearest-idle-machine lookups only ever scan idle, live machines.
+CREATE INDEX IF NOT EXISTS idx_machines_idle_location ON machines USING GIST (current_location)
+    WHERE status = 'IDLE' AND deleted_at IS NULL;
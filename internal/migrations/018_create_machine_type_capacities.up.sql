@@ -0,0 +1,15 @@
+-- Largest package each machine type can carry. Quotes only offer machine
+-- types the package fits, and dispatch only sends machines of those types.
+-- Dimensions are in meters, like models.Dimensions.
+CREATE TABLE machine_type_capacities (
+    type machine_type PRIMARY KEY,
+    max_weight_kg DECIMAL(10, 2) NOT NULL CHECK (max_weight_kg > 0),
+    max_length_m DECIMAL(10, 2) NOT NULL CHECK (max_length_m > 0),
+    max_width_m DECIMAL(10, 2) NOT NULL CHECK (max_width_m > 0),
+    max_height_m DECIMAL(10, 2) NOT NULL CHECK (max_height_m > 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO machine_type_capacities (type, max_weight_kg, max_length_m, max_width_m, max_height_m) VALUES
+    ('DRONE', 3.0, 0.5, 0.5, 0.5),
+    ('ROBOT', 10.0, 1.0, 1.0, 1.0);
@@ -0,0 +1,9 @@
+-- Enum values cannot be dropped; return parked orders to CONFIRMED and rebuild the type.
+DROP TABLE IF EXISTS assignment_queue;
+UPDATE orders SET status = 'CONFIRMED' WHERE status = 'ASSIGNMENT_PENDING';
+ALTER TABLE orders ALTER COLUMN status DROP DEFAULT;
+ALTER TYPE order_status RENAME TO order_status_old;
+CREATE TYPE order_status AS ENUM ('PENDING_PAYMENT', 'CONFIRMED', 'IN_PROGRESS', 'DELIVERED', 'CANCELLED', 'FAILED');
+ALTER TABLE orders ALTER COLUMN status TYPE order_status USING status::text::order_status;
+ALTER TABLE orders ALTER COLUMN status SET DEFAULT 'PENDING_PAYMENT';
+DROP TYPE order_status_old;
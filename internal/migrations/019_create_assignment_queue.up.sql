@@ -0,0 +1,14 @@
+-- Paid orders that found no idle machine wait in ASSIGNMENT_PENDING while a
+-- background job retries the assignment. The new enum value cannot be used in
+-- the same transaction that adds it, so nothing below refers to it.
+ALTER TYPE order_status ADD VALUE IF NOT EXISTS 'ASSIGNMENT_PENDING' AFTER 'CONFIRMED';
+
+CREATE TABLE assignment_queue (
+    order_id UUID PRIMARY KEY REFERENCES orders(id) ON DELETE CASCADE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT,
+    enqueued_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_assignment_queue_next_attempt ON assignment_queue(next_attempt_at);
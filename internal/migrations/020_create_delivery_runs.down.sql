@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS delivery_run_stops;
+DROP TABLE IF EXISTS delivery_runs;
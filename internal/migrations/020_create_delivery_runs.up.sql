@@ -0,0 +1,24 @@
+-- Multi-stop batching: one ground robot carries several orders in a single run.
+CREATE TABLE delivery_runs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    machine_id UUID NOT NULL REFERENCES machines(id) ON DELETE RESTRICT,
+    distance_meters INTEGER NOT NULL,
+    duration_seconds INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_delivery_runs_machine_id ON delivery_runs(machine_id);
+
+-- Stops are visited in seq order; every order in a run has one PICKUP stop
+-- followed (not necessarily directly) by one DROPOFF stop.
+CREATE TABLE delivery_run_stops (
+    run_id UUID NOT NULL REFERENCES delivery_runs(id) ON DELETE CASCADE,
+    seq INTEGER NOT NULL CHECK (seq > 0),
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    kind VARCHAR(10) NOT NULL CHECK (kind IN ('PICKUP', 'DROPOFF')),
+    location GEOGRAPHY(Point, 4326) NOT NULL,
+    distance_meters INTEGER NOT NULL,
+    eta TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (run_id, seq),
+    UNIQUE (run_id, order_id, kind)
+);
+CREATE INDEX IF NOT EXISTS idx_delivery_run_stops_order_id ON delivery_run_stops(order_id);
@@ -0,0 +1,11 @@
+-- Geofences checked when quoting: drones may not cross NO_FLY zones, and
+-- robots must stay inside the union of SERVICE_AREA zones (when any exist).
+CREATE TABLE zones (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(100) NOT NULL,
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('NO_FLY', 'SERVICE_AREA')),
+    area GEOGRAPHY(Polygon, 4326) NOT NULL CHECK (ST_IsValid(area::geometry)),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_zones_area ON zones USING GIST (area);
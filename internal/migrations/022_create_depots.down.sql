@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS charge_trips;
+DROP TABLE IF EXISTS depots;
@@ -0,0 +1,19 @@
+-- Charging depots: machines with a low battery are sent to the nearest one.
+CREATE TABLE depots (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(100) NOT NULL,
+    location GEOGRAPHY(Point, 4326) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_depots_location ON depots USING GIST (location);
+
+-- The trip a CHARGING machine is making back to its depot. Removed once the
+-- machine has recharged and returns to IDLE.
+CREATE TABLE charge_trips (
+    machine_id UUID PRIMARY KEY REFERENCES machines(id) ON DELETE CASCADE,
+    depot_id UUID NOT NULL REFERENCES depots(id) ON DELETE CASCADE,
+    distance_meters INTEGER NOT NULL,
+    eta TIMESTAMPTZ NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_charge_trips_depot_id ON charge_trips(depot_id);
@@ -0,0 +1 @@
+ALTER TABLE machines DROP COLUMN max_weight_kg;
@@ -0,0 +1,3 @@
+-- Optional per-machine payload limit, set when a machine is registered. NULL
+-- means the limit for its type in machine_type_capacities.
+ALTER TABLE machines ADD COLUMN max_weight_kg DECIMAL(10, 2) CHECK (max_weight_kg > 0);
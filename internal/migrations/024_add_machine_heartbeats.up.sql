@@ -0,0 +1,8 @@
+-- Machines ping a heartbeat endpoint; a background job marks machines whose
+-- last heartbeat is too old as OFFLINE so they are not dispatched. The new
+-- enum value cannot be used in the same transaction that adds it, so nothing
+-- below refers to it.
+ALTER TYPE machine_status ADD VALUE IF NOT EXISTS 'OFFLINE';
+
+-- NULL until the first heartbeat; the stale check then falls back to created_at.
+ALTER TABLE machines ADD COLUMN last_heartbeat_at TIMESTAMPTZ;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_routes_order_created;
@@ -0,0 +1,2 @@
+-- The live ETA reads an order's newest route on every tracking update.
+CREATE INDEX IF NOT EXISTS idx_routes_order_created ON routes(order_id, created_at);
@@ -0,0 +1,8 @@
+-- Enum values cannot be dropped; return arrived orders to IN_PROGRESS and rebuild the type.
+UPDATE orders SET status = 'IN_PROGRESS' WHERE status = 'ARRIVED';
+ALTER TABLE orders ALTER COLUMN status DROP DEFAULT;
+ALTER TYPE order_status RENAME TO order_status_old;
+CREATE TYPE order_status AS ENUM ('PENDING_PAYMENT', 'CONFIRMED', 'ASSIGNMENT_PENDING', 'IN_PROGRESS', 'DELIVERED', 'CANCELLED', 'FAILED');
+ALTER TABLE orders ALTER COLUMN status TYPE order_status USING status::text::order_status;
+ALTER TABLE orders ALTER COLUMN status SET DEFAULT 'PENDING_PAYMENT';
+DROP TYPE order_status_old;
@@ -0,0 +1,4 @@
+-- Orders move to ARRIVED when tracking shows the machine inside the dropoff
+-- geofence, and to DELIVERED once the recipient confirms. The new enum value
+-- cannot be used in the same transaction that adds it, so nothing below refers to it.
+ALTER TYPE order_status ADD VALUE IF NOT EXISTS 'ARRIVED' AFTER 'IN_PROGRESS';
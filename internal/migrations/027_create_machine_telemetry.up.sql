@@ -0,0 +1,13 @@
+-- Periodic snapshots of every machine's location, battery and status, written
+-- by a background job and read back (downsampled) for fleet history charts.
+-- Old rows are pruned by the same job, so the table stays bounded.
+CREATE TABLE machine_telemetry (
+    id BIGSERIAL PRIMARY KEY,
+    machine_id UUID NOT NULL REFERENCES machines(id) ON DELETE CASCADE,
+    location GEOGRAPHY(Point, 4326),
+    battery_level INTEGER NOT NULL,
+    status machine_status NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_machine_telemetry_machine_time ON machine_telemetry(machine_id, recorded_at);
+CREATE INDEX IF NOT EXISTS idx_machine_telemetry_recorded_at ON machine_telemetry(recorded_at);
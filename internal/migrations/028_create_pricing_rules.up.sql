@@ -0,0 +1,30 @@
+-- Quote prices: (base_fare + per_km * km) * multiplier, using the most
+-- specific rule for the machine type whose distance tier [min_km, max_km)
+-- and hour window [start_hour, end_hour) contain the delivery. Rules with an
+-- hour window beat all-day rules; a window with end_hour <= start_hour wraps
+-- past midnight.
+CREATE TABLE pricing_rules (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    machine_type machine_type NOT NULL,
+    min_km DECIMAL(10, 3) NOT NULL DEFAULT 0 CHECK (min_km >= 0),
+    max_km DECIMAL(10, 3) CHECK (max_km > min_km),
+    start_hour SMALLINT CHECK (start_hour BETWEEN 0 AND 23),
+    end_hour SMALLINT CHECK (end_hour BETWEEN 0 AND 24),
+    base_fare DECIMAL(10, 2) NOT NULL CHECK (base_fare >= 0),
+    per_km DECIMAL(10, 2) NOT NULL CHECK (per_km >= 0),
+    multiplier DECIMAL(6, 3) NOT NULL DEFAULT 1 CHECK (multiplier > 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK ((start_hour IS NULL) = (end_hour IS NULL)),
+    CHECK (start_hour <> end_hour)
+);
+
+-- The fares that were previously hard-coded: a flat 1.2x base fare in the
+-- 08:00-11:00 and 17:00-20:00 peaks.
+INSERT INTO pricing_rules (machine_type, start_hour, end_hour, base_fare, per_km, multiplier) VALUES
+    ('DRONE', NULL, NULL, 2.00, 0.50, 1),
+    ('DRONE', 8, 11, 2.00, 0, 1.2),
+    ('DRONE', 17, 20, 2.00, 0, 1.2),
+    ('ROBOT', NULL, NULL, 1.00, 0.30, 1),
+    ('ROBOT', 8, 11, 1.00, 0, 1.2),
+    ('ROBOT', 17, 20, 1.00, 0, 1.2);
@@ -0,0 +1,10 @@
+-- Routes with waypoints (e.g. pickup -> depot -> dropoff) are split into
+-- legs, one per stop-to-stop segment, numbered from 1 in travel order.
+CREATE TABLE route_legs (
+    route_id UUID NOT NULL REFERENCES routes(id) ON DELETE CASCADE,
+    seq INTEGER NOT NULL CHECK (seq >= 1),
+    polyline TEXT NOT NULL DEFAULT '',
+    distance_meters INTEGER NOT NULL,
+    duration_seconds INTEGER NOT NULL,
+    PRIMARY KEY (route_id, seq)
+);
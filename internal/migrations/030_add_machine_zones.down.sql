@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_machines_zone;
+ALTER TABLE machines DROP COLUMN zone_id;
+
+DELETE FROM zones WHERE kind = 'OPERATIONAL';
+ALTER TABLE zones DROP CONSTRAINT IF EXISTS zones_kind_check;
+ALTER TABLE zones ADD CONSTRAINT zones_kind_check CHECK (kind IN ('NO_FLY', 'SERVICE_AREA'));
@@ -0,0 +1,7 @@
+-- Operational zones partition the fleet: a machine belongs to at most one,
+-- and orders picked up inside a zone are only assigned to its machines.
+ALTER TABLE zones DROP CONSTRAINT IF EXISTS zones_kind_check;
+ALTER TABLE zones ADD CONSTRAINT zones_kind_check CHECK (kind IN ('NO_FLY', 'SERVICE_AREA', 'OPERATIONAL'));
+
+ALTER TABLE machines ADD COLUMN zone_id UUID REFERENCES zones(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_machines_zone ON machines(zone_id) WHERE zone_id IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS machine_commands;
+ALTER TABLE machines DROP COLUMN IF EXISTS firmware_version;
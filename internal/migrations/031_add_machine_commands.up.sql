@@ -0,0 +1,23 @@
+-- Firmware version as last reported by the machine; NULL until it reports one.
+ALTER TABLE machines ADD COLUMN firmware_version VARCHAR(64);
+
+-- Commands queued by operators for a machine. They are pushed over MQTT when a
+-- broker is configured and otherwise picked up by polling; the machine
+-- acknowledges each one by ID. Commands not acknowledged by expires_at expire.
+CREATE TABLE IF NOT EXISTS machine_commands (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    machine_id UUID NOT NULL REFERENCES machines(id) ON DELETE CASCADE,
+    command VARCHAR(20) NOT NULL CHECK (command IN ('PAUSE', 'RESUME', 'RETURN_TO_BASE', 'REBOOT')),
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING'
+        CHECK (status IN ('PENDING', 'DELIVERED', 'ACKNOWLEDGED', 'REJECTED', 'EXPIRED')),
+    reason TEXT,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMPTZ,
+    acked_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_machine_commands_machine ON machine_commands(machine_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_machine_commands_open ON machine_commands(expires_at)
+    WHERE status IN ('PENDING', 'DELIVERED');
@@ -0,0 +1,2 @@
+-- Delivery reports count order.delivered events by day.
+CREATE INDEX IF NOT EXISTS idx_outbox_events_type_time ON outbox_events(event_type, created_at);
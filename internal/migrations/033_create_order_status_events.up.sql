@@ -0,0 +1,21 @@
+-- Every status change of an order, with who made it and why. from_status is
+-- NULL for the event that records the order's creation.
+CREATE TABLE IF NOT EXISTS order_status_events (
+    id BIGSERIAL PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    from_status order_status,
+    to_status order_status NOT NULL,
+    actor_type VARCHAR(10) NOT NULL CHECK (actor_type IN ('USER', 'ADMIN', 'SYSTEM', 'MACHINE')),
+    actor_id UUID,
+    reason TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_events_order ON order_status_events(order_id, created_at, id);
+
+-- Orders created before this migration only have their current status.
+-- Orders that already have a history keep it.
+INSERT INTO order_status_events (order_id, to_status, actor_type, reason, created_at)
+SELECT o.id, o.status, 'SYSTEM', 'recorded before status history', o.updated_at
+FROM orders o
+WHERE NOT EXISTS (SELECT 1 FROM order_status_events e WHERE e.order_id = o.id);
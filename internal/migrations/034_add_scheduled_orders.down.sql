@@ -0,0 +1,17 @@
+-- Enum values cannot be dropped; release scheduled orders to dispatch and rebuild the type.
+DROP INDEX IF EXISTS idx_orders_scheduled_pickup;
+ALTER TABLE orders DROP COLUMN IF EXISTS scheduled_pickup_time;
+INSERT INTO assignment_queue (order_id)
+SELECT id FROM orders WHERE status = 'SCHEDULED'
+ON CONFLICT (order_id) DO NOTHING;
+UPDATE orders SET status = 'CONFIRMED' WHERE status = 'SCHEDULED';
+UPDATE order_status_events SET from_status = 'CONFIRMED' WHERE from_status = 'SCHEDULED';
+UPDATE order_status_events SET to_status = 'CONFIRMED' WHERE to_status = 'SCHEDULED';
+ALTER TABLE orders ALTER COLUMN status DROP DEFAULT;
+ALTER TYPE order_status RENAME TO order_status_old;
+CREATE TYPE order_status AS ENUM ('PENDING_PAYMENT', 'CONFIRMED', 'ASSIGNMENT_PENDING', 'IN_PROGRESS', 'ARRIVED', 'DELIVERED', 'CANCELLED', 'FAILED');
+ALTER TABLE orders ALTER COLUMN status TYPE order_status USING status::text::order_status;
+ALTER TABLE order_status_events ALTER COLUMN from_status TYPE order_status USING from_status::text::order_status;
+ALTER TABLE order_status_events ALTER COLUMN to_status TYPE order_status USING to_status::text::order_status;
+ALTER TABLE orders ALTER COLUMN status SET DEFAULT 'PENDING_PAYMENT';
+DROP TYPE order_status_old;
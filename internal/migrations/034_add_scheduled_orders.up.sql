@@ -0,0 +1,10 @@
+-- Orders can be booked for a later pickup. Paid scheduled orders wait in
+-- SCHEDULED until a background job releases them to dispatch shortly before
+-- scheduled_pickup_time. The new enum value cannot be used in the same
+-- transaction that adds it, so nothing below refers to it.
+ALTER TYPE order_status ADD VALUE IF NOT EXISTS 'SCHEDULED' AFTER 'CONFIRMED';
+
+ALTER TABLE orders ADD COLUMN scheduled_pickup_time TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_orders_scheduled_pickup ON orders(scheduled_pickup_time)
+    WHERE scheduled_pickup_time IS NOT NULL;
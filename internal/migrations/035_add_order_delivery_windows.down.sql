@@ -0,0 +1,4 @@
+ALTER TABLE orders
+    DROP CONSTRAINT IF EXISTS orders_delivery_window_check,
+    DROP COLUMN IF EXISTS delivery_window_end,
+    DROP COLUMN IF EXISTS delivery_window_start;
@@ -0,0 +1,8 @@
+-- Optional window in which the recipient wants the package delivered.
+ALTER TABLE orders
+    ADD COLUMN delivery_window_start TIMESTAMPTZ,
+    ADD COLUMN delivery_window_end TIMESTAMPTZ,
+    ADD CONSTRAINT orders_delivery_window_check CHECK (
+        (delivery_window_start IS NULL AND delivery_window_end IS NULL)
+        OR delivery_window_end > delivery_window_start
+    );
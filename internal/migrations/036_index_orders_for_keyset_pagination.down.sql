@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_orders_user_created_id;
+DROP INDEX IF EXISTS idx_orders_created_id;
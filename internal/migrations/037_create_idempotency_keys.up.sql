@@ -0,0 +1,17 @@
+-- Idempotency-Key values sent with POST /orders and POST /orders/:orderId/pay.
+-- A key is claimed before the request runs and completed, in the request's own
+-- transaction, with the order it produced; retries return that order instead
+-- of repeating the work. request_hash detects a key reused for another request.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    operation VARCHAR(32) NOT NULL,
+    key VARCHAR(128) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    order_id UUID REFERENCES orders(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, operation, key)
+);
+
+-- Expired keys are purged by age.
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created ON idempotency_keys(created_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_order_status_events_created;
+DROP TABLE IF EXISTS webhook_attempts;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_endpoints;
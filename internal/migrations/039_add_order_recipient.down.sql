@@ -0,0 +1,4 @@
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS delivery_instructions,
+    DROP COLUMN IF EXISTS recipient_phone,
+    DROP COLUMN IF EXISTS recipient_name;
@@ -0,0 +1,6 @@
+-- Who receives the package at the dropoff, and how to hand it over. Shown to
+-- the machine carrying the order.
+ALTER TABLE orders
+    ADD COLUMN recipient_name VARCHAR(100) NOT NULL DEFAULT '',
+    ADD COLUMN recipient_phone VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN delivery_instructions VARCHAR(500) NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_orders_return_of;
+ALTER TABLE orders DROP COLUMN IF EXISTS return_of_order_id;
@@ -0,0 +1,8 @@
+-- A return is a reverse order: it collects the package at the original
+-- dropoff and takes it back to the original pickup.
+ALTER TABLE orders
+    ADD COLUMN return_of_order_id UUID REFERENCES orders(id) ON DELETE RESTRICT;
+
+-- At most one live return per order; a cancelled return can be requested again.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_return_of ON orders(return_of_order_id)
+    WHERE return_of_order_id IS NOT NULL AND status <> 'CANCELLED';
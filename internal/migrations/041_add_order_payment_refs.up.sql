@@ -0,0 +1,5 @@
+-- The payment provider's IDs for an order's charge and refund. A cancelled
+-- order with a payment_id but no refund_id still has a refund outstanding.
+ALTER TABLE orders
+    ADD COLUMN payment_id VARCHAR(255),
+    ADD COLUMN refund_id VARCHAR(255);
@@ -0,0 +1,11 @@
+-- Quoted route options a customer can still order, so quotes survive restarts
+-- and work on every instance. An option is deleted when an order uses it.
+CREATE TABLE IF NOT EXISTS route_quotes (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    option JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_route_quotes_expires ON route_quotes(expires_at);
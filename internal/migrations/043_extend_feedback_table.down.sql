@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_feedback_created_at;
+DROP INDEX IF EXISTS idx_feedback_machine_id;
+
+ALTER TABLE feedback
+    ALTER COLUMN comment DROP NOT NULL,
+    ALTER COLUMN comment DROP DEFAULT,
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS machine_id;
@@ -0,0 +1,15 @@
+-- Feedback keeps the machine that delivered the order, so ratings can be
+-- averaged per machine without joining orders, and a comment is never NULL.
+ALTER TABLE feedback
+    ADD COLUMN machine_id UUID REFERENCES machines(id) ON DELETE SET NULL,
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+UPDATE feedback f SET machine_id = o.machine_id FROM orders o WHERE o.id = f.order_id;
+UPDATE feedback SET comment = '' WHERE comment IS NULL;
+
+ALTER TABLE feedback
+    ALTER COLUMN comment SET DEFAULT '',
+    ALTER COLUMN comment SET NOT NULL;
+
+CREATE INDEX idx_feedback_machine_id ON feedback(machine_id);
+CREATE INDEX idx_feedback_created_at ON feedback(created_at DESC, id DESC);
@@ -0,0 +1,5 @@
+-- An order's service tier. EXPRESS orders pay a surcharge and are assigned a
+-- machine before STANDARD ones.
+ALTER TABLE orders
+    ADD COLUMN priority VARCHAR(16) NOT NULL DEFAULT 'STANDARD'
+        CHECK (priority IN ('STANDARD', 'EXPRESS'));
@@ -0,0 +1,3 @@
+-- The itemized price of an order (base fare, distance, surcharges, tax,
+-- discount) as quoted. NULL for orders placed before it was kept.
+ALTER TABLE orders ADD COLUMN cost_breakdown JSONB;
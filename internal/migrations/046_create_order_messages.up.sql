@@ -0,0 +1,23 @@
+-- Notes the customer and support or operations staff exchange about an order.
+-- Admins hide abusive messages; hidden messages are kept for staff only.
+CREATE TABLE IF NOT EXISTS order_messages (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    sender_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    sender_role VARCHAR(16) NOT NULL CHECK (sender_role IN ('CUSTOMER', 'ADMIN', 'SUPPORT')),
+    body TEXT NOT NULL,
+    hidden_at TIMESTAMPTZ,
+    hidden_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_messages_order ON order_messages(order_id, created_at);
+
+-- How far each user has read an order's thread; later messages from the
+-- other side are unread.
+CREATE TABLE IF NOT EXISTS order_message_reads (
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    read_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (order_id, user_id)
+);
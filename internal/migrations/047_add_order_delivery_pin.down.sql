@@ -0,0 +1,3 @@
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS delivery_pin_attempts,
+    DROP COLUMN IF EXISTS delivery_pin;
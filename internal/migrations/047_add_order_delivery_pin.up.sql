@@ -0,0 +1,6 @@
+-- A one-time PIN the recipient gives the machine, or enters in the app, to
+-- complete delivery. NULL for orders placed before PINs, which need none.
+-- delivery_pin_attempts counts wrong PINs; entry locks after a few.
+ALTER TABLE orders
+    ADD COLUMN delivery_pin VARCHAR(6),
+    ADD COLUMN delivery_pin_attempts INT NOT NULL DEFAULT 0;
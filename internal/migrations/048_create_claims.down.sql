@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS wallet_credits;
+DROP TABLE IF EXISTS claim_photos;
+DROP TABLE IF EXISTS claims;
@@ -0,0 +1,44 @@
+-- Claims customers file for lost or damaged packages; an order takes one.
+-- Admins approve them with a refund or wallet credit, or reject them.
+CREATE TABLE IF NOT EXISTS claims (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    order_id UUID NOT NULL UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(16) NOT NULL CHECK (type IN ('LOST', 'DAMAGED')),
+    description TEXT NOT NULL,
+    amount_claimed DECIMAL(10, 2) NOT NULL CHECK (amount_claimed > 0),
+    status VARCHAR(16) NOT NULL DEFAULT 'OPEN' CHECK (status IN ('OPEN', 'APPROVED', 'REJECTED')),
+    resolution VARCHAR(16) CHECK (resolution IN ('REFUND', 'CREDIT')),
+    amount_approved DECIMAL(10, 2),
+    refund_id TEXT,
+    decision_note TEXT NOT NULL DEFAULT '',
+    decided_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    decided_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_claims_status ON claims(status, created_at);
+
+CREATE TABLE IF NOT EXISTS claim_photos (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    claim_id UUID NOT NULL REFERENCES claims(id) ON DELETE CASCADE,
+    storage_key TEXT NOT NULL,
+    content_type VARCHAR(64) NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_claim_photos_claim ON claim_photos(claim_id, created_at);
+
+-- Credit customers hold towards future orders. The balance is the sum of
+-- their entries; a claim is credited at most once.
+CREATE TABLE IF NOT EXISTS wallet_credits (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount DECIMAL(10, 2) NOT NULL,
+    reason TEXT NOT NULL,
+    claim_id UUID UNIQUE REFERENCES claims(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_wallet_credits_user ON wallet_credits(user_id, created_at);
@@ -0,0 +1,3 @@
+-- The fee kept when a customer cancels a paid order; the rest is refunded.
+-- NULL for orders cancelled free of charge or not cancelled.
+ALTER TABLE orders ADD COLUMN cancellation_fee DECIMAL(10, 2);
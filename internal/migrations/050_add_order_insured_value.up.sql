@@ -0,0 +1,3 @@
+-- The declared value a package is insured for, bought with the quote. Claims
+-- on the order are paid up to it. NULL for uninsured orders.
+ALTER TABLE orders ADD COLUMN insured_value DECIMAL(10, 2);
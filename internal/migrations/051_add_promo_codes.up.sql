@@ -0,0 +1,30 @@
+-- Promo codes admins create for discounts applied when an order is paid.
+-- Codes are stored in upper case; redemptions counts the rows in
+-- promo_redemptions so limits can be checked in a single update.
+CREATE TABLE IF NOT EXISTS promo_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    code VARCHAR(32) NOT NULL UNIQUE,
+    discount_type VARCHAR(16) NOT NULL CHECK (discount_type IN ('PERCENT', 'FIXED')),
+    value DECIMAL(10, 2) NOT NULL CHECK (value > 0),
+    max_redemptions INT CHECK (max_redemptions > 0),
+    max_per_user INT CHECK (max_per_user > 0),
+    redemptions INT NOT NULL DEFAULT 0,
+    valid_from TIMESTAMPTZ,
+    valid_until TIMESTAMPTZ,
+    disabled_at TIMESTAMPTZ,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (discount_type <> 'PERCENT' OR value <= 100),
+    CHECK (valid_until IS NULL OR valid_from IS NULL OR valid_until > valid_from)
+);
+
+-- An order takes at most one promo code.
+CREATE TABLE IF NOT EXISTS promo_redemptions (
+    order_id UUID PRIMARY KEY REFERENCES orders(id) ON DELETE CASCADE,
+    promo_code_id UUID NOT NULL REFERENCES promo_codes(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    discount DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_promo_redemptions_code_user ON promo_redemptions(promo_code_id, user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS payment_methods;
+ALTER TABLE users DROP COLUMN IF EXISTS payment_customer_id;
@@ -0,0 +1,16 @@
+-- The payment provider's customer for each user, created when they first
+-- save a card, and the cards saved to it.
+ALTER TABLE users ADD COLUMN payment_customer_id VARCHAR(255) UNIQUE;
+
+CREATE TABLE IF NOT EXISTS payment_methods (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider_id VARCHAR(255) NOT NULL UNIQUE,
+    brand VARCHAR(32) NOT NULL,
+    last4 VARCHAR(4) NOT NULL,
+    exp_month INT NOT NULL,
+    exp_year INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_methods_user ON payment_methods(user_id);
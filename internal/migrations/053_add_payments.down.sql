@@ -0,0 +1,17 @@
+DROP INDEX IF EXISTS idx_payments_order;
+
+-- The baseline table holds one charge per order: keep each order's latest.
+DELETE FROM payments WHERE kind <> 'CHARGE';
+DELETE FROM payments p
+USING payments q
+WHERE p.order_id = q.order_id AND (p.created_at, p.id) < (q.created_at, q.id);
+
+UPDATE payments SET external_payment_id = provider_ref WHERE external_payment_id IS NULL;
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_status_check;
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_kind_check;
+ALTER TABLE payments DROP COLUMN failure_reason;
+ALTER TABLE payments DROP COLUMN provider;
+ALTER TABLE payments DROP COLUMN kind;
+ALTER TABLE payments DROP COLUMN user_id;
+ALTER TABLE payments DROP COLUMN provider_ref;
+ALTER TABLE payments ADD CONSTRAINT payments_order_id_key UNIQUE (order_id);
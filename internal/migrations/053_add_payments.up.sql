@@ -0,0 +1,27 @@
+-- Every attempt to charge or refund an order, failed ones included. The
+-- baseline table (007) held one charge per order; it becomes the log.
+-- external_payment_id is superseded by provider_ref and no longer written.
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_order_id_key;
+ALTER TABLE payments ADD COLUMN provider_ref VARCHAR(255);
+ALTER TABLE payments ADD COLUMN user_id UUID REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE payments ADD COLUMN kind VARCHAR(16);
+ALTER TABLE payments ADD COLUMN provider VARCHAR(32);
+ALTER TABLE payments ADD COLUMN failure_reason TEXT;
+
+-- Existing rows are Stripe charges of their order.
+UPDATE payments p
+SET user_id = o.user_id,
+    provider_ref = p.external_payment_id,
+    kind = 'CHARGE',
+    provider = 'stripe',
+    status = CASE WHEN upper(p.status) IN ('SUCCEEDED', 'SUCCESS', 'PAID', 'COMPLETED') THEN 'SUCCEEDED' ELSE 'FAILED' END
+FROM orders o
+WHERE o.id = p.order_id;
+
+ALTER TABLE payments ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE payments ALTER COLUMN kind SET NOT NULL;
+ALTER TABLE payments ALTER COLUMN provider SET NOT NULL;
+ALTER TABLE payments ADD CONSTRAINT payments_kind_check CHECK (kind IN ('CHARGE', 'REFUND'));
+ALTER TABLE payments ADD CONSTRAINT payments_status_check CHECK (status IN ('SUCCEEDED', 'FAILED'));
+
+CREATE INDEX IF NOT EXISTS idx_payments_order ON payments(order_id, created_at);
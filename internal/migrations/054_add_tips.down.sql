@@ -0,0 +1,5 @@
+DELETE FROM payments WHERE kind = 'TIP';
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_kind_check;
+ALTER TABLE payments ADD CONSTRAINT payments_kind_check CHECK (kind IN ('CHARGE', 'REFUND'));
+
+ALTER TABLE orders DROP COLUMN IF EXISTS tip;
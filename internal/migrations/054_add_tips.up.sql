@@ -0,0 +1,8 @@
+-- What the customer tipped on an order, at payment time or after delivery.
+-- It is paid on top of the order's cost.
+ALTER TABLE orders ADD COLUMN tip DECIMAL(10, 2) NOT NULL DEFAULT 0;
+
+-- Tips are recorded as payments of their own, even when charged together
+-- with the order.
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_kind_check;
+ALTER TABLE payments ADD CONSTRAINT payments_kind_check CHECK (kind IN ('CHARGE', 'TIP', 'REFUND'));
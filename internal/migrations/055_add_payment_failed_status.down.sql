@@ -0,0 +1,15 @@
+-- Enum values cannot be dropped; return orders whose payment failed to
+-- PENDING_PAYMENT and rebuild the type.
+ALTER TABLE orders DROP COLUMN IF EXISTS payment_failure_reason;
+UPDATE orders SET status = 'PENDING_PAYMENT' WHERE status = 'PAYMENT_FAILED';
+DELETE FROM order_status_events WHERE from_status = 'PAYMENT_FAILED' AND to_status = 'PENDING_PAYMENT';
+UPDATE order_status_events SET from_status = 'PENDING_PAYMENT' WHERE from_status = 'PAYMENT_FAILED';
+UPDATE order_status_events SET to_status = 'PENDING_PAYMENT' WHERE to_status = 'PAYMENT_FAILED';
+ALTER TABLE orders ALTER COLUMN status DROP DEFAULT;
+ALTER TYPE order_status RENAME TO order_status_old;
+CREATE TYPE order_status AS ENUM ('PENDING_PAYMENT', 'CONFIRMED', 'SCHEDULED', 'ASSIGNMENT_PENDING', 'IN_PROGRESS', 'ARRIVED', 'DELIVERED', 'CANCELLED', 'FAILED');
+ALTER TABLE orders ALTER COLUMN status TYPE order_status USING status::text::order_status;
+ALTER TABLE order_status_events ALTER COLUMN from_status TYPE order_status USING from_status::text::order_status;
+ALTER TABLE order_status_events ALTER COLUMN to_status TYPE order_status USING to_status::text::order_status;
+ALTER TABLE orders ALTER COLUMN status SET DEFAULT 'PENDING_PAYMENT';
+DROP TYPE order_status_old;
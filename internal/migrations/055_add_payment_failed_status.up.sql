@@ -0,0 +1,7 @@
+-- An order whose charge failed moves to PAYMENT_FAILED and keeps the
+-- provider's reason until the customer retries with another payment method.
+-- The new enum value cannot be used in the same transaction that adds it, so
+-- nothing below refers to it.
+ALTER TYPE order_status ADD VALUE IF NOT EXISTS 'PAYMENT_FAILED' AFTER 'PENDING_PAYMENT';
+
+ALTER TABLE orders ADD COLUMN payment_failure_reason TEXT;
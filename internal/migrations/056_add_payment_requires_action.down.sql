@@ -0,0 +1,3 @@
+UPDATE payments SET status = 'FAILED', failure_reason = 'authentication not completed' WHERE status = 'REQUIRES_ACTION';
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_status_check;
+ALTER TABLE payments ADD CONSTRAINT payments_status_check CHECK (status IN ('SUCCEEDED', 'FAILED'));
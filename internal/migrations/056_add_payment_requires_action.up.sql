@@ -0,0 +1,4 @@
+-- A charge the customer has to authenticate, e.g. with 3-D Secure, is
+-- recorded as REQUIRES_ACTION until they have, then updated to its outcome.
+ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_status_check;
+ALTER TABLE payments ADD CONSTRAINT payments_status_check CHECK (status IN ('SUCCEEDED', 'FAILED', 'REQUIRES_ACTION'));
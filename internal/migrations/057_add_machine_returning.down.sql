@@ -0,0 +1,15 @@
+-- Enum values cannot be dropped; treat returning machines as still out on a
+-- delivery and rebuild the type. The partial index compares status with an
+-- enum literal, so it is rebuilt too.
+UPDATE machines SET status = 'IN_TRANSIT' WHERE status = 'RETURNING';
+UPDATE machine_telemetry SET status = 'IN_TRANSIT' WHERE status = 'RETURNING';
+DROP INDEX IF EXISTS idx_machines_idle_location;
+ALTER TABLE machines ALTER COLUMN status DROP DEFAULT;
+ALTER TYPE machine_status RENAME TO machine_status_old;
+CREATE TYPE machine_status AS ENUM ('IDLE', 'IN_TRANSIT', 'CHARGING', 'MAINTENANCE', 'OFFLINE');
+ALTER TABLE machines ALTER COLUMN status TYPE machine_status USING status::text::machine_status;
+ALTER TABLE machine_telemetry ALTER COLUMN status TYPE machine_status USING status::text::machine_status;
+ALTER TABLE machines ALTER COLUMN status SET DEFAULT 'IDLE';
+DROP TYPE machine_status_old;
+CREATE INDEX IF NOT EXISTS idx_machines_idle_location ON machines USING GIST (current_location)
+    WHERE status = 'IDLE' AND deleted_at IS NULL;
@@ -0,0 +1,5 @@
+-- A machine whose delivery is cancelled heads back to base. It is RETURNING
+-- until it reports IDLE there, so it is not dispatched while it still carries
+-- the package. The new enum value cannot be used in the same transaction that
+-- adds it, so nothing below refers to it.
+ALTER TYPE machine_status ADD VALUE IF NOT EXISTS 'RETURNING';
@@ -0,0 +1,12 @@
+-- The webhook fan-out job remembers the last status change it queued
+-- deliveries for, so changes made while it was not running are still sent.
+-- The single row starts at the latest change; earlier ones were fanned out by
+-- time.
+CREATE TABLE IF NOT EXISTS webhook_fanout_cursor (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    last_status_event_id BIGINT NOT NULL
+);
+
+INSERT INTO webhook_fanout_cursor (last_status_event_id)
+SELECT COALESCE(MAX(id), 0) FROM order_status_events
+ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migrations and development seed data so
+// tools such as cmd/circuitctl can apply them without a checkout.
+package migrations
+
+import "embed"
+
+// FS holds every NNN_name.{up,down}.sql migration and seed.sql.
+//
+//go:embed *.sql
+var FS embed.FS
@@ -6,9 +6,9 @@ INSERT INTO users (id, nickname, email, password_hash) VALUES
 ON CONFLICT (email) DO NOTHING;
 
 -- Seed Addresses for Alice
-INSERT INTO addresses (id, user_id, label, street_address, is_default) VALUES
-('b0eebc99-9c0b-4ef8-bb6d-6bb9bd380a21', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', 'Home', '123 Main St, San Francisco, CA 94105', true),
-('b0eebc99-9c0b-4ef8-bb6d-6bb9bd380a22', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', 'Work', '456 Market St, San Francisco, CA 94104', false)
+INSERT INTO addresses (id, user_id, label, street_address, is_default, location) VALUES
+('b0eebc99-9c0b-4ef8-bb6d-6bb9bd380a21', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', 'Home', '123 Main St, San Francisco, CA 94105', true, ST_SetSRID(ST_MakePoint(-122.3937, 37.7898), 4326)),
+('b0eebc99-9c0b-4ef8-bb6d-6bb9bd380a22', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', 'Work', '456 Market St, San Francisco, CA 94104', false, ST_SetSRID(ST_MakePoint(-122.4003, 37.7904), 4326))
 ON CONFLICT (id) DO NOTHING;
 
 -- Seed Machines (one drone, one robot)
@@ -17,6 +17,24 @@ INSERT INTO machines (id, type, status, current_location, battery_level) VALUES
 ('d0eebc99-9c0b-4ef8-bb6d-6bb9bd380a32', 'ROBOT', 'IDLE', ST_SetSRID(ST_MakePoint(-122.4194, 37.7749), 4326), 88)
 ON CONFLICT (id) DO NOTHING;
 
+-- Seed an operational zone covering San Francisco, served by both machines,
+-- so orders picked up there are dispatched and quotes can surge
+INSERT INTO zones (id, name, kind, area) VALUES
+('e0eebc99-9c0b-4ef8-bb6d-6bb9bd380a41', 'San Francisco', 'OPERATIONAL',
+ ST_GeogFromText('POLYGON((-122.52 37.70, -122.35 37.70, -122.35 37.83, -122.52 37.83, -122.52 37.70))'))
+ON CONFLICT (id) DO NOTHING;
+
+UPDATE machines SET zone_id = 'e0eebc99-9c0b-4ef8-bb6d-6bb9bd380a41'
+WHERE id IN ('d0eebc99-9c0b-4ef8-bb6d-6bb9bd380a31', 'd0eebc99-9c0b-4ef8-bb6d-6bb9bd380a32')
+  AND zone_id IS NULL;
+
+-- Seed the base tariffs for machine types without any pricing rule, e.g.
+-- after an admin deleted the ones the migration created
+INSERT INTO pricing_rules (machine_type, base_fare, per_km, multiplier)
+SELECT t.machine_type::machine_type, t.base_fare, t.per_km, 1
+FROM (VALUES ('DRONE', 2.00, 0.50), ('ROBOT', 1.00, 0.30)) AS t(machine_type, base_fare, per_km)
+WHERE NOT EXISTS (SELECT 1 FROM pricing_rules WHERE machine_type = t.machine_type::machine_type);
+
 -- Seed a completed order for Alice to populate history
 INSERT INTO orders (id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost)
 SELECT
@@ -43,3 +61,21 @@ WHERE
     u.email = 'alice@example.com'
 LIMIT 1
 ON CONFLICT (id) DO NOTHING;
+
+-- Seed the status history of Alice's order, unless it already has one, e.g.
+-- the event migration 033 recorded for an order seeded before it.
+INSERT INTO order_status_events (order_id, from_status, to_status, actor_type, actor_id, reason)
+SELECT o.id, e.from_status::order_status, e.to_status::order_status, e.actor_type,
+       CASE e.actor_type WHEN 'USER' THEN o.user_id WHEN 'MACHINE' THEN o.machine_id END,
+       e.reason
+FROM orders o
+CROSS JOIN (VALUES
+    (1, NULL, 'PENDING_PAYMENT', 'USER', 'order created'),
+    (2, 'PENDING_PAYMENT', 'CONFIRMED', 'USER', 'paid'),
+    (3, 'CONFIRMED', 'IN_PROGRESS', 'SYSTEM', 'assigned to machine'),
+    (4, 'IN_PROGRESS', 'ARRIVED', 'MACHINE', 'reached dropoff geofence'),
+    (5, 'ARRIVED', 'DELIVERED', 'USER', 'delivery confirmed by recipient')
+) AS e(seq, from_status, to_status, actor_type, reason)
+WHERE o.id = 'c0eebc99-9c0b-4ef8-bb6d-6bb9bd380a13'
+  AND NOT EXISTS (SELECT 1 FROM order_status_events WHERE order_id = o.id)
+ORDER BY e.seq;
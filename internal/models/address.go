@@ -3,25 +3,35 @@ package models
 import "time"
 
 type Address struct {
-	ID            string    `json:"id" db:"id"`
-	UserID        string    `json:"-" db:"user_id"`
-	Label         *string   `json:"label,omitempty" db:"label"`
-	StreetAddress string    `json:"street_address" db:"street_address"`
-	IsDefault     bool      `json:"is_default" db:"is_default"`
-	CreatedAt     time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+	ID            string     `json:"id" db:"id"`
+	UserID        string     `json:"-" db:"user_id"`
+	Label         *string    `json:"label,omitempty" db:"label"`
+	StreetAddress string     `json:"street_address" db:"street_address"`
+	IsDefault     bool       `json:"is_default" db:"is_default"`
+	Location      *GeoPoint  `json:"location,omitempty" db:"location"` // Optional; used to dispatch the nearest machine
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty" db:"deleted_at"` // Set when soft deleted; only visible to admins
 }
 
 // AddAddressRequest defines the shape of the request body for creating a new address.
 type AddAddressRequest struct {
-	Label         *string `json:"label" validate:"min=2"`
-	StreetAddress string  `json:"street_address" validate:"required,min=10"`
-	IsDefault     bool    `json:"is_default"`
+	Label         *string   `json:"label" validate:"min=2"`
+	StreetAddress string    `json:"street_address" validate:"required,min=10"`
+	IsDefault     bool      `json:"is_default"`
+	Location      *GeoPoint `json:"location,omitempty"`
 }
 
 // UpdateAddressRequest defines the shape of the request body for updating an address.
 type UpdateAddressRequest struct {
-	Label         *string `json:"label,omitempty"`
-	StreetAddress string  `json:"street_address,omitempty"`
-	IsDefault     *bool   `json:"is_default,omitempty"` // Pointer to handle 'false' as a valid update
+	Label         *string   `json:"label,omitempty"`
+	StreetAddress string    `json:"street_address,omitempty"`
+	IsDefault     *bool     `json:"is_default,omitempty"` // Pointer to handle 'false' as a valid update
+	Location      *GeoPoint `json:"location,omitempty"`
+}
+
+// GeoPoint is a WGS 84 coordinate.
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude" validate:"min=-90,max=90"`
+	Longitude float64 `json:"longitude" validate:"min=-180,max=180"`
 }
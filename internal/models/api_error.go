@@ -0,0 +1,289 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"dispatch-and-delivery/pkg/resilience"
+	"dispatch-and-delivery/pkg/storage"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrorCode is a stable, machine-readable identifier returned with every API error.
+// Clients should branch on the code rather than on the human-readable message.
+type ErrorCode string
+
+// Generic error codes.
+const (
+	CodeInvalidRequest       ErrorCode = "INVALID_REQUEST"
+	CodeValidationFailed     ErrorCode = "VALIDATION_FAILED"
+	CodeUnauthorized         ErrorCode = "UNAUTHORIZED"
+	CodeForbidden            ErrorCode = "FORBIDDEN"
+	CodeNotFound             ErrorCode = "NOT_FOUND"
+	CodeMethodNotAllowed     ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeConflict             ErrorCode = "CONFLICT"
+	CodeUnsupportedMediaType ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodePayloadTooLarge      ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeTooManyRequests      ErrorCode = "TOO_MANY_REQUESTS"
+	CodeInternal             ErrorCode = "INTERNAL_ERROR"
+	CodeTimeout              ErrorCode = "TIMEOUT"
+	CodeUnavailable          ErrorCode = "SERVICE_UNAVAILABLE"
+)
+
+// Domain error codes.
+const (
+	CodeInactiveAccount          ErrorCode = "INACTIVE_ACCOUNT"
+	CodeInvalidToken             ErrorCode = "INVALID_TOKEN"
+	CodeTokenExpired             ErrorCode = "TOKEN_EXPIRED"
+	CodeInvalidCSRFToken         ErrorCode = "INVALID_CSRF_TOKEN"
+	CodeInvalidCredentials       ErrorCode = "INVALID_CREDENTIALS"
+	CodeEmailTaken               ErrorCode = "EMAIL_TAKEN"
+	CodeNicknameTaken            ErrorCode = "NICKNAME_TAKEN"
+	CodeNoFieldsToUpdate         ErrorCode = "NO_FIELDS_TO_UPDATE"
+	CodeOrderCannotBeCancelled   ErrorCode = "ORDER_CANNOT_BE_CANCELLED"
+	CodeOrderCannotBePaid        ErrorCode = "ORDER_CANNOT_BE_PAID"
+	CodeOrderCannotBeConfirmed   ErrorCode = "ORDER_CANNOT_BE_CONFIRMED"
+	CodeOrderStatusChanged       ErrorCode = "ORDER_STATUS_CHANGED"
+	CodeRefundFailed             ErrorCode = "REFUND_FAILED"
+	CodeOrderCannotBeReturned    ErrorCode = "ORDER_CANNOT_BE_RETURNED"
+	CodeReturnAlreadyExists      ErrorCode = "RETURN_ALREADY_EXISTS"
+	CodeRouteOptionExpired       ErrorCode = "ROUTE_OPTION_EXPIRED"
+	CodeRouteOptionNotFound      ErrorCode = "ROUTE_OPTION_NOT_FOUND"
+	CodeReceiptNotAvailable      ErrorCode = "RECEIPT_NOT_AVAILABLE"
+	CodeInvalidDeliveryPIN       ErrorCode = "INVALID_DELIVERY_PIN"
+	CodeDeliveryPINLocked        ErrorCode = "DELIVERY_PIN_LOCKED"
+	CodeClaimNotAllowed          ErrorCode = "CLAIM_NOT_ALLOWED"
+	CodeClaimAlreadyExists       ErrorCode = "CLAIM_ALREADY_EXISTS"
+	CodeClaimAlreadyDecided      ErrorCode = "CLAIM_ALREADY_DECIDED"
+	CodeTooManyClaimPhotos       ErrorCode = "TOO_MANY_CLAIM_PHOTOS"
+	CodeClaimNotRefundable       ErrorCode = "CLAIM_NOT_REFUNDABLE"
+	CodePromoCodeInvalid         ErrorCode = "PROMO_CODE_INVALID"
+	CodePromoCodeExhausted       ErrorCode = "PROMO_CODE_EXHAUSTED"
+	CodePromoCodeAlreadyApplied  ErrorCode = "PROMO_CODE_ALREADY_APPLIED"
+	CodePromoCodeTaken           ErrorCode = "PROMO_CODE_TAKEN"
+	CodePaymentMethodNotFound    ErrorCode = "PAYMENT_METHOD_NOT_FOUND"
+	CodePaymentFailed            ErrorCode = "PAYMENT_FAILED"
+	CodePaymentUnavailable       ErrorCode = "PAYMENT_UNAVAILABLE"
+	CodeNoPaymentAction          ErrorCode = "NO_PAYMENT_ACTION"
+	CodePaymentActionPending     ErrorCode = "PAYMENT_ACTION_PENDING"
+	CodeCannotTip                ErrorCode = "CANNOT_TIP"
+	CodeTipAlreadyAdded          ErrorCode = "TIP_ALREADY_ADDED"
+	CodeCannotSubmitFeedback     ErrorCode = "CANNOT_SUBMIT_FEEDBACK"
+	CodeFeedbackAlreadySubmitted ErrorCode = "FEEDBACK_ALREADY_SUBMITTED"
+	CodePackageTooLarge          ErrorCode = "PACKAGE_TOO_LARGE"
+	CodeNoMachineAvailable       ErrorCode = "NO_MACHINE_AVAILABLE"
+	CodeOrderNotBatchable        ErrorCode = "ORDER_NOT_BATCHABLE"
+	CodeInvalidGeometry          ErrorCode = "INVALID_GEOMETRY"
+	CodeRouteRestricted          ErrorCode = "ROUTE_RESTRICTED"
+	CodeWeatherUnsafe            ErrorCode = "WEATHER_UNSAFE"
+	CodeNoPricingRule            ErrorCode = "NO_PRICING_RULE"
+	CodeMachineBusy              ErrorCode = "MACHINE_BUSY"
+	CodeInvalidMachineCapacity   ErrorCode = "INVALID_MACHINE_CAPACITY"
+	CodeInvalidZone              ErrorCode = "INVALID_ZONE"
+	CodeIdempotencyKeyInUse      ErrorCode = "IDEMPOTENCY_KEY_IN_USE"
+	CodeIdempotencyKeyReused     ErrorCode = "IDEMPOTENCY_KEY_REUSED"
+)
+
+// FieldError describes why a single request field failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// APIError is an error that knows how it should be rendered to API clients.
+// Handlers return it (or a sentinel from errors.go) and the central
+// HTTP error handler turns it into an ErrorResponse.
+type APIError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+	Fields  []FieldError
+	// Err is the underlying cause. It is logged but never sent to the client.
+	Err error
+}
+
+// NewAPIError creates an APIError with the given HTTP status, code and message.
+func NewAPIError(status int, code ErrorCode, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// WithCause returns a copy of the error carrying err as its underlying cause.
+func (e *APIError) WithCause(err error) *APIError {
+	cp := *e
+	cp.Err = err
+	return &cp
+}
+
+// Response converts the error into the JSON body sent to clients.
+func (e *APIError) Response() ErrorResponse {
+	return ErrorResponse{
+		Code:    e.Code,
+		Message: e.Message,
+		Fields:  e.Fields,
+	}
+}
+
+// errorMappings binds every sentinel error to its HTTP status and code.
+// The sentinel's own text is used as the client-facing message.
+var errorMappings = []struct {
+	err    error
+	status int
+	code   ErrorCode
+}{
+	{ErrNotFound, http.StatusNotFound, CodeNotFound},
+	{ErrForbidden, http.StatusForbidden, CodeForbidden},
+	{ErrInactiveAccount, http.StatusForbidden, CodeInactiveAccount},
+	{ErrInvalidToken, http.StatusBadRequest, CodeInvalidToken},
+	{ErrConflict, http.StatusConflict, CodeConflict},
+	{ErrInvalidCredentials, http.StatusUnauthorized, CodeInvalidCredentials},
+	{ErrNicknameTaken, http.StatusConflict, CodeNicknameTaken},
+	{ErrNoFieldsToUpdate, http.StatusBadRequest, CodeNoFieldsToUpdate},
+	{ErrOrderCannotBeCancelled, http.StatusConflict, CodeOrderCannotBeCancelled},
+	{ErrOrderCannotBePaid, http.StatusConflict, CodeOrderCannotBePaid},
+	{ErrOrderStatusChanged, http.StatusConflict, CodeOrderStatusChanged},
+	{ErrOrderCannotBeConfirmed, http.StatusConflict, CodeOrderCannotBeConfirmed},
+	{ErrRefundFailed, http.StatusBadGateway, CodeRefundFailed},
+	{ErrOrderCannotBeReturned, http.StatusConflict, CodeOrderCannotBeReturned},
+	{ErrReturnAlreadyExists, http.StatusConflict, CodeReturnAlreadyExists},
+	{ErrRouteOptionExpired, http.StatusGone, CodeRouteOptionExpired},
+	{ErrRouteOptionNotFound, http.StatusNotFound, CodeRouteOptionNotFound},
+	{ErrReceiptNotAvailable, http.StatusConflict, CodeReceiptNotAvailable},
+	{ErrInvalidDeliveryPIN, http.StatusUnprocessableEntity, CodeInvalidDeliveryPIN},
+	{ErrDeliveryPINLocked, http.StatusConflict, CodeDeliveryPINLocked},
+	{ErrClaimNotAllowed, http.StatusConflict, CodeClaimNotAllowed},
+	{ErrClaimAlreadyExists, http.StatusConflict, CodeClaimAlreadyExists},
+	{ErrClaimAlreadyDecided, http.StatusConflict, CodeClaimAlreadyDecided},
+	{ErrTooManyClaimPhotos, http.StatusConflict, CodeTooManyClaimPhotos},
+	{ErrClaimNotRefundable, http.StatusConflict, CodeClaimNotRefundable},
+	{ErrPromoCodeInvalid, http.StatusUnprocessableEntity, CodePromoCodeInvalid},
+	{ErrPromoCodeExhausted, http.StatusConflict, CodePromoCodeExhausted},
+	{ErrPromoCodeAlreadyApplied, http.StatusConflict, CodePromoCodeAlreadyApplied},
+	{ErrPromoCodeTaken, http.StatusConflict, CodePromoCodeTaken},
+	{ErrPaymentMethodNotFound, http.StatusNotFound, CodePaymentMethodNotFound},
+	{ErrPaymentFailed, http.StatusPaymentRequired, CodePaymentFailed},
+	{ErrPaymentUnavailable, http.StatusServiceUnavailable, CodePaymentUnavailable},
+	{ErrNoPaymentAction, http.StatusConflict, CodeNoPaymentAction},
+	{ErrPaymentActionPending, http.StatusConflict, CodePaymentActionPending},
+	{ErrCannotTip, http.StatusConflict, CodeCannotTip},
+	{ErrTipAlreadyAdded, http.StatusConflict, CodeTipAlreadyAdded},
+	{ErrCannotSubmitFeedback, http.StatusConflict, CodeCannotSubmitFeedback},
+	{ErrFeedbackAlreadySubmitted, http.StatusConflict, CodeFeedbackAlreadySubmitted},
+	{ErrPackageTooLarge, http.StatusBadRequest, CodePackageTooLarge},
+	{ErrNoMachineAvailable, http.StatusServiceUnavailable, CodeNoMachineAvailable},
+	{ErrOrderNotBatchable, http.StatusConflict, CodeOrderNotBatchable},
+	{ErrInvalidGeometry, http.StatusBadRequest, CodeInvalidGeometry},
+	{ErrRouteRestricted, http.StatusUnprocessableEntity, CodeRouteRestricted},
+	{ErrWeatherUnsafe, http.StatusUnprocessableEntity, CodeWeatherUnsafe},
+	{ErrNoPricingRule, http.StatusUnprocessableEntity, CodeNoPricingRule},
+	{ErrMachineBusy, http.StatusConflict, CodeMachineBusy},
+	{ErrInvalidMachineCapacity, http.StatusBadRequest, CodeInvalidMachineCapacity},
+	{ErrInvalidZone, http.StatusBadRequest, CodeInvalidZone},
+	{ErrIdempotencyKeyInUse, http.StatusConflict, CodeIdempotencyKeyInUse},
+	{ErrIdempotencyKeyReused, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused},
+	{ErrMachineVersionConflict, http.StatusConflict, CodeConflict},
+	{ErrMachineClaimed, http.StatusConflict, CodeConflict},
+	{resilience.ErrCircuitOpen, http.StatusServiceUnavailable, CodeUnavailable},
+	{storage.ErrTooLarge, http.StatusRequestEntityTooLarge, CodePayloadTooLarge},
+	{storage.ErrUnsupportedContent, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType},
+}
+
+// ToAPIError classifies any error returned by a handler. APIErrors are returned
+// as-is, known sentinels are mapped through errorMappings, and everything else
+// becomes an opaque 500 so internal details never leak to clients.
+func ToAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			return &APIError{Status: m.status, Code: m.code, Message: m.err.Error(), Err: err}
+		}
+	}
+	return &APIError{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeInternal,
+		Message: "internal server error",
+		Err:     err,
+	}
+}
+
+// NewBindError is returned by handlers when the request body cannot be decoded.
+// Errors the binder already classified (oversized body, unknown fields) pass through.
+func NewBindError(cause error) *APIError {
+	var apiErr *APIError
+	if errors.As(cause, &apiErr) {
+		return apiErr
+	}
+	return NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "invalid request body").WithCause(cause)
+}
+
+// NewValidationError converts the error returned by validator.Struct into an
+// APIError listing every offending field.
+func NewValidationError(err error) *APIError {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return NewAPIError(http.StatusBadRequest, CodeValidationFailed, "validation failed").WithCause(err)
+	}
+	fields := make([]FieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		fields = append(fields, FieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Param:   fe.Param(),
+			Message: fieldMessage(fe),
+		})
+	}
+	return ValidationFailed(fields...)
+}
+
+// ValidationFailed builds a validation APIError from hand-written field errors,
+// for checks that are not expressed as struct tags.
+func ValidationFailed(fields ...FieldError) *APIError {
+	apiErr := NewAPIError(http.StatusBadRequest, CodeValidationFailed, "validation failed")
+	apiErr.Fields = fields
+	return apiErr
+}
+
+// fieldMessage renders a short English explanation for a failed validation rule.
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fe.Field() + " is required"
+	case "email":
+		return fe.Field() + " must be a valid email address"
+	case "url":
+		return fe.Field() + " must be a valid URL"
+	case "min":
+		return fmt.Sprintf("%s must be at least %s", fe.Field(), fe.Param())
+	case "max":
+		return fmt.Sprintf("%s must be at most %s", fe.Field(), fe.Param())
+	case "gt":
+		return fmt.Sprintf("%s must be greater than %s", fe.Field(), fe.Param())
+	case "gte":
+		return fmt.Sprintf("%s must be greater than or equal to %s", fe.Field(), fe.Param())
+	case "lt":
+		return fmt.Sprintf("%s must be less than %s", fe.Field(), fe.Param())
+	case "lte":
+		return fmt.Sprintf("%s must be less than or equal to %s", fe.Field(), fe.Param())
+	case "oneof":
+		return fmt.Sprintf("%s must be one of [%s]", fe.Field(), strings.ReplaceAll(fe.Param(), " ", ", "))
+	}
+	return fmt.Sprintf("%s failed the %q rule", fe.Field(), fe.Tag())
+}
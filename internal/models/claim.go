@@ -0,0 +1,120 @@
+package models
+
+import "time"
+
+// ClaimType is what went wrong with a claimed order.
+type ClaimType string
+
+const (
+	ClaimTypeLost    ClaimType = "LOST"
+	ClaimTypeDamaged ClaimType = "DAMAGED"
+)
+
+// ClaimStatus is where a claim is in adjudication.
+type ClaimStatus string
+
+const (
+	ClaimStatusOpen     ClaimStatus = "OPEN"     // Filed, waiting for an admin.
+	ClaimStatusApproved ClaimStatus = "APPROVED" // Paid out as a refund or wallet credit.
+	ClaimStatusRejected ClaimStatus = "REJECTED"
+)
+
+// ClaimResolution is how an approved claim is paid out.
+type ClaimResolution string
+
+const (
+	// ClaimResolutionRefund refunds part or all of the order's payment.
+	ClaimResolutionRefund ClaimResolution = "REFUND"
+	// ClaimResolutionCredit adds the amount to the customer's wallet.
+	ClaimResolutionCredit ClaimResolution = "CREDIT"
+)
+
+// Claims can be filed for ClaimWindow after an order is delivered or fails,
+// with up to MaxClaimPhotos photos.
+const (
+	ClaimWindow    = 30 * 24 * time.Hour
+	MaxClaimPhotos = 5
+)
+
+// Claim is a customer's claim for a lost or damaged package. An order takes
+// one claim; the decision fields are set once an admin has decided it.
+type Claim struct {
+	ID            string       `json:"id"`
+	OrderID       string       `json:"order_id"`
+	UserID        string       `json:"user_id"`
+	Type          ClaimType    `json:"type"`
+	Description   string       `json:"description"`
+	AmountClaimed float64      `json:"amount_claimed"`
+	Status        ClaimStatus  `json:"status"`
+	Photos        []ClaimPhoto `json:"photos"`
+	// InsuredValue is the insured value of the order, if it was insured; it
+	// caps the amount claimed.
+	InsuredValue *float64 `json:"insured_value,omitempty"`
+	// Resolution and AmountApproved are set on approved claims; RefundID on
+	// those resolved with a refund.
+	Resolution     *ClaimResolution `json:"resolution,omitempty"`
+	AmountApproved *float64         `json:"amount_approved,omitempty"`
+	RefundID       string           `json:"refund_id,omitempty"`
+	DecisionNote   string           `json:"decision_note,omitempty"`
+	DecidedBy      *string          `json:"decided_by,omitempty"`
+	DecidedAt      *time.Time       `json:"decided_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// ClaimPhoto is a photo attached to a claim. URL is a short-lived download
+// link, issued each time the claim is read.
+type ClaimPhoto struct {
+	ID          string    `json:"id"`
+	Key         string    `json:"-"` // Storage key.
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	URL         string    `json:"url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CreateClaimRequest files a claim against an order.
+type CreateClaimRequest struct {
+	Type        ClaimType `json:"type" validate:"required,oneof=LOST DAMAGED"`
+	Description string    `json:"description" validate:"required,max=2000"`
+	// Amount is what the customer asks for, in USD.
+	Amount float64 `json:"amount" validate:"required,gt=0"`
+}
+
+// ClaimDecisionRequest approves or rejects an open claim. An approval pays
+// out Amount, or the amount claimed when it is zero, by Resolution.
+type ClaimDecisionRequest struct {
+	Approve    bool            `json:"approve"`
+	Resolution ClaimResolution `json:"resolution" validate:"required_if=Approve true,omitempty,oneof=REFUND CREDIT"`
+	Amount     float64         `json:"amount" validate:"gte=0"`
+	Note       string          `json:"note" validate:"max=1000"`
+}
+
+// ClaimQuery selects one page of the admin claim listing, oldest first so
+// the longest-waiting claims lead. A nil Status does not filter.
+type ClaimQuery struct {
+	Page   int
+	Limit  int
+	Status *ClaimStatus
+}
+
+// ClaimPage is one page of the admin claim listing. Photos are not loaded.
+type ClaimPage struct {
+	Claims []*Claim `json:"claims"`
+	Total  int      `json:"total"`
+}
+
+// WalletCredit is one entry in a customer's wallet: credit from an approved
+// claim.
+type WalletCredit struct {
+	ID        int64     `json:"id"`
+	Amount    float64   `json:"amount"`
+	Reason    string    `json:"reason"`
+	ClaimID   *string   `json:"claim_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Wallet is a customer's credit balance and its entries, newest first.
+type Wallet struct {
+	Balance float64        `json:"balance"`
+	Credits []WalletCredit `json:"credits"`
+}
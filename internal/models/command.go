@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+// MachineCommandType is an operator command sent to a machine.
+type MachineCommandType string
+
+const (
+	CommandPause        MachineCommandType = "PAUSE"
+	CommandResume       MachineCommandType = "RESUME"
+	CommandReturnToBase MachineCommandType = "RETURN_TO_BASE"
+	CommandReboot       MachineCommandType = "REBOOT"
+)
+
+// MachineCommandStatus tracks a command from queueing to acknowledgement.
+type MachineCommandStatus string
+
+const (
+	// CommandPending is queued but not yet sent to the machine.
+	CommandPending MachineCommandStatus = "PENDING"
+	// CommandDelivered was published over MQTT or returned by polling; it is
+	// sent again until the machine acknowledges it.
+	CommandDelivered MachineCommandStatus = "DELIVERED"
+	// CommandAcknowledged was accepted by the machine.
+	CommandAcknowledged MachineCommandStatus = "ACKNOWLEDGED"
+	// CommandRejected was refused by the machine; Reason says why.
+	CommandRejected MachineCommandStatus = "REJECTED"
+	// CommandExpired was not acknowledged before ExpiresAt.
+	CommandExpired MachineCommandStatus = "EXPIRED"
+)
+
+// DefaultCommandTTL is how long a machine has to acknowledge a command.
+const DefaultCommandTTL = 10 * time.Minute
+
+// MachineCommand is a command queued for a machine. Machines may receive the
+// same command more than once and must deduplicate by ID.
+type MachineCommand struct {
+	ID          string               `json:"id"`
+	MachineID   string               `json:"machine_id"`
+	Command     MachineCommandType   `json:"command"`
+	Status      MachineCommandStatus `json:"status"`
+	Reason      string               `json:"reason,omitempty"`     // Set by the machine when it rejects the command.
+	CreatedBy   string               `json:"created_by,omitempty"` // Administrator who sent it.
+	CreatedAt   time.Time            `json:"created_at"`
+	DeliveredAt *time.Time           `json:"delivered_at,omitempty"` // First delivery.
+	AckedAt     *time.Time           `json:"acked_at,omitempty"`
+	ExpiresAt   time.Time            `json:"expires_at"`
+}
+
+// MachineCommandRequest queues a command for a machine.
+type MachineCommandRequest struct {
+	Command MachineCommandType `json:"command" validate:"required,oneof=PAUSE RESUME RETURN_TO_BASE REBOOT"`
+	// TTLSeconds overrides how long the machine has to acknowledge the command.
+	TTLSeconds int `json:"ttl_seconds" validate:"omitempty,min=10,max=86400"`
+}
+
+// MachineCommandAck is a machine's answer to a command, sent over HTTP or
+// published to <prefix>/machines/<id>/commands/ack (with CommandID set).
+type MachineCommandAck struct {
+	CommandID string `json:"command_id,omitempty"`
+	Accepted  *bool  `json:"accepted" validate:"required"`
+	Reason    string `json:"reason" validate:"max=500"`
+}
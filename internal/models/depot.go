@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Depot is a charging station machines return to when their battery is low.
+type Depot struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Location  GeoPoint  `json:"location"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DepotRequest creates a depot.
+type DepotRequest struct {
+	Name     string    `json:"name" validate:"required,max=100"`
+	Location *GeoPoint `json:"location" validate:"required"`
+}
+
+// ChargeTrip is a CHARGING machine's trip back to the nearest depot. The
+// distance and ETA are estimated from the straight-line distance when the
+// trip starts.
+type ChargeTrip struct {
+	MachineID      string    `json:"machine_id"`
+	DepotID        string    `json:"depot_id"`
+	DistanceMeters int       `json:"distance_meters"`
+	ETA            time.Time `json:"eta"`
+	StartedAt      time.Time `json:"started_at"`
+}
@@ -24,18 +24,126 @@ var (
 	// ErrNicknameTaken is returned when a nickname is already in use.
 	ErrNicknameTaken = errors.New("nickname is already taken")
 
+	// ErrNoFieldsToUpdate is returned when a partial update request carries no fields.
+	ErrNoFieldsToUpdate = errors.New("no fields to update")
+
 	// ErrOrderCannotBeCancelled is returned when an attempt is made to cancel an order
-	// that is no longer in a cancellable state (e.g., 'in_transit' or 'delivered').
+	// that is no longer in a cancellable state (e.g., 'ARRIVED' or 'DELIVERED').
 	ErrOrderCannotBeCancelled = errors.New("order cannot be cancelled")
 
 	// ErrOrderCannotBePaid is returned when an attempt is made to pay for an order
 	// that is not in a 'pending' state.
 	ErrOrderCannotBePaid = errors.New("order is not in a state that can be paid for")
 
+	// ErrOrderStatusChanged is returned when an order's status changed between
+	// reading the order and updating it, e.g. an unpaid order cancelled while
+	// its payment was in flight.
+	ErrOrderStatusChanged = errors.New("the order's status changed; reload it and try again")
+
 	// ErrRouteOptionExpired is returned when the user tries to create an order
-	// with a route option ID that is expired or invalid.
+	// with a route option past its expires_at.
 	ErrRouteOptionExpired = errors.New("the delivery quote has expired, please request a new one")
 
+	// ErrRouteOptionNotFound is returned when the user tries to create an order
+	// with a route option ID that was not quoted to them or was already used.
+	ErrRouteOptionNotFound = errors.New("the delivery quote was not found, please request a new one")
+
+	// ErrPaymentFailed is returned when the payment provider declined a
+	// payment. An order it was paying for moves to PAYMENT_FAILED with the
+	// provider's reason.
+	ErrPaymentFailed = errors.New("the payment failed; retry it with another payment method")
+
+	// ErrPaymentUnavailable is returned when a payment could not be made for
+	// a reason other than a decline, e.g. the provider timed out. The order
+	// stays as it was and the request can be retried with the same
+	// idempotency key.
+	ErrPaymentUnavailable = errors.New("the payment could not be processed right now; please try again")
+
+	// ErrNoPaymentAction is returned when a payment is confirmed for an
+	// order without a charge waiting for authentication.
+	ErrNoPaymentAction = errors.New("the order has no payment waiting for authentication")
+
+	// ErrPaymentActionPending is returned when a payment is confirmed before
+	// the customer has completed its authentication.
+	ErrPaymentActionPending = errors.New("the payment has not been authenticated yet")
+
+	// ErrRefundFailed is returned when an order was cancelled but its payment
+	// could not be refunded. Cancelling the order again retries the refund.
+	ErrRefundFailed = errors.New("the order was cancelled but the refund failed; cancel it again to retry")
+
+	// ErrOrderCannotBeReturned is returned when a return is requested for an
+	// order that is not delivered, was delivered more than ReturnWindow ago,
+	// or is itself a return.
+	ErrOrderCannotBeReturned = errors.New("only orders delivered in the last 30 days can be returned")
+
+	// ErrReturnAlreadyExists is returned when a return is requested for an
+	// order that already has one that is not cancelled.
+	ErrReturnAlreadyExists = errors.New("a return has already been requested for this order")
+
+	// ErrOrderCannotBeConfirmed is returned when a recipient confirms delivery of
+	// an order whose machine has not arrived at the dropoff.
+	ErrOrderCannotBeConfirmed = errors.New("delivery can only be confirmed once the machine has arrived")
+
+	// ErrInvalidDeliveryPIN is returned when a handover is completed with the
+	// wrong PIN.
+	ErrInvalidDeliveryPIN = errors.New("the delivery PIN is not correct")
+
+	// ErrDeliveryPINLocked is returned once too many wrong PINs were entered
+	// for an order.
+	ErrDeliveryPINLocked = errors.New("too many wrong delivery PINs; please contact support")
+
+	// ErrReceiptNotAvailable is returned when a receipt is requested for an
+	// order that has not been paid.
+	ErrReceiptNotAvailable = errors.New("a receipt is only available once the order has been paid")
+
+	// ErrClaimNotAllowed is returned when a claim is filed for an order that is
+	// not delivered or failed, or that was more than ClaimWindow ago.
+	ErrClaimNotAllowed = errors.New("claims can only be filed for orders delivered or failed in the last 30 days")
+
+	// ErrClaimAlreadyExists is returned when a claim is filed for an order that
+	// already has one.
+	ErrClaimAlreadyExists = errors.New("a claim has already been filed for this order")
+
+	// ErrClaimAlreadyDecided is returned when a claim that is no longer open is
+	// decided or given more photos.
+	ErrClaimAlreadyDecided = errors.New("this claim has already been decided")
+
+	// ErrTooManyClaimPhotos is returned when a photo is added to a claim that
+	// already has MaxClaimPhotos.
+	ErrTooManyClaimPhotos = errors.New("a claim can have at most 5 photos")
+
+	// ErrClaimNotRefundable is returned when a claim is approved with a refund
+	// for an order that was not paid or was already refunded.
+	ErrClaimNotRefundable = errors.New("this order has no payment left to refund; approve the claim with credit instead")
+
+	// ErrPromoCodeInvalid is returned when an order is paid with a promo code
+	// that does not exist, is disabled or is outside its validity window.
+	ErrPromoCodeInvalid = errors.New("this promo code is not valid")
+
+	// ErrPromoCodeExhausted is returned when a promo code has been redeemed as
+	// often as it may be, in all or by this customer.
+	ErrPromoCodeExhausted = errors.New("this promo code has been used up")
+
+	// ErrPromoCodeAlreadyApplied is returned when an order that already has a
+	// promo code is paid with another one.
+	ErrPromoCodeAlreadyApplied = errors.New("a different promo code has already been applied to this order")
+
+	// ErrPromoCodeTaken is returned when a promo code is created with a code
+	// that already exists.
+	ErrPromoCodeTaken = errors.New("a promo code with this code already exists")
+
+	// ErrPaymentMethodNotFound is returned when a saved payment method does
+	// not exist or belongs to another user.
+	ErrPaymentMethodNotFound = errors.New("the saved payment method was not found")
+
+	// ErrCannotTip is returned when a tip is added after payment to an order
+	// that is not yet delivered.
+	ErrCannotTip = errors.New("a tip can only be added to a delivered order")
+
+	// ErrTipAlreadyAdded is returned when a tip is added to an order that
+	// already has one.
+	ErrTipAlreadyAdded = errors.New("a tip has already been added to this order")
+
 	// ErrCannotSubmitFeedback is returned when a user tries to submit feedback for an order
 	// that is not yet delivered.
 	ErrCannotSubmitFeedback = errors.New("feedback can only be submitted for delivered orders")
@@ -47,4 +155,54 @@ var (
 	// ErrPackageTooLarge indicates that the weight or dimensions of the requested
 	// delivery exceed what our machines can handle.
 	ErrPackageTooLarge = errors.New("package exceeds allowed weight or dimensions")
+
+	// ErrMachineVersionConflict is returned when a machine was modified after the
+	// caller read it. Callers re-read the machine and retry.
+	ErrMachineVersionConflict = errors.New("machine was modified concurrently, please retry")
+
+	// ErrMachineClaimed is returned when a machine picked for an order is no longer
+	// idle, or is being claimed by another request. Callers move on to the next candidate.
+	ErrMachineClaimed = errors.New("machine was claimed by another order")
+
+	// ErrNoMachineAvailable is returned when no idle machine can take an order.
+	ErrNoMachineAvailable = errors.New("no idle machines available")
+
+	// ErrOrderNotBatchable is returned when an order cannot join a delivery run,
+	// e.g. it is unpaid, already assigned or has no coordinates.
+	ErrOrderNotBatchable = errors.New("order cannot be added to a delivery run")
+
+	// ErrInvalidGeometry is returned when a zone polygon is not a valid simple polygon
+	// (e.g. its edges cross each other).
+	ErrInvalidGeometry = errors.New("polygon is not valid")
+
+	// ErrRouteRestricted is returned when every delivery option crosses a
+	// no-fly zone or leaves the service area.
+	ErrRouteRestricted = errors.New("no delivery option avoids the restricted zones")
+
+	// ErrWeatherUnsafe is returned when the weather at the pickup or dropoff
+	// rules out every delivery option.
+	ErrWeatherUnsafe = errors.New("weather conditions rule out every delivery option")
+
+	// ErrNoPricingRule is returned when no pricing rule covers the distance and
+	// time of any delivery option.
+	ErrNoPricingRule = errors.New("no pricing rule covers this delivery")
+
+	// ErrMachineBusy is returned when a machine on a delivery is decommissioned.
+	ErrMachineBusy = errors.New("machine is on a delivery and cannot be decommissioned")
+
+	// ErrInvalidMachineCapacity is returned when a machine is registered with a
+	// payload limit above the limit for its type.
+	ErrInvalidMachineCapacity = errors.New("machine capacity exceeds the limit for its type")
+
+	// ErrInvalidZone is returned when a machine is moved into a zone that does
+	// not exist or is not an operational zone.
+	ErrInvalidZone = errors.New("machines can only join an existing operational zone")
+
+	// ErrIdempotencyKeyInUse is returned when a request arrives while an earlier
+	// request with the same Idempotency-Key is still being processed.
+	ErrIdempotencyKeyInUse = errors.New("a request with this idempotency key is still in progress")
+
+	// ErrIdempotencyKeyReused is returned when an Idempotency-Key is sent again
+	// with a different request body or for a different order.
+	ErrIdempotencyKeyReused = errors.New("this idempotency key was already used for a different request")
 )
@@ -4,10 +4,36 @@ import "time"
 
 // Feedback represents feedback for an order.
 type Feedback struct {
-	ID        string    `json:"id"`
-	OrderID   string    `json:"order_id"`
+	ID      string `json:"id"`
+	OrderID string `json:"order_id"`
+	// MachineID is the machine that delivered the order, nil when none was
+	// assigned. Ratings are averaged per machine.
+	MachineID *string   `json:"machine_id,omitempty"`
 	Rating    int       `json:"rating"`
 	Comment   string    `json:"comment"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
-} 
\ No newline at end of file
+}
+
+// FeedbackQuery selects one page of the admin feedback listing, newest
+// first. An empty MachineID or a zero Rating does not filter.
+type FeedbackQuery struct {
+	Page      int
+	Limit     int
+	MachineID string
+	Rating    int
+}
+
+// FeedbackPage is one page of the admin feedback listing.
+type FeedbackPage struct {
+	Feedback []*Feedback `json:"feedback"`
+	Total    int         `json:"total"`
+}
+
+// MachineRating is the average rating customers gave the orders a machine
+// delivered.
+type MachineRating struct {
+	MachineID     string  `json:"machine_id"`
+	AverageRating float64 `json:"average_rating"`
+	RatingCount   int     `json:"rating_count"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "math"
+
+// InsuranceRequest asks for a package to be insured for its declared value.
+type InsuranceRequest struct {
+	DeclaredValue float64 `json:"declared_value" validate:"required,gt=0"`
+}
+
+// InsurancePolicy prices insurance: the premium is Rate of the declared
+// value, at least MinPremium. Values above MaxDeclaredValue cannot be
+// insured, so a zero MaxDeclaredValue offers no insurance.
+type InsurancePolicy struct {
+	Rate             float64
+	MinPremium       float64
+	MaxDeclaredValue float64
+}
+
+// Premium returns the premium for insuring declaredValue, in cents.
+func (p InsurancePolicy) Premium(declaredValue float64) float64 {
+	return math.Round(math.Max(declaredValue*p.Rate, p.MinPremium)*100) / 100
+}
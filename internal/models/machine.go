@@ -2,38 +2,188 @@
 // It includes the Machine model and request structures for updating machine status.
 package models
 
-import "time"
-
-// MachineType defines the available machine categories.
-const (
-	MachineTypeDrone = "DRONE"
-	MachineTypeRobot = "ROBOT"
-)
-
-// Machine status constants used throughout the application.
-const (
-	StatusIdle        = "IDLE"
-	StatusInTransit   = "IN_TRANSIT"
-	StatusCharging    = "CHARGING"
-	StatusMaintenance = "MAINTENANCE"
+import (
+	"fmt"
+	"sort"
+	"time"
 )
 
 // Machine represents a delivery machine such as a drone or ground robot.
 type Machine struct {
-	ID           string    `json:"id"`
-	Type         string    `json:"type"`
-	Status       string    `json:"status"`
-	Latitude     float64   `json:"latitude"`
-	Longitude    float64   `json:"longitude"`
-	BatteryLevel int       `json:"battery_level"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           string        `json:"id"`
+	Type         MachineType   `json:"type"`
+	Status       MachineStatus `json:"status"`
+	Latitude     float64       `json:"latitude"`
+	Longitude    float64       `json:"longitude"`
+	BatteryLevel int           `json:"battery_level"`
+	MaxWeightKG  *float64      `json:"max_weight_kg,omitempty"` // Per-machine payload limit; nil means the limit for its type
+	ZoneID       *string       `json:"zone_id,omitempty"`       // Operational zone the machine serves; nil means none
+	// FirmwareVersion is the version last reported by the machine; empty until it reports one.
+	FirmwareVersion string     `json:"firmware_version,omitempty"`
+	Version         int        `json:"version"` // 乐观锁版本号，每次写入递增
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	DeletedAt       *time.Time `json:"deleted_at,omitempty"` // 软删除时间，仅管理员可见
+}
+
+// Carries reports whether the machine's own payload limit, if it has one,
+// allows a package of the given weight. The limit for its type is checked
+// separately.
+func (m *Machine) Carries(weightKG float64) bool {
+	return m.MaxWeightKG == nil || weightKG <= *m.MaxWeightKG
+}
+
+// RegisterMachineRequest registers a new machine with the fleet.
+type RegisterMachineRequest struct {
+	Type         MachineType `json:"type" validate:"required,oneof=DRONE ROBOT"`
+	Location     *GeoPoint   `json:"location" validate:"required"`
+	BatteryLevel *int        `json:"battery_level" validate:"omitempty,min=0,max=100"` // Defaults to 100.
+	MaxWeightKG  *float64    `json:"max_weight_kg" validate:"omitempty,gt=0"`          // Defaults to the limit for the type.
+}
+
+// MachineRegistration is returned once when a machine is registered. The API
+// key is not stored and cannot be shown again; rotate it if it is lost.
+type MachineRegistration struct {
+	Machine *Machine `json:"machine"`
+	APIKey  string   `json:"api_key"`
+}
+
+// FleetStats summarizes the fleet for monitoring dashboards. Deleted machines
+// are not counted.
+type FleetStats struct {
+	TotalMachines       int                   `json:"total_machines"`
+	ByStatus            map[MachineStatus]int `json:"by_status"`
+	ByType              map[MachineType]int   `json:"by_type"`
+	AverageBatteryLevel float64               `json:"average_battery_level"` // 0 when the fleet is empty
+	MachinesOffline     int                   `json:"machines_offline"`
+	OrdersInTransit     int                   `json:"orders_in_transit"` // Orders in IN_PROGRESS or ARRIVED
+}
+
+// StaleMachine is a machine that was just marked OFFLINE because its last
+// heartbeat is too old.
+type StaleMachine struct {
+	ID              string        `json:"id"`
+	Type            MachineType   `json:"type"`
+	PreviousStatus  MachineStatus `json:"previous_status"`
+	LastHeartbeatAt *time.Time    `json:"last_heartbeat_at"` // nil if it never sent one
+}
+
+// MachineCapacity is the largest package a machine type can carry, stored in
+// the machine_type_capacities table. Dimensions are in meters.
+type MachineCapacity struct {
+	Type        MachineType `json:"type"`
+	MaxWeightKG float64     `json:"max_weight_kg"`
+	MaxLengthM  float64     `json:"max_length_m"`
+	MaxWidthM   float64     `json:"max_width_m"`
+	MaxHeightM  float64     `json:"max_height_m"`
+}
+
+// Fits reports whether a package of the given weight and dimensions can be
+// carried. The package may be rotated, so its sides are compared with the
+// limits from longest to shortest.
+func (c MachineCapacity) Fits(weightKG float64, d Dimensions) bool {
+	if weightKG > c.MaxWeightKG {
+		return false
+	}
+	sides := []float64{d.Length, d.Width, d.Height}
+	limits := []float64{c.MaxLengthM, c.MaxWidthM, c.MaxHeightM}
+	sort.Sort(sort.Reverse(sort.Float64Slice(sides)))
+	sort.Sort(sort.Reverse(sort.Float64Slice(limits)))
+	for i := range sides {
+		if sides[i] > limits[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // MachineStatusUpdateRequest contains fields for updating a machine's
 // status and current location.
 type MachineStatusUpdateRequest struct {
-	Status    string  `json:"status"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	Status          MachineStatus `json:"status"`
+	Latitude        float64       `json:"latitude"`
+	Longitude       float64       `json:"longitude"`
+	FirmwareVersion string        `json:"firmware_version,omitempty"` // Unchanged when omitted.
+}
+
+// MachineAssignment is an order a machine is currently delivering, as the
+// machine sees it: where to collect the package and where to drop it off.
+// Path is the route geometry from pickup to dropoff when one has been
+// computed; without it the machine plans its own way. Recipient is nil when
+// the customer gave no recipient details.
+type MachineAssignment struct {
+	OrderID   string     `json:"order_id"`
+	Pickup    *GeoPoint  `json:"pickup,omitempty"`
+	Dropoff   *GeoPoint  `json:"dropoff,omitempty"`
+	Path      []GeoPoint `json:"path,omitempty"`
+	Recipient *Recipient `json:"recipient,omitempty"`
+}
+
+// Machine history ranges and chart resolution.
+const (
+	DefaultMachineHistoryRange  = 24 * time.Hour
+	DefaultMachineHistoryPoints = 500
+	MaxMachineHistoryPoints     = 2000
+)
+
+// MachineHistoryQuery selects a machine's telemetry snapshots in [From, To),
+// downsampled to at most MaxPoints buckets of equal width.
+type MachineHistoryQuery struct {
+	From      time.Time
+	To        time.Time
+	MaxPoints int
+}
+
+// MachineHistoryPoint summarizes the snapshots in one bucket: the average
+// battery level and the last position and status seen in it.
+type MachineHistoryPoint struct {
+	RecordedAt   time.Time     `json:"recorded_at"` // Start of the bucket.
+	Latitude     float64       `json:"latitude"`
+	Longitude    float64       `json:"longitude"`
+	BatteryLevel float64       `json:"battery_level"`
+	Status       MachineStatus `json:"status"`
+}
+
+// MachineHistory is a downsampled telemetry series for charting. Buckets with
+// no snapshots are omitted.
+type MachineHistory struct {
+	MachineID     string                `json:"machine_id"`
+	From          time.Time             `json:"from"`
+	To            time.Time             `json:"to"`
+	BucketSeconds int                   `json:"bucket_seconds"`
+	Points        []MachineHistoryPoint `json:"points"`
+}
+
+// MachineTelemetry is one report published by a machine over MQTT. The
+// machine is identified by the topic, not the payload.
+type MachineTelemetry struct {
+	Latitude     float64       `json:"latitude"`
+	Longitude    float64       `json:"longitude"`
+	BatteryLevel *int          `json:"battery_level,omitempty"` // Unchanged when omitted.
+	Status       MachineStatus `json:"status,omitempty"`        // Unchanged when omitted.
+	// FirmwareVersion is unchanged when omitted.
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+	// OrderID, when set, also records a tracking event for that order. The
+	// machine must be assigned to it, as with POST /logistics/orders/:orderId/track.
+	OrderID string `json:"order_id,omitempty"`
+}
+
+// MaxFirmwareVersionLength is the longest firmware version a machine may report.
+const MaxFirmwareVersionLength = 64
+
+// Validate checks coordinate ranges, battery level, status and firmware version.
+func (t MachineTelemetry) Validate() error {
+	switch {
+	case t.Latitude < -90 || t.Latitude > 90:
+		return fmt.Errorf("latitude %v out of range", t.Latitude)
+	case t.Longitude < -180 || t.Longitude > 180:
+		return fmt.Errorf("longitude %v out of range", t.Longitude)
+	case t.BatteryLevel != nil && (*t.BatteryLevel < 0 || *t.BatteryLevel > 100):
+		return fmt.Errorf("battery_level %d out of range", *t.BatteryLevel)
+	case t.Status != "" && !t.Status.Valid():
+		return fmt.Errorf("invalid status %q", t.Status)
+	case len(t.FirmwareVersion) > MaxFirmwareVersionLength:
+		return fmt.Errorf("firmware_version longer than %d characters", MaxFirmwareVersionLength)
+	}
+	return nil
 }
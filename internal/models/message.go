@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// MaxOrderMessageLength bounds the body of an order message.
+const MaxOrderMessageLength = 2000
+
+// OrderMessage is a note in an order's thread, between the customer and
+// support or operations staff.
+type OrderMessage struct {
+	ID      string `json:"id"`
+	OrderID string `json:"order_id"`
+	// SenderID is nil once the sender's account is deleted.
+	SenderID   *string `json:"sender_id,omitempty"`
+	SenderRole string  `json:"sender_role"` // RoleCustomer, RoleAdmin or RoleSupport
+	Body       string  `json:"body"`
+	// HiddenAt is set when an admin hid the message. Hidden messages are only
+	// shown to staff.
+	HiddenAt  *time.Time `json:"hidden_at,omitempty"`
+	HiddenBy  *string    `json:"hidden_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// FromStaff reports whether the message was sent by support or an admin.
+func (m *OrderMessage) FromStaff() bool {
+	return m.SenderRole != RoleCustomer
+}
+
+// OrderMessageRequest posts a message to an order's thread.
+type OrderMessageRequest struct {
+	Body string `json:"body" validate:"required,max=2000"`
+}
+
+// UnreadOrderMessages counts the messages of an order's thread its reader has
+// not seen: staff messages for the customer, customer messages for staff.
+type UnreadOrderMessages struct {
+	OrderID string `json:"order_id"`
+	Unread  int    `json:"unread"`
+}
+
+// UnreadMessages lists a user's threads with unread messages, most recent
+// message first.
+type UnreadMessages struct {
+	Orders []UnreadOrderMessages `json:"orders"`
+	Total  int                   `json:"total"`
+}
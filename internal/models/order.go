@@ -1,6 +1,7 @@
 package models
 
 import (
+	"math"
 	"time"
 )
 
@@ -13,29 +14,344 @@ type Order struct {
 	DropoffAddressID string      `json:"dropoff_address_id"`
 	PickupAddress    *Address    `json:"pickup_address,omitempty"`
 	DropoffAddress   *Address    `json:"dropoff_address,omitempty"`
-	Status           string      `json:"status"`
+	Status           OrderStatus `json:"status"`
 	Dimensions       Dimensions  `json:"dimensions"`
 	ItemWeightKg     float64     `json:"item_weight_kg"`
 	Cost             float64     `json:"cost"`
-	Feedback         *Feedback   `json:"feedback,omitempty"`
-	CreatedAt        time.Time   `json:"created_at"`
-	UpdatedAt        time.Time   `json:"updated_at"`
+	// CostBreakdown itemizes Cost; nil for orders placed before it was kept.
+	CostBreakdown *CostBreakdown `json:"cost_breakdown,omitempty"`
+	Priority      Priority       `json:"priority"`
+	Feedback      *Feedback      `json:"feedback,omitempty"`
+	// ScheduledPickupTime is set for orders booked for a later pickup; they
+	// are not dispatched before it.
+	ScheduledPickupTime *time.Time `json:"scheduled_pickup_time,omitempty"`
+	// DeliveryWindow is when the recipient wants the package; nil means any time.
+	DeliveryWindow *DeliveryWindow `json:"delivery_window,omitempty"`
+	// Recipient details are passed to the machine carrying the order.
+	RecipientName        string `json:"recipient_name,omitempty"`
+	RecipientPhone       string `json:"recipient_phone,omitempty"`
+	DeliveryInstructions string `json:"delivery_instructions,omitempty"`
+	// DeliveryPIN completes the handover: the recipient gives it to the
+	// machine or enters it in the app. Only the customer is shown it; it is
+	// empty on orders placed before PINs, which need none.
+	DeliveryPIN string `json:"delivery_pin,omitempty"`
+	// CancellationFee is what the customer paid to cancel the order after
+	// paying for it; the rest was refunded.
+	CancellationFee *float64 `json:"cancellation_fee,omitempty"`
+	// InsuredValue is the declared value the package is insured for; claims
+	// are paid up to it. Nil for uninsured orders.
+	InsuredValue *float64 `json:"insured_value,omitempty"`
+	// PaymentFailureReason is the provider's reason for the last failed
+	// charge while the order is PAYMENT_FAILED.
+	PaymentFailureReason *string `json:"payment_failure_reason,omitempty"`
+	// PaymentAction is only set on the order returned by a payment the
+	// customer still has to authenticate.
+	PaymentAction *PaymentAction `json:"payment_action,omitempty"`
+	// Tip is what the customer tipped, at payment time or after delivery, on
+	// top of Cost. An order takes one tip.
+	Tip float64 `json:"tip,omitempty"`
+	// ReturnOfOrderID is set on a return: the delivered order whose package
+	// it takes back from that order's dropoff to its pickup.
+	ReturnOfOrderID *string   `json:"return_of_order_id,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Scheduled pickups must be booked at least MinScheduleLead and at most
+// MaxScheduleAhead in advance.
+const (
+	MinScheduleLead  = 30 * time.Minute
+	MaxScheduleAhead = 30 * 24 * time.Hour
+)
+
+// Delivery windows must be between MinDeliveryWindow and MaxDeliveryWindow long.
+const (
+	MinDeliveryWindow = 30 * time.Minute
+	MaxDeliveryWindow = 24 * time.Hour
+)
+
+// DeliveryWindow is the interval [Start, End] in which the package should
+// reach the dropoff, e.g. between 2 and 4pm.
+type DeliveryWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Validate checks the window's length and that it has not already closed.
+func (w DeliveryWindow) Validate(now time.Time) error {
+	field := func(rule, param, msg string) error {
+		return ValidationFailed(FieldError{Field: "delivery_window", Rule: rule, Param: param, Message: msg})
+	}
+	switch {
+	case w.Start.IsZero() || w.End.IsZero():
+		return field("required", "", "start and end are required")
+	case w.End.Sub(w.Start) < MinDeliveryWindow:
+		return field("min", MinDeliveryWindow.String(), "must be at least "+MinDeliveryWindow.String()+" long")
+	case w.End.Sub(w.Start) > MaxDeliveryWindow:
+		return field("max", MaxDeliveryWindow.String(), "must be at most "+MaxDeliveryWindow.String()+" long")
+	case !w.End.After(now):
+		return field("future", "", "must end in the future")
+	}
+	return nil
+}
+
+// Contains reports whether t falls inside the window.
+func (w DeliveryWindow) Contains(t time.Time) bool {
+	return !t.Before(w.Start) && !t.After(w.End)
+}
+
+// OrderCursor is a keyset position in an order listing: the (created_at, id)
+// of the last order already returned. Listings are newest first, so the next
+// page starts strictly before it. It is encoded like a TrackingCursor.
+type OrderCursor TrackingCursor
+
+// Encode returns the opaque string form handed to clients.
+func (c OrderCursor) Encode() string { return TrackingCursor(c).Encode() }
+
+// DecodeOrderCursor parses a cursor produced by Encode.
+func DecodeOrderCursor(s string) (*OrderCursor, error) {
+	c, err := DecodeTrackingCursor(s)
+	if err != nil {
+		return nil, err
+	}
+	return (*OrderCursor)(c), nil
+}
+
+// OrderListQuery selects one page of an order listing. With After set the
+// page continues from that cursor; otherwise Page selects it by offset.
+type OrderListQuery struct {
+	Page  int
+	Limit int
+	After *OrderCursor
+}
+
+// OrderPage is one page of an order listing. Total is only counted for
+// offset pages; NextCursor is empty on the last page.
+type OrderPage struct {
+	Orders     []*Order `json:"orders"`
+	Total      *int     `json:"total,omitempty"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// OrderExportQuery selects the orders created in [From, To) for a CSV
+// export; a non-nil Status keeps only orders currently in that status.
+type OrderExportQuery struct {
+	From   time.Time
+	To     time.Time
+	Status *OrderStatus
+}
+
+// OrderExportRow is one line of an order export: the order with its
+// customer's email and address text resolved. Addresses and feedback on the
+// embedded Order are not loaded.
+type OrderExportRow struct {
+	Order
+	CustomerEmail string
+	PickupStreet  string
+	DropoffStreet string
+}
+
+// Recipient is who takes an order's package at the dropoff and how it should
+// be handed over, as shown to the machine delivering it.
+type Recipient struct {
+	Name         string `json:"name,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	Instructions string `json:"delivery_instructions,omitempty"`
+}
+
+// PendingAssignment is a paid order waiting in the assignment queue for an
+// idle machine. EXPRESS orders are served before STANDARD ones.
+type PendingAssignment struct {
+	OrderID    string    `json:"order_id"`
+	Priority   Priority  `json:"priority"`
+	Attempts   int       `json:"attempts"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
 }
 
 // CreateOrderRequest represents the data needed to create a new order from a chosen route option.
 type CreateOrderRequest struct {
-	RouteOptionID string      `json:"route_option_id" validate:"required"`
-	Dimensions    Dimensions  `json:"dimensions" validate:"required"`
-	Items         []byte      `json:"items" validate:"required"`
+	RouteOptionID string     `json:"route_option_id" validate:"required"`
+	Dimensions    Dimensions `json:"dimensions" validate:"required"`
+	Items         []byte     `json:"items" validate:"required"`
+	// ScheduledPickupTime books the pickup for later. It must fall in the hour
+	// the route option was quoted for (its pickup_time).
+	ScheduledPickupTime *time.Time `json:"scheduled_pickup_time,omitempty"`
+	// DeliveryWindow asks for delivery within a time window. The route
+	// option must be able to arrive inside it.
+	DeliveryWindow *DeliveryWindow `json:"delivery_window,omitempty"`
+	// RecipientName and RecipientPhone (E.164, e.g. +14155550123) say who takes
+	// the package at the dropoff; DeliveryInstructions says how, e.g. "leave
+	// with the concierge". All are optional.
+	RecipientName        string `json:"recipient_name" validate:"max=100"`
+	RecipientPhone       string `json:"recipient_phone" validate:"omitempty,e164"`
+	DeliveryInstructions string `json:"delivery_instructions" validate:"max=500"`
+	// IdempotencyKey comes from the Idempotency-Key header.
+	IdempotencyKey string `json:"-"`
+	// DeliveryPIN is generated for the new order.
+	DeliveryPIN string `json:"-"`
 }
 
 // PaymentRequest represents the data needed to pay for an order.
 type PaymentRequest struct {
-	PaymentMethodID string `json:"payment_method_id" validate:"required"`
+	// PaymentMethodID is a card tokenized by the client. To pay with a saved
+	// card, pass its ID as SavedPaymentMethodID instead.
+	PaymentMethodID      string `json:"payment_method_id" validate:"required_without=SavedPaymentMethodID,excluded_with=SavedPaymentMethodID"`
+	SavedPaymentMethodID string `json:"saved_payment_method_id,omitempty" validate:"omitempty,uuid"`
+	// PromoCode, when set, discounts the order before it is charged.
+	PromoCode string `json:"promo_code,omitempty" validate:"omitempty,max=32"`
+	// Tip, when set, is charged together with the order.
+	Tip float64 `json:"tip,omitempty" validate:"omitempty,gt=0,lte=500"`
+	// IdempotencyKey comes from the Idempotency-Key header.
+	IdempotencyKey string `json:"-"`
+}
+
+// TipRequest adds a tip to a delivered order. It is charged to a card like a
+// PaymentRequest.
+type TipRequest struct {
+	Amount               float64 `json:"amount" validate:"gt=0,lte=500"`
+	PaymentMethodID      string  `json:"payment_method_id" validate:"required_without=SavedPaymentMethodID,excluded_with=SavedPaymentMethodID"`
+	SavedPaymentMethodID string  `json:"saved_payment_method_id,omitempty" validate:"omitempty,uuid"`
+	// IdempotencyKey comes from the Idempotency-Key header.
+	IdempotencyKey string `json:"-"`
+}
+
+// MaxIdempotencyKeyLength bounds the Idempotency-Key header.
+const MaxIdempotencyKeyLength = 128
+
+// IdempotencyKeyTTL is how long a completed Idempotency-Key is remembered;
+// after that the same key starts a new request.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// IdempotencyKey records a request sent with an Idempotency-Key header.
+// OrderID is set once the request has completed.
+type IdempotencyKey struct {
+	UserID      string
+	Operation   string
+	Key         string
+	RequestHash string
+	OrderID     *string
+	CreatedAt   time.Time
+	CompletedAt *time.Time
+}
+
+// A delivered order can be returned for ReturnWindow after delivery. Returns
+// requested within FreeReturnWindow cost nothing; later ones are paid like
+// any order.
+const (
+	ReturnWindow     = 30 * 24 * time.Hour
+	FreeReturnWindow = 7 * 24 * time.Hour
+)
+
+// ReturnQuote prices a return of a delivered order. Options run from the
+// order's dropoff back to its pickup and are quoted at their usual cost;
+// when Free is set the return is created at no charge whichever is chosen.
+type ReturnQuote struct {
+	Options   []RouteOption `json:"options"`
+	Free      bool          `json:"free"`
+	FreeUntil time.Time     `json:"free_until"`
+	ReturnBy  time.Time     `json:"return_by"`
+}
+
+// CreateReturnRequest creates a return from one of its quoted options.
+type CreateReturnRequest struct {
+	RouteOptionID string `json:"route_option_id" validate:"required"`
+}
+
+// DeliveryPINLength is the number of digits in a delivery PIN. After
+// MaxDeliveryPINAttempts wrong PINs an order's PIN entry is locked.
+const (
+	DeliveryPINLength      = 6
+	MaxDeliveryPINAttempts = 5
+)
+
+// HandoffRequest completes the handover of an arrived order with its PIN.
+type HandoffRequest struct {
+	PIN string `json:"pin" validate:"required,len=6,numeric"`
+}
+
+// ReorderRequest creates a new order like a past one. Priority defaults to
+// the past order's.
+type ReorderRequest struct {
+	Priority Priority `json:"priority,omitempty" validate:"omitempty,oneof=STANDARD EXPRESS"`
+	// IdempotencyKey comes from the Idempotency-Key header.
+	IdempotencyKey string `json:"-"`
+}
+
+// AdminCancelRequest cancels an order on an operator's behalf.
+type AdminCancelRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+// OrderCancellation is the result of a cancellation. RefundID is set when
+// the order had been paid and its payment was refunded, less Fee when the
+// customer cancelled.
+type OrderCancellation struct {
+	Order        *Order  `json:"order"`
+	Fee          float64 `json:"fee,omitempty"`
+	RefundID     string  `json:"refund_id,omitempty"`
+	RefundAmount float64 `json:"refund_amount,omitempty"`
+}
+
+// CancellationPolicy prices a customer's cancellation of a paid order. The
+// fee is a fraction of the order's cost that grows with how far the delivery
+// has got, at least MinFee and at most the cost; the rest is refunded.
+type CancellationPolicy struct {
+	QueuedFeeRate     float64 // Paid, but no machine is carrying it yet.
+	InProgressFeeRate float64 // A machine is carrying it; cancelling recalls the machine.
+	MinFee            float64
+}
+
+// Fee returns the fee for cancelling an order of cost in status, and false
+// when customers cannot cancel an order in that status. Unpaid orders are
+// cancelled free; ARRIVED and finished ones cannot be cancelled.
+func (p CancellationPolicy) Fee(status OrderStatus, cost float64) (float64, bool) {
+	var rate float64
+	switch status {
+	case OrderStatusPendingPayment, OrderStatusPaymentFailed:
+		return 0, true
+	case OrderStatusConfirmed, OrderStatusScheduled, OrderStatusAssignmentPending:
+		rate = p.QueuedFeeRate
+	case OrderStatusInProgress:
+		rate = p.InProgressFeeRate
+	default:
+		return 0, false
+	}
+	fee := math.Min(math.Max(cost*rate, p.MinFee), cost)
+	return math.Round(fee*100) / 100, true
+}
+
+// CancellationQuote is what cancelling an order now would cost the customer
+// and how much of their payment would be refunded.
+type CancellationQuote struct {
+	Fee          float64 `json:"fee"`
+	RefundAmount float64 `json:"refund_amount"`
 }
 
 // FeedbackRequest represents the data needed to submit feedback for an order.
 type FeedbackRequest struct {
 	Rating  int    `json:"rating" validate:"required,min=1,max=5"`
-	Comment string `json:"comment,omitempty"`
-} 
\ No newline at end of file
+	Comment string `json:"comment,omitempty" validate:"max=1000"`
+}
+
+// StatusActor is who made an order status change.
+type StatusActor string
+
+const (
+	ActorUser    StatusActor = "USER"    // The customer who owns the order.
+	ActorAdmin   StatusActor = "ADMIN"   // An operator acting on the order.
+	ActorSystem  StatusActor = "SYSTEM"  // The dispatcher or another background job.
+	ActorMachine StatusActor = "MACHINE" // The machine carrying the order, e.g. on arrival.
+)
+
+// OrderStatusEvent records one status change of an order. FromStatus is nil
+// for the event recording the order's creation.
+type OrderStatusEvent struct {
+	ID         int64        `json:"id"`
+	OrderID    string       `json:"order_id"`
+	FromStatus *OrderStatus `json:"from_status,omitempty"`
+	ToStatus   OrderStatus  `json:"to_status"`
+	ActorType  StatusActor  `json:"actor_type"`
+	ActorID    string       `json:"actor_id,omitempty"`
+	Reason     string       `json:"reason,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// PaymentKind is what a payment record moves: money from the customer for
+// the order or as a tip, or back to them.
+type PaymentKind string
+
+const (
+	PaymentKindCharge PaymentKind = "CHARGE"
+	// A tip given at payment time is charged together with the order but
+	// recorded apart from it, with the same ProviderRef.
+	PaymentKindTip    PaymentKind = "TIP"
+	PaymentKindRefund PaymentKind = "REFUND"
+)
+
+// PaymentStatus is the outcome of a payment attempt.
+type PaymentStatus string
+
+const (
+	PaymentStatusSucceeded PaymentStatus = "SUCCEEDED"
+	PaymentStatusFailed    PaymentStatus = "FAILED"
+	// PaymentStatusRequiresAction is a charge waiting for the customer to
+	// authenticate it, e.g. with 3-D Secure.
+	PaymentStatusRequiresAction PaymentStatus = "REQUIRES_ACTION"
+)
+
+// Payment records one attempt to charge or refund an order with the payment
+// provider, whether it succeeded or not. ProviderRef is the provider's ID of
+// the charge or refund, e.g. a Stripe PaymentIntent; failed attempts have a
+// FailureReason instead.
+type Payment struct {
+	ID            string        `json:"id"`
+	OrderID       string        `json:"order_id"`
+	UserID        string        `json:"user_id"`
+	Kind          PaymentKind   `json:"kind"`
+	Amount        float64       `json:"amount"`
+	Provider      string        `json:"provider"`
+	ProviderRef   *string       `json:"provider_ref,omitempty"`
+	Status        PaymentStatus `json:"status"`
+	FailureReason *string       `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+}
+
+// PaymentAction is returned with an order whose charge the customer has to
+// authenticate, e.g. with 3-D Secure, before it completes. The client
+// authenticates the charge with ClientSecret, e.g. with Stripe.js's
+// handleNextAction, then confirms the payment.
+type PaymentAction struct {
+	Status       string `json:"status"` // "requires_action"
+	PaymentID    string `json:"payment_id"`
+	ClientSecret string `json:"client_secret"`
+}
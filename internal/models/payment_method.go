@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// PaymentMethod is a card a customer saved with the payment provider, so
+// orders can be paid with it by reference instead of entering it again.
+type PaymentMethod struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	ProviderID string    `json:"-"` // The provider's ID of the card, e.g. Stripe's "pm_...".
+	Brand      string    `json:"brand"`
+	Last4      string    `json:"last4"`
+	ExpMonth   int       `json:"exp_month"`
+	ExpYear    int       `json:"exp_year"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// AddPaymentMethodRequest saves a card the client has tokenized with the
+// payment provider, e.g. with Stripe.js.
+type AddPaymentMethodRequest struct {
+	PaymentMethodID string `json:"payment_method_id" validate:"required,max=255"`
+}
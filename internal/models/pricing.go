@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// PricingRule prices quotes for one machine type as
+// (BaseFare + PerKM × km) × Multiplier.
+//
+// A rule applies to deliveries whose distance is in [MinKM, MaxKM) and, when
+// it has an hour window, whose requested time falls in [StartHour, EndHour).
+// A window with EndHour before StartHour wraps past midnight. Of the rules
+// that apply, one with an hour window beats an all-day rule, and then the one
+// with the highest MinKM wins.
+type PricingRule struct {
+	ID          string      `json:"id"`
+	MachineType MachineType `json:"machine_type"`
+	MinKM       float64     `json:"min_km"`
+	MaxKM       *float64    `json:"max_km,omitempty"`     // Nil means no upper bound.
+	StartHour   *int        `json:"start_hour,omitempty"` // 0-23; nil means all day.
+	EndHour     *int        `json:"end_hour,omitempty"`   // 0-24; set together with StartHour.
+	BaseFare    float64     `json:"base_fare"`
+	PerKM       float64     `json:"per_km"`
+	Multiplier  float64     `json:"multiplier"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// PricingRuleRequest creates or replaces a pricing rule. Multiplier defaults to 1.
+type PricingRuleRequest struct {
+	MachineType MachineType `json:"machine_type" validate:"required,oneof=DRONE ROBOT"`
+	MinKM       float64     `json:"min_km" validate:"gte=0"`
+	MaxKM       *float64    `json:"max_km" validate:"omitempty,gt=0"`
+	StartHour   *int        `json:"start_hour" validate:"omitempty,min=0,max=23"`
+	EndHour     *int        `json:"end_hour" validate:"omitempty,min=0,max=24"`
+	BaseFare    float64     `json:"base_fare" validate:"gte=0"`
+	PerKM       float64     `json:"per_km" validate:"gte=0"`
+	Multiplier  *float64    `json:"multiplier" validate:"omitempty,gt=0"`
+}
+
+// Applies reports whether the rule covers a delivery of km kilometres
+// requested during hour (0-23).
+func (r *PricingRule) Applies(km float64, hour int) bool {
+	if km < r.MinKM || (r.MaxKM != nil && km >= *r.MaxKM) {
+		return false
+	}
+	if r.StartHour == nil || r.EndHour == nil {
+		return true
+	}
+	start, end := *r.StartHour, *r.EndHour%24
+	if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end // Wraps past midnight.
+}
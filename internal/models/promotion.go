@@ -0,0 +1,92 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// PromoDiscountType is how a promo code discounts an order.
+type PromoDiscountType string
+
+const (
+	// PromoDiscountPercent takes Value percent off the order's total.
+	PromoDiscountPercent PromoDiscountType = "PERCENT"
+	// PromoDiscountFixed takes Value USD off the order's total.
+	PromoDiscountFixed PromoDiscountType = "FIXED"
+)
+
+// PromoCode is a code customers enter when paying for an order to get a
+// discount. It can be redeemed MaxRedemptions times in all and MaxPerUser
+// times by each customer, nil meaning no limit, between ValidFrom and
+// ValidUntil. A disabled code cannot be redeemed any more.
+type PromoCode struct {
+	ID             string            `json:"id"`
+	Code           string            `json:"code"`
+	DiscountType   PromoDiscountType `json:"discount_type"`
+	Value          float64           `json:"value"`
+	MaxRedemptions *int              `json:"max_redemptions,omitempty"`
+	MaxPerUser     *int              `json:"max_per_user,omitempty"`
+	Redemptions    int               `json:"redemptions"`
+	ValidFrom      *time.Time        `json:"valid_from,omitempty"`
+	ValidUntil     *time.Time        `json:"valid_until,omitempty"`
+	DisabledAt     *time.Time        `json:"disabled_at,omitempty"`
+	CreatedBy      *string           `json:"created_by,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+// Redeemable reports whether the code can be redeemed at now, leaving its
+// usage limits aside.
+func (p *PromoCode) Redeemable(now time.Time) bool {
+	if p.DisabledAt != nil {
+		return false
+	}
+	if p.ValidFrom != nil && now.Before(*p.ValidFrom) {
+		return false
+	}
+	return p.ValidUntil == nil || now.Before(*p.ValidUntil)
+}
+
+// Discount returns what the code takes off total, in cents and at most
+// total.
+func (p *PromoCode) Discount(total float64) float64 {
+	discount := p.Value
+	if p.DiscountType == PromoDiscountPercent {
+		discount = total * p.Value / 100
+	}
+	return math.Round(math.Min(discount, total)*100) / 100
+}
+
+// CreatePromoCodeRequest creates a promo code. Codes are case-insensitive
+// and stored in upper case.
+type CreatePromoCodeRequest struct {
+	Code           string            `json:"code" validate:"required,alphanum,min=3,max=32"`
+	DiscountType   PromoDiscountType `json:"discount_type" validate:"required,oneof=PERCENT FIXED"`
+	Value          float64           `json:"value" validate:"required,gt=0"`
+	MaxRedemptions *int              `json:"max_redemptions,omitempty" validate:"omitempty,gte=1"`
+	MaxPerUser     *int              `json:"max_per_user,omitempty" validate:"omitempty,gte=1"`
+	ValidFrom      *time.Time        `json:"valid_from,omitempty"`
+	ValidUntil     *time.Time        `json:"valid_until,omitempty"`
+}
+
+// PromoCodeQuery selects one page of the admin promo code listing, newest
+// first.
+type PromoCodeQuery struct {
+	Page  int
+	Limit int
+}
+
+// PromoCodePage is one page of the admin promo code listing.
+type PromoCodePage struct {
+	PromoCodes []*PromoCode `json:"promo_codes"`
+	Total      int          `json:"total"`
+}
+
+// PromoRedemption records a promo code applied to an order.
+type PromoRedemption struct {
+	PromoCodeID string    `json:"promo_code_id"`
+	Code        string    `json:"code"`
+	OrderID     string    `json:"order_id"`
+	UserID      string    `json:"user_id"`
+	Discount    float64   `json:"discount"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,88 @@
+package models
+
+import "time"
+
+// Report ranges.
+const (
+	DefaultReportRange = 30 * 24 * time.Hour
+	MaxReportRange     = 366 * 24 * time.Hour
+)
+
+// ReportQuery selects the half-open range [From, To) a fleet report covers.
+type ReportQuery struct {
+	From time.Time
+	To   time.Time
+}
+
+// MachineUtilization is how long a machine spent in each status, measured
+// from telemetry snapshots. A snapshot's status is assumed to hold until the
+// next snapshot; gaps in the snapshots are not counted.
+type MachineUtilization struct {
+	MachineID        string      `json:"machine_id"`
+	Type             MachineType `json:"type"`
+	InTransitSeconds int64       `json:"in_transit_seconds"`
+	IdleSeconds      int64       `json:"idle_seconds"`
+	ChargingSeconds  int64       `json:"charging_seconds"`
+	OtherSeconds     int64       `json:"other_seconds"` // MAINTENANCE and OFFLINE
+	// Utilization is the share of observed time spent in transit, 0 to 1.
+	Utilization float64 `json:"utilization"`
+}
+
+// UtilizationReport lists every machine with telemetry in the range.
+type UtilizationReport struct {
+	From     time.Time            `json:"from"`
+	To       time.Time            `json:"to"`
+	Machines []MachineUtilization `json:"machines"`
+}
+
+// DailyDeliveries counts the orders confirmed as delivered on one UTC day.
+type DailyDeliveries struct {
+	Date       string `json:"date"` // YYYY-MM-DD
+	Deliveries int    `json:"deliveries"`
+	ByDrone    int    `json:"by_drone"`
+	ByRobot    int    `json:"by_robot"`
+}
+
+// DeliveriesReport has one entry per day in the range, including days
+// without deliveries.
+type DeliveriesReport struct {
+	From time.Time         `json:"from"`
+	To   time.Time         `json:"to"`
+	Days []DailyDeliveries `json:"days"`
+}
+
+// DailyRevenue sums the payments that succeeded on one UTC day: Charged for
+// orders, Tips apart from them, and Refunded to customers. Net is what was
+// kept.
+type DailyRevenue struct {
+	Date     string  `json:"date"` // YYYY-MM-DD
+	Charged  float64 `json:"charged"`
+	Tips     float64 `json:"tips"`
+	Refunded float64 `json:"refunded"`
+	Net      float64 `json:"net"`
+}
+
+// RevenueReport has one entry per day in the range, including days without
+// payments.
+type RevenueReport struct {
+	From time.Time      `json:"from"`
+	To   time.Time      `json:"to"`
+	Days []DailyRevenue `json:"days"`
+}
+
+// WeeklyDistance is the distance a machine traveled in one ISO week (starting
+// Monday, UTC), summed as straight lines between telemetry snapshots.
+type WeeklyDistance struct {
+	WeekStart  string      `json:"week_start"` // YYYY-MM-DD
+	MachineID  string      `json:"machine_id"`
+	Type       MachineType `json:"type"`
+	DistanceKM float64     `json:"distance_km"`
+}
+
+// DistanceReport lists machine-weeks with telemetry in the range, by week and
+// then machine.
+type DistanceReport struct {
+	From  time.Time        `json:"from"`
+	To    time.Time        `json:"to"`
+	Weeks []WeeklyDistance `json:"weeks"`
+}
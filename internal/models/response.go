@@ -2,8 +2,10 @@ package models
 
 // ErrorResponse is a generic structure for JSON error responses.
 type ErrorResponse struct {
-	Message string `json:"message"`
-	Details string `json:"details,omitempty"` // Optional additional details
+	Code    ErrorCode    `json:"code,omitempty"` // Stable machine-readable code, see api_error.go
+	Message string       `json:"message"`
+	Details string       `json:"details,omitempty"` // Optional additional details
+	Fields  []FieldError `json:"fields,omitempty"`  // Per-field validation failures
 }
 
 type PaginatedResponse struct {
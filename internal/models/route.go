@@ -1,11 +1,8 @@
 package models
 
-import "time"
-
-// Strategy constants for different routing modes.
-const (
-	FastestStrategy  = "FASTEST"
-	CheapestStrategy = "CHEAPEST"
+import (
+	"math"
+	"time"
 )
 
 // Dimensions describes the package size in meters.
@@ -23,23 +20,95 @@ type RouteRequest struct {
 	DeliveryLocation Address    `json:"delivery_location"`
 	WeightKG         float64    `json:"weight_kg"`
 	Dimensions       Dimensions `json:"dimensions"`
-	RequestedTime    time.Time  `json:"requested_time"`
-	OrderID          string     `json:"order_id,omitempty"`
+	// RequestedTime is the pickup time to quote for; pricing rules with hour
+	// windows apply to its hour. Zero means now.
+	RequestedTime time.Time `json:"requested_time"`
+	// DeliveryWindow, when set, marks each option with whether it arrives
+	// inside the window.
+	DeliveryWindow *DeliveryWindow `json:"delivery_window,omitempty"`
+	OrderID        string          `json:"order_id,omitempty"`
+	// Priority is the tier to quote; empty means STANDARD.
+	Priority Priority `json:"priority,omitempty" validate:"omitempty,oneof=STANDARD EXPRESS"`
+	// Insurance, when set, insures the package for its declared value; the
+	// options quoted include the premium.
+	Insurance *InsuranceRequest `json:"insurance,omitempty"`
 }
 
-// RouteOption represents a single routing option with a price and estimated duration.
+// RouteOption represents a single routing option quoted by the logistics
+// service: its cost is EstimatedCost and its duration DurationSeconds.
 type RouteOption struct {
-	ID                string        `json:"id"`
-	PickupLocation    Address       `json:"pickup_location"`
-	DeliveryLocation  Address       `json:"delivery_location"`
-	Price             float64       `json:"price"`
-	EstimatedDuration time.Duration `json:"estimated_duration"`
-	Polyline          string        `json:"polyline,omitempty"`
-	DistanceMeters    int           `json:"distance_meters,omitempty"`
-	DurationSeconds   int           `json:"duration_seconds,omitempty"`
-	Strategy          string        `json:"strategy,omitempty"`
-	EstimatedCost     float64       `json:"estimated_cost,omitempty"`
-	MachineType       string        `json:"machine_type,omitempty"`
+	ID               string      `json:"id"`
+	PickupLocation   Address     `json:"pickup_location"`
+	DeliveryLocation Address     `json:"delivery_location"`
+	Polyline         string      `json:"polyline,omitempty"`
+	DistanceMeters   int         `json:"distance_meters"`
+	DurationSeconds  int         `json:"duration_seconds"`
+	Strategy         Strategy    `json:"strategy"`
+	EstimatedCost    float64     `json:"estimated_cost"`
+	MachineType      MachineType `json:"machine_type"`
+	// Estimated is set when the maps provider was unavailable and distance and
+	// duration are straight-line estimates; the option has no polyline then.
+	Estimated bool `json:"estimated,omitempty"`
+	// WeatherSurcharge is the fraction added to EstimatedCost for wind or
+	// rain near the machine type's limits (0.25 means +25%).
+	WeatherSurcharge float64 `json:"weather_surcharge,omitempty"`
+	// SurgeMultiplier is the demand factor EstimatedCost includes because few
+	// idle machines are near the pickup for the orders waiting there; 1 when
+	// there is no surge.
+	SurgeMultiplier float64 `json:"surge_multiplier"`
+	// Priority is the tier the option was quoted for; an order created from it
+	// gets this tier. PrioritySurcharge is the fraction EstimatedCost includes
+	// for it (0.5 means +50%).
+	Priority          Priority `json:"priority"`
+	PrioritySurcharge float64  `json:"priority_surcharge,omitempty"`
+	// CostBreakdown itemizes EstimatedCost.
+	CostBreakdown CostBreakdown `json:"cost_breakdown"`
+	// Legs is the route split at its stops; quotes have a single leg.
+	Legs []RouteLeg `json:"legs,omitempty"`
+	// PickupTime is the pickup time the option was priced for. An order for a
+	// later pickup must be scheduled within the same hour.
+	PickupTime time.Time `json:"pickup_time"`
+	// EstimatedArrival is PickupTime plus the route's duration. It does not
+	// include the machine's trip to the pickup.
+	EstimatedArrival time.Time `json:"estimated_arrival"`
+	// WindowFeasible is set when the request had a delivery window: true if
+	// EstimatedArrival falls inside it.
+	WindowFeasible *bool `json:"window_feasible,omitempty"`
+	// ExpiresAt is when the quote stops being orderable; refresh it before
+	// then.
+	ExpiresAt time.Time `json:"expires_at"`
+	// InsuredValue is the declared value an order created from the option is
+	// insured for, 0 if none; the premium is CostBreakdown.Insurance.
+	InsuredValue float64 `json:"insured_value,omitempty"`
+}
+
+// CostBreakdown itemizes a price. Each charge is what that pricing step
+// adds to the amount before it, in cents, so the charges, Tax and Insurance
+// less Discount add up to Total exactly. Insurance is the premium for
+// insuring the package; it is not taxed.
+type CostBreakdown struct {
+	BaseFare       float64 `json:"base_fare"`
+	DistanceCharge float64 `json:"distance_charge"`
+	// PeakSurcharge is added by the time-of-day rule's multiplier.
+	PeakSurcharge     float64 `json:"peak_surcharge"`
+	Surge             float64 `json:"surge"`
+	PrioritySurcharge float64 `json:"priority_surcharge"`
+	WeatherSurcharge  float64 `json:"weather_surcharge"`
+	Tax               float64 `json:"tax"`
+	Insurance         float64 `json:"insurance"`
+	Discount          float64 `json:"discount"`
+	Total             float64 `json:"total"`
+	// Tip is what the customer tipped; it is paid on top of Total.
+	Tip float64 `json:"tip,omitempty"`
+}
+
+// WithDiscount returns b with amount taken off its Total, which does not go
+// below zero.
+func (b CostBreakdown) WithDiscount(amount float64) CostBreakdown {
+	amount = min(amount, b.Total)
+	b.Discount = math.Round((b.Discount+amount)*100) / 100
+	b.Total = math.Round((b.Total-amount)*100) / 100
+	return b
 }
 
 // Route represents a persisted route calculated for an order.
@@ -50,4 +119,23 @@ type Route struct {
 	DistanceMeters  int       `json:"distance_meters"`
 	DurationSeconds int       `json:"duration_seconds"`
 	CreatedAt       time.Time `json:"created_at"`
+	// Legs splits the route at its waypoints, in travel order: pickup to the
+	// first waypoint, between waypoints, then the last waypoint to the dropoff.
+	// Routes saved before legs were recorded have none.
+	Legs []RouteLeg `json:"legs,omitempty"`
+}
+
+// RouteLeg is the part of a route between two consecutive stops.
+type RouteLeg struct {
+	Polyline        string `json:"polyline,omitempty"`
+	DistanceMeters  int    `json:"distance_meters"`
+	DurationSeconds int    `json:"duration_seconds"`
+}
+
+// ComputeRouteRequest lists the stops an order's route passes through
+// between pickup and dropoff, e.g. a depot to collect the package from. The
+// body is optional; without waypoints the route goes straight to the dropoff.
+// Each waypoint needs a street address or a location.
+type ComputeRouteRequest struct {
+	Waypoints []Address `json:"waypoints" validate:"max=10,dive"`
 }
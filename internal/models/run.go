@@ -0,0 +1,68 @@
+package models
+
+import "time"
+
+// StopKind says what a machine does at a run stop.
+type StopKind string
+
+const (
+	StopPickup  StopKind = "PICKUP"
+	StopDropoff StopKind = "DROPOFF"
+)
+
+// DeliveryRun is one trip of a ground robot that carries several orders,
+// visiting their pickup and dropoff points as an ordered list of stops.
+type DeliveryRun struct {
+	ID              string       `json:"id"`
+	MachineID       string       `json:"machine_id"`
+	DistanceMeters  int          `json:"distance_meters"`  // Start to last stop.
+	DurationSeconds int          `json:"duration_seconds"` // Start to last stop, including stop dwell time.
+	Stops           []RunStop    `json:"stops"`
+	Segments        []RunSegment `json:"segments"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+// RunStop is one leg of a delivery run, ending at Location.
+type RunStop struct {
+	Seq            int       `json:"seq"` // 1-based visiting order.
+	OrderID        string    `json:"order_id"`
+	Kind           StopKind  `json:"kind"`
+	Location       GeoPoint  `json:"location"`
+	DistanceMeters int       `json:"distance_meters"` // Cumulative from the start of the run.
+	ETA            time.Time `json:"eta"`
+}
+
+// RunSegment is the part of a run during which one order is on board, from
+// its pickup stop to its dropoff stop. Tracking events for the order are
+// reported while the run is inside this segment.
+type RunSegment struct {
+	OrderID    string    `json:"order_id"`
+	PickupSeq  int       `json:"pickup_seq"`
+	DropoffSeq int       `json:"dropoff_seq"`
+	PickupETA  time.Time `json:"pickup_eta"`
+	DropoffETA time.Time `json:"dropoff_eta"`
+}
+
+// BuildSegments derives the per-order segments from the run's stops.
+func (r *DeliveryRun) BuildSegments() {
+	byOrder := map[string]int{}
+	r.Segments = r.Segments[:0]
+	for _, s := range r.Stops {
+		i, ok := byOrder[s.OrderID]
+		if !ok {
+			i = len(r.Segments)
+			byOrder[s.OrderID] = i
+			r.Segments = append(r.Segments, RunSegment{OrderID: s.OrderID})
+		}
+		if s.Kind == StopPickup {
+			r.Segments[i].PickupSeq, r.Segments[i].PickupETA = s.Seq, s.ETA
+		} else {
+			r.Segments[i].DropoffSeq, r.Segments[i].DropoffETA = s.Seq, s.ETA
+		}
+	}
+}
+
+// CreateRunRequest asks the dispatcher to batch orders onto one robot run.
+type CreateRunRequest struct {
+	OrderIDs []string `json:"order_ids" validate:"required,min=2,max=8,unique,dive,uuid"`
+}
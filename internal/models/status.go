@@ -0,0 +1,199 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// OrderStatus mirrors the order_status database enum.
+type OrderStatus string
+
+const (
+	OrderStatusPendingPayment    OrderStatus = "PENDING_PAYMENT"
+	OrderStatusPaymentFailed     OrderStatus = "PAYMENT_FAILED" // Its charge failed; the customer may retry.
+	OrderStatusConfirmed         OrderStatus = "CONFIRMED"
+	OrderStatusScheduled         OrderStatus = "SCHEDULED"          // Paid, waiting for its scheduled pickup time.
+	OrderStatusAssignmentPending OrderStatus = "ASSIGNMENT_PENDING" // Paid, waiting for an idle machine.
+	OrderStatusInProgress        OrderStatus = "IN_PROGRESS"
+	OrderStatusArrived           OrderStatus = "ARRIVED" // At the dropoff, waiting for the recipient to confirm.
+	OrderStatusDelivered         OrderStatus = "DELIVERED"
+	OrderStatusCancelled         OrderStatus = "CANCELLED"
+	OrderStatusFailed            OrderStatus = "FAILED"
+)
+
+// Valid reports whether s is a known order status.
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderStatusPendingPayment, OrderStatusPaymentFailed, OrderStatusConfirmed, OrderStatusScheduled,
+		OrderStatusAssignmentPending, OrderStatusInProgress, OrderStatusArrived, OrderStatusDelivered,
+		OrderStatusCancelled, OrderStatusFailed:
+		return true
+	}
+	return false
+}
+
+func (s OrderStatus) MarshalJSON() ([]byte, error) {
+	return marshalEnum("order status", string(s), s.Valid())
+}
+func (s OrderStatus) Value() (driver.Value, error) {
+	return valueEnum("order status", string(s), s.Valid())
+}
+func (s *OrderStatus) Scan(src any) error {
+	v, err := scanEnum("order status", src)
+	*s = OrderStatus(v)
+	if err == nil && !s.Valid() {
+		err = fmt.Errorf("models: unknown order status %q", v)
+	}
+	return err
+}
+
+// MachineStatus mirrors the machine_status database enum.
+type MachineStatus string
+
+const (
+	StatusIdle        MachineStatus = "IDLE"
+	StatusInTransit   MachineStatus = "IN_TRANSIT"
+	StatusCharging    MachineStatus = "CHARGING"
+	StatusMaintenance MachineStatus = "MAINTENANCE"
+	// StatusOffline is set by the server when a machine stops sending
+	// heartbeats; its next heartbeat returns it to IDLE, or to IN_TRANSIT if
+	// it still has orders in progress.
+	StatusOffline MachineStatus = "OFFLINE"
+	// StatusReturning is set by the server when a machine's delivery is
+	// cancelled: it heads back to base and is not dispatched until it
+	// reports IDLE there.
+	StatusReturning MachineStatus = "RETURNING"
+)
+
+// Valid reports whether s is a known machine status.
+func (s MachineStatus) Valid() bool {
+	switch s {
+	case StatusIdle, StatusInTransit, StatusCharging, StatusMaintenance, StatusOffline, StatusReturning:
+		return true
+	}
+	return false
+}
+
+func (s MachineStatus) MarshalJSON() ([]byte, error) {
+	return marshalEnum("machine status", string(s), s.Valid())
+}
+func (s MachineStatus) Value() (driver.Value, error) {
+	return valueEnum("machine status", string(s), s.Valid())
+}
+func (s *MachineStatus) Scan(src any) error {
+	v, err := scanEnum("machine status", src)
+	*s = MachineStatus(v)
+	if err == nil && !s.Valid() {
+		err = fmt.Errorf("models: unknown machine status %q", v)
+	}
+	return err
+}
+
+// MachineType mirrors the machine_type database enum.
+type MachineType string
+
+const (
+	MachineTypeDrone MachineType = "DRONE"
+	MachineTypeRobot MachineType = "ROBOT"
+)
+
+// Valid reports whether t is a known machine type.
+func (t MachineType) Valid() bool {
+	return t == MachineTypeDrone || t == MachineTypeRobot
+}
+
+func (t MachineType) MarshalJSON() ([]byte, error) {
+	return marshalEnum("machine type", string(t), t.Valid())
+}
+func (t MachineType) Value() (driver.Value, error) {
+	return valueEnum("machine type", string(t), t.Valid())
+}
+func (t *MachineType) Scan(src any) error {
+	v, err := scanEnum("machine type", src)
+	*t = MachineType(v)
+	if err == nil && !t.Valid() {
+		err = fmt.Errorf("models: unknown machine type %q", v)
+	}
+	return err
+}
+
+// Priority is the service tier of an order. EXPRESS costs ExpressSurcharge
+// more and is assigned a machine before any STANDARD order.
+type Priority string
+
+const (
+	PriorityStandard Priority = "STANDARD"
+	PriorityExpress  Priority = "EXPRESS"
+)
+
+// ExpressSurcharge is the fraction added to the price of an EXPRESS option
+// (0.5 means +50%).
+const ExpressSurcharge = 0.5
+
+// Valid reports whether p is a known priority.
+func (p Priority) Valid() bool {
+	return p == PriorityStandard || p == PriorityExpress
+}
+
+// Surcharge returns the fraction the tier adds to a price.
+func (p Priority) Surcharge() float64 {
+	if p == PriorityExpress {
+		return ExpressSurcharge
+	}
+	return 0
+}
+
+func (p Priority) Value() (driver.Value, error) {
+	return valueEnum("priority", string(p), p.Valid())
+}
+func (p *Priority) Scan(src any) error {
+	v, err := scanEnum("priority", src)
+	*p = Priority(v)
+	if err == nil && !p.Valid() {
+		err = fmt.Errorf("models: unknown priority %q", v)
+	}
+	return err
+}
+
+// Strategy is the routing mode of a quoted RouteOption.
+type Strategy string
+
+const (
+	FastestStrategy  Strategy = "FASTEST"
+	CheapestStrategy Strategy = "CHEAPEST"
+)
+
+// Valid reports whether s is a known routing strategy.
+func (s Strategy) Valid() bool {
+	return s == FastestStrategy || s == CheapestStrategy
+}
+
+func (s Strategy) MarshalJSON() ([]byte, error) { return marshalEnum("strategy", string(s), s.Valid()) }
+
+// marshalEnum refuses to serialize unknown values so a corrupted or
+// uninitialized status never reaches clients as if it were a real state.
+func marshalEnum(kind, v string, valid bool) ([]byte, error) {
+	if !valid {
+		return nil, fmt.Errorf("models: cannot marshal unknown %s %q", kind, v)
+	}
+	return json.Marshal(v)
+}
+
+func valueEnum(kind, v string, valid bool) (driver.Value, error) {
+	if !valid {
+		return nil, fmt.Errorf("models: cannot store unknown %s %q", kind, v)
+	}
+	return v, nil
+}
+
+func scanEnum(kind string, src any) (string, error) {
+	switch v := src.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	default:
+		return "", fmt.Errorf("models: cannot scan %T into %s", src, kind)
+	}
+}
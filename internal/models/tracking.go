@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
 
 // TrackingEvent represents a single location update from a delivery machine.
 type TrackingEvent struct {
@@ -15,7 +20,115 @@ type TrackingEvent struct {
 // TrackingEventRequest contains the data required when a machine reports
 // a new tracking event.
 type TrackingEventRequest struct {
+	// MachineID is ignored: the reporting machine is identified by its API key.
+	// It is still accepted so existing firmware keeps passing strict JSON.
 	MachineID string  `json:"machine_id"`
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
-}
\ No newline at end of file
+}
+
+// MaxTrackingBatchSize caps the points in one TrackingBatchRequest; machines
+// with a longer backlog send several batches.
+const MaxTrackingBatchSize = 1000
+
+// TrackingPoint is one position a machine buffered while it was offline.
+// RecordedAt is the machine's clock when it took the fix and becomes the
+// event's CreatedAt.
+type TrackingPoint struct {
+	Latitude   float64   `json:"latitude" validate:"min=-90,max=90"`
+	Longitude  float64   `json:"longitude" validate:"min=-180,max=180"`
+	RecordedAt time.Time `json:"recorded_at" validate:"required"`
+}
+
+// TrackingBatchRequest uploads buffered points in one request. All points are
+// stored or none are.
+type TrackingBatchRequest struct {
+	Points []TrackingPoint `json:"points" validate:"required,min=1,max=1000,dive"`
+}
+
+// Tracking history page sizes.
+const (
+	DefaultTrackingPageSize = 500
+	MaxTrackingPageSize     = 1000
+)
+
+// TrackingCursor is a keyset position: the (created_at, id) of the last event
+// already returned. The next page starts strictly after it.
+type TrackingCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// TrackingQuery selects one page of an order's tracking history.
+type TrackingQuery struct {
+	Since time.Time       // Only events after this time; zero means all.
+	After *TrackingCursor // Resume after this event; nil starts at the beginning.
+	Limit int
+	// Fresh reads from the primary. Live streams need it to see an event as
+	// soon as its notification arrives, before replicas have caught up.
+	Fresh bool
+}
+
+// TrackingStreamMessage is one frame on the tracking WebSocket. Cursor is the
+// position of Event; a client that reconnects passes the last one it saw as
+// ?cursor= to resume without gaps. After each batch of events the stream sends
+// a frame with only ETA set, recomputed from the newest position; its Cursor
+// repeats the last event's.
+type TrackingStreamMessage struct {
+	Event  *TrackingEvent `json:"event,omitempty"`
+	ETA    *ETA           `json:"eta,omitempty"`
+	Cursor string         `json:"cursor"`
+}
+
+// ETA is the live arrival estimate for an order, recomputed from its latest
+// persisted route and the machine's newest tracking event.
+type ETA struct {
+	OrderID                  string    `json:"order_id"`
+	RemainingDistanceMeters  int       `json:"remaining_distance_meters"`
+	RemainingDurationSeconds int       `json:"remaining_duration_seconds"`
+	EstimatedArrival         time.Time `json:"estimated_arrival"`
+	// Position is the machine's last reported location; nil until it reports one.
+	Position *GeoPoint `json:"position,omitempty"`
+	// UpdatedAt is when Position was reported, or when the estimate was made
+	// if there is no position yet.
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeliveryWindow is the order's window, and WindowRisk how
+	// EstimatedArrival relates to it; both are omitted for orders without one.
+	DeliveryWindow *DeliveryWindow `json:"delivery_window,omitempty"`
+	WindowRisk     WindowRisk      `json:"window_risk,omitempty"`
+}
+
+// WindowRisk rates an arrival estimate against the order's delivery window.
+type WindowRisk string
+
+const (
+	WindowOnTime WindowRisk = "ON_TIME"
+	// WindowAtRisk arrives inside the window but so close to its end that the
+	// estimate's error could make it late.
+	WindowAtRisk WindowRisk = "AT_RISK"
+	WindowLate   WindowRisk = "LATE"
+	WindowEarly  WindowRisk = "EARLY"
+)
+
+// Encode returns the opaque string form handed to clients.
+func (c TrackingCursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeTrackingCursor parses a cursor produced by Encode.
+func DecodeTrackingCursor(s string) (*TrackingCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return nil, errors.New("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return &TrackingCursor{CreatedAt: t, ID: id}, nil
+}
@@ -2,6 +2,18 @@ package models
 
 import "time"
 
+// User roles, mirroring the user_role enum. The role is carried in the JWT.
+const (
+	RoleCustomer = "CUSTOMER"
+	RoleAdmin    = "ADMIN"
+	RoleSupport  = "SUPPORT" // Read-only access to every order.
+)
+
+// RoleMachine is the role under which a delivery machine, authenticated by
+// its API key, reads orders; its machine ID stands in for the user ID. It is
+// not a user role.
+const RoleMachine = "MACHINE"
+
 // User struct
 type User struct {
 	ID             string    `json:"id" db:"id"` // UUID string from DB
@@ -11,6 +23,7 @@ type User struct {
 	AvatarURL      *string   `json:"avatar_url,omitempty" db:"avatar_url"`
 	AuthProvider   string    `json:"auth_provider" db:"auth_provider"`
 	AuthProviderID string    `json:"-" db:"auth_provider_id"`
+	Role           string    `json:"role" db:"role"` // RoleCustomer, RoleAdmin or RoleSupport
 	IsActive       bool      `json:"is_active" db:"is_active"`
 	CreatedAt      time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Webhook limits.
+const (
+	// MaxWebhookEndpoints is how many webhook URLs one customer may register.
+	MaxWebhookEndpoints = 10
+	// MaxWebhookAttempts is how often a delivery is tried before it is FAILED.
+	MaxWebhookAttempts = 8
+)
+
+// WebhookEventOrderStatusChanged is sent for every status change of an order.
+const WebhookEventOrderStatusChanged = "order.status_changed"
+
+// WebhookEndpoint is a URL a customer registered to receive status changes
+// of their orders.
+type WebhookEndpoint struct {
+	ID          string `json:"id"`
+	UserID      string `json:"-"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+	// Secret signs deliveries. It is only returned when the endpoint is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateWebhookRequest registers a webhook URL.
+type CreateWebhookRequest struct {
+	URL         string `json:"url" validate:"required,url,max=2048"`
+	Description string `json:"description" validate:"max=200"`
+}
+
+// WebhookDeliveryStatus tracks a delivery through its retries.
+type WebhookDeliveryStatus string
+
+const (
+	WebhookPending   WebhookDeliveryStatus = "PENDING"   // Not yet accepted; retried at NextAttemptAt.
+	WebhookSucceeded WebhookDeliveryStatus = "SUCCEEDED" // The endpoint answered 2xx.
+	WebhookFailed    WebhookDeliveryStatus = "FAILED"    // Gave up after MaxWebhookAttempts.
+)
+
+// WebhookDelivery is one event sent, or to be sent, to one endpoint.
+type WebhookDelivery struct {
+	ID             string                `json:"id"`
+	EndpointID     string                `json:"endpoint_id"`
+	OrderID        string                `json:"order_id"`
+	EventType      string                `json:"event_type"`
+	Payload        json.RawMessage       `json:"payload"`
+	Status         WebhookDeliveryStatus `json:"status"`
+	Attempts       int                   `json:"attempts"`
+	NextAttemptAt  *time.Time            `json:"next_attempt_at,omitempty"` // Only while PENDING.
+	LastStatusCode *int                  `json:"last_status_code,omitempty"`
+	LastError      string                `json:"last_error,omitempty"`
+	LastAttemptAt  *time.Time            `json:"last_attempt_at,omitempty"`
+	CreatedAt      time.Time             `json:"created_at"`
+	// AttemptLog lists every try, oldest first; only filled for a single delivery.
+	AttemptLog []WebhookAttempt `json:"attempt_log,omitempty"`
+}
+
+// WebhookAttempt is one POST made for a delivery. StatusCode is nil when no
+// response arrived (connection refused, timeout).
+type WebhookAttempt struct {
+	Attempt    int       `json:"attempt"`
+	StatusCode *int      `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// PendingWebhook is a due delivery with what is needed to send it.
+type PendingWebhook struct {
+	WebhookDelivery
+	URL    string
+	Secret string
+}
+
+// WebhookEvent is the JSON body POSTed to an endpoint. ID is the delivery ID
+// and stays the same across retries, so receivers can discard duplicates.
+type WebhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
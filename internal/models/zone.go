@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// ZoneKind says how a zone restricts deliveries.
+type ZoneKind string
+
+const (
+	// ZoneNoFly is an area drones must not fly over.
+	ZoneNoFly ZoneKind = "NO_FLY"
+	// ZoneServiceArea is an area ground robots may drive in. With no service
+	// areas defined, robots are not restricted.
+	ZoneServiceArea ZoneKind = "SERVICE_AREA"
+	// ZoneOperational partitions the fleet. Orders picked up inside it are
+	// only assigned to machines that belong to it.
+	ZoneOperational ZoneKind = "OPERATIONAL"
+)
+
+// Zone is a geofence polygon.
+type Zone struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Kind      ZoneKind   `json:"kind"`
+	Polygon   []GeoPoint `json:"polygon"` // Outer ring; the closing point is implied.
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// ZoneRequest creates or replaces a zone.
+type ZoneRequest struct {
+	Name    string     `json:"name" validate:"required,max=100"`
+	Kind    ZoneKind   `json:"kind" validate:"required,oneof=NO_FLY SERVICE_AREA OPERATIONAL"`
+	Polygon []GeoPoint `json:"polygon" validate:"required,min=3,max=1000,dive"`
+}
+
+// MachineZoneRequest moves a machine into an operational zone, or out of any
+// zone when ZoneID is null.
+type MachineZoneRequest struct {
+	ZoneID *string `json:"zone_id" validate:"omitempty,uuid"`
+}
@@ -0,0 +1,347 @@
+package logistics
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/internal/modules/logistics/agentpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// 机器代理流计数，经 expvar 以 agent_streams.{connected,received,rejected} 导出；connected 为当前连接数
+var agentMetrics = expvar.NewMap("agent_streams")
+
+// AgentKeyMetadata 是机器在 gRPC metadata 中携带 API Key 的键，对应 HTTP 的 X-Machine-Key。
+const AgentKeyMetadata = "x-machine-key"
+
+// DefaultAgentSyncInterval 是流上轮询命令与任务变更的默认间隔
+const DefaultAgentSyncInterval = 5 * time.Second
+
+// agentOutboxSize 是每条流待发送消息的缓冲；缓冲满时推送失败，命令留待下次同步
+const agentOutboxSize = 16
+
+// ErrAgentNotConnected 表示机器没有连接到本实例的 gRPC 流。
+var ErrAgentNotConnected = errors.New("machine has no agent stream on this instance")
+
+// AgentHub 记录连接到本实例的机器流，作为 CommandPublisher 把命令直接推送到机器的流上。
+// 机器连接在其他实例时推送失败，命令由该实例的定期同步送达。
+type AgentHub struct {
+	mu       sync.Mutex
+	sessions map[string]*agentSession
+}
+
+// agentSession 是一条机器流；outbox 中的消息由 Connect 所在的 goroutine 依次发送。
+type agentSession struct {
+	machineID string
+	outbox    chan *agentpb.ServerMessage
+}
+
+// NewAgentHub 创建空的流注册表。
+func NewAgentHub() *AgentHub {
+	return &AgentHub{sessions: make(map[string]*agentSession)}
+}
+
+// PublishCommand 把命令放入机器流的发送队列，不等待发送完成。
+func (h *AgentHub) PublishCommand(ctx context.Context, cmd *models.MachineCommand) error {
+	h.mu.Lock()
+	sess := h.sessions[cmd.MachineID]
+	h.mu.Unlock()
+	if sess == nil {
+		return ErrAgentNotConnected
+	}
+	select {
+	case sess.outbox <- commandMessageProto(cmd):
+		return nil
+	default:
+		return errors.New("agent stream outbox full")
+	}
+}
+
+// register 登记机器的新流；同一台机器重连时新流取代旧流。
+func (h *AgentHub) register(machineID string) *agentSession {
+	sess := &agentSession{machineID: machineID, outbox: make(chan *agentpb.ServerMessage, agentOutboxSize)}
+	h.mu.Lock()
+	h.sessions[machineID] = sess
+	h.mu.Unlock()
+	return sess
+}
+
+// unregister 注销流；已被重连取代的旧流不影响新流。
+func (h *AgentHub) unregister(sess *agentSession) {
+	h.mu.Lock()
+	if h.sessions[sess.machineID] == sess {
+		delete(h.sessions, sess.machineID)
+	}
+	h.mu.Unlock()
+}
+
+// AgentServer 实现 agentpb.MachineAgentServer：机器通过一条双向流上报遥测、心跳与命令确认，
+// 并接收命令和任务变更。上报经 ServiceInterface 处理，与 HTTP 和 MQTT 接口的业务逻辑相同。
+type AgentServer struct {
+	agentpb.UnimplementedMachineAgentServer
+	svc          ServiceInterface
+	hub          *AgentHub
+	syncInterval time.Duration
+}
+
+// NewAgentServer 创建 gRPC 服务实现。hub 须与 WithCommandPublisher 传给 svc 的相同，
+// 命令才能直接推送；syncInterval <= 0 时使用 DefaultAgentSyncInterval。
+func NewAgentServer(svc ServiceInterface, hub *AgentHub, syncInterval time.Duration) *AgentServer {
+	if syncInterval <= 0 {
+		syncInterval = DefaultAgentSyncInterval
+	}
+	return &AgentServer{svc: svc, hub: hub, syncInterval: syncInterval}
+}
+
+// GRPCServer 创建只注册 MachineAgent 服务的 gRPC 服务器。keepalive 探测及时发现断线的机器，
+// 注销其流，命令改由其他途径送达。
+func (s *AgentServer) GRPCServer() *grpc.Server {
+	gs := grpc.NewServer(
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: 30 * time.Second, Timeout: 10 * time.Second}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 10 * time.Second, PermitWithoutStream: true}),
+	)
+	agentpb.RegisterMachineAgentServer(gs, s)
+	return gs
+}
+
+// Connect 认证机器后保持流直到任一方关闭。连接建立时立即下发未确认的命令与当前任务，
+// 之后每隔 syncInterval 同步一次，所以连接在其他实例上的命令与派单也能送达。
+func (s *AgentServer) Connect(stream agentpb.MachineAgent_ConnectServer) error {
+	ctx := stream.Context()
+	machineID, err := s.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+	sess := s.hub.register(machineID)
+	defer s.hub.unregister(sess)
+	agentMetrics.Add("connected", 1)
+	defer agentMetrics.Add("connected", -1)
+	log.Printf("agent: machine %s connected", machineID)
+
+	recvErr := make(chan error, 1)
+	go func() { recvErr <- s.receive(ctx, stream, sess) }()
+
+	st := &agentSync{sent: map[string]bool{}}
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	if err := s.sync(ctx, stream, sess, st); err != nil {
+		return err
+	}
+	for {
+		select {
+		case msg := <-sess.outbox:
+			if cmd := msg.GetCommand(); cmd != nil {
+				if st.sent[cmd.Id] {
+					continue
+				}
+				st.sent[cmd.Id] = true
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := s.sync(ctx, stream, sess, st); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			log.Printf("agent: machine %s disconnected", machineID)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// authenticate 用 metadata 中的 API Key 识别机器。
+func (s *AgentServer) authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(AgentKeyMetadata)
+	if len(keys) == 0 || keys[0] == "" {
+		return "", status.Error(codes.Unauthenticated, "missing machine API key")
+	}
+	machineID, err := s.svc.AuthenticateMachine(ctx, keys[0])
+	if errors.Is(err, models.ErrInvalidCredentials) {
+		return "", status.Error(codes.Unauthenticated, "invalid machine API key")
+	}
+	if err != nil {
+		log.Printf("agent: authenticate: %v", err)
+		return "", status.Error(codes.Unavailable, "cannot authenticate the machine right now")
+	}
+	return machineID, nil
+}
+
+// agentSync 记录一条流已下发的内容，避免重复发送。只在 Connect 所在的 goroutine 中使用。
+type agentSync struct {
+	sent        map[string]bool // 已下发且尚未确认的命令 ID
+	assignments *agentpb.Assignments
+}
+
+// sync 下发未确认的新命令，以及与上次不同的任务列表。查询失败只记录日志，等下次同步重试。
+func (s *AgentServer) sync(ctx context.Context, stream agentpb.MachineAgent_ConnectServer, sess *agentSession, st *agentSync) error {
+	cmds, err := s.svc.PollMachineCommands(ctx, sess.machineID)
+	if err != nil {
+		log.Printf("agent: machine %s: %v", sess.machineID, err)
+	} else {
+		// 轮询结果只含未确认的命令，已确认或过期的命令就此从 sent 中移除
+		sent := make(map[string]bool, len(cmds))
+		for _, cmd := range cmds {
+			sent[cmd.ID] = true
+			if st.sent[cmd.ID] {
+				continue
+			}
+			if err := stream.Send(commandMessageProto(cmd)); err != nil {
+				return err
+			}
+		}
+		st.sent = sent
+	}
+
+	assignments, err := s.svc.GetMachineAssignments(ctx, sess.machineID)
+	if err != nil {
+		log.Printf("agent: machine %s: %v", sess.machineID, err)
+		return nil
+	}
+	msg := assignmentsProto(assignments)
+	if st.assignments != nil && proto.Equal(st.assignments, msg) {
+		return nil
+	}
+	if err := stream.Send(&agentpb.ServerMessage{Payload: &agentpb.ServerMessage_Assignments{Assignments: msg}}); err != nil {
+		return err
+	}
+	st.assignments = msg
+	return nil
+}
+
+// receive 依次处理机器的上行消息，直到流关闭。被拒绝的消息以 Rejection 回复，不中断流。
+func (s *AgentServer) receive(ctx context.Context, stream agentpb.MachineAgent_ConnectServer, sess *agentSession) error {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		agentMetrics.Add("received", 1)
+		if err := s.handle(ctx, sess.machineID, msg); err != nil {
+			agentMetrics.Add("rejected", 1)
+			apiErr := models.ToAPIError(err)
+			if apiErr.Status >= http.StatusInternalServerError {
+				log.Printf("agent: machine %s: %v", sess.machineID, err)
+			}
+			rejection := &agentpb.ServerMessage{Payload: &agentpb.ServerMessage_Rejection{Rejection: &agentpb.Rejection{
+				Seq:     msg.GetSeq(),
+				Code:    string(apiErr.Code),
+				Message: apiErr.Message,
+			}}}
+			select {
+			case sess.outbox <- rejection:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// handle 处理一条上行消息，与 MQTT 遥测一样限制处理时间。
+func (s *AgentServer) handle(ctx context.Context, machineID string, msg *agentpb.AgentMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, telemetryTimeout)
+	defer cancel()
+	switch p := msg.GetPayload().(type) {
+	case *agentpb.AgentMessage_Telemetry:
+		t := telemetryFromProto(p.Telemetry)
+		if err := t.Validate(); err != nil {
+			return models.NewAPIError(http.StatusBadRequest, models.CodeValidationFailed, err.Error())
+		}
+		return s.svc.IngestTelemetry(ctx, machineID, t)
+	case *agentpb.AgentMessage_Heartbeat:
+		return s.svc.Heartbeat(ctx, machineID)
+	case *agentpb.AgentMessage_Ack:
+		ack := p.Ack
+		switch {
+		case ack.CommandId == "":
+			return models.ValidationFailed(models.FieldError{Field: "command_id", Rule: "required", Message: "command_id is required"})
+		case len(ack.Reason) > 500:
+			return models.ValidationFailed(models.FieldError{Field: "reason", Rule: "max", Param: "500", Message: "reason must be at most 500"})
+		}
+		accepted := ack.Accepted
+		_, err := s.svc.AckMachineCommand(ctx, machineID, ack.CommandId, models.MachineCommandAck{
+			CommandID: ack.CommandId,
+			Accepted:  &accepted,
+			Reason:    ack.Reason,
+		})
+		return err
+	}
+	return models.NewAPIError(http.StatusBadRequest, models.CodeInvalidRequest, "message has no payload")
+}
+
+// telemetryFromProto 把上行遥测转换为 models.MachineTelemetry。
+func telemetryFromProto(t *agentpb.Telemetry) models.MachineTelemetry {
+	out := models.MachineTelemetry{
+		Latitude:        t.Latitude,
+		Longitude:       t.Longitude,
+		Status:          models.MachineStatus(t.Status),
+		FirmwareVersion: t.FirmwareVersion,
+		OrderID:         t.OrderId,
+	}
+	if t.BatteryLevel != nil {
+		level := int(*t.BatteryLevel)
+		out.BatteryLevel = &level
+	}
+	return out
+}
+
+// commandMessageProto 是 commandMessage 的 gRPC 版本。
+func commandMessageProto(cmd *models.MachineCommand) *agentpb.ServerMessage {
+	return &agentpb.ServerMessage{Payload: &agentpb.ServerMessage_Command{Command: &agentpb.Command{
+		Id:        cmd.ID,
+		Command:   string(cmd.Command),
+		CreatedAt: timestamppb.New(cmd.CreatedAt),
+		ExpiresAt: timestamppb.New(cmd.ExpiresAt),
+	}}}
+}
+
+// assignmentsProto 转换 GetMachineAssignments 的结果。
+func assignmentsProto(assignments []models.MachineAssignment) *agentpb.Assignments {
+	out := &agentpb.Assignments{Assignments: make([]*agentpb.Assignment, 0, len(assignments))}
+	for _, a := range assignments {
+		pa := &agentpb.Assignment{
+			OrderId: a.OrderID,
+			Pickup:  geoPointProto(a.Pickup),
+			Dropoff: geoPointProto(a.Dropoff),
+		}
+		for i := range a.Path {
+			pa.Path = append(pa.Path, geoPointProto(&a.Path[i]))
+		}
+		if a.Recipient != nil {
+			pa.Recipient = &agentpb.Recipient{
+				Name:                 a.Recipient.Name,
+				Phone:                a.Recipient.Phone,
+				DeliveryInstructions: a.Recipient.Instructions,
+			}
+		}
+		out.Assignments = append(out.Assignments, pa)
+	}
+	return out
+}
+
+func geoPointProto(p *models.GeoPoint) *agentpb.GeoPoint {
+	if p == nil {
+		return nil
+	}
+	return &agentpb.GeoPoint{Latitude: p.Latitude, Longitude: p.Longitude}
+}
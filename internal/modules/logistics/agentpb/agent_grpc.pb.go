@@ -0,0 +1,124 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: agent.proto
+
+// 机器代理（onboard agent）的 gRPC 接口，独立于 HTTP 端口监听（AGENT_GRPC_PORT）。
+// 与 HTTP 和 MQTT 接口共用 logistics.ServiceInterface，校验与业务规则一致。
+
+package agentpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	MachineAgent_Connect_FullMethodName = "/circuit.agent.v1.MachineAgent/Connect"
+)
+
+// MachineAgentClient is the client API for MachineAgent service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MachineAgentClient interface {
+	// Connect 建立机器的长连接会话，机器以 metadata x-machine-key 携带 API Key 认证。
+	// 机器上行遥测、心跳与命令确认；服务端下行命令与任务（派单及路线）变更。
+	// 被拒绝的上行消息以 Rejection 回复，流保持打开。
+	Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AgentMessage, ServerMessage], error)
+}
+
+type machineAgentClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMachineAgentClient(cc grpc.ClientConnInterface) MachineAgentClient {
+	return &machineAgentClient{cc}
+}
+
+func (c *machineAgentClient) Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AgentMessage, ServerMessage], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &MachineAgent_ServiceDesc.Streams[0], MachineAgent_Connect_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AgentMessage, ServerMessage]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type MachineAgent_ConnectClient = grpc.BidiStreamingClient[AgentMessage, ServerMessage]
+
+// MachineAgentServer is the server API for MachineAgent service.
+// All implementations must embed UnimplementedMachineAgentServer
+// for forward compatibility.
+type MachineAgentServer interface {
+	// Connect 建立机器的长连接会话，机器以 metadata x-machine-key 携带 API Key 认证。
+	// 机器上行遥测、心跳与命令确认；服务端下行命令与任务（派单及路线）变更。
+	// 被拒绝的上行消息以 Rejection 回复，流保持打开。
+	Connect(grpc.BidiStreamingServer[AgentMessage, ServerMessage]) error
+	mustEmbedUnimplementedMachineAgentServer()
+}
+
+// UnimplementedMachineAgentServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMachineAgentServer struct{}
+
+func (UnimplementedMachineAgentServer) Connect(grpc.BidiStreamingServer[AgentMessage, ServerMessage]) error {
+	return status.Error(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedMachineAgentServer) mustEmbedUnimplementedMachineAgentServer() {}
+func (UnimplementedMachineAgentServer) testEmbeddedByValue()                      {}
+
+// UnsafeMachineAgentServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MachineAgentServer will
+// result in compilation errors.
+type UnsafeMachineAgentServer interface {
+	mustEmbedUnimplementedMachineAgentServer()
+}
+
+func RegisterMachineAgentServer(s grpc.ServiceRegistrar, srv MachineAgentServer) {
+	// If the following call panics, it indicates UnimplementedMachineAgentServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&MachineAgent_ServiceDesc, srv)
+}
+
+func _MachineAgent_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MachineAgentServer).Connect(&grpc.GenericServerStream[AgentMessage, ServerMessage]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type MachineAgent_ConnectServer = grpc.BidiStreamingServer[AgentMessage, ServerMessage]
+
+// MachineAgent_ServiceDesc is the grpc.ServiceDesc for MachineAgent service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MachineAgent_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "circuit.agent.v1.MachineAgent",
+	HandlerType: (*MachineAgentServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _MachineAgent_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "agent.proto",
+}
@@ -0,0 +1,6 @@
+// Package agentpb 是 agent.proto 生成的机器代理 gRPC 接口。修改 agent.proto 后重新生成：
+//
+//	go generate ./internal/modules/logistics/agentpb
+package agentpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative agent.proto
@@ -0,0 +1,43 @@
+package logistics
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// DefaultArrivalRadiusMeters 是投递点地理围栏的默认半径：机器上报的位置进入该范围即视为到达。
+// 取值需大于 GPS 误差，又不能大到机器还在隔壁街区就提示收件人取件。
+const DefaultArrivalRadiusMeters = 30.0
+
+// checkArrival 在新轨迹保存后检查机器是否进入投递点的地理围栏；
+// 任一点进入围栏时把配送中的订单置为 ARRIVED，等待收件人确认送达。
+// 订单没有投递点坐标或未启用围栏（半径为 0）时不做任何事。
+func (s *service) checkArrival(ctx context.Context, orderID string, points []models.GeoPoint) error {
+	if s.arrival <= 0 || len(points) == 0 {
+		return nil
+	}
+	_, dropoff, err := s.logisticRepo.GetOrderPoints(ctx, orderID)
+	if err != nil {
+		return fmt.Errorf("fetch points: %w", err)
+	}
+	if dropoff == nil {
+		return nil
+	}
+	for _, p := range points {
+		if haversineKM(p, *dropoff)*1000 > s.arrival {
+			continue
+		}
+		arrived, err := s.logisticRepo.MarkOrderArrived(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if arrived {
+			log.Printf("order %s arrived at dropoff", orderID)
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package logistics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// GetMachineAssignments 返回机器正在配送的订单，按分配顺序排列，供机器轮询新任务。
+// 订单已计算路线时附带解码后的路线坐标；路线不存在或无法解码时 Path 为空，由机器自行规划。
+// 下单时填写了收件人或投递说明的订单附带 Recipient，供机器在投递点交付包裹。
+func (s *service) GetMachineAssignments(ctx context.Context, machineID string) ([]models.MachineAssignment, error) {
+	orderIDs, err := s.logisticRepo.ListMachineOrders(ctx, machineID)
+	if err != nil {
+		return nil, fmt.Errorf("GetMachineAssignments: %w", err)
+	}
+	recipients, err := s.logisticRepo.ListMachineRecipients(ctx, machineID)
+	if err != nil {
+		return nil, fmt.Errorf("GetMachineAssignments: %w", err)
+	}
+	assignments := make([]models.MachineAssignment, 0, len(orderIDs))
+	for _, orderID := range orderIDs {
+		pickup, dropoff, err := s.logisticRepo.GetOrderPoints(ctx, orderID)
+		if err != nil {
+			return nil, fmt.Errorf("GetMachineAssignments: order %s: %w", orderID, err)
+		}
+		a := models.MachineAssignment{OrderID: orderID, Pickup: pickup, Dropoff: dropoff, Recipient: recipients[orderID]}
+		route, err := s.logisticRepo.GetLatestRoute(ctx, orderID)
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+		case err != nil:
+			return nil, fmt.Errorf("GetMachineAssignments: order %s: %w", orderID, err)
+		default:
+			if path, err := decodePolyline(route.Polyline); err == nil && len(path) >= 2 {
+				a.Path = path
+			}
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments, nil
+}
+
+// ReleaseMachine 在订单被取消后让机器带着包裹返回基地：机器没有其他配送中的订单时置为
+// RETURNING 并排队一条 RETURN_TO_BASE 命令；机器仍在配送其他订单时不召回。
+// ctx 中有事务时加入该事务，与订单状态的变更一起提交。机器回到基地上报 IDLE 后才重新参与派单。
+func (s *service) ReleaseMachine(ctx context.Context, machineID string) error {
+	returning, err := s.logisticRepo.ReturnMachine(ctx, machineID)
+	if err != nil {
+		return fmt.Errorf("ReleaseMachine: %w", err)
+	}
+	if !returning {
+		return nil
+	}
+	cmd := &models.MachineCommand{
+		MachineID: machineID,
+		Command:   models.CommandReturnToBase,
+		ExpiresAt: time.Now().Add(s.commandTTL),
+	}
+	if err := s.logisticRepo.CreateMachineCommand(ctx, cmd); err != nil {
+		return fmt.Errorf("ReleaseMachine: %w", err)
+	}
+	commandMetrics.Add("sent", 1)
+	log.Printf("machine %s returning to base (command %s)", machineID, cmd.ID)
+	return nil
+}
+
+// RecallMachine 在订单取消提交之后推送 ReleaseMachine 排队的 RETURN_TO_BASE 命令。
+// 推送失败的命令由 SweepMachineCommands 重试，机器也会在轮询时取得。
+func (s *service) RecallMachine(ctx context.Context, machineID string) error {
+	if s.commands == nil {
+		return nil
+	}
+	pending, err := s.logisticRepo.ListUndeliveredCommands(ctx)
+	if err != nil {
+		return fmt.Errorf("RecallMachine: %w", err)
+	}
+	for _, cmd := range pending {
+		if cmd.MachineID == machineID && cmd.Command == models.CommandReturnToBase {
+			s.publishCommand(ctx, cmd)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package logistics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+const (
+	// robotSpeedKMH 是地面机器人的平均行驶速度，用于估算各站点的 ETA
+	robotSpeedKMH = 6.0
+	// stopDwell 是每个站点的停留时间（装卸货物）
+	stopDwell = 2 * time.Minute
+)
+
+// batchOrder 是参与批量配送的一个订单
+type batchOrder struct {
+	id       string
+	pickup   models.GeoPoint
+	dropoff  models.GeoPoint
+	weightKG float64
+}
+
+// BatchOrders 将多个订单合并为一台地面机器人的一次多站点配送任务。
+//  1. 校验每个订单已支付、尚未分配机器、取件与投递地址都有坐标；
+//  2. 每个包裹都要能放入机器人，且总重量不超过机器人的载重；
+//  3. 取件点中心在运营区内时只考虑该区的机器人；从距取件点中心最近的空闲机器人开始，按最近邻规划站点顺序（取件必须先于投递），
+//     选择第一台载重与电量都足够跑完全程的机器人；
+//  4. 在同一事务中通过 ClaimMachine 原子领取机器人并分配所有订单，再保存任务与站点；
+//     保存失败时领取与分配一并回滚。
+func (s *service) BatchOrders(ctx context.Context, orderIDs []string) (*models.DeliveryRun, error) {
+	orders := make([]batchOrder, 0, len(orderIDs))
+	for _, id := range orderIDs {
+		o, err := s.loadBatchOrder(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	total, err := s.checkBatchCapacity(ctx, orders)
+	if err != nil {
+		return nil, err
+	}
+
+	center := pickupCenter(orders)
+	zoneID, err := s.logisticRepo.FindOperationalZone(ctx, center.Longitude, center.Latitude)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := s.logisticRepo.ListNearestIdleMachines(ctx, center.Longitude, center.Latitude,
+		[]models.MachineType{models.MachineTypeRobot}, zoneID, nearestCandidates)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, models.ErrNoMachineAvailable
+	}
+
+	// 由近到远尝试领取第一台载重与电量都足够跑完全程的机器人；
+	// 领取时已被其他请求占用则换下一台
+	ids := make([]string, len(orders))
+	for i, o := range orders {
+		ids[i] = o.id
+	}
+	var run *models.DeliveryRun
+	for _, m := range candidates {
+		stops := planStops(m, orders)
+		points := make([]models.GeoPoint, len(stops))
+		for i, st := range stops {
+			points[i] = st.Location
+		}
+		if !m.Carries(total) || float64(m.BatteryLevel) < s.battery.RequiredBatteryForStops(m, points) {
+			continue
+		}
+		planned := s.buildRun(m, stops, time.Now())
+		err := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+			if err := s.logisticRepo.ClaimMachine(ctx, m.ID, ids...); err != nil {
+				return err
+			}
+			return s.logisticRepo.CreateDeliveryRun(ctx, planned)
+		})
+		if errors.Is(err, models.ErrMachineClaimed) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		run = planned
+		break
+	}
+	if run == nil {
+		return nil, fmt.Errorf("%w: none of the %d nearest idle robots can carry the batch with enough battery for the run", models.ErrNoMachineAvailable, len(candidates))
+	}
+	return run, nil
+}
+
+// GetDeliveryRun 查询配送任务，包括站点与每个订单的区段
+func (s *service) GetDeliveryRun(ctx context.Context, runID string) (*models.DeliveryRun, error) {
+	return s.logisticRepo.GetDeliveryRun(ctx, runID)
+}
+
+// loadBatchOrder 读取并校验一个待合并的订单
+func (s *service) loadBatchOrder(ctx context.Context, orderID string) (batchOrder, error) {
+	status, err := s.logisticRepo.GetOrderStatus(ctx, orderID)
+	if err != nil {
+		return batchOrder{}, err
+	}
+	if status != models.OrderStatusConfirmed && status != models.OrderStatusAssignmentPending {
+		return batchOrder{}, fmt.Errorf("%w: order %s is %s", models.ErrOrderNotBatchable, orderID, status)
+	}
+	machineID, err := s.logisticRepo.GetOrderMachineID(ctx, orderID)
+	if err != nil {
+		return batchOrder{}, err
+	}
+	if machineID != "" {
+		return batchOrder{}, fmt.Errorf("%w: order %s is already assigned", models.ErrOrderNotBatchable, orderID)
+	}
+	pickup, dropoff, err := s.logisticRepo.GetOrderPoints(ctx, orderID)
+	if err != nil {
+		return batchOrder{}, err
+	}
+	if pickup == nil || dropoff == nil {
+		return batchOrder{}, fmt.Errorf("%w: order %s has no coordinates", models.ErrOrderNotBatchable, orderID)
+	}
+	weightKG, dims, err := s.logisticRepo.GetOrderPackage(ctx, orderID)
+	if err != nil {
+		return batchOrder{}, err
+	}
+	types, err := s.eligibleTypes(ctx, weightKG, dims)
+	if err != nil {
+		return batchOrder{}, err
+	}
+	if !slices.Contains(types, models.MachineTypeRobot) {
+		return batchOrder{}, fmt.Errorf("%w: order %s does not fit a robot", models.ErrPackageTooLarge, orderID)
+	}
+	return batchOrder{id: orderID, pickup: *pickup, dropoff: *dropoff, weightKG: weightKG}, nil
+}
+
+// checkBatchCapacity 校验所有包裹同时在车上时的总重量
+// （最近邻规划可能先取完所有包裹再依次投递），返回总重量。
+func (s *service) checkBatchCapacity(ctx context.Context, orders []batchOrder) (float64, error) {
+	caps, err := s.logisticRepo.ListMachineCapacities(ctx)
+	if err != nil {
+		return 0, err
+	}
+	total := 0.0
+	for _, o := range orders {
+		total += o.weightKG
+	}
+	for _, c := range caps {
+		if c.Type == models.MachineTypeRobot && total > c.MaxWeightKG {
+			return 0, fmt.Errorf("%w: batch weighs %.1f kg, robots carry at most %.1f kg", models.ErrPackageTooLarge, total, c.MaxWeightKG)
+		}
+	}
+	return total, nil
+}
+
+// pickupCenter 返回所有取件点的平均坐标，用于选择最近的机器人
+func pickupCenter(orders []batchOrder) models.GeoPoint {
+	var c models.GeoPoint
+	for _, o := range orders {
+		c.Latitude += o.pickup.Latitude
+		c.Longitude += o.pickup.Longitude
+	}
+	c.Latitude /= float64(len(orders))
+	c.Longitude /= float64(len(orders))
+	return c
+}
+
+// planStops 从机器当前位置出发，每次前往最近的可访问站点：
+// 尚未取件订单的取件点，或已取件订单的投递点。距离相同时按请求中的订单顺序，保证结果确定。
+// 返回的站点只填写 Seq、OrderID、Kind 与 Location。
+func planStops(m *models.Machine, orders []batchOrder) []models.RunStop {
+	pickedUp := make([]bool, len(orders))
+	delivered := make([]bool, len(orders))
+	at := models.GeoPoint{Latitude: m.Latitude, Longitude: m.Longitude}
+	stops := make([]models.RunStop, 0, 2*len(orders))
+	for len(stops) < 2*len(orders) {
+		best, bestKind, bestDist := -1, models.StopPickup, math.Inf(1)
+		for i, o := range orders {
+			var kind models.StopKind
+			var p models.GeoPoint
+			switch {
+			case !pickedUp[i]:
+				kind, p = models.StopPickup, o.pickup
+			case !delivered[i]:
+				kind, p = models.StopDropoff, o.dropoff
+			default:
+				continue
+			}
+			if d := haversineKM(at, p); d < bestDist {
+				best, bestKind, bestDist = i, kind, d
+			}
+		}
+		o := orders[best]
+		stop := models.RunStop{Seq: len(stops) + 1, OrderID: o.id, Kind: bestKind}
+		if bestKind == models.StopPickup {
+			pickedUp[best], stop.Location = true, o.pickup
+		} else {
+			delivered[best], stop.Location = true, o.dropoff
+		}
+		stops = append(stops, stop)
+		at = stop.Location
+	}
+	return stops
+}
+
+// buildRun 为规划好的站点计算累计距离与 ETA，并生成任务。
+// 距离按直线距离乘以机器人的绕行系数估算。
+func (s *service) buildRun(m *models.Machine, stops []models.RunStop, start time.Time) *models.DeliveryRun {
+	detour := 1.0
+	if em, ok := s.battery.Models[m.Type]; ok {
+		detour = em.DetourFactor
+	}
+	at := models.GeoPoint{Latitude: m.Latitude, Longitude: m.Longitude}
+	km, elapsed := 0.0, time.Duration(0)
+	for i := range stops {
+		leg := haversineKM(at, stops[i].Location) * detour
+		km += leg
+		elapsed += time.Duration(leg / robotSpeedKMH * float64(time.Hour))
+		stops[i].DistanceMeters = int(math.Round(km * 1000))
+		stops[i].ETA = start.Add(elapsed).Truncate(time.Second)
+		elapsed += stopDwell
+		at = stops[i].Location
+	}
+	run := &models.DeliveryRun{
+		MachineID:       m.ID,
+		DistanceMeters:  int(math.Round(km * 1000)),
+		DurationSeconds: int((elapsed - stopDwell).Seconds()),
+		Stops:           stops,
+	}
+	run.BuildSegments()
+	return run
+}
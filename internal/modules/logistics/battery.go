@@ -0,0 +1,78 @@
+package logistics
+
+import (
+	"math"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// EnergyModel 描述一类机器的耗电情况，用于派单前判断电量能否完成任务。
+type EnergyModel struct {
+	PercentPerKM float64 // 每公里消耗的电量（百分点）
+	DetourFactor float64 // 实际路程 / 直线距离：无人机约为 1，地面机器人沿道路行驶更长
+}
+
+// BatteryPolicy 是派单的电量约束。一次任务的行程为
+// 机器当前位置 → 取件点 → 投递点 → 返回出发点；所需电量为
+//
+//	行程公里数 × PercentPerKM × (1 + SafetyMargin) + ReservePercent
+//
+// 电量低于所需电量的机器不参与派单。在引入充电站之前，返程终点取机器的出发位置。
+type BatteryPolicy struct {
+	Models         map[models.MachineType]EnergyModel
+	SafetyMargin   float64 // 对耗电估算的放大比例，覆盖风力、坡度、等待等不确定性
+	ReservePercent float64 // 任务结束时至少保留的电量
+}
+
+// DefaultBatteryPolicy 返回默认的电量约束：满电的无人机约可飞行 25 km，
+// 地面机器人约可行驶 60 km。
+func DefaultBatteryPolicy() BatteryPolicy {
+	return BatteryPolicy{
+		Models: map[models.MachineType]EnergyModel{
+			models.MachineTypeDrone: {PercentPerKM: 4, DetourFactor: 1},
+			models.MachineTypeRobot: {PercentPerKM: 1.5, DetourFactor: 1.3},
+		},
+		SafetyMargin:   0.2,
+		ReservePercent: 10,
+	}
+}
+
+// RequiredBattery 返回机器 m 完成 pickup → dropoff 配送并返回出发点所需的电量百分比。
+// 未配置耗电模型的机器类型返回 +Inf（不派单）。
+func (p BatteryPolicy) RequiredBattery(m *models.Machine, pickup, dropoff models.GeoPoint) float64 {
+	return p.RequiredBatteryForStops(m, []models.GeoPoint{pickup, dropoff})
+}
+
+// RequiredBatteryForStops 与 RequiredBattery 相同，但行程为依次经过 stops 后返回出发点，
+// 用于多站点的批量配送。
+func (p BatteryPolicy) RequiredBatteryForStops(m *models.Machine, stops []models.GeoPoint) float64 {
+	em, ok := p.Models[m.Type]
+	if !ok {
+		return math.Inf(1)
+	}
+	start := models.GeoPoint{Latitude: m.Latitude, Longitude: m.Longitude}
+	km, at := 0.0, start
+	for _, stop := range stops {
+		km += haversineKM(at, stop)
+		at = stop
+	}
+	km += haversineKM(at, start)
+	return km*em.DetourFactor*em.PercentPerKM*(1+p.SafetyMargin) + p.ReservePercent
+}
+
+// CanDeliver 判断机器当前电量是否足以完成该配送。
+func (p BatteryPolicy) CanDeliver(m *models.Machine, pickup, dropoff models.GeoPoint) bool {
+	return float64(m.BatteryLevel) >= p.RequiredBattery(m, pickup, dropoff)
+}
+
+// earthRadiusKM 是地球平均半径
+const earthRadiusKM = 6371.0
+
+// haversineKM 计算两点间的大圆距离（公里）。
+func haversineKM(a, b models.GeoPoint) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
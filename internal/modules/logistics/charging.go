@@ -0,0 +1,138 @@
+package logistics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// droneSpeedKMH 是无人机的平均飞行速度（报价中假设地面机器人速度为其一半）
+const droneSpeedKMH = 2 * robotSpeedKMH
+
+// ChargePolicy 是自动回充策略：空闲机器电量低于 LowPercent 时转为 CHARGING，
+// 并前往最近的充电站；CHARGING 的机器电量回到 ResumePercent 以上时恢复 IDLE。
+// CHARGING 的机器不参与派单。
+type ChargePolicy struct {
+	LowPercent    float64
+	ResumePercent float64
+}
+
+// DefaultChargePolicy 返回默认的回充策略：低于 20% 回充，充到 90% 恢复派单。
+func DefaultChargePolicy() ChargePolicy {
+	return ChargePolicy{LowPercent: 20, ResumePercent: 90}
+}
+
+// next 返回策略要求机器进入的状态；不需要变化时返回当前状态。
+// 配送中（IN_TRANSIT）和维护中的机器不受影响。
+func (p ChargePolicy) next(m *models.Machine) models.MachineStatus {
+	switch {
+	case m.Status == models.StatusIdle && float64(m.BatteryLevel) < p.LowPercent:
+		return models.StatusCharging
+	case m.Status == models.StatusCharging && float64(m.BatteryLevel) >= p.ResumePercent:
+		return models.StatusIdle
+	}
+	return m.Status
+}
+
+// ReturnToCharge 对所有机器执行回充策略，由调度器定期运行。
+// 遥测会即时应用同样的策略；这里覆盖没有上报遥测、或通过管理接口改为 IDLE 的机器。
+// 单台机器失败只记录日志，不影响其他机器。
+func (s *service) ReturnToCharge(ctx context.Context) error {
+	machines, err := s.logisticRepo.ListMachines(ctx, false)
+	if err != nil {
+		return fmt.Errorf("ReturnToCharge: %w", err)
+	}
+	for _, m := range machines {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if s.charge.next(m) == m.Status {
+			continue
+		}
+		var from models.MachineStatus
+		var updated *models.Machine
+		err := s.updateMachine(ctx, m.ID, func(cur *models.Machine) {
+			from = cur.Status
+			cur.Status = s.charge.next(cur)
+			updated = cur
+		})
+		if err == nil {
+			err = s.chargeTransition(ctx, updated, from)
+		}
+		if err != nil {
+			log.Printf("ReturnToCharge: machine %s: %v", m.ID, err)
+		}
+	}
+	return nil
+}
+
+// chargeTransition 在机器状态从 from 变为 m.Status 后维护充电行程：
+// 进入 CHARGING 时规划前往最近充电站的行程，离开 CHARGING 时删除行程。
+func (s *service) chargeTransition(ctx context.Context, m *models.Machine, from models.MachineStatus) error {
+	switch {
+	case from == m.Status:
+		return nil
+	case m.Status == models.StatusCharging:
+		return s.startChargeTrip(ctx, m)
+	case from == models.StatusCharging:
+		return s.logisticRepo.DeleteChargeTrip(ctx, m.ID)
+	}
+	return nil
+}
+
+// startChargeTrip 按直线距离（乘以绕行系数）估算前往最近充电站的距离与 ETA 并保存。
+// 没有任何充电站时机器原地充电，不生成行程。
+func (s *service) startChargeTrip(ctx context.Context, m *models.Machine) error {
+	depot, err := s.logisticRepo.FindNearestDepot(ctx, m.Longitude, m.Latitude)
+	if errors.Is(err, models.ErrNotFound) {
+		log.Printf("machine %s is charging in place: no depot is defined", m.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	detour, speed := 1.0, droneSpeedKMH
+	if em, ok := s.battery.Models[m.Type]; ok {
+		detour = em.DetourFactor
+	}
+	if m.Type == models.MachineTypeRobot {
+		speed = robotSpeedKMH
+	}
+	km := haversineKM(models.GeoPoint{Latitude: m.Latitude, Longitude: m.Longitude}, depot.Location) * detour
+	trip := &models.ChargeTrip{
+		MachineID:      m.ID,
+		DepotID:        depot.ID,
+		DistanceMeters: int(math.Round(km * 1000)),
+		ETA:            time.Now().Add(time.Duration(km / speed * float64(time.Hour))).Truncate(time.Second),
+	}
+	return s.logisticRepo.SaveChargeTrip(ctx, trip)
+}
+
+// GetChargeTrip 查询机器当前前往充电站的行程
+func (s *service) GetChargeTrip(ctx context.Context, machineID string) (*models.ChargeTrip, error) {
+	return s.logisticRepo.GetChargeTrip(ctx, machineID)
+}
+
+// ListDepots 返回所有充电站
+func (s *service) ListDepots(ctx context.Context) ([]*models.Depot, error) {
+	return s.logisticRepo.ListDepots(ctx)
+}
+
+// CreateDepot 新增充电站
+func (s *service) CreateDepot(ctx context.Context, req models.DepotRequest) (*models.Depot, error) {
+	d := &models.Depot{Name: req.Name, Location: *req.Location}
+	if err := s.logisticRepo.CreateDepot(ctx, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DeleteDepot 删除充电站
+func (s *service) DeleteDepot(ctx context.Context, depotID string) error {
+	return s.logisticRepo.DeleteDepot(ctx, depotID)
+}
@@ -0,0 +1,212 @@
+package logistics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/mqtt"
+)
+
+// 命令计数，经 expvar 以 machine_commands.{sent,published,publish_failed,acknowledged,rejected,expired} 导出
+var commandMetrics = expvar.NewMap("machine_commands")
+
+// maxCommandHistory 是 GET /logistics/fleet/:machineId/commands 返回的最多命令数
+const maxCommandHistory = 50
+
+// CommandPublisher 把命令推送到机器的长连接（MQTT 等）。推送失败的命令保持 PENDING，
+// 由 SweepMachineCommands 重试；机器也可以轮询 GET /logistics/fleet/:machineId/commands/pending。
+type CommandPublisher interface {
+	PublishCommand(ctx context.Context, cmd *models.MachineCommand) error
+}
+
+// WithCommandPublisher 设置命令推送通道；未设置时机器只能通过轮询取得命令。
+func WithCommandPublisher(p CommandPublisher) Option {
+	return func(s *service) { s.commands = p }
+}
+
+// CommandPublishers 依次尝试各推送通道，第一个成功即返回，全部失败时返回各自的错误。
+// 例如先推送到本实例的 gRPC 流（AgentHub），机器不在本实例时再经 MQTT 发布。
+func CommandPublishers(ps ...CommandPublisher) CommandPublisher {
+	if len(ps) == 1 {
+		return ps[0]
+	}
+	return commandPublishers(ps)
+}
+
+type commandPublishers []CommandPublisher
+
+func (ps commandPublishers) PublishCommand(ctx context.Context, cmd *models.MachineCommand) error {
+	var errs []error
+	for _, p := range ps {
+		err := p.PublishCommand(ctx, cmd)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// WithCommandTTL 设置命令的默认确认时限；超时未确认的命令标记为 EXPIRED。d <= 0 时保持默认值。
+func WithCommandTTL(d time.Duration) Option {
+	return func(s *service) {
+		if d > 0 {
+			s.commandTTL = d
+		}
+	}
+}
+
+// SendMachineCommand 为机器排队一条命令并尝试立即推送。推送失败不影响排队结果。
+// 命令只负责送达与确认：执行后的状态变化（如暂停时的 MAINTENANCE）仍由机器自己上报。
+func (s *service) SendMachineCommand(ctx context.Context, machineID, adminID string, req models.MachineCommandRequest) (*models.MachineCommand, error) {
+	ttl := s.commandTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	cmd := &models.MachineCommand{
+		MachineID: machineID,
+		Command:   req.Command,
+		CreatedBy: adminID,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := s.logisticRepo.CreateMachineCommand(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("SendMachineCommand: %w", err)
+	}
+	commandMetrics.Add("sent", 1)
+	log.Printf("machine %s: command %s %s queued by %s", machineID, cmd.ID, cmd.Command, adminID)
+	s.publishCommand(ctx, cmd)
+	return cmd, nil
+}
+
+// publishCommand 推送命令并标记为 DELIVERED；失败只记录日志，命令留待重试或轮询。
+func (s *service) publishCommand(ctx context.Context, cmd *models.MachineCommand) {
+	if s.commands == nil {
+		return
+	}
+	if err := s.commands.PublishCommand(ctx, cmd); err != nil {
+		commandMetrics.Add("publish_failed", 1)
+		log.Printf("machine %s: publish command %s: %v", cmd.MachineID, cmd.ID, err)
+		return
+	}
+	commandMetrics.Add("published", 1)
+	if err := s.logisticRepo.MarkCommandDelivered(ctx, cmd.ID); err != nil {
+		log.Printf("machine %s: command %s: %v", cmd.MachineID, cmd.ID, err)
+		return
+	}
+	if cmd.Status == models.CommandPending {
+		now := time.Now()
+		cmd.Status = models.CommandDelivered
+		cmd.DeliveredAt = &now
+	}
+}
+
+// ListMachineCommands 返回机器最近的命令及其确认状态（管理员）。
+func (s *service) ListMachineCommands(ctx context.Context, machineID string) ([]*models.MachineCommand, error) {
+	if _, err := s.logisticRepo.FindMachineByID(ctx, machineID); err != nil {
+		return nil, fmt.Errorf("ListMachineCommands: %w", err)
+	}
+	cmds, err := s.logisticRepo.ListMachineCommands(ctx, machineID, maxCommandHistory)
+	if err != nil {
+		return nil, fmt.Errorf("ListMachineCommands: %w", err)
+	}
+	return cmds, nil
+}
+
+// PollMachineCommands 返回机器尚未确认的命令并标记为已送达，供没有 MQTT 连接的机器轮询。
+// 未确认的命令每次轮询都会再次返回，机器须按命令 ID 去重。
+func (s *service) PollMachineCommands(ctx context.Context, machineID string) ([]*models.MachineCommand, error) {
+	cmds, err := s.logisticRepo.TakeMachineCommands(ctx, machineID)
+	if err != nil {
+		return nil, fmt.Errorf("PollMachineCommands: %w", err)
+	}
+	if cmds == nil {
+		cmds = []*models.MachineCommand{}
+	}
+	return cmds, nil
+}
+
+// AckMachineCommand 记录机器对命令的确认或拒绝；重复确认返回第一次的结果。
+func (s *service) AckMachineCommand(ctx context.Context, machineID, commandID string, ack models.MachineCommandAck) (*models.MachineCommand, error) {
+	accepted := ack.Accepted != nil && *ack.Accepted
+	cmd, err := s.logisticRepo.AckMachineCommand(ctx, machineID, commandID, accepted, ack.Reason)
+	if err != nil {
+		return nil, fmt.Errorf("AckMachineCommand: %w", err)
+	}
+	if accepted {
+		commandMetrics.Add("acknowledged", 1)
+	} else {
+		commandMetrics.Add("rejected", 1)
+		log.Printf("machine %s rejected command %s %s: %s", machineID, cmd.ID, cmd.Command, ack.Reason)
+	}
+	return cmd, nil
+}
+
+// SweepMachineCommands 将超时未确认的命令标记为 EXPIRED，并重新推送推送失败的命令。
+// 由调度器定期运行。
+func (s *service) SweepMachineCommands(ctx context.Context) error {
+	expired, err := s.logisticRepo.ExpireMachineCommands(ctx)
+	if err != nil {
+		return fmt.Errorf("SweepMachineCommands: %w", err)
+	}
+	if expired > 0 {
+		commandMetrics.Add("expired", expired)
+		log.Printf("SweepMachineCommands: %d command(s) expired unacknowledged", expired)
+	}
+	if s.commands == nil {
+		return nil
+	}
+	pending, err := s.logisticRepo.ListUndeliveredCommands(ctx)
+	if err != nil {
+		return fmt.Errorf("SweepMachineCommands: %w", err)
+	}
+	for _, cmd := range pending {
+		s.publishCommand(ctx, cmd)
+	}
+	return nil
+}
+
+// CommandTopic 返回服务端向机器推送命令的主题：<prefix>/machines/<machineID>/commands。
+func CommandTopic(prefix, machineID string) string {
+	return prefix + "/machines/" + machineID + "/commands"
+}
+
+// CommandAckTopic 返回机器发布命令确认的主题：<prefix>/machines/<machineID>/commands/ack，
+// 消息体为 models.MachineCommandAck。与遥测一样，机器身份取自主题。
+func CommandAckTopic(prefix, machineID string) string {
+	return CommandTopic(prefix, machineID) + "/ack"
+}
+
+// commandMessage 是推送给机器的命令消息体。
+type commandMessage struct {
+	ID        string                    `json:"id"`
+	Command   models.MachineCommandType `json:"command"`
+	ExpiresAt time.Time                 `json:"expires_at"`
+}
+
+// MQTTCommandPublisher 以 QoS 1 把命令发布到 CommandTopic。机器应以持久会话订阅，
+// 离线期间的命令由 Broker 在重连后补发。每条命令单独建立一次连接：命令由管理员手动发出，频率很低。
+type MQTTCommandPublisher struct {
+	cfg    mqtt.Config
+	prefix string
+}
+
+// NewMQTTCommandPublisher 创建命令发布者。cfg.ClientID 不能与遥测订阅者相同，
+// 否则 Broker 会断开订阅者的连接。
+func NewMQTTCommandPublisher(cfg mqtt.Config, topicPrefix string) *MQTTCommandPublisher {
+	return &MQTTCommandPublisher{cfg: cfg, prefix: topicPrefix}
+}
+
+// PublishCommand 发布命令，在 Broker 返回 PUBACK 后返回。
+func (p *MQTTCommandPublisher) PublishCommand(ctx context.Context, cmd *models.MachineCommand) error {
+	payload, err := json.Marshal(commandMessage{ID: cmd.ID, Command: cmd.Command, ExpiresAt: cmd.ExpiresAt})
+	if err != nil {
+		return err
+	}
+	return mqtt.Publish(ctx, p.cfg, CommandTopic(p.prefix, cmd.MachineID), payload, 1)
+}
@@ -0,0 +1,145 @@
+package logistics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// GetETA 结合订单最近一次保存的路线与机器最新的轨迹点，估算剩余距离、时长与到达时间。
+//  1. 已到达或已送达的订单剩余为 0；已取消或失败的订单没有 ETA（models.ErrNotFound）；
+//  2. 订单还没有路线时返回 models.ErrNotFound（由 ComputeRoute 生成）；
+//  3. 还没有轨迹时按整条路线、从当前时间起算；
+//  4. 否则把最新位置投影到路线折线上，按剩余比例折算路线的距离与时长，
+//     偏离路线的距离按同样的平均速度计入；
+//  5. 路线没有可用的折线时，按最新位置到投递点的直线距离与路线平均速度估算；
+//  6. 订单有送达时间窗时，附上时间窗并评估预计到达时间的违约风险（见 windowRisk）。
+func (s *service) GetETA(ctx context.Context, orderID string) (*models.ETA, error) {
+	status, err := s.logisticRepo.GetOrderStatus(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("GetETA: fetch status: %w", err)
+	}
+	if status == models.OrderStatusCancelled || status == models.OrderStatusFailed {
+		return nil, fmt.Errorf("GetETA: order is %s: %w", status, models.ErrNotFound)
+	}
+
+	latest, err := s.logisticRepo.GetLatestTrackingEvent(ctx, orderID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return nil, fmt.Errorf("GetETA: fetch tracking: %w", err)
+	}
+	eta := &models.ETA{OrderID: orderID, UpdatedAt: time.Now().Truncate(time.Second)}
+	if latest != nil {
+		eta.Position = &models.GeoPoint{Latitude: latest.Latitude, Longitude: latest.Longitude}
+		eta.UpdatedAt = latest.CreatedAt
+	}
+	window, err := s.logisticRepo.GetOrderDeliveryWindow(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("GetETA: fetch delivery window: %w", err)
+	}
+	if status == models.OrderStatusArrived || status == models.OrderStatusDelivered {
+		eta.EstimatedArrival = eta.UpdatedAt
+		setWindowRisk(eta, window)
+		return eta, nil
+	}
+
+	route, err := s.logisticRepo.GetLatestRoute(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("GetETA: fetch route: %w", err)
+	}
+	remaining := float64(route.DistanceMeters)
+	if eta.Position != nil {
+		if remaining, err = s.remainingMeters(ctx, orderID, route, *eta.Position); err != nil {
+			return nil, fmt.Errorf("GetETA: %w", err)
+		}
+	}
+	eta.RemainingDistanceMeters = int(math.Round(remaining))
+	if route.DistanceMeters > 0 {
+		eta.RemainingDurationSeconds = int(math.Ceil(remaining * float64(route.DurationSeconds) / float64(route.DistanceMeters)))
+	}
+	eta.EstimatedArrival = eta.UpdatedAt.Add(time.Duration(eta.RemainingDurationSeconds) * time.Second)
+	setWindowRisk(eta, window)
+	return eta, nil
+}
+
+// windowRiskMinMargin 是判定“有迟到风险”的最小余量：预计到达时间晚于时间窗结束前这么久即为 AT_RISK。
+// 余量至少为剩余时长的 1/5，剩余路程越长，估算误差越大。
+const windowRiskMinMargin = 5 * time.Minute
+
+// setWindowRisk 附上订单的送达时间窗，并按预计到达时间评估违约风险；没有时间窗时不做任何修改。
+func setWindowRisk(eta *models.ETA, window *models.DeliveryWindow) {
+	if window == nil {
+		return
+	}
+	eta.DeliveryWindow = window
+	margin := max(windowRiskMinMargin, time.Duration(eta.RemainingDurationSeconds)*time.Second/5)
+	switch {
+	case eta.EstimatedArrival.After(window.End):
+		eta.WindowRisk = models.WindowLate
+	case eta.EstimatedArrival.Before(window.Start):
+		eta.WindowRisk = models.WindowEarly
+	case eta.RemainingDurationSeconds > 0 && eta.EstimatedArrival.After(window.End.Add(-margin)):
+		eta.WindowRisk = models.WindowAtRisk
+	default:
+		eta.WindowRisk = models.WindowOnTime
+	}
+}
+
+// remainingMeters 估算机器从 pos 到终点还需行驶的距离（米）。
+// 折线按其自身长度的剩余比例折算到路线距离，使结果与地图服务给出的总距离一致。
+func (s *service) remainingMeters(ctx context.Context, orderID string, route *models.Route, pos models.GeoPoint) (float64, error) {
+	if path, err := decodePolyline(route.Polyline); err == nil && len(path) >= 2 {
+		left, total, offKM := remainingAlong(path, pos)
+		if total > 0 {
+			return left/total*float64(route.DistanceMeters) + offKM*1000, nil
+		}
+	}
+	_, dropoff, err := s.logisticRepo.GetOrderPoints(ctx, orderID)
+	if err != nil {
+		return 0, fmt.Errorf("fetch points: %w", err)
+	}
+	if dropoff == nil {
+		// 既没有折线也没有投递点坐标：无法定位进度，按整条路线估算
+		return float64(route.DistanceMeters), nil
+	}
+	return haversineKM(pos, *dropoff) * 1000, nil
+}
+
+// remainingAlong 把 pos 投影到折线 path 上距离最近的一段，返回投影点到终点的折线长度、
+// 折线总长度以及 pos 到投影点的距离（均为公里）。
+// 每段在其起点附近按等距圆柱投影近似为平面，城市配送的路段长度下误差可以忽略。
+func remainingAlong(path []models.GeoPoint, pos models.GeoPoint) (left, total, offKM float64) {
+	segs := make([]float64, len(path)-1)
+	for i := range segs {
+		segs[i] = haversineKM(path[i], path[i+1])
+		total += segs[i]
+	}
+
+	best, bestT, bestOff := 0, 0.0, math.Inf(1)
+	for i := range segs {
+		t, off := projectOnSegment(path[i], path[i+1], pos)
+		if off < bestOff {
+			best, bestT, bestOff = i, t, off
+		}
+	}
+	left = (1 - bestT) * segs[best]
+	for _, l := range segs[best+1:] {
+		left += l
+	}
+	return left, total, bestOff
+}
+
+// projectOnSegment 返回 p 在线段 ab 上的投影位置 t（0 为 a，1 为 b）以及 p 到投影点的距离（公里）。
+func projectOnSegment(a, b, p models.GeoPoint) (t, distKM float64) {
+	kx := math.Cos(a.Latitude*math.Pi/180) * earthRadiusKM * math.Pi / 180
+	ky := earthRadiusKM * math.Pi / 180
+	bx, by := (b.Longitude-a.Longitude)*kx, (b.Latitude-a.Latitude)*ky
+	px, py := (p.Longitude-a.Longitude)*kx, (p.Latitude-a.Latitude)*ky
+	if l2 := bx*bx + by*by; l2 > 0 {
+		t = math.Max(0, math.Min(1, (px*bx+py*by)/l2))
+	}
+	return t, math.Hypot(px-t*bx, py-t*by)
+}
@@ -0,0 +1,296 @@
+package logistics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"dispatch-and-delivery/internal/database"
+	"dispatch-and-delivery/internal/models"
+)
+
+// FleetCacheName 是车队快照在 database.CacheBus 上使用的缓存名。
+const FleetCacheName = "fleet"
+
+// Invalidator 是 database.CacheBus 中车队缓存用到的部分，便于测试替换。
+type Invalidator interface {
+	Subscribe(cache string, fn func(key string))
+	Invalidate(ctx context.Context, cache, key string) error
+}
+
+// fleetCache 包装 RepositoryInterface，在内存中维护未删除机器的快照，
+// 使 GET /logistics/fleet 与派单不必每次都查询数据库。
+//
+//   - 读：ListMachines(false)、ListIdleMachines、FindMachineByID 命中快照；
+//     未加载时回源数据库加载完整快照。
+//   - 写：成功后立即在本地标记该机器为过期，并通过 CacheBus 通知其他实例。
+//     NOTIFY 是事务性的，事务内的写在提交后才会通知到其他实例。
+//   - 事务内的读直接走数据库，保证读到本事务自己的写入。
+type fleetCache struct {
+	RepositoryInterface
+	bus Invalidator
+
+	loadMu sync.Mutex // 串行化回源加载，避免缓存击穿时并发全量查询
+
+	mu       sync.RWMutex
+	loaded   bool
+	gen      uint64 // 每次失效递增；加载期间发生失效则不标记为干净
+	machines []*models.Machine
+	stale    map[string]struct{}
+}
+
+// NewCachedRepository 返回带车队快照与计价规则缓存（见 pricingCache）的仓库，并订阅 bus 上的失效通知。
+func NewCachedRepository(repo RepositoryInterface, bus Invalidator) RepositoryInterface {
+	c := &fleetCache{RepositoryInterface: repo, bus: bus, stale: map[string]struct{}{}}
+	bus.Subscribe(FleetCacheName, c.invalidateLocal)
+	return newPricingCache(c, bus)
+}
+
+// invalidateLocal 处理失效：key 为空表示整个快照失效（如新增机器、断线重连）。
+func (c *fleetCache) invalidateLocal(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if key == "" {
+		c.loaded = false
+		c.machines = nil
+		c.stale = map[string]struct{}{}
+		return
+	}
+	c.stale[key] = struct{}{}
+}
+
+func (c *fleetCache) invalidate(ctx context.Context, machineID string) error {
+	c.invalidateLocal(machineID)
+	return c.bus.Invalidate(ctx, FleetCacheName, machineID)
+}
+
+func inTx(ctx context.Context) bool {
+	_, ok := database.TxFromContext(ctx)
+	return ok
+}
+
+// snapshot 返回最新快照的副本，必要时回源加载。
+func (c *fleetCache) snapshot(ctx context.Context) ([]*models.Machine, error) {
+	c.mu.RLock()
+	if c.loaded && len(c.stale) == 0 {
+		out := copyMachines(c.machines)
+		c.mu.RUnlock()
+		return out, nil
+	}
+	c.mu.RUnlock()
+
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+
+	c.mu.RLock()
+	loaded, gen := c.loaded, c.gen
+	machines := copyMachines(c.machines)
+	stale := make([]string, 0, len(c.stale))
+	for id := range c.stale {
+		stale = append(stale, id)
+	}
+	c.mu.RUnlock()
+
+	var err error
+	if !loaded {
+		machines, err = c.RepositoryInterface.ListMachines(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(stale) > 0 {
+		// 只刷新过期的机器；按 ID 查询走主库，不受副本延迟影响。
+		machines, err = c.refresh(ctx, machines, stale)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	if c.gen == gen {
+		c.machines = copyMachines(machines)
+		c.loaded = true
+		c.stale = map[string]struct{}{}
+	}
+	c.mu.Unlock()
+	return machines, nil
+}
+
+func (c *fleetCache) refresh(ctx context.Context, machines []*models.Machine, stale []string) ([]*models.Machine, error) {
+	fresh := make(map[string]*models.Machine, len(stale))
+	for _, id := range stale {
+		m, err := c.RepositoryInterface.FindMachineByID(ctx, id)
+		if errors.Is(err, models.ErrNotFound) {
+			fresh[id] = nil // 已删除
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fresh[id] = m
+	}
+
+	out := machines[:0]
+	for _, m := range machines {
+		if f, ok := fresh[m.ID]; ok {
+			delete(fresh, m.ID)
+			if f == nil {
+				continue
+			}
+			m = f
+		}
+		out = append(out, m)
+	}
+	// 快照中原本没有的机器（如恢复的机器）追加到末尾
+	for _, f := range fresh {
+		if f != nil {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+func copyMachines(in []*models.Machine) []*models.Machine {
+	if in == nil {
+		return nil
+	}
+	out := make([]*models.Machine, len(in))
+	for i, m := range in {
+		cp := *m
+		out[i] = &cp
+	}
+	return out
+}
+
+// ===== 读：命中快照 =====
+
+func (c *fleetCache) ListMachines(ctx context.Context, includeDeleted bool) ([]*models.Machine, error) {
+	if includeDeleted || inTx(ctx) {
+		return c.RepositoryInterface.ListMachines(ctx, includeDeleted)
+	}
+	return c.snapshot(ctx)
+}
+
+func (c *fleetCache) ListIdleMachines(ctx context.Context) ([]*models.Machine, error) {
+	if inTx(ctx) {
+		return c.RepositoryInterface.ListIdleMachines(ctx)
+	}
+	machines, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idle := machines[:0]
+	for _, m := range machines {
+		if m.Status == models.StatusIdle {
+			idle = append(idle, m)
+		}
+	}
+	return idle, nil
+}
+
+func (c *fleetCache) FindMachineByID(ctx context.Context, id string) (*models.Machine, error) {
+	if inTx(ctx) {
+		return c.RepositoryInterface.FindMachineByID(ctx, id)
+	}
+	machines, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range machines {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+// ===== 写：成功后失效 =====
+
+func (c *fleetCache) UpdateMachine(ctx context.Context, m *models.Machine) error {
+	if err := c.RepositoryInterface.UpdateMachine(ctx, m); err != nil {
+		if errors.Is(err, models.ErrMachineVersionConflict) {
+			// 快照中的版本已过期，重试前需重新读取
+			c.invalidateLocal(m.ID)
+		}
+		return err
+	}
+	return c.invalidate(ctx, m.ID)
+}
+
+func (c *fleetCache) UpdateMachineStatus(ctx context.Context, machineID string, status models.MachineStatus) error {
+	if err := c.RepositoryInterface.UpdateMachineStatus(ctx, machineID, status); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, machineID)
+}
+
+func (c *fleetCache) ClaimMachine(ctx context.Context, machineID string, orderIDs ...string) error {
+	if err := c.RepositoryInterface.ClaimMachine(ctx, machineID, orderIDs...); err != nil {
+		if errors.Is(err, models.ErrMachineClaimed) {
+			// 快照中该机器仍显示为 IDLE，下次选择前需重新读取
+			c.invalidateLocal(machineID)
+		}
+		return err
+	}
+	return c.invalidate(ctx, machineID)
+}
+
+func (c *fleetCache) ReturnMachine(ctx context.Context, machineID string) (bool, error) {
+	returning, err := c.RepositoryInterface.ReturnMachine(ctx, machineID)
+	if err != nil || !returning {
+		return returning, err
+	}
+	return returning, c.invalidate(ctx, machineID)
+}
+
+func (c *fleetCache) RecordHeartbeat(ctx context.Context, machineID string) (bool, error) {
+	revived, err := c.RepositoryInterface.RecordHeartbeat(ctx, machineID)
+	if err != nil || !revived {
+		// 只更新心跳时间时快照中的字段都没有变化
+		return revived, err
+	}
+	return revived, c.invalidate(ctx, machineID)
+}
+
+func (c *fleetCache) MarkStaleMachinesOffline(ctx context.Context, timeout time.Duration) ([]models.StaleMachine, error) {
+	stale, err := c.RepositoryInterface.MarkStaleMachinesOffline(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range stale {
+		if err := c.invalidate(ctx, m.ID); err != nil {
+			return stale, err
+		}
+	}
+	return stale, nil
+}
+
+func (c *fleetCache) CreateMachine(ctx context.Context, m *models.Machine, keyHash string) error {
+	if err := c.RepositoryInterface.CreateMachine(ctx, m, keyHash); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, m.ID)
+}
+
+func (c *fleetCache) DeleteMachine(ctx context.Context, id string) error {
+	if err := c.RepositoryInterface.DeleteMachine(ctx, id); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, id)
+}
+
+func (c *fleetCache) SetMachineZone(ctx context.Context, machineID string, zoneID *string) error {
+	if err := c.RepositoryInterface.SetMachineZone(ctx, machineID, zoneID); err != nil {
+		return err
+	}
+	return c.invalidate(ctx, machineID)
+}
+
+func (c *fleetCache) DeleteZone(ctx context.Context, id string) error {
+	if err := c.RepositoryInterface.DeleteZone(ctx, id); err != nil {
+		return err
+	}
+	// 删除运营区会清空其所有机器的 zone_id，整个快照失效
+	return c.invalidate(ctx, "")
+}
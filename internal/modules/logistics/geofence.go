@@ -0,0 +1,179 @@
+package logistics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/maps"
+)
+
+// ListZones 返回所有地理围栏
+func (s *service) ListZones(ctx context.Context) ([]*models.Zone, error) {
+	return s.logisticRepo.ListZones(ctx)
+}
+
+// CreateZone 新增地理围栏
+func (s *service) CreateZone(ctx context.Context, req models.ZoneRequest) (*models.Zone, error) {
+	z := &models.Zone{Name: req.Name, Kind: req.Kind, Polygon: openRing(req.Polygon)}
+	if err := s.logisticRepo.CreateZone(ctx, z); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// UpdateZone 整体替换地理围栏
+func (s *service) UpdateZone(ctx context.Context, zoneID string, req models.ZoneRequest) (*models.Zone, error) {
+	z := &models.Zone{ID: zoneID, Name: req.Name, Kind: req.Kind, Polygon: openRing(req.Polygon)}
+	if err := s.logisticRepo.UpdateZone(ctx, z); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// DeleteZone 删除地理围栏
+func (s *service) DeleteZone(ctx context.Context, zoneID string) error {
+	return s.logisticRepo.DeleteZone(ctx, zoneID)
+}
+
+// SetMachineZone 把机器移入或移出运营区，返回更新后的机器。
+// 派单时取件点所在运营区只使用该区的机器，见 pickMachines。
+func (s *service) SetMachineZone(ctx context.Context, machineID string, req models.MachineZoneRequest) (*models.Machine, error) {
+	if err := s.logisticRepo.SetMachineZone(ctx, machineID, req.ZoneID); err != nil {
+		return nil, err
+	}
+	return s.logisticRepo.FindMachineByID(ctx, machineID)
+}
+
+// restrictedSpecs 从报价选项（及其对应路线 routes）中去掉违反地理围栏的机器类型：
+//   - 无人机沿取件点到投递点的直线飞行，直线穿过禁飞区时不提供该选项；
+//   - 地面机器人沿自己的地图路线行驶，路线离开服务区时不提供该选项。
+//
+// 路线和地址坐标都未知时无法判断，不做限制。
+func (s *service) restrictedSpecs(ctx context.Context, req models.RouteRequest, specs []quoteSpec, routes []*maps.Route) ([]quoteSpec, []*maps.Route, error) {
+	var allowed []quoteSpec
+	var allowedRoutes []*maps.Route
+	for i, spec := range specs {
+		path := routePath(req, routes[i].Polyline)
+		var blocked bool
+		var err error
+		switch {
+		case len(path) < 2:
+		case spec.machineType == models.MachineTypeDrone:
+			blocked, err = s.logisticRepo.CrossesNoFlyZone(ctx, []models.GeoPoint{path[0], path[len(path)-1]})
+		case spec.machineType == models.MachineTypeRobot:
+			blocked, err = s.logisticRepo.LeavesServiceArea(ctx, path)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !blocked {
+			allowed = append(allowed, spec)
+			allowedRoutes = append(allowedRoutes, routes[i])
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, nil, models.ErrRouteRestricted
+	}
+	return allowed, allowedRoutes, nil
+}
+
+// routePath 返回用于围栏检查的路线：优先解码地图 API 返回的 polyline；
+// 解码失败时退回到取件与投递地址的坐标（都存在时）。
+func routePath(req models.RouteRequest, polyline string) []models.GeoPoint {
+	if path, err := decodePolyline(polyline); err == nil && len(path) >= 2 {
+		return path
+	}
+	if req.PickupLocation.Location != nil && req.DeliveryLocation.Location != nil {
+		return []models.GeoPoint{*req.PickupLocation.Location, *req.DeliveryLocation.Location}
+	}
+	return nil
+}
+
+// errBadPolyline 表示 polyline 字符串在某个数值的中间截断
+var errBadPolyline = errors.New("malformed encoded polyline")
+
+// decodePolyline 解码 Google Encoded Polyline（精度 1e-5）。
+func decodePolyline(encoded string) ([]models.GeoPoint, error) {
+	var points []models.GeoPoint
+	var lat, lon int
+	for i := 0; i < len(encoded); {
+		var deltas [2]int
+		for k := range deltas {
+			result, shift := 0, 0
+			for {
+				if i >= len(encoded) {
+					return nil, errBadPolyline
+				}
+				b := int(encoded[i]) - 63
+				i++
+				if b < 0 || b > 63 {
+					return nil, errBadPolyline
+				}
+				result |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if result&1 != 0 {
+				deltas[k] = ^(result >> 1)
+			} else {
+				deltas[k] = result >> 1
+			}
+		}
+		lat += deltas[0]
+		lon += deltas[1]
+		points = append(points, models.GeoPoint{Latitude: float64(lat) / 1e5, Longitude: float64(lon) / 1e5})
+	}
+	return points, nil
+}
+
+// openRing 去掉与首点重复的闭合点；存储时由 polygonWKT 统一闭合
+func openRing(ring []models.GeoPoint) []models.GeoPoint {
+	if n := len(ring); n > 1 && ring[0] == ring[n-1] {
+		return ring[:n-1]
+	}
+	return ring
+}
+
+// polygonWKT 生成 POLYGON((lon lat, ...)) 文本，并闭合外环
+func polygonWKT(ring []models.GeoPoint) string {
+	return "POLYGON((" + coordsWKT(append(ring[:len(ring):len(ring)], ring[0])) + "))"
+}
+
+// lineWKT 生成 LINESTRING(lon lat, ...) 文本
+func lineWKT(path []models.GeoPoint) string {
+	return "LINESTRING(" + coordsWKT(path) + ")"
+}
+
+func coordsWKT(points []models.GeoPoint) string {
+	parts := make([]string, len(points))
+	for i, p := range points {
+		parts[i] = strconv.FormatFloat(p.Longitude, 'f', -1, 64) + " " + strconv.FormatFloat(p.Latitude, 'f', -1, 64)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// polygonFromGeoJSON 解析 ST_AsGeoJSON 输出的 Polygon，返回不含闭合点的外环
+func polygonFromGeoJSON(s string) ([]models.GeoPoint, error) {
+	var g struct {
+		Type        string         `json:"type"`
+		Coordinates [][][2]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal([]byte(s), &g); err != nil {
+		return nil, err
+	}
+	if g.Type != "Polygon" || len(g.Coordinates) == 0 {
+		return nil, fmt.Errorf("unexpected GeoJSON geometry %q", g.Type)
+	}
+	ring := make([]models.GeoPoint, len(g.Coordinates[0]))
+	for i, c := range g.Coordinates[0] {
+		ring[i] = models.GeoPoint{Latitude: c[1], Longitude: c[0]}
+	}
+	return openRing(ring), nil
+}
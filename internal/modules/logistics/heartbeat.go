@@ -0,0 +1,57 @@
+package logistics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// DefaultHeartbeatTimeout 是机器被标记为 OFFLINE 前允许的默认最长心跳间隔
+const DefaultHeartbeatTimeout = 5 * time.Minute
+
+// Heartbeat 记录机器心跳；OFFLINE 的机器恢复为 IDLE，重新参与派单
+// （电量不足时由回充策略再转为 CHARGING）。掉线前仍在配送的机器恢复为 IN_TRANSIT，
+// 继续配送其订单，不会被再次派单。
+func (s *service) Heartbeat(ctx context.Context, machineID string) error {
+	revived, err := s.logisticRepo.RecordHeartbeat(ctx, machineID)
+	if err != nil {
+		return err
+	}
+	if revived {
+		log.Printf("machine %s is back online", machineID)
+	}
+	return nil
+}
+
+// MarkOfflineMachines 将心跳超时的机器标记为 OFFLINE（不再参与派单），并通知管理员。
+// 由调度器定期运行；配送中的机器掉线时，其订单需要管理员介入。
+func (s *service) MarkOfflineMachines(ctx context.Context) error {
+	stale, err := s.logisticRepo.MarkStaleMachinesOffline(ctx, s.heartbeatTTL)
+	if err != nil {
+		return fmt.Errorf("MarkOfflineMachines: %w", err)
+	}
+	for _, m := range stale {
+		msg := offlineMessage(m)
+		log.Print(msg)
+		if err := s.logisticRepo.NotifyAdmins(ctx, msg); err != nil {
+			return fmt.Errorf("MarkOfflineMachines: %w", err)
+		}
+	}
+	return nil
+}
+
+// offlineMessage 生成发给管理员的掉线通知
+func offlineMessage(m models.StaleMachine) string {
+	last := "never sent a heartbeat"
+	if m.LastHeartbeatAt != nil {
+		last = "last heartbeat at " + m.LastHeartbeatAt.UTC().Format(time.RFC3339)
+	}
+	msg := fmt.Sprintf("%s %s went offline (%s).", m.Type, m.ID, last)
+	if m.PreviousStatus == models.StatusInTransit {
+		msg += " It was on a delivery; check its orders."
+	}
+	return msg
+}
@@ -1,51 +1,99 @@
 package logistics
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/utils"
+	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
 )
 
 // Handler 聚合了物流模块所有 HTTP 接口，
 // 负责参数校验、调用 Service 层，并返回规范化的 JSON 响应。
-// 错误响应的 Message 字段为 English，方便前端统一处理；
+// 出错时直接返回 error，由 middleware.HTTPErrorHandler 统一映射为带错误码的 JSON 响应；
 // 所有逻辑注释均为中文，详述每一步算法和流程。
 type Handler struct {
-	svc ServiceInterface
+	svc            ServiceInterface
+	validate       *validator.Validate // 请求体校验
+	allowedOrigins []string            // 允许发起轨迹 WebSocket 的浏览器来源（与 CORS 一致）
 }
 
 // NewHandler 构造函数，注入 Service，便于单元测试与扩展。
 // svc 必须实现以下方法：
-//   ListMachines(ctx) ([]*models.Machine, error)
+//   ListMachines(ctx, includeDeleted) ([]*models.Machine, error)
+//   GetFleetStats(ctx) (*models.FleetStats, error)
+//   GetMachineHistory(ctx, machineID, q) (*models.MachineHistory, error)
+//   RegisterMachine(ctx, req) (*models.MachineRegistration, error)
+//   DeleteMachine(ctx, machineID) error
+//   RotateMachineKey(ctx, machineID) (string, error)
+//   AuthenticateMachine(ctx, apiKey) (string, error)
 //   SetMachineStatus(ctx, machineID, req) error
+//   Heartbeat(ctx, machineID) error
+//   GetMachineAssignments(ctx, machineID) ([]models.MachineAssignment, error)
 //   AssignOrder(ctx, orderID) (*models.Machine, error)
+//   BatchOrders(ctx, orderIDs) (*models.DeliveryRun, error)
+//   GetDeliveryRun(ctx, runID) (*models.DeliveryRun, error)
+//   ListZones / CreateZone / UpdateZone / DeleteZone 地理围栏管理
+//   SetMachineZone(ctx, machineID, req) (*models.Machine, error)
+//   SendMachineCommand / ListMachineCommands 管理员下发与查询机器命令
+//   PollMachineCommands / AckMachineCommand 机器轮询与确认命令
+//   GetUtilizationReport / GetDeliveriesReport / GetDistanceReport / GetRevenueReport 报表（JSON 或 CSV）
+//   ListDepots / CreateDepot / DeleteDepot 充电站管理
+//   ListPricingRules / CreatePricingRule / UpdatePricingRule / DeletePricingRule 计价规则管理
+//   GetChargeTrip(ctx, machineID) (*models.ChargeTrip, error)
 //   CalculateRouteOptions(ctx, req) ([]*models.RouteOption, error)
-//   ComputeRoute(ctx, orderID) (*models.Route, error)
-//   ReportTracking(ctx, orderID, req) error
-//   GetTracking(ctx, orderID) ([]*models.TrackingEvent, error)
-func NewHandler(svc ServiceInterface) *Handler {
-	return &Handler{svc: svc}
+//   ComputeRoute(ctx, orderID, waypoints) (*models.Route, error)
+//   ReportTracking(ctx, orderID, machineID, req) error
+//   ReportTrackingBatch(ctx, orderID, machineID, points) error
+//   GetTracking(ctx, orderID, q) ([]*models.TrackingEvent, *models.TrackingCursor, error)
+//   AuthorizeTrackingViewer(ctx, orderID, userID, role) error
+//   WatchTracking(orderID) (<-chan struct{}, func())
+//   GetETA(ctx, orderID) (*models.ETA, error)
+// allowedOrigins 为允许建立轨迹 WebSocket 的浏览器来源；同源请求始终允许。
+func NewHandler(svc ServiceInterface, allowedOrigins ...string) *Handler {
+	return &Handler{svc: svc, validate: utils.NewValidator(), allowedOrigins: allowedOrigins}
 }
 
 
 // ---- 1) 机器管理 ----
 
 // GetFleet 返回所有机器的当前状态、位置和电量，供后台监控或展示。
-// 调用 svc.ListMachines 并直接返回结果。
+// 调用 svc.ListMachines 并直接返回结果；?include_deleted=true 仅对管理员开放。
 func (h *Handler) GetFleet(c echo.Context) error {
 	ctx := c.Request().Context()
-	machines, err := h.svc.ListMachines(ctx)
+	includeDeleted := c.QueryParam("include_deleted") == "true"
+	if includeDeleted && !utils.IsAdmin(c) {
+		return models.NewAPIError(http.StatusForbidden, models.CodeForbidden, "Only administrators can view deleted machines")
+	}
+	machines, err := h.svc.ListMachines(ctx, includeDeleted)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "failed to list machines"})
+		return fmt.Errorf("GetFleet: %w", err)
 	}
 	return c.JSON(http.StatusOK, machines)
 }
 
-// SetMachineStatus 更新指定机器的状态与坐标。
-//  1) 提取 path 中 machineId；
+// GetFleetStats 返回车队汇总：各状态与类型的机器数、平均电量、离线机器数与配送中的订单数。
+func (h *Handler) GetFleetStats(c echo.Context) error {
+	stats, err := h.svc.GetFleetStats(c.Request().Context())
+	if err != nil {
+		return fmt.Errorf("GetFleetStats: %w", err)
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// SetMachineStatus 由机器自身上报状态与坐标（需机器 API Key）。
+//  1) 提取 path 中 machineId，必须与凭证对应的机器一致；
 //  2) Bind JSON 为 models.MachineStatusUpdateRequest；
 //  3) validate status；
 //  4) 调用 svc.SetMachineStatus；
@@ -53,26 +101,145 @@ func (h *Handler) GetFleet(c echo.Context) error {
 func (h *Handler) SetMachineStatus(c echo.Context) error {
 	ctx := c.Request().Context()
 	machineID := c.Param("machineId")
+	// 机器只能更新自己的状态
+	if authID, _ := c.Get("machineID").(string); authID != machineID {
+		return models.NewAPIError(http.StatusForbidden, models.CodeForbidden, "Machine credentials do not match this machine")
+	}
 	// 解析请求体
 	var req models.MachineStatusUpdateRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "invalid request body"})
+		return models.NewBindError(err)
 	}
 	// 校验状态值是否合法
 	if err := validateMachineStatus(req.Status); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: err.Error()})
+		return models.ValidationFailed(models.FieldError{
+			Field:   "status",
+			Rule:    "oneof",
+			Param:   fmt.Sprintf("%s %s %s", models.StatusIdle, models.StatusInTransit, models.StatusMaintenance),
+			Message: err.Error(),
+		})
+	}
+	if len(req.FirmwareVersion) > models.MaxFirmwareVersionLength {
+		return models.ValidationFailed(models.FieldError{
+			Field:   "firmware_version",
+			Rule:    "max",
+			Param:   strconv.Itoa(models.MaxFirmwareVersionLength),
+			Message: fmt.Sprintf("firmware_version must be at most %d characters", models.MaxFirmwareVersionLength),
+		})
 	}
 	// 调用服务层更新机器状态和位置
 	if err := h.svc.SetMachineStatus(ctx, machineID, req); err != nil {
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "machine not found"})
-		}
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "failed to update machine"})
+		return fmt.Errorf("SetMachineStatus: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+// Heartbeat 接收机器心跳（机器 API Key 认证），返回 204 No Content。
+// 机器只能为自己发送心跳。
+func (h *Handler) Heartbeat(c echo.Context) error {
+	machineID := c.Param("machineId")
+	if authID, _ := c.Get("machineID").(string); authID != machineID {
+		return models.NewAPIError(http.StatusForbidden, models.CodeForbidden, "Machine credentials do not match this machine")
+	}
+	if err := h.svc.Heartbeat(c.Request().Context(), machineID); err != nil {
+		return fmt.Errorf("Heartbeat: %w", err)
 	}
 	return c.NoContent(http.StatusNoContent)
 }
+
+// GetMachineAssignments 返回机器正在配送的订单及其取件点、投递点与路线（机器 API Key 认证）。
+// 机器只能查询自己的任务；没有任务时返回空数组。
+func (h *Handler) GetMachineAssignments(c echo.Context) error {
+	machineID := c.Param("machineId")
+	if authID, _ := c.Get("machineID").(string); authID != machineID {
+		return models.NewAPIError(http.StatusForbidden, models.CodeForbidden, "Machine credentials do not match this machine")
+	}
+	assignments, err := h.svc.GetMachineAssignments(c.Request().Context(), machineID)
+	if err != nil {
+		return fmt.Errorf("GetMachineAssignments: %w", err)
+	}
+	return c.JSON(http.StatusOK, assignments)
+}
+
+// PollMachineCommands 返回机器尚未确认的命令（机器 API Key 认证），供没有 MQTT 连接的机器轮询。
+// 未确认的命令会被重复返回，机器须按命令 ID 去重；没有命令时返回空数组。
+func (h *Handler) PollMachineCommands(c echo.Context) error {
+	machineID := c.Param("machineId")
+	if authID, _ := c.Get("machineID").(string); authID != machineID {
+		return models.NewAPIError(http.StatusForbidden, models.CodeForbidden, "Machine credentials do not match this machine")
+	}
+	cmds, err := h.svc.PollMachineCommands(c.Request().Context(), machineID)
+	if err != nil {
+		return fmt.Errorf("PollMachineCommands: %w", err)
+	}
+	return c.JSON(http.StatusOK, cmds)
+}
+
+// AckMachineCommand 接收机器对命令的确认或拒绝（机器 API Key 认证），返回更新后的命令。
+// 重复确认返回第一次的结果。
+func (h *Handler) AckMachineCommand(c echo.Context) error {
+	machineID := c.Param("machineId")
+	if authID, _ := c.Get("machineID").(string); authID != machineID {
+		return models.NewAPIError(http.StatusForbidden, models.CodeForbidden, "Machine credentials do not match this machine")
+	}
+	var req models.MachineCommandAck
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	cmd, err := h.svc.AckMachineCommand(c.Request().Context(), machineID, c.Param("commandId"), req)
+	if err != nil {
+		return fmt.Errorf("AckMachineCommand: %w", err)
+	}
+	return c.JSON(http.StatusOK, cmd)
+}
+
+// RegisterMachine 注册新机器并签发 API Key（仅管理员），返回 201；Key 明文只在本次响应中返回。
+func (h *Handler) RegisterMachine(c echo.Context) error {
+	var req models.RegisterMachineRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	reg, err := h.svc.RegisterMachine(c.Request().Context(), req)
+	if err != nil {
+		return fmt.Errorf("RegisterMachine: %w", err)
+	}
+	return c.JSON(http.StatusCreated, reg)
+}
+
+// DeleteMachine 退役指定机器（仅管理员）：软删除并吊销 API Key，返回 204 No Content；
+// 配送中的机器返回 409。
+func (h *Handler) DeleteMachine(c echo.Context) error {
+	if !utils.IsAdmin(c) {
+		return models.NewAPIError(http.StatusForbidden, models.CodeForbidden, "Forbidden: Access is restricted to administrators")
+	}
+	if err := h.svc.DeleteMachine(c.Request().Context(), c.Param("machineId")); err != nil {
+		return fmt.Errorf("DeleteMachine: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RotateMachineKey 为机器签发新的 API Key（仅管理员），明文只在本次响应中返回。
+func (h *Handler) RotateMachineKey(c echo.Context) error {
+	machineID := c.Param("machineId")
+	apiKey, err := h.svc.RotateMachineKey(c.Request().Context(), machineID)
+	if err != nil {
+		return fmt.Errorf("RotateMachineKey: %w", err)
+	}
+	return c.JSON(http.StatusCreated, map[string]string{"machine_id": machineID, "api_key": apiKey})
+}
+
+// AuthenticateMachine 供 middleware.MachineAuth 校验机器 API Key。
+func (h *Handler) AuthenticateMachine(ctx context.Context, apiKey string) (string, error) {
+	return h.svc.AuthenticateMachine(ctx, apiKey)
+}
+
 // validateMachineStatus 用于校验机器状态值
-func validateMachineStatus(status string) error {
+func validateMachineStatus(status models.MachineStatus) error {
 	switch status {
 	case models.StatusIdle, models.StatusInTransit, models.StatusMaintenance:
 		return nil
@@ -91,14 +258,400 @@ func (h *Handler) ReassignOrder(c echo.Context) error {
 
 	machine, err := h.svc.AssignOrder(ctx, orderID)
 	if err != nil {
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "order or machine not found"})
-		}
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "failed to reassign order"})
+		return fmt.Errorf("ReassignOrder: %w", err)
 	}
 	return c.JSON(http.StatusOK, machine)
 }
 
+// CreateRun 将多个已支付订单合并为一台地面机器人的多站点配送任务（管理员）。
+//  1) Bind JSON 为 models.CreateRunRequest 并校验（2–8 个不重复的订单 ID）；
+//  2) 调用 svc.BatchOrders；
+//  3) 返回 201 与包含站点、ETA 和订单区段的任务。
+func (h *Handler) CreateRun(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req models.CreateRunRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	run, err := h.svc.BatchOrders(ctx, req.OrderIDs)
+	if err != nil {
+		return fmt.Errorf("CreateRun: %w", err)
+	}
+	return c.JSON(http.StatusCreated, run)
+}
+
+// GetRun 返回配送任务的站点、ETA 与订单区段（管理员）。
+func (h *Handler) GetRun(c echo.Context) error {
+	ctx := c.Request().Context()
+	run, err := h.svc.GetDeliveryRun(ctx, c.Param("runId"))
+	if err != nil {
+		return fmt.Errorf("GetRun: %w", err)
+	}
+	return c.JSON(http.StatusOK, run)
+}
+
+// ListZones 返回所有地理围栏（管理员）。
+func (h *Handler) ListZones(c echo.Context) error {
+	zones, err := h.svc.ListZones(c.Request().Context())
+	if err != nil {
+		return fmt.Errorf("ListZones: %w", err)
+	}
+	return c.JSON(http.StatusOK, zones)
+}
+
+// CreateZone 新增禁飞区或服务区（管理员），返回 201 与新围栏。
+func (h *Handler) CreateZone(c echo.Context) error {
+	var req models.ZoneRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	zone, err := h.svc.CreateZone(c.Request().Context(), req)
+	if err != nil {
+		return fmt.Errorf("CreateZone: %w", err)
+	}
+	return c.JSON(http.StatusCreated, zone)
+}
+
+// UpdateZone 整体替换地理围栏（管理员）。
+func (h *Handler) UpdateZone(c echo.Context) error {
+	var req models.ZoneRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	zone, err := h.svc.UpdateZone(c.Request().Context(), c.Param("zoneId"), req)
+	if err != nil {
+		return fmt.Errorf("UpdateZone: %w", err)
+	}
+	return c.JSON(http.StatusOK, zone)
+}
+
+// DeleteZone 删除地理围栏（管理员），返回 204 No Content。
+func (h *Handler) DeleteZone(c echo.Context) error {
+	if err := h.svc.DeleteZone(c.Request().Context(), c.Param("zoneId")); err != nil {
+		return fmt.Errorf("DeleteZone: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// SetMachineZone 把机器移入运营区，或以 {"zone_id": null} 移出（管理员），返回更新后的机器。
+func (h *Handler) SetMachineZone(c echo.Context) error {
+	var req models.MachineZoneRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	machine, err := h.svc.SetMachineZone(c.Request().Context(), c.Param("machineId"), req)
+	if err != nil {
+		return fmt.Errorf("SetMachineZone: %w", err)
+	}
+	return c.JSON(http.StatusOK, machine)
+}
+
+// SendMachineCommand 为机器排队一条命令（管理员），返回 202 与命令；
+// 命令经 MQTT 推送或由机器轮询取得，确认结果见 ListMachineCommands。
+func (h *Handler) SendMachineCommand(c echo.Context) error {
+	var req models.MachineCommandRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	adminID, _ := c.Get("userID").(string)
+	cmd, err := h.svc.SendMachineCommand(c.Request().Context(), c.Param("machineId"), adminID, req)
+	if err != nil {
+		return fmt.Errorf("SendMachineCommand: %w", err)
+	}
+	return c.JSON(http.StatusAccepted, cmd)
+}
+
+// ListMachineCommands 返回机器最近的命令及其送达与确认状态（管理员），按创建时间倒序。
+func (h *Handler) ListMachineCommands(c echo.Context) error {
+	cmds, err := h.svc.ListMachineCommands(c.Request().Context(), c.Param("machineId"))
+	if err != nil {
+		return fmt.Errorf("ListMachineCommands: %w", err)
+	}
+	if cmds == nil {
+		cmds = []*models.MachineCommand{}
+	}
+	return c.JSON(http.StatusOK, cmds)
+}
+
+// ListDepots 返回所有充电站（管理员）。
+func (h *Handler) ListDepots(c echo.Context) error {
+	depots, err := h.svc.ListDepots(c.Request().Context())
+	if err != nil {
+		return fmt.Errorf("ListDepots: %w", err)
+	}
+	return c.JSON(http.StatusOK, depots)
+}
+
+// CreateDepot 新增充电站（管理员），返回 201 与新充电站。
+func (h *Handler) CreateDepot(c echo.Context) error {
+	var req models.DepotRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	depot, err := h.svc.CreateDepot(c.Request().Context(), req)
+	if err != nil {
+		return fmt.Errorf("CreateDepot: %w", err)
+	}
+	return c.JSON(http.StatusCreated, depot)
+}
+
+// DeleteDepot 删除充电站（管理员），返回 204 No Content。
+func (h *Handler) DeleteDepot(c echo.Context) error {
+	if err := h.svc.DeleteDepot(c.Request().Context(), c.Param("depotId")); err != nil {
+		return fmt.Errorf("DeleteDepot: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListPricingRules 返回所有计价规则（管理员）。
+func (h *Handler) ListPricingRules(c echo.Context) error {
+	rules, err := h.svc.ListPricingRules(c.Request().Context())
+	if err != nil {
+		return fmt.Errorf("ListPricingRules: %w", err)
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+// CreatePricingRule 新增计价规则（管理员），返回 201 与新规则；之后的报价立即按新规则计价。
+func (h *Handler) CreatePricingRule(c echo.Context) error {
+	var req models.PricingRuleRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	rule, err := h.svc.CreatePricingRule(c.Request().Context(), req)
+	if err != nil {
+		return fmt.Errorf("CreatePricingRule: %w", err)
+	}
+	return c.JSON(http.StatusCreated, rule)
+}
+
+// UpdatePricingRule 整体替换计价规则（管理员）。
+func (h *Handler) UpdatePricingRule(c echo.Context) error {
+	var req models.PricingRuleRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	rule, err := h.svc.UpdatePricingRule(c.Request().Context(), c.Param("ruleId"), req)
+	if err != nil {
+		return fmt.Errorf("UpdatePricingRule: %w", err)
+	}
+	return c.JSON(http.StatusOK, rule)
+}
+
+// DeletePricingRule 删除计价规则（管理员），返回 204 No Content。
+func (h *Handler) DeletePricingRule(c echo.Context) error {
+	if err := h.svc.DeletePricingRule(c.Request().Context(), c.Param("ruleId")); err != nil {
+		return fmt.Errorf("DeletePricingRule: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetChargeTrip 返回机器前往充电站的行程（管理员）；机器不在回充途中时返回 404。
+func (h *Handler) GetChargeTrip(c echo.Context) error {
+	trip, err := h.svc.GetChargeTrip(c.Request().Context(), c.Param("machineId"))
+	if err != nil {
+		return fmt.Errorf("GetChargeTrip: %w", err)
+	}
+	return c.JSON(http.StatusOK, trip)
+}
+
+// GetMachineHistory 返回机器的遥测历史（管理员），用于绘制电量与位置曲线。
+//  1) ?from= / ?to= 为 RFC3339 时间，缺省为最近 24 小时，from 必须早于 to；
+//  2) ?max_points= 为返回的最多点数（时间桶数），缺省 500，上限 2000；
+//  3) 调用 svc.GetMachineHistory；机器不存在时返回 404。
+func (h *Handler) GetMachineHistory(c echo.Context) error {
+	from, to, err := parseTimeRange(c, models.DefaultMachineHistoryRange)
+	if err != nil {
+		return err
+	}
+	q := models.MachineHistoryQuery{From: from, To: to}
+	if raw := c.QueryParam("max_points"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > models.MaxMachineHistoryPoints {
+			return models.ValidationFailed(models.FieldError{
+				Field:   "max_points",
+				Rule:    "max",
+				Param:   strconv.Itoa(models.MaxMachineHistoryPoints),
+				Message: fmt.Sprintf("max_points must be between 1 and %d", models.MaxMachineHistoryPoints),
+			})
+		}
+		q.MaxPoints = n
+	}
+
+	history, err := h.svc.GetMachineHistory(c.Request().Context(), c.Param("machineId"), q)
+	if err != nil {
+		return fmt.Errorf("GetMachineHistory: %w", err)
+	}
+	return c.JSON(http.StatusOK, history)
+}
+
+// parseTimeRange 解析 ?from= / ?to=（RFC3339）：to 缺省为当前时间，from 缺省为 to 之前 defaultRange，
+// from 必须早于 to。
+func parseTimeRange(c echo.Context, defaultRange time.Duration) (from, to time.Time, err error) {
+	to = time.Now()
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		raw := c.QueryParam(p.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return from, to, models.ValidationFailed(models.FieldError{
+				Field:   p.name,
+				Rule:    "datetime",
+				Param:   time.RFC3339,
+				Message: p.name + " must be an RFC3339 timestamp",
+			})
+		}
+		*p.dst = t
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultRange)
+	}
+	if !from.Before(to) {
+		return from, to, models.ValidationFailed(models.FieldError{
+			Field:   "from",
+			Rule:    "ltfield",
+			Param:   "to",
+			Message: "from must be before to",
+		})
+	}
+	return from, to, nil
+}
+
+// ---- 报表（管理员）----
+
+// parseReportQuery 解析报表的时间范围（缺省最近 30 天，最长 366 天）与 ?format=（json 或 csv）。
+func parseReportQuery(c echo.Context) (models.ReportQuery, bool, error) {
+	from, to, err := parseTimeRange(c, models.DefaultReportRange)
+	if err != nil {
+		return models.ReportQuery{}, false, err
+	}
+	if to.Sub(from) > models.MaxReportRange {
+		return models.ReportQuery{}, false, models.ValidationFailed(models.FieldError{
+			Field:   "from",
+			Rule:    "max",
+			Param:   models.MaxReportRange.String(),
+			Message: "reports cover at most 366 days",
+		})
+	}
+	switch c.QueryParam("format") {
+	case "", "json":
+		return models.ReportQuery{From: from, To: to}, false, nil
+	case "csv":
+		return models.ReportQuery{From: from, To: to}, true, nil
+	}
+	return models.ReportQuery{}, false, models.ValidationFailed(models.FieldError{
+		Field:   "format",
+		Rule:    "oneof",
+		Param:   "json csv",
+		Message: "format must be json or csv",
+	})
+}
+
+// writeReportCSV 以附件形式返回 CSV，文件名为 <name>-<from>-<to>.csv（UTC 日期）。
+func writeReportCSV(c echo.Context, name string, q models.ReportQuery, write func(w io.Writer) error) error {
+	filename := fmt.Sprintf("%s-%s-%s.csv", name, q.From.UTC().Format(time.DateOnly), q.To.UTC().Format(time.DateOnly))
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	res.WriteHeader(http.StatusOK)
+	return write(res)
+}
+
+// GetUtilizationReport 返回每台机器在配送、空闲、充电与其他状态的时长及利用率（管理员）；
+// ?format=csv 时以 CSV 附件导出。
+func (h *Handler) GetUtilizationReport(c echo.Context) error {
+	q, asCSV, err := parseReportQuery(c)
+	if err != nil {
+		return err
+	}
+	report, err := h.svc.GetUtilizationReport(c.Request().Context(), q)
+	if err != nil {
+		return fmt.Errorf("GetUtilizationReport: %w", err)
+	}
+	if asCSV {
+		return writeReportCSV(c, "utilization", q, func(w io.Writer) error { return writeUtilizationCSV(w, report) })
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// GetDeliveriesReport 返回每天（UTC）确认送达的订单数（管理员）；?format=csv 时以 CSV 附件导出。
+func (h *Handler) GetDeliveriesReport(c echo.Context) error {
+	q, asCSV, err := parseReportQuery(c)
+	if err != nil {
+		return err
+	}
+	report, err := h.svc.GetDeliveriesReport(c.Request().Context(), q)
+	if err != nil {
+		return fmt.Errorf("GetDeliveriesReport: %w", err)
+	}
+	if asCSV {
+		return writeReportCSV(c, "deliveries", q, func(w io.Writer) error { return writeDeliveriesCSV(w, report) })
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// GetDistanceReport 返回每台机器每周的行驶距离（管理员）；?format=csv 时以 CSV 附件导出。
+func (h *Handler) GetDistanceReport(c echo.Context) error {
+	q, asCSV, err := parseReportQuery(c)
+	if err != nil {
+		return err
+	}
+	report, err := h.svc.GetDistanceReport(c.Request().Context(), q)
+	if err != nil {
+		return fmt.Errorf("GetDistanceReport: %w", err)
+	}
+	if asCSV {
+		return writeReportCSV(c, "distance", q, func(w io.Writer) error { return writeDistanceCSV(w, report) })
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// GetRevenueReport 返回每天（UTC）成功的订单扣款、小费、退款与净收入（管理员）；?format=csv 时以 CSV 附件导出。
+func (h *Handler) GetRevenueReport(c echo.Context) error {
+	q, asCSV, err := parseReportQuery(c)
+	if err != nil {
+		return err
+	}
+	report, err := h.svc.GetRevenueReport(c.Request().Context(), q)
+	if err != nil {
+		return fmt.Errorf("GetRevenueReport: %w", err)
+	}
+	if asCSV {
+		return writeReportCSV(c, "revenue", q, func(w io.Writer) error { return writeRevenueCSV(w, report) })
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
 // ---- 3) 客户端：下单前报价 ----
 
 // CalculateQuote 向前端返回“最快”和“最便宜”两种配送方案的估算。
@@ -110,7 +663,7 @@ func (h *Handler) CalculateQuote(c echo.Context) error {
 	ctx := c.Request().Context()
 	var req models.RouteRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "invalid request body"})
+		return models.NewBindError(err)
 	}
 	// 若客户端未指定期望取件/送达时间，则使用当前时间
 	if req.RequestedTime.IsZero() {
@@ -119,10 +672,7 @@ func (h *Handler) CalculateQuote(c echo.Context) error {
 
 	options, err := h.svc.CalculateRouteOptions(ctx, req)
 	if err != nil {
-		if err == models.ErrPackageTooLarge {
-			return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: err.Error()})
-		}
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "failed to calculate quote"})
+		return fmt.Errorf("CalculateQuote: %w", err)
 	}
 	return c.JSON(http.StatusOK, options)
 }
@@ -136,60 +686,313 @@ func (h *Handler) AssignOrderAlias(c echo.Context) error {
 // ---- 5) 纯路线计算与持久化 ----
 
 // ComputeRoute 生成并保存路径至 routes 表。
-//  1) 提取 orderId；
+//  1) 提取 orderId，绑定可选的请求体（途经点 waypoints）；
 //  2) 调用 svc.ComputeRoute；
-//  3) 返回 models.Route 对象。
+//  3) 返回 models.Route 对象（含各段）。
 func (h *Handler) ComputeRoute(c echo.Context) error {
 	ctx := c.Request().Context()
 	orderID := c.Param("orderId")
+	var req models.ComputeRouteRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
 
-	route, err := h.svc.ComputeRoute(ctx, orderID)
+	route, err := h.svc.ComputeRoute(ctx, orderID, req.Waypoints)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "failed to compute route"})
+		return fmt.Errorf("ComputeRoute: %w", err)
 	}
 	return c.JSON(http.StatusOK, route)
 }
 
 // ---- 6) 轨迹上报与查询 ----
-// ReportTracking 持久化单次定位事件，用于实时或事后跟踪。
-// Bind JSON → svc.ReportTracking → 201 Created
+// ReportTracking 持久化单次定位事件，用于实时或事后跟踪（需机器 API Key）。
+// Bind JSON → svc.ReportTracking（校验机器是否分配给该订单）→ 201 Created
 func (h *Handler) ReportTracking(c echo.Context) error {
 	ctx := c.Request().Context()
 	orderID := c.Param("orderId")
+	machineID, _ := c.Get("machineID").(string)
 
 	var req models.TrackingEventRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "invalid request body"})
+		return models.NewBindError(err)
 	}
-	if err := h.svc.ReportTracking(ctx, orderID, req); err != nil {
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "failed to record tracking"})
+	if err := h.svc.ReportTracking(ctx, orderID, machineID, req); err != nil {
+		return fmt.Errorf("ReportTracking: %w", err)
 	}
 	return c.NoContent(http.StatusCreated)
 }
 
-// GetTracking 返回指定订单的所有轨迹事件，按时间升序。
-// 算法：svc.GetTracking → JSON 返回
+// trackingBatchClockSkew 是补传轨迹点的时间允许超前服务器时钟的幅度
+const trackingBatchClockSkew = time.Minute
+
+// ReportTrackingBatch 补传机器离线期间缓存的轨迹点（需机器 API Key）。
+// Bind JSON 为 models.TrackingBatchRequest（1～1000 个点）→ 校验坐标与 recorded_at
+// （不得晚于服务器时间超过 1 分钟）→ svc.ReportTrackingBatch（全部写入或全部不写）→ 201 Created
+func (h *Handler) ReportTrackingBatch(c echo.Context) error {
+	orderID := c.Param("orderId")
+	machineID, _ := c.Get("machineID").(string)
+
+	var req models.TrackingBatchRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	latest := time.Now().Add(trackingBatchClockSkew)
+	for i, p := range req.Points {
+		if p.RecordedAt.After(latest) {
+			return models.ValidationFailed(models.FieldError{
+				Field:   fmt.Sprintf("points[%d].recorded_at", i),
+				Rule:    "lte",
+				Message: "recorded_at must not be in the future",
+			})
+		}
+	}
+	if err := h.svc.ReportTrackingBatch(c.Request().Context(), orderID, machineID, req.Points); err != nil {
+		return fmt.Errorf("ReportTrackingBatch: %w", err)
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+// GetTracking 分页返回指定订单的轨迹事件，按时间升序；仅下单用户、管理员与客服可查看。
+// 查询参数：since（RFC3339）、limit（默认 500，最大 1000）、cursor（上一页返回的游标）。
+// 还有下一页时，响应头 X-Next-Cursor 携带下一页的游标。
+// 返回了事件时，响应头 X-Last-Cursor 携带最后一个事件的游标：轮询的客户端下次以它作为 cursor，
+// 只取新增的事件（到了最后一页也可以续传）。
 func (h *Handler) GetTracking(c echo.Context) error {
 	ctx := c.Request().Context()
 	orderID := c.Param("orderId")
-	sinceStr := c.QueryParam("since")
-	var since time.Time
-	if sinceStr != "" {
+	if err := h.authorizeViewer(c, orderID); err != nil {
+		return fmt.Errorf("GetTracking: %w", err)
+	}
+	var q models.TrackingQuery
+	if sinceStr := c.QueryParam("since"); sinceStr != "" {
 		t, err := time.Parse(time.RFC3339, sinceStr)
-		if err == nil {
-			since = t
+		if err != nil {
+			return models.ValidationFailed(models.FieldError{
+				Field:   "since",
+				Rule:    "datetime",
+				Param:   time.RFC3339,
+				Message: "since must be an RFC3339 timestamp",
+			})
 		}
+		q.Since = t
+	}
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return models.ValidationFailed(models.FieldError{
+				Field:   "limit",
+				Rule:    "min",
+				Param:   "1",
+				Message: "limit must be a positive integer",
+			})
+		}
+		q.Limit = limit
+	}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		after, err := models.DecodeTrackingCursor(cursor)
+		if err != nil {
+			return models.NewAPIError(http.StatusBadRequest, models.CodeInvalidRequest, "Invalid cursor")
+		}
+		q.After = after
 	}
 
-
-	events, err := h.svc.GetTracking(ctx, orderID, since)
+	events, next, err := h.svc.GetTracking(ctx, orderID, q)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "failed to get tracking"})
+		return fmt.Errorf("GetTracking: %w", err)
+	}
+	if next != nil {
+		c.Response().Header().Set("X-Next-Cursor", next.Encode())
+	}
+	if len(events) > 0 {
+		last := events[len(events)-1]
+		c.Response().Header().Set("X-Last-Cursor", models.TrackingCursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode())
 	}
 	return c.JSON(http.StatusOK, events)
 }
 
-// HandleTracking 目前仅作为占位实现，防止build error for WebSocket path。
+// GetETA 返回订单的实时预计到达时间（剩余距离、时长与到达时刻）；查看权限与轨迹相同。
+// 订单还没有路线，或已取消、失败时返回 404。
+func (h *Handler) GetETA(c echo.Context) error {
+	orderID := c.Param("orderId")
+	if err := h.authorizeViewer(c, orderID); err != nil {
+		return fmt.Errorf("GetETA: %w", err)
+	}
+	eta, err := h.svc.GetETA(c.Request().Context(), orderID)
+	if err != nil {
+		return fmt.Errorf("GetETA: %w", err)
+	}
+	return c.JSON(http.StatusOK, eta)
+}
+
+// authorizeViewer 使用 JWT 中的用户 ID 与角色校验订单轨迹的查看权限。
+func (h *Handler) authorizeViewer(c echo.Context, orderID string) error {
+	userID, _ := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+	return h.svc.AuthorizeTrackingViewer(c.Request().Context(), orderID, userID, role)
+}
+
+// 轨迹 WebSocket 参数
+const (
+	trackingStreamPageSize     = 100              // 每次从数据库补读的事件数
+	trackingStreamWriteTimeout = 10 * time.Second // 单帧写超时；客户端跟不上则断开，由其凭游标重连续传
+	trackingStreamPingInterval = 30 * time.Second // 保活 ping，防止代理回收空闲连接
+	trackingStreamMaxInbound   = 4 << 10          // 客户端消息只用于探测断开，限制其大小
+)
+
+// pingCodec 发送 WebSocket ping 控制帧；浏览器会自动回复 pong。
+var pingCodec = websocket.Codec{Marshal: func(any) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+// HandleTracking 通过 WebSocket 实时推送订单的新轨迹事件。
+//  1) 校验查看权限（下单用户、管理员、客服），握手前失败按普通 HTTP 错误返回；
+//  2) 起点：?cursor= 从游标之后续传，?since=（RFC3339）从指定时间开始，否则只推送之后的新事件；
+//  3) 每帧为 models.TrackingStreamMessage；断线后客户端以最后收到的 cursor 重连即可无缝续传；
+//  4) 背压：新事件只作为信号合并，连接按自己的游标从数据库读取，
+//     慢客户端不会占用服务端内存；单帧写超时则断开连接；
+//  5) 每批新事件之后推送一帧只含 eta 的消息，按最新位置重新估算到达时间。
 func (h *Handler) HandleTracking(c echo.Context) error {
-	return c.NoContent(http.StatusNotImplemented)
-}
\ No newline at end of file
+	orderID := c.Param("orderId")
+	if err := h.authorizeViewer(c, orderID); err != nil {
+		return fmt.Errorf("HandleTracking: %w", err)
+	}
+	q := models.TrackingQuery{Limit: trackingStreamPageSize, Fresh: true}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		after, err := models.DecodeTrackingCursor(cursor)
+		if err != nil {
+			return models.NewAPIError(http.StatusBadRequest, models.CodeInvalidRequest, "Invalid cursor")
+		}
+		q.After = after
+	} else if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		t, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return models.NewAPIError(http.StatusBadRequest, models.CodeInvalidRequest, "since must be an RFC3339 timestamp")
+		}
+		q.Since = t
+	} else {
+		q.Since = time.Now()
+	}
+
+	server := websocket.Server{
+		Handshake: h.checkOrigin,
+		Handler: func(ws *websocket.Conn) {
+			err := h.streamTracking(ws, orderID, q)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+				c.Logger().Warnf("HandleTracking %s: %v", orderID, err)
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// checkOrigin 防止跨站 WebSocket 劫持（cookie 认证模式下浏览器会自动携带凭证）：
+// 不带 Origin 的非浏览器客户端、同源请求与 allowedOrigins 中的来源允许握手。
+func (h *Handler) checkOrigin(_ *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	for _, allowed := range h.allowedOrigins {
+		if allowed != "" && strings.EqualFold(allowed, origin) {
+			return nil
+		}
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	return fmt.Errorf("origin %q not allowed", origin)
+}
+
+// streamTracking 在连接关闭前循环：补读并发送新事件，然后等待下一个信号或 ping 周期。
+func (h *Handler) streamTracking(ws *websocket.Conn, orderID string, q models.TrackingQuery) error {
+	defer ws.Close()
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+
+	// HTTP 服务器的读写超时会残留在被接管的连接上，这里清除，改为按帧设置写超时
+	ws.SetDeadline(time.Time{})
+	ws.MaxPayloadBytes = trackingStreamMaxInbound
+
+	// 先订阅再补读，避免两者之间提交的事件被漏掉
+	wake, unsubscribe := h.svc.WatchTracking(orderID)
+	defer unsubscribe()
+
+	// 读协程：丢弃客户端消息（ping/close 帧由 websocket 包处理），连接断开时取消 ctx
+	go func() {
+		defer cancel()
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	ticker := time.NewTicker(trackingStreamPingInterval)
+	defer ticker.Stop()
+	for {
+		if err := h.sendNewEvents(ctx, ws, orderID, &q); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		case <-ticker.C:
+			ws.SetWriteDeadline(time.Now().Add(trackingStreamWriteTimeout))
+			if err := pingCodec.Send(ws, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendNewEvents 从 q 的游标开始读取并发送所有新事件，随发送推进游标；
+// 发送过事件时再推送一帧最新的 ETA。
+func (h *Handler) sendNewEvents(ctx context.Context, ws *websocket.Conn, orderID string, q *models.TrackingQuery) error {
+	sent := false
+	for {
+		events, next, err := h.svc.GetTracking(ctx, orderID, *q)
+		if err != nil {
+			return err
+		}
+		sent = sent || len(events) > 0
+		for _, ev := range events {
+			cursor := &models.TrackingCursor{CreatedAt: ev.CreatedAt, ID: ev.ID}
+			ws.SetWriteDeadline(time.Now().Add(trackingStreamWriteTimeout))
+			if err := websocket.JSON.Send(ws, models.TrackingStreamMessage{Event: ev, Cursor: cursor.Encode()}); err != nil {
+				return err
+			}
+			q.After = cursor
+		}
+		if next == nil {
+			break
+		}
+	}
+	if !sent {
+		return nil
+	}
+	return h.sendETA(ctx, ws, orderID, q.After)
+}
+
+// sendETA 推送订单的最新 ETA。订单没有路线（ErrNotFound）时跳过；
+// 其他估算失败只记录日志，不中断轨迹推送。
+func (h *Handler) sendETA(ctx context.Context, ws *websocket.Conn, orderID string, cursor *models.TrackingCursor) error {
+	eta, err := h.svc.GetETA(ctx, orderID)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) && ctx.Err() == nil {
+			log.Printf("HandleTracking %s: %v", orderID, err)
+		}
+		return nil
+	}
+	msg := models.TrackingStreamMessage{ETA: eta}
+	if cursor != nil {
+		msg.Cursor = cursor.Encode()
+	}
+	ws.SetWriteDeadline(time.Now().Add(trackingStreamWriteTimeout))
+	return websocket.JSON.Send(ws, msg)
+}
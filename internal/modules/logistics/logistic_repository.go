@@ -2,12 +2,16 @@ package logistics
 
 import (
     "context"
+    "errors"
     "fmt"
+    "sort"
     "time"
 
+    "dispatch-and-delivery/internal/database"
     "dispatch-and-delivery/internal/models"
 
     "github.com/jackc/pgx/v5"
+    "github.com/jackc/pgx/v5/pgconn"
     "github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -17,42 +21,209 @@ type RepositoryInterface interface {
     // ===== Machine Status =====
     // FindMachineByID 根据机器 UUID 查询机器详情。
     FindMachineByID(ctx context.Context, id string) (*models.Machine, error)
-    // UpdateMachine 更新机器状态、位置、以及电量等字段。
+    // UpdateMachine 更新机器状态、位置、电量以及固件版本等字段；版本号不匹配时返回 models.ErrMachineVersionConflict。
     UpdateMachine(ctx context.Context, m *models.Machine) error
-    // ListMachines 查询所有机器信息，并按创建时间排序返回。
-    ListMachines(ctx context.Context) ([]*models.Machine, error)
+    // ListMachines 查询所有机器信息，并按创建时间排序返回；includeDeleted 为 true 时包含已软删除的机器。
+    ListMachines(ctx context.Context, includeDeleted bool) ([]*models.Machine, error)
+    // CreateMachine 新增机器并保存其 API Key 摘要，回填 ID、版本号与时间戳。
+    CreateMachine(ctx context.Context, m *models.Machine, keyHash string) error
+    // DeleteMachine 退役机器：软删除（设置 deleted_at），保留历史订单对其的引用，并吊销 API Key；
+    // 配送中的机器返回 models.ErrMachineBusy。
+    DeleteMachine(ctx context.Context, id string) error
+    // GetFleetStats 在数据库中聚合未删除机器的状态、类型与电量，以及配送中的订单数。
+    GetFleetStats(ctx context.Context) (*models.FleetStats, error)
+
+    // ===== Heartbeat =====
+    // RecordHeartbeat 记录机器的心跳时间；OFFLINE 的机器恢复为 IDLE，此时 revived 为 true。
+    // 机器不存在或已删除时返回 models.ErrNotFound。
+    RecordHeartbeat(ctx context.Context, machineID string) (revived bool, err error)
+    // MarkStaleMachinesOffline 将超过 timeout 没有心跳的机器（维护中的除外）标记为 OFFLINE，
+    // 返回本次被标记的机器及其原状态。
+    MarkStaleMachinesOffline(ctx context.Context, timeout time.Duration) ([]models.StaleMachine, error)
+    // NotifyAdmins 给每个管理员写入一条站内通知。
+    NotifyAdmins(ctx context.Context, message string) error
+
+    // ===== Telemetry History =====
+    // SnapshotMachines 把每台未删除机器当前的位置、电量与状态写入 machine_telemetry，返回写入行数。
+    SnapshotMachines(ctx context.Context) (int64, error)
+    // PruneMachineTelemetry 删除 before 之前的遥测快照，返回删除行数。
+    PruneMachineTelemetry(ctx context.Context, before time.Time) (int64, error)
+    // ListMachineHistory 按宽度为 bucket 的时间桶降采样 [from, to) 内的遥测快照，按时间升序返回。
+    ListMachineHistory(ctx context.Context, machineID string, from, to time.Time, bucket time.Duration) ([]models.MachineHistoryPoint, error)
+
+    // ===== Reports =====
+    // ListMachineUtilization 按 [from, to) 内的遥测快照统计每台机器（含已删除）在各状态停留的秒数；
+    // 每条快照的状态持续到下一条快照，但至多 maxGap（更长的空档视为没有数据）。按机器 ID 排序。
+    ListMachineUtilization(ctx context.Context, from, to time.Time, maxGap time.Duration) ([]models.MachineUtilization, error)
+    // CountDeliveriesByDay 按 UTC 日期统计 [from, to) 内确认送达（order.delivered 事件）的订单数，
+    // 只返回有送达的日期，按日期升序。
+    CountDeliveriesByDay(ctx context.Context, from, to time.Time) ([]models.DailyDeliveries, error)
+    // SumRevenueByDay 按 UTC 日期汇总 [from, to) 内成功的订单扣款、小费与退款金额（不含 Net），
+    // 只返回有支付记录的日期，按日期升序。
+    SumRevenueByDay(ctx context.Context, from, to time.Time) ([]models.DailyRevenue, error)
+    // SumDistanceByWeek 按 ISO 周（UTC）累加 [from, to) 内相邻遥测快照之间的直线距离，按周与机器 ID 排序。
+    SumDistanceByWeek(ctx context.Context, from, to time.Time) ([]models.WeeklyDistance, error)
+
+    // ===== Machine Credentials =====
+    // SetMachineKeyHash 保存机器 API Key 的 SHA-256 摘要（覆盖旧 Key）。
+    SetMachineKeyHash(ctx context.Context, machineID, keyHash string) error
+    // FindMachineIDByKeyHash 按 API Key 摘要查找未删除的机器 ID；未找到返回 models.ErrNotFound。
+    FindMachineIDByKeyHash(ctx context.Context, keyHash string) (string, error)
+
+    // ===== Commands =====
+    // CreateMachineCommand 为未删除的机器排队一条命令，回填 ID、状态（PENDING）与创建时间；
+    // 机器不存在时返回 models.ErrNotFound。
+    CreateMachineCommand(ctx context.Context, cmd *models.MachineCommand) error
+    // ListMachineCommands 按创建时间倒序查询机器最近的至多 limit 条命令。
+    ListMachineCommands(ctx context.Context, machineID string, limit int) ([]*models.MachineCommand, error)
+    // TakeMachineCommands 返回机器尚未确认且未过期的命令（按创建时间升序），并标记为 DELIVERED。
+    TakeMachineCommands(ctx context.Context, machineID string) ([]*models.MachineCommand, error)
+    // ListUndeliveredCommands 查询全车队仍为 PENDING 且未过期的命令，按创建时间升序。
+    ListUndeliveredCommands(ctx context.Context) ([]*models.MachineCommand, error)
+    // MarkCommandDelivered 将 PENDING 的命令标记为 DELIVERED；其他状态不修改。
+    MarkCommandDelivered(ctx context.Context, commandID string) error
+    // AckMachineCommand 记录机器对命令的确认或拒绝并返回命令；已确认或拒绝的命令不再修改（重复确认是幂等的）。
+    // 命令不存在或不属于该机器时返回 models.ErrNotFound。
+    AckMachineCommand(ctx context.Context, machineID, commandID string, accepted bool, reason string) (*models.MachineCommand, error)
+    // ExpireMachineCommands 将超过 expires_at 仍未确认的命令标记为 EXPIRED，返回标记行数。
+    ExpireMachineCommands(ctx context.Context) (int64, error)
+
+    // ===== Capacity =====
+    // ListMachineCapacities 查询各机器类型可承载的最大重量与尺寸。
+    ListMachineCapacities(ctx context.Context) ([]models.MachineCapacity, error)
+    // GetOrderPackage 查询订单包裹的重量与尺寸。
+    GetOrderPackage(ctx context.Context, orderID string) (weightKG float64, dims models.Dimensions, err error)
 
     // ===== Route =====
     // GetOrderAddresses 查询指定订单的取件地址和投递地址。
     GetOrderAddresses(ctx context.Context, orderID string) (pickup, dropoff string, err error)
-    // SaveRoute 持久化计算出的路线数据（polyline、距离、时长）。
+    // SaveRoute 持久化计算出的路线数据（polyline、距离、时长）及其各段（route.Legs）。
     SaveRoute(ctx context.Context, route *models.Route) error
+    // GetLatestRoute 查询订单最近一次保存的路线（含各段）；未计算过路线时返回 models.ErrNotFound。
+    GetLatestRoute(ctx context.Context, orderID string) (*models.Route, error)
 
     // ===== Assignment =====
     // GetOrderDestination 查询订单的投递地点（delivery_location 字段）。
     GetOrderDestination(ctx context.Context, orderID string) (string, error)
+    // GetOrderMachineID 查询订单当前分配的机器 ID；未分配时返回空字符串。
+    GetOrderMachineID(ctx context.Context, orderID string) (string, error)
+    // GetOrderOwnerID 查询下单用户 ID，用于校验谁可以查看订单轨迹。
+    GetOrderOwnerID(ctx context.Context, orderID string) (string, error)
+    // GetOrderPoints 查询订单取件与投递地址的坐标；地址未设置坐标时对应返回值为 nil。
+    GetOrderPoints(ctx context.Context, orderID string) (pickup, dropoff *models.GeoPoint, err error)
+    // GetOrderDeliveryWindow 查询订单的送达时间窗；没有时间窗时返回 nil。
+    GetOrderDeliveryWindow(ctx context.Context, orderID string) (*models.DeliveryWindow, error)
+    // ListMachineOrders 按分配时间顺序查询机器正在配送（IN_PROGRESS）的订单 ID。
+    ListMachineOrders(ctx context.Context, machineID string) ([]string, error)
+    // ListMachineRecipients 一次查询机器正在配送的订单的收件人与投递说明，按订单 ID 索引；
+    // 下单时未填写的订单不在结果中。
+    ListMachineRecipients(ctx context.Context, machineID string) (map[string]*models.Recipient, error)
     // ListIdleMachines 查询所有当前状态为 'IDLE' 的机器列表。
     ListIdleMachines(ctx context.Context) ([]*models.Machine, error)
+    // ListNearestIdleMachines 按 PostGIS KNN（<->）返回距 (lon, lat) 最近的至多 limit 台空闲机器，
+    // 由近到远排列；只返回 types 中的机器类型，types 为空表示不限类型；
+    // zoneID 非空时只返回属于该运营区的机器。
+    ListNearestIdleMachines(ctx context.Context, lon, lat float64, types []models.MachineType, zoneID string, limit int) ([]*models.Machine, error)
     // AssignOrder 将机器分配给订单：设置订单的 machine_id 与 status，并更新更新时间。
     AssignOrder(ctx context.Context, orderID, machineID string) error
     // UpdateMachineStatus 单独更新机器的 status 字段（不修改位置、电量等）。
-    UpdateMachineStatus(ctx context.Context, machineID, status string) error
+    UpdateMachineStatus(ctx context.Context, machineID string, status models.MachineStatus) error
+    // ClaimMachine 在一个事务中锁定空闲机器、将其置为 IN_TRANSIT，并把 orderIDs 全部分配给它。
+    // 机器已不是 IDLE 或正被其他事务锁定时返回 models.ErrMachineClaimed。
+    ClaimMachine(ctx context.Context, machineID string, orderIDs ...string) error
+    // ReturnMachine 在机器没有其他 IN_PROGRESS 订单时将 IN_TRANSIT 的机器置为 RETURNING；
+    // returning 表示机器是否确实开始返航。机器回到基地上报 IDLE 后才重新参与派单。
+    ReturnMachine(ctx context.Context, machineID string) (returning bool, err error)
+
+    // ===== Batching =====
+    // GetOrderStatus 查询订单状态。
+    GetOrderStatus(ctx context.Context, orderID string) (models.OrderStatus, error)
+    // CreateDeliveryRun 保存多站点配送任务及其全部站点，回填 run.ID 与 run.CreatedAt。
+    CreateDeliveryRun(ctx context.Context, run *models.DeliveryRun) error
+    // GetDeliveryRun 查询配送任务及按 seq 排序的站点；未找到返回 models.ErrNotFound。
+    GetDeliveryRun(ctx context.Context, runID string) (*models.DeliveryRun, error)
+
+    // ===== Zones =====
+    // ListZones 查询所有地理围栏，按名称排序。
+    ListZones(ctx context.Context) ([]*models.Zone, error)
+    // CreateZone 新增地理围栏，回填 ID 与时间戳；多边形无效时返回 models.ErrInvalidGeometry。
+    CreateZone(ctx context.Context, z *models.Zone) error
+    // UpdateZone 替换地理围栏的名称、类型与多边形；未找到返回 models.ErrNotFound。
+    UpdateZone(ctx context.Context, z *models.Zone) error
+    // DeleteZone 删除地理围栏（运营区的机器随之移出该区）；未找到返回 models.ErrNotFound。
+    DeleteZone(ctx context.Context, id string) error
+    // CrossesNoFlyZone 判断折线 path 是否与任一禁飞区相交。
+    CrossesNoFlyZone(ctx context.Context, path []models.GeoPoint) (bool, error)
+    // LeavesServiceArea 判断折线 path 是否离开服务区（所有服务区的并集）；未定义服务区时返回 false。
+    LeavesServiceArea(ctx context.Context, path []models.GeoPoint) (bool, error)
+    // FindOperationalZone 返回包含 (lon, lat) 的运营区 ID，多个运营区重叠时取面积最小的；
+    // 不在任何运营区内时返回空字符串。
+    FindOperationalZone(ctx context.Context, lon, lat float64) (string, error)
+    // SetMachineZone 把机器移入运营区 zoneID，zoneID 为 nil 表示移出所有运营区；
+    // 运营区不存在或不是 OPERATIONAL 时返回 models.ErrInvalidZone，机器不存在时返回 models.ErrNotFound。
+    SetMachineZone(ctx context.Context, machineID string, zoneID *string) error
+
+    // ===== Depots =====
+    // ListDepots 查询所有充电站，按名称排序。
+    ListDepots(ctx context.Context) ([]*models.Depot, error)
+    // CreateDepot 新增充电站，回填 ID 与创建时间。
+    CreateDepot(ctx context.Context, d *models.Depot) error
+    // DeleteDepot 删除充电站（前往该站的充电行程一并删除）；未找到返回 models.ErrNotFound。
+    DeleteDepot(ctx context.Context, id string) error
+    // FindNearestDepot 返回距 (lon, lat) 最近的充电站；没有充电站时返回 models.ErrNotFound。
+    FindNearestDepot(ctx context.Context, lon, lat float64) (*models.Depot, error)
+    // SaveChargeTrip 保存机器的充电行程，覆盖该机器已有的行程，回填 StartedAt。
+    SaveChargeTrip(ctx context.Context, trip *models.ChargeTrip) error
+    // GetChargeTrip 查询机器当前的充电行程；未找到返回 models.ErrNotFound。
+    GetChargeTrip(ctx context.Context, machineID string) (*models.ChargeTrip, error)
+    // DeleteChargeTrip 删除机器的充电行程；没有行程时不报错。
+    DeleteChargeTrip(ctx context.Context, machineID string) error
+
+    // ===== Pricing =====
+    // ListPricingRules 查询所有计价规则，按机器类型与距离分段排序。
+    ListPricingRules(ctx context.Context) ([]*models.PricingRule, error)
+    // CreatePricingRule 新增计价规则，回填 ID 与时间戳。
+    CreatePricingRule(ctx context.Context, rule *models.PricingRule) error
+    // UpdatePricingRule 整体替换计价规则；未找到返回 models.ErrNotFound。
+    UpdatePricingRule(ctx context.Context, rule *models.PricingRule) error
+    // DeletePricingRule 删除计价规则；未找到返回 models.ErrNotFound。
+    DeletePricingRule(ctx context.Context, id string) error
+    // CountSurgeDemand 统计位于运营区 zoneID 多边形内的空闲机器数与等待派单的订单数（按取件点）。
+    CountSurgeDemand(ctx context.Context, zoneID string) (idle, pending int, err error)
 
     // ===== Tracking =====
     // CreateTrackingEvent 新增一条订单轨迹事件，将机器位置写入 tracking_events 表。
     CreateTrackingEvent(ctx context.Context, event *models.TrackingEvent) error
-    // ListTrackingEvents 按时间升序查询指定订单的所有轨迹事件，可选起始时间
-    ListTrackingEvents(ctx context.Context, orderID string, since time.Time) ([]*models.TrackingEvent, error)
+    // CreateTrackingEvents 在一个事务中批量新增轨迹事件，保留各事件的 CreatedAt，回填 ID；
+    // 任一事件写入失败则全部回滚。
+    CreateTrackingEvents(ctx context.Context, events []*models.TrackingEvent) error
+    // ListTrackingEvents 按 (created_at, id) 升序分页查询指定订单的轨迹事件，可选起始时间和游标
+    ListTrackingEvents(ctx context.Context, orderID string, q models.TrackingQuery) ([]*models.TrackingEvent, error)
+    // GetLatestTrackingEvent 查询订单最新的一条轨迹事件（读主库）；还没有轨迹时返回 models.ErrNotFound。
+    GetLatestTrackingEvent(ctx context.Context, orderID string) (*models.TrackingEvent, error)
+    // MarkOrderArrived 将配送中（IN_PROGRESS）的订单置为 ARRIVED；订单不在配送中时不修改并返回 false。
+    MarkOrderArrived(ctx context.Context, orderID string) (bool, error)
 }
 
 // Repository 实现 RepositoryInterface，使用 PostgreSQL (pgxpool.Pool) 与数据库交互。
 type Repository struct {
-    db *pgxpool.Pool // pgx 连接池
+    db      *pgxpool.Pool // pgx 连接池（主库，所有写操作）
+    replica *pgxpool.Pool // 只读副本，用于车队列表、轨迹历史等重读查询
+}
+
+// NewRepository 创建 Repository 实例，传入主库连接池和只读副本连接池。
+// 未配置副本时，replica 可直接传入主库连接池。
+func NewRepository(db, replica *pgxpool.Pool) RepositoryInterface {
+    if replica == nil {
+        replica = db
+    }
+    return &Repository{db: db, replica: replica}
 }
 
-// NewRepository 创建 Repository 实例，传入已初始化的 *pgxpool.Pool。
-func NewRepository(db *pgxpool.Pool) RepositoryInterface {
-    return &Repository{db: db}
+// conn 返回 ctx 中携带的事务（由 database.TxManager 开启），否则返回主库连接池。
+// 这样订单模块在同一事务中调用 AssignOrder 时，分配操作会一起提交或回滚。
+func (r *Repository) conn(ctx context.Context) database.Executor {
+    return database.Conn(ctx, r.db)
 }
 
 // ===== Machine Status 实现 =====
@@ -64,16 +235,16 @@ func (r *Repository) FindMachineByID(ctx context.Context, id string) (*models.Ma
         SELECT id, type, status,
                COALESCE(ST_Y(current_location::geometry), 0) AS lat,
                COALESCE(ST_X(current_location::geometry), 0) AS lon,
-               battery_level, created_at, updated_at
+               battery_level, max_weight_kg, zone_id, COALESCE(firmware_version, ''), version, created_at, updated_at
         FROM machines
-        WHERE id = $1`
-    row := r.db.QueryRow(ctx, query, id)
+        WHERE id = $1 AND deleted_at IS NULL`
+    row := r.conn(ctx).QueryRow(ctx, query, id)
 
     m := &models.Machine{}
     if err := row.Scan(
         &m.ID, &m.Type, &m.Status,
         &m.Latitude, &m.Longitude,
-        &m.BatteryLevel, &m.CreatedAt, &m.UpdatedAt,
+        &m.BatteryLevel, &m.MaxWeightKG, &m.ZoneID, &m.FirmwareVersion, &m.Version, &m.CreatedAt, &m.UpdatedAt,
     ); err != nil {
         if err == pgx.ErrNoRows {
             return nil, models.ErrNotFound
@@ -83,41 +254,58 @@ func (r *Repository) FindMachineByID(ctx context.Context, id string) (*models.Ma
     return m, nil
 }
 
-// UpdateMachine 将机器的状态、位置和电量写回数据库。
+// UpdateMachine 将机器的状态、位置、电量和固件版本写回数据库。
 // 使用 ST_SetSRID/ST_MakePoint 更新地理位置字段。
+// 乐观锁：仅当 version 仍为调用方读到的 m.Version 时才写入，成功后 m.Version 递增；
+// 否则返回 models.ErrMachineVersionConflict，由调用方重新读取后重试。
 func (r *Repository) UpdateMachine(ctx context.Context, m *models.Machine) error {
     const query = `
         UPDATE machines
         SET status = $2,
             current_location = ST_SetSRID(ST_MakePoint($3, $4), 4326),
             battery_level = $5,
+            firmware_version = NULLIF($7, ''),
+            version = version + 1,
             updated_at = now()
-        WHERE id = $1`
-    cmd, err := r.db.Exec(ctx, query,
+        WHERE id = $1 AND version = $6 AND deleted_at IS NULL`
+    cmd, err := r.conn(ctx).Exec(ctx, query,
         m.ID, m.Status,
         m.Longitude, m.Latitude,
-        m.BatteryLevel,
+        m.BatteryLevel, m.Version, m.FirmwareVersion,
     )
     if err != nil {
         return fmt.Errorf("UpdateMachine failed: %w", err)
     }
     if cmd.RowsAffected() == 0 {
+        // 区分机器不存在与版本冲突
+        var exists bool
+        if err := r.conn(ctx).QueryRow(ctx,
+            `SELECT EXISTS(SELECT 1 FROM machines WHERE id = $1 AND deleted_at IS NULL)`, m.ID,
+        ).Scan(&exists); err != nil {
+            return fmt.Errorf("UpdateMachine failed: %w", err)
+        }
+        if exists {
+            return models.ErrMachineVersionConflict
+        }
         return models.ErrNotFound
     }
+    m.Version++
     return nil
 }
 
 // ListMachines 查询所有机器信息，并按 created_at 升序排序返回。
-// 完整加载每台机器的地理位置、电量和状态。
-func (r *Repository) ListMachines(ctx context.Context) ([]*models.Machine, error) {
+// 完整加载每台机器的地理位置、电量和状态；默认过滤已软删除的机器。
+func (r *Repository) ListMachines(ctx context.Context, includeDeleted bool) ([]*models.Machine, error) {
     const query = `
         SELECT id, type, status,
                COALESCE(ST_Y(current_location::geometry), 0) AS lat,
                COALESCE(ST_X(current_location::geometry), 0) AS lon,
-               battery_level, created_at, updated_at
+               battery_level, max_weight_kg, zone_id, COALESCE(firmware_version, ''), version, created_at, updated_at, deleted_at
         FROM machines
+        WHERE $1 OR deleted_at IS NULL
         ORDER BY created_at`
-    rows, err := r.db.Query(ctx, query)
+    // 管理端车队列表，走只读副本
+    rows, err := r.replica.Query(ctx, query, includeDeleted)
     if err != nil {
         return nil, fmt.Errorf("ListMachines failed: %w", err)
     }
@@ -129,7 +317,7 @@ func (r *Repository) ListMachines(ctx context.Context) ([]*models.Machine, error
         if err := rows.Scan(
             &m.ID, &m.Type, &m.Status,
             &m.Latitude, &m.Longitude,
-            &m.BatteryLevel, &m.CreatedAt, &m.UpdatedAt,
+            &m.BatteryLevel, &m.MaxWeightKG, &m.ZoneID, &m.FirmwareVersion, &m.Version, &m.CreatedAt, &m.UpdatedAt, &m.DeletedAt,
         ); err != nil {
             return nil, fmt.Errorf("ListMachines Scan failed: %w", err)
         }
@@ -141,114 +329,412 @@ func (r *Repository) ListMachines(ctx context.Context) ([]*models.Machine, error
     return machines, nil
 }
 
-// ===== Route 实现 =====
+// GetFleetStats 按 (type, status) 分组聚合机器数量与电量之和，再在内存中合并各组；
+// 无论车队多大，只需传输至多 类型数×状态数 行。走只读副本。
+func (r *Repository) GetFleetStats(ctx context.Context) (*models.FleetStats, error) {
+    const machinesQuery = `
+        SELECT type, status, count(*), COALESCE(sum(battery_level), 0)
+        FROM machines
+        WHERE deleted_at IS NULL
+        GROUP BY type, status`
+    const ordersQuery = `SELECT count(*) FROM orders WHERE status IN ('IN_PROGRESS', 'ARRIVED')`
 
-// GetOrderAddresses 从 orders 表中获取取件(pickup_location)和投递(delivery_location)地址。
-// 常用于报价计算前的数据准备。
-func (r *Repository) GetOrderAddresses(ctx context.Context, orderID string) (string, string, error) {
+    stats := &models.FleetStats{
+        ByStatus: map[models.MachineStatus]int{},
+        ByType:   map[models.MachineType]int{},
+    }
+    rows, err := r.replica.Query(ctx, machinesQuery)
+    if err != nil {
+        return nil, fmt.Errorf("GetFleetStats failed: %w", err)
+    }
+    defer rows.Close()
+
+    var batterySum int64
+    for rows.Next() {
+        var (
+            typ     models.MachineType
+            status  models.MachineStatus
+            count   int
+            battery int64
+        )
+        if err := rows.Scan(&typ, &status, &count, &battery); err != nil {
+            return nil, fmt.Errorf("GetFleetStats Scan failed: %w", err)
+        }
+        stats.TotalMachines += count
+        stats.ByStatus[status] += count
+        stats.ByType[typ] += count
+        batterySum += battery
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("GetFleetStats rows failed: %w", err)
+    }
+    if stats.TotalMachines > 0 {
+        stats.AverageBatteryLevel = float64(batterySum) / float64(stats.TotalMachines)
+    }
+    stats.MachinesOffline = stats.ByStatus[models.StatusOffline]
+
+    if err := r.replica.QueryRow(ctx, ordersQuery).Scan(&stats.OrdersInTransit); err != nil {
+        return nil, fmt.Errorf("GetFleetStats orders failed: %w", err)
+    }
+    return stats, nil
+}
+
+// CreateMachine 插入 machines 表，同时写入 API Key 摘要，机器从注册起即可上报遥测。
+func (r *Repository) CreateMachine(ctx context.Context, m *models.Machine, keyHash string) error {
     const query = `
-        SELECT pickup_location, delivery_location
-        FROM orders
-        WHERE id = $1`
-    var pickup, dropoff string
-    if err := r.db.QueryRow(ctx, query, orderID).Scan(&pickup, &dropoff); err != nil {
-        return "", "", fmt.Errorf("GetOrderAddresses failed: %w", err)
+        INSERT INTO machines (type, status, current_location, battery_level, max_weight_kg, api_key_hash)
+        VALUES ($1, $2, ST_SetSRID(ST_MakePoint($3, $4), 4326), $5, $6, $7)
+        RETURNING id, version, created_at, updated_at`
+    err := r.conn(ctx).QueryRow(ctx, query,
+        m.Type, m.Status,
+        m.Longitude, m.Latitude,
+        m.BatteryLevel, m.MaxWeightKG, keyHash,
+    ).Scan(&m.ID, &m.Version, &m.CreatedAt, &m.UpdatedAt)
+    if err != nil {
+        return fmt.Errorf("CreateMachine failed: %w", err)
     }
-    return pickup, dropoff, nil
+    return nil
 }
 
-// SaveRoute 将计算出的路线数据持久化到 routes 表。
-// polyline: Google Maps Polyline 编码；distance_meters: 距离；duration_seconds: 时长。
-func (r *Repository) SaveRoute(ctx context.Context, route *models.Route) error {
+// DeleteMachine 软删除机器：只设置 deleted_at，不删除行，
+// 以免破坏历史订单中的 machine_id 引用。已删除的机器不会再参与分配。
+// 状态转为 MAINTENANCE、清空 API Key 摘要，并删除未完成的充电行程；
+// IN_TRANSIT 或 RETURNING 的机器不能退役（条件写在 UPDATE 中，避免与派单竞争）。
+func (r *Repository) DeleteMachine(ctx context.Context, id string) error {
     const query = `
-        INSERT INTO routes (order_id, polyline, distance_meters, duration_seconds)
-        VALUES ($1, $2, $3, $4)
-        RETURNING id, created_at`
-    return r.db.QueryRow(ctx, query,
-        route.OrderID, route.Polyline,
-        route.DistanceMeters, route.DurationSeconds,
-    ).Scan(&route.ID, &route.CreatedAt)
+        WITH trip AS (
+            DELETE FROM charge_trips WHERE machine_id = $1
+        )
+        UPDATE machines
+        SET status = 'MAINTENANCE',
+            api_key_hash = NULL,
+            version = version + 1,
+            deleted_at = now(),
+            updated_at = now()
+        WHERE id = $1 AND deleted_at IS NULL AND status NOT IN ('IN_TRANSIT', 'RETURNING')`
+    cmd, err := r.conn(ctx).Exec(ctx, query, id)
+    if err != nil {
+        return fmt.Errorf("DeleteMachine failed: %w", err)
+    }
+    if cmd.RowsAffected() == 0 {
+        // 区分机器不存在与配送中
+        var busy bool
+        if err := r.conn(ctx).QueryRow(ctx,
+            `SELECT EXISTS(SELECT 1 FROM machines WHERE id = $1 AND deleted_at IS NULL)`, id,
+        ).Scan(&busy); err != nil {
+            return fmt.Errorf("DeleteMachine failed: %w", err)
+        }
+        if busy {
+            return models.ErrMachineBusy
+        }
+        return models.ErrNotFound
+    }
+    return nil
 }
 
-// ===== Assignment 实现 =====
+// ===== Heartbeat 实现 =====
 
-// GetOrderDestination 查询订单的 delivery_location 字段，用于机器分配时获取目的地。
-func (r *Repository) GetOrderDestination(ctx context.Context, orderID string) (string, error) {
+// RecordHeartbeat 更新 last_heartbeat_at。OFFLINE 的机器仍有 IN_PROGRESS 订单时恢复为
+// IN_TRANSIT，否则恢复为 IDLE。只有状态变化时才递增版本号，
+// 以免频繁的心跳与派单、遥测的读改写产生版本冲突。
+func (r *Repository) RecordHeartbeat(ctx context.Context, machineID string) (bool, error) {
     const query = `
-        SELECT delivery_location
-        FROM orders
-        WHERE id = $1`
-    var dest string
-    if err := r.db.QueryRow(ctx, query, orderID).Scan(&dest); err != nil {
+        WITH old AS (
+            SELECT id, status FROM machines
+            WHERE id = $1 AND deleted_at IS NULL
+            FOR UPDATE
+        )
+        UPDATE machines m
+        SET last_heartbeat_at = now(),
+            status = CASE
+                WHEN old.status <> 'OFFLINE' THEN old.status
+                WHEN EXISTS (
+                    SELECT 1 FROM orders WHERE machine_id = $1 AND status = 'IN_PROGRESS'
+                ) THEN 'IN_TRANSIT'
+                ELSE 'IDLE'
+            END,
+            version = CASE WHEN old.status = 'OFFLINE' THEN m.version + 1 ELSE m.version END,
+            updated_at = CASE WHEN old.status = 'OFFLINE' THEN now() ELSE m.updated_at END
+        FROM old
+        WHERE m.id = old.id
+        RETURNING old.status = 'OFFLINE'`
+    var revived bool
+    if err := r.conn(ctx).QueryRow(ctx, query, machineID).Scan(&revived); err != nil {
         if err == pgx.ErrNoRows {
-            return "", models.ErrNotFound
+            return false, models.ErrNotFound
         }
-        return "", fmt.Errorf("GetOrderDestination failed: %w", err)
+        return false, fmt.Errorf("RecordHeartbeat failed: %w", err)
     }
-    return dest, nil
+    return revived, nil
 }
 
-// ListIdleMachines 查询 machines 表中所有 status = 'IDLE' 的机器，用于可用机器列表。
-func (r *Repository) ListIdleMachines(ctx context.Context) ([]*models.Machine, error) {
+// MarkStaleMachinesOffline 以 last_heartbeat_at（从未心跳时取 created_at）判断是否过期，
+// 在一条 UPDATE 中完成标记，多个实例同时运行也不会重复返回同一台机器。
+func (r *Repository) MarkStaleMachinesOffline(ctx context.Context, timeout time.Duration) ([]models.StaleMachine, error) {
     const query = `
-        SELECT id, type, status,
-               COALESCE(ST_Y(current_location::geometry), 0) AS lat,
-               COALESCE(ST_X(current_location::geometry), 0) AS lon,
-               battery_level, created_at, updated_at
-        FROM machines
-        WHERE status = 'IDLE'`
-    rows, err := r.db.Query(ctx, query)
+        WITH stale AS (
+            SELECT id, status FROM machines
+            WHERE deleted_at IS NULL
+              AND status NOT IN ('OFFLINE', 'MAINTENANCE')
+              AND COALESCE(last_heartbeat_at, created_at) < now() - make_interval(secs => $1)
+            FOR UPDATE SKIP LOCKED
+        )
+        UPDATE machines m
+        SET status = 'OFFLINE',
+            version = m.version + 1,
+            updated_at = now()
+        FROM stale
+        WHERE m.id = stale.id
+        RETURNING m.id, m.type, stale.status, m.last_heartbeat_at`
+    rows, err := r.conn(ctx).Query(ctx, query, timeout.Seconds())
     if err != nil {
-        return nil, fmt.Errorf("ListIdleMachines failed: %w", err)
+        return nil, fmt.Errorf("MarkStaleMachinesOffline failed: %w", err)
     }
     defer rows.Close()
 
-    var machines []*models.Machine
+    var machines []models.StaleMachine
     for rows.Next() {
-        m := &models.Machine{}
-        if err := rows.Scan(
-            &m.ID, &m.Type, &m.Status,
-            &m.Latitude, &m.Longitude,
-            &m.BatteryLevel, &m.CreatedAt, &m.UpdatedAt,
-        ); err != nil {
-            return nil, fmt.Errorf("ListIdleMachines Scan failed: %w", err)
+        var m models.StaleMachine
+        if err := rows.Scan(&m.ID, &m.Type, &m.PreviousStatus, &m.LastHeartbeatAt); err != nil {
+            return nil, fmt.Errorf("MarkStaleMachinesOffline Scan failed: %w", err)
         }
         machines = append(machines, m)
     }
     if err := rows.Err(); err != nil {
-        return nil, fmt.Errorf("ListIdleMachines rows failed: %w", err)
+        return nil, fmt.Errorf("MarkStaleMachinesOffline rows failed: %w", err)
     }
     return machines, nil
 }
 
-// AssignOrder 将机器分配给订单：更新 orders.machine_id, orders.status, 并设置 updated_at。
-func (r *Repository) AssignOrder(ctx context.Context, orderID, machineID string) error {
+// NotifyAdmins 向 notifications 表为每个 ADMIN 用户插入同一条消息。
+func (r *Repository) NotifyAdmins(ctx context.Context, message string) error {
     const query = `
-        UPDATE orders
-        SET machine_id = $2,
-            status = 'IN_PROGRESS',
-            updated_at = now()
-        WHERE id = $1`
-    cmd, err := r.db.Exec(ctx, query, orderID, machineID)
+        INSERT INTO notifications (user_id, message)
+        SELECT id, $1 FROM users WHERE role = 'ADMIN'`
+    if _, err := r.conn(ctx).Exec(ctx, query, message); err != nil {
+        return fmt.Errorf("NotifyAdmins failed: %w", err)
+    }
+    return nil
+}
+
+// ===== Telemetry History 实现 =====
+
+// SnapshotMachines 用一条 INSERT ... SELECT 写入整个车队的快照，不经过应用内存。
+func (r *Repository) SnapshotMachines(ctx context.Context) (int64, error) {
+    const query = `
+        INSERT INTO machine_telemetry (machine_id, location, battery_level, status)
+        SELECT id, current_location, battery_level, status
+        FROM machines
+        WHERE deleted_at IS NULL`
+    cmd, err := r.conn(ctx).Exec(ctx, query)
     if err != nil {
-        return fmt.Errorf("AssignOrder failed: %w", err)
+        return 0, fmt.Errorf("SnapshotMachines failed: %w", err)
     }
-    if cmd.RowsAffected() == 0 {
-        return models.ErrNotFound
+    return cmd.RowsAffected(), nil
+}
+
+// PruneMachineTelemetry 按 recorded_at 删除过期快照。
+func (r *Repository) PruneMachineTelemetry(ctx context.Context, before time.Time) (int64, error) {
+    const query = `DELETE FROM machine_telemetry WHERE recorded_at < $1`
+    cmd, err := r.conn(ctx).Exec(ctx, query, before)
+    if err != nil {
+        return 0, fmt.Errorf("PruneMachineTelemetry failed: %w", err)
     }
-    return nil
+    return cmd.RowsAffected(), nil
 }
 
-// UpdateMachineStatus 单独更新 machines.status 字段及更新时间，用于分配后快速切换状态。
-func (r *Repository) UpdateMachineStatus(ctx context.Context, machineID, status string) error {
+// ListMachineHistory 用 date_bin 把快照按 from 对齐分桶：每桶取平均电量，
+// 以及桶内最后一条快照的位置与状态（DISTINCT ON 按 recorded_at 倒序取第一条）。走只读副本。
+func (r *Repository) ListMachineHistory(ctx context.Context, machineID string, from, to time.Time, bucket time.Duration) ([]models.MachineHistoryPoint, error) {
+    const query = `
+        SELECT DISTINCT ON (bucket) bucket, lat, lon, battery, status
+        FROM (
+            SELECT date_bin(make_interval(secs => $4), recorded_at, $2) AS bucket,
+                   COALESCE(ST_Y(location::geometry), 0) AS lat,
+                   COALESCE(ST_X(location::geometry), 0) AS lon,
+                   avg(battery_level) OVER (PARTITION BY date_bin(make_interval(secs => $4), recorded_at, $2))::float8 AS battery,
+                   status, recorded_at
+            FROM machine_telemetry
+            WHERE machine_id = $1 AND recorded_at >= $2 AND recorded_at < $3
+        ) t
+        ORDER BY bucket, recorded_at DESC`
+    rows, err := r.replica.Query(ctx, query, machineID, from, to, bucket.Seconds())
+    if err != nil {
+        return nil, fmt.Errorf("ListMachineHistory failed: %w", err)
+    }
+    defer rows.Close()
+
+    var points []models.MachineHistoryPoint
+    for rows.Next() {
+        var p models.MachineHistoryPoint
+        if err := rows.Scan(&p.RecordedAt, &p.Latitude, &p.Longitude, &p.BatteryLevel, &p.Status); err != nil {
+            return nil, fmt.Errorf("ListMachineHistory Scan failed: %w", err)
+        }
+        points = append(points, p)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListMachineHistory rows failed: %w", err)
+    }
+    return points, nil
+}
+
+// ===== Reports 实现 =====
+
+// ListMachineUtilization 用 LEAD 取得每条快照到下一条快照的时长，截断到 to 与 maxGap 后按状态求和。走只读副本。
+func (r *Repository) ListMachineUtilization(ctx context.Context, from, to time.Time, maxGap time.Duration) ([]models.MachineUtilization, error) {
+    const query = `
+        WITH spans AS (
+            SELECT machine_id, status,
+                   LEAST(COALESCE(LEAD(recorded_at) OVER w, $2), recorded_at + make_interval(secs => $3), $2) - recorded_at AS span
+            FROM machine_telemetry
+            WHERE recorded_at >= $1 AND recorded_at < $2
+            WINDOW w AS (PARTITION BY machine_id ORDER BY recorded_at)
+        )
+        SELECT m.id, m.type,
+               COALESCE(EXTRACT(EPOCH FROM SUM(s.span) FILTER (WHERE s.status = 'IN_TRANSIT')), 0)::bigint,
+               COALESCE(EXTRACT(EPOCH FROM SUM(s.span) FILTER (WHERE s.status = 'IDLE')), 0)::bigint,
+               COALESCE(EXTRACT(EPOCH FROM SUM(s.span) FILTER (WHERE s.status = 'CHARGING')), 0)::bigint,
+               COALESCE(EXTRACT(EPOCH FROM SUM(s.span) FILTER (WHERE s.status IN ('MAINTENANCE', 'OFFLINE'))), 0)::bigint
+        FROM spans s
+        JOIN machines m ON m.id = s.machine_id
+        GROUP BY m.id, m.type
+        ORDER BY m.id`
+    rows, err := r.replica.Query(ctx, query, from, to, maxGap.Seconds())
+    if err != nil {
+        return nil, fmt.Errorf("ListMachineUtilization failed: %w", err)
+    }
+    defer rows.Close()
+
+    var out []models.MachineUtilization
+    for rows.Next() {
+        var u models.MachineUtilization
+        if err := rows.Scan(&u.MachineID, &u.Type,
+            &u.InTransitSeconds, &u.IdleSeconds, &u.ChargingSeconds, &u.OtherSeconds); err != nil {
+            return nil, fmt.Errorf("ListMachineUtilization Scan failed: %w", err)
+        }
+        out = append(out, u)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListMachineUtilization rows failed: %w", err)
+    }
+    return out, nil
+}
+
+// CountDeliveriesByDay 以 order.delivered 事件的时间为送达时间（走 idx_outbox_events_type_time），
+// 机器类型取订单当前分配的机器。走只读副本。
+func (r *Repository) CountDeliveriesByDay(ctx context.Context, from, to time.Time) ([]models.DailyDeliveries, error) {
+    const query = `
+        SELECT to_char(e.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day,
+               COUNT(*),
+               COUNT(*) FILTER (WHERE m.type = 'DRONE'),
+               COUNT(*) FILTER (WHERE m.type = 'ROBOT')
+        FROM outbox_events e
+        JOIN orders o ON o.id = e.aggregate_id
+        LEFT JOIN machines m ON m.id = o.machine_id
+        WHERE e.event_type = 'order.delivered' AND e.created_at >= $1 AND e.created_at < $2
+        GROUP BY day
+        ORDER BY day`
+    rows, err := r.replica.Query(ctx, query, from, to)
+    if err != nil {
+        return nil, fmt.Errorf("CountDeliveriesByDay failed: %w", err)
+    }
+    defer rows.Close()
+
+    var out []models.DailyDeliveries
+    for rows.Next() {
+        var d models.DailyDeliveries
+        if err := rows.Scan(&d.Date, &d.Deliveries, &d.ByDrone, &d.ByRobot); err != nil {
+            return nil, fmt.Errorf("CountDeliveriesByDay Scan failed: %w", err)
+        }
+        out = append(out, d)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("CountDeliveriesByDay rows failed: %w", err)
+    }
+    return out, nil
+}
+
+// SumRevenueByDay 汇总 payments 表中成功的记录，失败的尝试不计入。走只读副本。
+func (r *Repository) SumRevenueByDay(ctx context.Context, from, to time.Time) ([]models.DailyRevenue, error) {
+    const query = `
+        SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day,
+               COALESCE(SUM(amount) FILTER (WHERE kind = 'CHARGE'), 0),
+               COALESCE(SUM(amount) FILTER (WHERE kind = 'TIP'), 0),
+               COALESCE(SUM(amount) FILTER (WHERE kind = 'REFUND'), 0)
+        FROM payments
+        WHERE status = 'SUCCEEDED' AND created_at >= $1 AND created_at < $2
+        GROUP BY day
+        ORDER BY day`
+    rows, err := r.replica.Query(ctx, query, from, to)
+    if err != nil {
+        return nil, fmt.Errorf("SumRevenueByDay failed: %w", err)
+    }
+    defer rows.Close()
+
+    var out []models.DailyRevenue
+    for rows.Next() {
+        var d models.DailyRevenue
+        if err := rows.Scan(&d.Date, &d.Charged, &d.Tips, &d.Refunded); err != nil {
+            return nil, fmt.Errorf("SumRevenueByDay Scan failed: %w", err)
+        }
+        out = append(out, d)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("SumRevenueByDay rows failed: %w", err)
+    }
+    return out, nil
+}
+
+// SumDistanceByWeek 用 LAG 取得上一条快照的位置，geography 上的 ST_Distance 单位为米。
+// 跨周的一段计入后一条快照所在的周。走只读副本。
+func (r *Repository) SumDistanceByWeek(ctx context.Context, from, to time.Time) ([]models.WeeklyDistance, error) {
+    const query = `
+        WITH legs AS (
+            SELECT machine_id, recorded_at,
+                   ST_Distance(location, LAG(location) OVER w) AS meters
+            FROM machine_telemetry
+            WHERE recorded_at >= $1 AND recorded_at < $2 AND location IS NOT NULL
+            WINDOW w AS (PARTITION BY machine_id ORDER BY recorded_at)
+        )
+        SELECT to_char(date_trunc('week', l.recorded_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD') AS week,
+               m.id, m.type,
+               COALESCE(SUM(l.meters), 0) / 1000
+        FROM legs l
+        JOIN machines m ON m.id = l.machine_id
+        GROUP BY week, m.id, m.type
+        ORDER BY week, m.id`
+    rows, err := r.replica.Query(ctx, query, from, to)
+    if err != nil {
+        return nil, fmt.Errorf("SumDistanceByWeek failed: %w", err)
+    }
+    defer rows.Close()
+
+    var out []models.WeeklyDistance
+    for rows.Next() {
+        var w models.WeeklyDistance
+        if err := rows.Scan(&w.WeekStart, &w.MachineID, &w.Type, &w.DistanceKM); err != nil {
+            return nil, fmt.Errorf("SumDistanceByWeek Scan failed: %w", err)
+        }
+        out = append(out, w)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("SumDistanceByWeek rows failed: %w", err)
+    }
+    return out, nil
+}
+
+// ===== Machine Credentials 实现 =====
+
+// SetMachineKeyHash 写入新的 API Key 摘要，旧 Key 随即失效。
+func (r *Repository) SetMachineKeyHash(ctx context.Context, machineID, keyHash string) error {
     const query = `
         UPDATE machines
-        SET status = $2,
+        SET api_key_hash = $2,
             updated_at = now()
-        WHERE id = $1`
-    cmd, err := r.db.Exec(ctx, query, machineID, status)
+        WHERE id = $1 AND deleted_at IS NULL`
+    cmd, err := r.conn(ctx).Exec(ctx, query, machineID, keyHash)
     if err != nil {
-        return fmt.Errorf("UpdateMachineStatus failed: %w", err)
+        return fmt.Errorf("SetMachineKeyHash failed: %w", err)
     }
     if cmd.RowsAffected() == 0 {
         return models.ErrNotFound
@@ -256,52 +742,1267 @@ func (r *Repository) UpdateMachineStatus(ctx context.Context, machineID, status
     return nil
 }
 
-// ===== Tracking 实现 =====
+// FindMachineIDByKeyHash 通过唯一索引 idx_machines_api_key_hash 查找机器；
+// 已软删除的机器不能再上报。
+func (r *Repository) FindMachineIDByKeyHash(ctx context.Context, keyHash string) (string, error) {
+    const query = `
+        SELECT id
+        FROM machines
+        WHERE api_key_hash = $1 AND deleted_at IS NULL`
+    var id string
+    if err := r.conn(ctx).QueryRow(ctx, query, keyHash).Scan(&id); err != nil {
+        if err == pgx.ErrNoRows {
+            return "", models.ErrNotFound
+        }
+        return "", fmt.Errorf("FindMachineIDByKeyHash failed: %w", err)
+    }
+    return id, nil
+}
 
-// CreateTrackingEvent 在 tracking_events 表中插入一条新记录，保存机器、位置和时间戳。
-// location 字段使用 PostGIS 函数 ST_SetSRID(ST_MakePoint(lon, lat), 4326)。
-func (r *Repository) CreateTrackingEvent(ctx context.Context, event *models.TrackingEvent) error {
+// ===== Commands 实现 =====
+
+// commandColumns 是 machine_commands 的查询列，与 scanCommand 的顺序一致。
+const commandColumns = `id, machine_id, command, status, COALESCE(reason, ''), COALESCE(created_by::text, ''),
+               created_at, delivered_at, acked_at, expires_at`
+
+func scanCommand(row pgx.Row) (*models.MachineCommand, error) {
+    cmd := &models.MachineCommand{}
+    err := row.Scan(&cmd.ID, &cmd.MachineID, &cmd.Command, &cmd.Status, &cmd.Reason, &cmd.CreatedBy,
+        &cmd.CreatedAt, &cmd.DeliveredAt, &cmd.AckedAt, &cmd.ExpiresAt)
+    return cmd, err
+}
+
+func scanCommands(rows pgx.Rows, op string) ([]*models.MachineCommand, error) {
+    defer rows.Close()
+    var out []*models.MachineCommand
+    for rows.Next() {
+        cmd, err := scanCommand(rows)
+        if err != nil {
+            return nil, fmt.Errorf("%s Scan failed: %w", op, err)
+        }
+        out = append(out, cmd)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("%s rows failed: %w", op, err)
+    }
+    return out, nil
+}
+
+// CreateMachineCommand 以 INSERT ... SELECT 写入，机器不存在或已删除时不插入任何行。
+func (r *Repository) CreateMachineCommand(ctx context.Context, cmd *models.MachineCommand) error {
     const query = `
-        INSERT INTO tracking_events (order_id, machine_id, location)
-        VALUES ($1, $2, ST_SetSRID(ST_MakePoint($3, $4), 4326))
-        RETURNING id, created_at`
-    return r.db.QueryRow(ctx, query,
-        event.OrderID, event.MachineID,
-        event.Longitude, event.Latitude,
-    ).Scan(&event.ID, &event.CreatedAt)
+        INSERT INTO machine_commands (machine_id, command, created_by, expires_at)
+        SELECT id, $2, NULLIF($3, '')::uuid, $4
+        FROM machines
+        WHERE id = $1 AND deleted_at IS NULL
+        RETURNING id, status, created_at`
+    err := r.conn(ctx).QueryRow(ctx, query, cmd.MachineID, cmd.Command, cmd.CreatedBy, cmd.ExpiresAt).
+        Scan(&cmd.ID, &cmd.Status, &cmd.CreatedAt)
+    if err == pgx.ErrNoRows {
+        return models.ErrNotFound
+    }
+    if err != nil {
+        return fmt.Errorf("CreateMachineCommand failed: %w", err)
+    }
+    return nil
+}
+
+// ListMachineCommands 走 idx_machine_commands_machine。读主库，管理员发送命令后立即可见。
+func (r *Repository) ListMachineCommands(ctx context.Context, machineID string, limit int) ([]*models.MachineCommand, error) {
+    query := `
+        SELECT ` + commandColumns + `
+        FROM machine_commands
+        WHERE machine_id = $1
+        ORDER BY created_at DESC, id
+        LIMIT $2`
+    rows, err := r.conn(ctx).Query(ctx, query, machineID, limit)
+    if err != nil {
+        return nil, fmt.Errorf("ListMachineCommands failed: %w", err)
+    }
+    return scanCommands(rows, "ListMachineCommands")
+}
+
+// TakeMachineCommands 已送达但未确认的命令同样返回：机器可能在确认前重启，重复送达由机器按 ID 去重。
+// delivered_at 只记录首次送达。UPDATE ... RETURNING 不保证顺序，返回前按创建时间排序。
+func (r *Repository) TakeMachineCommands(ctx context.Context, machineID string) ([]*models.MachineCommand, error) {
+    query := `
+        UPDATE machine_commands
+        SET status = 'DELIVERED',
+            delivered_at = COALESCE(delivered_at, now())
+        WHERE machine_id = $1
+          AND status IN ('PENDING', 'DELIVERED')
+          AND expires_at > now()
+        RETURNING ` + commandColumns
+    rows, err := r.conn(ctx).Query(ctx, query, machineID)
+    if err != nil {
+        return nil, fmt.Errorf("TakeMachineCommands failed: %w", err)
+    }
+    cmds, err := scanCommands(rows, "TakeMachineCommands")
+    if err != nil {
+        return nil, err
+    }
+    sort.Slice(cmds, func(i, j int) bool { return cmds[i].CreatedAt.Before(cmds[j].CreatedAt) })
+    return cmds, nil
 }
 
-// ListTrackingEvents 按 created_at 升序查询指定订单的所有轨迹事件，
-// 并将经纬度解析为模型字段。
-func (r *Repository) ListTrackingEvents(ctx context.Context, orderID string, since time.Time) ([]*models.TrackingEvent, error) {
+// ListUndeliveredCommands 走 idx_machine_commands_open 部分索引。
+func (r *Repository) ListUndeliveredCommands(ctx context.Context) ([]*models.MachineCommand, error) {
+    query := `
+        SELECT ` + commandColumns + `
+        FROM machine_commands
+        WHERE status = 'PENDING' AND expires_at > now()
+        ORDER BY created_at, id`
+    rows, err := r.conn(ctx).Query(ctx, query)
+    if err != nil {
+        return nil, fmt.Errorf("ListUndeliveredCommands failed: %w", err)
+    }
+    return scanCommands(rows, "ListUndeliveredCommands")
+}
+
+// MarkCommandDelivered 只推进 PENDING 的命令，不会覆盖并发写入的确认结果。
+func (r *Repository) MarkCommandDelivered(ctx context.Context, commandID string) error {
     const query = `
-        SELECT id, order_id, machine_id,
-               COALESCE(ST_Y(location::geometry), 0) AS lat,
-               COALESCE(ST_X(location::geometry), 0) AS lon,
-               created_at
-        FROM tracking_events
-        WHERE order_id = $1 AND created_at > $2
-        ORDER BY created_at`
-    rows, err := r.db.Query(ctx, query, orderID, since)
+        UPDATE machine_commands
+        SET status = 'DELIVERED', delivered_at = COALESCE(delivered_at, now())
+        WHERE id = $1 AND status = 'PENDING'`
+    if _, err := r.conn(ctx).Exec(ctx, query, commandID); err != nil {
+        return fmt.Errorf("MarkCommandDelivered failed: %w", err)
+    }
+    return nil
+}
+
+// AckMachineCommand 接受过期命令的迟到确认（机器确实执行了命令，记录下来比丢弃更有用）；
+// 已确认或拒绝的命令保持原结果，返回当前记录。
+func (r *Repository) AckMachineCommand(ctx context.Context, machineID, commandID string, accepted bool, reason string) (*models.MachineCommand, error) {
+    query := `
+        UPDATE machine_commands
+        SET status = CASE WHEN $3 THEN 'ACKNOWLEDGED' ELSE 'REJECTED' END,
+            reason = NULLIF($4, ''),
+            delivered_at = COALESCE(delivered_at, now()),
+            acked_at = now()
+        WHERE id = $1 AND machine_id = $2
+          AND status IN ('PENDING', 'DELIVERED', 'EXPIRED')
+        RETURNING ` + commandColumns
+    cmd, err := scanCommand(r.conn(ctx).QueryRow(ctx, query, commandID, machineID, accepted, reason))
+    if err == nil {
+        return cmd, nil
+    }
+    if err != pgx.ErrNoRows {
+        return nil, fmt.Errorf("AckMachineCommand failed: %w", err)
+    }
+    // 区分重复确认与命令不存在
+    cmd, err = scanCommand(r.conn(ctx).QueryRow(ctx,
+        `SELECT `+commandColumns+` FROM machine_commands WHERE id = $1 AND machine_id = $2`, commandID, machineID))
+    if err == pgx.ErrNoRows {
+        return nil, models.ErrNotFound
+    }
     if err != nil {
-        return nil, fmt.Errorf("ListTrackingEvents failed: %w", err)
+        return nil, fmt.Errorf("AckMachineCommand failed: %w", err)
+    }
+    return cmd, nil
+}
+
+// ExpireMachineCommands 走 idx_machine_commands_open 部分索引。
+func (r *Repository) ExpireMachineCommands(ctx context.Context) (int64, error) {
+    const query = `
+        UPDATE machine_commands
+        SET status = 'EXPIRED'
+        WHERE status IN ('PENDING', 'DELIVERED') AND expires_at <= now()`
+    cmd, err := r.conn(ctx).Exec(ctx, query)
+    if err != nil {
+        return 0, fmt.Errorf("ExpireMachineCommands failed: %w", err)
+    }
+    return cmd.RowsAffected(), nil
+}
+
+// ===== Capacity 实现 =====
+
+// ListMachineCapacities 读取 machine_type_capacities 表，按机器类型排序。
+func (r *Repository) ListMachineCapacities(ctx context.Context) ([]models.MachineCapacity, error) {
+    const query = `
+        SELECT type, max_weight_kg, max_length_m, max_width_m, max_height_m
+        FROM machine_type_capacities
+        ORDER BY type`
+    rows, err := r.replica.Query(ctx, query)
+    if err != nil {
+        return nil, fmt.Errorf("ListMachineCapacities failed: %w", err)
     }
     defer rows.Close()
 
-    var events []*models.TrackingEvent
+    var caps []models.MachineCapacity
     for rows.Next() {
-        ev := &models.TrackingEvent{}
-        if err := rows.Scan(
-            &ev.ID, &ev.OrderID, &ev.MachineID,
-            &ev.Latitude, &ev.Longitude,
-            &ev.CreatedAt,
-        ); err != nil {
-            return nil, fmt.Errorf("ListTrackingEvents Scan failed: %w", err)
+        var c models.MachineCapacity
+        if err := rows.Scan(&c.Type, &c.MaxWeightKG, &c.MaxLengthM, &c.MaxWidthM, &c.MaxHeightM); err != nil {
+            return nil, fmt.Errorf("ListMachineCapacities Scan failed: %w", err)
         }
-        events = append(events, ev)
+        caps = append(caps, c)
     }
     if err := rows.Err(); err != nil {
-        return nil, fmt.Errorf("ListTrackingEvents rows failed: %w", err)
+        return nil, fmt.Errorf("ListMachineCapacities rows failed: %w", err)
     }
-    return events, nil
+    return caps, nil
+}
+
+// GetOrderPackage 读取订单的 item_weight_kg 与 item_*_cm 列。
+// 与订单模块一致，这些列保存的是 models.Dimensions 的原值（米）。
+func (r *Repository) GetOrderPackage(ctx context.Context, orderID string) (float64, models.Dimensions, error) {
+    const query = `
+        SELECT item_weight_kg, item_length_cm, item_width_cm, item_height_cm
+        FROM orders
+        WHERE id = $1`
+    var weight float64
+    var d models.Dimensions
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&weight, &d.Length, &d.Width, &d.Height); err != nil {
+        if err == pgx.ErrNoRows {
+            return 0, models.Dimensions{}, models.ErrNotFound
+        }
+        return 0, models.Dimensions{}, fmt.Errorf("GetOrderPackage failed: %w", err)
+    }
+    return weight, d, nil
+}
+
+// ===== Route 实现 =====
+
+// GetOrderAddresses 从 orders 表中获取取件(pickup_location)和投递(delivery_location)地址。
+// 常用于报价计算前的数据准备。
+func (r *Repository) GetOrderAddresses(ctx context.Context, orderID string) (string, string, error) {
+    const query = `
+        SELECT pickup_location, delivery_location
+        FROM orders
+        WHERE id = $1`
+    var pickup, dropoff string
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&pickup, &dropoff); err != nil {
+        if err == pgx.ErrNoRows {
+            return "", "", models.ErrNotFound
+        }
+        return "", "", fmt.Errorf("GetOrderAddresses failed: %w", err)
+    }
+    return pickup, dropoff, nil
+}
+
+// SaveRoute 在一条语句中插入 routes 与 route_legs（unnest 展开各段，seq 从 1 开始），
+// 二者要么都写入，要么都不写入。
+// polyline: Google Maps Polyline 编码；distance_meters: 距离；duration_seconds: 时长。
+func (r *Repository) SaveRoute(ctx context.Context, route *models.Route) error {
+    const query = `
+        WITH route AS (
+            INSERT INTO routes (order_id, polyline, distance_meters, duration_seconds)
+            VALUES ($1, $2, $3, $4)
+            RETURNING id, created_at
+        ), legs AS (
+            INSERT INTO route_legs (route_id, seq, polyline, distance_meters, duration_seconds)
+            SELECT route.id, l.seq, l.polyline, l.distance_meters, l.duration_seconds
+            FROM route, unnest($5::text[], $6::int[], $7::int[])
+                WITH ORDINALITY AS l(polyline, distance_meters, duration_seconds, seq)
+        )
+        SELECT id, created_at FROM route`
+    n := len(route.Legs)
+    polylines, dists, durations := make([]string, n), make([]int, n), make([]int, n)
+    for i, leg := range route.Legs {
+        polylines[i], dists[i], durations[i] = leg.Polyline, leg.DistanceMeters, leg.DurationSeconds
+    }
+    return r.conn(ctx).QueryRow(ctx, query,
+        route.OrderID, route.Polyline,
+        route.DistanceMeters, route.DurationSeconds,
+        polylines, dists, durations,
+    ).Scan(&route.ID, &route.CreatedAt)
+}
+
+// GetLatestRoute 查询订单最近一次保存的路线（ComputeRoute 可能被多次调用，以最新的为准）。
+func (r *Repository) GetLatestRoute(ctx context.Context, orderID string) (*models.Route, error) {
+    const query = `
+        SELECT id, order_id, polyline, distance_meters, duration_seconds, created_at
+        FROM routes
+        WHERE order_id = $1
+        ORDER BY created_at DESC
+        LIMIT 1`
+    route := &models.Route{}
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(
+        &route.ID, &route.OrderID, &route.Polyline,
+        &route.DistanceMeters, &route.DurationSeconds, &route.CreatedAt,
+    ); err != nil {
+        if err == pgx.ErrNoRows {
+            return nil, models.ErrNotFound
+        }
+        return nil, fmt.Errorf("GetLatestRoute failed: %w", err)
+    }
+
+    const legsQuery = `
+        SELECT polyline, distance_meters, duration_seconds
+        FROM route_legs
+        WHERE route_id = $1
+        ORDER BY seq`
+    rows, err := r.conn(ctx).Query(ctx, legsQuery, route.ID)
+    if err != nil {
+        return nil, fmt.Errorf("GetLatestRoute legs failed: %w", err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var leg models.RouteLeg
+        if err := rows.Scan(&leg.Polyline, &leg.DistanceMeters, &leg.DurationSeconds); err != nil {
+            return nil, fmt.Errorf("GetLatestRoute Scan failed: %w", err)
+        }
+        route.Legs = append(route.Legs, leg)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("GetLatestRoute rows failed: %w", err)
+    }
+    return route, nil
+}
+
+// ===== Assignment 实现 =====
+
+// GetOrderDestination 查询订单的 delivery_location 字段，用于机器分配时获取目的地。
+func (r *Repository) GetOrderDestination(ctx context.Context, orderID string) (string, error) {
+    const query = `
+        SELECT delivery_location
+        FROM orders
+        WHERE id = $1`
+    var dest string
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&dest); err != nil {
+        if err == pgx.ErrNoRows {
+            return "", models.ErrNotFound
+        }
+        return "", fmt.Errorf("GetOrderDestination failed: %w", err)
+    }
+    return dest, nil
+}
+
+// GetOrderMachineID 查询 orders.machine_id，用于校验上报轨迹的机器是否为该订单的执行机器。
+func (r *Repository) GetOrderMachineID(ctx context.Context, orderID string) (string, error) {
+    const query = `
+        SELECT COALESCE(machine_id::text, '')
+        FROM orders
+        WHERE id = $1`
+    var machineID string
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&machineID); err != nil {
+        if err == pgx.ErrNoRows {
+            return "", models.ErrNotFound
+        }
+        return "", fmt.Errorf("GetOrderMachineID failed: %w", err)
+    }
+    return machineID, nil
+}
+
+// GetOrderOwnerID 查询 orders.user_id，订单不存在时返回 models.ErrNotFound。
+func (r *Repository) GetOrderOwnerID(ctx context.Context, orderID string) (string, error) {
+    const query = `
+        SELECT user_id::text
+        FROM orders
+        WHERE id = $1`
+    var userID string
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&userID); err != nil {
+        if err == pgx.ErrNoRows {
+            return "", models.ErrNotFound
+        }
+        return "", fmt.Errorf("GetOrderOwnerID failed: %w", err)
+    }
+    return userID, nil
+}
+
+// GetOrderPoints 通过 orders.pickup_address_id / dropoff_address_id 关联 addresses 读取坐标。
+func (r *Repository) GetOrderPoints(ctx context.Context, orderID string) (*models.GeoPoint, *models.GeoPoint, error) {
+    const query = `
+        SELECT ST_Y(p.location::geometry), ST_X(p.location::geometry),
+               ST_Y(d.location::geometry), ST_X(d.location::geometry)
+        FROM orders o
+        JOIN addresses p ON p.id = o.pickup_address_id
+        JOIN addresses d ON d.id = o.dropoff_address_id
+        WHERE o.id = $1`
+    var pLat, pLon, dLat, dLon *float64
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&pLat, &pLon, &dLat, &dLon); err != nil {
+        if err == pgx.ErrNoRows {
+            return nil, nil, models.ErrNotFound
+        }
+        return nil, nil, fmt.Errorf("GetOrderPoints failed: %w", err)
+    }
+    return geoPoint(pLat, pLon), geoPoint(dLat, dLon), nil
+}
+
+// ListMachineOrders 按 created_at 排序：同一台机器的多笔订单先下单的先配送。
+func (r *Repository) ListMachineOrders(ctx context.Context, machineID string) ([]string, error) {
+    const query = `
+        SELECT id FROM orders
+        WHERE machine_id = $1 AND status = 'IN_PROGRESS'
+        ORDER BY created_at, id`
+    rows, err := r.conn(ctx).Query(ctx, query, machineID)
+    if err != nil {
+        return nil, fmt.Errorf("ListMachineOrders failed: %w", err)
+    }
+    defer rows.Close()
+
+    var ids []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return nil, fmt.Errorf("ListMachineOrders Scan failed: %w", err)
+        }
+        ids = append(ids, id)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListMachineOrders rows failed: %w", err)
+    }
+    return ids, nil
+}
+
+func geoPoint(lat, lon *float64) *models.GeoPoint {
+    if lat == nil || lon == nil {
+        return nil
+    }
+    return &models.GeoPoint{Latitude: *lat, Longitude: *lon}
+}
+
+// ListNearestIdleMachines 使用 <-> 距离排序，由 idx_machines_idle_location（GiST）
+// 按距离由近到远扫描，只读取前 limit 行，不必计算所有空闲机器的距离。
+// ORDER BY 只能是 <-> 表达式本身，追加其他排序键会让计划退化为全量排序。
+// 没有上报过位置的机器（current_location 为 NULL）排在最后。
+func (r *Repository) ListNearestIdleMachines(ctx context.Context, lon, lat float64, types []models.MachineType, zoneID string, limit int) ([]*models.Machine, error) {
+    const query = `
+        SELECT id, type, status,
+               COALESCE(ST_Y(current_location::geometry), 0) AS lat,
+               COALESCE(ST_X(current_location::geometry), 0) AS lon,
+               battery_level, max_weight_kg, zone_id, COALESCE(firmware_version, ''), version, created_at, updated_at
+        FROM machines
+        WHERE status = 'IDLE' AND deleted_at IS NULL
+          AND (cardinality($3::text[]) = 0 OR type::text = ANY($3::text[]))
+          AND ($5 = '' OR zone_id::text = $5)
+        ORDER BY current_location <-> ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography
+        LIMIT $4`
+    names := make([]string, len(types))
+    for i, t := range types {
+        names[i] = string(t)
+    }
+    rows, err := r.conn(ctx).Query(ctx, query, lon, lat, names, limit, zoneID)
+    if err != nil {
+        return nil, fmt.Errorf("ListNearestIdleMachines failed: %w", err)
+    }
+    defer rows.Close()
+
+    var machines []*models.Machine
+    for rows.Next() {
+        m := &models.Machine{}
+        if err := rows.Scan(
+            &m.ID, &m.Type, &m.Status,
+            &m.Latitude, &m.Longitude,
+            &m.BatteryLevel, &m.MaxWeightKG, &m.ZoneID, &m.FirmwareVersion, &m.Version, &m.CreatedAt, &m.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("ListNearestIdleMachines Scan failed: %w", err)
+        }
+        machines = append(machines, m)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListNearestIdleMachines rows failed: %w", err)
+    }
+    return machines, nil
+}
+
+// ListIdleMachines 查询 machines 表中所有 status = 'IDLE' 的机器，用于可用机器列表。
+func (r *Repository) ListIdleMachines(ctx context.Context) ([]*models.Machine, error) {
+    const query = `
+        SELECT id, type, status,
+               COALESCE(ST_Y(current_location::geometry), 0) AS lat,
+               COALESCE(ST_X(current_location::geometry), 0) AS lon,
+               battery_level, max_weight_kg, zone_id, COALESCE(firmware_version, ''), version, created_at, updated_at
+        FROM machines
+        WHERE status = 'IDLE' AND deleted_at IS NULL`
+    rows, err := r.conn(ctx).Query(ctx, query)
+    if err != nil {
+        return nil, fmt.Errorf("ListIdleMachines failed: %w", err)
+    }
+    defer rows.Close()
+
+    var machines []*models.Machine
+    for rows.Next() {
+        m := &models.Machine{}
+        if err := rows.Scan(
+            &m.ID, &m.Type, &m.Status,
+            &m.Latitude, &m.Longitude,
+            &m.BatteryLevel, &m.MaxWeightKG, &m.ZoneID, &m.FirmwareVersion, &m.Version, &m.CreatedAt, &m.UpdatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("ListIdleMachines Scan failed: %w", err)
+        }
+        machines = append(machines, m)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListIdleMachines rows failed: %w", err)
+    }
+    return machines, nil
+}
+
+// AssignOrder 将机器分配给订单：更新 orders.machine_id, orders.status, 并设置 updated_at，
+// 同时在 order_status_events 中记录这次状态变化。
+func (r *Repository) AssignOrder(ctx context.Context, orderID, machineID string) error {
+    const query = `
+        WITH prev AS (
+            SELECT id, status FROM orders WHERE id = $1 FOR UPDATE
+        ), upd AS (
+            UPDATE orders o
+            SET machine_id = $2,
+                status = 'IN_PROGRESS',
+                updated_at = now()
+            FROM prev
+            WHERE o.id = prev.id
+            RETURNING o.id, o.machine_id, prev.status AS from_status
+        )
+        INSERT INTO order_status_events (order_id, from_status, to_status, actor_type, reason)
+        SELECT id, from_status, 'IN_PROGRESS', 'SYSTEM', 'assigned to machine ' || machine_id::text
+        FROM upd`
+    cmd, err := r.conn(ctx).Exec(ctx, query, orderID, machineID)
+    if err != nil {
+        return fmt.Errorf("AssignOrder failed: %w", err)
+    }
+    if cmd.RowsAffected() == 0 {
+        return models.ErrNotFound
+    }
+    return nil
+}
+
+// UpdateMachineStatus 单独更新 machines.status 字段及更新时间，用于分配后快速切换状态。
+// 不校验版本（调用方已通过分配逻辑持有该机器），但会递增 version，
+// 使并发的 UpdateMachine 读改写检测到冲突。
+func (r *Repository) UpdateMachineStatus(ctx context.Context, machineID string, status models.MachineStatus) error {
+    const query = `
+        UPDATE machines
+        SET status = $2,
+            version = version + 1,
+            updated_at = now()
+        WHERE id = $1 AND deleted_at IS NULL`
+    cmd, err := r.conn(ctx).Exec(ctx, query, machineID, status)
+    if err != nil {
+        return fmt.Errorf("UpdateMachineStatus failed: %w", err)
+    }
+    if cmd.RowsAffected() == 0 {
+        return models.ErrNotFound
+    }
+    return nil
+}
+
+// ClaimMachine 原子地领取机器：
+//  1. SELECT ... FOR UPDATE SKIP LOCKED 锁定仍为 IDLE 的机器，取不到（已被分配或正被其他事务锁定）时返回 models.ErrMachineClaimed；
+//  2. 将机器置为 IN_TRANSIT 并递增 version；
+//  3. 将所有订单分配给该机器并记录状态变化，任一订单不存在时整个事务回滚。
+// ctx 中已有事务（例如订单模块的支付事务）时加入该事务，否则单独开启一个。
+func (r *Repository) ClaimMachine(ctx context.Context, machineID string, orderIDs ...string) error {
+    const lockQuery = `
+        SELECT id
+        FROM machines
+        WHERE id = $1 AND status = 'IDLE' AND deleted_at IS NULL
+        FOR UPDATE SKIP LOCKED`
+    const machineQuery = `
+        UPDATE machines
+        SET status = 'IN_TRANSIT',
+            version = version + 1,
+            updated_at = now()
+        WHERE id = $1`
+    const ordersQuery = `
+        WITH prev AS (
+            SELECT id, status FROM orders WHERE id = ANY($2::uuid[]) FOR UPDATE
+        ), upd AS (
+            UPDATE orders o
+            SET machine_id = $1,
+                status = 'IN_PROGRESS',
+                updated_at = now()
+            FROM prev
+            WHERE o.id = prev.id
+            RETURNING o.id, o.machine_id, prev.status AS from_status
+        )
+        INSERT INTO order_status_events (order_id, from_status, to_status, actor_type, reason)
+        SELECT id, from_status, 'IN_PROGRESS', 'SYSTEM', 'assigned to machine ' || machine_id::text
+        FROM upd`
+    return database.NewTxManager(r.db).WithinTx(ctx, func(ctx context.Context) error {
+        var id string
+        if err := r.conn(ctx).QueryRow(ctx, lockQuery, machineID).Scan(&id); err != nil {
+            if err == pgx.ErrNoRows {
+                return models.ErrMachineClaimed
+            }
+            return fmt.Errorf("ClaimMachine lock failed: %w", err)
+        }
+        if _, err := r.conn(ctx).Exec(ctx, machineQuery, machineID); err != nil {
+            return fmt.Errorf("ClaimMachine failed: %w", err)
+        }
+        cmd, err := r.conn(ctx).Exec(ctx, ordersQuery, machineID, orderIDs)
+        if err != nil {
+            return fmt.Errorf("ClaimMachine assign failed: %w", err)
+        }
+        if cmd.RowsAffected() != int64(len(orderIDs)) {
+            return models.ErrNotFound
+        }
+        return nil
+    })
+}
+
+// ReturnMachine 只让 IN_TRANSIT 的机器返航：充电、维护或离线的机器保持原状态，
+// 仍在配送其他订单（如多站点任务）的机器继续执行。递增 version，与 UpdateMachineStatus 一致。
+func (r *Repository) ReturnMachine(ctx context.Context, machineID string) (bool, error) {
+    const query = `
+        UPDATE machines
+        SET status = 'RETURNING',
+            version = version + 1,
+            updated_at = now()
+        WHERE id = $1 AND status = 'IN_TRANSIT' AND deleted_at IS NULL
+          AND NOT EXISTS (
+              SELECT 1 FROM orders WHERE machine_id = $1 AND status = 'IN_PROGRESS'
+          )`
+    cmd, err := r.conn(ctx).Exec(ctx, query, machineID)
+    if err != nil {
+        return false, fmt.Errorf("ReturnMachine failed: %w", err)
+    }
+    return cmd.RowsAffected() > 0, nil
+}
+
+// ===== Batching 实现 =====
+
+// GetOrderStatus 读取 orders.status。
+func (r *Repository) GetOrderStatus(ctx context.Context, orderID string) (models.OrderStatus, error) {
+    const query = `SELECT status FROM orders WHERE id = $1`
+    var status models.OrderStatus
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&status); err != nil {
+        if err == pgx.ErrNoRows {
+            return "", models.ErrNotFound
+        }
+        return "", fmt.Errorf("GetOrderStatus failed: %w", err)
+    }
+    return status, nil
+}
+
+// GetOrderDeliveryWindow 读取 orders.delivery_window_start/end；两者为 NULL 时返回 nil。
+func (r *Repository) GetOrderDeliveryWindow(ctx context.Context, orderID string) (*models.DeliveryWindow, error) {
+    const query = `SELECT delivery_window_start, delivery_window_end FROM orders WHERE id = $1`
+    var start, end *time.Time
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&start, &end); err != nil {
+        if err == pgx.ErrNoRows {
+            return nil, models.ErrNotFound
+        }
+        return nil, fmt.Errorf("GetOrderDeliveryWindow failed: %w", err)
+    }
+    if start == nil || end == nil {
+        return nil, nil
+    }
+    return &models.DeliveryWindow{Start: *start, End: *end}, nil
+}
+
+// ListMachineRecipients 读取机器正在配送订单的 recipient_name/recipient_phone/delivery_instructions；
+// 三者均为空的订单不返回。
+func (r *Repository) ListMachineRecipients(ctx context.Context, machineID string) (map[string]*models.Recipient, error) {
+    const query = `
+        SELECT id, recipient_name, recipient_phone, delivery_instructions FROM orders
+        WHERE machine_id = $1 AND status = 'IN_PROGRESS'
+          AND (recipient_name <> '' OR recipient_phone <> '' OR delivery_instructions <> '')`
+    rows, err := r.conn(ctx).Query(ctx, query, machineID)
+    if err != nil {
+        return nil, fmt.Errorf("ListMachineRecipients failed: %w", err)
+    }
+    defer rows.Close()
+
+    recipients := make(map[string]*models.Recipient)
+    for rows.Next() {
+        var id string
+        var rc models.Recipient
+        if err := rows.Scan(&id, &rc.Name, &rc.Phone, &rc.Instructions); err != nil {
+            return nil, fmt.Errorf("ListMachineRecipients Scan failed: %w", err)
+        }
+        recipients[id] = &rc
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListMachineRecipients rows failed: %w", err)
+    }
+    return recipients, nil
+}
+
+// CreateDeliveryRun 在一条语句中插入 delivery_runs 与 delivery_run_stops（unnest 展开站点数组），
+// 二者要么都写入，要么都不写入。
+func (r *Repository) CreateDeliveryRun(ctx context.Context, run *models.DeliveryRun) error {
+    const query = `
+        WITH run AS (
+            INSERT INTO delivery_runs (machine_id, distance_meters, duration_seconds)
+            VALUES ($1, $2, $3)
+            RETURNING id, created_at
+        ), stops AS (
+            INSERT INTO delivery_run_stops (run_id, seq, order_id, kind, location, distance_meters, eta)
+            SELECT run.id, s.seq, s.order_id, s.kind,
+                   ST_SetSRID(ST_MakePoint(s.lon, s.lat), 4326)::geography, s.distance_meters, s.eta
+            FROM run, unnest($4::int[], $5::uuid[], $6::text[], $7::float8[], $8::float8[], $9::int[], $10::timestamptz[])
+                AS s(seq, order_id, kind, lat, lon, distance_meters, eta)
+        )
+        SELECT id, created_at FROM run`
+    n := len(run.Stops)
+    seqs, orderIDs, kinds := make([]int, n), make([]string, n), make([]string, n)
+    lats, lons, dists, etas := make([]float64, n), make([]float64, n), make([]int, n), make([]time.Time, n)
+    for i, st := range run.Stops {
+        seqs[i], orderIDs[i], kinds[i] = st.Seq, st.OrderID, string(st.Kind)
+        lats[i], lons[i], dists[i], etas[i] = st.Location.Latitude, st.Location.Longitude, st.DistanceMeters, st.ETA
+    }
+    err := r.conn(ctx).QueryRow(ctx, query,
+        run.MachineID, run.DistanceMeters, run.DurationSeconds,
+        seqs, orderIDs, kinds, lats, lons, dists, etas,
+    ).Scan(&run.ID, &run.CreatedAt)
+    if err != nil {
+        return fmt.Errorf("CreateDeliveryRun failed: %w", err)
+    }
+    return nil
+}
+
+// GetDeliveryRun 读取配送任务与站点，并由站点推导每个订单的区段。
+func (r *Repository) GetDeliveryRun(ctx context.Context, runID string) (*models.DeliveryRun, error) {
+    const runQuery = `
+        SELECT id, machine_id, distance_meters, duration_seconds, created_at
+        FROM delivery_runs
+        WHERE id = $1`
+    run := &models.DeliveryRun{}
+    err := r.conn(ctx).QueryRow(ctx, runQuery, runID).Scan(
+        &run.ID, &run.MachineID, &run.DistanceMeters, &run.DurationSeconds, &run.CreatedAt,
+    )
+    if err != nil {
+        if err == pgx.ErrNoRows {
+            return nil, models.ErrNotFound
+        }
+        return nil, fmt.Errorf("GetDeliveryRun failed: %w", err)
+    }
+
+    const stopsQuery = `
+        SELECT seq, order_id, kind,
+               ST_Y(location::geometry), ST_X(location::geometry),
+               distance_meters, eta
+        FROM delivery_run_stops
+        WHERE run_id = $1
+        ORDER BY seq`
+    rows, err := r.conn(ctx).Query(ctx, stopsQuery, runID)
+    if err != nil {
+        return nil, fmt.Errorf("GetDeliveryRun stops failed: %w", err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var st models.RunStop
+        var kind string
+        if err := rows.Scan(
+            &st.Seq, &st.OrderID, &kind,
+            &st.Location.Latitude, &st.Location.Longitude,
+            &st.DistanceMeters, &st.ETA,
+        ); err != nil {
+            return nil, fmt.Errorf("GetDeliveryRun Scan failed: %w", err)
+        }
+        st.Kind = models.StopKind(kind)
+        run.Stops = append(run.Stops, st)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("GetDeliveryRun rows failed: %w", err)
+    }
+    run.BuildSegments()
+    return run, nil
+}
+
+// ===== Zones 实现 =====
+
+// ListZones 读取 zones 表，多边形以 GeoJSON 返回后解析为顶点列表。
+func (r *Repository) ListZones(ctx context.Context) ([]*models.Zone, error) {
+    const query = `
+        SELECT id, name, kind, ST_AsGeoJSON(area), created_at, updated_at
+        FROM zones
+        ORDER BY name, id`
+    rows, err := r.replica.Query(ctx, query)
+    if err != nil {
+        return nil, fmt.Errorf("ListZones failed: %w", err)
+    }
+    defer rows.Close()
+
+    var zones []*models.Zone
+    for rows.Next() {
+        z := &models.Zone{}
+        var kind, geoJSON string
+        if err := rows.Scan(&z.ID, &z.Name, &kind, &geoJSON, &z.CreatedAt, &z.UpdatedAt); err != nil {
+            return nil, fmt.Errorf("ListZones Scan failed: %w", err)
+        }
+        z.Kind = models.ZoneKind(kind)
+        if z.Polygon, err = polygonFromGeoJSON(geoJSON); err != nil {
+            return nil, fmt.Errorf("ListZones zone %s: %w", z.ID, err)
+        }
+        zones = append(zones, z)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListZones rows failed: %w", err)
+    }
+    return zones, nil
+}
+
+// CreateZone 插入 zones 表。数据库的 CHECK (ST_IsValid) 拒绝自相交等无效多边形。
+func (r *Repository) CreateZone(ctx context.Context, z *models.Zone) error {
+    const query = `
+        INSERT INTO zones (name, kind, area)
+        VALUES ($1, $2, ST_GeogFromText($3))
+        RETURNING id, created_at, updated_at`
+    err := r.conn(ctx).QueryRow(ctx, query, z.Name, string(z.Kind), polygonWKT(z.Polygon)).
+        Scan(&z.ID, &z.CreatedAt, &z.UpdatedAt)
+    if err != nil {
+        return zoneWriteError("CreateZone", err)
+    }
+    return nil
+}
+
+// UpdateZone 整体替换围栏并刷新 updated_at。
+func (r *Repository) UpdateZone(ctx context.Context, z *models.Zone) error {
+    const query = `
+        UPDATE zones
+        SET name = $2, kind = $3, area = ST_GeogFromText($4), updated_at = now()
+        WHERE id = $1
+        RETURNING created_at, updated_at`
+    err := r.conn(ctx).QueryRow(ctx, query, z.ID, z.Name, string(z.Kind), polygonWKT(z.Polygon)).
+        Scan(&z.CreatedAt, &z.UpdatedAt)
+    if err != nil {
+        if err == pgx.ErrNoRows {
+            return models.ErrNotFound
+        }
+        return zoneWriteError("UpdateZone", err)
+    }
+    return nil
+}
+
+// DeleteZone 物理删除围栏（围栏没有历史引用，不需要软删除）。
+func (r *Repository) DeleteZone(ctx context.Context, id string) error {
+    cmd, err := r.conn(ctx).Exec(ctx, `DELETE FROM zones WHERE id = $1`, id)
+    if err != nil {
+        return fmt.Errorf("DeleteZone failed: %w", err)
+    }
+    if cmd.RowsAffected() == 0 {
+        return models.ErrNotFound
+    }
+    return nil
+}
+
+// CrossesNoFlyZone 由 idx_zones_area（GiST）过滤候选禁飞区后再精确判断相交。
+func (r *Repository) CrossesNoFlyZone(ctx context.Context, path []models.GeoPoint) (bool, error) {
+    const query = `
+        SELECT EXISTS (
+            SELECT 1 FROM zones
+            WHERE kind = 'NO_FLY' AND ST_Intersects(area, ST_GeogFromText($1))
+        )`
+    var crosses bool
+    if err := r.replica.QueryRow(ctx, query, lineWKT(path)).Scan(&crosses); err != nil {
+        return false, fmt.Errorf("CrossesNoFlyZone failed: %w", err)
+    }
+    return crosses, nil
+}
+
+// LeavesServiceArea 在 geometry 上合并所有服务区后判断折线是否完全被覆盖。
+// 服务区通常只覆盖一座城市，平面近似的误差可以忽略。
+func (r *Repository) LeavesServiceArea(ctx context.Context, path []models.GeoPoint) (bool, error) {
+    const query = `
+        SELECT COUNT(*) > 0
+               AND NOT COALESCE(ST_CoveredBy(ST_GeomFromText($1, 4326), ST_Union(area::geometry)), false)
+        FROM zones
+        WHERE kind = 'SERVICE_AREA'`
+    var leaves bool
+    if err := r.replica.QueryRow(ctx, query, lineWKT(path)).Scan(&leaves); err != nil {
+        return false, fmt.Errorf("LeavesServiceArea failed: %w", err)
+    }
+    return leaves, nil
+}
+
+// FindOperationalZone 由 idx_zones_area（GiST）过滤候选运营区后精确判断点是否被覆盖。
+func (r *Repository) FindOperationalZone(ctx context.Context, lon, lat float64) (string, error) {
+    const query = `
+        SELECT id
+        FROM zones
+        WHERE kind = 'OPERATIONAL'
+          AND ST_Covers(area, ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography)
+        ORDER BY ST_Area(area), id
+        LIMIT 1`
+    var id string
+    err := r.conn(ctx).QueryRow(ctx, query, lon, lat).Scan(&id)
+    if err == pgx.ErrNoRows {
+        return "", nil
+    }
+    if err != nil {
+        return "", fmt.Errorf("FindOperationalZone failed: %w", err)
+    }
+    return id, nil
+}
+
+// SetMachineZone 更新 machines.zone_id，并递增版本号使并发的 UpdateMachine 重新读取。
+// 运营区检查与更新在同一条语句中完成：FOR SHARE 锁住运营区，
+// 检查之后它不会再被删除或改为其他类型。
+func (r *Repository) SetMachineZone(ctx context.Context, machineID string, zoneID *string) error {
+    const query = `
+        WITH z AS (
+            SELECT id FROM zones WHERE id = $2 AND kind = 'OPERATIONAL' FOR SHARE
+        ), m AS (
+            UPDATE machines
+            SET zone_id = $2,
+                version = version + 1,
+                updated_at = now()
+            WHERE id = $1 AND deleted_at IS NULL
+              AND ($2::uuid IS NULL OR EXISTS (SELECT 1 FROM z))
+            RETURNING id
+        )
+        SELECT $2::uuid IS NULL OR EXISTS (SELECT 1 FROM z), EXISTS (SELECT 1 FROM m)`
+    var zoneOK, updated bool
+    if err := r.conn(ctx).QueryRow(ctx, query, machineID, zoneID).Scan(&zoneOK, &updated); err != nil {
+        return fmt.Errorf("SetMachineZone failed: %w", err)
+    }
+    if !zoneOK {
+        return models.ErrInvalidZone
+    }
+    if !updated {
+        return models.ErrNotFound
+    }
+    return nil
+}
+
+// zoneWriteError 把 CHECK 约束失败（无效多边形）和 PostGIS 的几何解析错误映射为 models.ErrInvalidGeometry。
+func zoneWriteError(op string, err error) error {
+    var pgErr *pgconn.PgError
+    if errors.As(err, &pgErr) && (pgErr.Code == "23514" || pgErr.Code == "XX000") {
+        return fmt.Errorf("%s: %w: %s", op, models.ErrInvalidGeometry, pgErr.Message)
+    }
+    return fmt.Errorf("%s failed: %w", op, err)
+}
+
+// ===== Depots 实现 =====
+
+// ListDepots 读取 depots 表，坐标由 geography 拆成经纬度。
+func (r *Repository) ListDepots(ctx context.Context) ([]*models.Depot, error) {
+    const query = `
+        SELECT id, name, ST_Y(location::geometry), ST_X(location::geometry), created_at
+        FROM depots
+        ORDER BY name, id`
+    rows, err := r.replica.Query(ctx, query)
+    if err != nil {
+        return nil, fmt.Errorf("ListDepots failed: %w", err)
+    }
+    defer rows.Close()
+
+    var depots []*models.Depot
+    for rows.Next() {
+        d := &models.Depot{}
+        if err := rows.Scan(&d.ID, &d.Name, &d.Location.Latitude, &d.Location.Longitude, &d.CreatedAt); err != nil {
+            return nil, fmt.Errorf("ListDepots Scan failed: %w", err)
+        }
+        depots = append(depots, d)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListDepots rows failed: %w", err)
+    }
+    return depots, nil
+}
+
+// CreateDepot 插入 depots 表。
+func (r *Repository) CreateDepot(ctx context.Context, d *models.Depot) error {
+    const query = `
+        INSERT INTO depots (name, location)
+        VALUES ($1, ST_SetSRID(ST_MakePoint($2, $3), 4326)::geography)
+        RETURNING id, created_at`
+    err := r.conn(ctx).QueryRow(ctx, query, d.Name, d.Location.Longitude, d.Location.Latitude).
+        Scan(&d.ID, &d.CreatedAt)
+    if err != nil {
+        return fmt.Errorf("CreateDepot failed: %w", err)
+    }
+    return nil
+}
+
+// DeleteDepot 物理删除充电站；charge_trips 通过 ON DELETE CASCADE 一并删除。
+func (r *Repository) DeleteDepot(ctx context.Context, id string) error {
+    cmd, err := r.conn(ctx).Exec(ctx, `DELETE FROM depots WHERE id = $1`, id)
+    if err != nil {
+        return fmt.Errorf("DeleteDepot failed: %w", err)
+    }
+    if cmd.RowsAffected() == 0 {
+        return models.ErrNotFound
+    }
+    return nil
+}
+
+// FindNearestDepot 使用 <-> 距离排序，由 idx_depots_location（GiST）只读取最近的一行。
+func (r *Repository) FindNearestDepot(ctx context.Context, lon, lat float64) (*models.Depot, error) {
+    const query = `
+        SELECT id, name, ST_Y(location::geometry), ST_X(location::geometry), created_at
+        FROM depots
+        ORDER BY location <-> ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography
+        LIMIT 1`
+    d := &models.Depot{}
+    err := r.conn(ctx).QueryRow(ctx, query, lon, lat).
+        Scan(&d.ID, &d.Name, &d.Location.Latitude, &d.Location.Longitude, &d.CreatedAt)
+    if err != nil {
+        if err == pgx.ErrNoRows {
+            return nil, models.ErrNotFound
+        }
+        return nil, fmt.Errorf("FindNearestDepot failed: %w", err)
+    }
+    return d, nil
+}
+
+// SaveChargeTrip 按 machine_id upsert 充电行程，重新计时 started_at。
+func (r *Repository) SaveChargeTrip(ctx context.Context, trip *models.ChargeTrip) error {
+    const query = `
+        INSERT INTO charge_trips (machine_id, depot_id, distance_meters, eta)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (machine_id) DO UPDATE
+        SET depot_id = EXCLUDED.depot_id,
+            distance_meters = EXCLUDED.distance_meters,
+            eta = EXCLUDED.eta,
+            started_at = now()
+        RETURNING started_at`
+    err := r.conn(ctx).QueryRow(ctx, query, trip.MachineID, trip.DepotID, trip.DistanceMeters, trip.ETA).
+        Scan(&trip.StartedAt)
+    if err != nil {
+        return fmt.Errorf("SaveChargeTrip failed: %w", err)
+    }
+    return nil
+}
+
+// GetChargeTrip 查询 charge_trips 表中机器的充电行程。
+func (r *Repository) GetChargeTrip(ctx context.Context, machineID string) (*models.ChargeTrip, error) {
+    const query = `
+        SELECT machine_id, depot_id, distance_meters, eta, started_at
+        FROM charge_trips
+        WHERE machine_id = $1`
+    t := &models.ChargeTrip{}
+    err := r.conn(ctx).QueryRow(ctx, query, machineID).
+        Scan(&t.MachineID, &t.DepotID, &t.DistanceMeters, &t.ETA, &t.StartedAt)
+    if err != nil {
+        if err == pgx.ErrNoRows {
+            return nil, models.ErrNotFound
+        }
+        return nil, fmt.Errorf("GetChargeTrip failed: %w", err)
+    }
+    return t, nil
+}
+
+// DeleteChargeTrip 删除机器的充电行程（机器充满后调用）。
+func (r *Repository) DeleteChargeTrip(ctx context.Context, machineID string) error {
+    if _, err := r.conn(ctx).Exec(ctx, `DELETE FROM charge_trips WHERE machine_id = $1`, machineID); err != nil {
+        return fmt.Errorf("DeleteChargeTrip failed: %w", err)
+    }
+    return nil
+}
+
+// ===== Pricing 实现 =====
+
+// ListPricingRules 读取 pricing_rules 表。规则由缓存整体加载，读主库以免失效后读到副本上的旧规则。
+func (r *Repository) ListPricingRules(ctx context.Context) ([]*models.PricingRule, error) {
+    const query = `
+        SELECT id, machine_type, min_km, max_km, start_hour, end_hour,
+               base_fare, per_km, multiplier, created_at, updated_at
+        FROM pricing_rules
+        ORDER BY machine_type, min_km, start_hour NULLS FIRST, id`
+    rows, err := r.conn(ctx).Query(ctx, query)
+    if err != nil {
+        return nil, fmt.Errorf("ListPricingRules failed: %w", err)
+    }
+    defer rows.Close()
+
+    var rules []*models.PricingRule
+    for rows.Next() {
+        rule := &models.PricingRule{}
+        if err := rows.Scan(&rule.ID, &rule.MachineType, &rule.MinKM, &rule.MaxKM, &rule.StartHour, &rule.EndHour,
+            &rule.BaseFare, &rule.PerKM, &rule.Multiplier, &rule.CreatedAt, &rule.UpdatedAt); err != nil {
+            return nil, fmt.Errorf("ListPricingRules Scan failed: %w", err)
+        }
+        rules = append(rules, rule)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListPricingRules rows failed: %w", err)
+    }
+    return rules, nil
+}
+
+// CreatePricingRule 插入 pricing_rules 表。
+func (r *Repository) CreatePricingRule(ctx context.Context, rule *models.PricingRule) error {
+    const query = `
+        INSERT INTO pricing_rules (machine_type, min_km, max_km, start_hour, end_hour, base_fare, per_km, multiplier)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        RETURNING id, created_at, updated_at`
+    err := r.conn(ctx).QueryRow(ctx, query, rule.MachineType, rule.MinKM, rule.MaxKM, rule.StartHour, rule.EndHour,
+        rule.BaseFare, rule.PerKM, rule.Multiplier).Scan(&rule.ID, &rule.CreatedAt, &rule.UpdatedAt)
+    if err != nil {
+        return fmt.Errorf("CreatePricingRule failed: %w", err)
+    }
+    return nil
+}
+
+// UpdatePricingRule 整体替换规则并刷新 updated_at。
+func (r *Repository) UpdatePricingRule(ctx context.Context, rule *models.PricingRule) error {
+    const query = `
+        UPDATE pricing_rules
+        SET machine_type = $2, min_km = $3, max_km = $4, start_hour = $5, end_hour = $6,
+            base_fare = $7, per_km = $8, multiplier = $9, updated_at = now()
+        WHERE id = $1
+        RETURNING created_at, updated_at`
+    err := r.conn(ctx).QueryRow(ctx, query, rule.ID, rule.MachineType, rule.MinKM, rule.MaxKM, rule.StartHour, rule.EndHour,
+        rule.BaseFare, rule.PerKM, rule.Multiplier).Scan(&rule.CreatedAt, &rule.UpdatedAt)
+    if err != nil {
+        if err == pgx.ErrNoRows {
+            return models.ErrNotFound
+        }
+        return fmt.Errorf("UpdatePricingRule failed: %w", err)
+    }
+    return nil
+}
+
+// DeletePricingRule 物理删除规则（报价保存的是价格而非规则，没有历史引用）。
+func (r *Repository) DeletePricingRule(ctx context.Context, id string) error {
+    cmd, err := r.conn(ctx).Exec(ctx, `DELETE FROM pricing_rules WHERE id = $1`, id)
+    if err != nil {
+        return fmt.Errorf("DeletePricingRule failed: %w", err)
+    }
+    if cmd.RowsAffected() == 0 {
+        return models.ErrNotFound
+    }
+    return nil
+}
+
+// CountSurgeDemand 在副本上统计：机器按当前位置、订单按取件地址落在运营区多边形内计入，
+// 等待派单的订单指已支付（CONFIRMED）或正在排队重试派单（ASSIGNMENT_PENDING）的订单。
+func (r *Repository) CountSurgeDemand(ctx context.Context, zoneID string) (int, int, error) {
+    const query = `
+        WITH z AS (SELECT area FROM zones WHERE id = $1)
+        SELECT
+            (SELECT count(*) FROM machines m, z
+             WHERE m.status = 'IDLE' AND m.deleted_at IS NULL
+               AND ST_Covers(z.area, m.current_location)),
+            (SELECT count(*) FROM orders o
+             JOIN addresses a ON a.id = o.pickup_address_id, z
+             WHERE o.status IN ('CONFIRMED', 'ASSIGNMENT_PENDING')
+               AND ST_Covers(z.area, a.location))`
+    var idle, pending int
+    if err := r.replica.QueryRow(ctx, query, zoneID).Scan(&idle, &pending); err != nil {
+        return 0, 0, fmt.Errorf("CountSurgeDemand failed: %w", err)
+    }
+    return idle, pending, nil
+}
+
+// ===== Tracking 实现 =====
+
+// CreateTrackingEvent 在 tracking_events 表中插入一条新记录，保存机器、位置和时间戳。
+// location 字段使用 PostGIS 函数 ST_SetSRID(ST_MakePoint(lon, lat), 4326)。
+func (r *Repository) CreateTrackingEvent(ctx context.Context, event *models.TrackingEvent) error {
+    const query = `
+        INSERT INTO tracking_events (order_id, machine_id, location)
+        VALUES ($1, NULLIF($2, '')::uuid, ST_SetSRID(ST_MakePoint($3, $4), 4326))
+        RETURNING id, created_at`
+    return r.conn(ctx).QueryRow(ctx, query,
+        event.OrderID, event.MachineID,
+        event.Longitude, event.Latitude,
+    ).Scan(&event.ID, &event.CreatedAt)
+}
+
+// CreateTrackingEvents 用 pgx.Batch 把全部 INSERT 一次发送，在同一事务中执行。
+// created_at 使用机器记录的时间（离线缓存的点补传时仍按实际时间排序），而非写入时间。
+func (r *Repository) CreateTrackingEvents(ctx context.Context, events []*models.TrackingEvent) error {
+    const query = `
+        INSERT INTO tracking_events (order_id, machine_id, location, created_at)
+        VALUES ($1, NULLIF($2, '')::uuid, ST_SetSRID(ST_MakePoint($3, $4), 4326), $5)
+        RETURNING id`
+    return database.NewTxManager(r.db).WithinTx(ctx, func(ctx context.Context) error {
+        tx, _ := database.TxFromContext(ctx)
+        batch := &pgx.Batch{}
+        for _, ev := range events {
+            batch.Queue(query, ev.OrderID, ev.MachineID, ev.Longitude, ev.Latitude, ev.CreatedAt)
+        }
+        results := tx.SendBatch(ctx, batch)
+        for _, ev := range events {
+            if err := results.QueryRow().Scan(&ev.ID); err != nil {
+                results.Close()
+                return fmt.Errorf("CreateTrackingEvents failed: %w", err)
+            }
+        }
+        // 必须在提交前关闭，连接才能继续执行 COMMIT
+        if err := results.Close(); err != nil {
+            return fmt.Errorf("CreateTrackingEvents failed: %w", err)
+        }
+        return nil
+    })
+}
+
+// ListTrackingEvents 按 (created_at, id) 升序分页查询指定订单的轨迹事件，
+// 并将经纬度解析为模型字段。使用 keyset 分页（而非 OFFSET），
+// 长距离配送的数万条轨迹也只扫描所需的一页。
+func (r *Repository) ListTrackingEvents(ctx context.Context, orderID string, q models.TrackingQuery) ([]*models.TrackingEvent, error) {
+    const query = `
+        SELECT id, order_id, COALESCE(machine_id::text, ''),
+               COALESCE(ST_Y(location::geometry), 0) AS lat,
+               COALESCE(ST_X(location::geometry), 0) AS lon,
+               created_at
+        FROM tracking_events
+        WHERE order_id = $1 AND created_at > $2
+          AND ($3::timestamptz IS NULL OR (created_at, id) > ($3, $4::uuid))
+        ORDER BY created_at, id
+        LIMIT $5`
+    var afterTime *time.Time
+    var afterID *string
+    if q.After != nil {
+        afterTime, afterID = &q.After.CreatedAt, &q.After.ID
+    }
+    // 轨迹历史走只读副本；副本的少量复制延迟对轮询查询可以接受。
+    // 实时推送（q.Fresh）收到通知时事件刚提交，必须读主库。
+    db := r.replica
+    if q.Fresh {
+        db = r.db
+    }
+    rows, err := db.Query(ctx, query, orderID, q.Since, afterTime, afterID, q.Limit)
+    if err != nil {
+        return nil, fmt.Errorf("ListTrackingEvents failed: %w", err)
+    }
+    defer rows.Close()
+
+    var events []*models.TrackingEvent
+    for rows.Next() {
+        ev := &models.TrackingEvent{}
+        if err := rows.Scan(
+            &ev.ID, &ev.OrderID, &ev.MachineID,
+            &ev.Latitude, &ev.Longitude,
+            &ev.CreatedAt,
+        ); err != nil {
+            return nil, fmt.Errorf("ListTrackingEvents Scan failed: %w", err)
+        }
+        events = append(events, ev)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("ListTrackingEvents rows failed: %w", err)
+    }
+    return events, nil
+}
+
+// GetLatestTrackingEvent 查询订单最新的一条轨迹事件，用于估算到达时间。
+// 读主库：实时推送在收到新轨迹通知后立即调用，副本可能还没有这条事件。
+func (r *Repository) GetLatestTrackingEvent(ctx context.Context, orderID string) (*models.TrackingEvent, error) {
+    const query = `
+        SELECT id, order_id, COALESCE(machine_id::text, ''),
+               COALESCE(ST_Y(location::geometry), 0) AS lat,
+               COALESCE(ST_X(location::geometry), 0) AS lon,
+               created_at
+        FROM tracking_events
+        WHERE order_id = $1
+        ORDER BY created_at DESC, id DESC
+        LIMIT 1`
+    ev := &models.TrackingEvent{}
+    if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(
+        &ev.ID, &ev.OrderID, &ev.MachineID,
+        &ev.Latitude, &ev.Longitude,
+        &ev.CreatedAt,
+    ); err != nil {
+        if err == pgx.ErrNoRows {
+            return nil, models.ErrNotFound
+        }
+        return nil, fmt.Errorf("GetLatestTrackingEvent failed: %w", err)
+    }
+    return ev, nil
+}
+
+// MarkOrderArrived 条件更新订单状态：只有 IN_PROGRESS 的订单会变为 ARRIVED，
+// 重复上报到达、已确认送达或已取消的订单都不受影响。状态变化记为承运机器所为。
+func (r *Repository) MarkOrderArrived(ctx context.Context, orderID string) (bool, error) {
+    const query = `
+        WITH upd AS (
+            UPDATE orders
+            SET status = 'ARRIVED', updated_at = now()
+            WHERE id = $1 AND status = 'IN_PROGRESS'
+            RETURNING id, machine_id
+        )
+        INSERT INTO order_status_events (order_id, from_status, to_status, actor_type, actor_id, reason)
+        SELECT id, 'IN_PROGRESS', 'ARRIVED', 'MACHINE', machine_id, 'reached dropoff geofence'
+        FROM upd`
+    cmd, err := r.conn(ctx).Exec(ctx, query, orderID)
+    if err != nil {
+        return false, fmt.Errorf("MarkOrderArrived failed: %w", err)
+    }
+    return cmd.RowsAffected() == 1, nil
 }
@@ -2,193 +2,721 @@ package logistics
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"math"
 	"net/http"
-	"net/url"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
+	"dispatch-and-delivery/internal/database"
 	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/cache"
+	"dispatch-and-delivery/pkg/maps"
+	"dispatch-and-delivery/pkg/resilience"
+	"dispatch-and-delivery/pkg/weather"
 
 	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
 )
 
 // ServiceInterface 定义物流模块对 Handler 暴露的所有业务方法。
 // 与 Handler 一一对应，职责清晰。
 type ServiceInterface interface {
-	ListMachines(ctx context.Context) ([]*models.Machine, error)
+	ListMachines(ctx context.Context, includeDeleted bool) ([]*models.Machine, error)
+	GetFleetStats(ctx context.Context) (*models.FleetStats, error)
+	GetMachineHistory(ctx context.Context, machineID string, q models.MachineHistoryQuery) (*models.MachineHistory, error)
+	RegisterMachine(ctx context.Context, req models.RegisterMachineRequest) (*models.MachineRegistration, error)
+	DeleteMachine(ctx context.Context, machineID string) error
+	RotateMachineKey(ctx context.Context, machineID string) (string, error)
+	AuthenticateMachine(ctx context.Context, apiKey string) (string, error)
 	SetMachineStatus(ctx context.Context, machineID string, req models.MachineStatusUpdateRequest) error
+	IngestTelemetry(ctx context.Context, machineID string, t models.MachineTelemetry) error
+	Heartbeat(ctx context.Context, machineID string) error
+	GetMachineAssignments(ctx context.Context, machineID string) ([]models.MachineAssignment, error)
+	MarkOfflineMachines(ctx context.Context) error
+	SnapshotFleet(ctx context.Context) error
 	AssignOrder(ctx context.Context, orderID string) (*models.Machine, error)
+	ReleaseMachine(ctx context.Context, machineID string) error
+	RecallMachine(ctx context.Context, machineID string) error
+	BatchOrders(ctx context.Context, orderIDs []string) (*models.DeliveryRun, error)
+	GetDeliveryRun(ctx context.Context, runID string) (*models.DeliveryRun, error)
+	ListZones(ctx context.Context) ([]*models.Zone, error)
+	CreateZone(ctx context.Context, req models.ZoneRequest) (*models.Zone, error)
+	UpdateZone(ctx context.Context, zoneID string, req models.ZoneRequest) (*models.Zone, error)
+	DeleteZone(ctx context.Context, zoneID string) error
+	SetMachineZone(ctx context.Context, machineID string, req models.MachineZoneRequest) (*models.Machine, error)
+	SendMachineCommand(ctx context.Context, machineID, adminID string, req models.MachineCommandRequest) (*models.MachineCommand, error)
+	ListMachineCommands(ctx context.Context, machineID string) ([]*models.MachineCommand, error)
+	PollMachineCommands(ctx context.Context, machineID string) ([]*models.MachineCommand, error)
+	AckMachineCommand(ctx context.Context, machineID, commandID string, ack models.MachineCommandAck) (*models.MachineCommand, error)
+	SweepMachineCommands(ctx context.Context) error
+	GetUtilizationReport(ctx context.Context, q models.ReportQuery) (*models.UtilizationReport, error)
+	GetDeliveriesReport(ctx context.Context, q models.ReportQuery) (*models.DeliveriesReport, error)
+	GetDistanceReport(ctx context.Context, q models.ReportQuery) (*models.DistanceReport, error)
+	GetRevenueReport(ctx context.Context, q models.ReportQuery) (*models.RevenueReport, error)
+	ListDepots(ctx context.Context) ([]*models.Depot, error)
+	CreateDepot(ctx context.Context, req models.DepotRequest) (*models.Depot, error)
+	DeleteDepot(ctx context.Context, depotID string) error
+	ListPricingRules(ctx context.Context) ([]*models.PricingRule, error)
+	CreatePricingRule(ctx context.Context, req models.PricingRuleRequest) (*models.PricingRule, error)
+	UpdatePricingRule(ctx context.Context, ruleID string, req models.PricingRuleRequest) (*models.PricingRule, error)
+	DeletePricingRule(ctx context.Context, ruleID string) error
+	GetChargeTrip(ctx context.Context, machineID string) (*models.ChargeTrip, error)
+	ReturnToCharge(ctx context.Context) error
 	CalculateRouteOptions(ctx context.Context, req models.RouteRequest) ([]models.RouteOption, error)
-	ComputeRoute(ctx context.Context, orderID string) (*models.Route, error)
-	ReportTracking(ctx context.Context, orderID string, req models.TrackingEventRequest) error
-	GetTracking(ctx context.Context, orderID string, since time.Time) ([]*models.TrackingEvent, error)
+	ComputeRoute(ctx context.Context, orderID string, waypoints []models.Address) (*models.Route, error)
+	ReportTracking(ctx context.Context, orderID, machineID string, req models.TrackingEventRequest) error
+	ReportTrackingBatch(ctx context.Context, orderID, machineID string, points []models.TrackingPoint) error
+	GetTracking(ctx context.Context, orderID string, q models.TrackingQuery) ([]*models.TrackingEvent, *models.TrackingCursor, error)
+	AuthorizeTrackingViewer(ctx context.Context, orderID, userID, role string) error
+	WatchTracking(orderID string) (<-chan struct{}, func())
+	GetETA(ctx context.Context, orderID string) (*models.ETA, error)
 }
 
 // service 是 ServiceInterface 的实现，依赖 Repository。
 type service struct {
 	logisticRepo RepositoryInterface
-	httpClient   *http.Client
+	httpClient   *http.Client         // 默认 Google 路线服务使用的客户端，nil 表示共享客户端
 	apiKey       string
+	mapsBaseURL  string               // Directions API 地址，测试时可替换
+	routing      maps.RoutingProvider // 路线服务：Google、Mapbox 或自建 OSRM
+	routeBreaker *resilience.Executor // 路线服务的超时、重试与熔断
+	quoteCache   cache.Store          // 报价路线缓存，nil 表示不缓存
+	quoteTTL     time.Duration
+	tracking     *TrackingHub         // 新轨迹事件的实时推送信号
+	battery      BatteryPolicy        // 派单电量约束
+	charge       ChargePolicy         // 低电量自动回充
+	heartbeatTTL time.Duration        // 超过该时长没有心跳的机器标记为 OFFLINE
+	throttle     TrackingPolicy       // 按机器类型的轨迹节流，nil 表示不节流
+	arrival      float64              // 投递点地理围栏半径（米），0 表示不自动标记到达
+	weather      *weatherCheck        // 报价前的天气检查，nil 表示不检查
+	retention    time.Duration        // 机器遥测快照保留时长，0 表示不清理
+	surge        SurgePolicy          // 基于车队利用率的动态加价
+	taxRate      float64              // 报价税率（0.08 表示 8%），0 表示不含税
+	commands     CommandPublisher     // 命令推送通道，nil 表示机器只能轮询
+	commandTTL   time.Duration        // 命令的默认确认时限
+	txManager    database.Transactor  // 跨多个仓库调用的事务
 }
 
-const (
-	droneMaxWeightKG = 3.0
-	droneMaxDimM     = 0.5
-	robotMaxWeightKG = 10.0
-	robotMaxDimM     = 1.0
-)
+// Option 用于定制 NewService 构造的 service。
+type Option func(*service)
+
+// WithMapsBaseURL 替换默认 Google 路线服务的 Directions API 地址（例如指向 httptest 服务器或代理）。
+func WithMapsBaseURL(baseURL string) Option {
+	return func(s *service) { s.mapsBaseURL = baseURL }
+}
+
+// WithHTTPClient 替换默认 Google 路线服务使用的 HTTP 客户端。
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *service) { s.httpClient = c }
+}
+
+// WithTrackingHub 指定轨迹推送 Hub；多实例部署时应传入基于 CacheBus 的 Hub。
+// 未指定时使用仅在本进程内分发的 Hub。
+func WithTrackingHub(h *TrackingHub) Option {
+	return func(s *service) { s.tracking = h }
+}
+
+// WithBatteryPolicy 替换派单使用的耗电模型与安全余量。
+func WithBatteryPolicy(p BatteryPolicy) Option {
+	return func(s *service) { s.battery = p }
+}
+
+// WithChargePolicy 替换自动回充的电量阈值。
+func WithChargePolicy(p ChargePolicy) Option {
+	return func(s *service) { s.charge = p }
+}
+
+// WithRoutingProvider 替换路线服务（例如 Google 不覆盖的地区使用自建 OSRM）。
+// 未指定时使用以 NewService 的 apiKey 构造的 Google 路线服务。
+func WithRoutingProvider(p maps.RoutingProvider) Option {
+	return func(s *service) { s.routing = p }
+}
+
+// WithQuoteCache 缓存报价使用的路线 ttl 时长，减少地图 API 的调用次数与延迟。
+func WithQuoteCache(store cache.Store, ttl time.Duration) Option {
+	return func(s *service) {
+		s.quoteCache = store
+		s.quoteTTL = ttl
+	}
+}
+
+// WithHeartbeatTimeout 设置机器被标记为 OFFLINE 前允许的最长心跳间隔。
+func WithHeartbeatTimeout(d time.Duration) Option {
+	return func(s *service) { s.heartbeatTTL = d }
+}
+
+// WithTrackingPolicy 设置轨迹上报的节流规则；默认不节流。
+func WithTrackingPolicy(p TrackingPolicy) Option {
+	return func(s *service) { s.throttle = p }
+}
+
+// WithArrivalRadius 设置投递点地理围栏的半径（米）；0 表示关闭自动到达检测。
+func WithArrivalRadius(meters float64) Option {
+	return func(s *service) { s.arrival = meters }
+}
+
+// WithWeather 启用报价前的天气检查：按 limits 去掉或上浮风雨超限的机器类型报价。
+func WithWeather(p weather.Provider, limits WeatherPolicy) Option {
+	return func(s *service) { s.weather = newWeatherCheck(p, limits) }
+}
 
-// NewService 构造函数，注入仓库与 Google Maps API Key
-func NewService(logisticRepo RepositoryInterface, apiKey string) ServiceInterface {
-	return &service{
+// WithSurgePolicy 替换报价的动态加价策略；没有档位的 SurgePolicy{} 表示不加价。
+func WithSurgePolicy(p SurgePolicy) Option {
+	return func(s *service) { s.surge = p }
+}
+
+// WithTaxRate 设置报价的税率（0.08 表示 8%），税额计入报价与分项价格的 Tax。
+func WithTaxRate(rate float64) Option {
+	return func(s *service) { s.taxRate = rate }
+}
+
+// WithTxManager 设置跨多个仓库调用的事务管理器（例如领取机器人并保存配送任务）；
+// 默认不开启事务，依次执行各个调用。
+func WithTxManager(tx database.Transactor) Option {
+	return func(s *service) { s.txManager = tx }
+}
+
+// WithTelemetryRetention 设置机器遥测快照的保留时长；0 表示不清理。
+func WithTelemetryRetention(d time.Duration) Option {
+	return func(s *service) { s.retention = d }
+}
+
+// noTx 直接执行事务函数，用于没有配置事务管理器的 service
+type noTx struct{}
+
+func (noTx) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// NewService 构造函数，注入仓库与 Google Maps API Key（来自 config.GoogleMapsAPIKey）
+func NewService(logisticRepo RepositoryInterface, apiKey string, opts ...Option) ServiceInterface {
+	s := &service{
 		logisticRepo: logisticRepo,
-		httpClient:   &http.Client{Timeout: 5 * time.Second},
 		apiKey:       apiKey,
+		battery:      DefaultBatteryPolicy(),
+		charge:       DefaultChargePolicy(),
+		heartbeatTTL: DefaultHeartbeatTimeout,
+		arrival:      DefaultArrivalRadiusMeters,
+		retention:    DefaultTelemetryRetention,
+		surge:        DefaultSurgePolicy(),
+		commandTTL:   models.DefaultCommandTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	if s.routing == nil {
+		s.routing = maps.NewGoogle(s.apiKey, s.mapsBaseURL, s.httpClient)
+	}
+	s.routeBreaker = resilience.New(resilience.Policy{
+		Name:             s.routing.Name(),
+		Timeout:          3 * time.Second,
+		MaxAttempts:      3, // 路线查询是幂等的，可以安全重试（5xx、超时、限流）
+		BaseBackoff:      100 * time.Millisecond,
+		MaxBackoff:       time.Second,
+		FailureThreshold: 5,
+		OpenDuration:     30 * time.Second,
+	})
+	if s.tracking == nil {
+		s.tracking = NewTrackingHub(nil)
+	}
+	if s.txManager == nil {
+		s.txManager = noTx{}
+	}
+	return s
 }
 
 // ListMachines 直接代理到 repo.ListMachines
-func (s *service) ListMachines(ctx context.Context) ([]*models.Machine, error) {
-	return s.logisticRepo.ListMachines(ctx)
+func (s *service) ListMachines(ctx context.Context, includeDeleted bool) ([]*models.Machine, error) {
+	return s.logisticRepo.ListMachines(ctx, includeDeleted)
+}
+
+// GetFleetStats 直接代理到 repo.GetFleetStats：统计由数据库聚合，不经过车队快照。
+func (s *service) GetFleetStats(ctx context.Context) (*models.FleetStats, error) {
+	return s.logisticRepo.GetFleetStats(ctx)
 }
 
-// SetMachineStatus 先查询旧记录，再更新状态与位置，保持电量不变
+// RegisterMachine 注册新机器并签发 API Key（明文仅在返回值中出现一次）。
+// 电量缺省为 100；单机载重上限不能超过其类型的上限。电量低于回充阈值的机器直接进入 CHARGING。
+func (s *service) RegisterMachine(ctx context.Context, req models.RegisterMachineRequest) (*models.MachineRegistration, error) {
+	if req.MaxWeightKG != nil {
+		caps, err := s.logisticRepo.ListMachineCapacities(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range caps {
+			if c.Type == req.Type && *req.MaxWeightKG > c.MaxWeightKG {
+				return nil, fmt.Errorf("%w: %s carries at most %.1f kg", models.ErrInvalidMachineCapacity, c.Type, c.MaxWeightKG)
+			}
+		}
+	}
+	m := &models.Machine{
+		Type:         req.Type,
+		Status:       models.StatusIdle,
+		Latitude:     req.Location.Latitude,
+		Longitude:    req.Location.Longitude,
+		BatteryLevel: 100,
+		MaxWeightKG:  req.MaxWeightKG,
+	}
+	if req.BatteryLevel != nil {
+		m.BatteryLevel = *req.BatteryLevel
+	}
+	m.Status = s.charge.next(m)
+
+	apiKey, err := newMachineKey()
+	if err != nil {
+		return nil, fmt.Errorf("RegisterMachine: %w", err)
+	}
+	if err := s.logisticRepo.CreateMachine(ctx, m, hashMachineKey(apiKey)); err != nil {
+		return nil, err
+	}
+	if err := s.chargeTransition(ctx, m, models.StatusIdle); err != nil {
+		return nil, fmt.Errorf("RegisterMachine: %w", err)
+	}
+	return &models.MachineRegistration{Machine: m, APIKey: apiKey}, nil
+}
+
+// DeleteMachine 退役机器（软删除并吊销 API Key），直接代理到 repo.DeleteMachine；
+// 配送中的机器返回 models.ErrMachineBusy。
+func (s *service) DeleteMachine(ctx context.Context, machineID string) error {
+	return s.logisticRepo.DeleteMachine(ctx, machineID)
+}
+
+// machineKeyPrefix 便于在日志和密钥扫描中识别机器 API Key
+const machineKeyPrefix = "mk_"
+
+// hashMachineKey 返回 API Key 的 SHA-256 十六进制摘要；数据库只保存摘要。
+// Key 本身是 256 位随机数，无需加盐或慢哈希。
+func hashMachineKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// newMachineKey 生成新的机器 API Key：前缀加 256 位随机数。
+func newMachineKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return machineKeyPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// RotateMachineKey 为机器生成新的 API Key 并返回明文（仅此一次），旧 Key 立即失效。
+func (s *service) RotateMachineKey(ctx context.Context, machineID string) (string, error) {
+	apiKey, err := newMachineKey()
+	if err != nil {
+		return "", fmt.Errorf("RotateMachineKey: %w", err)
+	}
+	if err := s.logisticRepo.SetMachineKeyHash(ctx, machineID, hashMachineKey(apiKey)); err != nil {
+		return "", err
+	}
+	return apiKey, nil
+}
+
+// AuthenticateMachine 校验机器 API Key，返回对应的机器 ID。
+// Key 无效或机器已删除时返回 models.ErrInvalidCredentials。
+func (s *service) AuthenticateMachine(ctx context.Context, apiKey string) (string, error) {
+	if apiKey == "" {
+		return "", models.ErrInvalidCredentials
+	}
+	machineID, err := s.logisticRepo.FindMachineIDByKeyHash(ctx, hashMachineKey(apiKey))
+	if errors.Is(err, models.ErrNotFound) {
+		return "", models.ErrInvalidCredentials
+	}
+	return machineID, err
+}
+
+// machineUpdateAttempts 是机器读改写遇到版本冲突时的最大尝试次数
+const machineUpdateAttempts = 3
+
+// SetMachineStatus 先查询旧记录，再更新状态与位置（以及上报的固件版本），保持电量不变。
+// 与心跳、派单并发写入时按版本号检测冲突，重新读取后重试，避免覆盖他人的更新。
 func (s *service) SetMachineStatus(ctx context.Context, machineID string, req models.MachineStatusUpdateRequest) error {
-	m, err := s.logisticRepo.FindMachineByID(ctx, machineID)
+	return s.updateMachine(ctx, machineID, func(m *models.Machine) {
+		m.Status = req.Status
+		m.Latitude = req.Latitude
+		m.Longitude = req.Longitude
+		if req.FirmwareVersion != "" {
+			m.FirmwareVersion = req.FirmwareVersion
+		}
+		// BatteryLevel 保持原值
+	})
+}
+
+// IngestTelemetry 处理机器经 MQTT 上报的遥测：更新机器位置（以及可选的电量、状态与固件版本），
+// 并应用回充策略（ChargePolicy；机器自己上报 CHARGING 时不会被提前恢复为 IDLE）。
+// 携带 order_id 时同时记录轨迹事件（与 HTTP 上报相同，要求机器已分配给该订单）。
+func (s *service) IngestTelemetry(ctx context.Context, machineID string, t models.MachineTelemetry) error {
+	if err := t.Validate(); err != nil {
+		return fmt.Errorf("IngestTelemetry: %w", err)
+	}
+	// 遥测同样说明机器在线
+	if err := s.Heartbeat(ctx, machineID); err != nil {
+		return fmt.Errorf("IngestTelemetry: %w", err)
+	}
+	var from models.MachineStatus
+	var updated *models.Machine
+	err := s.updateMachine(ctx, machineID, func(m *models.Machine) {
+		from = m.Status
+		m.Latitude = t.Latitude
+		m.Longitude = t.Longitude
+		if t.BatteryLevel != nil {
+			m.BatteryLevel = *t.BatteryLevel
+		}
+		if t.Status != "" {
+			m.Status = t.Status
+		}
+		if t.FirmwareVersion != "" {
+			m.FirmwareVersion = t.FirmwareVersion
+		}
+		if t.Status != models.StatusCharging {
+			m.Status = s.charge.next(m)
+		}
+		updated = m
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("IngestTelemetry: %w", err)
+	}
+	if err := s.chargeTransition(ctx, updated, from); err != nil {
+		return fmt.Errorf("IngestTelemetry: %w", err)
 	}
-	m.Status = req.Status
-	m.Latitude = req.Latitude
-	m.Longitude = req.Longitude
-	// BatteryLevel 保持原值
-	return s.logisticRepo.UpdateMachine(ctx, m)
+	if t.OrderID == "" {
+		return nil
+	}
+	return s.ReportTracking(ctx, t.OrderID, machineID, models.TrackingEventRequest{
+		Latitude:  t.Latitude,
+		Longitude: t.Longitude,
+	})
+}
+
+// updateMachine 读取机器、应用 mutate 后按版本号写回；版本冲突时重新读取并重试。
+func (s *service) updateMachine(ctx context.Context, machineID string, mutate func(m *models.Machine)) error {
+	var err error
+	for attempt := 0; attempt < machineUpdateAttempts; attempt++ {
+		var m *models.Machine
+		m, err = s.logisticRepo.FindMachineByID(ctx, machineID)
+		if err != nil {
+			return err
+		}
+		mutate(m)
+		err = s.logisticRepo.UpdateMachine(ctx, m)
+		if !errors.Is(err, models.ErrMachineVersionConflict) {
+			return err
+		}
+	}
+	return err
 }
 
-// AssignOrder 为订单分配一台空闲机器并更新数据库
+// AssignOrder 为订单分配一台空闲机器并更新数据库。
+// 只考虑能承载该订单包裹的机器类型（machine_type_capacities），并遵守单机载重上限。
+// 取件地址有坐标时选择距离最近、且电量足以完成整趟任务的空闲机器（PostGIS KNN + BatteryPolicy），
+// 取件点位于运营区内时只考虑属于该区的机器；
+// 否则退回到按 ID 排序取第一台，保证选择具有确定性。
+// 机器通过 ClaimMachine 原子领取：并发的分配请求选中同一台机器时，后到者改用下一台候选机器。
 func (s *service) AssignOrder(ctx context.Context, orderID string) (*models.Machine, error) {
-    machines, err := s.logisticRepo.ListIdleMachines(ctx)
+    candidates, err := s.pickMachines(ctx, orderID)
     if err != nil {
         return nil, err
     }
-    if len(machines) == 0 {
-        return nil, fmt.Errorf("no idle machines available")
+    for _, m := range candidates {
+        err := s.logisticRepo.ClaimMachine(ctx, m.ID, orderID)
+        if errors.Is(err, models.ErrMachineClaimed) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        m.Status = models.StatusInTransit
+        return m, nil
     }
+    return nil, fmt.Errorf("%w: all %d candidate machines were claimed by other orders", models.ErrNoMachineAvailable, len(candidates))
+}
 
-    // 确保选择具有确定性：按 ID 升序排序
-    sort.Slice(machines, func(i, j int) bool {
-        return machines[i].ID < machines[j].ID
-    })
+// nearestCandidates 是按距离取出、再逐一检查电量的空闲机器数量
+const nearestCandidates = 20
 
-    m := machines[0]
-    if err := s.logisticRepo.AssignOrder(ctx, orderID, m.ID); err != nil {
+// pickMachines 按优先顺序返回可以承接订单的机器，见 AssignOrder。
+func (s *service) pickMachines(ctx context.Context, orderID string) ([]*models.Machine, error) {
+    weightKG, dims, err := s.logisticRepo.GetOrderPackage(ctx, orderID)
+    if err != nil {
         return nil, err
     }
-    if err := s.logisticRepo.UpdateMachineStatus(ctx, m.ID, models.StatusInTransit); err != nil {
+    types, err := s.eligibleTypes(ctx, weightKG, dims)
+    if err != nil {
         return nil, err
     }
-    m.Status = models.StatusInTransit
-    return m, nil
-}
-
-
-// CalculateRouteOptions 调用地图 API 并计算两种报价，同时保存对应路线
-func (s *service) CalculateRouteOptions(ctx context.Context, req models.RouteRequest) ([]models.RouteOption, error) {
-    // 调用 Google Maps
-    pickup := req.PickupLocation.StreetAddress
-    dropoff := req.DeliveryLocation.StreetAddress
-    dMeters, dSeconds, polyline, err := s.callGoogleMaps(ctx, pickup, dropoff)
+    pickup, dropoff, err := s.logisticRepo.GetOrderPoints(ctx, orderID)
     if err != nil {
-        return nil, fmt.Errorf("CalculateRouteOptions: maps API: %w", err)
+        return nil, err
     }
-    // 高峰判断
-    peak := isPeakHour(req.RequestedTime)
-
-    if req.WeightKG > robotMaxWeightKG ||
-        req.Dimensions.Length > robotMaxDimM ||
-        req.Dimensions.Width > robotMaxDimM ||
-        req.Dimensions.Height > robotMaxDimM {
-        return nil, models.ErrPackageTooLarge
+    if pickup != nil {
+        // 取件点在运营区内时只考虑该区的机器
+        zoneID, err := s.logisticRepo.FindOperationalZone(ctx, pickup.Longitude, pickup.Latitude)
+        if err != nil {
+            return nil, err
+        }
+        candidates, err := s.logisticRepo.ListNearestIdleMachines(ctx, pickup.Longitude, pickup.Latitude, types, zoneID, nearestCandidates)
+        if err != nil {
+            return nil, err
+        }
+        if len(candidates) == 0 {
+            return nil, models.ErrNoMachineAvailable
+        }
+        // 投递地址没有坐标时只能计入往返取件点的行程
+        if dropoff == nil {
+            dropoff = pickup
+        }
+        // 由近到远保留载重与电量都足够完成整趟任务的机器
+        var machines []*models.Machine
+        for _, m := range candidates {
+            if m.Carries(weightKG) && s.battery.CanDeliver(m, *pickup, *dropoff) {
+                machines = append(machines, m)
+            }
+        }
+        if len(machines) == 0 {
+            return nil, fmt.Errorf("%w: none of the %d nearest idle machines can carry the package with enough battery", models.ErrNoMachineAvailable, len(candidates))
+        }
+        return machines, nil
     }
 
-    useDrone := req.WeightKG <= droneMaxWeightKG &&
-        req.Dimensions.Length <= droneMaxDimM &&
-        req.Dimensions.Width <= droneMaxDimM &&
-        req.Dimensions.Height <= droneMaxDimM
-
-    // “最快” 使用 DRONE
-    fastest := models.RouteOption{
-        ID:               uuid.NewString(),
-        PickupLocation:   req.PickupLocation,
-        DeliveryLocation: req.DeliveryLocation,
-        Polyline:         polyline,
-        DistanceMeters:   dMeters,
-        DurationSeconds:  dSeconds,
-        Strategy:         models.FastestStrategy,
-        EstimatedCost:    computeCost(dMeters, dSeconds, models.MachineTypeDrone, peak),
-        MachineType:      models.MachineTypeDrone,
+    // 取件地址没有坐标：无法估算行程，也就无法做电量约束
+    idle, err := s.logisticRepo.ListIdleMachines(ctx)
+    if err != nil {
+        return nil, err
     }
-
-    // “最便宜” 使用 ROBOT
-    cheapest := models.RouteOption{
-        ID:               uuid.NewString(),
-        PickupLocation:   req.PickupLocation,
-        DeliveryLocation: req.DeliveryLocation,
-        Polyline:         polyline,
-        DistanceMeters:   dMeters,
-        DurationSeconds:  int(math.Ceil(float64(dSeconds) * 2)), // 假设地面速度为飞行一半
-        Strategy:         models.CheapestStrategy,
-        EstimatedCost:    computeCost(dMeters, dSeconds, models.MachineTypeRobot, peak),
-        MachineType:      models.MachineTypeRobot,
+    var machines []*models.Machine
+    for _, m := range idle {
+        if slices.Contains(types, m.Type) && m.Carries(weightKG) {
+            machines = append(machines, m)
+        }
     }
-
-    options := []models.RouteOption{}
-
-    if useDrone {
-        options = append(options, fastest)
-        // 保存 fastest 路线
-        _ = s.logisticRepo.SaveRoute(ctx, &models.Route{
-            OrderID:         "", // 这里因为报价阶段不确定 orderID，可设为空或 req 内有 orderID 再填
-            Polyline:        fastest.Polyline,
-            DistanceMeters:  fastest.DistanceMeters,
-            DurationSeconds: fastest.DurationSeconds,
-        })
+    if len(machines) == 0 {
+        return nil, models.ErrNoMachineAvailable
     }
-
-    options = append(options, cheapest)
-    // 保存 cheapest 路线
-    _ = s.logisticRepo.SaveRoute(ctx, &models.Route{
-        OrderID:         "",
-        Polyline:        cheapest.Polyline,
-        DistanceMeters:  cheapest.DistanceMeters,
-        DurationSeconds: cheapest.DurationSeconds,
+    sort.Slice(machines, func(i, j int) bool {
+        return machines[i].ID < machines[j].ID
     })
+    return machines, nil
+}
+
+// eligibleTypes 返回能承载该包裹的机器类型；没有任何类型能承载时返回 models.ErrPackageTooLarge。
+func (s *service) eligibleTypes(ctx context.Context, weightKG float64, dims models.Dimensions) ([]models.MachineType, error) {
+	caps, err := s.logisticRepo.ListMachineCapacities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var types []models.MachineType
+	for _, c := range caps {
+		if c.Fits(weightKG, dims) {
+			types = append(types, c.Type)
+		}
+	}
+	if len(types) == 0 {
+		return nil, models.ErrPackageTooLarge
+	}
+	return types, nil
+}
+
+
+// quoteParallelism 限制单次报价中并发计算/保存的选项数
+const quoteParallelism = 4
+
+// quoteSpec 描述一种机器类型的报价选项
+type quoteSpec struct {
+	strategy    models.Strategy
+	machineType models.MachineType
+	// mode 是该机器类型在路线服务中使用的出行方式
+	mode maps.TravelMode
+}
+
+// quoteSpecs 是报价选项的固定顺序：“最快” 使用 DRONE，按两轮车路线估算；
+// “最便宜” 使用 ROBOT，按步行（人行道）路线估算。包裹超出某类机器的承载能力时跳过该选项。
+var quoteSpecs = []quoteSpec{
+	{models.FastestStrategy, models.MachineTypeDrone, maps.ModeTwoWheeler},
+	{models.CheapestStrategy, models.MachineTypeRobot, maps.ModeWalk},
+}
 
-    return options, nil
+// travelMode 返回机器类型使用的出行方式；未知类型按驾车计算。
+func travelMode(mt models.MachineType) maps.TravelMode {
+	for _, spec := range quoteSpecs {
+		if spec.machineType == mt {
+			return spec.mode
+		}
+	}
+	return maps.ModeDrive
 }
 
+// CalculateRouteOptions 按每种可用机器类型的出行方式调用地图 API 并计算报价，同时保存对应路线。
+// 违反地理围栏的机器类型不参与报价（见 restrictedSpecs）。
+// 各选项的计价与路线保存并发执行（errgroup，有并发上限），结果按固定顺序返回。
+// 报价按 req.RequestedTime（取件时间，零值为当前时间）所在的时段计价，并记录在 PickupTime 中；
+// 请求带送达时间窗时，按取件时间加路线时长标出各选项能否在窗口内送达（WindowFeasible）。
+// req.Priority 为 EXPRESS 时各选项加收 models.ExpressSurcharge，并在选项中注明服务等级。
+func (s *service) CalculateRouteOptions(ctx context.Context, req models.RouteRequest) ([]models.RouteOption, error) {
+	if req.RequestedTime.IsZero() {
+		req.RequestedTime = time.Now()
+	}
+	if req.Priority == "" {
+		req.Priority = models.PriorityStandard
+	}
+	if !req.Priority.Valid() {
+		return nil, models.ValidationFailed(models.FieldError{
+			Field: "priority", Rule: "oneof", Param: "STANDARD EXPRESS", Message: "priority must be STANDARD or EXPRESS",
+		})
+	}
+	if req.DeliveryWindow != nil {
+		if err := req.DeliveryWindow.Validate(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	// 尺寸/重量校验不依赖地图结果，先做，超限时省掉一次地图调用
+	types, err := s.eligibleTypes(ctx, req.WeightKG, req.Dimensions)
+	if err != nil {
+		return nil, err
+	}
+	var specs []quoteSpec
+	for _, spec := range quoteSpecs {
+		if slices.Contains(types, spec.machineType) {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		return nil, models.ErrPackageTooLarge
+	}
+
+	// 调用路线服务（优先使用缓存）
+	routes := make([]*maps.Route, len(specs))
+	estimated := make(map[*maps.Route]bool)
+	for i, spec := range specs {
+		var est bool
+		routes[i], est, err = s.quoteRoute(ctx, req, spec)
+		if err != nil {
+			return nil, fmt.Errorf("CalculateRouteOptions: maps API: %w", err)
+		}
+		estimated[routes[i]] = est
+	}
+	// 地理围栏：去掉穿过禁飞区的无人机选项与离开服务区的机器人选项
+	specs, routes, err = s.restrictedSpecs(ctx, req, specs, routes)
+	if err != nil {
+		return nil, err
+	}
+	// 天气：去掉风雨超限的选项，接近上限的选项上浮报价
+	specs, routes, surcharges, err := s.weatherSpecs(ctx, req, specs, routes)
+	if err != nil {
+		return nil, err
+	}
+	// 计价：按机器类型、距离与请求时段选用计价规则，再按取件点附近的供需动态加价
+	surge := s.surgeMultiplier(ctx, req)
+	specs, routes, surcharges, breakdowns, err := s.pricedSpecs(ctx, req, specs, routes, surcharges, surge)
+	if err != nil {
+		return nil, err
+	}
+
+	options := make([]models.RouteOption, len(specs))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(quoteParallelism)
+	for i, spec := range specs {
+		r, breakdown, surcharge := routes[i], breakdowns[i], surcharges[i]
+		g.Go(func() error {
+			opt := models.RouteOption{
+				ID:                uuid.NewString(),
+				PickupLocation:    req.PickupLocation,
+				DeliveryLocation:  req.DeliveryLocation,
+				Polyline:          r.Polyline,
+				DistanceMeters:    r.DistanceMeters,
+				DurationSeconds:   r.DurationSeconds,
+				Strategy:          spec.strategy,
+				EstimatedCost:     breakdown.Total,
+				MachineType:       spec.machineType,
+				Estimated:         estimated[r],
+				WeatherSurcharge:  surcharge,
+				SurgeMultiplier:   surge,
+				Priority:          req.Priority,
+				PrioritySurcharge: req.Priority.Surcharge(),
+				CostBreakdown:     breakdown,
+				Legs:              routeLegs(r),
+				PickupTime:        req.RequestedTime,
+				EstimatedArrival:  req.RequestedTime.Add(time.Duration(r.DurationSeconds) * time.Second),
+			}
+			if w := req.DeliveryWindow; w != nil {
+				feasible := w.Contains(opt.EstimatedArrival)
+				opt.WindowFeasible = &feasible
+			}
+			// 保存路线失败不影响报价；报价阶段还没有 orderID
+			if err := s.logisticRepo.SaveRoute(gctx, &models.Route{
+				OrderID:         "",
+				Polyline:        opt.Polyline,
+				DistanceMeters:  opt.DistanceMeters,
+				DurationSeconds: opt.DurationSeconds,
+				Legs:            opt.Legs,
+			}); err != nil {
+				log.Printf("CalculateRouteOptions: save %s route: %v", spec.machineType, err)
+			}
+			options[i] = opt
+			return gctx.Err()
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, fmt.Errorf("CalculateRouteOptions: %w", err)
+	}
+	return options, nil
+}
 
-// ComputeRoute 生成并持久化实际路线
-func (s *service) ComputeRoute(ctx context.Context, orderID string) (*models.Route, error) {
+// ComputeRoute 生成并持久化实际路线。waypoints 是取件与投递之间依次经过的停靠点
+// （如先到仓库取货），路线按停靠点分段保存；每个停靠点需要地址或坐标。
+func (s *service) ComputeRoute(ctx context.Context, orderID string, waypoints []models.Address) (*models.Route, error) {
+	via := make([]maps.Place, len(waypoints))
+	for i, w := range waypoints {
+		if strings.TrimSpace(w.StreetAddress) == "" && w.Location == nil {
+			return nil, models.ValidationFailed(models.FieldError{
+				Field: fmt.Sprintf("waypoints[%d]", i), Rule: "required", Message: "a waypoint needs a street_address or a location",
+			})
+		}
+		via[i] = routePlace(w.StreetAddress, w.Location)
+	}
 	// 1) 获取地址
 	pickup, dropoff, err := s.logisticRepo.GetOrderAddresses(ctx, orderID)
 	if err != nil {
 		return nil, fmt.Errorf("ComputeRoute: fetch addresses: %w", err)
 	}
-	// 2) 调用 Google Maps
-	dMeters, dSeconds, polyline, err := s.callGoogleMaps(ctx, pickup, dropoff)
+	// 坐标供不能地理编码的路线服务（OSRM）使用
+	pickupPoint, dropoffPoint, err := s.logisticRepo.GetOrderPoints(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("ComputeRoute: fetch points: %w", err)
+	}
+	// 已分配机器时按该机器类型的出行方式规划，否则按驾车
+	mode := maps.ModeDrive
+	machineID, err := s.logisticRepo.GetOrderMachineID(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("ComputeRoute: fetch machine: %w", err)
+	}
+	if machineID != "" {
+		m, err := s.logisticRepo.FindMachineByID(ctx, machineID)
+		if err != nil {
+			return nil, fmt.Errorf("ComputeRoute: fetch machine: %w", err)
+		}
+		mode = travelMode(m.Type)
+	}
+	// 2) 调用路线服务
+	r, err := s.route(ctx, routePlace(pickup, pickupPoint), routePlace(dropoff, dropoffPoint), mode, via...)
 	if err != nil {
 		return nil, fmt.Errorf("ComputeRoute: maps API: %w", err)
 	}
 	// 3) 构造模型
 	route := &models.Route{
 		OrderID:         orderID,
-		Polyline:        polyline,
-		DistanceMeters:  dMeters,
-		DurationSeconds: dSeconds,
+		Polyline:        r.Polyline,
+		DistanceMeters:  r.DistanceMeters,
+		DurationSeconds: r.DurationSeconds,
+		Legs:            routeLegs(r),
 	}
 	// 4) 持久化
 	if err := s.logisticRepo.SaveRoute(ctx, route); err != nil {
@@ -197,85 +725,158 @@ func (s *service) ComputeRoute(ctx context.Context, orderID string) (*models.Rou
 	return route, nil
 }
 
-// ReportTracking 上报轨迹事件
-func (s *service) ReportTracking(ctx context.Context, orderID string, req models.TrackingEventRequest) error {
-	return s.logisticRepo.CreateTrackingEvent(ctx, &models.TrackingEvent{
+// ReportTracking 上报轨迹事件。machineID 来自机器凭证（而非请求体），
+// 且必须是订单当前分配的机器，防止伪造其他订单的轨迹。
+func (s *service) ReportTracking(ctx context.Context, orderID, machineID string, req models.TrackingEventRequest) error {
+	assigned, err := s.logisticRepo.GetOrderMachineID(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if assigned == "" || assigned != machineID {
+		return models.ErrForbidden
+	}
+	// 与上一条轨迹过近（时间或距离）的点直接丢弃，对机器而言仍是上报成功
+	record, err := s.shouldRecord(ctx, orderID, machineID, models.GeoPoint{Latitude: req.Latitude, Longitude: req.Longitude})
+	if err != nil || !record {
+		return err
+	}
+	if err := s.logisticRepo.CreateTrackingEvent(ctx, &models.TrackingEvent{
 		OrderID:   orderID,
-		MachineID: req.MachineID,
+		MachineID: machineID,
 		Latitude:  req.Latitude,
 		Longitude: req.Longitude,
-	})
+	}); err != nil {
+		return err
+	}
+	// 事件已持久化；到达检测失败不影响上报，下一个点会再次检测
+	if err := s.checkArrival(ctx, orderID, []models.GeoPoint{{Latitude: req.Latitude, Longitude: req.Longitude}}); err != nil {
+		log.Printf("ReportTracking: check arrival %s: %v", orderID, err)
+	}
+	// 通知失败只影响实时推送，客户端重连或下一次上报时会补齐
+	if err := s.tracking.Notify(ctx, orderID); err != nil {
+		log.Printf("ReportTracking: notify %s: %v", orderID, err)
+	}
+	return nil
 }
 
-// GetTracking 查询轨迹事件列表
-func (s *service) GetTracking(ctx context.Context, orderID string, since time.Time) ([]*models.TrackingEvent, error) {
-	return s.logisticRepo.ListTrackingEvents(ctx, orderID, since)
+// ReportTrackingBatch 一次写入机器离线期间缓存的轨迹点，保留机器记录的时间。
+// 与 ReportTracking 相同，machineID 必须是订单当前分配的机器。
+// 补传的点早于实时推送连接的游标时不会被推送，GET 轨迹历史按时间顺序返回它们。
+func (s *service) ReportTrackingBatch(ctx context.Context, orderID, machineID string, points []models.TrackingPoint) error {
+	assigned, err := s.logisticRepo.GetOrderMachineID(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if assigned == "" || assigned != machineID {
+		return models.ErrForbidden
+	}
+	events := make([]*models.TrackingEvent, len(points))
+	for i, p := range points {
+		events[i] = &models.TrackingEvent{
+			OrderID:   orderID,
+			MachineID: machineID,
+			Latitude:  p.Latitude,
+			Longitude: p.Longitude,
+			CreatedAt: p.RecordedAt,
+		}
+	}
+	events, err = s.throttleBatch(ctx, orderID, machineID, events)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+	if err := s.logisticRepo.CreateTrackingEvents(ctx, events); err != nil {
+		return err
+	}
+	positions := make([]models.GeoPoint, len(events))
+	for i, ev := range events {
+		positions[i] = models.GeoPoint{Latitude: ev.Latitude, Longitude: ev.Longitude}
+	}
+	if err := s.checkArrival(ctx, orderID, positions); err != nil {
+		log.Printf("ReportTrackingBatch: check arrival %s: %v", orderID, err)
+	}
+	if err := s.tracking.Notify(ctx, orderID); err != nil {
+		log.Printf("ReportTrackingBatch: notify %s: %v", orderID, err)
+	}
+	return nil
 }
 
-// callGoogleMaps 调用 Google Maps Directions API 获取路线信息
-// 返回距离（米）、时长（秒）和多段线编码
-func (s *service) callGoogleMaps(ctx context.Context, origin, destination string) (int, int, string, error) {
-	u := "https://maps.googleapis.com/maps/api/directions/json"
-	params := url.Values{}
-	params.Set("origin", origin)
-	params.Set("destination", destination)
-	params.Set("key", s.apiKey)
-	resp, err := s.httpClient.Get(u + "?" + params.Encode())
+// AuthorizeTrackingViewer 校验用户能否查看订单轨迹：下单用户、管理员与客服可以查看；
+// 其他用户返回 models.ErrNotFound，与订单详情一致，不暴露订单是否存在。
+func (s *service) AuthorizeTrackingViewer(ctx context.Context, orderID, userID, role string) error {
+	if role == models.RoleAdmin || role == models.RoleSupport {
+		return nil
+	}
+	owner, err := s.logisticRepo.GetOrderOwnerID(ctx, orderID)
 	if err != nil {
-		return 0, 0, "", err
-	}
-	defer resp.Body.Close()
-
-	var out struct {
-		Routes []struct {
-			OverviewPolyline struct{ Points string } `json:"overview_polyline"`
-			Legs             []struct {
-				Distance struct{ Value int } `json:"distance"`
-				Duration struct{ Value int } `json:"duration"`
-			} `json:"legs"`
-		} `json:"routes"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return 0, 0, "", err
-	}
-	if len(out.Routes) == 0 || len(out.Routes[0].Legs) == 0 {
-		return 0, 0, "", fmt.Errorf("no route data")
-	}
-	leg := out.Routes[0].Legs[0]
-	return leg.Distance.Value, leg.Duration.Value, out.Routes[0].OverviewPolyline.Points, nil
-}
-
-// computeCost 根据距离、时长、机器类型和是否高峰期计算价格
-// 说明：
-//  1. 基础费 base + 单位距离费/Km * km
-//  2. 高峰期乘以 peakMultiplier
-//  3. 根据机器类型(drone/robot)应用不同 base/perKm
-func computeCost(distanceMeters, durationSeconds int, machineType string, peak bool) float64 {
-    km := float64(distanceMeters) / 1000.0
-    var base, perKm float64
-    switch machineType {
-    case models.MachineTypeDrone:
-        base, perKm = 2.0, 0.5
-    default:
-        base, perKm = 1.0, 0.3
-    }
-    if peak {
-        base *= 1.2
-        perKm = 0 
-    }
-    price := base + perKm*km
-    return math.Round(price*100) / 100
+		return err
+	}
+	if owner != userID {
+		return models.ErrNotFound
+	}
+	return nil
 }
 
+// WatchTracking 订阅订单的新轨迹信号，见 TrackingHub.Subscribe。
+func (s *service) WatchTracking(orderID string) (<-chan struct{}, func()) {
+	return s.tracking.Subscribe(orderID)
+}
 
+// GetTracking 分页查询轨迹事件列表；还有下一页时返回下一页的游标，否则为 nil。
+func (s *service) GetTracking(ctx context.Context, orderID string, q models.TrackingQuery) ([]*models.TrackingEvent, *models.TrackingCursor, error) {
+	if q.Limit <= 0 {
+		q.Limit = models.DefaultTrackingPageSize
+	}
+	if q.Limit > models.MaxTrackingPageSize {
+		q.Limit = models.MaxTrackingPageSize
+	}
+	// 多取一条用于判断是否还有下一页
+	limit := q.Limit
+	q.Limit++
+	events, err := s.logisticRepo.ListTrackingEvents(ctx, orderID, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(events) <= limit {
+		return events, nil, nil
+	}
+	events = events[:limit]
+	last := events[limit-1]
+	return events, &models.TrackingCursor{CreatedAt: last.CreatedAt, ID: last.ID}, nil
+}
+
+// route 通过熔断器调用路线服务获取路线信息（距离、时长和多段线编码）
+func (s *service) route(ctx context.Context, origin, destination maps.Place, mode maps.TravelMode, waypoints ...maps.Place) (*maps.Route, error) {
+	var r *maps.Route
+	err := s.routeBreaker.Do(ctx, func(ctx context.Context) error {
+		var err error
+		r, err = s.routing.Route(ctx, origin, destination, mode, waypoints...)
+		return err
+	})
+	return r, err
+}
 
-// isPeakHour 判断给定时间是否属于高峰期
-// 支持传入请求时间，当为零值时使用当前时间
-func isPeakHour(requestedTime time.Time) bool {
-	t := requestedTime
-	if t.IsZero() {
-		t = time.Now()
+// routeLegs 将路线服务返回的各段转换为模型；没有分段信息（如直线估算）时返回 nil
+func routeLegs(r *maps.Route) []models.RouteLeg {
+	if len(r.Legs) == 0 {
+		return nil
+	}
+	legs := make([]models.RouteLeg, len(r.Legs))
+	for i, l := range r.Legs {
+		legs[i] = models.RouteLeg{Polyline: l.Polyline, DistanceMeters: l.DistanceMeters, DurationSeconds: l.DurationSeconds}
 	}
-	h := t.Hour()
-	return (h >= 8 && h <= 10) || (h >= 17 && h <= 19)
+	return legs
+}
+
+// routePlace 将地址与可选坐标转换为路线服务的地点
+func routePlace(address string, p *models.GeoPoint) maps.Place {
+	place := maps.Place{Address: address}
+	if p != nil {
+		place.Point = &maps.LatLng{Lat: p.Latitude, Lng: p.Longitude}
+	}
+	return place
+}
+
+// withSurcharge 按比例上浮报价，结果保留两位小数
+func withSurcharge(price, surcharge float64) float64 {
+	return math.Round(price*(1+surcharge)*100) / 100
 }
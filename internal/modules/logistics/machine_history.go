@@ -0,0 +1,66 @@
+package logistics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// DefaultTelemetryRetention 是机器遥测快照的默认保留时长，更早的快照由 SnapshotFleet 删除
+const DefaultTelemetryRetention = 30 * 24 * time.Hour
+
+// SnapshotFleet 记录整个车队当前的位置、电量与状态，并删除超过保留时长的快照。
+// 由调度器定期运行，运行间隔即快照的时间分辨率。
+func (s *service) SnapshotFleet(ctx context.Context) error {
+	if _, err := s.logisticRepo.SnapshotMachines(ctx); err != nil {
+		return fmt.Errorf("SnapshotFleet: %w", err)
+	}
+	if s.retention <= 0 {
+		return nil
+	}
+	if _, err := s.logisticRepo.PruneMachineTelemetry(ctx, time.Now().Add(-s.retention)); err != nil {
+		return fmt.Errorf("SnapshotFleet: %w", err)
+	}
+	return nil
+}
+
+// GetMachineHistory 返回机器在 [q.From, q.To) 内的遥测快照，降采样为至多 q.MaxPoints 个等宽时间桶。
+// 桶宽向上取整到秒；机器不存在时返回 models.ErrNotFound。
+func (s *service) GetMachineHistory(ctx context.Context, machineID string, q models.MachineHistoryQuery) (*models.MachineHistory, error) {
+	if _, err := s.logisticRepo.FindMachineByID(ctx, machineID); err != nil {
+		return nil, err
+	}
+	if q.MaxPoints <= 0 {
+		q.MaxPoints = models.DefaultMachineHistoryPoints
+	}
+	if q.MaxPoints > models.MaxMachineHistoryPoints {
+		q.MaxPoints = models.MaxMachineHistoryPoints
+	}
+	bucket := historyBucket(q.To.Sub(q.From), q.MaxPoints)
+	points, err := s.logisticRepo.ListMachineHistory(ctx, machineID, q.From, q.To, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if points == nil {
+		points = []models.MachineHistoryPoint{}
+	}
+	return &models.MachineHistory{
+		MachineID:     machineID,
+		From:          q.From,
+		To:            q.To,
+		BucketSeconds: int(bucket / time.Second),
+		Points:        points,
+	}, nil
+}
+
+// historyBucket 返回把 span 分成至多 n 个桶所需的桶宽，按整秒向上取整，至少 1 秒。
+func historyBucket(span time.Duration, n int) time.Duration {
+	bucket := (span + time.Duration(n) - 1) / time.Duration(n)
+	bucket = (bucket + time.Second - 1).Truncate(time.Second)
+	if bucket < time.Second {
+		bucket = time.Second
+	}
+	return bucket
+}
@@ -0,0 +1,212 @@
+package logistics
+
+import (
+	"context"
+	"log"
+	"math"
+	"slices"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/maps"
+)
+
+// DefaultPricingRules 返回内置的计价规则，与迁移 028 写入 pricing_rules 的初始规则相同：
+// 全天按基础费 + 每公里费计价；早晚高峰（8–11 点、17–20 点）只收 1.2 倍基础费。
+// 数据库中没有某类机器的规则时，该类机器按这些规则计价。
+func DefaultPricingRules() []*models.PricingRule {
+	hour := func(h int) *int { return &h }
+	var rules []*models.PricingRule
+	for _, f := range []struct {
+		mt          models.MachineType
+		base, perKM float64
+	}{
+		{models.MachineTypeDrone, 2.0, 0.5},
+		{models.MachineTypeRobot, 1.0, 0.3},
+	} {
+		rules = append(rules,
+			&models.PricingRule{MachineType: f.mt, BaseFare: f.base, PerKM: f.perKM, Multiplier: 1},
+			&models.PricingRule{MachineType: f.mt, StartHour: hour(8), EndHour: hour(11), BaseFare: f.base, Multiplier: 1.2},
+			&models.PricingRule{MachineType: f.mt, StartHour: hour(17), EndHour: hour(20), BaseFare: f.base, Multiplier: 1.2},
+		)
+	}
+	return rules
+}
+
+// ListPricingRules 返回所有计价规则
+func (s *service) ListPricingRules(ctx context.Context) ([]*models.PricingRule, error) {
+	return s.logisticRepo.ListPricingRules(ctx)
+}
+
+// CreatePricingRule 新增计价规则
+func (s *service) CreatePricingRule(ctx context.Context, req models.PricingRuleRequest) (*models.PricingRule, error) {
+	rule, err := pricingRule(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.logisticRepo.CreatePricingRule(ctx, rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// UpdatePricingRule 整体替换计价规则
+func (s *service) UpdatePricingRule(ctx context.Context, ruleID string, req models.PricingRuleRequest) (*models.PricingRule, error) {
+	rule, err := pricingRule(req)
+	if err != nil {
+		return nil, err
+	}
+	rule.ID = ruleID
+	if err := s.logisticRepo.UpdatePricingRule(ctx, rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// DeletePricingRule 删除计价规则
+func (s *service) DeletePricingRule(ctx context.Context, ruleID string) error {
+	return s.logisticRepo.DeletePricingRule(ctx, ruleID)
+}
+
+// pricingRule 校验结构体标签无法表达的字段关系，并把请求转换为规则（倍率缺省为 1）。
+func pricingRule(req models.PricingRuleRequest) (*models.PricingRule, error) {
+	if req.MaxKM != nil && *req.MaxKM <= req.MinKM {
+		return nil, models.ValidationFailed(models.FieldError{
+			Field: "max_km", Rule: "gtfield", Param: "min_km", Message: "max_km must be greater than min_km",
+		})
+	}
+	if (req.StartHour == nil) != (req.EndHour == nil) {
+		return nil, models.ValidationFailed(models.FieldError{
+			Field: "end_hour", Rule: "required_with", Param: "start_hour", Message: "start_hour and end_hour must be set together",
+		})
+	}
+	if req.StartHour != nil && *req.StartHour == *req.EndHour%24 {
+		return nil, models.ValidationFailed(models.FieldError{
+			Field: "end_hour", Rule: "nefield", Param: "start_hour", Message: "an hour window must not be empty; omit both hours for an all-day rule",
+		})
+	}
+	rule := &models.PricingRule{
+		MachineType: req.MachineType,
+		MinKM:       req.MinKM,
+		MaxKM:       req.MaxKM,
+		StartHour:   req.StartHour,
+		EndHour:     req.EndHour,
+		BaseFare:    req.BaseFare,
+		PerKM:       req.PerKM,
+		Multiplier:  1,
+	}
+	if req.Multiplier != nil {
+		rule.Multiplier = *req.Multiplier
+	}
+	return rule, nil
+}
+
+// pricedSpecs 按计价规则为报价选项（及其路线与天气上浮比例）计算价格，再乘以天气上浮、动态加价倍率 surge
+// 与服务等级（EXPRESS）加价，最后加税；返回每个选项的分项价格，其 Total 即报价。
+// 请求时间为零值时按当前时间。
+// 没有规则覆盖该距离与时段的机器类型不提供报价；所有选项都无法计价时返回 models.ErrNoPricingRule。
+func (s *service) pricedSpecs(ctx context.Context, req models.RouteRequest, specs []quoteSpec, routes []*maps.Route, surcharges []float64, surge float64) ([]quoteSpec, []*maps.Route, []float64, []models.CostBreakdown, error) {
+	rules, err := s.logisticRepo.ListPricingRules(ctx)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	at := req.RequestedTime
+	if at.IsZero() {
+		at = time.Now()
+	}
+	var priced []quoteSpec
+	var pricedRoutes []*maps.Route
+	var pricedSurcharges []float64
+	var breakdowns []models.CostBreakdown
+	for i, spec := range specs {
+		km := float64(routes[i].DistanceMeters) / 1000.0
+		rule := quoteRule(rules, spec.machineType, km, at)
+		if rule == nil {
+			log.Printf("CalculateRouteOptions: no pricing rule for %s over %d m at %s", spec.machineType, routes[i].DistanceMeters, at.Format("15:04"))
+			continue
+		}
+		priced = append(priced, spec)
+		pricedRoutes = append(pricedRoutes, routes[i])
+		pricedSurcharges = append(pricedSurcharges, surcharges[i])
+		breakdowns = append(breakdowns, costBreakdown(rule, km, surge, req.Priority.Surcharge(), surcharges[i], s.taxRate))
+	}
+	if len(priced) == 0 {
+		return nil, nil, nil, nil, models.ErrNoPricingRule
+	}
+	return priced, pricedRoutes, pricedSurcharges, breakdowns, nil
+}
+
+// costBreakdown 逐步计算价格：基础费、里程费、时段倍率、动态加价、服务等级加价、天气上浮，
+// 每一步都保留两位小数，分项为相邻两步之差，因此各分项之和恰好等于总价。
+// 税按 taxRate 对税前小计计算。
+func costBreakdown(rule *models.PricingRule, km, surge, priority, weather, taxRate float64) models.CostBreakdown {
+	list := (rule.BaseFare + rule.PerKM*km) * rule.Multiplier
+	steps := []int64{
+		cents(rule.BaseFare),
+		cents(rule.BaseFare + rule.PerKM*km),
+		cents(list),
+		cents(cents2(list) * surge),
+		cents(cents2(list) * surge * (1 + priority)),
+		cents(withSurcharge(cents2(list)*surge*(1+priority), weather)),
+	}
+	subtotal := steps[len(steps)-1]
+	tax := cents(float64(subtotal) / 100 * taxRate)
+	return models.CostBreakdown{
+		BaseFare:          float64(steps[0]) / 100,
+		DistanceCharge:    float64(steps[1]-steps[0]) / 100,
+		PeakSurcharge:     float64(steps[2]-steps[1]) / 100,
+		Surge:             float64(steps[3]-steps[2]) / 100,
+		PrioritySurcharge: float64(steps[4]-steps[3]) / 100,
+		WeatherSurcharge:  float64(steps[5]-steps[4]) / 100,
+		Tax:               float64(tax) / 100,
+		Total:             float64(subtotal+tax) / 100,
+	}
+}
+
+// cents 把金额换算为分（四舍五入）
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// cents2 把金额四舍五入到分
+func cents2(amount float64) float64 {
+	return float64(cents(amount)) / 100
+}
+
+// quotePrice 用 rules 中适用于该机器类型、距离与时刻的最具体规则计算价格，保留两位小数。
+// rules 中没有该机器类型的规则时使用 DefaultPricingRules；有规则但都不适用时 ok 为 false。
+func quotePrice(rules []*models.PricingRule, mt models.MachineType, distanceMeters int, at time.Time) (price float64, ok bool) {
+	km := float64(distanceMeters) / 1000.0
+	best := quoteRule(rules, mt, km, at)
+	if best == nil {
+		return 0, false
+	}
+	return cents2((best.BaseFare + best.PerKM*km) * best.Multiplier), true
+}
+
+// quoteRule 返回 rules 中适用于该机器类型、距离（公里）与时刻的最具体规则。
+// rules 中没有该机器类型的规则时从 DefaultPricingRules 中选；都不适用时返回 nil。
+func quoteRule(rules []*models.PricingRule, mt models.MachineType, km float64, at time.Time) *models.PricingRule {
+	candidates := DefaultPricingRules()
+	if slices.ContainsFunc(rules, func(r *models.PricingRule) bool { return r.MachineType == mt }) {
+		candidates = rules
+	}
+	var best *models.PricingRule
+	for _, r := range candidates {
+		if r.MachineType == mt && r.Applies(km, at.Hour()) && moreSpecific(r, best) {
+			best = r
+		}
+	}
+	return best
+}
+
+// moreSpecific 判断 r 是否比 best 更具体：有时段的规则优先于全天规则，其次是起始距离更大的分段。
+func moreSpecific(r, best *models.PricingRule) bool {
+	if best == nil {
+		return true
+	}
+	if (r.StartHour != nil) != (best.StartHour != nil) {
+		return r.StartHour != nil
+	}
+	return r.MinKM > best.MinKM
+}
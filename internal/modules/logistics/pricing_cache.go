@@ -0,0 +1,102 @@
+package logistics
+
+import (
+	"context"
+	"sync"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// PricingCacheName 是计价规则在 database.CacheBus 上使用的缓存名。
+const PricingCacheName = "pricing"
+
+// pricingCache 包装 RepositoryInterface，在内存中保存全部计价规则，报价时不必查询数据库。
+// 规则很少变化：任一写入成功后整体失效，并通过 CacheBus 通知其他实例；下次读取时整体重新加载。
+// 事务内的读直接走数据库。
+type pricingCache struct {
+	RepositoryInterface
+	bus Invalidator
+
+	mu     sync.Mutex
+	loaded bool
+	gen    uint64 // 每次失效递增；加载期间发生失效则不保存加载结果
+	rules  []*models.PricingRule
+}
+
+func newPricingCache(repo RepositoryInterface, bus Invalidator) *pricingCache {
+	c := &pricingCache{RepositoryInterface: repo, bus: bus}
+	bus.Subscribe(PricingCacheName, func(string) { c.invalidateLocal() })
+	return c
+}
+
+func (c *pricingCache) invalidateLocal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.loaded = false
+	c.rules = nil
+}
+
+func (c *pricingCache) invalidate(ctx context.Context) error {
+	c.invalidateLocal()
+	return c.bus.Invalidate(ctx, PricingCacheName, "")
+}
+
+func (c *pricingCache) ListPricingRules(ctx context.Context) ([]*models.PricingRule, error) {
+	if inTx(ctx) {
+		return c.RepositoryInterface.ListPricingRules(ctx)
+	}
+	c.mu.Lock()
+	if c.loaded {
+		out := copyPricingRules(c.rules)
+		c.mu.Unlock()
+		return out, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	rules, err := c.RepositoryInterface.ListPricingRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.rules = copyPricingRules(rules)
+		c.loaded = true
+	}
+	c.mu.Unlock()
+	return rules, nil
+}
+
+func (c *pricingCache) CreatePricingRule(ctx context.Context, rule *models.PricingRule) error {
+	if err := c.RepositoryInterface.CreatePricingRule(ctx, rule); err != nil {
+		return err
+	}
+	return c.invalidate(ctx)
+}
+
+func (c *pricingCache) UpdatePricingRule(ctx context.Context, rule *models.PricingRule) error {
+	if err := c.RepositoryInterface.UpdatePricingRule(ctx, rule); err != nil {
+		return err
+	}
+	return c.invalidate(ctx)
+}
+
+func (c *pricingCache) DeletePricingRule(ctx context.Context, id string) error {
+	if err := c.RepositoryInterface.DeletePricingRule(ctx, id); err != nil {
+		return err
+	}
+	return c.invalidate(ctx)
+}
+
+func copyPricingRules(in []*models.PricingRule) []*models.PricingRule {
+	if in == nil {
+		return nil
+	}
+	out := make([]*models.PricingRule, len(in))
+	for i, r := range in {
+		cp := *r
+		out[i] = &cp
+	}
+	return out
+}
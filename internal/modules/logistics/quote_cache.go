@@ -0,0 +1,116 @@
+package logistics
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/maps"
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// DefaultQuoteCacheTTL 是报价路线的默认缓存时长
+const DefaultQuoteCacheTTL = 15 * time.Minute
+
+// quoteRoute 返回报价选项 spec 使用的路线（按该机器类型的出行方式），
+// 按（取件地点、投递地点、机器类型、小时）缓存。
+// 小时与高峰定价的粒度一致，同一小时内的报价不会因缓存而用错价格。
+// 缓存读写失败只记录日志，退回到直接调用路线服务。
+// 路线服务熔断时返回直线距离估算（estimated 为 true），估算结果不写入缓存。
+func (s *service) quoteRoute(ctx context.Context, req models.RouteRequest, spec quoteSpec) (r *maps.Route, estimated bool, err error) {
+	origin := routePlace(req.PickupLocation.StreetAddress, req.PickupLocation.Location)
+	destination := routePlace(req.DeliveryLocation.StreetAddress, req.DeliveryLocation.Location)
+	if s.quoteCache == nil || s.quoteTTL <= 0 {
+		return s.routeOrEstimate(ctx, origin, destination, spec)
+	}
+
+	key := quoteCacheKey(origin, destination, spec.machineType, req.RequestedTime)
+	if r := s.cachedRoute(ctx, key); r != nil {
+		return r, false, nil
+	}
+	r, estimated, err = s.routeOrEstimate(ctx, origin, destination, spec)
+	if err != nil || estimated {
+		return r, estimated, err
+	}
+	if data, err := json.Marshal(r); err == nil {
+		if err := s.quoteCache.Set(ctx, key, data, s.quoteTTL); err != nil {
+			log.Printf("quote cache: set: %v", err)
+		}
+	}
+	return r, false, nil
+}
+
+// routeOrEstimate 调用路线服务；熔断器打开（连续失败、重试无效）时，
+// 按取件与投递坐标的直线距离乘以绕行系数、机器平均速度估算路线，报价降级而不是失败。
+// 缺少坐标时无法估算，返回原错误。
+func (s *service) routeOrEstimate(ctx context.Context, origin, destination maps.Place, spec quoteSpec) (*maps.Route, bool, error) {
+	r, err := s.route(ctx, origin, destination, spec.mode)
+	if err == nil || !errors.Is(err, resilience.ErrCircuitOpen) || origin.Point == nil || destination.Point == nil {
+		return r, false, err
+	}
+	detour, speed := 1.0, droneSpeedKMH
+	if em, ok := s.battery.Models[spec.machineType]; ok {
+		detour = em.DetourFactor
+	}
+	if spec.machineType == models.MachineTypeRobot {
+		speed = robotSpeedKMH
+	}
+	km := haversineKM(
+		models.GeoPoint{Latitude: origin.Point.Lat, Longitude: origin.Point.Lng},
+		models.GeoPoint{Latitude: destination.Point.Lat, Longitude: destination.Point.Lng},
+	) * detour
+	log.Printf("quote: %v; estimating the %s route from straight-line distance", err, spec.machineType)
+	return &maps.Route{
+		DistanceMeters:  int(math.Round(km * 1000)),
+		DurationSeconds: int(math.Ceil(km / speed * 3600)),
+	}, true, nil
+}
+
+// cachedRoute 读取缓存的路线；未命中或读取失败时返回 nil。
+func (s *service) cachedRoute(ctx context.Context, key string) *maps.Route {
+	data, ok, err := s.quoteCache.Get(ctx, key)
+	if err != nil {
+		log.Printf("quote cache: get: %v", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	var r maps.Route
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil
+	}
+	return &r
+}
+
+// quoteCacheKey 由规范化的地点、机器类型与请求时间所在的小时生成缓存键。
+// 地址忽略大小写与多余空白，坐标保留 5 位小数（约 1 米）。
+func quoteCacheKey(origin, destination maps.Place, mt models.MachineType, requested time.Time) string {
+	if requested.IsZero() {
+		requested = time.Now()
+	}
+	raw := strings.Join([]string{
+		placeKey(origin),
+		placeKey(destination),
+		string(mt),
+		requested.UTC().Truncate(time.Hour).Format("2006010215"),
+	}, "|")
+	sum := sha256.Sum256([]byte(raw))
+	return "quote:v1:" + hex.EncodeToString(sum[:])
+}
+
+func placeKey(p maps.Place) string {
+	key := strings.ToLower(strings.Join(strings.Fields(p.Address), " "))
+	if p.Point != nil {
+		key += fmt.Sprintf("@%.5f,%.5f", p.Point.Lat, p.Point.Lng)
+	}
+	return key
+}
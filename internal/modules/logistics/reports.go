@@ -0,0 +1,149 @@
+package logistics
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// reportMaxGap 是利用率报表中一条快照的状态最多持续的时长。快照默认每分钟一条，
+// 更长的空档（API 停机、机器被删除）不计入任何状态。
+const reportMaxGap = 15 * time.Minute
+
+// GetUtilizationReport 统计每台机器在 [q.From, q.To) 内配送、空闲、充电与其他状态的时长，
+// 以及配送时长占已观测时长的比例。数据来自 SnapshotFleet 写入的遥测快照。
+func (s *service) GetUtilizationReport(ctx context.Context, q models.ReportQuery) (*models.UtilizationReport, error) {
+	rows, err := s.logisticRepo.ListMachineUtilization(ctx, q.From, q.To, reportMaxGap)
+	if err != nil {
+		return nil, fmt.Errorf("GetUtilizationReport: %w", err)
+	}
+	if rows == nil {
+		rows = []models.MachineUtilization{}
+	}
+	for i := range rows {
+		u := &rows[i]
+		if total := u.InTransitSeconds + u.IdleSeconds + u.ChargingSeconds + u.OtherSeconds; total > 0 {
+			u.Utilization = float64(u.InTransitSeconds) / float64(total)
+		}
+	}
+	return &models.UtilizationReport{From: q.From, To: q.To, Machines: rows}, nil
+}
+
+// GetDeliveriesReport 按 UTC 日期统计 [q.From, q.To) 内确认送达的订单数；没有送达的日期补 0，
+// 便于直接绘图或导入表格。
+func (s *service) GetDeliveriesReport(ctx context.Context, q models.ReportQuery) (*models.DeliveriesReport, error) {
+	counted, err := s.logisticRepo.CountDeliveriesByDay(ctx, q.From, q.To)
+	if err != nil {
+		return nil, fmt.Errorf("GetDeliveriesReport: %w", err)
+	}
+	byDate := make(map[string]models.DailyDeliveries, len(counted))
+	for _, d := range counted {
+		byDate[d.Date] = d
+	}
+	days := []models.DailyDeliveries{}
+	for day := q.From.UTC().Truncate(24 * time.Hour); day.Before(q.To); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		d, ok := byDate[date]
+		if !ok {
+			d = models.DailyDeliveries{Date: date}
+		}
+		days = append(days, d)
+	}
+	return &models.DeliveriesReport{From: q.From, To: q.To, Days: days}, nil
+}
+
+// GetRevenueReport 按 UTC 日期汇总 [q.From, q.To) 内成功的订单扣款、小费与退款，
+// Net = 扣款 + 小费 - 退款；没有支付的日期补 0。数据来自订单模块写入的 payments 表。
+func (s *service) GetRevenueReport(ctx context.Context, q models.ReportQuery) (*models.RevenueReport, error) {
+	summed, err := s.logisticRepo.SumRevenueByDay(ctx, q.From, q.To)
+	if err != nil {
+		return nil, fmt.Errorf("GetRevenueReport: %w", err)
+	}
+	byDate := make(map[string]models.DailyRevenue, len(summed))
+	for _, d := range summed {
+		d.Net = math.Round((d.Charged+d.Tips-d.Refunded)*100) / 100
+		byDate[d.Date] = d
+	}
+	days := []models.DailyRevenue{}
+	for day := q.From.UTC().Truncate(24 * time.Hour); day.Before(q.To); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		d, ok := byDate[date]
+		if !ok {
+			d = models.DailyRevenue{Date: date}
+		}
+		days = append(days, d)
+	}
+	return &models.RevenueReport{From: q.From, To: q.To, Days: days}, nil
+}
+
+// GetDistanceReport 按 ISO 周统计每台机器在 [q.From, q.To) 内的行驶距离。
+// 距离是相邻遥测快照之间的直线距离之和，快照间隔越长越偏小。
+func (s *service) GetDistanceReport(ctx context.Context, q models.ReportQuery) (*models.DistanceReport, error) {
+	weeks, err := s.logisticRepo.SumDistanceByWeek(ctx, q.From, q.To)
+	if err != nil {
+		return nil, fmt.Errorf("GetDistanceReport: %w", err)
+	}
+	if weeks == nil {
+		weeks = []models.WeeklyDistance{}
+	}
+	return &models.DistanceReport{From: q.From, To: q.To, Weeks: weeks}, nil
+}
+
+// writeUtilizationCSV 把利用率报表写成 CSV，每台机器一行，时长单位为秒。
+func writeUtilizationCSV(w io.Writer, r *models.UtilizationReport) error {
+	records := [][]string{{"machine_id", "type", "in_transit_seconds", "idle_seconds", "charging_seconds", "other_seconds", "utilization"}}
+	for _, u := range r.Machines {
+		records = append(records, []string{
+			u.MachineID, string(u.Type),
+			strconv.FormatInt(u.InTransitSeconds, 10),
+			strconv.FormatInt(u.IdleSeconds, 10),
+			strconv.FormatInt(u.ChargingSeconds, 10),
+			strconv.FormatInt(u.OtherSeconds, 10),
+			strconv.FormatFloat(u.Utilization, 'f', 4, 64),
+		})
+	}
+	return csv.NewWriter(w).WriteAll(records)
+}
+
+// writeDeliveriesCSV 把每日送达报表写成 CSV，每天一行。
+func writeDeliveriesCSV(w io.Writer, r *models.DeliveriesReport) error {
+	records := [][]string{{"date", "deliveries", "by_drone", "by_robot"}}
+	for _, d := range r.Days {
+		records = append(records, []string{
+			d.Date, strconv.Itoa(d.Deliveries), strconv.Itoa(d.ByDrone), strconv.Itoa(d.ByRobot),
+		})
+	}
+	return csv.NewWriter(w).WriteAll(records)
+}
+
+// writeRevenueCSV 把每日收入报表写成 CSV，每天一行，金额保留两位小数。
+func writeRevenueCSV(w io.Writer, r *models.RevenueReport) error {
+	records := [][]string{{"date", "charged", "tips", "refunded", "net"}}
+	for _, d := range r.Days {
+		records = append(records, []string{
+			d.Date,
+			strconv.FormatFloat(d.Charged, 'f', 2, 64),
+			strconv.FormatFloat(d.Tips, 'f', 2, 64),
+			strconv.FormatFloat(d.Refunded, 'f', 2, 64),
+			strconv.FormatFloat(d.Net, 'f', 2, 64),
+		})
+	}
+	return csv.NewWriter(w).WriteAll(records)
+}
+
+// writeDistanceCSV 把每周行驶距离报表写成 CSV，每台机器每周一行。
+func writeDistanceCSV(w io.Writer, r *models.DistanceReport) error {
+	records := [][]string{{"week_start", "machine_id", "type", "distance_km"}}
+	for _, wk := range r.Weeks {
+		records = append(records, []string{
+			wk.WeekStart, wk.MachineID, string(wk.Type), strconv.FormatFloat(wk.DistanceKM, 'f', 3, 64),
+		})
+	}
+	return csv.NewWriter(w).WriteAll(records)
+}
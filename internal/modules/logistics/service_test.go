@@ -2,14 +2,36 @@ package logistics
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/internal/modules/logistics/agentpb"
+	"dispatch-and-delivery/pkg/cache"
+	"dispatch-and-delivery/pkg/maps"
+	"dispatch-and-delivery/pkg/resilience"
+	"dispatch-and-delivery/pkg/weather"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 // ----------------------------------------------------------------------------
@@ -30,11 +52,39 @@ func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
 // - trackingEvents: 存储 CreateTrackingEvent 调用产生的 TrackingEvent 列表
 // ----------------------------------------------------------------------------
 type fakeRepo struct {
+	mu             sync.Mutex // SaveRoute 会被并发调用（报价选项并发计算）
 	machines       map[string]*models.Machine
 	orderDest      map[string]string
 	ordersAssigned map[string]string
+	orderOwners    map[string]string // orderID → 下单用户 ID
+	orderPickups   map[string]models.GeoPoint
+	orderDropoffs  map[string]models.GeoPoint
+	orderPackages  map[string]models.Order // 只使用 ItemWeightKg 与 Dimensions；缺省为空包裹
+	capacities     []models.MachineCapacity
+	orderStatuses  map[string]models.OrderStatus
+	orderWindows   map[string]models.DeliveryWindow
+	recipients     map[string]models.Recipient
+	runs           map[string]*models.DeliveryRun
+	zones          map[string]*models.Zone
+	noFly          bool // CrossesNoFlyZone 的返回值
+	outsideArea    bool // LeavesServiceArea 的返回值
+	depots         []*models.Depot
+	chargeTrips    map[string]*models.ChargeTrip // machineID → 充电行程
+	heartbeats     map[string]time.Time          // machineID → 最近一次心跳
+	notifications  []string                      // NotifyAdmins 写入的消息
+	snapshots      []fakeSnapshot                // SnapshotMachines 写入的遥测快照
+	historyBucket  time.Duration                 // 最近一次 ListMachineHistory 的桶宽
+	pricingRules   []*models.PricingRule
+	pricingReads   int // ListPricingRules 的调用次数
 	routes         []*models.Route
 	trackingEvents []*models.TrackingEvent
+	keyHashes      map[string]string        // machineID → API Key 摘要
+	commands       []*models.MachineCommand // 按创建顺序排列的机器命令
+	utilization    []models.MachineUtilization
+	deliveries     []models.DailyDeliveries
+	distances      []models.WeeklyDistance
+	revenue        []models.DailyRevenue
+	beforeUpdate   func(cur *models.Machine) // 模拟 UpdateMachine 前的并发写入
 }
 
 func newFakeRepo() *fakeRepo {
@@ -42,9 +92,32 @@ func newFakeRepo() *fakeRepo {
 		machines:       make(map[string]*models.Machine),
 		orderDest:      make(map[string]string),
 		ordersAssigned: make(map[string]string),
+		orderOwners:    make(map[string]string),
+		orderPickups:   make(map[string]models.GeoPoint),
+		orderDropoffs:  make(map[string]models.GeoPoint),
+		orderPackages:  make(map[string]models.Order),
+		orderStatuses:  make(map[string]models.OrderStatus),
+		orderWindows:   make(map[string]models.DeliveryWindow),
+		recipients:     make(map[string]models.Recipient),
+		runs:           make(map[string]*models.DeliveryRun),
+		zones:          make(map[string]*models.Zone),
+		chargeTrips:    make(map[string]*models.ChargeTrip),
+		heartbeats:     make(map[string]time.Time),
+		// 与 018_create_machine_type_capacities 的初始数据一致
+		capacities: []models.MachineCapacity{
+			{Type: models.MachineTypeDrone, MaxWeightKG: 3, MaxLengthM: 0.5, MaxWidthM: 0.5, MaxHeightM: 0.5},
+			{Type: models.MachineTypeRobot, MaxWeightKG: 10, MaxLengthM: 1, MaxWidthM: 1, MaxHeightM: 1},
+		},
+		keyHashes: make(map[string]string),
 	}
 }
 
+// fakeSnapshot 是 machine_telemetry 中的一行
+type fakeSnapshot struct {
+	machineID string
+	point     models.MachineHistoryPoint
+}
+
 // ----------------------------------------------------------------------------
 // fakeRepo 方法实现：模仿真实 Repo 层行为，并记录调用结果供测试断言
 // ----------------------------------------------------------------------------
@@ -58,23 +131,174 @@ func (f *fakeRepo) FindMachineByID(ctx context.Context, id string) (*models.Mach
 }
 
 func (f *fakeRepo) UpdateMachine(ctx context.Context, m *models.Machine) error {
-	if _, ok := f.machines[m.ID]; !ok {
+	cur, ok := f.machines[m.ID]
+	if !ok {
 		return models.ErrNotFound
 	}
+	if f.beforeUpdate != nil {
+		f.beforeUpdate(cur)
+	}
+	if cur.Version != m.Version {
+		return models.ErrMachineVersionConflict
+	}
+	m.Version++
 	cp := *m
 	f.machines[m.ID] = &cp
 	return nil
 }
 
-func (f *fakeRepo) ListMachines(ctx context.Context) ([]*models.Machine, error) {
+func (f *fakeRepo) ListMachines(ctx context.Context, includeDeleted bool) ([]*models.Machine, error) {
 	out := make([]*models.Machine, 0, len(f.machines))
 	for _, m := range f.machines {
+		if m.DeletedAt != nil && !includeDeleted {
+			continue
+		}
 		cp := *m
 		out = append(out, &cp)
 	}
 	return out, nil
 }
 
+func (f *fakeRepo) GetFleetStats(ctx context.Context) (*models.FleetStats, error) {
+	stats := &models.FleetStats{ByStatus: map[models.MachineStatus]int{}, ByType: map[models.MachineType]int{}}
+	battery := 0
+	for _, m := range f.machines {
+		if m.DeletedAt != nil {
+			continue
+		}
+		stats.TotalMachines++
+		stats.ByStatus[m.Status]++
+		stats.ByType[m.Type]++
+		battery += m.BatteryLevel
+	}
+	if stats.TotalMachines > 0 {
+		stats.AverageBatteryLevel = float64(battery) / float64(stats.TotalMachines)
+	}
+	stats.MachinesOffline = stats.ByStatus[models.StatusOffline]
+	for _, st := range f.orderStatuses {
+		if st == models.OrderStatusInProgress || st == models.OrderStatusArrived {
+			stats.OrdersInTransit++
+		}
+	}
+	return stats, nil
+}
+
+func (f *fakeRepo) RecordHeartbeat(ctx context.Context, machineID string) (bool, error) {
+	m, ok := f.machines[machineID]
+	if !ok || m.DeletedAt != nil {
+		return false, models.ErrNotFound
+	}
+	f.heartbeats[machineID] = time.Now()
+	if m.Status != models.StatusOffline {
+		return false, nil
+	}
+	m.Status = models.StatusIdle
+	for orderID, id := range f.ordersAssigned {
+		if id == machineID && f.orderStatuses[orderID] == models.OrderStatusInProgress {
+			m.Status = models.StatusInTransit
+		}
+	}
+	m.Version++
+	return true, nil
+}
+
+func (f *fakeRepo) SnapshotMachines(ctx context.Context) (int64, error) {
+	var n int64
+	for id, m := range f.machines {
+		if m.DeletedAt != nil {
+			continue
+		}
+		f.snapshots = append(f.snapshots, fakeSnapshot{id, models.MachineHistoryPoint{
+			RecordedAt:   time.Now(),
+			Latitude:     m.Latitude,
+			Longitude:    m.Longitude,
+			BatteryLevel: float64(m.BatteryLevel),
+			Status:       m.Status,
+		}})
+		n++
+	}
+	return n, nil
+}
+
+func (f *fakeRepo) PruneMachineTelemetry(ctx context.Context, before time.Time) (int64, error) {
+	kept := f.snapshots[:0]
+	for _, sn := range f.snapshots {
+		if !sn.point.RecordedAt.Before(before) {
+			kept = append(kept, sn)
+		}
+	}
+	n := int64(len(f.snapshots) - len(kept))
+	f.snapshots = kept
+	return n, nil
+}
+
+// ListMachineHistory 不做降采样，只记录桶宽并返回区间内的快照
+func (f *fakeRepo) ListMachineHistory(ctx context.Context, machineID string, from, to time.Time, bucket time.Duration) ([]models.MachineHistoryPoint, error) {
+	f.historyBucket = bucket
+	var out []models.MachineHistoryPoint
+	for _, sn := range f.snapshots {
+		if sn.machineID == machineID && !sn.point.RecordedAt.Before(from) && sn.point.RecordedAt.Before(to) {
+			out = append(out, sn.point)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) MarkStaleMachinesOffline(ctx context.Context, timeout time.Duration) ([]models.StaleMachine, error) {
+	var out []models.StaleMachine
+	for id, m := range f.machines {
+		if m.DeletedAt != nil || m.Status == models.StatusOffline || m.Status == models.StatusMaintenance {
+			continue
+		}
+		last, ok := f.heartbeats[id]
+		if !ok {
+			last = m.CreatedAt
+		}
+		if time.Since(last) <= timeout {
+			continue
+		}
+		sm := models.StaleMachine{ID: id, Type: m.Type, PreviousStatus: m.Status}
+		if ok {
+			sm.LastHeartbeatAt = &last
+		}
+		m.Status = models.StatusOffline
+		m.Version++
+		out = append(out, sm)
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) NotifyAdmins(ctx context.Context, message string) error {
+	f.notifications = append(f.notifications, message)
+	return nil
+}
+
+func (f *fakeRepo) CreateMachine(ctx context.Context, m *models.Machine, keyHash string) error {
+	m.ID = fmt.Sprintf("m-%d", len(f.machines)+1)
+	m.CreatedAt = time.Now()
+	m.UpdatedAt = m.CreatedAt
+	cp := *m
+	f.machines[m.ID] = &cp
+	f.keyHashes[m.ID] = keyHash
+	return nil
+}
+
+func (f *fakeRepo) DeleteMachine(ctx context.Context, id string) error {
+	m, ok := f.machines[id]
+	if !ok || m.DeletedAt != nil {
+		return models.ErrNotFound
+	}
+	if m.Status == models.StatusInTransit || m.Status == models.StatusReturning {
+		return models.ErrMachineBusy
+	}
+	now := time.Now()
+	m.DeletedAt = &now
+	m.Status = models.StatusMaintenance
+	delete(f.keyHashes, id)
+	delete(f.chargeTrips, id)
+	return nil
+}
+
 func (f *fakeRepo) GetOrderAddresses(ctx context.Context, orderID string) (string, string, error) {
 	dest, ok := f.orderDest[orderID]
 	if !ok {
@@ -84,6 +308,8 @@ func (f *fakeRepo) GetOrderAddresses(ctx context.Context, orderID string) (strin
 }
 
 func (f *fakeRepo) SaveRoute(ctx context.Context, r *models.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	// 模拟生成 ID 和时间戳
 	r.ID = fmt.Sprintf("route-%d", len(f.routes)+1)
 	r.CreatedAt = time.Now()
@@ -91,6 +317,18 @@ func (f *fakeRepo) SaveRoute(ctx context.Context, r *models.Route) error {
 	return nil
 }
 
+func (f *fakeRepo) GetLatestRoute(ctx context.Context, orderID string) (*models.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.routes) - 1; i >= 0; i-- {
+		if f.routes[i].OrderID == orderID {
+			cp := *f.routes[i]
+			return &cp, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
 func (f *fakeRepo) GetOrderDestination(ctx context.Context, orderID string) (string, error) {
 	dest, ok := f.orderDest[orderID]
 	if !ok {
@@ -102,7 +340,7 @@ func (f *fakeRepo) GetOrderDestination(ctx context.Context, orderID string) (str
 func (f *fakeRepo) ListIdleMachines(ctx context.Context) ([]*models.Machine, error) {
 	out := []*models.Machine{}
 	for _, m := range f.machines {
-		if m.Status == models.StatusIdle {
+		if m.Status == models.StatusIdle && m.DeletedAt == nil {
 			cp := *m
 			out = append(out, &cp)
 		}
@@ -110,256 +348,3018 @@ func (f *fakeRepo) ListIdleMachines(ctx context.Context) ([]*models.Machine, err
 	return out, nil
 }
 
-func (f *fakeRepo) AssignOrder(ctx context.Context, orderID, machineID string) error {
-	if _, ok := f.machines[machineID]; !ok {
-		return models.ErrNotFound
+func (f *fakeRepo) GetOrderPoints(ctx context.Context, orderID string) (*models.GeoPoint, *models.GeoPoint, error) {
+	var pickup, dropoff *models.GeoPoint
+	if p, ok := f.orderPickups[orderID]; ok {
+		pickup = &p
 	}
-	f.ordersAssigned[orderID] = machineID
-	return nil
+	if d, ok := f.orderDropoffs[orderID]; ok {
+		dropoff = &d
+	}
+	return pickup, dropoff, nil
 }
 
-func (f *fakeRepo) UpdateMachineStatus(ctx context.Context, machineID, status string) error {
-	m, ok := f.machines[machineID]
-	if !ok {
+func (f *fakeRepo) GetOrderDeliveryWindow(ctx context.Context, orderID string) (*models.DeliveryWindow, error) {
+	if w, ok := f.orderWindows[orderID]; ok {
+		return &w, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeRepo) ListMachineRecipients(ctx context.Context, machineID string) (map[string]*models.Recipient, error) {
+	recipients := make(map[string]*models.Recipient)
+	for orderID, rc := range f.recipients {
+		if f.ordersAssigned[orderID] == machineID && f.orderStatuses[orderID] == models.OrderStatusInProgress {
+			rc := rc
+			recipients[orderID] = &rc
+		}
+	}
+	return recipients, nil
+}
+
+func (f *fakeRepo) ListMachineOrders(ctx context.Context, machineID string) ([]string, error) {
+	var ids []string
+	for orderID, m := range f.ordersAssigned {
+		if m == machineID && f.orderStatuses[orderID] == models.OrderStatusInProgress {
+			ids = append(ids, orderID)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (f *fakeRepo) ListMachineCapacities(ctx context.Context) ([]models.MachineCapacity, error) {
+	return f.capacities, nil
+}
+
+func (f *fakeRepo) GetOrderPackage(ctx context.Context, orderID string) (float64, models.Dimensions, error) {
+	o := f.orderPackages[orderID]
+	return o.ItemWeightKg, o.Dimensions, nil
+}
+
+// ListNearestIdleMachines 用大圆距离代替 PostGIS 的 <->
+func (f *fakeRepo) ListNearestIdleMachines(ctx context.Context, lon, lat float64, types []models.MachineType, zoneID string, limit int) ([]*models.Machine, error) {
+	target := models.GeoPoint{Latitude: lat, Longitude: lon}
+	dist := func(m *models.Machine) float64 {
+		return haversineKM(models.GeoPoint{Latitude: m.Latitude, Longitude: m.Longitude}, target)
+	}
+	out := []*models.Machine{}
+	for _, m := range f.machines {
+		if m.Status != models.StatusIdle || m.DeletedAt != nil || (len(types) > 0 && !slices.Contains(types, m.Type)) {
+			continue
+		}
+		if zoneID != "" && (m.ZoneID == nil || *m.ZoneID != zoneID) {
+			continue
+		}
+		cp := *m
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return dist(out[i]) < dist(out[j]) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) CreateMachineCommand(ctx context.Context, cmd *models.MachineCommand) error {
+	if m, ok := f.machines[cmd.MachineID]; !ok || m.DeletedAt != nil {
 		return models.ErrNotFound
 	}
-	m.Status = status
-	m.UpdatedAt = time.Now()
+	cmd.ID = fmt.Sprintf("cmd-%d", len(f.commands)+1)
+	cmd.Status = models.CommandPending
+	cmd.CreatedAt = time.Now()
+	cp := *cmd
+	f.commands = append(f.commands, &cp)
 	return nil
 }
 
-func (f *fakeRepo) CreateTrackingEvent(ctx context.Context, ev *models.TrackingEvent) error {
-	ev.ID = fmt.Sprintf("track-%d", len(f.trackingEvents)+1)
-	ev.CreatedAt = time.Now()
-	f.trackingEvents = append(f.trackingEvents, ev)
-	return nil
+func (f *fakeRepo) ListMachineCommands(ctx context.Context, machineID string, limit int) ([]*models.MachineCommand, error) {
+	var out []*models.MachineCommand
+	for i := len(f.commands) - 1; i >= 0 && len(out) < limit; i-- {
+		if f.commands[i].MachineID == machineID {
+			cp := *f.commands[i]
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
 }
 
-func (f *fakeRepo) ListTrackingEvents(ctx context.Context, orderID string, since time.Time) ([]*models.TrackingEvent, error) {
-	out := []*models.TrackingEvent{}
-	for _, ev := range f.trackingEvents {
-		if ev.OrderID == orderID && ev.CreatedAt.After(since) {
-			cp := *ev
+func (f *fakeRepo) TakeMachineCommands(ctx context.Context, machineID string) ([]*models.MachineCommand, error) {
+	var out []*models.MachineCommand
+	for _, c := range f.commands {
+		open := c.Status == models.CommandPending || c.Status == models.CommandDelivered
+		if c.MachineID != machineID || !open || !c.ExpiresAt.After(time.Now()) {
+			continue
+		}
+		f.deliverCommand(c)
+		cp := *c
+		out = append(out, &cp)
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) ListUndeliveredCommands(ctx context.Context) ([]*models.MachineCommand, error) {
+	var out []*models.MachineCommand
+	for _, c := range f.commands {
+		if c.Status == models.CommandPending && c.ExpiresAt.After(time.Now()) {
+			cp := *c
 			out = append(out, &cp)
 		}
 	}
 	return out, nil
 }
 
-// ----------------------------------------------------------------------------
-// newTestService: 构造带有 FakeRepo 和可定制 HTTP 模拟响应的 Service 实例
-// ----------------------------------------------------------------------------
-func newTestService(fr *fakeRepo, respBody string) ServiceInterface {
-	svc := NewService(fr, "test").(*service)
-	svc.httpClient = &http.Client{
-		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
-			// 模拟 API 返回 JSON 格式的路线数据
-			return &http.Response{
-				StatusCode: http.StatusOK,
-				Body:       io.NopCloser(strings.NewReader(respBody)),
-				Header:     http.Header{},
-			}, nil
-		}),
+func (f *fakeRepo) MarkCommandDelivered(ctx context.Context, commandID string) error {
+	for _, c := range f.commands {
+		if c.ID == commandID && c.Status == models.CommandPending {
+			f.deliverCommand(c)
+		}
 	}
-	return svc
+	return nil
 }
 
-// ----------------------------------------------------------------------------
-// 单元测试：针对各业务函数的功能与 FakeRepo 状态变更做完整覆盖
-// ----------------------------------------------------------------------------
+// deliverCommand 模拟 status = 'DELIVERED', delivered_at = COALESCE(delivered_at, now())
+func (f *fakeRepo) deliverCommand(c *models.MachineCommand) {
+	c.Status = models.CommandDelivered
+	if c.DeliveredAt == nil {
+		now := time.Now()
+		c.DeliveredAt = &now
+	}
+}
 
-func TestIsPeakHour(t *testing.T) {
-	// 验证早上 9 点属于高峰期，14 点不属于
-	times := []struct {
-		at   time.Time
-		want bool
-	}{
-		{time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC), true},
-		{time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC), false},
+func (f *fakeRepo) AckMachineCommand(ctx context.Context, machineID, commandID string, accepted bool, reason string) (*models.MachineCommand, error) {
+	for _, c := range f.commands {
+		if c.ID != commandID || c.MachineID != machineID {
+			continue
+		}
+		if c.Status != models.CommandAcknowledged && c.Status != models.CommandRejected {
+			c.Status = models.CommandRejected
+			if accepted {
+				c.Status = models.CommandAcknowledged
+			}
+			c.Reason = reason
+			now := time.Now()
+			c.AckedAt = &now
+		}
+		cp := *c
+		return &cp, nil
 	}
-	for _, tt := range times {
-		got := isPeakHour(tt.at)
-		if got != tt.want {
-			t.Errorf("isPeakHour(%v) = %v; want %v", tt.at, got, tt.want)
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeRepo) ExpireMachineCommands(ctx context.Context) (int64, error) {
+	var n int64
+	for _, c := range f.commands {
+		open := c.Status == models.CommandPending || c.Status == models.CommandDelivered
+		if open && !c.ExpiresAt.After(time.Now()) {
+			c.Status = models.CommandExpired
+			n++
 		}
 	}
+	return n, nil
+}
+
+func (f *fakeRepo) ListMachineUtilization(ctx context.Context, from, to time.Time, maxGap time.Duration) ([]models.MachineUtilization, error) {
+	return append([]models.MachineUtilization(nil), f.utilization...), nil
+}
+
+func (f *fakeRepo) CountDeliveriesByDay(ctx context.Context, from, to time.Time) ([]models.DailyDeliveries, error) {
+	return f.deliveries, nil
 }
 
-func TestComputeCost(t *testing.T) {
-	// 非高峰：Drone 1000m、600s → 单价 0.0025 → 总价 2.50
-	c := computeCost(1000, 600, models.MachineTypeDrone, false)
-	if c != 2.5 {
-		t.Errorf("computeCost non-peak drone = %.2f; want 2.50", c)
+func (f *fakeRepo) SumRevenueByDay(ctx context.Context, from, to time.Time) ([]models.DailyRevenue, error) {
+	return f.revenue, nil
+}
+
+func (f *fakeRepo) SumDistanceByWeek(ctx context.Context, from, to time.Time) ([]models.WeeklyDistance, error) {
+	return f.distances, nil
+}
+
+func (f *fakeRepo) SetMachineKeyHash(ctx context.Context, machineID, keyHash string) error {
+	if _, ok := f.machines[machineID]; !ok {
+		return models.ErrNotFound
 	}
-	// 高峰：Robot 1000m、600s → 基价 1.0 + 高峰倍率 1.2 = 1.2 → 四舍五入 1.2
-	c2 := computeCost(1000, 600, models.MachineTypeRobot, true)
-	if c2 != 1.2 {
-		t.Errorf("computeCost peak robot = %.2f; want 1.20", c2)
+	f.keyHashes[machineID] = keyHash
+	return nil
+}
+
+func (f *fakeRepo) FindMachineIDByKeyHash(ctx context.Context, keyHash string) (string, error) {
+	for id, h := range f.keyHashes {
+		if h == keyHash {
+			return id, nil
+		}
 	}
+	return "", models.ErrNotFound
 }
 
-func TestCalculateRouteOptions(t *testing.T) {
-	fr := newFakeRepo()
-	// 预置 orderID → 地址映射
-	fr.orderDest["order123"] = "DEST-123"
-	// 模拟 Google Routes API 返回的数据
-	resp := `{"routes":[{"overview_polyline":{"points":"abc"},"legs":[{"distance":{"value":1000},"duration":{"value":600}}]},{"overview_polyline":{"points":"def"},"legs":[{"distance":{"value":2000},"duration":{"value":1200}}]}]}`
-	svc := newTestService(fr, resp)
+func (f *fakeRepo) GetOrderMachineID(ctx context.Context, orderID string) (string, error) {
+	return f.ordersAssigned[orderID], nil
+}
 
-	// 构造请求：1000m/600s 的第一条为最快，第二条为最便宜
-	req := models.RouteRequest{
-		PickupLocation:   models.Address{StreetAddress: "A"},
-		DeliveryLocation: models.Address{StreetAddress: "B"},
-		WeightKG:         2,
-		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
-		RequestedTime:    time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC),
-	}
-	opts, err := svc.CalculateRouteOptions(context.Background(), req)
-	if err != nil {
-		t.Fatalf("CalculateRouteOptions error: %v", err)
+func (f *fakeRepo) GetOrderOwnerID(ctx context.Context, orderID string) (string, error) {
+	owner, ok := f.orderOwners[orderID]
+	if !ok {
+		return "", models.ErrNotFound
 	}
-	// 返回了 2 种选项：最快和最便宜
-	if len(opts) != 2 {
-		t.Fatalf("got %d options; want 2", len(opts))
+	return owner, nil
+}
+
+func (f *fakeRepo) AssignOrder(ctx context.Context, orderID, machineID string) error {
+	if _, ok := f.machines[machineID]; !ok {
+		return models.ErrNotFound
 	}
+	f.ordersAssigned[orderID] = machineID
+	return nil
+}
 
-	// Fastest: Drone
-	fast := opts[0]
-	if fast.MachineType != models.MachineTypeDrone {
-		t.Errorf("fastest MachineType = %s; want Drone", fast.MachineType)
+func (f *fakeRepo) UpdateMachineStatus(ctx context.Context, machineID string, status models.MachineStatus) error {
+	m, ok := f.machines[machineID]
+	if !ok {
+		return models.ErrNotFound
 	}
-	if fast.DurationSeconds != 600 {
-		t.Errorf("fastest DurationSeconds = %d; want 600", fast.DurationSeconds)
+	m.Status = status
+	m.UpdatedAt = time.Now()
+	return nil
+}
+
+func (f *fakeRepo) ReturnMachine(ctx context.Context, machineID string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.machines[machineID]
+	if !ok || m.Status != models.StatusInTransit || m.DeletedAt != nil {
+		return false, nil
 	}
-	if fast.EstimatedCost != computeCost(1000, 600, models.MachineTypeDrone, true) {
-		t.Errorf("fastest EstimatedCost = %.2f; want %.2f", fast.EstimatedCost, computeCost(1000, 600, models.MachineTypeDrone, true))
+	for orderID, id := range f.ordersAssigned {
+		if id == machineID && f.orderStatuses[orderID] == models.OrderStatusInProgress {
+			return false, nil
+		}
 	}
+	m.Status = models.StatusReturning
+	return true, nil
+}
 
-	// Cheapest: Robot
-	cheap := opts[1]
-	if cheap.MachineType != models.MachineTypeRobot {
-		t.Errorf("cheapest MachineType = %s; want Robot", cheap.MachineType)
+func (f *fakeRepo) ClaimMachine(ctx context.Context, machineID string, orderIDs ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.machines[machineID]
+	if !ok || m.Status != models.StatusIdle || m.DeletedAt != nil {
+		return models.ErrMachineClaimed
 	}
-	if cheap.DurationSeconds != 1200 {
-		t.Errorf("cheapest DurationSeconds = %d; want 1200", cheap.DurationSeconds)
+	m.Status = models.StatusInTransit
+	m.UpdatedAt = time.Now()
+	for _, id := range orderIDs {
+		f.ordersAssigned[id] = machineID
 	}
-	if cheap.EstimatedCost != computeCost(2000, 1200, models.MachineTypeRobot, true) {
-		t.Errorf("cheapest EstimatedCost = %.2f; want %.2f", cheap.EstimatedCost, computeCost(2000, 1200, models.MachineTypeRobot, true))
+	return nil
+}
+
+func (f *fakeRepo) GetOrderStatus(ctx context.Context, orderID string) (models.OrderStatus, error) {
+	status, ok := f.orderStatuses[orderID]
+	if !ok {
+		return "", models.ErrNotFound
 	}
+	return status, nil
+}
 
-	// 确认 SaveRoute 被调用，fakeRepo 中 routes 列表新增了 2 条
-	if len(fr.routes) != 2 {
-		t.Errorf("fakeRepo.routes length = %d; want 2", len(fr.routes))
+func (f *fakeRepo) CreateDeliveryRun(ctx context.Context, run *models.DeliveryRun) error {
+	run.ID = fmt.Sprintf("run-%d", len(f.runs)+1)
+	run.CreatedAt = time.Now()
+	f.runs[run.ID] = run
+	return nil
+}
+
+func (f *fakeRepo) GetDeliveryRun(ctx context.Context, runID string) (*models.DeliveryRun, error) {
+	run, ok := f.runs[runID]
+	if !ok {
+		return nil, models.ErrNotFound
 	}
+	return run, nil
 }
 
-func TestAssignOrderAndStatusUpdate(t *testing.T) {
-	fr := newFakeRepo()
-	// 预置两台空闲机器
-	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusIdle}
-	fr.machines["m2"] = &models.Machine{ID: "m2", Status: models.StatusIdle}
-	svc := NewService(fr, "test")
+func (f *fakeRepo) ListZones(ctx context.Context) ([]*models.Zone, error) {
+	out := make([]*models.Zone, 0, len(f.zones))
+	for _, z := range f.zones {
+		out = append(out, z)
+	}
+	return out, nil
+}
 
-	// 分配订单 o1，应挑选 m1
-	m, err := svc.AssignOrder(context.Background(), "o1")
-	if err != nil {
-		t.Fatalf("AssignOrder error: %v", err)
+func (f *fakeRepo) CreateZone(ctx context.Context, z *models.Zone) error {
+	if len(z.Polygon) < 3 {
+		return models.ErrInvalidGeometry
 	}
-	// 返回正确的机器，并写入 repo
-	if m.ID != "m1" {
-		t.Errorf("AssignOrder returned ID = %s; want m1", m.ID)
+	z.ID = fmt.Sprintf("zone-%d", len(f.zones)+1)
+	f.zones[z.ID] = z
+	return nil
+}
+
+func (f *fakeRepo) UpdateZone(ctx context.Context, z *models.Zone) error {
+	if _, ok := f.zones[z.ID]; !ok {
+		return models.ErrNotFound
 	}
-	if got, ok := fr.ordersAssigned["o1"]; !ok || got != "m1" {
-		t.Errorf("fakeRepo.ordersAssigned[\"o1\"] = %s; want m1", got)
+	if len(z.Polygon) < 3 {
+		return models.ErrInvalidGeometry
 	}
-	// 机器状态应更新为 InTransit
-	if fr.machines["m1"].Status != models.StatusInTransit {
-		t.Errorf("machine m1 Status = %s; want InTransit", fr.machines["m1"].Status)
+	f.zones[z.ID] = z
+	return nil
+}
+
+func (f *fakeRepo) DeleteZone(ctx context.Context, zoneID string) error {
+	if _, ok := f.zones[zoneID]; !ok {
+		return models.ErrNotFound
 	}
+	delete(f.zones, zoneID)
+	return nil
 }
 
-func TestSetMachineStatus(t *testing.T) {
-	fr := newFakeRepo()
-	// 预置一台机器
-	fr.machines["m1"] = &models.Machine{
-		ID:        "m1",
+func (f *fakeRepo) CrossesNoFlyZone(ctx context.Context, path []models.GeoPoint) (bool, error) {
+	return f.noFly, nil
+}
+
+func (f *fakeRepo) LeavesServiceArea(ctx context.Context, path []models.GeoPoint) (bool, error) {
+	return f.outsideArea, nil
+}
+
+// zoneCovers 用多边形的外接矩形代替 ST_Covers
+func zoneCovers(z *models.Zone, lon, lat float64) bool {
+	minLat, maxLat, minLon, maxLon := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	for _, p := range z.Polygon {
+		minLat, maxLat = math.Min(minLat, p.Latitude), math.Max(maxLat, p.Latitude)
+		minLon, maxLon = math.Min(minLon, p.Longitude), math.Max(maxLon, p.Longitude)
+	}
+	return lat >= minLat && lat <= maxLat && lon >= minLon && lon <= maxLon
+}
+
+func (f *fakeRepo) FindOperationalZone(ctx context.Context, lon, lat float64) (string, error) {
+	for id, z := range f.zones {
+		if z.Kind == models.ZoneOperational && zoneCovers(z, lon, lat) {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+func (f *fakeRepo) SetMachineZone(ctx context.Context, machineID string, zoneID *string) error {
+	if zoneID != nil {
+		if z, ok := f.zones[*zoneID]; !ok || z.Kind != models.ZoneOperational {
+			return models.ErrInvalidZone
+		}
+	}
+	m, ok := f.machines[machineID]
+	if !ok || m.DeletedAt != nil {
+		return models.ErrNotFound
+	}
+	m.ZoneID = zoneID
+	m.Version++
+	return nil
+}
+
+func (f *fakeRepo) ListDepots(ctx context.Context) ([]*models.Depot, error) {
+	return f.depots, nil
+}
+
+func (f *fakeRepo) CreateDepot(ctx context.Context, d *models.Depot) error {
+	d.ID = fmt.Sprintf("depot-%d", len(f.depots)+1)
+	f.depots = append(f.depots, d)
+	return nil
+}
+
+func (f *fakeRepo) DeleteDepot(ctx context.Context, id string) error {
+	for i, d := range f.depots {
+		if d.ID == id {
+			f.depots = slices.Delete(f.depots, i, i+1)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+func (f *fakeRepo) ListPricingRules(ctx context.Context) ([]*models.PricingRule, error) {
+	f.pricingReads++
+	return f.pricingRules, nil
+}
+
+func (f *fakeRepo) CreatePricingRule(ctx context.Context, rule *models.PricingRule) error {
+	rule.ID = fmt.Sprintf("rule-%d", len(f.pricingRules)+1)
+	f.pricingRules = append(f.pricingRules, rule)
+	return nil
+}
+
+func (f *fakeRepo) UpdatePricingRule(ctx context.Context, rule *models.PricingRule) error {
+	for i, r := range f.pricingRules {
+		if r.ID == rule.ID {
+			f.pricingRules[i] = rule
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+func (f *fakeRepo) DeletePricingRule(ctx context.Context, id string) error {
+	for i, r := range f.pricingRules {
+		if r.ID == id {
+			f.pricingRules = slices.Delete(f.pricingRules, i, i+1)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+func (f *fakeRepo) CountSurgeDemand(ctx context.Context, zoneID string) (int, int, error) {
+	z, ok := f.zones[zoneID]
+	if !ok {
+		return 0, 0, nil
+	}
+	idle, pending := 0, 0
+	for _, m := range f.machines {
+		if m.Status == models.StatusIdle && m.DeletedAt == nil && zoneCovers(z, m.Longitude, m.Latitude) {
+			idle++
+		}
+	}
+	for id, st := range f.orderStatuses {
+		p, ok := f.orderPickups[id]
+		if (st == models.OrderStatusConfirmed || st == models.OrderStatusAssignmentPending) && ok && zoneCovers(z, p.Longitude, p.Latitude) {
+			pending++
+		}
+	}
+	return idle, pending, nil
+}
+
+func (f *fakeRepo) FindNearestDepot(ctx context.Context, lon, lat float64) (*models.Depot, error) {
+	var best *models.Depot
+	for _, d := range f.depots {
+		at := models.GeoPoint{Latitude: lat, Longitude: lon}
+		if best == nil || haversineKM(at, d.Location) < haversineKM(at, best.Location) {
+			best = d
+		}
+	}
+	if best == nil {
+		return nil, models.ErrNotFound
+	}
+	return best, nil
+}
+
+func (f *fakeRepo) SaveChargeTrip(ctx context.Context, trip *models.ChargeTrip) error {
+	trip.StartedAt = time.Now()
+	f.chargeTrips[trip.MachineID] = trip
+	return nil
+}
+
+func (f *fakeRepo) GetChargeTrip(ctx context.Context, machineID string) (*models.ChargeTrip, error) {
+	trip, ok := f.chargeTrips[machineID]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	return trip, nil
+}
+
+func (f *fakeRepo) DeleteChargeTrip(ctx context.Context, machineID string) error {
+	delete(f.chargeTrips, machineID)
+	return nil
+}
+
+func (f *fakeRepo) CreateTrackingEvent(ctx context.Context, ev *models.TrackingEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ev.ID = fmt.Sprintf("track-%d", len(f.trackingEvents)+1)
+	ev.CreatedAt = time.Now()
+	f.trackingEvents = append(f.trackingEvents, ev)
+	return nil
+}
+
+func (f *fakeRepo) CreateTrackingEvents(ctx context.Context, evs []*models.TrackingEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ev := range evs {
+		ev.ID = fmt.Sprintf("track-%d", len(f.trackingEvents)+1)
+		f.trackingEvents = append(f.trackingEvents, ev)
+	}
+	return nil
+}
+
+func (f *fakeRepo) ListTrackingEvents(ctx context.Context, orderID string, q models.TrackingQuery) ([]*models.TrackingEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []*models.TrackingEvent{}
+	for _, ev := range f.trackingEvents {
+		if ev.OrderID != orderID || !ev.CreatedAt.After(q.Since) {
+			continue
+		}
+		// 假仓库的事件按插入顺序排列，游标按 ID 跳过已返回的事件
+		if q.After != nil && ev.ID <= q.After.ID {
+			continue
+		}
+		if len(out) == q.Limit {
+			break
+		}
+		cp := *ev
+		out = append(out, &cp)
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) GetLatestTrackingEvent(ctx context.Context, orderID string) (*models.TrackingEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.trackingEvents) - 1; i >= 0; i-- {
+		if f.trackingEvents[i].OrderID == orderID {
+			cp := *f.trackingEvents[i]
+			return &cp, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeRepo) MarkOrderArrived(ctx context.Context, orderID string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.orderStatuses[orderID] != models.OrderStatusInProgress {
+		return false, nil
+	}
+	f.orderStatuses[orderID] = models.OrderStatusArrived
+	return true, nil
+}
+
+// ----------------------------------------------------------------------------
+// newTestService: 构造带有 FakeRepo 和可定制 HTTP 模拟响应的 Service 实例
+// ----------------------------------------------------------------------------
+func newTestService(fr *fakeRepo, respBody string, opts ...Option) ServiceInterface {
+	return NewService(fr, "test", append(opts, WithHTTPClient(&http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			// 模拟 API 返回 JSON 格式的路线数据
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(respBody)),
+				Header:     http.Header{},
+			}, nil
+		}),
+	}))...)
+}
+
+// ----------------------------------------------------------------------------
+// 单元测试：针对各业务函数的功能与 FakeRepo 状态变更做完整覆盖
+// ----------------------------------------------------------------------------
+
+func TestQuotePrice(t *testing.T) {
+	morning := time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC)
+	afternoon := time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC)
+	// 内置规则 — 非高峰：Drone 1 km → 基础费 2.0 + 0.5/km = 2.50
+	if c, ok := quotePrice(nil, models.MachineTypeDrone, 1000, afternoon); !ok || c != 2.5 {
+		t.Errorf("quotePrice non-peak drone = %.2f, %v; want 2.50", c, ok)
+	}
+	// 高峰：Robot 只收 1.2 倍基础费 1.0 → 1.20
+	if c, ok := quotePrice(nil, models.MachineTypeRobot, 1000, morning); !ok || c != 1.2 {
+		t.Errorf("quotePrice peak robot = %.2f, %v; want 1.20", c, ok)
+	}
+
+	// 配置了规则的机器类型只按配置计价：5 km 以上分段更便宜，夜间（22–6 点，跨午夜）上浮 50%
+	maxKM, start, end := 5.0, 22, 6
+	rules := []*models.PricingRule{
+		{MachineType: models.MachineTypeDrone, MaxKM: &maxKM, BaseFare: 3, PerKM: 1, Multiplier: 1},
+		{MachineType: models.MachineTypeDrone, MinKM: 5, BaseFare: 5, PerKM: 0.5, Multiplier: 1},
+		{MachineType: models.MachineTypeDrone, StartHour: &start, EndHour: &end, MaxKM: &maxKM, BaseFare: 3, PerKM: 1, Multiplier: 1.5},
+	}
+	tests := []struct {
+		name   string
+		mt     models.MachineType
+		meters int
+		at     time.Time
+		want   float64
+		ok     bool
+	}{
+		{"first tier", models.MachineTypeDrone, 2000, afternoon, 5, true},
+		{"second tier", models.MachineTypeDrone, 10000, afternoon, 10, true},
+		{"night window before midnight", models.MachineTypeDrone, 2000, time.Date(2023, 1, 1, 23, 0, 0, 0, time.UTC), 7.5, true},
+		{"night window after midnight", models.MachineTypeDrone, 2000, time.Date(2023, 1, 1, 5, 0, 0, 0, time.UTC), 7.5, true},
+		{"night window ends", models.MachineTypeDrone, 2000, time.Date(2023, 1, 1, 6, 0, 0, 0, time.UTC), 5, true},
+		{"night outside its tier", models.MachineTypeDrone, 10000, time.Date(2023, 1, 1, 23, 0, 0, 0, time.UTC), 10, true},
+		{"unconfigured type uses defaults", models.MachineTypeRobot, 1000, afternoon, 1.3, true},
+	}
+	for _, tt := range tests {
+		if got, ok := quotePrice(rules, tt.mt, tt.meters, tt.at); got != tt.want || ok != tt.ok {
+			t.Errorf("%s: quotePrice = %.2f, %v; want %.2f, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+	// 分段之间有空隙时该距离不计价
+	if _, ok := quotePrice(rules[:1], models.MachineTypeDrone, 10000, afternoon); ok {
+		t.Error("quotePrice beyond the last tier ok = true; want false")
+	}
+}
+
+func TestPricingRules(t *testing.T) {
+	fr := newFakeRepo()
+	bus := &fakeBus{}
+	// 两个实例共享同一个数据库和失效总线
+	a := NewService(NewCachedRepository(fr, bus), "test")
+	b := NewService(NewCachedRepository(fr, bus), "test")
+	ctx := context.Background()
+
+	// 字段关系校验
+	maxKM, start := 1.0, 8
+	for name, req := range map[string]models.PricingRuleRequest{
+		"max below min": {MachineType: models.MachineTypeDrone, MinKM: 2, MaxKM: &maxKM},
+		"start only":    {MachineType: models.MachineTypeDrone, StartHour: &start},
+		"empty window":  {MachineType: models.MachineTypeDrone, StartHour: &start, EndHour: &start},
+	} {
+		var apiErr *models.APIError
+		if _, err := a.CreatePricingRule(ctx, req); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+			t.Errorf("%s: CreatePricingRule error = %v; want VALIDATION_FAILED", name, err)
+		}
+	}
+
+	// 实例 b 缓存规则：重复读取不回源
+	b.ListPricingRules(ctx)
+	b.ListPricingRules(ctx)
+	if fr.pricingReads != 1 {
+		t.Errorf("repository reads = %d; want 1 (cached)", fr.pricingReads)
+	}
+	// 实例 a 的写入通过总线让实例 b 的缓存失效；倍率缺省为 1
+	rule, err := a.CreatePricingRule(ctx, models.PricingRuleRequest{MachineType: models.MachineTypeDrone, BaseFare: 4, PerKM: 1})
+	if err != nil {
+		t.Fatalf("CreatePricingRule error: %v", err)
+	}
+	if rule.Multiplier != 1 {
+		t.Errorf("Multiplier = %v; want default 1", rule.Multiplier)
+	}
+	rules, _ := b.ListPricingRules(ctx)
+	if len(rules) != 1 || rules[0].BaseFare != 4 {
+		t.Fatalf("rules after create = %+v; want the new rule", rules)
+	}
+	if _, err := a.UpdatePricingRule(ctx, "missing", models.PricingRuleRequest{MachineType: models.MachineTypeDrone}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("UpdatePricingRule(missing) error = %v; want ErrNotFound", err)
+	}
+	if err := a.DeletePricingRule(ctx, rule.ID); err != nil {
+		t.Fatalf("DeletePricingRule error: %v", err)
+	}
+	if rules, _ := b.ListPricingRules(ctx); len(rules) != 0 {
+		t.Errorf("rules after delete = %+v; want none", rules)
+	}
+}
+
+func TestCalculateRouteOptions(t *testing.T) {
+	fr := newFakeRepo()
+	// 预置 orderID → 地址映射
+	fr.orderDest["order123"] = "DEST-123"
+	// 模拟 Google Routes API 返回的数据
+	resp := `{"routes":[{"overview_polyline":{"points":"abc"},"legs":[{"distance":{"value":1000},"duration":{"value":600}}]},{"overview_polyline":{"points":"def"},"legs":[{"distance":{"value":2000},"duration":{"value":1200}}]}]}`
+	svc := newTestService(fr, resp)
+
+	// 构造请求：模拟 API 对每种出行方式都返回 1000m/600s 的路线
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A"},
+		DeliveryLocation: models.Address{StreetAddress: "B"},
+		WeightKG:         2,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC),
+	}
+	opts, err := svc.CalculateRouteOptions(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CalculateRouteOptions error: %v", err)
+	}
+	// 返回了 2 种选项：最快和最便宜
+	if len(opts) != 2 {
+		t.Fatalf("got %d options; want 2", len(opts))
+	}
+
+	// Fastest: Drone
+	fast := opts[0]
+	if fast.MachineType != models.MachineTypeDrone {
+		t.Errorf("fastest MachineType = %s; want Drone", fast.MachineType)
+	}
+	if fast.DurationSeconds != 600 {
+		t.Errorf("fastest DurationSeconds = %d; want 600", fast.DurationSeconds)
+	}
+	// 9 点高峰：只收 1.2 倍基础费
+	if fast.EstimatedCost != 2.4 {
+		t.Errorf("fastest EstimatedCost = %.2f; want 2.40", fast.EstimatedCost)
+	}
+
+	// Cheapest: Robot
+	cheap := opts[1]
+	if cheap.MachineType != models.MachineTypeRobot {
+		t.Errorf("cheapest MachineType = %s; want Robot", cheap.MachineType)
+	}
+	if cheap.DurationSeconds != 600 {
+		t.Errorf("cheapest DurationSeconds = %d; want 600 (walking route, no extra factor)", cheap.DurationSeconds)
+	}
+	if cheap.EstimatedCost != 1.2 {
+		t.Errorf("cheapest EstimatedCost = %.2f; want 1.20", cheap.EstimatedCost)
+	}
+
+	// 确认 SaveRoute 被调用，fakeRepo 中 routes 列表新增了 2 条
+	if len(fr.routes) != 2 {
+		t.Errorf("fakeRepo.routes length = %d; want 2", len(fr.routes))
+	}
+
+	// 超出无人机承载能力：只剩地面机器人选项
+	req.WeightKG = 5
+	if opts, err := svc.CalculateRouteOptions(context.Background(), req); err != nil || len(opts) != 1 || opts[0].MachineType != models.MachineTypeRobot {
+		t.Errorf("CalculateRouteOptions(5 kg) = %v, %v; want only a Robot option", opts, err)
+	}
+	// 超出所有机器的承载能力
+	req.WeightKG = 2
+	req.Dimensions.Height = 1.2
+	if _, err := svc.CalculateRouteOptions(context.Background(), req); !errors.Is(err, models.ErrPackageTooLarge) {
+		t.Errorf("CalculateRouteOptions(1.2 m) error = %v; want ErrPackageTooLarge", err)
+	}
+}
+
+func TestMachineCapacityFits(t *testing.T) {
+	c := models.MachineCapacity{MaxWeightKG: 3, MaxLengthM: 0.8, MaxWidthM: 0.4, MaxHeightM: 0.2}
+	tests := []struct {
+		weight float64
+		dims   models.Dimensions
+		want   bool
+	}{
+		{3, models.Dimensions{Length: 0.8, Width: 0.4, Height: 0.2}, true},
+		{3.1, models.Dimensions{Length: 0.1, Width: 0.1, Height: 0.1}, false},
+		// 可以旋转包裹：长边对应最长的限制
+		{1, models.Dimensions{Length: 0.2, Width: 0.4, Height: 0.8}, true},
+		{1, models.Dimensions{Length: 0.5, Width: 0.5, Height: 0.1}, false},
+	}
+	for _, tt := range tests {
+		if got := c.Fits(tt.weight, tt.dims); got != tt.want {
+			t.Errorf("Fits(%v, %+v) = %v; want %v", tt.weight, tt.dims, got, tt.want)
+		}
+	}
+}
+
+func TestAssignOrderRespectsCapacity(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.78, Longitude: -122.40, BatteryLevel: 100}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Type: models.MachineTypeRobot, Status: models.StatusIdle, Latitude: 37.80, Longitude: -122.40, BatteryLevel: 100}
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 37.78, Longitude: -122.40}
+	fr.orderPackages["o1"] = models.Order{ItemWeightKg: 5, Dimensions: models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3}}
+	svc := NewService(fr, "test")
+
+	// 无人机更近，但 5 kg 超出其载重，应分配地面机器人
+	if m, err := svc.AssignOrder(context.Background(), "o1"); err != nil || m.ID != "m2" {
+		t.Errorf("AssignOrder = %v, %v; want robot m2", m, err)
+	}
+
+	// 没有坐标时的兜底路径同样过滤机器类型
+	fr.orderPackages["o2"] = fr.orderPackages["o1"]
+	if _, err := svc.AssignOrder(context.Background(), "o2"); !errors.Is(err, models.ErrNoMachineAvailable) {
+		t.Errorf("AssignOrder with only a drone idle error = %v; want ErrNoMachineAvailable", err)
+	}
+
+	fr.orderPackages["o3"] = models.Order{ItemWeightKg: 20}
+	if _, err := svc.AssignOrder(context.Background(), "o3"); !errors.Is(err, models.ErrPackageTooLarge) {
+		t.Errorf("AssignOrder(20 kg) error = %v; want ErrPackageTooLarge", err)
+	}
+}
+
+func TestAssignOrderAndStatusUpdate(t *testing.T) {
+	fr := newFakeRepo()
+	// 预置两台空闲机器
+	fr.machines["m1"] = &models.Machine{ID: "m1", Type: models.MachineTypeDrone, Status: models.StatusIdle}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Type: models.MachineTypeDrone, Status: models.StatusIdle}
+	svc := NewService(fr, "test")
+
+	// 分配订单 o1，应挑选 m1
+	m, err := svc.AssignOrder(context.Background(), "o1")
+	if err != nil {
+		t.Fatalf("AssignOrder error: %v", err)
+	}
+	// 返回正确的机器，并写入 repo
+	if m.ID != "m1" {
+		t.Errorf("AssignOrder returned ID = %s; want m1", m.ID)
+	}
+	if got, ok := fr.ordersAssigned["o1"]; !ok || got != "m1" {
+		t.Errorf("fakeRepo.ordersAssigned[\"o1\"] = %s; want m1", got)
+	}
+	// 机器状态应更新为 InTransit
+	if fr.machines["m1"].Status != models.StatusInTransit {
+		t.Errorf("machine m1 Status = %s; want InTransit", fr.machines["m1"].Status)
+	}
+}
+
+func TestAssignOrderPicksNearestMachine(t *testing.T) {
+	fr := newFakeRepo()
+	// 旧金山附近：m2 距取件点约 1 km，m1 约 5 km，m3 最近但不空闲
+	fr.machines["m1"] = &models.Machine{ID: "m1", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.82, Longitude: -122.40, BatteryLevel: 100}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.79, Longitude: -122.40, BatteryLevel: 100}
+	fr.machines["m3"] = &models.Machine{ID: "m3", Type: models.MachineTypeDrone, Status: models.StatusInTransit, Latitude: 37.78, Longitude: -122.40, BatteryLevel: 100}
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 37.78, Longitude: -122.40}
+	fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 37.77, Longitude: -122.41}
+	svc := NewService(fr, "test")
+
+	// 应选择空闲机器中最近的 m2，而不是 ID 最小的 m1
+	m, err := svc.AssignOrder(context.Background(), "o1")
+	if err != nil {
+		t.Fatalf("AssignOrder error: %v", err)
+	}
+	if m.ID != "m2" {
+		t.Errorf("AssignOrder picked %s; want nearest idle machine m2", m.ID)
+	}
+
+	// 电量不足以完成往返的机器被跳过：m1 满电，m4 最近但电量只剩 15%
+	fr.machines["m4"] = &models.Machine{ID: "m4", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.78, Longitude: -122.40, BatteryLevel: 15}
+	fr.orderPickups["o2"] = fr.orderPickups["o1"]
+	fr.orderDropoffs["o2"] = fr.orderDropoffs["o1"]
+	if m, err := svc.AssignOrder(context.Background(), "o2"); err != nil || m.ID != "m1" {
+		t.Errorf("AssignOrder = %v, %v; want m1 (m4 lacks battery)", m, err)
+	}
+
+	// 没有电量足够的空闲机器时返回 ErrNoMachineAvailable
+	fr.orderPickups["o3"] = fr.orderPickups["o1"]
+	fr.orderDropoffs["o3"] = fr.orderDropoffs["o1"]
+	if _, err := svc.AssignOrder(context.Background(), "o3"); !errors.Is(err, models.ErrNoMachineAvailable) {
+		t.Errorf("AssignOrder with only low-battery machines error = %v; want ErrNoMachineAvailable", err)
+	}
+}
+
+// racingRepo 模拟并发支付：列出候选机器之后、领取之前，另一个订单抢先领取了最近的机器。
+type racingRepo struct {
+	*fakeRepo
+	raced bool
+}
+
+func (r *racingRepo) ListNearestIdleMachines(ctx context.Context, lon, lat float64, types []models.MachineType, zoneID string, limit int) ([]*models.Machine, error) {
+	out, err := r.fakeRepo.ListNearestIdleMachines(ctx, lon, lat, types, zoneID, limit)
+	if err == nil && !r.raced && len(out) > 0 {
+		r.raced = true
+		if err := r.fakeRepo.ClaimMachine(ctx, out[0].ID, "other"); err != nil {
+			return nil, err
+		}
+	}
+	return out, err
+}
+
+func TestAssignOrderSkipsClaimedMachine(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.79, Longitude: -122.40, BatteryLevel: 100}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.82, Longitude: -122.40, BatteryLevel: 100}
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 37.78, Longitude: -122.40}
+	fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 37.77, Longitude: -122.41}
+	svc := NewService(&racingRepo{fakeRepo: fr}, "test")
+
+	// 最近的 m1 已被 other 领取，o1 应改用 m2，而不是与 other 共用 m1
+	m, err := svc.AssignOrder(context.Background(), "o1")
+	if err != nil {
+		t.Fatalf("AssignOrder error: %v", err)
+	}
+	if m.ID != "m2" || fr.ordersAssigned["o1"] != "m2" || fr.ordersAssigned["other"] != "m1" {
+		t.Errorf("AssignOrder picked %s (assignments %v); want m2 after m1 was claimed", m.ID, fr.ordersAssigned)
+	}
+
+	// 所有候选机器都被领取时返回 ErrNoMachineAvailable
+	fr.machines["m3"] = &models.Machine{ID: "m3", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.79, Longitude: -122.40, BatteryLevel: 100}
+	fr.orderPickups["o2"] = fr.orderPickups["o1"]
+	fr.orderDropoffs["o2"] = fr.orderDropoffs["o1"]
+	svc = NewService(&racingRepo{fakeRepo: fr}, "test")
+	if _, err := svc.AssignOrder(context.Background(), "o2"); !errors.Is(err, models.ErrNoMachineAvailable) {
+		t.Errorf("AssignOrder with every candidate claimed error = %v; want ErrNoMachineAvailable", err)
+	}
+}
+
+func TestAssignOrderStaysInPickupZone(t *testing.T) {
+	ctx := context.Background()
+	fr := newFakeRepo()
+	svc := NewService(fr, "test")
+	zone, err := svc.CreateZone(ctx, models.ZoneRequest{Name: "downtown", Kind: models.ZoneOperational, Polygon: []models.GeoPoint{
+		{Latitude: 37.70, Longitude: -122.50}, {Latitude: 37.70, Longitude: -122.30}, {Latitude: 37.80, Longitude: -122.30}, {Latitude: 37.80, Longitude: -122.50},
+	}})
+	if err != nil {
+		t.Fatalf("CreateZone error: %v", err)
+	}
+	// m1 最近但不属于运营区，m2 较远但在区内
+	fr.machines["m1"] = &models.Machine{ID: "m1", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.78, Longitude: -122.40, BatteryLevel: 100}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.76, Longitude: -122.40, BatteryLevel: 100}
+	if _, err := svc.SetMachineZone(ctx, "m2", models.MachineZoneRequest{ZoneID: &zone.ID}); err != nil {
+		t.Fatalf("SetMachineZone error: %v", err)
+	}
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 37.78, Longitude: -122.40}
+	fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 37.77, Longitude: -122.41}
+
+	m, err := svc.AssignOrder(ctx, "o1")
+	if err != nil {
+		t.Fatalf("AssignOrder error: %v", err)
+	}
+	if m.ID != "m2" {
+		t.Errorf("AssignOrder picked %s; want m2 from the pickup zone", m.ID)
+	}
+
+	// 区外取件不受运营区限制
+	fr.orderPickups["o2"] = models.GeoPoint{Latitude: 37.85, Longitude: -122.40}
+	fr.orderDropoffs["o2"] = models.GeoPoint{Latitude: 37.86, Longitude: -122.41}
+	if m, err := svc.AssignOrder(ctx, "o2"); err != nil || m.ID != "m1" {
+		t.Errorf("AssignOrder outside zones = %v, %v; want m1", m, err)
+	}
+
+	// 只能移入已有的运营区
+	noFly, _ := svc.CreateZone(ctx, models.ZoneRequest{Name: "airport", Kind: models.ZoneNoFly, Polygon: zone.Polygon})
+	if _, err := svc.SetMachineZone(ctx, "m1", models.MachineZoneRequest{ZoneID: &noFly.ID}); !errors.Is(err, models.ErrInvalidZone) {
+		t.Errorf("SetMachineZone(no-fly zone) error = %v; want ErrInvalidZone", err)
+	}
+}
+
+func TestBatteryPolicy(t *testing.T) {
+	p := DefaultBatteryPolicy()
+	at := func(lat, lon float64) models.GeoPoint { return models.GeoPoint{Latitude: lat, Longitude: lon} }
+	drone := &models.Machine{Type: models.MachineTypeDrone, Latitude: 0, Longitude: 0}
+	robot := &models.Machine{Type: models.MachineTypeRobot, Latitude: 0, Longitude: 0}
+
+	// 原地取件、原地投递：只需要保留电量
+	if got := p.RequiredBattery(drone, at(0, 0), at(0, 0)); got != p.ReservePercent {
+		t.Errorf("RequiredBattery for a zero-length trip = %v; want reserve %v", got, p.ReservePercent)
+	}
+	// 0.05° 纬度约 5.56 km：往返约 11.1 km
+	droneNeed := p.RequiredBattery(drone, at(0, 0), at(0.05, 0))
+	if want := 11.12*4*1.2 + 10; math.Abs(droneNeed-want) > 0.5 {
+		t.Errorf("drone RequiredBattery = %.2f; want about %.2f", droneNeed, want)
+	}
+	// 地面机器人单位耗电更低，但绕行系数更高
+	if robotNeed := p.RequiredBattery(robot, at(0, 0), at(0.05, 0)); robotNeed >= droneNeed {
+		t.Errorf("robot RequiredBattery %.2f >= drone %.2f; want less", robotNeed, droneNeed)
+	}
+	if !math.IsInf(p.RequiredBattery(&models.Machine{Type: "HOVERCRAFT"}, at(0, 0), at(0, 0)), 1) {
+		t.Error("RequiredBattery for an unknown machine type is finite; want +Inf")
+	}
+}
+
+func TestGetFleetStats(t *testing.T) {
+	fr := newFakeRepo()
+	deleted := time.Now()
+	fr.machines["d1"] = &models.Machine{ID: "d1", Type: models.MachineTypeDrone, Status: models.StatusIdle, BatteryLevel: 80}
+	fr.machines["d2"] = &models.Machine{ID: "d2", Type: models.MachineTypeDrone, Status: models.StatusOffline, BatteryLevel: 40}
+	fr.machines["r1"] = &models.Machine{ID: "r1", Type: models.MachineTypeRobot, Status: models.StatusInTransit, BatteryLevel: 60}
+	fr.machines["r2"] = &models.Machine{ID: "r2", Type: models.MachineTypeRobot, Status: models.StatusIdle, BatteryLevel: 10, DeletedAt: &deleted}
+	fr.orderStatuses["o1"] = models.OrderStatusInProgress
+	fr.orderStatuses["o2"] = models.OrderStatusArrived // 已到达、等待收件人确认的订单仍在配送中
+	fr.orderStatuses["o3"] = models.OrderStatusDelivered
+	svc := NewService(fr, "test")
+
+	stats, err := svc.GetFleetStats(context.Background())
+	if err != nil {
+		t.Fatalf("GetFleetStats error: %v", err)
+	}
+	if stats.TotalMachines != 3 || stats.ByType[models.MachineTypeDrone] != 2 || stats.ByStatus[models.StatusIdle] != 1 {
+		t.Errorf("stats = %+v; want 3 machines, 2 drones, 1 idle (deleted r2 not counted)", stats)
+	}
+	if stats.AverageBatteryLevel != 60 || stats.MachinesOffline != 1 || stats.OrdersInTransit != 2 {
+		t.Errorf("battery %.1f, offline %d, in transit %d; want 60, 1, 2", stats.AverageBatteryLevel, stats.MachinesOffline, stats.OrdersInTransit)
+	}
+}
+
+func TestBatchOrders(t *testing.T) {
+	fr := newFakeRepo()
+	// 旧金山附近：无人机离取件点最近，但批量配送只使用地面机器人
+	fr.machines["d1"] = &models.Machine{ID: "d1", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.780, Longitude: -122.400, BatteryLevel: 100}
+	fr.machines["r1"] = &models.Machine{ID: "r1", Type: models.MachineTypeRobot, Status: models.StatusIdle, Latitude: 37.775, Longitude: -122.400, BatteryLevel: 100}
+	for id, pts := range map[string][2]models.GeoPoint{
+		"o1": {{Latitude: 37.780, Longitude: -122.400}, {Latitude: 37.790, Longitude: -122.410}},
+		"o2": {{Latitude: 37.782, Longitude: -122.401}, {Latitude: 37.786, Longitude: -122.405}},
+	} {
+		fr.orderPickups[id], fr.orderDropoffs[id] = pts[0], pts[1]
+		fr.orderStatuses[id] = models.OrderStatusConfirmed
+		fr.orderPackages[id] = models.Order{ItemWeightKg: 4}
+	}
+	svc := NewService(fr, "test")
+
+	run, err := svc.BatchOrders(context.Background(), []string{"o1", "o2"})
+	if err != nil {
+		t.Fatalf("BatchOrders error: %v", err)
+	}
+	if run.MachineID != "r1" {
+		t.Errorf("run machine = %s; want robot r1", run.MachineID)
+	}
+	// 最近邻：o1 取件 → o2 取件 → o2 投递（更近）→ o1 投递
+	want := []struct {
+		order string
+		kind  models.StopKind
+	}{{"o1", models.StopPickup}, {"o2", models.StopPickup}, {"o2", models.StopDropoff}, {"o1", models.StopDropoff}}
+	if len(run.Stops) != len(want) {
+		t.Fatalf("got %d stops; want %d", len(run.Stops), len(want))
+	}
+	for i, w := range want {
+		st := run.Stops[i]
+		if st.Seq != i+1 || st.OrderID != w.order || st.Kind != w.kind {
+			t.Errorf("stop %d = %d %s %s; want %d %s %s", i, st.Seq, st.OrderID, st.Kind, i+1, w.order, w.kind)
+		}
+		if i > 0 && (!st.ETA.After(run.Stops[i-1].ETA) || st.DistanceMeters < run.Stops[i-1].DistanceMeters) {
+			t.Errorf("stop %d ETA/distance not increasing", i+1)
+		}
+	}
+	if len(run.Segments) != 2 || run.Segments[0].OrderID != "o1" || run.Segments[0].PickupSeq != 1 || run.Segments[0].DropoffSeq != 4 {
+		t.Errorf("segments = %+v; want o1 spanning stops 1–4 first", run.Segments)
+	}
+	if fr.ordersAssigned["o1"] != "r1" || fr.ordersAssigned["o2"] != "r1" || fr.machines["r1"].Status != models.StatusInTransit {
+		t.Error("orders not assigned to r1 or r1 not IN_TRANSIT")
+	}
+
+	// 已分配或未支付的订单不能再合并
+	fr.orderStatuses["o3"] = models.OrderStatusPendingPayment
+	if _, err := svc.BatchOrders(context.Background(), []string{"o1", "o3"}); !errors.Is(err, models.ErrOrderNotBatchable) {
+		t.Errorf("BatchOrders with assigned order error = %v; want ErrOrderNotBatchable", err)
+	}
+}
+
+// failingRunRepo 保存配送任务失败
+type failingRunRepo struct {
+	*fakeRepo
+}
+
+func (r failingRunRepo) CreateDeliveryRun(ctx context.Context, run *models.DeliveryRun) error {
+	return errors.New("insert failed")
+}
+
+// rollbackTx 模拟事务：fn 失败时恢复机器状态与订单分配
+type rollbackTx struct {
+	fr *fakeRepo
+}
+
+func (tx rollbackTx) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	statuses := make(map[string]models.MachineStatus, len(tx.fr.machines))
+	for id, m := range tx.fr.machines {
+		statuses[id] = m.Status
+	}
+	assigned := make(map[string]string, len(tx.fr.ordersAssigned))
+	for id, m := range tx.fr.ordersAssigned {
+		assigned[id] = m
+	}
+	if err := fn(ctx); err != nil {
+		for id, st := range statuses {
+			tx.fr.machines[id].Status = st
+		}
+		tx.fr.ordersAssigned = assigned
+		return err
+	}
+	return nil
+}
+
+func TestBatchOrdersRollsBackClaim(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["r1"] = &models.Machine{ID: "r1", Type: models.MachineTypeRobot, Status: models.StatusIdle, Latitude: 37.775, Longitude: -122.400, BatteryLevel: 100}
+	fr.orderPickups["o1"], fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 37.780, Longitude: -122.400}, models.GeoPoint{Latitude: 37.790, Longitude: -122.410}
+	fr.orderStatuses["o1"] = models.OrderStatusConfirmed
+	svc := NewService(failingRunRepo{fr}, "test", WithTxManager(rollbackTx{fr}))
+
+	if _, err := svc.BatchOrders(context.Background(), []string{"o1"}); err == nil {
+		t.Fatal("BatchOrders succeeded although the run was not saved")
+	}
+	// 任务未保存时机器人仍空闲，订单也未分配
+	if fr.machines["r1"].Status != models.StatusIdle || fr.ordersAssigned["o1"] != "" {
+		t.Errorf("r1 is %s and o1 assigned to %q; want the claim rolled back", fr.machines["r1"].Status, fr.ordersAssigned["o1"])
+	}
+}
+
+func TestSetMachineStatus(t *testing.T) {
+	fr := newFakeRepo()
+	// 预置一台机器
+	fr.machines["m1"] = &models.Machine{
+		ID:        "m1",
 		Status:    models.StatusIdle,
 		Latitude:  1.0,
 		Longitude: 2.0,
 	}
 	svc := NewService(fr, "test")
 
-	// 更新状态及位置
-	req := models.MachineStatusUpdateRequest{
-		Status:    models.StatusCharging,
-		Latitude:  3.0,
-		Longitude: 4.0,
+	// 更新状态及位置
+	req := models.MachineStatusUpdateRequest{
+		Status:    models.StatusCharging,
+		Latitude:  3.0,
+		Longitude: 4.0,
+	}
+	if err := svc.SetMachineStatus(context.Background(), "m1", req); err != nil {
+		t.Fatalf("SetMachineStatus error: %v", err)
+	}
+	// 验证 repo 中的机器记录已被更新
+	updated := fr.machines["m1"]
+	if updated.Status != models.StatusCharging {
+		t.Errorf("updated.Status = %s; want Charging", updated.Status)
+	}
+	if updated.Latitude != 3.0 || updated.Longitude != 4.0 {
+		t.Errorf("updated coords = (%f,%f); want (3,4)", updated.Latitude, updated.Longitude)
+	}
+}
+
+func TestComputeRoute(t *testing.T) {
+	fr := newFakeRepo()
+	// 预置目的地映射
+	fr.orderDest["o1"] = "dest-X"
+	resp := `{"routes":[{"overview_polyline":{"points":"xyz"},"legs":[{"distance":{"value":500},"duration":{"value":300}}]}]}`
+	svc := newTestService(fr, resp)
+
+	route, err := svc.ComputeRoute(context.Background(), "o1", nil)
+	if err != nil {
+		t.Fatalf("ComputeRoute error: %v", err)
+	}
+	// 验证返回值及 repo 保存行为
+	if route.DistanceMeters != 500 {
+		t.Errorf("ComputeRoute DistanceMeters = %d; want 500", route.DistanceMeters)
+	}
+	if len(fr.routes) != 1 {
+		t.Errorf("fakeRepo.routes length = %d; want 1", len(fr.routes))
+	}
+}
+
+func TestQuoteDeliveryWindow(t *testing.T) {
+	fr := newFakeRepo()
+	resp := `{"routes":[{"overview_polyline":{"points":"abc"},"legs":[{"distance":{"value":1000},"duration":{"value":600}}]}]}`
+	svc := newTestService(fr, resp)
+	ctx := context.Background()
+	pickup := time.Now().Add(48 * time.Hour).Truncate(time.Hour)
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A"},
+		DeliveryLocation: models.Address{StreetAddress: "B"},
+		WeightKG:         1,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    pickup,
+	}
+
+	// 没有时间窗：只给出预计到达时间
+	opts, err := svc.CalculateRouteOptions(ctx, req)
+	if err != nil {
+		t.Fatalf("CalculateRouteOptions error: %v", err)
+	}
+	if o := opts[0]; !o.PickupTime.Equal(pickup) || !o.EstimatedArrival.Equal(pickup.Add(10*time.Minute)) || o.WindowFeasible != nil {
+		t.Errorf("option = pickup %v, arrival %v, feasible %v; want %v, +10m, unset", o.PickupTime, o.EstimatedArrival, o.WindowFeasible, pickup)
+	}
+
+	tests := []struct {
+		name   string
+		window models.DeliveryWindow
+		want   bool
+	}{
+		{"arrives inside", models.DeliveryWindow{Start: pickup, End: pickup.Add(time.Hour)}, true},
+		{"arrives after the end", models.DeliveryWindow{Start: pickup.Add(-time.Hour), End: pickup.Add(5 * time.Minute)}, false},
+		{"arrives before the start", models.DeliveryWindow{Start: pickup.Add(time.Hour), End: pickup.Add(2 * time.Hour)}, false},
+	}
+	for _, tt := range tests {
+		req.DeliveryWindow = &tt.window
+		opts, err := svc.CalculateRouteOptions(ctx, req)
+		if err != nil {
+			t.Fatalf("%s: CalculateRouteOptions error: %v", tt.name, err)
+		}
+		for _, o := range opts {
+			if o.WindowFeasible == nil || *o.WindowFeasible != tt.want {
+				t.Errorf("%s: %s WindowFeasible = %v; want %v", tt.name, o.MachineType, o.WindowFeasible, tt.want)
+			}
+		}
+	}
+
+	// 过短的时间窗
+	req.DeliveryWindow = &models.DeliveryWindow{Start: pickup, End: pickup.Add(10 * time.Minute)}
+	var apiErr *models.APIError
+	if _, err := svc.CalculateRouteOptions(ctx, req); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+		t.Errorf("CalculateRouteOptions with a 10 minute window error = %v; want a validation error", err)
+	}
+}
+
+func TestQuoteCache(t *testing.T) {
+	fr := newFakeRepo()
+	calls := 0
+	resp := `{"routes":[{"overview_polyline":{"points":"abc"},"legs":[{"distance":{"value":1000},"duration":{"value":600}}]}]}`
+	svc := NewService(fr, "test", WithQuoteCache(cache.NewMemory(0), time.Minute), WithHTTPClient(&http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(resp)),
+				Header:     http.Header{},
+			}, nil
+		}),
+	}))
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "1 Market St"},
+		DeliveryLocation: models.Address{StreetAddress: "2 Mission St"},
+		WeightKG:         2,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    time.Date(2023, 1, 1, 9, 5, 0, 0, time.UTC),
+	}
+	quote := func(req models.RouteRequest) []models.RouteOption {
+		t.Helper()
+		opts, err := svc.CalculateRouteOptions(context.Background(), req)
+		if err != nil {
+			t.Fatalf("CalculateRouteOptions error: %v", err)
+		}
+		return opts
+	}
+
+	first := quote(req)
+	// 同一小时内、地址只差大小写与空白：命中缓存，报价相同
+	again := req
+	again.PickupLocation.StreetAddress = "1  market st"
+	again.RequestedTime = req.RequestedTime.Add(40 * time.Minute)
+	second := quote(again)
+	if calls != 2 {
+		t.Errorf("maps API calls = %d; want 2 (one per machine type, second quote cached)", calls)
+	}
+	if len(second) != len(first) || second[0].DistanceMeters != 1000 || second[0].EstimatedCost != first[0].EstimatedCost {
+		t.Errorf("cached quote = %+v; want the same as %+v", second, first)
+	}
+
+	// 下一个小时重新调用
+	later := req
+	later.RequestedTime = req.RequestedTime.Add(time.Hour)
+	quote(later)
+	if calls != 4 {
+		t.Errorf("maps API calls = %d; want 4 (new hour bucket)", calls)
+	}
+}
+
+func TestGoogleRoutesTravelModes(t *testing.T) {
+	fr := newFakeRepo()
+	type routesBody struct {
+		Origin struct {
+			Address string `json:"address"`
+		} `json:"origin"`
+		TravelMode        string `json:"travelMode"`
+		RoutingPreference string `json:"routingPreference"`
+	}
+	var bodies []routesBody
+	client := &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method != http.MethodPost || req.Header.Get("X-Goog-Api-Key") != "k" || req.Header.Get("X-Goog-FieldMask") == "" {
+				t.Errorf("Routes API request %s with headers %v", req.Method, req.Header)
+			}
+			var b routesBody
+			json.NewDecoder(req.Body).Decode(&b)
+			bodies = append(bodies, b)
+			resp := `{"routes":[{"distanceMeters":1500,"duration":"300s","polyline":{"encodedPolyline":"abc"}}]}`
+			if b.TravelMode == "WALK" {
+				resp = `{"routes":[{"distanceMeters":1400,"duration":"1020s","polyline":{"encodedPolyline":"def"}}]}`
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(resp)),
+				Header:     http.Header{},
+			}, nil
+		}),
+	}
+	svc := NewService(fr, "", WithRoutingProvider(maps.NewGoogleRoutes("k", "", client)))
+	opts, err := svc.CalculateRouteOptions(context.Background(), models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A"},
+		DeliveryLocation: models.Address{StreetAddress: "B"},
+		WeightKG:         2,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("CalculateRouteOptions error: %v", err)
+	}
+
+	// 无人机按两轮车、机器人按步行规划；步行不能使用实时路况
+	if len(bodies) != 2 || bodies[0].Origin.Address != "A" ||
+		bodies[0].TravelMode != "TWO_WHEELER" || bodies[0].RoutingPreference != "TRAFFIC_AWARE" ||
+		bodies[1].TravelMode != "WALK" || bodies[1].RoutingPreference != "" {
+		t.Errorf("Routes API requests = %+v; want TWO_WHEELER (traffic-aware) then WALK", bodies)
+	}
+	if len(opts) != 2 || opts[0].DurationSeconds != 300 || opts[0].Polyline != "abc" ||
+		opts[1].DurationSeconds != 1020 || opts[1].DistanceMeters != 1400 || opts[1].Polyline != "def" {
+		t.Errorf("CalculateRouteOptions = %+v; want each option on its own route", opts)
+	}
+}
+
+func TestQuoteFallsBackWhenMapsBreakerOpen(t *testing.T) {
+	fr := newFakeRepo()
+	calls := 0
+	svc := NewService(fr, "test", WithHTTPClient(&http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Body:       io.NopCloser(strings.NewReader(`{}`)),
+				Header:     http.Header{},
+			}, nil
+		}),
+	}))
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A", Location: &models.GeoPoint{Latitude: 37.78, Longitude: -122.40}},
+		DeliveryLocation: models.Address{StreetAddress: "B", Location: &models.GeoPoint{Latitude: 37.77, Longitude: -122.41}},
+		WeightKG:         2,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC),
+	}
+
+	// 前两次报价的重试耗尽失败次数并打开熔断器，期间返回真实错误
+	for i := 0; i < 2; i++ {
+		if _, err := svc.CalculateRouteOptions(context.Background(), req); err == nil || errors.Is(err, resilience.ErrCircuitOpen) {
+			t.Fatalf("quote %d error = %v; want the maps API failure", i+1, err)
+		}
+	}
+	if calls != 5 {
+		t.Fatalf("maps API calls = %d; want 5 before the breaker opens", calls)
+	}
+
+	// 熔断期间按直线距离估算，不再调用地图服务
+	opts, err := svc.CalculateRouteOptions(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CalculateRouteOptions error while breaker open: %v", err)
+	}
+	if calls != 5 {
+		t.Errorf("maps API calls = %d; want none while the breaker is open", calls)
+	}
+	km := haversineKM(*req.PickupLocation.Location, *req.DeliveryLocation.Location)
+	if len(opts) != 2 {
+		t.Fatalf("got %d options; want 2", len(opts))
+	}
+	for _, o := range opts {
+		if !o.Estimated || o.Polyline != "" || o.DistanceMeters == 0 || o.DurationSeconds == 0 {
+			t.Errorf("option %+v; want a straight-line estimate", o)
+		}
+	}
+	if want := int(math.Round(km * 1000)); opts[0].DistanceMeters != want {
+		t.Errorf("drone DistanceMeters = %d; want %d", opts[0].DistanceMeters, want)
+	}
+	if want := int(math.Round(km * 1.3 * 1000)); opts[1].DistanceMeters != want {
+		t.Errorf("robot DistanceMeters = %d; want %d (detour factor applied)", opts[1].DistanceMeters, want)
+	}
+
+	// 没有坐标时无法估算，仍然返回熔断错误
+	req.PickupLocation.Location = nil
+	if _, err := svc.CalculateRouteOptions(context.Background(), req); !errors.Is(err, resilience.ErrCircuitOpen) {
+		t.Errorf("quote without coordinates error = %v; want ErrCircuitOpen", err)
+	}
+}
+
+func TestComputeRouteWithOSRM(t *testing.T) {
+	fr := newFakeRepo()
+	fr.orderDest["o1"] = "dest-X"
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 37.78, Longitude: -122.4}
+	fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 37.77, Longitude: -122.41}
+	fr.orderDest["o2"] = "dest-Y" // 没有坐标
+	var gotPath string
+	osrm, err := maps.NewOSRM("http://osrm.test", &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			gotPath = req.URL.Path
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"code":"Ok","routes":[{"distance":1234.6,"duration":300.2,"geometry":"xyz"}]}`)),
+				Header:     http.Header{},
+			}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(fr, "", WithRoutingProvider(osrm))
+
+	// OSRM 使用订单坐标（经度在前）而不是地址
+	route, err := svc.ComputeRoute(context.Background(), "o1", nil)
+	if err != nil {
+		t.Fatalf("ComputeRoute error: %v", err)
+	}
+	if gotPath != "/route/v1/driving/-122.4,37.78;-122.41,37.77" {
+		t.Errorf("OSRM request path = %s", gotPath)
+	}
+	if route.DistanceMeters != 1235 || route.DurationSeconds != 300 || route.Polyline != "xyz" {
+		t.Errorf("ComputeRoute = %+v; want 1235 m, 300 s, polyline xyz", route)
+	}
+
+	// OSRM 不能地理编码：没有坐标的订单直接失败，不重试
+	gotPath = ""
+	if _, err := svc.ComputeRoute(context.Background(), "o2", nil); !errors.Is(err, maps.ErrNoCoordinates) {
+		t.Errorf("ComputeRoute without coordinates error = %v; want ErrNoCoordinates", err)
+	}
+	if gotPath != "" {
+		t.Errorf("OSRM was called for an order without coordinates")
+	}
+}
+
+func TestComputeRouteWithWaypoints(t *testing.T) {
+	fr := newFakeRepo()
+	fr.orderDest["o1"] = "dest-X"
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 38.5, Longitude: -120.2}
+	fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 43.252, Longitude: -126.453}
+	var gotPath string
+	// 两段路线：每段的几何由各步骤拼接，衔接处的重复点只保留一个
+	body := `{"code":"Ok","routes":[{"distance":3000,"duration":600,"geometry":"_p~iF~ps|U_ulLnnqC_mqNvxq` + "`" + `@","legs":[
+		{"distance":1000,"duration":200,"steps":[{"geometry":"_p~iF~ps|U_ulLnnqC"},{"geometry":"_flwFn` + "`" + `faV"}]},
+		{"distance":2000,"duration":400,"steps":[{"geometry":"_flwFn` + "`" + `faV_mqNvxq` + "`" + `@"}]}]}]}`
+	osrm, err := maps.NewOSRM("http://osrm.test", &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			gotPath = req.URL.Path
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(body)),
+				Header:     http.Header{},
+			}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(fr, "", WithRoutingProvider(osrm))
+
+	depot := models.Address{StreetAddress: "Depot", Location: &models.GeoPoint{Latitude: 40.7, Longitude: -120.95}}
+	route, err := svc.ComputeRoute(context.Background(), "o1", []models.Address{depot})
+	if err != nil {
+		t.Fatalf("ComputeRoute error: %v", err)
+	}
+	// 途经点按顺序位于起点与终点之间
+	if gotPath != "/route/v1/driving/-120.2,38.5;-120.95,40.7;-126.453,43.252" {
+		t.Errorf("OSRM request path = %s", gotPath)
+	}
+	want := []models.RouteLeg{
+		{Polyline: "_p~iF~ps|U_ulLnnqC", DistanceMeters: 1000, DurationSeconds: 200},
+		{Polyline: "_flwFn`faV_mqNvxq`@", DistanceMeters: 2000, DurationSeconds: 400},
+	}
+	if !slices.Equal(route.Legs, want) {
+		t.Errorf("ComputeRoute legs = %+v; want %+v", route.Legs, want)
+	}
+	if route.DistanceMeters != 3000 || route.DurationSeconds != 600 {
+		t.Errorf("ComputeRoute = %d m, %d s; want 3000 m, 600 s", route.DistanceMeters, route.DurationSeconds)
+	}
+	saved, err := fr.GetLatestRoute(context.Background(), "o1")
+	if err != nil || len(saved.Legs) != 2 {
+		t.Errorf("saved route = %+v, %v; want 2 legs", saved, err)
+	}
+
+	// 既没有地址也没有坐标的途经点无法规划
+	var apiErr *models.APIError
+	if _, err := svc.ComputeRoute(context.Background(), "o1", []models.Address{{}}); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+		t.Errorf("ComputeRoute with an empty waypoint error = %v; want validation failure", err)
+	}
+}
+
+func TestSetMachineStatusRetriesOnConflict(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusIdle, BatteryLevel: 80}
+	// 第一次写入前，心跳并发更新了电量
+	concurrent := true
+	fr.beforeUpdate = func(cur *models.Machine) {
+		if concurrent {
+			concurrent = false
+			cur.BatteryLevel = 60
+			cur.Version++
+		}
+	}
+	svc := NewService(fr, "test")
+
+	req := models.MachineStatusUpdateRequest{Status: models.StatusMaintenance, Latitude: 1, Longitude: 2}
+	if err := svc.SetMachineStatus(context.Background(), "m1", req); err != nil {
+		t.Fatalf("SetMachineStatus error: %v", err)
+	}
+	got := fr.machines["m1"]
+	if got.Status != models.StatusMaintenance || got.BatteryLevel != 60 {
+		t.Errorf("machine = status %s battery %d; want MAINTENANCE with the concurrent battery 60 kept", got.Status, got.BatteryLevel)
+	}
+
+	// 持续冲突时放弃并返回冲突错误
+	fr.beforeUpdate = func(cur *models.Machine) { cur.Version++ }
+	err := svc.SetMachineStatus(context.Background(), "m1", req)
+	if !errors.Is(err, models.ErrMachineVersionConflict) {
+		t.Errorf("SetMachineStatus under constant conflict error = %v; want ErrMachineVersionConflict", err)
+	}
+}
+
+func TestTrackingEvents(t *testing.T) {
+    fr := newFakeRepo()
+    fr.machines["m1"] = &models.Machine{ID: "m1"}
+    fr.ordersAssigned["order-1"] = "m1"
+    svc := NewService(fr, "test")
+    ctx := context.Background()
+
+    // 未分配给该订单的机器不能上报轨迹
+    err := svc.ReportTracking(ctx, "order-1", "m2", models.TrackingEventRequest{Latitude: 1, Longitude: 2})
+    if !errors.Is(err, models.ErrForbidden) {
+        t.Fatalf("ReportTracking by unassigned machine error = %v; want ErrForbidden", err)
+    }
+
+    err = svc.ReportTracking(ctx, "order-1", "m1", models.TrackingEventRequest{
+        Latitude:  12.34,
+        Longitude: 56.78,
+    })
+    if err != nil {
+        t.Fatalf("ReportTracking error: %v", err)
+    }
+    err = svc.ReportTracking(ctx, "order-1", "m1", models.TrackingEventRequest{
+        Latitude:  98.76,
+        Longitude: 54.32,
+    })
+    if err != nil {
+        t.Fatalf("ReportTracking error: %v", err)
+    }
+
+    evs, next, err := svc.GetTracking(ctx, "order-1", models.TrackingQuery{})
+    if err != nil {
+        t.Fatalf("GetTracking error: %v", err)
+    }
+
+    if len(evs) != 2 {
+        t.Errorf("GetTracking returned %d; want 2", len(evs))
+    }
+    if next != nil {
+        t.Errorf("GetTracking next cursor = %v; want nil", next)
+    }
+
+    // 分页：每页 1 条，第二页从游标之后开始
+    page1, next, err := svc.GetTracking(ctx, "order-1", models.TrackingQuery{Limit: 1})
+    if err != nil || len(page1) != 1 || next == nil {
+        t.Fatalf("GetTracking page 1 = %d events, next %v, err %v; want 1 event and a cursor", len(page1), next, err)
+    }
+    page2, next, err := svc.GetTracking(ctx, "order-1", models.TrackingQuery{Limit: 1, After: next})
+    if err != nil || len(page2) != 1 || next != nil {
+        t.Fatalf("GetTracking page 2 = %d events, next %v, err %v; want 1 event and no cursor", len(page2), next, err)
+    }
+    if page2[0].ID == page1[0].ID {
+        t.Errorf("GetTracking page 2 repeated event %s", page1[0].ID)
+    }
+    if len(fr.trackingEvents) != 2 {
+        t.Errorf("fakeRepo.trackingEvents length = %d; want 2", len(fr.trackingEvents))
+    }
+}
+
+func TestGetTrackingPolling(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1"}
+	fr.ordersAssigned["order-1"] = "m1"
+	fr.orderOwners["order-1"] = "owner"
+	svc := NewService(fr, "test")
+	h := NewHandler(svc)
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		if err := svc.ReportTracking(ctx, "order-1", "m1", models.TrackingEventRequest{Latitude: float64(i)}); err != nil {
+			t.Fatalf("ReportTracking: %v", err)
+		}
+	}
+
+	get := func(query string) (*httptest.ResponseRecorder, []models.TrackingEvent, error) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/orders/order-1/track?"+query, nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("orderId")
+		c.SetParamValues("order-1")
+		c.Set("userID", "owner")
+		c.Set("userRole", models.RoleCustomer)
+		if err := h.GetTracking(c); err != nil {
+			return rec, nil, err
+		}
+		var events []models.TrackingEvent
+		if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return rec, events, nil
+	}
+
+	var apiErr *models.APIError
+	if _, _, err := get("since=yesterday"); !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+		t.Errorf("GetTracking with malformed since error = %v; want 400", err)
+	}
+
+	// 第一页：还有下一页；X-Last-Cursor 指向本页最后一个事件
+	rec, page, err := get("limit=2")
+	if err != nil || len(page) != 2 || rec.Header().Get("X-Next-Cursor") == "" {
+		t.Fatalf("page 1 = %d events, next %q, err %v; want 2 events and a next cursor", len(page), rec.Header().Get("X-Next-Cursor"), err)
+	}
+	// 最后一页没有 X-Next-Cursor，但仍可用 X-Last-Cursor 续传
+	rec, page, err = get("cursor=" + rec.Header().Get("X-Last-Cursor"))
+	if err != nil || len(page) != 1 || page[0].Latitude != 3 || rec.Header().Get("X-Next-Cursor") != "" {
+		t.Fatalf("page 2 = %+v, err %v; want only the third event", page, err)
+	}
+	last := rec.Header().Get("X-Last-Cursor")
+	if _, page, err = get("cursor=" + last); err != nil || len(page) != 0 {
+		t.Errorf("poll with no new events = %+v, %v; want none", page, err)
+	}
+	svc.ReportTracking(ctx, "order-1", "m1", models.TrackingEventRequest{Latitude: 4})
+	if _, page, err = get("cursor=" + last); err != nil || len(page) != 1 || page[0].Latitude != 4 {
+		t.Errorf("poll after a new event = %+v, %v; want only the new event", page, err)
+	}
+}
+
+func TestReportTrackingBatch(t *testing.T) {
+	fr := newFakeRepo()
+	fr.ordersAssigned["order-1"] = "m1"
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+
+	recorded := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	points := []models.TrackingPoint{
+		{Latitude: 1, Longitude: 2, RecordedAt: recorded},
+		{Latitude: 3, Longitude: 4, RecordedAt: recorded.Add(10 * time.Second)},
+	}
+	if err := svc.ReportTrackingBatch(ctx, "order-1", "m2", points); !errors.Is(err, models.ErrForbidden) {
+		t.Fatalf("ReportTrackingBatch by unassigned machine error = %v; want ErrForbidden", err)
+	}
+	wake, cancel := svc.WatchTracking("order-1")
+	defer cancel()
+	if err := svc.ReportTrackingBatch(ctx, "order-1", "m1", points); err != nil {
+		t.Fatalf("ReportTrackingBatch error: %v", err)
+	}
+
+	// 保留机器记录的时间，并唤醒实时推送
+	if len(fr.trackingEvents) != 2 {
+		t.Fatalf("stored %d events; want 2", len(fr.trackingEvents))
+	}
+	for i, ev := range fr.trackingEvents {
+		if ev.MachineID != "m1" || ev.Latitude != points[i].Latitude || !ev.CreatedAt.Equal(points[i].RecordedAt) {
+			t.Errorf("event %d = %+v; want point %+v from m1", i, ev, points[i])
+		}
+	}
+	select {
+	case <-wake:
+	default:
+		t.Error("ReportTrackingBatch did not notify tracking subscribers")
+	}
+}
+
+func TestTrackingThrottle(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Type: models.MachineTypeRobot}
+	fr.machines["d1"] = &models.Machine{ID: "d1", Type: models.MachineTypeDrone}
+	fr.ordersAssigned["order-1"] = "m1"
+	fr.ordersAssigned["order-2"] = "d1"
+	svc := NewService(fr, "test", WithTrackingPolicy(TrackingPolicy{
+		models.MachineTypeRobot: {MinDistanceMeters: 5, MaxGap: time.Minute},
+		models.MachineTypeDrone: {MinInterval: 2 * time.Second},
+	}))
+	ctx := context.Background()
+	report := func(lat float64) {
+		t.Helper()
+		if err := svc.ReportTracking(ctx, "order-1", "m1", models.TrackingEventRequest{Latitude: lat}); err != nil {
+			t.Fatalf("ReportTracking error: %v", err)
+		}
+	}
+
+	// 约 1 米的抖动被丢弃，约 100 米的移动被保存
+	report(10)
+	report(10.00001)
+	report(10.001)
+	if len(fr.trackingEvents) != 2 || fr.trackingEvents[1].Latitude != 10.001 {
+		t.Fatalf("stored %d events; want the first point and the 100 m move", len(fr.trackingEvents))
+	}
+	// 静止超过 MaxGap 后仍保存一个点
+	fr.trackingEvents[1].CreatedAt = time.Now().Add(-2 * time.Minute)
+	report(10.001)
+	if len(fr.trackingEvents) != 3 {
+		t.Errorf("stored %d events; want a keep-alive point after MaxGap", len(fr.trackingEvents))
+	}
+
+	// 批量补传按记录时间节流：每秒一个点，只保存间隔 2 秒以上的
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	var points []models.TrackingPoint
+	for i := 3; i >= 0; i-- { // 乱序上传
+		points = append(points, models.TrackingPoint{Latitude: float64(i), RecordedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+	if err := svc.ReportTrackingBatch(ctx, "order-2", "d1", points); err != nil {
+		t.Fatalf("ReportTrackingBatch error: %v", err)
+	}
+	var got []float64
+	for _, ev := range fr.trackingEvents[3:] {
+		got = append(got, ev.Latitude)
+	}
+	if !slices.Equal(got, []float64{0, 2}) {
+		t.Errorf("batch stored latitudes %v; want [0 2]", got)
+	}
+}
+
+func TestArrivalGeofence(t *testing.T) {
+	fr := newFakeRepo()
+	fr.ordersAssigned["o1"] = "m1"
+	fr.orderStatuses["o1"] = models.OrderStatusInProgress
+	fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 37.77, Longitude: -122.41}
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+
+	// 约 110 米外：仍在配送中
+	if err := svc.ReportTracking(ctx, "o1", "m1", models.TrackingEventRequest{Latitude: 37.771, Longitude: -122.41}); err != nil {
+		t.Fatalf("ReportTracking error: %v", err)
+	}
+	if got := fr.orderStatuses["o1"]; got != models.OrderStatusInProgress {
+		t.Fatalf("status 110 m away = %s; want IN_PROGRESS", got)
+	}
+	// 约 10 米：进入围栏，等待收件人确认
+	if err := svc.ReportTracking(ctx, "o1", "m1", models.TrackingEventRequest{Latitude: 37.7701, Longitude: -122.41}); err != nil {
+		t.Fatalf("ReportTracking error: %v", err)
+	}
+	if got := fr.orderStatuses["o1"]; got != models.OrderStatusArrived {
+		t.Fatalf("status inside geofence = %s; want ARRIVED", got)
+	}
+	if eta, err := svc.GetETA(ctx, "o1"); err != nil || eta.RemainingDistanceMeters != 0 {
+		t.Errorf("ETA after arrival = %+v, %v; want nothing remaining", eta, err)
+	}
+
+	// 批量补传中任一点进入围栏即到达；已确认送达的订单不会回退
+	fr.ordersAssigned["o2"] = "m1"
+	fr.orderStatuses["o2"] = models.OrderStatusInProgress
+	fr.orderDropoffs["o2"] = fr.orderDropoffs["o1"]
+	start := time.Now().Add(-time.Minute)
+	points := []models.TrackingPoint{
+		{Latitude: 37.7701, Longitude: -122.41, RecordedAt: start},
+		{Latitude: 37.78, Longitude: -122.41, RecordedAt: start.Add(30 * time.Second)},
+	}
+	if err := svc.ReportTrackingBatch(ctx, "o2", "m1", points); err != nil {
+		t.Fatalf("ReportTrackingBatch error: %v", err)
+	}
+	if got := fr.orderStatuses["o2"]; got != models.OrderStatusArrived {
+		t.Errorf("status after batch through geofence = %s; want ARRIVED", got)
+	}
+	fr.orderStatuses["o1"] = models.OrderStatusDelivered
+	svc.ReportTracking(ctx, "o1", "m1", models.TrackingEventRequest{Latitude: 37.77, Longitude: -122.41})
+	if got := fr.orderStatuses["o1"]; got != models.OrderStatusDelivered {
+		t.Errorf("status of delivered order = %s; want DELIVERED", got)
+	}
+}
+
+func TestMachineAssignments(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1"}
+	for _, id := range []string{"o1", "o2", "o3"} {
+		fr.ordersAssigned[id] = "m1"
+		fr.orderStatuses[id] = models.OrderStatusInProgress
+		fr.orderPickups[id] = models.GeoPoint{Latitude: 38.5, Longitude: -120.2}
+		fr.orderDropoffs[id] = models.GeoPoint{Latitude: 43.252, Longitude: -126.453}
+	}
+	fr.orderStatuses["o3"] = models.OrderStatusArrived // 已到达的订单不再是机器的任务
+	fr.ordersAssigned["o4"] = "m2"
+	fr.orderStatuses["o4"] = models.OrderStatusInProgress
+	fr.routes = append(fr.routes, &models.Route{OrderID: "o1", Polyline: "_p~iF~ps|U_ulLnnqC_mqNvxq`@"})
+	fr.recipients["o2"] = models.Recipient{Name: "Ada", Phone: "+14155550123", Instructions: "leave with the concierge"}
+	svc := NewService(fr, "test")
+
+	got, err := svc.GetMachineAssignments(context.Background(), "m1")
+	if err != nil {
+		t.Fatalf("GetMachineAssignments error: %v", err)
+	}
+	if len(got) != 2 || got[0].OrderID != "o1" || got[1].OrderID != "o2" {
+		t.Fatalf("assignments = %+v; want o1, o2", got)
+	}
+	if got[0].Pickup == nil || got[0].Dropoff == nil || got[0].Dropoff.Latitude != 43.252 {
+		t.Errorf("o1 points = %v, %v; want pickup and dropoff", got[0].Pickup, got[0].Dropoff)
+	}
+	// 有路线时附带解码后的坐标；没有路线时由机器自行规划
+	if len(got[0].Path) != 3 || got[0].Path[2].Longitude != -126.453 {
+		t.Errorf("o1 path = %v; want the decoded route", got[0].Path)
+	}
+	if got[1].Path != nil {
+		t.Errorf("o2 path = %v; want none", got[1].Path)
+	}
+	// 收件人与投递说明随任务下发；未填写时不附带
+	if got[0].Recipient != nil {
+		t.Errorf("o1 recipient = %+v; want none", got[0].Recipient)
+	}
+	if rc := got[1].Recipient; rc == nil || rc.Phone != "+14155550123" || rc.Instructions != "leave with the concierge" {
+		t.Errorf("o2 recipient = %+v; want Ada's details", rc)
+	}
+
+	h := NewHandler(svc)
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/logistics/fleet/m1/assignments", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("machineId")
+	c.SetParamValues("m1")
+	c.Set("machineID", "m2")
+	err = h.GetMachineAssignments(c)
+	var apiErr *models.APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusForbidden {
+		t.Errorf("another machine's assignments: err = %v; want 403", err)
+	}
+}
+
+func TestReleaseMachine(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusInTransit}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Status: models.StatusCharging}
+	fr.ordersAssigned["o1"], fr.ordersAssigned["o2"] = "m1", "m1"
+	fr.orderStatuses["o1"], fr.orderStatuses["o2"] = models.OrderStatusCancelled, models.OrderStatusInProgress
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+
+	// 多站点任务中仍有订单在配送时不释放
+	if err := svc.ReleaseMachine(ctx, "m1"); err != nil {
+		t.Fatalf("ReleaseMachine error: %v", err)
+	}
+	if got := fr.machines["m1"].Status; got != models.StatusInTransit {
+		t.Errorf("m1 with o2 in progress = %s; want IN_TRANSIT", got)
+	}
+	// 没有其他订单时返航，并排队 RETURN_TO_BASE 命令；返航中的机器不参与派单
+	fr.orderStatuses["o2"] = models.OrderStatusCancelled
+	if err := svc.ReleaseMachine(ctx, "m1"); err != nil {
+		t.Fatalf("ReleaseMachine error: %v", err)
+	}
+	if got := fr.machines["m1"].Status; got != models.StatusReturning {
+		t.Errorf("m1 without orders = %s; want RETURNING", got)
+	}
+	if cmds, _ := svc.PollMachineCommands(ctx, "m1"); len(cmds) != 1 || cmds[0].Command != models.CommandReturnToBase {
+		t.Errorf("m1 commands = %+v; want RETURN_TO_BASE", cmds)
+	}
+	if err := svc.DeleteMachine(ctx, "m1"); !errors.Is(err, models.ErrMachineBusy) {
+		t.Errorf("DeleteMachine(returning m1) error = %v; want ErrMachineBusy", err)
+	}
+	// 不是 IN_TRANSIT 的机器保持原状态
+	if err := svc.ReleaseMachine(ctx, "m2"); err != nil {
+		t.Fatalf("ReleaseMachine error: %v", err)
+	}
+	if got := fr.machines["m2"].Status; got != models.StatusCharging {
+		t.Errorf("charging m2 = %s; want CHARGING", got)
+	}
+	if cmds, _ := svc.PollMachineCommands(ctx, "m2"); len(cmds) != 0 {
+		t.Errorf("charging m2 commands = %+v; want none", cmds)
+	}
+
+	// 回到基地上报 IDLE 后重新参与派单
+	if err := svc.SetMachineStatus(ctx, "m1", models.MachineStatusUpdateRequest{Status: models.StatusIdle}); err != nil {
+		t.Fatalf("SetMachineStatus error: %v", err)
+	}
+	if got := fr.machines["m1"].Status; got != models.StatusIdle {
+		t.Errorf("m1 at base = %s; want IDLE", got)
+	}
+}
+
+func TestRecallMachinePublishes(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusInTransit}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Status: models.StatusInTransit}
+	pub := &fakePublisher{}
+	svc := NewService(fr, "test", WithCommandPublisher(pub))
+	ctx := context.Background()
+
+	// 命令在事务中只排队，订单取消提交后才推送，且只推送该机器的命令
+	for _, id := range []string{"m1", "m2"} {
+		if err := svc.ReleaseMachine(ctx, id); err != nil {
+			t.Fatalf("ReleaseMachine(%s) error: %v", id, err)
+		}
+	}
+	if len(pub.published) != 0 {
+		t.Fatalf("published before commit: %+v", pub.published)
+	}
+	if err := svc.RecallMachine(ctx, "m1"); err != nil {
+		t.Fatalf("RecallMachine error: %v", err)
+	}
+	cmds, _ := svc.ListMachineCommands(ctx, "m1")
+	if len(cmds) != 1 || !slices.Equal(pub.published, []string{cmds[0].ID}) || cmds[0].Status != models.CommandDelivered {
+		t.Errorf("published %v, m1 commands %+v; want m1's RETURN_TO_BASE delivered", pub.published, cmds)
+	}
+}
+
+func TestTrackingStream(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1"}
+	fr.ordersAssigned["order-1"] = "m1"
+	fr.orderOwners["order-1"] = "owner"
+	svc := NewService(fr, "test")
+	h := NewHandler(svc)
+
+	// 模拟 JWT 中间件：X-User 头作为用户 ID
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		if errors.Is(err, models.ErrNotFound) {
+			c.NoContent(http.StatusNotFound)
+			return
+		}
+		e.DefaultHTTPErrorHandler(err, c)
+	}
+	e.GET("/orders/:orderId/track/ws", h.HandleTracking, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("userID", c.Request().Header.Get("X-User"))
+			c.Set("userRole", models.RoleCustomer)
+			return next(c)
+		}
+	})
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/orders/order-1/track/ws"
+
+	dial := func(user, origin string) (*websocket.Conn, error) {
+		cfg, err := websocket.NewConfig(wsURL, origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Header.Set("X-User", user)
+		return websocket.DialConfig(cfg)
+	}
+
+	// 非下单用户与跨站来源都无法建立连接
+	if ws, err := dial("someone-else", srv.URL); err == nil {
+		ws.Close()
+		t.Fatal("stream opened for a user who does not own the order")
+	}
+	if ws, err := dial("owner", "https://evil.example"); err == nil {
+		ws.Close()
+		t.Fatal("stream opened for a cross-site origin")
+	}
+
+	ws, err := dial("owner", srv.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// 连接建立后上报的事件被推送，且游标指向该事件
+	for i := 1; i <= 2; i++ {
+		if err := svc.ReportTracking(context.Background(), "order-1", "m1", models.TrackingEventRequest{Latitude: float64(i)}); err != nil {
+			t.Fatalf("ReportTracking: %v", err)
+		}
+		var msg models.TrackingStreamMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("receive event %d: %v", i, err)
+		}
+		if msg.Event == nil || msg.Event.Latitude != float64(i) {
+			t.Fatalf("event %d = %+v; want latitude %d", i, msg.Event, i)
+		}
+		cursor, err := models.DecodeTrackingCursor(msg.Cursor)
+		if err != nil || cursor.ID != msg.Event.ID {
+			t.Errorf("event %d cursor = %v, %v; want position of %s", i, cursor, err, msg.Event.ID)
+		}
+	}
+
+	// 订单有路线后，每批事件之后推送一帧最新的 ETA
+	fr.orderStatuses["order-1"] = models.OrderStatusInProgress
+	fr.SaveRoute(context.Background(), &models.Route{OrderID: "order-1", Polyline: "_p~iF~ps|U_ulLnnqC_mqNvxq`@", DistanceMeters: 1000, DurationSeconds: 100})
+	if err := svc.ReportTracking(context.Background(), "order-1", "m1", models.TrackingEventRequest{Latitude: 38.5, Longitude: -120.2}); err != nil {
+		t.Fatalf("ReportTracking: %v", err)
+	}
+	var ev, eta models.TrackingStreamMessage
+	if err := websocket.JSON.Receive(ws, &ev); err != nil || ev.Event == nil {
+		t.Fatalf("receive event: %+v, %v", ev, err)
+	}
+	if err := websocket.JSON.Receive(ws, &eta); err != nil {
+		t.Fatalf("receive eta: %v", err)
+	}
+	if eta.Event != nil || eta.ETA == nil || eta.ETA.RemainingDistanceMeters != 1000 || eta.Cursor != ev.Cursor {
+		t.Errorf("eta frame = %+v; want the full route remaining, cursor %s", eta, ev.Cursor)
+	}
+}
+
+func TestGetETA(t *testing.T) {
+	fr := newFakeRepo()
+	fr.orderStatuses["o1"] = models.OrderStatusInProgress
+	fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 43.252, Longitude: -126.453}
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+
+	if _, err := svc.GetETA(ctx, "o1"); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("GetETA without a route error = %v; want ErrNotFound", err)
+	}
+
+	// Google 文档中的示例折线：(38.5,-120.2) → (40.7,-120.95) → (43.252,-126.453)
+	fr.SaveRoute(ctx, &models.Route{OrderID: "o1", Polyline: "_p~iF~ps|U_ulLnnqC_mqNvxq`@", DistanceMeters: 10000, DurationSeconds: 1000})
+	before := time.Now().Truncate(time.Second)
+	eta, err := svc.GetETA(ctx, "o1")
+	if err != nil {
+		t.Fatalf("GetETA error: %v", err)
+	}
+	// 还没有轨迹：整条路线，从现在起算
+	if eta.Position != nil || eta.RemainingDistanceMeters != 10000 || eta.RemainingDurationSeconds != 1000 ||
+		eta.EstimatedArrival.Before(before.Add(1000*time.Second)) {
+		t.Errorf("ETA before tracking = %+v; want the whole route from now", eta)
+	}
+
+	// 机器位于第二个顶点：剩余比例为最后一段占折线总长的比例
+	fr.trackingEvents = append(fr.trackingEvents, &models.TrackingEvent{ID: "t1", OrderID: "o1", Latitude: 40.7, Longitude: -120.95, CreatedAt: before})
+	eta, err = svc.GetETA(ctx, "o1")
+	if err != nil {
+		t.Fatalf("GetETA error: %v", err)
+	}
+	a := models.GeoPoint{Latitude: 38.5, Longitude: -120.2}
+	b := models.GeoPoint{Latitude: 40.7, Longitude: -120.95}
+	c := models.GeoPoint{Latitude: 43.252, Longitude: -126.453}
+	frac := haversineKM(b, c) / (haversineKM(a, b) + haversineKM(b, c))
+	if want := int(math.Round(frac * 10000)); eta.RemainingDistanceMeters != want {
+		t.Errorf("RemainingDistanceMeters = %d; want %d", eta.RemainingDistanceMeters, want)
+	}
+	if want := int(math.Ceil(float64(eta.RemainingDistanceMeters) / 10)); eta.RemainingDurationSeconds < want-1 || eta.RemainingDurationSeconds > want+1 {
+		t.Errorf("RemainingDurationSeconds = %d; want about %d at the route's average speed", eta.RemainingDurationSeconds, want)
+	}
+	if !eta.EstimatedArrival.Equal(before.Add(time.Duration(eta.RemainingDurationSeconds) * time.Second)) {
+		t.Errorf("EstimatedArrival = %v; want the last report plus the remaining duration", eta.EstimatedArrival)
+	}
+
+	// 折线无法解码时按到投递点的直线距离估算
+	fr.SaveRoute(ctx, &models.Route{OrderID: "o1", DistanceMeters: 10000, DurationSeconds: 1000})
+	eta, err = svc.GetETA(ctx, "o1")
+	if want := int(math.Round(haversineKM(b, c) * 1000)); err != nil || eta.RemainingDistanceMeters != want {
+		t.Errorf("ETA without polyline = %+v, %v; want %d m straight to the dropoff", eta, err, want)
+	}
+
+	// 送达时间窗：按预计到达时间评估风险，余量为剩余时长的 1/5（至少 5 分钟）
+	arrival := eta.EstimatedArrival
+	riskTests := []struct {
+		name   string
+		window models.DeliveryWindow
+		want   models.WindowRisk
+	}{
+		{"well inside", models.DeliveryWindow{Start: arrival.Add(-time.Hour), End: arrival.Add(24 * time.Hour)}, models.WindowOnTime},
+		{"close to the end", models.DeliveryWindow{Start: arrival.Add(-time.Hour), End: arrival.Add(2 * time.Minute)}, models.WindowAtRisk},
+		{"after the end", models.DeliveryWindow{Start: arrival.Add(-time.Hour), End: arrival.Add(-time.Minute)}, models.WindowLate},
+		{"before the start", models.DeliveryWindow{Start: arrival.Add(time.Minute), End: arrival.Add(time.Hour)}, models.WindowEarly},
+	}
+	for _, tt := range riskTests {
+		fr.orderWindows["o1"] = tt.window
+		eta, err := svc.GetETA(ctx, "o1")
+		if err != nil || eta.WindowRisk != tt.want || eta.DeliveryWindow == nil {
+			t.Errorf("%s: ETA = %+v, %v; want risk %s", tt.name, eta, err, tt.want)
+		}
+	}
+	delete(fr.orderWindows, "o1")
+
+	// 已送达：剩余为 0；已取消：没有 ETA
+	fr.orderStatuses["o1"] = models.OrderStatusDelivered
+	if eta, err := svc.GetETA(ctx, "o1"); err != nil || eta.RemainingDistanceMeters != 0 || !eta.EstimatedArrival.Equal(before) {
+		t.Errorf("ETA after delivery = %+v, %v; want nothing remaining", eta, err)
+	}
+	fr.orderStatuses["o1"] = models.OrderStatusCancelled
+	if _, err := svc.GetETA(ctx, "o1"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetETA for cancelled order error = %v; want ErrNotFound", err)
+	}
+}
+
+func TestIngestTelemetry(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusInTransit, BatteryLevel: 50}
+	fr.ordersAssigned["order-1"] = "m1"
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+
+	battery := 42
+	err := svc.IngestTelemetry(ctx, "m1", models.MachineTelemetry{Latitude: 1.5, Longitude: 2.5, BatteryLevel: &battery, FirmwareVersion: "2.4.1", OrderID: "order-1"})
+	if err != nil {
+		t.Fatalf("IngestTelemetry error: %v", err)
+	}
+	m := fr.machines["m1"]
+	if m.Latitude != 1.5 || m.Longitude != 2.5 || m.BatteryLevel != 42 || m.Status != models.StatusInTransit || m.FirmwareVersion != "2.4.1" {
+		t.Errorf("machine after telemetry = %+v; want position 1.5,2.5, battery 42, firmware 2.4.1, status unchanged", m)
+	}
+	if len(fr.trackingEvents) != 1 || fr.trackingEvents[0].MachineID != "m1" {
+		t.Errorf("tracking events = %v; want one event from m1", fr.trackingEvents)
+	}
+
+	// 电量缺省时保持不变；越界数据与未分配订单被拒绝
+	if err := svc.IngestTelemetry(ctx, "m1", models.MachineTelemetry{Latitude: 3, Longitude: 4}); err != nil || m.BatteryLevel != 42 {
+		t.Errorf("IngestTelemetry without battery: err %v, battery %d; want nil, 42", err, m.BatteryLevel)
+	}
+	if fw := fr.machines["m1"].FirmwareVersion; fw != "2.4.1" {
+		t.Errorf("firmware after telemetry without one = %q; want 2.4.1 kept", fw)
+	}
+	if err := svc.IngestTelemetry(ctx, "m1", models.MachineTelemetry{Latitude: 91}); err == nil {
+		t.Error("IngestTelemetry accepted latitude 91")
+	}
+	err = svc.IngestTelemetry(ctx, "m1", models.MachineTelemetry{Latitude: 1, Longitude: 1, OrderID: "order-2"})
+	if !errors.Is(err, models.ErrForbidden) {
+		t.Errorf("IngestTelemetry for unassigned order error = %v; want ErrForbidden", err)
+	}
+}
+
+func TestMachineKeys(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1"}
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+
+	key, err := svc.RotateMachineKey(ctx, "m1")
+	if err != nil {
+		t.Fatalf("RotateMachineKey error: %v", err)
+	}
+	if fr.keyHashes["m1"] == key {
+		t.Fatal("RotateMachineKey stored the plaintext key")
+	}
+	if id, err := svc.AuthenticateMachine(ctx, key); err != nil || id != "m1" {
+		t.Fatalf("AuthenticateMachine = %q, %v; want m1", id, err)
+	}
+
+	// 轮换后旧 Key 失效
+	if _, err := svc.RotateMachineKey(ctx, "m1"); err != nil {
+		t.Fatalf("RotateMachineKey error: %v", err)
+	}
+	if _, err := svc.AuthenticateMachine(ctx, key); !errors.Is(err, models.ErrInvalidCredentials) {
+		t.Errorf("AuthenticateMachine with rotated key error = %v; want ErrInvalidCredentials", err)
+	}
+}
+
+// fakeBus 模拟 database.CacheBus：Invalidate 同步通知所有订阅者（相当于所有实例）
+type fakeBus struct {
+	handlers map[string][]func(key string)
+}
+
+func (b *fakeBus) Subscribe(cache string, fn func(key string)) {
+	if b.handlers == nil {
+		b.handlers = map[string][]func(key string){}
+	}
+	b.handlers[cache] = append(b.handlers[cache], fn)
+}
+
+func (b *fakeBus) Invalidate(ctx context.Context, cache, key string) error {
+	for _, fn := range b.handlers[cache] {
+		fn(key)
+	}
+	return nil
+}
+
+func TestFleetCache(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusIdle}
+	bus := &fakeBus{}
+	// 两个实例共享同一个数据库和失效总线
+	a := NewService(NewCachedRepository(fr, bus), "test")
+	b := NewService(NewCachedRepository(fr, bus), "test")
+	ctx := context.Background()
+
+	if _, err := b.ListMachines(ctx, false); err != nil {
+		t.Fatalf("ListMachines error: %v", err)
+	}
+
+	// 绕过缓存直接改库：快照不应回源
+	fr.machines["m1"].BatteryLevel = 42
+	ms, _ := b.ListMachines(ctx, false)
+	if len(ms) != 1 || ms[0].BatteryLevel != 0 {
+		t.Fatalf("ListMachines = %+v; want cached snapshot", ms)
+	}
+
+	// 实例 a 的写入通过总线让实例 b 的快照失效
+	if err := a.SetMachineStatus(ctx, "m1", models.MachineStatusUpdateRequest{Status: models.StatusCharging}); err != nil {
+		t.Fatalf("SetMachineStatus error: %v", err)
+	}
+	ms, _ = b.ListMachines(ctx, false)
+	if len(ms) != 1 || ms[0].Status != models.StatusCharging {
+		t.Errorf("ListMachines after write = %+v; want status %s", ms, models.StatusCharging)
+	}
+}
+
+func TestDecodePolyline(t *testing.T) {
+	// Google 文档中的示例
+	got, err := decodePolyline("_p~iF~ps|U_ulLnnqC_mqNvxq`@")
+	if err != nil {
+		t.Fatalf("decodePolyline error: %v", err)
+	}
+	want := []models.GeoPoint{
+		{Latitude: 38.5, Longitude: -120.2},
+		{Latitude: 40.7, Longitude: -120.95},
+		{Latitude: 43.252, Longitude: -126.453},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("decodePolyline = %v; want %v", got, want)
+	}
+	for i := range want {
+		if math.Abs(got[i].Latitude-want[i].Latitude) > 1e-9 || math.Abs(got[i].Longitude-want[i].Longitude) > 1e-9 {
+			t.Errorf("point %d = %v; want %v", i, got[i], want[i])
+		}
+	}
+	if _, err := decodePolyline("abc"); err == nil {
+		t.Error("decodePolyline(truncated) error = nil; want error")
+	}
+}
+
+func TestRouteRestrictedByZones(t *testing.T) {
+	fr := newFakeRepo()
+	resp := `{"routes":[{"overview_polyline":{"points":"_p~iF~ps|U_ulLnnqC"},"legs":[{"distance":{"value":1000},"duration":{"value":600}}]}]}`
+	svc := newTestService(fr, resp)
+	ctx := context.Background()
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A"},
+		DeliveryLocation: models.Address{StreetAddress: "B"},
+		WeightKG:         1,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC),
+	}
+
+	// 直线穿过禁飞区：只剩地面机器人选项
+	fr.noFly = true
+	opts, err := svc.CalculateRouteOptions(ctx, req)
+	if err != nil || len(opts) != 1 || opts[0].MachineType != models.MachineTypeRobot {
+		t.Errorf("CalculateRouteOptions(no-fly) = %v, %v; want only a Robot option", opts, err)
+	}
+
+	// 同时离开服务区：没有可用选项
+	fr.outsideArea = true
+	if _, err := svc.CalculateRouteOptions(ctx, req); !errors.Is(err, models.ErrRouteRestricted) {
+		t.Errorf("CalculateRouteOptions(restricted) error = %v; want ErrRouteRestricted", err)
+	}
+
+	// 围栏增删改：闭合点被去掉，非法多边形被拒绝
+	z, err := svc.CreateZone(ctx, models.ZoneRequest{Name: "airport", Kind: models.ZoneNoFly, Polygon: []models.GeoPoint{
+		{Latitude: 0, Longitude: 0}, {Latitude: 0, Longitude: 1}, {Latitude: 1, Longitude: 1}, {Latitude: 0, Longitude: 0},
+	}})
+	if err != nil || len(z.Polygon) != 3 {
+		t.Fatalf("CreateZone = %+v, %v; want a 3-point ring", z, err)
+	}
+	if _, err := svc.UpdateZone(ctx, z.ID, models.ZoneRequest{Name: "airport", Kind: models.ZoneNoFly, Polygon: []models.GeoPoint{
+		{Latitude: 0, Longitude: 0}, {Latitude: 0, Longitude: 1}, {Latitude: 0, Longitude: 0},
+	}}); !errors.Is(err, models.ErrInvalidGeometry) {
+		t.Errorf("UpdateZone(degenerate) error = %v; want ErrInvalidGeometry", err)
+	}
+	if err := svc.DeleteZone(ctx, z.ID); err != nil {
+		t.Fatalf("DeleteZone error: %v", err)
+	}
+	if zones, _ := svc.ListZones(ctx); len(zones) != 0 {
+		t.Errorf("ListZones after delete = %v; want none", zones)
+	}
+}
+
+// fakeWeather 对所有地点返回相同的天气，并记录查询次数
+type fakeWeather struct {
+	cond  weather.Conditions
+	err   error
+	calls int
+}
+
+func (w *fakeWeather) Name() string { return "fake_weather" }
+
+func (w *fakeWeather) Current(ctx context.Context, lat, lng float64) (*weather.Conditions, error) {
+	w.calls++
+	if w.err != nil {
+		return nil, w.err
+	}
+	c := w.cond
+	return &c, nil
+}
+
+func TestSurgePricing(t *testing.T) {
+	fr := newFakeRepo()
+	resp := `{"routes":[{"overview_polyline":{"points":"abc"},"legs":[{"distance":{"value":1000},"duration":{"value":600}}]}]}`
+	svc := newTestService(fr, resp)
+	ctx := context.Background()
+	if _, err := svc.CreateZone(ctx, models.ZoneRequest{Name: "downtown", Kind: models.ZoneOperational, Polygon: []models.GeoPoint{
+		{Latitude: 37.70, Longitude: -122.50}, {Latitude: 37.70, Longitude: -122.30}, {Latitude: 37.80, Longitude: -122.30}, {Latitude: 37.80, Longitude: -122.50},
+	}}); err != nil {
+		t.Fatalf("CreateZone error: %v", err)
+	}
+	pickup := models.GeoPoint{Latitude: 37.77, Longitude: -122.41}
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A", Location: &pickup},
+		DeliveryLocation: models.Address{StreetAddress: "B"},
+		WeightKG:         1,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC),
+	}
+	listPrice, _ := quotePrice(nil, models.MachineTypeDrone, 1000, req.RequestedTime)
+	droneQuote := func() models.RouteOption {
+		t.Helper()
+		opts, err := svc.CalculateRouteOptions(ctx, req)
+		if err != nil {
+			t.Fatalf("CalculateRouteOptions error: %v", err)
+		}
+		return opts[0]
+	}
+
+	// 区外的机器和订单不计入供需
+	tests := []struct {
+		name                                       string
+		idle, pending, idleOutside, pendingOutside int
+		want                                       float64
+	}{
+		{"no waiting orders", 0, 0, 0, 0, 1},
+		{"enough machines", 3, 3, 0, 0, 1},
+		{"fewer machines than orders", 2, 3, 0, 0, 1.25},
+		{"under half", 1, 3, 0, 0, 1.5},
+		{"machines outside the zone", 1, 3, 5, 0, 1.5},
+		{"orders outside the zone", 3, 3, 0, 5, 1},
+	}
+	inside := models.GeoPoint{Latitude: 37.75, Longitude: -122.40}
+	outside := models.GeoPoint{Latitude: 37.90, Longitude: -122.40}
+	for _, tt := range tests {
+		fr.machines = map[string]*models.Machine{}
+		fr.orderStatuses = map[string]models.OrderStatus{}
+		addMachines := func(n int, at models.GeoPoint, prefix string) {
+			for i := range n {
+				id := fmt.Sprint(prefix, i)
+				fr.machines[id] = &models.Machine{ID: id, Status: models.StatusIdle, Latitude: at.Latitude, Longitude: at.Longitude}
+			}
+		}
+		addOrders := func(n int, at models.GeoPoint, prefix string) {
+			for i := range n {
+				id := fmt.Sprint(prefix, i)
+				fr.orderStatuses[id] = models.OrderStatusAssignmentPending
+				fr.orderPickups[id] = at
+			}
+		}
+		addMachines(tt.idle, inside, "m")
+		addMachines(tt.idleOutside, outside, "far-m")
+		addOrders(tt.pending, inside, "o")
+		addOrders(tt.pendingOutside, outside, "far-o")
+		opt := droneQuote()
+		if opt.SurgeMultiplier != tt.want || opt.EstimatedCost != withSurcharge(listPrice*tt.want, 0) {
+			t.Errorf("%s: surge = %v, cost = %.2f; want %v, %.2f", tt.name, opt.SurgeMultiplier, opt.EstimatedCost, tt.want, listPrice*tt.want)
+		}
+	}
+
+	// 取件点不在任何运营区内时不加价
+	req.PickupLocation.Location = &outside
+	if opt := droneQuote(); opt.SurgeMultiplier != 1 {
+		t.Errorf("surge outside every zone = %v; want 1", opt.SurgeMultiplier)
+	}
+	// 取件点没有坐标时无法确定运营区，不加价
+	req.PickupLocation.Location = nil
+	if opt := droneQuote(); opt.SurgeMultiplier != 1 {
+		t.Errorf("surge without pickup coordinates = %v; want 1", opt.SurgeMultiplier)
+	}
+}
+
+func TestExpressQuotes(t *testing.T) {
+	fr := newFakeRepo()
+	resp := `{"routes":[{"overview_polyline":{"points":"abc"},"legs":[{"distance":{"value":1000},"duration":{"value":600}}]}]}`
+	svc := newTestService(fr, resp)
+	ctx := context.Background()
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A"},
+		DeliveryLocation: models.Address{StreetAddress: "B"},
+		WeightKG:         1,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC),
+	}
+	listPrice, _ := quotePrice(nil, models.MachineTypeDrone, 1000, req.RequestedTime)
+
+	// 未指定服务等级按 STANDARD 报价
+	opts, err := svc.CalculateRouteOptions(ctx, req)
+	if err != nil {
+		t.Fatalf("CalculateRouteOptions error: %v", err)
+	}
+	if opts[0].Priority != models.PriorityStandard || opts[0].EstimatedCost != listPrice {
+		t.Errorf("standard quote = %s at %.2f; want STANDARD at %.2f", opts[0].Priority, opts[0].EstimatedCost, listPrice)
+	}
+
+	req.Priority = models.PriorityExpress
+	opts, err = svc.CalculateRouteOptions(ctx, req)
+	if err != nil {
+		t.Fatalf("CalculateRouteOptions error: %v", err)
+	}
+	want := withSurcharge(listPrice, models.ExpressSurcharge)
+	if opts[0].Priority != models.PriorityExpress || opts[0].PrioritySurcharge != models.ExpressSurcharge || opts[0].EstimatedCost != want {
+		t.Errorf("express quote = %s +%v at %.2f; want EXPRESS +%v at %.2f", opts[0].Priority, opts[0].PrioritySurcharge, opts[0].EstimatedCost, models.ExpressSurcharge, want)
+	}
+
+	req.Priority = "OVERNIGHT"
+	var apiErr *models.APIError
+	if _, err := svc.CalculateRouteOptions(ctx, req); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+		t.Errorf("unknown priority error = %v; want a validation error", err)
+	}
+}
+
+func TestCostBreakdown(t *testing.T) {
+	fr := newFakeRepo()
+	resp := `{"routes":[{"overview_polyline":{"points":"abc"},"legs":[{"distance":{"value":2000},"duration":{"value":600}}]}]}`
+	svc := newTestService(fr, resp, WithTaxRate(0.08))
+	ctx := context.Background()
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A"},
+		DeliveryLocation: models.Address{StreetAddress: "B"},
+		WeightKG:         1,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		Priority:         models.PriorityExpress,
+	}
+	tests := []struct {
+		name string
+		at   time.Time
+		want models.CostBreakdown
+	}{
+		// 无人机 2 公里：2.00 + 2 × 0.50，EXPRESS 加价 50%，税 8%
+		{"off-peak", time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC), models.CostBreakdown{
+			BaseFare: 2, DistanceCharge: 1, PrioritySurcharge: 1.5, Tax: 0.36, Total: 4.86,
+		}},
+		// 高峰规则只收 1.2 倍基础费
+		{"peak", time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC), models.CostBreakdown{
+			BaseFare: 2, PeakSurcharge: 0.4, PrioritySurcharge: 1.2, Tax: 0.29, Total: 3.89,
+		}},
+	}
+	for _, tt := range tests {
+		req.RequestedTime = tt.at
+		opts, err := svc.CalculateRouteOptions(ctx, req)
+		if err != nil {
+			t.Fatalf("%s: CalculateRouteOptions error: %v", tt.name, err)
+		}
+		i := slices.IndexFunc(opts, func(o models.RouteOption) bool { return o.MachineType == models.MachineTypeDrone })
+		if i < 0 {
+			t.Fatalf("%s: no drone option in %+v", tt.name, opts)
+		}
+		if got := opts[i]; got.CostBreakdown != tt.want || got.EstimatedCost != tt.want.Total {
+			t.Errorf("%s: breakdown = %+v, cost %.2f; want %+v", tt.name, got.CostBreakdown, got.EstimatedCost, tt.want)
+		}
+	}
+
+	free := tests[0].want.WithDiscount(10)
+	if free.Discount != 4.86 || free.Total != 0 {
+		t.Errorf("WithDiscount(10) = %+v; want the whole 4.86 discounted", free)
+	}
+}
+
+func TestWeatherQuotes(t *testing.T) {
+	fr := newFakeRepo()
+	wx := &fakeWeather{}
+	resp := `{"routes":[{"overview_polyline":{"points":"_p~iF~ps|U_ulLnnqC"},"legs":[{"distance":{"value":1000},"duration":{"value":600}}]}]}`
+	svc := NewService(fr, "test", WithWeather(wx, DefaultWeatherPolicy()), WithHTTPClient(&http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(resp)), Header: http.Header{}}, nil
+		}),
+	}))
+	ctx := context.Background()
+	req := models.RouteRequest{
+		PickupLocation:   models.Address{StreetAddress: "A"},
+		DeliveryLocation: models.Address{StreetAddress: "B"},
+		WeightKG:         1,
+		Dimensions:       models.Dimensions{Length: 0.3, Width: 0.3, Height: 0.3},
+		RequestedTime:    time.Date(2023, 1, 1, 14, 0, 0, 0, time.UTC),
+	}
+	quote := func() map[models.MachineType]models.RouteOption {
+		t.Helper()
+		opts, err := svc.CalculateRouteOptions(ctx, req)
+		if err != nil {
+			t.Fatalf("CalculateRouteOptions error: %v", err)
+		}
+		byType := map[models.MachineType]models.RouteOption{}
+		for _, o := range opts {
+			byType[o.MachineType] = o
+		}
+		return byType
+	}
+	droneCost, _ := quotePrice(nil, models.MachineTypeDrone, 1000, req.RequestedTime)
+
+	// 无风无雨：两个选项都按原价
+	if opts := quote(); len(opts) != 2 || opts[models.MachineTypeDrone].EstimatedCost != droneCost {
+		t.Errorf("calm quote = %+v; want both options at list price", opts)
+	}
+	// 阵风接近上限：无人机上浮 25%
+	wx.cond = weather.Conditions{WindSpeedMS: 5, WindGustMS: 9}
+	opts := quote()
+	if d := opts[models.MachineTypeDrone]; d.WeatherSurcharge != 0.25 || d.EstimatedCost != withSurcharge(droneCost, 0.25) {
+		t.Errorf("gusty drone option = %+v; want a 25%% surcharge", d)
+	}
+	if r := opts[models.MachineTypeRobot]; r.WeatherSurcharge != 0 {
+		t.Errorf("gusty robot option = %+v; want no surcharge", r)
+	}
+	// 超过无人机的风速上限：只剩地面机器人
+	wx.cond = weather.Conditions{WindSpeedMS: 14}
+	if opts := quote(); len(opts) != 1 || opts[models.MachineTypeRobot].ID == "" {
+		t.Errorf("windy quote = %+v; want only the robot option", opts)
+	}
+	// 暴雨：没有可用选项
+	wx.cond = weather.Conditions{PrecipitationMMH: 30}
+	if _, err := svc.CalculateRouteOptions(ctx, req); !errors.Is(err, models.ErrWeatherUnsafe) {
+		t.Errorf("CalculateRouteOptions in a storm error = %v; want ErrWeatherUnsafe", err)
+	}
+	// 天气服务故障时不限制报价
+	wx.err = errors.New("weather down")
+	if opts := quote(); len(opts) != 2 {
+		t.Errorf("quote without weather = %+v; want both options", opts)
+	}
+}
+
+func TestReturnToCharge(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Type: models.MachineTypeRobot, Status: models.StatusIdle, Latitude: 37.78, Longitude: -122.40, BatteryLevel: 60}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Type: models.MachineTypeDrone, Status: models.StatusIdle, Latitude: 37.80, Longitude: -122.40, BatteryLevel: 10}
+	fr.machines["m3"] = &models.Machine{ID: "m3", Type: models.MachineTypeDrone, Status: models.StatusInTransit, BatteryLevel: 5}
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+	for _, req := range []models.DepotRequest{
+		{Name: "south", Location: &models.GeoPoint{Latitude: 37.70, Longitude: -122.40}},
+		{Name: "north", Location: &models.GeoPoint{Latitude: 37.79, Longitude: -122.40}},
+	} {
+		if _, err := svc.CreateDepot(ctx, req); err != nil {
+			t.Fatalf("CreateDepot error: %v", err)
+		}
+	}
+
+	// 遥测电量跌破阈值：转为 CHARGING，前往最近的 north 充电站（约 1.1 km × 绕行系数 1.3）
+	battery := 15
+	if err := svc.IngestTelemetry(ctx, "m1", models.MachineTelemetry{Latitude: 37.78, Longitude: -122.40, BatteryLevel: &battery}); err != nil {
+		t.Fatalf("IngestTelemetry error: %v", err)
 	}
-	if err := svc.SetMachineStatus(context.Background(), "m1", req); err != nil {
-		t.Fatalf("SetMachineStatus error: %v", err)
+	if got := fr.machines["m1"].Status; got != models.StatusCharging {
+		t.Errorf("m1 status = %s; want CHARGING", got)
 	}
-	// 验证 repo 中的机器记录已被更新
-	updated := fr.machines["m1"]
-	if updated.Status != models.StatusCharging {
-		t.Errorf("updated.Status = %s; want Charging", updated.Status)
+	trip, err := svc.GetChargeTrip(ctx, "m1")
+	if err != nil || trip.DepotID != "depot-2" || trip.DistanceMeters < 1400 || trip.DistanceMeters > 1500 {
+		t.Fatalf("GetChargeTrip(m1) = %+v, %v; want ~1446 m to depot-2", trip, err)
 	}
-	if updated.Latitude != 3.0 || updated.Longitude != 4.0 {
-		t.Errorf("updated coords = (%f,%f); want (3,4)", updated.Latitude, updated.Longitude)
+
+	// 定期检查覆盖没有上报遥测的机器；配送中的机器不受影响
+	if err := svc.ReturnToCharge(ctx); err != nil {
+		t.Fatalf("ReturnToCharge error: %v", err)
+	}
+	if fr.machines["m2"].Status != models.StatusCharging || fr.chargeTrips["m2"] == nil {
+		t.Errorf("m2 = %+v, trip %v; want CHARGING with a trip", fr.machines["m2"], fr.chargeTrips["m2"])
+	}
+	if fr.machines["m3"].Status != models.StatusInTransit {
+		t.Errorf("m3 status = %s; want IN_TRANSIT", fr.machines["m3"].Status)
+	}
+
+	// CHARGING 的机器不参与派单
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 37.78, Longitude: -122.40}
+	if _, err := svc.AssignOrder(ctx, "o1"); !errors.Is(err, models.ErrNoMachineAvailable) {
+		t.Errorf("AssignOrder error = %v; want ErrNoMachineAvailable", err)
+	}
+
+	// 充到恢复阈值后回到 IDLE，行程删除
+	battery = 95
+	if err := svc.IngestTelemetry(ctx, "m1", models.MachineTelemetry{Latitude: 37.79, Longitude: -122.40, BatteryLevel: &battery}); err != nil {
+		t.Fatalf("IngestTelemetry error: %v", err)
+	}
+	if got := fr.machines["m1"].Status; got != models.StatusIdle {
+		t.Errorf("m1 status after recharge = %s; want IDLE", got)
+	}
+	if _, err := svc.GetChargeTrip(ctx, "m1"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetChargeTrip after recharge error = %v; want ErrNotFound", err)
 	}
 }
 
-func TestComputeRoute(t *testing.T) {
+func TestRegisterAndDecommissionMachine(t *testing.T) {
 	fr := newFakeRepo()
-	// 预置目的地映射
-	fr.orderDest["o1"] = "dest-X"
-	resp := `{"routes":[{"overview_polyline":{"points":"xyz"},"legs":[{"distance":{"value":500},"duration":{"value":300}}]}]}`
-	svc := newTestService(fr, resp)
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+
+	// 单机载重不能超过机器类型的上限
+	tooHeavy := 5.0
+	_, err := svc.RegisterMachine(ctx, models.RegisterMachineRequest{
+		Type: models.MachineTypeDrone, Location: &models.GeoPoint{Latitude: 37.78, Longitude: -122.40}, MaxWeightKG: &tooHeavy,
+	})
+	if !errors.Is(err, models.ErrInvalidMachineCapacity) {
+		t.Fatalf("RegisterMachine(5 kg drone) error = %v; want ErrInvalidMachineCapacity", err)
+	}
 
-	route, err := svc.ComputeRoute(context.Background(), "o1")
+	// 注册后立即可以用签发的 Key 认证，电量缺省为 100
+	maxWeight := 2.0
+	reg, err := svc.RegisterMachine(ctx, models.RegisterMachineRequest{
+		Type: models.MachineTypeDrone, Location: &models.GeoPoint{Latitude: 37.78, Longitude: -122.40}, MaxWeightKG: &maxWeight,
+	})
 	if err != nil {
-		t.Fatalf("ComputeRoute error: %v", err)
+		t.Fatalf("RegisterMachine error: %v", err)
 	}
-	// 验证返回值及 repo 保存行为
-	if route.DistanceMeters != 500 {
-		t.Errorf("ComputeRoute DistanceMeters = %d; want 500", route.DistanceMeters)
+	if reg.Machine.Status != models.StatusIdle || reg.Machine.BatteryLevel != 100 {
+		t.Errorf("registered machine = %+v; want IDLE with battery 100", reg.Machine)
 	}
-	if len(fr.routes) != 1 {
-		t.Errorf("fakeRepo.routes length = %d; want 1", len(fr.routes))
+	if id, err := svc.AuthenticateMachine(ctx, reg.APIKey); err != nil || id != reg.Machine.ID {
+		t.Errorf("AuthenticateMachine = %q, %v; want %s", id, err, reg.Machine.ID)
+	}
+
+	// 超出单机载重的包裹不派给该机器
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 37.78, Longitude: -122.40}
+	fr.orderPackages["o1"] = models.Order{ItemWeightKg: 2.5}
+	if _, err := svc.AssignOrder(ctx, "o1"); !errors.Is(err, models.ErrNoMachineAvailable) {
+		t.Errorf("AssignOrder(2.5 kg) error = %v; want ErrNoMachineAvailable", err)
+	}
+
+	// 配送中的机器不能退役；空闲后退役，Key 随之失效
+	fr.orderPackages["o1"] = models.Order{ItemWeightKg: 1}
+	if _, err := svc.AssignOrder(ctx, "o1"); err != nil {
+		t.Fatalf("AssignOrder error: %v", err)
+	}
+	if err := svc.DeleteMachine(ctx, reg.Machine.ID); !errors.Is(err, models.ErrMachineBusy) {
+		t.Errorf("DeleteMachine(in transit) error = %v; want ErrMachineBusy", err)
+	}
+	fr.machines[reg.Machine.ID].Status = models.StatusIdle
+	if err := svc.DeleteMachine(ctx, reg.Machine.ID); err != nil {
+		t.Fatalf("DeleteMachine error: %v", err)
+	}
+	if _, err := svc.AuthenticateMachine(ctx, reg.APIKey); !errors.Is(err, models.ErrInvalidCredentials) {
+		t.Errorf("AuthenticateMachine after decommission error = %v; want ErrInvalidCredentials", err)
 	}
 }
 
-func TestTrackingEvents(t *testing.T) {
-    fr := newFakeRepo()
-    svc := NewService(fr, "test")
-    ctx := context.Background()
+func TestMachineHistory(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusIdle, BatteryLevel: 80}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Status: models.StatusCharging, BatteryLevel: 20}
+	svc := NewService(fr, "test", WithTelemetryRetention(time.Hour))
+	ctx := context.Background()
 
-  
-    err := svc.ReportTracking(ctx, "order-1", models.TrackingEventRequest{
-        MachineID: "",         
-        Latitude:  12.34,
-        Longitude: 56.78,
-    })
-    if err != nil {
-        t.Fatalf("ReportTracking error: %v", err)
-    }
-    err = svc.ReportTracking(ctx, "order-1", models.TrackingEventRequest{
-        MachineID: "",
-        Latitude:  98.76,
-        Longitude: 54.32,
-    })
-    if err != nil {
-        t.Fatalf("ReportTracking error: %v", err)
-    }
+	// 过期的快照在下一次快照时被删除
+	fr.snapshots = append(fr.snapshots, fakeSnapshot{"m1", models.MachineHistoryPoint{RecordedAt: time.Now().Add(-2 * time.Hour)}})
+	if err := svc.SnapshotFleet(ctx); err != nil {
+		t.Fatalf("SnapshotFleet error: %v", err)
+	}
+	if len(fr.snapshots) != 2 {
+		t.Fatalf("stored %d snapshots; want one per machine after pruning", len(fr.snapshots))
+	}
 
-    evs, err := svc.GetTracking(ctx, "order-1", time.Time{})
-    if err != nil {
-        t.Fatalf("GetTracking error: %v", err)
-    }
+	to := time.Now().Add(time.Second)
+	h, err := svc.GetMachineHistory(ctx, "m1", models.MachineHistoryQuery{From: to.Add(-24 * time.Hour), To: to})
+	if err != nil {
+		t.Fatalf("GetMachineHistory error: %v", err)
+	}
+	if len(h.Points) != 1 || h.Points[0].BatteryLevel != 80 {
+		t.Errorf("points = %+v; want the m1 snapshot", h.Points)
+	}
+	// 24 小时缺省分成 500 桶：172.8 秒向上取整为 173 秒
+	if h.BucketSeconds != 173 || fr.historyBucket != 173*time.Second {
+		t.Errorf("bucket = %d s (repo %v); want 173 s", h.BucketSeconds, fr.historyBucket)
+	}
+	// 很短的区间桶宽至少 1 秒；点数超过上限时按上限计算
+	h, _ = svc.GetMachineHistory(ctx, "m1", models.MachineHistoryQuery{From: to.Add(-time.Minute), To: to, MaxPoints: 10000})
+	if h.BucketSeconds != 1 {
+		t.Errorf("bucket for 1 minute = %d s; want 1", h.BucketSeconds)
+	}
+	if _, err := svc.GetMachineHistory(ctx, "missing", models.MachineHistoryQuery{From: to.Add(-time.Hour), To: to}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetMachineHistory for unknown machine error = %v; want ErrNotFound", err)
+	}
+}
 
-    if len(evs) != 2 {
-        t.Errorf("GetTracking returned %d; want 2", len(evs))
-    }
-    if len(fr.trackingEvents) != 2 {
-        t.Errorf("fakeRepo.trackingEvents length = %d; want 2", len(fr.trackingEvents))
-    }
+func TestMarkOfflineMachines(t *testing.T) {
+	fr := newFakeRepo()
+	old := time.Now().Add(-time.Hour)
+	fr.machines["m1"] = &models.Machine{ID: "m1", Type: models.MachineTypeDrone, Status: models.StatusIdle, CreatedAt: old}
+	fr.machines["m2"] = &models.Machine{ID: "m2", Type: models.MachineTypeDrone, Status: models.StatusIdle, CreatedAt: old}
+	fr.machines["m3"] = &models.Machine{ID: "m3", Type: models.MachineTypeRobot, Status: models.StatusInTransit, CreatedAt: old}
+	fr.machines["m4"] = &models.Machine{ID: "m4", Type: models.MachineTypeRobot, Status: models.StatusMaintenance, CreatedAt: old}
+	fr.heartbeats["m3"] = old
+	svc := NewService(fr, "test", WithHeartbeatTimeout(5*time.Minute))
+	ctx := context.Background()
+
+	if err := svc.Heartbeat(ctx, "m1"); err != nil {
+		t.Fatalf("Heartbeat error: %v", err)
+	}
+	if err := svc.MarkOfflineMachines(ctx); err != nil {
+		t.Fatalf("MarkOfflineMachines error: %v", err)
+	}
+	want := map[string]models.MachineStatus{
+		"m1": models.StatusIdle,        // 刚发送过心跳
+		"m2": models.StatusOffline,     // 从未发送心跳
+		"m3": models.StatusOffline,     // 配送中掉线
+		"m4": models.StatusMaintenance, // 维护中的机器不检查
+	}
+	for id, status := range want {
+		if got := fr.machines[id].Status; got != status {
+			t.Errorf("%s status = %s; want %s", id, got, status)
+		}
+	}
+	if len(fr.notifications) != 2 {
+		t.Fatalf("notifications = %q; want 2", fr.notifications)
+	}
+	for _, msg := range fr.notifications {
+		if strings.Contains(msg, "m3") != strings.Contains(msg, "on a delivery") {
+			t.Errorf("notification %q: only m3 was on a delivery", msg)
+		}
+	}
+
+	// OFFLINE 的机器不在空闲列表中，再次心跳后恢复
+	idle, _ := fr.ListIdleMachines(ctx)
+	if len(idle) != 1 || idle[0].ID != "m1" {
+		t.Errorf("ListIdleMachines = %v; want only m1", idle)
+	}
+	if err := svc.Heartbeat(ctx, "m2"); err != nil || fr.machines["m2"].Status != models.StatusIdle {
+		t.Errorf("Heartbeat(m2) = %v, status %s; want IDLE", err, fr.machines["m2"].Status)
+	}
+	// 掉线前在配送的机器恢复为 IN_TRANSIT，不会再被派单
+	fr.ordersAssigned["o3"], fr.orderStatuses["o3"] = "m3", models.OrderStatusInProgress
+	if err := svc.Heartbeat(ctx, "m3"); err != nil || fr.machines["m3"].Status != models.StatusInTransit {
+		t.Errorf("Heartbeat(m3) = %v, status %s; want IN_TRANSIT", err, fr.machines["m3"].Status)
+	}
+	if idle, _ := fr.ListIdleMachines(ctx); len(idle) != 2 {
+		t.Errorf("ListIdleMachines = %v; want m1 and m2", idle)
+	}
+
+	// 再次运行不会重复通知
+	if err := svc.MarkOfflineMachines(ctx); err != nil || len(fr.notifications) != 2 {
+		t.Errorf("second MarkOfflineMachines = %v, %d notifications; want nil, 2", err, len(fr.notifications))
+	}
+}
+
+// fakePublisher 记录推送的命令；fail 为 true 时模拟 Broker 不可用
+type fakePublisher struct {
+	fail      bool
+	published []string
+}
+
+func (p *fakePublisher) PublishCommand(ctx context.Context, cmd *models.MachineCommand) error {
+	if p.fail {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, cmd.ID)
+	return nil
+}
+
+func TestMachineCommands(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusIdle}
+	pub := &fakePublisher{fail: true}
+	svc := NewService(fr, "test", WithCommandPublisher(pub))
+	ctx := context.Background()
+
+	// Broker 不可用时命令仍然排队，机器可以轮询取得
+	cmd, err := svc.SendMachineCommand(ctx, "m1", "admin-1", models.MachineCommandRequest{Command: models.CommandPause})
+	if err != nil {
+		t.Fatalf("SendMachineCommand error: %v", err)
+	}
+	if cmd.Status != models.CommandPending || cmd.CreatedBy != "admin-1" {
+		t.Errorf("command = %+v; want PENDING, created by admin-1", cmd)
+	}
+	if ttl := time.Until(cmd.ExpiresAt); ttl < 9*time.Minute || ttl > models.DefaultCommandTTL {
+		t.Errorf("command expires in %v; want the default TTL", ttl)
+	}
+	if _, err := svc.SendMachineCommand(ctx, "missing", "admin-1", models.MachineCommandRequest{Command: models.CommandReboot}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("SendMachineCommand to unknown machine error = %v; want ErrNotFound", err)
+	}
+
+	// 未确认的命令每次轮询都会返回
+	for i := 0; i < 2; i++ {
+		cmds, err := svc.PollMachineCommands(ctx, "m1")
+		if err != nil || len(cmds) != 1 || cmds[0].ID != cmd.ID || cmds[0].Status != models.CommandDelivered {
+			t.Fatalf("poll %d = %+v, %v; want the delivered PAUSE command", i, cmds, err)
+		}
+	}
+
+	// 确认是幂等的：第二次（相反的）确认返回第一次的结果
+	yes, no := true, false
+	acked, err := svc.AckMachineCommand(ctx, "m1", cmd.ID, models.MachineCommandAck{Accepted: &yes})
+	if err != nil || acked.Status != models.CommandAcknowledged || acked.AckedAt == nil {
+		t.Fatalf("AckMachineCommand = %+v, %v; want ACKNOWLEDGED", acked, err)
+	}
+	again, err := svc.AckMachineCommand(ctx, "m1", cmd.ID, models.MachineCommandAck{Accepted: &no, Reason: "late"})
+	if err != nil || again.Status != models.CommandAcknowledged {
+		t.Errorf("duplicate ack = %+v, %v; want ACKNOWLEDGED kept", again, err)
+	}
+	if _, err := svc.AckMachineCommand(ctx, "m2", cmd.ID, models.MachineCommandAck{Accepted: &yes}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ack from another machine error = %v; want ErrNotFound", err)
+	}
+	if cmds, _ := svc.PollMachineCommands(ctx, "m1"); len(cmds) != 0 {
+		t.Errorf("poll after ack = %+v; want none", cmds)
+	}
+
+	// 拒绝记录原因
+	reboot, _ := svc.SendMachineCommand(ctx, "m1", "admin-1", models.MachineCommandRequest{Command: models.CommandReboot})
+	rejected, err := svc.AckMachineCommand(ctx, "m1", reboot.ID, models.MachineCommandAck{Accepted: &no, Reason: "carrying a package"})
+	if err != nil || rejected.Status != models.CommandRejected || rejected.Reason != "carrying a package" {
+		t.Errorf("reject = %+v, %v; want REJECTED with reason", rejected, err)
+	}
+
+	// Broker 恢复后，清扫任务重新推送未送达的命令并将超时命令标记为 EXPIRED
+	rtb, _ := svc.SendMachineCommand(ctx, "m1", "admin-1", models.MachineCommandRequest{Command: models.CommandReturnToBase})
+	stale, _ := svc.SendMachineCommand(ctx, "m1", "admin-1", models.MachineCommandRequest{Command: models.CommandResume})
+	fr.commands[3].ExpiresAt = time.Now().Add(-time.Second)
+	pub.fail = false
+	if err := svc.SweepMachineCommands(ctx); err != nil {
+		t.Fatalf("SweepMachineCommands error: %v", err)
+	}
+	if len(pub.published) != 1 || pub.published[0] != rtb.ID {
+		t.Errorf("published = %v; want only %s", pub.published, rtb.ID)
+	}
+	history, err := svc.ListMachineCommands(ctx, "m1")
+	if err != nil || len(history) != 4 {
+		t.Fatalf("ListMachineCommands = %d commands, %v; want 4", len(history), err)
+	}
+	want := map[string]models.MachineCommandStatus{
+		cmd.ID:    models.CommandAcknowledged,
+		reboot.ID: models.CommandRejected,
+		rtb.ID:    models.CommandDelivered,
+		stale.ID:  models.CommandExpired,
+	}
+	for _, c := range history {
+		if c.Status != want[c.ID] {
+			t.Errorf("%s %s status = %s; want %s", c.ID, c.Command, c.Status, want[c.ID])
+		}
+	}
+	if history[0].ID != stale.ID {
+		t.Errorf("history starts with %s; want newest first", history[0].ID)
+	}
+}
+
+func TestFleetReports(t *testing.T) {
+	fr := newFakeRepo()
+	fr.utilization = []models.MachineUtilization{
+		{MachineID: "m1", Type: models.MachineTypeDrone, InTransitSeconds: 3600, IdleSeconds: 2400, ChargingSeconds: 1200, OtherSeconds: 0},
+		{MachineID: "m2", Type: models.MachineTypeRobot},
+	}
+	fr.deliveries = []models.DailyDeliveries{{Date: "2025-03-02", Deliveries: 3, ByDrone: 2, ByRobot: 1}}
+	fr.distances = []models.WeeklyDistance{{WeekStart: "2025-02-24", MachineID: "m1", Type: models.MachineTypeDrone, DistanceKM: 12.5}}
+	fr.revenue = []models.DailyRevenue{{Date: "2025-03-03", Charged: 40.5, Tips: 4, Refunded: 10.25}}
+	svc := NewService(fr, "test")
+	ctx := context.Background()
+	q := models.ReportQuery{
+		From: time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC),
+		To:   time.Date(2025, 3, 4, 0, 0, 0, 0, time.UTC),
+	}
+
+	util, err := svc.GetUtilizationReport(ctx, q)
+	if err != nil {
+		t.Fatalf("GetUtilizationReport error: %v", err)
+	}
+	if got := util.Machines[0].Utilization; got != 0.5 {
+		t.Errorf("m1 utilization = %v; want 0.5", got)
+	}
+	if got := util.Machines[1].Utilization; got != 0 {
+		t.Errorf("m2 without telemetry: utilization = %v; want 0", got)
+	}
+
+	// 没有送达的日期补 0：3 月 1 日（from 所在日）到 3 月 3 日
+	deliveries, err := svc.GetDeliveriesReport(ctx, q)
+	if err != nil {
+		t.Fatalf("GetDeliveriesReport error: %v", err)
+	}
+	var dates []string
+	for _, d := range deliveries.Days {
+		dates = append(dates, fmt.Sprintf("%s:%d", d.Date, d.Deliveries))
+	}
+	if got := strings.Join(dates, " "); got != "2025-03-01:0 2025-03-02:3 2025-03-03:0" {
+		t.Errorf("days = %s; want 3 days with 3 deliveries on 03-02", got)
+	}
+
+	// 收入报表：Net = 扣款 + 小费 - 退款，没有支付的日期补 0
+	revenue, err := svc.GetRevenueReport(ctx, q)
+	if err != nil {
+		t.Fatalf("GetRevenueReport error: %v", err)
+	}
+	if len(revenue.Days) != 3 || revenue.Days[0] != (models.DailyRevenue{Date: "2025-03-01"}) || revenue.Days[2].Net != 34.25 {
+		t.Errorf("revenue days = %+v; want 3 days netting 34.25 on 03-03", revenue.Days)
+	}
+
+	// CSV 导出
+	h := NewHandler(svc)
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/logistics/reports/utilization?format=csv&from=2025-03-01T12:00:00Z&to=2025-03-04T00:00:00Z", nil)
+	rec := httptest.NewRecorder()
+	if err := h.GetUtilizationReport(e.NewContext(req, rec)); err != nil {
+		t.Fatalf("GetUtilizationReport handler error: %v", err)
+	}
+	if ct := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Content-Type = %q; want text/csv", ct)
+	}
+	if cd := rec.Header().Get(echo.HeaderContentDisposition); !strings.Contains(cd, "utilization-2025-03-01-2025-03-04.csv") {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	wantCSV := "machine_id,type,in_transit_seconds,idle_seconds,charging_seconds,other_seconds,utilization\n" +
+		"m1,DRONE,3600,2400,1200,0,0.5000\n" +
+		"m2,ROBOT,0,0,0,0,0.0000\n"
+	if rec.Body.String() != wantCSV {
+		t.Errorf("CSV =\n%s\nwant\n%s", rec.Body.String(), wantCSV)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/logistics/reports/distance?format=csv", nil)
+	rec = httptest.NewRecorder()
+	if err := h.GetDistanceReport(e.NewContext(req, rec)); err != nil {
+		t.Fatalf("GetDistanceReport handler error: %v", err)
+	}
+	if !strings.Contains(rec.Body.String(), "2025-02-24,m1,DRONE,12.500") {
+		t.Errorf("distance CSV = %q; want the m1 week", rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/logistics/reports/revenue?format=csv&from=2025-03-01T12:00:00Z&to=2025-03-04T00:00:00Z", nil)
+	rec = httptest.NewRecorder()
+	if err := h.GetRevenueReport(e.NewContext(req, rec)); err != nil {
+		t.Fatalf("GetRevenueReport handler error: %v", err)
+	}
+	if !strings.Contains(rec.Body.String(), "date,charged,tips,refunded,net\n") || !strings.Contains(rec.Body.String(), "2025-03-03,40.50,4.00,10.25,34.25\n") {
+		t.Errorf("revenue CSV = %q; want the header and the 03-03 totals", rec.Body.String())
+	}
+
+	// 超过 366 天或未知格式被拒绝
+	for _, query := range []string{"from=2023-01-01T00:00:00Z&to=2025-01-01T00:00:00Z", "format=xml"} {
+		req = httptest.NewRequest(http.MethodGet, "/logistics/reports/deliveries?"+query, nil)
+		err := h.GetDeliveriesReport(e.NewContext(req, httptest.NewRecorder()))
+		var apiErr *models.APIError
+		if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+			t.Errorf("%s: err = %v; want 400", query, err)
+		}
+	}
+}
+
+// agentClient 通过内存连接（bufconn）连上 MachineAgent 服务
+func agentClient(t *testing.T, srv *AgentServer) agentpb.MachineAgentClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	gs := srv.GRPCServer()
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	conn, err := grpc.NewClient("passthrough:///agent",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return agentpb.NewMachineAgentClient(conn)
+}
+
+func TestAgentStream(t *testing.T) {
+	fr := newFakeRepo()
+	fr.machines["m1"] = &models.Machine{ID: "m1", Status: models.StatusInTransit, BatteryLevel: 50}
+	fr.keyHashes["m1"] = hashMachineKey("key-1")
+	fr.ordersAssigned["o1"] = "m1"
+	fr.orderStatuses["o1"] = models.OrderStatusInProgress
+	fr.orderPickups["o1"] = models.GeoPoint{Latitude: 37.77, Longitude: -122.42}
+	fr.orderDropoffs["o1"] = models.GeoPoint{Latitude: 37.79, Longitude: -122.40}
+	fr.recipients["o1"] = models.Recipient{Name: "Ada", Instructions: "Leave at the door"}
+	hub := NewAgentHub()
+	mqtt := &fakePublisher{fail: true}
+	svc := NewService(fr, "test", WithCommandPublisher(CommandPublishers(hub, mqtt)))
+	client := agentClient(t, NewAgentServer(svc, hub, time.Hour))
+	ctx := context.Background()
+
+	// 缺少或错误的 API Key 都无法建立流
+	for _, key := range []string{"", "wrong"} {
+		callCtx := ctx
+		if key != "" {
+			callCtx = metadata.AppendToOutgoingContext(ctx, AgentKeyMetadata, key)
+		}
+		stream, err := client.Connect(callCtx)
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Connect with key %q error = %v; want Unauthenticated", key, err)
+		}
+	}
+
+	// 离线期间排队的命令在连接建立时下发，随后是当前任务
+	queued, err := svc.SendMachineCommand(ctx, "m1", "admin-1", models.MachineCommandRequest{Command: models.CommandPause})
+	if err != nil {
+		t.Fatalf("SendMachineCommand error: %v", err)
+	}
+	connect := func() (agentpb.MachineAgent_ConnectClient, context.CancelFunc) {
+		t.Helper()
+		streamCtx, cancel := context.WithTimeout(metadata.AppendToOutgoingContext(ctx, AgentKeyMetadata, "key-1"), 10*time.Second)
+		stream, err := client.Connect(streamCtx)
+		if err != nil {
+			t.Fatalf("Connect error: %v", err)
+		}
+		return stream, cancel
+	}
+	recv := func(stream agentpb.MachineAgent_ConnectClient) *agentpb.ServerMessage {
+		t.Helper()
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv error: %v", err)
+		}
+		return msg
+	}
+	stream, cancel := connect()
+	defer cancel()
+	if cmd := recv(stream).GetCommand(); cmd == nil || cmd.Id != queued.ID || cmd.Command != "PAUSE" {
+		t.Fatalf("first message command = %v; want the queued PAUSE", cmd)
+	}
+	as := recv(stream).GetAssignments()
+	if as == nil || len(as.Assignments) != 1 {
+		t.Fatalf("second message assignments = %v; want o1", as)
+	}
+	if a := as.Assignments[0]; a.OrderId != "o1" || a.Dropoff.GetLatitude() != 37.79 || a.Recipient.GetDeliveryInstructions() != "Leave at the door" {
+		t.Errorf("assignment = %v; want o1 with its dropoff and recipient", a)
+	}
+
+	// 遥测经 IngestTelemetry 入库；越界数据以 Rejection 回复，流不中断
+	battery := int32(42)
+	send := func(msg *agentpb.AgentMessage) {
+		t.Helper()
+		if err := stream.Send(msg); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+	}
+	send(&agentpb.AgentMessage{Seq: 1, Payload: &agentpb.AgentMessage_Telemetry{Telemetry: &agentpb.Telemetry{
+		Latitude: 37.78, Longitude: -122.41, BatteryLevel: &battery, OrderId: "o1",
+	}}})
+	send(&agentpb.AgentMessage{Seq: 2, Payload: &agentpb.AgentMessage_Telemetry{Telemetry: &agentpb.Telemetry{Latitude: 91}}})
+	if r := recv(stream).GetRejection(); r == nil || r.Seq != 2 || r.Code != string(models.CodeValidationFailed) {
+		t.Fatalf("reply to latitude 91 = %v; want a validation rejection of seq 2", r)
+	}
+	if m := fr.machines["m1"]; m.Latitude != 37.78 || m.BatteryLevel != 42 || len(fr.trackingEvents) != 1 {
+		t.Errorf("machine after telemetry = %+v, %d tracking events; want position 37.78, battery 42, one event", m, len(fr.trackingEvents))
+	}
+	send(&agentpb.AgentMessage{Seq: 3, Payload: &agentpb.AgentMessage_Telemetry{Telemetry: &agentpb.Telemetry{Latitude: 1, Longitude: 1, OrderId: "o2"}}})
+	if r := recv(stream).GetRejection(); r == nil || r.Seq != 3 || r.Code != string(models.CodeForbidden) {
+		t.Errorf("reply to telemetry for an unassigned order = %v; want a forbidden rejection of seq 3", r)
+	}
+
+	// 新命令直接推送到本实例的流上，不经 MQTT
+	reboot, err := svc.SendMachineCommand(ctx, "m1", "admin-1", models.MachineCommandRequest{Command: models.CommandReboot})
+	if err != nil {
+		t.Fatalf("SendMachineCommand error: %v", err)
+	}
+	if cmd := recv(stream).GetCommand(); cmd == nil || cmd.Id != reboot.ID || cmd.Command != "REBOOT" {
+		t.Fatalf("pushed command = %v; want REBOOT", cmd)
+	}
+	if reboot.Status != models.CommandDelivered {
+		t.Errorf("pushed command status = %s; want DELIVERED", reboot.Status)
+	}
+
+	// 确认经 AckMachineCommand 记录；缺少 command_id 或命令不存在时被拒绝
+	send(&agentpb.AgentMessage{Seq: 4, Payload: &agentpb.AgentMessage_Ack{Ack: &agentpb.CommandAck{CommandId: reboot.ID, Accepted: false, Reason: "carrying a package"}}})
+	send(&agentpb.AgentMessage{Seq: 5, Payload: &agentpb.AgentMessage_Ack{Ack: &agentpb.CommandAck{Accepted: true}}})
+	if r := recv(stream).GetRejection(); r == nil || r.Seq != 5 || r.Code != string(models.CodeValidationFailed) {
+		t.Fatalf("reply to ack without command_id = %v; want a validation rejection of seq 5", r)
+	}
+	if c := fr.commands[1]; c.Status != models.CommandRejected || c.Reason != "carrying a package" {
+		t.Errorf("REBOOT after ack = %s %q; want REJECTED with the reason", c.Status, c.Reason)
+	}
+	send(&agentpb.AgentMessage{Seq: 6, Payload: &agentpb.AgentMessage_Ack{Ack: &agentpb.CommandAck{CommandId: "missing", Accepted: true}}})
+	send(&agentpb.AgentMessage{Seq: 7})
+	if r := recv(stream).GetRejection(); r == nil || r.Seq != 6 || r.Code != string(models.CodeNotFound) {
+		t.Errorf("reply to ack of an unknown command = %v; want a not_found rejection of seq 6", r)
+	}
+	if r := recv(stream).GetRejection(); r == nil || r.Seq != 7 || r.Code != string(models.CodeInvalidRequest) {
+		t.Errorf("reply to an empty message = %v; want an invalid_request rejection of seq 7", r)
+	}
+	send(&agentpb.AgentMessage{Seq: 8, Payload: &agentpb.AgentMessage_Heartbeat{Heartbeat: &agentpb.Heartbeat{}}})
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("Recv after CloseSend error = %v; want io.EOF", err)
+	}
+	if _, ok := fr.heartbeats["m1"]; !ok {
+		t.Error("heartbeat on the stream was not recorded")
+	}
+
+	// 断开后命令改走 MQTT；重连时重新下发未确认的命令与最新任务
+	mqtt.fail = false
+	resume, _ := svc.SendMachineCommand(ctx, "m1", "admin-1", models.MachineCommandRequest{Command: models.CommandResume})
+	if len(mqtt.published) != 1 || mqtt.published[0] != resume.ID {
+		t.Errorf("published over MQTT = %v; want only %s", mqtt.published, resume.ID)
+	}
+	fr.ordersAssigned["o2"] = "m1"
+	fr.orderStatuses["o2"] = models.OrderStatusInProgress
+	stream, cancel = connect()
+	defer cancel()
+	var got []string
+	for _, want := range []string{queued.ID, resume.ID} {
+		if cmd := recv(stream).GetCommand(); cmd == nil || cmd.Id != want {
+			t.Fatalf("command on reconnect = %v; want %s", cmd, want)
+		}
+	}
+	for _, a := range recv(stream).GetAssignments().GetAssignments() {
+		got = append(got, a.OrderId)
+	}
+	if fmt.Sprint(got) != "[o1 o2]" {
+		t.Errorf("assignments on reconnect = %v; want [o1 o2]", got)
+	}
 }
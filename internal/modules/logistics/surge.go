@@ -0,0 +1,72 @@
+package logistics
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// SurgeTier 是一档动态加价：取件点所在运营区的空闲机器数 / 等待派单订单数低于 BelowRatio 时，报价乘以 Multiplier。
+type SurgeTier struct {
+	BelowRatio float64
+	Multiplier float64
+}
+
+// SurgePolicy 是基于车队利用率的动态加价。在取件点所在的运营区（见 FindOperationalZone）内统计供需，
+// 适用的各档中取最高的倍率；没有任何档位表示不加价。
+type SurgePolicy struct {
+	Tiers []SurgeTier
+}
+
+// DefaultSurgePolicy 返回默认的动态加价：运营区内空闲机器少于等待订单时加价 25%，不足一半时加价 50%。
+func DefaultSurgePolicy() SurgePolicy {
+	return SurgePolicy{
+		Tiers: []SurgeTier{
+			{BelowRatio: 1, Multiplier: 1.25},
+			{BelowRatio: 0.5, Multiplier: 1.5},
+		},
+	}
+}
+
+// multiplier 返回 idle 台空闲机器面对 pending 笔等待订单时的加价倍率；没有等待的订单时不加价。
+func (p SurgePolicy) multiplier(idle, pending int) float64 {
+	surge := 1.0
+	if pending == 0 {
+		return surge
+	}
+	ratio := float64(idle) / float64(pending)
+	for _, t := range p.Tiers {
+		if ratio < t.BelowRatio && t.Multiplier > surge {
+			surge = t.Multiplier
+		}
+	}
+	return surge
+}
+
+// surgeMultiplier 返回报价的动态加价倍率。取件点没有坐标、不在任何运营区内或统计失败时不加价，
+// 失败只记录日志：报价不因供需统计失败而失败。预约取件（取件时间晚于 models.MinScheduleLead 之后）
+// 不加价：当前的供需说明不了届时的情况。
+func (s *service) surgeMultiplier(ctx context.Context, req models.RouteRequest) float64 {
+	p := req.PickupLocation.Location
+	if len(s.surge.Tiers) == 0 || p == nil {
+		return 1
+	}
+	if req.RequestedTime.After(time.Now().Add(models.MinScheduleLead)) {
+		return 1
+	}
+	zoneID, err := s.logisticRepo.FindOperationalZone(ctx, p.Longitude, p.Latitude)
+	if err != nil || zoneID == "" {
+		if err != nil {
+			log.Printf("CalculateRouteOptions: surge: %v", err)
+		}
+		return 1
+	}
+	idle, pending, err := s.logisticRepo.CountSurgeDemand(ctx, zoneID)
+	if err != nil {
+		log.Printf("CalculateRouteOptions: surge: %v", err)
+		return 1
+	}
+	return s.surge.multiplier(idle, pending)
+}
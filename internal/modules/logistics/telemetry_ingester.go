@@ -0,0 +1,150 @@
+package logistics
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"strings"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/mqtt"
+)
+
+// 遥测计数，经 expvar 以 telemetry.{received,ingested,rejected,failed} 导出
+var telemetryMetrics = expvar.NewMap("telemetry")
+
+// telemetryTimeout 限制单条遥测的处理时间；消息按顺序处理，慢查询不能拖住整个订阅
+const telemetryTimeout = 5 * time.Second
+
+// TelemetryTopic 返回机器发布遥测的主题：<prefix>/machines/<machineID>/telemetry。
+// Broker 的 ACL 必须限制每台机器只能发布到自己的主题——机器身份取自主题而非消息体。
+func TelemetryTopic(prefix, machineID string) string {
+	return prefix + "/machines/" + machineID + "/telemetry"
+}
+
+// TelemetryIngester 订阅所有机器的遥测主题，校验后经 ServiceInterface.IngestTelemetry
+// 写入 machines 与 tracking_events，与 HTTP 上报走同一套业务逻辑。
+// 同一连接还订阅命令确认主题（CommandAckTopic），经 ServiceInterface.AckMachineCommand 记录。
+//
+// 投递语义为“至少一次”（QoS 1）。格式错误或被拒绝的消息记录日志后确认并丢弃，
+// 避免毒消息被反复投递；位置遥测每隔数秒就会刷新，丢弃单条的代价很小。
+type TelemetryIngester struct {
+	svc        ServiceInterface
+	cfg        mqtt.Config
+	prefix     string
+	shareGroup string
+}
+
+// NewTelemetryIngester 创建遥测订阅者。shareGroup 非空时使用共享订阅
+// （$share/<group>/...），多个 API 实例分摊消息而不是每条消息处理多次。
+func NewTelemetryIngester(svc ServiceInterface, cfg mqtt.Config, topicPrefix, shareGroup string) *TelemetryIngester {
+	return &TelemetryIngester{svc: svc, cfg: cfg, prefix: topicPrefix, shareGroup: shareGroup}
+}
+
+// Run 保持订阅直到 ctx 取消，断线后按退避重连（持久会话下断线期间的 QoS 1 消息由 Broker 补发）。
+func (i *TelemetryIngester) Run(ctx context.Context) {
+	filters := []string{TelemetryTopic(i.prefix, "+"), CommandAckTopic(i.prefix, "+")}
+	if i.shareGroup != "" {
+		for n, f := range filters {
+			filters[n] = "$share/" + i.shareGroup + "/" + f
+		}
+	}
+	backoff := time.Second
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := mqtt.Subscribe(ctx, i.cfg, filters, 1, func(msg mqtt.Message) {
+			i.handle(ctx, msg)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		// 连接稳定运行过一段时间则重置退避
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("telemetry: subscription stopped: %v; reconnecting in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// handle 按主题分发一条消息；任何错误都只记录日志。
+func (i *TelemetryIngester) handle(ctx context.Context, msg mqtt.Message) {
+	if machineID, ok := i.machineFromTopic(msg.Topic, "/commands/ack"); ok {
+		i.handleAck(ctx, machineID, msg)
+		return
+	}
+	telemetryMetrics.Add("received", 1)
+	// 保留消息是机器最后一次发布的旧位置，订阅时不应再次入库
+	if msg.Retain {
+		return
+	}
+	machineID, ok := i.machineFromTopic(msg.Topic, "/telemetry")
+	if !ok {
+		telemetryMetrics.Add("rejected", 1)
+		log.Printf("telemetry: ignoring message on unexpected topic %q", msg.Topic)
+		return
+	}
+	var t models.MachineTelemetry
+	if err := json.Unmarshal(msg.Payload, &t); err != nil {
+		telemetryMetrics.Add("rejected", 1)
+		log.Printf("telemetry: machine %s: malformed payload: %v", machineID, err)
+		return
+	}
+	if err := t.Validate(); err != nil {
+		telemetryMetrics.Add("rejected", 1)
+		log.Printf("telemetry: machine %s: %v", machineID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, telemetryTimeout)
+	defer cancel()
+	if err := i.svc.IngestTelemetry(ctx, machineID, t); err != nil {
+		telemetryMetrics.Add("failed", 1)
+		log.Printf("telemetry: machine %s: %v", machineID, err)
+		return
+	}
+	telemetryMetrics.Add("ingested", 1)
+}
+
+// handleAck 解析并记录一条命令确认。确认同样是至少一次投递，重复确认由仓库幂等处理。
+func (i *TelemetryIngester) handleAck(ctx context.Context, machineID string, msg mqtt.Message) {
+	if msg.Retain {
+		return
+	}
+	var ack models.MachineCommandAck
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+		log.Printf("commands: machine %s: malformed ack: %v", machineID, err)
+		return
+	}
+	if ack.CommandID == "" || ack.Accepted == nil {
+		log.Printf("commands: machine %s: ack needs command_id and accepted", machineID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, telemetryTimeout)
+	defer cancel()
+	if _, err := i.svc.AckMachineCommand(ctx, machineID, ack.CommandID, ack); err != nil {
+		log.Printf("commands: machine %s: %v", machineID, err)
+	}
+}
+
+// machineFromTopic 从 <prefix>/machines/<machineID><suffix> 中取出机器 ID。
+func (i *TelemetryIngester) machineFromTopic(topic, suffix string) (string, bool) {
+	rest, ok := strings.CutPrefix(topic, i.prefix+"/machines/")
+	if !ok {
+		return "", false
+	}
+	machineID, ok := strings.CutSuffix(rest, suffix)
+	if !ok || machineID == "" || strings.Contains(machineID, "/") {
+		return "", false
+	}
+	return machineID, true
+}
@@ -0,0 +1,81 @@
+package logistics
+
+import (
+	"context"
+	"sync"
+)
+
+// TrackingCacheName 是轨迹推送在 database.CacheBus 上使用的频道名，key 为订单 ID。
+const TrackingCacheName = "tracking"
+
+// TrackingHub 把“某订单有新轨迹”的信号分发给本实例上订阅该订单的 WebSocket 连接。
+//
+// 通知本身不携带事件：每个连接收到信号后按自己的游标从数据库读取新事件。
+// 这样信号可以合并（容量为 1 的通道，发送不阻塞），慢客户端不会让 Hub
+// 堆积内存，也不会丢事件——落后的连接下次读取时一次性补齐。
+//
+// 配置了 bus 时信号经 Postgres NOTIFY 广播到所有实例（机器上报的实例
+// 不一定持有观看者的连接）；bus 为 nil 时只在本进程内分发。
+type TrackingHub struct {
+	bus Invalidator
+
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+// NewTrackingHub 创建 Hub，并在 bus 非 nil 时订阅轨迹通知。
+func NewTrackingHub(bus Invalidator) *TrackingHub {
+	h := &TrackingHub{bus: bus, subs: map[string]map[chan struct{}]struct{}{}}
+	if bus != nil {
+		bus.Subscribe(TrackingCacheName, h.wake)
+	}
+	return h
+}
+
+// Subscribe 订阅 orderID 的新轨迹信号；调用方用完后必须调用 cancel。
+func (h *TrackingHub) Subscribe(orderID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.subs[orderID] == nil {
+		h.subs[orderID] = map[chan struct{}]struct{}{}
+	}
+	h.subs[orderID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[orderID], ch)
+		if len(h.subs[orderID]) == 0 {
+			delete(h.subs, orderID)
+		}
+	}
+	return ch, cancel
+}
+
+// Notify 在新轨迹事件持久化后调用，唤醒所有实例上该订单的订阅者。
+func (h *TrackingHub) Notify(ctx context.Context, orderID string) error {
+	if h.bus == nil {
+		h.wake(orderID)
+		return nil
+	}
+	return h.bus.Invalidate(ctx, TrackingCacheName, orderID)
+}
+
+// wake 唤醒 orderID 的订阅者；orderID 为空（CacheBus 断线重连）时唤醒全部，
+// 让各连接补读断线期间错过的事件。
+func (h *TrackingHub) wake(orderID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, subs := range h.subs {
+		if orderID != "" && id != orderID {
+			continue
+		}
+		for ch := range subs {
+			select {
+			case ch <- struct{}{}:
+			default: // 已有未处理的信号，合并
+			}
+		}
+	}
+}
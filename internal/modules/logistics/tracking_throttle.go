@@ -0,0 +1,110 @@
+package logistics
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// TrackingThrottle 是一类机器的轨迹节流规则，防止高频上报的设备把 tracking_events 撑爆。
+// 与该订单上一条已保存的轨迹点相比：
+//   - 间隔短于 MinInterval，或移动距离小于 MinDistanceMeters 的点被丢弃；
+//   - 距上一条已保存的点超过 MaxGap 时总是保存，静止的机器仍会定期留下位置。
+//
+// 各字段为零表示不做该项检查；零值的 TrackingThrottle 保存所有点。
+type TrackingThrottle struct {
+	MinInterval       time.Duration
+	MinDistanceMeters float64
+	MaxGap            time.Duration
+}
+
+// TrackingPolicy 按机器类型给出轨迹节流规则；未配置的机器类型不节流。
+type TrackingPolicy map[models.MachineType]TrackingThrottle
+
+// DefaultTrackingPolicy 返回默认的节流规则：无人机飞得更快，距离阈值更大。
+func DefaultTrackingPolicy() TrackingPolicy {
+	return TrackingPolicy{
+		models.MachineTypeDrone: {MinInterval: 2 * time.Second, MinDistanceMeters: 10, MaxGap: time.Minute},
+		models.MachineTypeRobot: {MinInterval: 2 * time.Second, MinDistanceMeters: 5, MaxGap: time.Minute},
+	}
+}
+
+// keep 判断在 at 时刻位于 p 的点相对上一条已保存的点 prev 是否应当保存。
+func (t TrackingThrottle) keep(prev *models.TrackingEvent, p models.GeoPoint, at time.Time) bool {
+	if prev == nil {
+		return true
+	}
+	gap := at.Sub(prev.CreatedAt)
+	if t.MaxGap > 0 && gap >= t.MaxGap {
+		return true
+	}
+	if gap < t.MinInterval {
+		return false
+	}
+	from := models.GeoPoint{Latitude: prev.Latitude, Longitude: prev.Longitude}
+	return haversineKM(from, p)*1000 >= t.MinDistanceMeters
+}
+
+// throttleFor 返回机器适用的节流规则；ok 为 false 表示不节流（无需查询上一条轨迹）。
+func (s *service) throttleFor(ctx context.Context, machineID string) (t TrackingThrottle, ok bool, err error) {
+	if len(s.throttle) == 0 {
+		return TrackingThrottle{}, false, nil
+	}
+	m, err := s.logisticRepo.FindMachineByID(ctx, machineID)
+	if err != nil {
+		return TrackingThrottle{}, false, err
+	}
+	t, ok = s.throttle[m.Type]
+	return t, ok && t != (TrackingThrottle{}), nil
+}
+
+// lastTrackingEvent 返回订单最新的轨迹事件；还没有轨迹时返回 nil。
+func (s *service) lastTrackingEvent(ctx context.Context, orderID string) (*models.TrackingEvent, error) {
+	ev, err := s.logisticRepo.GetLatestTrackingEvent(ctx, orderID)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, nil
+	}
+	return ev, err
+}
+
+// shouldRecord 判断机器此刻上报的位置 p 是否需要保存。
+func (s *service) shouldRecord(ctx context.Context, orderID, machineID string, p models.GeoPoint) (bool, error) {
+	t, ok, err := s.throttleFor(ctx, machineID)
+	if err != nil || !ok {
+		return true, err
+	}
+	prev, err := s.lastTrackingEvent(ctx, orderID)
+	if err != nil {
+		return false, err
+	}
+	return t.keep(prev, p, time.Now()), nil
+}
+
+// throttleBatch 按记录时间排序批量上报的事件并逐点节流，返回需要保存的事件。
+// 每个点与它之前最后一个保存的点比较；第一个点与已保存的最新轨迹比较
+// （最新轨迹晚于它时说明是补传的历史点，从批内第一个点开始重新计算）。
+func (s *service) throttleBatch(ctx context.Context, orderID, machineID string, events []*models.TrackingEvent) ([]*models.TrackingEvent, error) {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt.Before(events[j].CreatedAt) })
+	t, ok, err := s.throttleFor(ctx, machineID)
+	if err != nil || !ok {
+		return events, err
+	}
+	prev, err := s.lastTrackingEvent(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil && prev.CreatedAt.After(events[0].CreatedAt) {
+		prev = nil
+	}
+	kept := events[:0]
+	for _, ev := range events {
+		if t.keep(prev, models.GeoPoint{Latitude: ev.Latitude, Longitude: ev.Longitude}, ev.CreatedAt) {
+			kept = append(kept, ev)
+			prev = ev
+		}
+	}
+	return kept, nil
+}
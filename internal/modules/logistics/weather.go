@@ -0,0 +1,175 @@
+package logistics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/maps"
+	"dispatch-and-delivery/pkg/resilience"
+	"dispatch-and-delivery/pkg/weather"
+)
+
+// weatherCacheTTL 是天气查询结果的缓存时长；天气服务本身按 15 分钟左右更新
+const weatherCacheTTL = 10 * time.Minute
+
+// WeatherLimits 是一类机器可以接受的天气条件，风速取持续风速与阵风中较大者：
+//   - 风速超过 MaxWindMS 或降水超过 MaxPrecipitationMMH 时不提供该机器类型的报价；
+//   - 未超过上限、但风速超过 SurchargeWindMS 或降水超过 SurchargePrecipitationMMH 时，
+//     报价上浮 Surcharge（0.25 表示 +25%）。
+//
+// 各阈值为零表示不做该项检查。
+type WeatherLimits struct {
+	MaxWindMS                 float64
+	MaxPrecipitationMMH       float64
+	SurchargeWindMS           float64
+	SurchargePrecipitationMMH float64
+	Surcharge                 float64
+}
+
+// WeatherPolicy 按机器类型给出天气限制；未配置的机器类型不受天气影响。
+type WeatherPolicy map[models.MachineType]WeatherLimits
+
+// DefaultWeatherPolicy 返回默认的天气限制：无人机对风和雨都敏感；地面机器人只在暴雨时停运。
+func DefaultWeatherPolicy() WeatherPolicy {
+	return WeatherPolicy{
+		models.MachineTypeDrone: {
+			MaxWindMS:                 12,
+			MaxPrecipitationMMH:       4,
+			SurchargeWindMS:           8,
+			SurchargePrecipitationMMH: 1,
+			Surcharge:                 0.25,
+		},
+		models.MachineTypeRobot: {MaxPrecipitationMMH: 20},
+	}
+}
+
+// assess 判断天气 c 下能否提供报价（unsafe 为 true 表示不能），以及应上浮的比例。
+func (l WeatherLimits) assess(c weather.Conditions) (unsafe bool, surcharge float64) {
+	wind, rain := c.Wind(), c.PrecipitationMMH
+	if (l.MaxWindMS > 0 && wind > l.MaxWindMS) || (l.MaxPrecipitationMMH > 0 && rain > l.MaxPrecipitationMMH) {
+		return true, 0
+	}
+	if (l.SurchargeWindMS > 0 && wind > l.SurchargeWindMS) || (l.SurchargePrecipitationMMH > 0 && rain > l.SurchargePrecipitationMMH) {
+		return false, l.Surcharge
+	}
+	return false, 0
+}
+
+// weatherCheck 是报价前的天气检查：天气服务、其熔断器与各机器类型的限制。
+type weatherCheck struct {
+	provider weather.Provider
+	breaker  *resilience.Executor
+	limits   WeatherPolicy
+}
+
+func newWeatherCheck(p weather.Provider, limits WeatherPolicy) *weatherCheck {
+	return &weatherCheck{
+		provider: p,
+		limits:   limits,
+		breaker: resilience.New(resilience.Policy{
+			Name:             p.Name(),
+			Timeout:          2 * time.Second,
+			MaxAttempts:      2,
+			BaseBackoff:      100 * time.Millisecond,
+			MaxBackoff:       500 * time.Millisecond,
+			FailureThreshold: 5,
+			OpenDuration:     30 * time.Second,
+		}),
+	}
+}
+
+// weatherSpecs 按取件点与投递点中较差的天气调整报价选项（及其对应路线 routes）：
+// 超过上限的机器类型被去掉，接近上限的返回上浮比例（与返回的 specs 一一对应）。
+//
+// 天气服务不可用或坐标未知时不做限制，只记录日志：报价不因天气服务故障而失败，
+// 派单与起飞前的安全检查由机器自身负责。所有选项都被去掉时返回 models.ErrWeatherUnsafe。
+func (s *service) weatherSpecs(ctx context.Context, req models.RouteRequest, specs []quoteSpec, routes []*maps.Route) ([]quoteSpec, []*maps.Route, []float64, error) {
+	if s.weather == nil {
+		return specs, routes, make([]float64, len(specs)), nil
+	}
+	var allowed []quoteSpec
+	var allowedRoutes []*maps.Route
+	var surcharges []float64
+	for i, spec := range specs {
+		unsafe, surcharge := s.assessWeather(ctx, req, spec, routes[i])
+		if unsafe {
+			continue
+		}
+		allowed = append(allowed, spec)
+		allowedRoutes = append(allowedRoutes, routes[i])
+		surcharges = append(surcharges, surcharge)
+	}
+	if len(allowed) == 0 {
+		return nil, nil, nil, models.ErrWeatherUnsafe
+	}
+	return allowed, allowedRoutes, surcharges, nil
+}
+
+// assessWeather 按该机器类型的限制评估路线两端的天气；无法评估时视为安全、不上浮。
+func (s *service) assessWeather(ctx context.Context, req models.RouteRequest, spec quoteSpec, r *maps.Route) (unsafe bool, surcharge float64) {
+	limits, ok := s.weather.limits[spec.machineType]
+	path := routePath(req, r.Polyline)
+	if !ok || limits == (WeatherLimits{}) || len(path) < 2 {
+		return false, 0
+	}
+	c, err := s.worstConditions(ctx, path[0], path[len(path)-1])
+	if err != nil {
+		log.Printf("CalculateRouteOptions: weather for %s: %v", spec.machineType, err)
+		return false, 0
+	}
+	return limits.assess(*c)
+}
+
+// worstConditions 返回两个地点中各项都取较差值的天气
+func (s *service) worstConditions(ctx context.Context, a, b models.GeoPoint) (*weather.Conditions, error) {
+	ca, err := s.conditions(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	cb, err := s.conditions(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	worst := ca.Worse(*cb)
+	return &worst, nil
+}
+
+// conditions 通过熔断器查询 p 处的当前天气。启用报价缓存时按约 1 公里的网格
+// （坐标保留两位小数）缓存 weatherCacheTTL，相邻的报价共用一次查询。
+func (s *service) conditions(ctx context.Context, p models.GeoPoint) (*weather.Conditions, error) {
+	lat, lng := math.Round(p.Latitude*100)/100, math.Round(p.Longitude*100)/100
+	key := fmt.Sprintf("weather:%s:%.2f,%.2f", s.weather.provider.Name(), lat, lng)
+	if s.quoteCache != nil {
+		if data, ok, err := s.quoteCache.Get(ctx, key); err != nil {
+			log.Printf("weather cache: get: %v", err)
+		} else if ok {
+			var c weather.Conditions
+			if err := json.Unmarshal(data, &c); err == nil {
+				return &c, nil
+			}
+		}
+	}
+
+	var c *weather.Conditions
+	err := s.weather.breaker.Do(ctx, func(ctx context.Context) error {
+		var err error
+		c, err = s.weather.provider.Current(ctx, lat, lng)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.quoteCache != nil {
+		if data, err := json.Marshal(c); err == nil {
+			if err := s.quoteCache.Set(ctx, key, data, weatherCacheTTL); err != nil {
+				log.Printf("weather cache: set: %v", err)
+			}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,136 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// assignmentBatchSize bounds how many queued orders one dispatch run handles.
+	assignmentBatchSize = 50
+	// Retries back off exponentially from assignmentRetryBase up to
+	// assignmentRetryMax, so a fleet-wide outage does not hammer the database.
+	assignmentRetryBase = 15 * time.Second
+	assignmentRetryMax  = 5 * time.Minute
+)
+
+// errAssignmentBusy means another dispatcher holds the queued order right now.
+var errAssignmentBusy = errors.New("assignment is being handled by another dispatcher")
+
+// assignmentBackoff returns the delay before the next attempt after attempts failures.
+func assignmentBackoff(attempts int) time.Duration {
+	d := assignmentRetryBase
+	for i := 0; i < attempts && d < assignmentRetryMax; i++ {
+		d *= 2
+	}
+	return min(d, assignmentRetryMax)
+}
+
+// notifyPaid wakes the Dispatcher without blocking; a wake-up that is already
+// pending covers this order too.
+func (s *Service) notifyPaid() {
+	select {
+	case s.paid <- struct{}{}:
+	default:
+	}
+}
+
+// parkOrder moves a confirmed order that found no idle machine to
+// ASSIGNMENT_PENDING, so customers and operators can see it is waiting.
+func (s *Service) parkOrder(ctx context.Context, orderID string, cause error) error {
+	order, err := s.repo.FindByID(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if order.Status != models.OrderStatusConfirmed {
+		return nil
+	}
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		return s.setStatus(ctx, order, models.OrderStatusAssignmentPending, models.ActorSystem, "", cause.Error())
+	})
+	if errors.Is(err, models.ErrOrderStatusChanged) {
+		return nil // Assigned or cancelled in the meantime.
+	}
+	if err != nil {
+		return fmt.Errorf("failed to park order: %w", err)
+	}
+	log.Printf("order %s is waiting for an idle machine: %v", orderID, cause)
+	return nil
+}
+
+// RetryPendingAssignments tries to assign a machine to every queued order that
+// is due: freshly paid orders and those still waiting for a machine. An
+// assigned order leaves the queue and emits "order.assigned"; an order that
+// still finds no machine is parked in ASSIGNMENT_PENDING and rescheduled with
+// backoff. It is driven by the Dispatcher.
+func (s *Service) RetryPendingAssignments(ctx context.Context) error {
+	pending, err := s.repo.ListDueAssignments(ctx, assignmentBatchSize)
+	if err != nil {
+		return fmt.Errorf("service.RetryPendingAssignments: %w", err)
+	}
+	for _, p := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := s.retryAssignment(ctx, p.OrderID)
+		if err == nil || errors.Is(err, errAssignmentBusy) {
+			continue
+		}
+		if errors.Is(err, models.ErrNoMachineAvailable) {
+			if err := s.parkOrder(ctx, p.OrderID, err); err != nil {
+				return fmt.Errorf("service.RetryPendingAssignments: %w", err)
+			}
+		} else {
+			log.Printf("service.RetryPendingAssignments: order %s: %v", p.OrderID, err)
+		}
+		// The failed unit of work was rolled back; record the attempt outside it.
+		if err := s.repo.RescheduleAssignment(ctx, p.OrderID, assignmentBackoff(p.Attempts+1), err.Error()); err != nil {
+			return fmt.Errorf("service.RetryPendingAssignments: %w", err)
+		}
+	}
+	return nil
+}
+
+// retryAssignment assigns one queued order in a single unit of work.
+func (s *Service) retryAssignment(ctx context.Context, orderID string) error {
+	return s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		// Every instance runs a dispatcher; the row lock keeps an order to one.
+		locked, err := s.repo.LockAssignment(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if !locked {
+			return errAssignmentBusy
+		}
+
+		order, err := s.repo.FindByID(ctx, orderID)
+		if errors.Is(err, models.ErrNotFound) {
+			return s.repo.DeleteAssignment(ctx, orderID)
+		}
+		if err != nil {
+			return err
+		}
+		// The order left CONFIRMED/ASSIGNMENT_PENDING some other way (e.g. an
+		// operator assigned or cancelled it); it no longer needs the queue.
+		if order.Status != models.OrderStatusConfirmed && order.Status != models.OrderStatusAssignmentPending {
+			return s.repo.DeleteAssignment(ctx, orderID)
+		}
+
+		machine, err := s.logisticsService.AssignOrder(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if err := s.repo.DeleteAssignment(ctx, orderID); err != nil {
+			return err
+		}
+		return s.repo.InsertOutboxEvent(ctx, orderID, "order.assigned", map[string]string{
+			"order_id":   orderID,
+			"user_id":    order.UserID,
+			"machine_id": machine.ID,
+		})
+	})
+}
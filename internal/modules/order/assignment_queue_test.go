@@ -0,0 +1,1065 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// fakeRepo keeps orders, the assignment queue, outbox events, status
+// history and idempotency keys in memory.
+type fakeRepo struct {
+	RepositoryInterface // Methods the tests do not need panic.
+
+	orders  map[string]*models.Order
+	queue   map[string]*models.PendingAssignment
+	delays  map[string]time.Duration // Last reschedule delay per order.
+	events  []string                 // Outbox event types, in order.
+	notes   map[string][]string      // Notifications by user.
+	history []*models.OrderStatusEvent
+	keys    map[string]*models.IdempotencyKey // By user, operation and key.
+	pins    map[string]int                    // Wrong delivery PINs by order.
+
+	quotes   map[string]fakeQuote
+	payments map[string]string // Payment ID by order.
+	refunds  map[string]string // Refund ID by order.
+
+	webhooks   []*models.WebhookEndpoint
+	deliveries []*models.PendingWebhook
+	attempts   map[string][]models.WebhookAttempt // By delivery.
+
+	messages []*models.OrderMessage
+	reads    map[string]time.Time // Read marks by order and user.
+
+	claims  []*models.Claim
+	photos  map[string][]models.ClaimPhoto // By claim.
+	credits map[string][]models.WalletCredit
+
+	promos      []*models.PromoCode
+	redemptions map[string]*models.PromoRedemption // By order.
+
+	savedCards map[string]fakeCard // By saved payment method.
+	paymentLog []*models.Payment
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{
+		orders:   map[string]*models.Order{},
+		queue:    map[string]*models.PendingAssignment{},
+		delays:   map[string]time.Duration{},
+		keys:     map[string]*models.IdempotencyKey{},
+		attempts: map[string][]models.WebhookAttempt{},
+		payments: map[string]string{},
+		refunds:  map[string]string{},
+		quotes:   map[string]fakeQuote{},
+		notes:    map[string][]string{},
+		reads:    map[string]time.Time{},
+		pins:     map[string]int{},
+		photos:   map[string][]models.ClaimPhoto{},
+		credits:  map[string][]models.WalletCredit{},
+
+		redemptions: map[string]*models.PromoRedemption{},
+		savedCards:  map[string]fakeCard{},
+	}
+}
+
+// fakeCard is a saved card: its user and the provider's customer and card IDs.
+type fakeCard struct {
+	userID, customerID, providerID string
+}
+
+// fakeQuote is a stored route option and who may order it until when.
+type fakeQuote struct {
+	userID    string
+	option    models.RouteOption
+	expiresAt time.Time
+}
+
+func (f *fakeRepo) FindByID(ctx context.Context, orderID string) (*models.Order, error) {
+	o, ok := f.orders[orderID]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	cp := *o
+	return &cp, nil
+}
+
+// userOrders returns the user's orders newest first, like the listing queries.
+func (f *fakeRepo) userOrders(userID string) []*models.Order {
+	var out []*models.Order
+	for _, o := range f.orders {
+		if o.UserID == userID {
+			cp := *o
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.After(out[j].CreatedAt)
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out
+}
+
+func (f *fakeRepo) ListByUserID(ctx context.Context, userID string, page, limit int) ([]*models.Order, int, error) {
+	all := f.userOrders(userID)
+	start := min((page-1)*limit, len(all))
+	return all[start:min(start+limit, len(all))], len(all), nil
+}
+
+func (f *fakeRepo) ListByUserIDAfter(ctx context.Context, userID string, after *models.OrderCursor, limit int) ([]*models.Order, error) {
+	var out []*models.Order
+	for _, o := range f.userOrders(userID) {
+		if after == nil || o.CreatedAt.Before(after.CreatedAt) || (o.CreatedAt.Equal(after.CreatedAt) && o.ID < after.ID) {
+			out = append(out, o)
+		}
+	}
+	return out[:min(limit, len(out))], nil
+}
+
+func (f *fakeRepo) ExportOrders(ctx context.Context, q models.OrderExportQuery, fn func(row *models.OrderExportRow) error) error {
+	var out []*models.Order
+	for _, o := range f.orders {
+		if !o.CreatedAt.Before(q.From) && o.CreatedAt.Before(q.To) && (q.Status == nil || o.Status == *q.Status) {
+			out = append(out, o)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	for _, o := range out {
+		row := models.OrderExportRow{
+			Order:         *o,
+			CustomerEmail: o.UserID + "@example.com",
+			PickupStreet:  "from " + o.PickupAddressID,
+			DropoffStreet: "to " + o.DropoffAddressID,
+		}
+		if err := fn(&row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeRepo) UpdateStatusForUser(ctx context.Context, orderID, userID string, from, to models.OrderStatus) error {
+	o, ok := f.orders[orderID]
+	if !ok || o.UserID != userID || o.Status != from {
+		return models.ErrOrderStatusChanged
+	}
+	o.Status = to
+	return nil
+}
+
+func (f *fakeRepo) InsertStatusEvent(ctx context.Context, ev *models.OrderStatusEvent) error {
+	ev.ID = int64(len(f.history) + 1)
+	ev.CreatedAt = time.Now()
+	f.history = append(f.history, ev)
+	return nil
+}
+
+func (f *fakeRepo) ListStatusEvents(ctx context.Context, orderID string) ([]*models.OrderStatusEvent, error) {
+	var out []*models.OrderStatusEvent
+	for _, ev := range f.history {
+		if ev.OrderID == orderID {
+			out = append(out, ev)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) SetPaymentID(ctx context.Context, orderID, paymentID string) error {
+	f.payments[orderID] = paymentID
+	return nil
+}
+
+func (f *fakeRepo) SetRefundID(ctx context.Context, orderID, refundID string) error {
+	f.refunds[orderID] = refundID
+	return nil
+}
+
+func (f *fakeRepo) SetCancellationFee(ctx context.Context, orderID string, fee float64) error {
+	f.orders[orderID].CancellationFee = &fee
+	return nil
+}
+
+func (f *fakeRepo) SetPrice(ctx context.Context, orderID string, cost float64, breakdown *models.CostBreakdown) error {
+	f.orders[orderID].Cost = cost
+	f.orders[orderID].CostBreakdown = breakdown
+	return nil
+}
+
+func (f *fakeRepo) SetTip(ctx context.Context, orderID string, tip float64, breakdown *models.CostBreakdown) error {
+	if f.orders[orderID].Tip > 0 {
+		return models.ErrTipAlreadyAdded
+	}
+	f.orders[orderID].Tip = tip
+	f.orders[orderID].CostBreakdown = breakdown
+	return nil
+}
+
+func (f *fakeRepo) SetPaymentFailure(ctx context.Context, orderID string, reason *string) error {
+	o := f.orders[orderID]
+	if reason != nil && o.Status != models.OrderStatusPendingPayment && o.Status != models.OrderStatusPaymentFailed {
+		return models.ErrOrderStatusChanged
+	}
+	o.PaymentFailureReason = reason
+	return nil
+}
+
+func (f *fakeRepo) FindSavedPaymentMethod(ctx context.Context, userID, paymentMethodID string) (string, string, error) {
+	card, ok := f.savedCards[paymentMethodID]
+	if !ok || card.userID != userID {
+		return "", "", models.ErrPaymentMethodNotFound
+	}
+	return card.customerID, card.providerID, nil
+}
+
+func (f *fakeRepo) InsertPayment(ctx context.Context, p *models.Payment) error {
+	p.ID = fmt.Sprintf("p%d", len(f.paymentLog)+1)
+	p.CreatedAt = time.Now()
+	f.paymentLog = append(f.paymentLog, p)
+	return nil
+}
+
+func (f *fakeRepo) ListPayments(ctx context.Context, orderID string) ([]*models.Payment, error) {
+	out := []*models.Payment{}
+	for _, p := range f.paymentLog {
+		if p.OrderID == orderID {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) SettlePayments(ctx context.Context, orderID, providerRef string, status models.PaymentStatus, reason *string) (bool, error) {
+	settled := false
+	for _, p := range f.paymentLog {
+		if p.OrderID == orderID && p.ProviderRef != nil && *p.ProviderRef == providerRef && p.Status == models.PaymentStatusRequiresAction {
+			p.Status, p.FailureReason = status, reason
+			settled = true
+		}
+	}
+	return settled, nil
+}
+
+func (f *fakeRepo) GetPaymentRefs(ctx context.Context, orderID string) (string, string, error) {
+	return f.payments[orderID], f.refunds[orderID], nil
+}
+
+func (f *fakeRepo) InsertOutboxEvent(ctx context.Context, aggregateID, eventType string, payload any) error {
+	f.events = append(f.events, eventType)
+	return nil
+}
+
+func (f *fakeRepo) ListDueScheduled(ctx context.Context, due time.Time, limit int) ([]*models.Order, error) {
+	var out []*models.Order
+	for _, o := range f.orders {
+		if o.Status == models.OrderStatusScheduled && !o.ScheduledPickupTime.After(due) {
+			cp := *o
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) ListUnpaid(ctx context.Context, createdBefore time.Time, limit int) ([]*models.Order, error) {
+	var out []*models.Order
+	for _, o := range f.orders {
+		unpaid := o.Status == models.OrderStatusPendingPayment || o.Status == models.OrderStatusPaymentFailed
+		if unpaid && !o.CreatedAt.After(createdBefore) && !f.awaitingAction(o.ID) {
+			cp := *o
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) ListAwaitingPaymentAction(ctx context.Context, limit int) ([]*models.Order, error) {
+	var out []*models.Order
+	for _, o := range f.orders {
+		if f.awaitingAction(o.ID) {
+			cp := *o
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
+}
+
+// awaitingAction reports whether the order has a charge awaiting
+// authentication.
+func (f *fakeRepo) awaitingAction(orderID string) bool {
+	for _, p := range f.paymentLog {
+		if p.OrderID == orderID && p.Status == models.PaymentStatusRequiresAction {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeRepo) CancelUnpaid(ctx context.Context, orderID string) (bool, error) {
+	o, ok := f.orders[orderID]
+	if !ok || (o.Status != models.OrderStatusPendingPayment && o.Status != models.OrderStatusPaymentFailed) || f.awaitingAction(orderID) {
+		return false, nil
+	}
+	o.Status = models.OrderStatusCancelled
+	return true, nil
+}
+
+func (f *fakeRepo) InsertNotification(ctx context.Context, userID, message string) error {
+	f.notes[userID] = append(f.notes[userID], message)
+	return nil
+}
+
+func (f *fakeRepo) InsertOrderMessage(ctx context.Context, msg *models.OrderMessage) error {
+	msg.ID = fmt.Sprintf("msg-%d", len(f.messages)+1)
+	// Strictly increasing, like the thread's order.
+	msg.CreatedAt = time.Now().Add(time.Duration(len(f.messages)) * time.Millisecond)
+	cp := *msg
+	f.messages = append(f.messages, &cp)
+	return nil
+}
+
+func (f *fakeRepo) ListOrderMessages(ctx context.Context, orderID string, includeHidden bool) ([]*models.OrderMessage, error) {
+	var out []*models.OrderMessage
+	for _, m := range f.messages {
+		if m.OrderID == orderID && (includeHidden || m.HiddenAt == nil) {
+			cp := *m
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeRepo) HideOrderMessage(ctx context.Context, orderID, messageID, adminID string) error {
+	for _, m := range f.messages {
+		if m.ID == messageID && m.OrderID == orderID {
+			now := time.Now()
+			m.HiddenAt, m.HiddenBy = &now, &adminID
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+func (f *fakeRepo) MarkOrderMessagesRead(ctx context.Context, orderID, userID string, at time.Time) error {
+	if at.After(f.reads[orderID+"/"+userID]) {
+		f.reads[orderID+"/"+userID] = at
+	}
+	return nil
+}
+
+func (f *fakeRepo) ListUnreadOrderMessages(ctx context.Context, userID string, staff bool, limit int) ([]models.UnreadOrderMessages, error) {
+	var unread []models.UnreadOrderMessages
+	counts := map[string]int{}
+	for i := len(f.messages) - 1; i >= 0; i-- {
+		m := f.messages[i]
+		theirs := (staff && !m.FromStaff()) || (!staff && m.FromStaff() && f.orders[m.OrderID].UserID == userID)
+		if !theirs || m.HiddenAt != nil || !m.CreatedAt.After(f.reads[m.OrderID+"/"+userID]) {
+			continue
+		}
+		if counts[m.OrderID] == 0 {
+			unread = append(unread, models.UnreadOrderMessages{OrderID: m.OrderID})
+		}
+		counts[m.OrderID]++
+	}
+	for i := range unread {
+		unread[i].Unread = counts[unread[i].OrderID]
+	}
+	return unread, nil
+}
+
+func (f *fakeRepo) EnqueueAssignment(ctx context.Context, orderID, reason string) error {
+	if _, ok := f.queue[orderID]; !ok {
+		f.queue[orderID] = &models.PendingAssignment{OrderID: orderID, EnqueuedAt: time.Now()}
+	}
+	return nil
+}
+
+// ListDueAssignments orders the queue like the real query: EXPRESS orders
+// first, then by enqueue time.
+func (f *fakeRepo) ListDueAssignments(ctx context.Context, limit int) ([]models.PendingAssignment, error) {
+	var out []models.PendingAssignment
+	for _, p := range f.queue {
+		cp := *p
+		if o, ok := f.orders[p.OrderID]; ok {
+			cp.Priority = o.Priority
+		}
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if ei, ej := out[i].Priority == models.PriorityExpress, out[j].Priority == models.PriorityExpress; ei != ej {
+			return ei
+		}
+		return out[i].EnqueuedAt.Before(out[j].EnqueuedAt)
+	})
+	return out, nil
+}
+
+func (f *fakeRepo) RescheduleAssignment(ctx context.Context, orderID string, delay time.Duration, reason string) error {
+	f.queue[orderID].Attempts++
+	f.delays[orderID] = delay
+	return nil
+}
+
+func (f *fakeRepo) LockAssignment(ctx context.Context, orderID string) (bool, error) {
+	_, ok := f.queue[orderID]
+	return ok, nil
+}
+
+func (f *fakeRepo) DeleteAssignment(ctx context.Context, orderID string) error {
+	delete(f.queue, orderID)
+	return nil
+}
+
+// fakeLogistics assigns machine, or fails with ErrNoMachineAvailable when it is empty.
+func (f *fakeRepo) InsertAddress(ctx context.Context, addr *models.Address) (string, error) {
+	return "addr-" + addr.StreetAddress, nil
+}
+
+func (f *fakeRepo) Create(ctx context.Context, userID string, req models.CreateOrderRequest, option *models.RouteOption, pickupAddressID, dropoffAddressID string) (*models.Order, error) {
+	o := &models.Order{
+		ID:                   fmt.Sprintf("o-%d", len(f.orders)+1),
+		UserID:               userID,
+		PickupAddressID:      pickupAddressID,
+		DropoffAddressID:     dropoffAddressID,
+		Status:               models.OrderStatusPendingPayment,
+		Cost:                 option.EstimatedCost,
+		CostBreakdown:        &option.CostBreakdown,
+		Priority:             option.Priority,
+		ScheduledPickupTime:  req.ScheduledPickupTime,
+		DeliveryWindow:       req.DeliveryWindow,
+		RecipientName:        req.RecipientName,
+		RecipientPhone:       req.RecipientPhone,
+		DeliveryInstructions: req.DeliveryInstructions,
+		DeliveryPIN:          req.DeliveryPIN,
+		CreatedAt:            time.Now(),
+	}
+	if v := option.InsuredValue; v > 0 {
+		o.InsuredValue = &v
+	}
+	f.orders[o.ID] = o
+	cp := *o
+	return &cp, nil
+}
+
+func (f *fakeRepo) SaveRouteQuotes(ctx context.Context, userID string, options []models.RouteOption, expiresAt time.Time) error {
+	for _, o := range options {
+		f.quotes[o.ID] = fakeQuote{userID: userID, option: o, expiresAt: expiresAt}
+	}
+	return nil
+}
+
+func (f *fakeRepo) TakeRouteQuote(ctx context.Context, userID, optionID string) (*models.RouteOption, error) {
+	q, ok := f.quotes[optionID]
+	if !ok || q.userID != userID {
+		return nil, models.ErrRouteOptionNotFound
+	}
+	if !q.expiresAt.After(time.Now()) {
+		return nil, models.ErrRouteOptionExpired
+	}
+	delete(f.quotes, optionID)
+	return &q.option, nil
+}
+
+func (f *fakeRepo) DeleteExpiredRouteQuotes(ctx context.Context, before time.Time) (int64, error) {
+	var n int64
+	for id, q := range f.quotes {
+		if q.expiresAt.Before(before) {
+			delete(f.quotes, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (f *fakeRepo) CheckDeliveryPIN(ctx context.Context, orderID, pin string) (bool, error) {
+	if f.pins[orderID] >= models.MaxDeliveryPINAttempts {
+		return false, models.ErrDeliveryPINLocked
+	}
+	o := f.orders[orderID]
+	if o.DeliveryPIN != "" && o.DeliveryPIN != pin {
+		f.pins[orderID]++
+		return false, nil
+	}
+	return true, nil
+}
+
+func (f *fakeRepo) InsertClaim(ctx context.Context, claim *models.Claim) error {
+	for _, c := range f.claims {
+		if c.OrderID == claim.OrderID {
+			return models.ErrClaimAlreadyExists
+		}
+	}
+	claim.ID = fmt.Sprintf("c-%d", len(f.claims)+1)
+	claim.Status = models.ClaimStatusOpen
+	claim.CreatedAt = time.Now()
+	cp := *claim
+	f.claims = append(f.claims, &cp)
+	return nil
+}
+
+func (f *fakeRepo) FindClaim(ctx context.Context, claimID string) (*models.Claim, error) {
+	for _, c := range f.claims {
+		if c.ID == claimID {
+			cp := *c
+			return &cp, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeRepo) FindClaimByOrder(ctx context.Context, orderID string) (*models.Claim, error) {
+	for _, c := range f.claims {
+		if c.OrderID == orderID {
+			cp := *c
+			return &cp, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeRepo) ListClaims(ctx context.Context, q models.ClaimQuery) ([]*models.Claim, int, error) {
+	out := []*models.Claim{}
+	for _, c := range f.claims {
+		if q.Status == nil || c.Status == *q.Status {
+			out = append(out, c)
+		}
+	}
+	return out, len(out), nil
+}
+
+func (f *fakeRepo) DecideClaim(ctx context.Context, claim *models.Claim) error {
+	for i, c := range f.claims {
+		if c.ID == claim.ID {
+			if c.Status != models.ClaimStatusOpen {
+				return models.ErrClaimAlreadyDecided
+			}
+			now := time.Now()
+			claim.DecidedAt = &now
+			cp := *claim
+			f.claims[i] = &cp
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+func (f *fakeRepo) InsertClaimPhoto(ctx context.Context, claimID string, photo *models.ClaimPhoto) error {
+	photo.ID = fmt.Sprintf("p-%d", len(f.photos[claimID])+1)
+	photo.CreatedAt = time.Now()
+	f.photos[claimID] = append(f.photos[claimID], *photo)
+	return nil
+}
+
+func (f *fakeRepo) ListClaimPhotos(ctx context.Context, claimID string) ([]models.ClaimPhoto, error) {
+	return append([]models.ClaimPhoto{}, f.photos[claimID]...), nil
+}
+
+func (f *fakeRepo) InsertWalletCredit(ctx context.Context, userID string, credit *models.WalletCredit) error {
+	credit.ID = int64(len(f.credits[userID]) + 1)
+	credit.CreatedAt = time.Now()
+	f.credits[userID] = append(f.credits[userID], *credit)
+	return nil
+}
+
+func (f *fakeRepo) GetWallet(ctx context.Context, userID string, limit int) (*models.Wallet, error) {
+	w := &models.Wallet{Credits: []models.WalletCredit{}}
+	for _, c := range f.credits[userID] {
+		w.Balance += c.Amount
+		w.Credits = append([]models.WalletCredit{c}, w.Credits...)
+	}
+	return w, nil
+}
+
+func (f *fakeRepo) InsertPromoCode(ctx context.Context, p *models.PromoCode) error {
+	for _, other := range f.promos {
+		if other.Code == p.Code {
+			return models.ErrPromoCodeTaken
+		}
+	}
+	p.ID = fmt.Sprintf("promo-%d", len(f.promos)+1)
+	p.CreatedAt = time.Now()
+	f.promos = append(f.promos, p)
+	return nil
+}
+
+func (f *fakeRepo) FindPromoCode(ctx context.Context, code string) (*models.PromoCode, error) {
+	for _, p := range f.promos {
+		if p.Code == code {
+			cp := *p
+			return &cp, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeRepo) ListPromoCodes(ctx context.Context, q models.PromoCodeQuery) ([]*models.PromoCode, int, error) {
+	out := []*models.PromoCode{}
+	for i := len(f.promos) - 1; i >= 0; i-- {
+		out = append(out, f.promos[i])
+	}
+	total := len(out)
+	start := min((q.Page-1)*q.Limit, total)
+	return out[start:min(start+q.Limit, total)], total, nil
+}
+
+func (f *fakeRepo) DisablePromoCode(ctx context.Context, promoCodeID string) (*models.PromoCode, error) {
+	for _, p := range f.promos {
+		if p.ID == promoCodeID {
+			if p.DisabledAt == nil {
+				now := time.Now()
+				p.DisabledAt = &now
+			}
+			return p, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeRepo) FindPromoRedemption(ctx context.Context, orderID string) (*models.PromoRedemption, error) {
+	if r, ok := f.redemptions[orderID]; ok {
+		return r, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+func (f *fakeRepo) RedeemPromoCode(ctx context.Context, pr *models.PromoRedemption) error {
+	var promo *models.PromoCode
+	for _, p := range f.promos {
+		if p.ID == pr.PromoCodeID {
+			promo = p
+		}
+	}
+	byUser := 0
+	for _, r := range f.redemptions {
+		if r.PromoCodeID == pr.PromoCodeID && r.UserID == pr.UserID {
+			byUser++
+		}
+	}
+	if (promo.MaxRedemptions != nil && promo.Redemptions >= *promo.MaxRedemptions) ||
+		(promo.MaxPerUser != nil && byUser >= *promo.MaxPerUser) {
+		return models.ErrPromoCodeExhausted
+	}
+	if _, ok := f.redemptions[pr.OrderID]; ok {
+		return models.ErrPromoCodeAlreadyApplied
+	}
+	promo.Redemptions++
+	pr.Code = promo.Code
+	pr.CreatedAt = time.Now()
+	f.redemptions[pr.OrderID] = pr
+	return nil
+}
+
+func (f *fakeRepo) ReleasePromoRedemption(ctx context.Context, orderID string) error {
+	r, ok := f.redemptions[orderID]
+	if !ok {
+		return nil
+	}
+	delete(f.redemptions, orderID)
+	for _, p := range f.promos {
+		if p.ID == r.PromoCodeID {
+			p.Redemptions--
+		}
+	}
+	return nil
+}
+
+func (f *fakeRepo) CreateReturn(ctx context.Context, ret *models.Order, reason string) (*models.Order, error) {
+	if ok, _ := f.HasReturn(ctx, *ret.ReturnOfOrderID); ok {
+		return nil, models.ErrReturnAlreadyExists
+	}
+	o := *ret
+	o.ID = fmt.Sprintf("o-%d", len(f.orders)+1)
+	o.CreatedAt = time.Now()
+	f.orders[o.ID] = &o
+	f.history = append(f.history, &models.OrderStatusEvent{OrderID: o.ID, ToStatus: o.Status, ActorType: models.ActorUser, Reason: reason, CreatedAt: o.CreatedAt})
+	cp := o
+	return &cp, nil
+}
+
+func (f *fakeRepo) HasReturn(ctx context.Context, orderID string) (bool, error) {
+	for _, o := range f.orders {
+		if o.ReturnOfOrderID != nil && *o.ReturnOfOrderID == orderID && o.Status != models.OrderStatusCancelled {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// InsertFeedback attaches the feedback to the stored order, where FindByID
+// returns it like the real attachFeedback.
+func (f *fakeRepo) InsertFeedback(ctx context.Context, orderID string, req models.FeedbackRequest) (*models.Feedback, error) {
+	o, ok := f.orders[orderID]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	if o.Feedback != nil {
+		return nil, models.ErrFeedbackAlreadySubmitted
+	}
+	now := time.Now()
+	o.Feedback = &models.Feedback{
+		ID: "fb-" + orderID, OrderID: orderID, MachineID: o.MachineID,
+		Rating: req.Rating, Comment: req.Comment, CreatedAt: now, UpdatedAt: now,
+	}
+	cp := *o.Feedback
+	return &cp, nil
+}
+
+func (f *fakeRepo) ListFeedback(ctx context.Context, q models.FeedbackQuery) ([]*models.Feedback, int, error) {
+	var all []*models.Feedback
+	for _, o := range f.orders {
+		fb := o.Feedback
+		if fb == nil || (q.Rating != 0 && fb.Rating != q.Rating) || (q.MachineID != "" && (fb.MachineID == nil || *fb.MachineID != q.MachineID)) {
+			continue
+		}
+		all = append(all, fb)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].CreatedAt.After(all[j].CreatedAt) })
+	start := min((q.Page-1)*q.Limit, len(all))
+	return all[start:min(start+q.Limit, len(all))], len(all), nil
+}
+
+func (f *fakeRepo) MachineRatings(ctx context.Context) ([]models.MachineRating, error) {
+	byMachine := map[string]*models.MachineRating{}
+	for _, o := range f.orders {
+		if o.Feedback == nil || o.Feedback.MachineID == nil {
+			continue
+		}
+		id := *o.Feedback.MachineID
+		if byMachine[id] == nil {
+			byMachine[id] = &models.MachineRating{MachineID: id}
+		}
+		mr := byMachine[id]
+		mr.AverageRating = (mr.AverageRating*float64(mr.RatingCount) + float64(o.Feedback.Rating)) / float64(mr.RatingCount+1)
+		mr.RatingCount++
+	}
+	ratings := []models.MachineRating{}
+	for _, mr := range byMachine {
+		ratings = append(ratings, *mr)
+	}
+	sort.Slice(ratings, func(i, j int) bool { return ratings[i].AverageRating < ratings[j].AverageRating })
+	return ratings, nil
+}
+
+func (f *fakeRepo) ClaimIdempotencyKey(ctx context.Context, k *models.IdempotencyKey, lease time.Duration) (*models.IdempotencyKey, error) {
+	id := k.UserID + "/" + k.Operation + "/" + k.Key
+	if existing, ok := f.keys[id]; ok {
+		cp := *existing
+		return &cp, nil
+	}
+	cp := *k
+	f.keys[id] = &cp
+	return nil, nil
+}
+
+func (f *fakeRepo) CompleteIdempotencyKey(ctx context.Context, k *models.IdempotencyKey, orderID string) error {
+	f.keys[k.UserID+"/"+k.Operation+"/"+k.Key].OrderID = &orderID
+	return nil
+}
+
+func (f *fakeRepo) ReleaseIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error {
+	id := k.UserID + "/" + k.Operation + "/" + k.Key
+	if existing, ok := f.keys[id]; ok && existing.OrderID == nil {
+		delete(f.keys, id)
+	}
+	return nil
+}
+
+func (f *fakeRepo) CreateWebhookEndpoint(ctx context.Context, ep *models.WebhookEndpoint) error {
+	ep.ID = fmt.Sprintf("wh-%d", len(f.webhooks)+1)
+	ep.CreatedAt = time.Now()
+	cp := *ep
+	f.webhooks = append(f.webhooks, &cp)
+	return nil
+}
+
+func (f *fakeRepo) ListWebhookEndpoints(ctx context.Context, userID string) ([]*models.WebhookEndpoint, error) {
+	out := []*models.WebhookEndpoint{}
+	for _, ep := range f.webhooks {
+		if ep.UserID == userID {
+			cp := *ep
+			cp.Secret = ""
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
+}
+
+// CreateWebhookDeliveries is a no-op: tests add due deliveries directly.
+func (f *fakeRepo) CreateWebhookDeliveries(ctx context.Context, since time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeRepo) ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.PendingWebhook, error) {
+	var due []models.PendingWebhook
+	for _, d := range f.deliveries {
+		if d.Status == models.WebhookPending && !d.NextAttemptAt.After(time.Now()) && len(due) < limit {
+			leased := time.Now().Add(lease)
+			d.NextAttemptAt = &leased
+			due = append(due, *d)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeRepo) RecordWebhookAttempt(ctx context.Context, deliveryID string, attempt models.WebhookAttempt, status models.WebhookDeliveryStatus, next *time.Time) error {
+	for _, d := range f.deliveries {
+		if d.ID == deliveryID {
+			d.Attempts, d.Status, d.LastStatusCode, d.LastError = attempt.Attempt, status, attempt.StatusCode, attempt.Error
+			if next != nil {
+				d.NextAttemptAt = next
+			}
+		}
+	}
+	f.attempts[deliveryID] = append(f.attempts[deliveryID], attempt)
+	return nil
+}
+
+type fakeLogistics struct {
+	LogisticsServiceInterface
+	repo     *fakeRepo
+	machine  string
+	released []string
+	recalled []string
+	assigned []string // Order IDs, in the order they were assigned.
+}
+
+// CalculateRouteOptions quotes a single option at 12.50 plus the priority
+// surcharge.
+func (f *fakeLogistics) CalculateRouteOptions(ctx context.Context, req models.RouteRequest) ([]models.RouteOption, error) {
+	cost := 12.5 * (1 + req.Priority.Surcharge())
+	return []models.RouteOption{{
+		ID:               fmt.Sprintf("r-%s-%s", req.PickupLocation.ID, req.DeliveryLocation.ID),
+		PickupLocation:   req.PickupLocation,
+		DeliveryLocation: req.DeliveryLocation,
+		EstimatedCost:    cost,
+		Priority:         req.Priority,
+		CostBreakdown: models.CostBreakdown{
+			BaseFare:          2,
+			DistanceCharge:    10.5,
+			PrioritySurcharge: cost - 12.5,
+			Total:             cost,
+		},
+		PickupTime: time.Now(),
+	}}, nil
+}
+
+// ReleaseMachine records the released machine.
+func (f *fakeLogistics) ReleaseMachine(ctx context.Context, machineID string) error {
+	f.released = append(f.released, machineID)
+	return nil
+}
+
+// RecallMachine records the recalled machine.
+func (f *fakeLogistics) RecallMachine(ctx context.Context, machineID string) error {
+	f.recalled = append(f.recalled, machineID)
+	return nil
+}
+
+func (f *fakeLogistics) AssignOrder(ctx context.Context, orderID string) (*models.Machine, error) {
+	if f.machine == "" {
+		return nil, models.ErrNoMachineAvailable
+	}
+	f.repo.orders[orderID].Status = models.OrderStatusInProgress
+	f.assigned = append(f.assigned, orderID)
+	return &models.Machine{ID: f.machine}, nil
+}
+
+type fakePayments struct{}
+
+func (fakePayments) ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID, idempotencyKey string) (string, error) {
+	return "pay-1", nil
+}
+
+func (fakePayments) ChargeCustomer(ctx context.Context, customerID string, amount float64, paymentMethodID, idempotencyKey string) (string, error) {
+	return "pay-1", nil
+}
+
+func (fakePayments) PaymentStatus(ctx context.Context, paymentID string) (string, error) {
+	return "succeeded", nil
+}
+
+func (fakePayments) CancelPayment(ctx context.Context, paymentID string) error {
+	return nil
+}
+
+func (fakePayments) Provider() string {
+	return "fake"
+}
+
+func (fakePayments) RefundPayment(ctx context.Context, paymentID string, amount float64, idempotencyKey string) (string, error) {
+	return "re-" + paymentID, nil
+}
+
+// fakeTx runs the unit of work without rollback semantics.
+type fakeTx struct{}
+
+func (fakeTx) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func TestAssignmentQueue(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment}
+	logistics := &fakeLogistics{repo: repo}
+	svc := NewService(repo, fakePayments{}, logistics, fakeTx{})
+
+	// Payment only confirms and queues the order; no machine is picked yet.
+	order, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm"})
+	if err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	if order.Status != models.OrderStatusConfirmed {
+		t.Errorf("status = %s; want CONFIRMED", order.Status)
+	}
+	if _, ok := repo.queue["o1"]; !ok {
+		t.Fatal("order o1 was not queued")
+	}
+	select {
+	case <-svc.paid:
+	default:
+		t.Error("ConfirmAndPay did not wake the dispatcher")
+	}
+
+	// No idle machine: the order is parked and rescheduled with backoff.
+	if err := svc.RetryPendingAssignments(ctx); err != nil {
+		t.Fatalf("RetryPendingAssignments error: %v", err)
+	}
+	if repo.orders["o1"].Status != models.OrderStatusAssignmentPending {
+		t.Errorf("status = %s; want ASSIGNMENT_PENDING", repo.orders["o1"].Status)
+	}
+	if repo.queue["o1"].Attempts != 1 || repo.delays["o1"] != 2*assignmentRetryBase {
+		t.Errorf("after failed retry attempts = %d, delay = %v; want 1, %v", repo.queue["o1"].Attempts, repo.delays["o1"], 2*assignmentRetryBase)
+	}
+
+	// A machine became idle: the order is assigned, dequeued and announced.
+	logistics.machine = "m1"
+	if err := svc.RetryPendingAssignments(ctx); err != nil {
+		t.Fatalf("RetryPendingAssignments error: %v", err)
+	}
+	if _, ok := repo.queue["o1"]; ok {
+		t.Error("order o1 is still queued after assignment")
+	}
+	if repo.orders["o1"].Status != models.OrderStatusInProgress {
+		t.Errorf("status = %s; want IN_PROGRESS", repo.orders["o1"].Status)
+	}
+	if want := []string{"order.paid", "order.confirmed", "order.assigned"}; !slices.Equal(repo.events, want) {
+		t.Errorf("outbox events = %v; want %v", repo.events, want)
+	}
+}
+
+// passRepo reports how many orders each dispatcher pass found due, and waits
+// until the test has read it.
+type passRepo struct {
+	*fakeRepo
+	passes chan int
+}
+
+func (r passRepo) ListDueAssignments(ctx context.Context, limit int) ([]models.PendingAssignment, error) {
+	due, err := r.fakeRepo.ListDueAssignments(ctx, limit)
+	r.passes <- len(due)
+	return due, err
+}
+
+func TestDispatcherRun(t *testing.T) {
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment}
+	passes := make(chan int)
+	svc := NewService(passRepo{repo, passes}, fakePayments{}, &fakeLogistics{repo: repo, machine: "m1"}, fakeTx{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		// Polls too rarely to matter: only a payment wakes it.
+		NewDispatcher(svc, time.Hour).Run(ctx)
+		close(done)
+	}()
+
+	if n := <-passes; n != 0 {
+		t.Fatalf("first pass found %d order(s); want none", n)
+	}
+	if _, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm"}); err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	select {
+	case n := <-passes:
+		if n != 1 {
+			t.Errorf("pass after the payment found %d order(s); want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the payment did not wake the dispatcher")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after ctx was cancelled")
+	}
+	if repo.orders["o1"].Status != models.OrderStatusInProgress {
+		t.Errorf("status = %s; want IN_PROGRESS", repo.orders["o1"].Status)
+	}
+}
+
+func TestExpressPriority(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	logistics := &fakeLogistics{repo: repo, machine: "m1"}
+	svc := NewService(repo, fakePayments{}, logistics, fakeTx{})
+
+	options, err := svc.GetDeliveryQuote(ctx, "u1", models.RouteRequest{Priority: models.PriorityExpress})
+	if err != nil {
+		t.Fatalf("GetDeliveryQuote error: %v", err)
+	}
+	order, err := svc.CreateOrder(ctx, "u1", models.CreateOrderRequest{RouteOptionID: options[0].ID})
+	if err != nil {
+		t.Fatalf("CreateOrder error: %v", err)
+	}
+	if order.Priority != models.PriorityExpress || order.Cost != 18.75 {
+		t.Errorf("order priority = %s, cost = %.2f; want EXPRESS at 18.75", order.Priority, order.Cost)
+	}
+	if b := order.CostBreakdown; b == nil || b.PrioritySurcharge != 6.25 || b.Total != order.Cost {
+		t.Errorf("order breakdown = %+v; want a 6.25 priority surcharge totalling the cost", b)
+	}
+
+	// Standard orders queued earlier still wait behind the express one.
+	for _, id := range []string{"s1", "s2"} {
+		repo.orders[id] = &models.Order{ID: id, UserID: "u2", Status: models.OrderStatusConfirmed, Priority: models.PriorityStandard}
+		repo.queue[id] = &models.PendingAssignment{OrderID: id, EnqueuedAt: time.Now().Add(-time.Hour)}
+	}
+	if _, err := svc.ConfirmAndPay(ctx, "u1", order.ID, models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm"}); err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	if err := svc.RetryPendingAssignments(ctx); err != nil {
+		t.Fatalf("RetryPendingAssignments error: %v", err)
+	}
+	if len(logistics.assigned) != 3 || logistics.assigned[0] != order.ID {
+		t.Errorf("assigned %v; want the express order %s first", logistics.assigned, order.ID)
+	}
+}
+
+func TestAssignmentBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, assignmentRetryBase},
+		{1, 2 * assignmentRetryBase},
+		{3, 8 * assignmentRetryBase},
+		{100, assignmentRetryMax},
+	}
+	for _, tt := range tests {
+		if got := assignmentBackoff(tt.attempts); got != tt.want {
+			t.Errorf("assignmentBackoff(%d) = %v; want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package order
+
+import (
+	"context"
+	"crypto/rand"
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// claimPhotoURLTTL is how long the photo links on a claim stay valid.
+const claimPhotoURLTTL = 15 * time.Minute
+
+// walletCreditsShown bounds the wallet entries returned with the balance.
+const walletCreditsShown = 100
+
+// claimPhotoExtensions names stored claim photos by content type.
+var claimPhotoExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// WithStorage sets where claim photos are kept. Without it claims can be
+// filed but photos cannot be added.
+func WithStorage(st storage.Storage) Option {
+	return func(s *Service) { s.storage = st }
+}
+
+// FileClaim files the customer's claim for a package lost or damaged on an
+// order delivered or failed in the last ClaimWindow. An order takes one
+// claim; it stays OPEN, and takes photos, until an admin decides it. The
+// claim of an insured order is for at most its insured value.
+func (s *Service) FileClaim(ctx context.Context, orderID, userID, role string, req models.CreateClaimRequest) (*models.Claim, error) {
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != models.OrderStatusDelivered && order.Status != models.OrderStatusFailed {
+		return nil, models.ErrClaimNotAllowed
+	}
+	events, err := s.repo.ListStatusEvents(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.FileClaim: %w", err)
+	}
+	var endedAt time.Time
+	for _, ev := range events {
+		if ev.ToStatus == order.Status {
+			endedAt = ev.CreatedAt
+		}
+	}
+	if time.Since(endedAt) > models.ClaimWindow {
+		return nil, models.ErrClaimNotAllowed
+	}
+	description := strings.TrimSpace(req.Description)
+	if description == "" {
+		return nil, models.ValidationFailed(models.FieldError{Field: "description", Rule: "required", Message: "description must not be blank"})
+	}
+	if order.InsuredValue != nil && roundCents(req.Amount) > *order.InsuredValue {
+		return nil, amountTooHigh(*order.InsuredValue, "the insured value of the order")
+	}
+
+	claim := &models.Claim{
+		OrderID:       orderID,
+		UserID:        userID,
+		Type:          req.Type,
+		Description:   description,
+		AmountClaimed: roundCents(req.Amount),
+		Photos:        []models.ClaimPhoto{},
+		InsuredValue:  order.InsuredValue,
+	}
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.InsertClaim(ctx, claim); err != nil {
+			return err
+		}
+		event := map[string]any{
+			"claim_id": claim.ID,
+			"order_id": orderID,
+			"user_id":  userID,
+			"type":     claim.Type,
+			"amount":   claim.AmountClaimed,
+		}
+		return s.repo.InsertOutboxEvent(ctx, orderID, "claim.filed", event)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("service.FileClaim: %w", err)
+	}
+	return claim, nil
+}
+
+// GetClaim returns the claim filed against an order, with links to its
+// photos. It is visible to the same users as the order.
+func (s *Service) GetClaim(ctx context.Context, orderID, userID, role string) (*models.Claim, error) {
+	if _, err := s.GetOrderDetails(ctx, orderID, userID, role); err != nil {
+		return nil, err
+	}
+	claim, err := s.repo.FindClaimByOrder(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.GetClaim: %w", err)
+	}
+	if err := s.loadClaimPhotos(ctx, claim); err != nil {
+		return nil, fmt.Errorf("service.GetClaim: %w", err)
+	}
+	return claim, nil
+}
+
+// AddClaimPhoto stores a photo of size bytes read from r and attaches it to
+// the open claim on the customer's order. Photos must be JPEG, PNG or WebP
+// of at most 10 MB, and a claim takes up to MaxClaimPhotos.
+func (s *Service) AddClaimPhoto(ctx context.Context, orderID, userID, role string, r io.Reader, size int64, contentType string) (*models.ClaimPhoto, error) {
+	if s.storage == nil {
+		return nil, errors.New("service.AddClaimPhoto: no file storage configured")
+	}
+	if _, err := s.ownedOrder(ctx, orderID, userID, role); err != nil {
+		return nil, err
+	}
+	claim, err := s.repo.FindClaimByOrder(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.AddClaimPhoto: %w", err)
+	}
+	if claim.Status != models.ClaimStatusOpen {
+		return nil, models.ErrClaimAlreadyDecided
+	}
+	photos, err := s.repo.ListClaimPhotos(ctx, claim.ID)
+	if err != nil {
+		return nil, fmt.Errorf("service.AddClaimPhoto: %w", err)
+	}
+	if len(photos) >= models.MaxClaimPhotos {
+		return nil, models.ErrTooManyClaimPhotos
+	}
+	if err := storage.PolicyClaimPhoto.Validate(contentType, size); err != nil {
+		return nil, err
+	}
+
+	name := make([]byte, 8)
+	if _, err := rand.Read(name); err != nil {
+		return nil, fmt.Errorf("service.AddClaimPhoto: %w", err)
+	}
+	mediaType := strings.TrimSpace(strings.ToLower(strings.SplitN(contentType, ";", 2)[0]))
+	photo := &models.ClaimPhoto{
+		Key:         storage.PolicyClaimPhoto.Key(claim.ID, hex.EncodeToString(name)+claimPhotoExtensions[mediaType]),
+		ContentType: mediaType,
+		Size:        size,
+	}
+	if err := storage.PutValidated(ctx, s.storage, storage.PolicyClaimPhoto, photo.Key, r, size, mediaType); err != nil {
+		return nil, fmt.Errorf("service.AddClaimPhoto: %w", err)
+	}
+	if err := s.repo.InsertClaimPhoto(ctx, claim.ID, photo); err != nil {
+		if delErr := s.storage.Delete(ctx, photo.Key); delErr != nil {
+			log.Printf("AddClaimPhoto: removing unrecorded photo %s: %v", photo.Key, delErr)
+		}
+		return nil, fmt.Errorf("service.AddClaimPhoto: %w", err)
+	}
+	if photo.URL, err = s.storage.PresignGet(ctx, photo.Key, claimPhotoURLTTL); err != nil {
+		return nil, fmt.Errorf("service.AddClaimPhoto: %w", err)
+	}
+	return photo, nil
+}
+
+// loadClaimPhotos sets the photos of claim with fresh download links.
+func (s *Service) loadClaimPhotos(ctx context.Context, claim *models.Claim) error {
+	photos, err := s.repo.ListClaimPhotos(ctx, claim.ID)
+	if err != nil {
+		return err
+	}
+	if s.storage != nil {
+		for i := range photos {
+			if photos[i].URL, err = s.storage.PresignGet(ctx, photos[i].Key, claimPhotoURLTTL); err != nil {
+				return err
+			}
+		}
+	}
+	claim.Photos = photos
+	return nil
+}
+
+// ListClaims returns one page of claims, oldest first, optionally only those
+// in one status. For admin use.
+func (s *Service) ListClaims(ctx context.Context, q models.ClaimQuery) (*models.ClaimPage, error) {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.Limit < 1 || q.Limit > 100 {
+		q.Limit = 50
+	}
+	claims, total, err := s.repo.ListClaims(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("service.ListClaims: %w", err)
+	}
+	return &models.ClaimPage{Claims: claims, Total: total}, nil
+}
+
+// DecideClaim approves or rejects an open claim on an admin's behalf. An
+// approval pays out the requested amount, at most the amount claimed, either
+// as a refund of the order's payment, at most what was paid, or as credit in
+// the customer's wallet. The customer is notified of the decision, which
+// emits "claim.decided".
+func (s *Service) DecideClaim(ctx context.Context, claimID, adminID string, req models.ClaimDecisionRequest) (*models.Claim, error) {
+	claim, err := s.repo.FindClaim(ctx, claimID)
+	if err != nil {
+		return nil, fmt.Errorf("service.DecideClaim: %w", err)
+	}
+	if claim.Status != models.ClaimStatusOpen {
+		return nil, models.ErrClaimAlreadyDecided
+	}
+	claim.DecisionNote = strings.TrimSpace(req.Note)
+	claim.DecidedBy = &adminID
+	claim.Status = models.ClaimStatusRejected
+
+	var amount float64
+	if req.Approve {
+		amount = roundCents(req.Amount)
+		if amount == 0 {
+			amount = claim.AmountClaimed
+		}
+		if amount > claim.AmountClaimed {
+			return nil, amountTooHigh(claim.AmountClaimed, "the amount claimed")
+		}
+		if req.Resolution == models.ClaimResolutionRefund {
+			if claim.RefundID, err = s.refundClaim(ctx, claim, amount); err != nil {
+				return nil, err
+			}
+		}
+		resolution := req.Resolution
+		claim.Status = models.ClaimStatusApproved
+		claim.Resolution = &resolution
+		claim.AmountApproved = &amount
+	}
+
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.DecideClaim(ctx, claim); err != nil {
+			return err
+		}
+		if req.Approve && req.Resolution == models.ClaimResolutionCredit {
+			err := s.repo.InsertWalletCredit(ctx, claim.UserID, &models.WalletCredit{
+				Amount:  amount,
+				Reason:  "claim for order " + claim.OrderID,
+				ClaimID: &claim.ID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		event := map[string]any{
+			"claim_id":   claim.ID,
+			"order_id":   claim.OrderID,
+			"user_id":    claim.UserID,
+			"status":     claim.Status,
+			"resolution": claim.Resolution,
+			"amount":     amount,
+		}
+		if err := s.repo.InsertOutboxEvent(ctx, claim.OrderID, "claim.decided", event); err != nil {
+			return err
+		}
+		return s.repo.InsertNotification(ctx, claim.UserID, claimDecisionMessage(claim))
+	})
+	if err != nil {
+		if claim.RefundID != "" {
+			log.Printf("CRITICAL: Refund %s issued for claim %s but the decision was not recorded: %v", claim.RefundID, claim.ID, err)
+		}
+		return nil, fmt.Errorf("service.DecideClaim: %w", err)
+	}
+	if err := s.loadClaimPhotos(ctx, claim); err != nil {
+		return nil, fmt.Errorf("service.DecideClaim: %w", err)
+	}
+	return claim, nil
+}
+
+// refundClaim refunds amount of the payment of the claimed order. The refund
+// is keyed by the claim, so deciding it again after a failure to record the
+// decision does not refund twice.
+func (s *Service) refundClaim(ctx context.Context, claim *models.Claim, amount float64) (string, error) {
+	order, err := s.repo.FindByID(ctx, claim.OrderID)
+	if err != nil {
+		return "", fmt.Errorf("service.DecideClaim: %w", err)
+	}
+	paymentID, refundID, err := s.repo.GetPaymentRefs(ctx, claim.OrderID)
+	if err != nil {
+		return "", fmt.Errorf("service.DecideClaim: %w", err)
+	}
+	if paymentID == "" || refundID != "" {
+		return "", models.ErrClaimNotRefundable
+	}
+	if amount > order.Cost {
+		return "", amountTooHigh(order.Cost, "what was paid for the order")
+	}
+	refundID, err = s.paymentService.RefundPayment(ctx, paymentID, amount, "claim-refund-"+claim.ID)
+	s.recordPayment(ctx, order, models.PaymentKindRefund, amount, refundID, err)
+	if err != nil {
+		log.Printf("DecideClaim: refund of payment %s for claim %s failed: %v", paymentID, claim.ID, err)
+		return "", fmt.Errorf("service.DecideClaim: %w: %w", models.ErrRefundFailed, err)
+	}
+	return refundID, nil
+}
+
+// amountTooHigh rejects a claim payout above limit, described by what.
+func amountTooHigh(limit float64, what string) error {
+	return models.ValidationFailed(models.FieldError{
+		Field:   "amount",
+		Rule:    "max",
+		Param:   strconv.FormatFloat(limit, 'f', 2, 64),
+		Message: "amount must not exceed " + what,
+	})
+}
+
+// claimDecisionMessage is the notification telling the customer how their
+// claim was decided.
+func claimDecisionMessage(claim *models.Claim) string {
+	var msg string
+	switch {
+	case claim.Status == models.ClaimStatusRejected:
+		msg = fmt.Sprintf("Your claim for order %s was not approved.", claim.OrderID)
+	case *claim.Resolution == models.ClaimResolutionRefund:
+		msg = fmt.Sprintf("Your claim for order %s was approved: %.2f USD will be refunded to your payment method.", claim.OrderID, *claim.AmountApproved)
+	default:
+		msg = fmt.Sprintf("Your claim for order %s was approved: %.2f USD was added to your wallet.", claim.OrderID, *claim.AmountApproved)
+	}
+	if claim.DecisionNote != "" {
+		msg += " " + claim.DecisionNote
+	}
+	return msg
+}
+
+// Wallet returns the user's credit balance and latest credits.
+func (s *Service) Wallet(ctx context.Context, userID string) (*models.Wallet, error) {
+	wallet, err := s.repo.GetWallet(ctx, userID, walletCreditsShown)
+	if err != nil {
+		return nil, fmt.Errorf("service.Wallet: %w", err)
+	}
+	return wallet, nil
+}
+
+// roundCents rounds an amount in USD to whole cents.
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,50 @@
+package order
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// dispatchTimeout bounds a single pass over the assignment queue.
+const dispatchTimeout = time.Minute
+
+// Dispatcher assigns machines to paid orders in the background. ConfirmAndPay
+// only queues the order and records "order.paid"; the dispatcher consumes the
+// queue when woken by a payment on this instance or every poll interval, which
+// also picks up orders paid on other instances and retries failed assignments.
+type Dispatcher struct {
+	svc  *Service
+	poll time.Duration
+}
+
+// NewDispatcher creates a dispatcher for svc. poll defaults to 2s.
+func NewDispatcher(svc *Service, poll time.Duration) *Dispatcher {
+	if poll <= 0 {
+		poll = 2 * time.Second
+	}
+	return &Dispatcher{svc: svc, poll: poll}
+}
+
+// Run dispatches queued orders until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.poll)
+	defer ticker.Stop()
+	for {
+		d.dispatch(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.svc.paid:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, dispatchTimeout)
+	defer cancel()
+	if err := d.svc.RetryPendingAssignments(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("dispatcher: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// orderExportHeader names the columns of an order export. Times are RFC3339
+// in UTC; optional values are left empty.
+var orderExportHeader = []string{
+	"order_id", "customer_id", "customer_email", "status", "machine_id",
+	"pickup_address", "dropoff_address", "item_weight_kg", "cost", "tip",
+	"scheduled_pickup_time", "delivery_window_start", "delivery_window_end",
+	"created_at", "updated_at",
+}
+
+// ExportOrders writes the orders matching q to w as CSV, oldest first. Rows
+// are written as the repository streams them, so a month of orders is never
+// held in memory; w sees its first bytes once the csv.Writer buffer fills or
+// the export ends. On error, w may already hold part of the export.
+func (s *Service) ExportOrders(ctx context.Context, q models.OrderExportQuery, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(orderExportHeader); err != nil {
+		return fmt.Errorf("service.ExportOrders: %w", err)
+	}
+	err := s.repo.ExportOrders(ctx, q, func(row *models.OrderExportRow) error {
+		return cw.Write(orderExportRecord(row))
+	})
+	if err != nil {
+		return fmt.Errorf("service.ExportOrders: %w", err)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("service.ExportOrders: %w", err)
+	}
+	return nil
+}
+
+// orderExportRecord formats one export row in orderExportHeader order.
+func orderExportRecord(row *models.OrderExportRow) []string {
+	var machineID string
+	if row.MachineID != nil {
+		machineID = *row.MachineID
+	}
+	var windowStart, windowEnd string
+	if w := row.DeliveryWindow; w != nil {
+		windowStart, windowEnd = exportTime(&w.Start), exportTime(&w.End)
+	}
+	return []string{
+		row.ID, row.UserID, exportText(row.CustomerEmail), string(row.Status), machineID,
+		exportText(row.PickupStreet), exportText(row.DropoffStreet),
+		strconv.FormatFloat(row.ItemWeightKg, 'f', -1, 64),
+		strconv.FormatFloat(row.Cost, 'f', 2, 64),
+		strconv.FormatFloat(row.Tip, 'f', 2, 64),
+		exportTime(row.ScheduledPickupTime), windowStart, windowEnd,
+		exportTime(&row.CreatedAt), exportTime(&row.UpdatedAt),
+	}
+}
+
+// exportText escapes a value customers typed in, so a spreadsheet shows it
+// as text instead of running it as a formula: one starting with =, +, -, @,
+// a tab or a carriage return is prefixed with a single quote.
+func exportText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportTime formats an optional timestamp for an export.
+func exportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,54 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"fmt"
+)
+
+// SubmitFeedback records the customer's rating of a delivered order. Each
+// order takes one feedback; it is shown with the order from then on and
+// counts towards the rating of the machine that delivered it.
+func (s *Service) SubmitFeedback(ctx context.Context, userID string, orderID string, role string, req models.FeedbackRequest) (*models.Feedback, error) {
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != models.OrderStatusDelivered {
+		return nil, models.ErrCannotSubmitFeedback
+	}
+	if order.Feedback != nil {
+		return nil, models.ErrFeedbackAlreadySubmitted
+	}
+	fb, err := s.repo.InsertFeedback(ctx, orderID, req)
+	if err != nil {
+		return nil, fmt.Errorf("service.SubmitFeedback: %w", err)
+	}
+	return fb, nil
+}
+
+// ListFeedback returns one page of all customers' feedback, newest first.
+// For admin use.
+func (s *Service) ListFeedback(ctx context.Context, q models.FeedbackQuery) (*models.FeedbackPage, error) {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.Limit < 1 || q.Limit > 100 {
+		q.Limit = 50
+	}
+	feedback, total, err := s.repo.ListFeedback(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("service.ListFeedback: %w", err)
+	}
+	return &models.FeedbackPage{Feedback: feedback, Total: total}, nil
+}
+
+// MachineRatings returns the average feedback rating of each machine that
+// has been rated, lowest first. For admin use.
+func (s *Service) MachineRatings(ctx context.Context) ([]models.MachineRating, error) {
+	ratings, err := s.repo.MachineRatings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("service.MachineRatings: %w", err)
+	}
+	return ratings, nil
+}
@@ -0,0 +1,98 @@
+package order
+
+import (
+	"context"
+	"crypto/rand"
+	"dispatch-and-delivery/internal/models"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// newDeliveryPIN returns a random PIN of models.DeliveryPINLength digits.
+func newDeliveryPIN() (string, error) {
+	limit := big.NewInt(1)
+	for range models.DeliveryPINLength {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", fmt.Errorf("generate delivery PIN: %w", err)
+	}
+	return fmt.Sprintf("%0*d", models.DeliveryPINLength, n), nil
+}
+
+// redactPIN clears the delivery PIN of an order shown to anyone but its
+// customer, so staff and machines cannot complete the handover themselves.
+func redactPIN(order *models.Order, userID string) {
+	if order.UserID != userID {
+		order.DeliveryPIN = ""
+	}
+}
+
+// redactPINs clears the delivery PINs of orders listed for staff.
+func redactPINs(orders []*models.Order) {
+	for _, order := range orders {
+		order.DeliveryPIN = ""
+	}
+}
+
+// ConfirmDelivery marks an order as delivered when the recipient enters its
+// PIN in the app. Orders become ARRIVED automatically when tracking shows the
+// machine inside the dropoff geofence; only those can be confirmed.
+func (s *Service) ConfirmDelivery(ctx context.Context, orderID string, userID string, role string, req models.HandoffRequest) error {
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return err
+	}
+	if order.Status != models.OrderStatusArrived {
+		return models.ErrOrderCannotBeConfirmed
+	}
+	return s.completeHandoff(ctx, order, req.PIN, models.ActorUser, userID, "delivery confirmed by recipient")
+}
+
+// MachineHandoff marks an order as delivered when the recipient gives its
+// PIN to the machine carrying it. The machine may hand over before tracking
+// has marked the order ARRIVED; the PIN shows the recipient is there.
+func (s *Service) MachineHandoff(ctx context.Context, orderID, machineID string, req models.HandoffRequest) error {
+	order, err := s.repo.FindByID(ctx, orderID)
+	if err != nil {
+		return fmt.Errorf("service.MachineHandoff: %w", err)
+	}
+	if order.MachineID == nil || *order.MachineID != machineID {
+		return models.ErrNotFound
+	}
+	if order.Status != models.OrderStatusArrived && order.Status != models.OrderStatusInProgress {
+		return models.ErrOrderCannotBeConfirmed
+	}
+	return s.completeHandoff(ctx, order, req.PIN, models.ActorMachine, machineID, "handed over with delivery PIN")
+}
+
+// completeHandoff checks pin and moves order to DELIVERED. The order only
+// moves from the status it was checked in; if it left it meanwhile, the
+// handover fails with ErrOrderCannotBeConfirmed.
+func (s *Service) completeHandoff(ctx context.Context, order *models.Order, pin string, actor models.StatusActor, actorID, reason string) error {
+	// Checked before the unit of work so wrong PINs stay counted.
+	ok, err := s.repo.CheckDeliveryPIN(ctx, order.ID, pin)
+	if err != nil {
+		return fmt.Errorf("service.completeHandoff: %w", err)
+	}
+	if !ok {
+		return models.ErrInvalidDeliveryPIN
+	}
+	return s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.setStatus(ctx, order, models.OrderStatusDelivered, actor, actorID, reason); err != nil {
+			// The order moved on since it was read, e.g. it was cancelled or
+			// another handover completed first.
+			if errors.Is(err, models.ErrOrderStatusChanged) {
+				return models.ErrOrderCannotBeConfirmed
+			}
+			return fmt.Errorf("failed to update order status: %w", err)
+		}
+		event := map[string]string{
+			"order_id": order.ID,
+			"user_id":  order.UserID,
+		}
+		return s.repo.InsertOutboxEvent(ctx, order.ID, "order.delivered", event)
+	})
+}
@@ -0,0 +1,108 @@
+package order
+
+import (
+	"context"
+	"crypto/sha256"
+	"dispatch-and-delivery/internal/models"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Operations an Idempotency-Key is scoped to; a client may use the same key
+// once for each.
+const (
+	opCreateOrder  = "create_order"
+	opPayOrder     = "pay_order"
+	opRetryPayment = "retry_payment"
+	opReorder      = "reorder"
+	opAddTip       = "add_tip"
+)
+
+// idempotencyLease is how long an unfinished claim blocks its key. Requests
+// finish well within it; a claim left behind by a crashed instance can be
+// retried once it has passed.
+const idempotencyLease = time.Minute
+
+// claimIdempotencyKey claims key for a request of userID and returns the
+// claim, or a nil claim when key is empty. When the same request already
+// completed with this key it returns the order that request produced, read
+// again, and the caller returns it without doing anything else.
+func (s *Service) claimIdempotencyKey(ctx context.Context, userID, op, key string, request any) (*models.IdempotencyKey, *models.Order, error) {
+	if key == "" {
+		return nil, nil, nil
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(body)
+	claim := &models.IdempotencyKey{UserID: userID, Operation: op, Key: key, RequestHash: hex.EncodeToString(sum[:])}
+
+	existing, err := s.repo.ClaimIdempotencyKey(ctx, claim, idempotencyLease)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case existing == nil:
+		return claim, nil, nil
+	case existing.RequestHash != claim.RequestHash:
+		return nil, nil, models.ErrIdempotencyKeyReused
+	case existing.OrderID == nil:
+		return nil, nil, models.ErrIdempotencyKeyInUse
+	}
+	order, err := s.repo.FindByID(ctx, *existing.OrderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, order, nil
+}
+
+// completeIdempotencyKey records the order a claimed request produced. Call
+// it in the request's unit of work, so the key completes exactly when the
+// request's writes commit.
+func (s *Service) completeIdempotencyKey(ctx context.Context, claim *models.IdempotencyKey, orderID string) error {
+	if claim == nil {
+		return nil
+	}
+	return s.repo.CompleteIdempotencyKey(ctx, claim, orderID)
+}
+
+// releaseIdempotencyKey frees the key of a failed request so the client can
+// retry it.
+func (s *Service) releaseIdempotencyKey(ctx context.Context, claim *models.IdempotencyKey) {
+	if claim == nil {
+		return
+	}
+	// The request may have failed because its context ended.
+	if err := s.repo.ReleaseIdempotencyKey(context.WithoutCancel(ctx), claim); err != nil {
+		log.Printf("releaseIdempotencyKey: %s %s: %v", claim.Operation, claim.Key, err)
+	}
+}
+
+// paymentIdempotencyKey derives the key sent to the payment provider with a
+// claimed payment, so a retried charge returns the first payment instead of
+// charging again. It differs per operation and request, so a retry with
+// another payment method, or through RetryPayment, is a new charge.
+func paymentIdempotencyKey(claim *models.IdempotencyKey) string {
+	if claim == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(claim.UserID + "\x00" + claim.Operation + "\x00" + claim.Key + "\x00" + claim.RequestHash))
+	return "order-pay-" + hex.EncodeToString(sum[:])
+}
+
+// PurgeIdempotencyKeys deletes keys older than models.IdempotencyKeyTTL. It is
+// run periodically by the scheduler.
+func (s *Service) PurgeIdempotencyKeys(ctx context.Context) error {
+	n, err := s.repo.DeleteExpiredIdempotencyKeys(ctx, time.Now().Add(-models.IdempotencyKeyTTL))
+	if err != nil {
+		return fmt.Errorf("service.PurgeIdempotencyKeys: %w", err)
+	}
+	if n > 0 {
+		log.Printf("PurgeIdempotencyKeys: deleted %d expired key(s)", n)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package order
+
+import (
+	"dispatch-and-delivery/internal/models"
+	"strconv"
+)
+
+// WithInsurancePolicy sets how packages are insured. Without it insurance is
+// not offered.
+func WithInsurancePolicy(p models.InsurancePolicy) Option {
+	return func(s *Service) { s.insurance = p }
+}
+
+// checkInsurance validates the insurance asked for with a quote, if any.
+func (s *Service) checkInsurance(req *models.InsuranceRequest) error {
+	if req == nil {
+		return nil
+	}
+	limit := s.insurance.MaxDeclaredValue
+	if limit <= 0 {
+		return models.ValidationFailed(models.FieldError{
+			Field: "insurance", Rule: "excluded", Message: "insurance is not offered",
+		})
+	}
+	if roundCents(req.DeclaredValue) > limit {
+		param := strconv.FormatFloat(limit, 'f', 2, 64)
+		return models.ValidationFailed(models.FieldError{
+			Field: "insurance.declared_value", Rule: "max", Param: param, Message: "declared_value must not exceed " + param,
+		})
+	}
+	return nil
+}
+
+// insure adds the premium for insuring req's declared value, checked with
+// checkInsurance, to each of options.
+func (s *Service) insure(options []models.RouteOption, req *models.InsuranceRequest) {
+	if req == nil {
+		return
+	}
+	value := roundCents(req.DeclaredValue)
+	premium := s.insurance.Premium(value)
+	for i := range options {
+		o := &options[i]
+		o.InsuredValue = value
+		o.CostBreakdown.Insurance = premium
+		o.CostBreakdown.Total = roundCents(o.CostBreakdown.Total + premium)
+		o.EstimatedCost = roundCents(o.EstimatedCost + premium)
+	}
+}
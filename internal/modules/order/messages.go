@@ -0,0 +1,91 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"fmt"
+	"strings"
+)
+
+// maxUnreadThreads bounds how many threads UnreadMessages lists.
+const maxUnreadThreads = 100
+
+// isStaff reports whether role answers customers' order messages.
+func isStaff(role string) bool {
+	return role == models.RoleAdmin || role == models.RoleSupport
+}
+
+// ListOrderMessages returns an order's message thread, oldest first, to the
+// users who can see the order, and marks it read for userID. Messages an
+// admin hid are only shown to staff.
+func (s *Service) ListOrderMessages(ctx context.Context, orderID, userID, role string) ([]*models.OrderMessage, error) {
+	if _, err := s.GetOrderDetails(ctx, orderID, userID, role); err != nil {
+		return nil, err
+	}
+	messages, err := s.repo.ListOrderMessages(ctx, orderID, isStaff(role))
+	if err != nil {
+		return nil, fmt.Errorf("service.ListOrderMessages: %w", err)
+	}
+	// Read up to the last message shown, by the database's clock.
+	if n := len(messages); n > 0 {
+		if err := s.repo.MarkOrderMessagesRead(ctx, orderID, userID, messages[n-1].CreatedAt); err != nil {
+			return nil, fmt.Errorf("service.ListOrderMessages: %w", err)
+		}
+	}
+	return messages, nil
+}
+
+// PostOrderMessage adds a message to an order's thread. The customer who owns
+// the order and staff can post; the customer is notified of staff messages.
+func (s *Service) PostOrderMessage(ctx context.Context, orderID, userID, role string, req models.OrderMessageRequest) (*models.OrderMessage, error) {
+	order, err := s.GetOrderDetails(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		return nil, models.ValidationFailed(models.FieldError{Field: "body", Rule: "required", Message: "body must not be blank"})
+	}
+	msg := &models.OrderMessage{OrderID: orderID, SenderID: &userID, SenderRole: models.RoleCustomer, Body: body}
+	if isStaff(role) {
+		msg.SenderRole = role
+	}
+
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.InsertOrderMessage(ctx, msg); err != nil {
+			return err
+		}
+		if !msg.FromStaff() || order.UserID == userID {
+			return nil
+		}
+		return s.repo.InsertNotification(ctx, order.UserID, fmt.Sprintf("You have a new message about your order %s.", orderID))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("service.PostOrderMessage: %w", err)
+	}
+	return msg, nil
+}
+
+// HideOrderMessage hides a message of an order's thread from its customer,
+// e.g. for abuse. For admin use; staff still see it, marked hidden.
+func (s *Service) HideOrderMessage(ctx context.Context, orderID, messageID, adminID string) error {
+	if err := s.repo.HideOrderMessage(ctx, orderID, messageID, adminID); err != nil {
+		return fmt.Errorf("service.HideOrderMessage: %w", err)
+	}
+	return nil
+}
+
+// UnreadMessages lists the threads with messages userID has not read. For a
+// customer these are staff messages on their orders; for staff, customer
+// messages on any order.
+func (s *Service) UnreadMessages(ctx context.Context, userID, role string) (*models.UnreadMessages, error) {
+	orders, err := s.repo.ListUnreadOrderMessages(ctx, userID, isStaff(role), maxUnreadThreads)
+	if err != nil {
+		return nil, fmt.Errorf("service.UnreadMessages: %w", err)
+	}
+	unread := &models.UnreadMessages{Orders: orders}
+	for _, o := range orders {
+		unread.Total += o.Unread
+	}
+	return unread, nil
+}
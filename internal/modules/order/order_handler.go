@@ -1,10 +1,14 @@
 package order
 
 import (
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/utils"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
@@ -17,26 +21,30 @@ type Handler struct {
 }
 
 // NewHandler creates a new order handler.
+// Handlers return errors instead of writing error JSON themselves;
+// middleware.HTTPErrorHandler maps them to status codes and error codes.
 func NewHandler(svc ServiceInterface) *Handler {
 	return &Handler{
 		svc:      svc,
-		validate: validator.New(),
+		validate: utils.NewValidator(),
 	}
 }
 
 func (h *Handler) GetDeliveryQuote(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
 	var req models.RouteRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body"})
+		return models.NewBindError(err)
 	}
 
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
-	options, err := h.svc.GetDeliveryQuote(c.Request().Context(), req)
+	options, err := h.svc.GetDeliveryQuote(c.Request().Context(), userID, req)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to get delivery quotes"})
+		return fmt.Errorf("Handler.GetDeliveryQuote: %w", err)
 	}
 
 	return c.JSON(http.StatusOK, options)
@@ -47,165 +55,865 @@ func (h *Handler) CreateOrder(c echo.Context) error {
 
 	var req models.CreateOrderRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body"})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
+	}
+	key, err := idempotencyKey(c)
+	if err != nil {
+		return err
 	}
+	req.IdempotencyKey = key
 
 	order, err := h.svc.CreateOrder(c.Request().Context(), userID, req)
 	if err != nil {
-		// Handle specific service errors
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "Route option not found"})
-		}
-		c.Logger().Error("Handler.CreateOrder: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to create order"})
+		return fmt.Errorf("Handler.CreateOrder: %w", err)
 	}
 
 	return c.JSON(http.StatusCreated, order)
 }
 
+// HeaderIdempotencyKey makes a POST safe to retry: a repeated request with
+// the same key returns the first request's result.
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// idempotencyKey reads the optional Idempotency-Key header.
+func idempotencyKey(c echo.Context) (string, error) {
+	key := c.Request().Header.Get(HeaderIdempotencyKey)
+	if len(key) > models.MaxIdempotencyKeyLength {
+		return "", models.ValidationFailed(models.FieldError{
+			Field:   HeaderIdempotencyKey,
+			Rule:    "max",
+			Param:   strconv.Itoa(models.MaxIdempotencyKeyLength),
+			Message: HeaderIdempotencyKey + " must be at most " + strconv.Itoa(models.MaxIdempotencyKeyLength) + " characters",
+		})
+	}
+	return key, nil
+}
+
 func (h *Handler) ListMyOrders(c echo.Context) error {
 	userID := c.Get("userID").(string)
 
-	// Extract pagination parameters
-	page := 1
-	limit := 10
+	q, err := listQuery(c)
+	if err != nil {
+		return err
+	}
+
+	page, err := h.svc.ListUserOrders(c.Request().Context(), userID, q)
+	if err != nil {
+		return fmt.Errorf("Handler.ListMyOrders: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// listQuery reads the pagination parameters of an order listing: page and
+// limit for offset pages, or cursor (a previous response's next_cursor) with
+// limit for keyset pages.
+func listQuery(c echo.Context) (models.OrderListQuery, error) {
+	q := models.OrderListQuery{Page: 1, Limit: 10}
 	if pageStr := c.QueryParam("page"); pageStr != "" {
 		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
+			q.Page = p
 		}
 	}
 	if limitStr := c.QueryParam("limit"); limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
-			limit = l
+			q.Limit = l
 		}
 	}
-
-	orders, total, err := h.svc.ListUserOrders(c.Request().Context(), userID, page, limit)
-	if err != nil {
-		c.Logger().Error("Handler.ListMyOrders: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to retrieve orders"})
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		after, err := models.DecodeOrderCursor(cursor)
+		if err != nil {
+			return q, models.NewAPIError(http.StatusBadRequest, models.CodeInvalidRequest, "Invalid cursor")
+		}
+		q.After = after
 	}
-
-	return c.JSON(http.StatusOK, map[string]interface{}{"orders": orders, "total": total})
+	return q, nil
 }
 
 func (h *Handler) GetOrderDetails(c echo.Context) error {
 	userID := c.Get("userID").(string)
-	role := c.Get("userRole").(string)
+	role, _ := c.Get("userRole").(string)
 
 	orderID := c.Param("orderId")
 
 	order, err := h.svc.GetOrderDetails(c.Request().Context(), orderID, userID, role)
 	if err != nil {
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "Order not found"})
-		}
-		if err == models.ErrForbidden {
-			return c.JSON(http.StatusForbidden, models.ErrorResponse{Message: "Access denied"})
-		}
-		c.Logger().Error("Handler.GetOrderDetails: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to retrieve order details"})
+		return fmt.Errorf("Handler.GetOrderDetails: %w", err)
 	}
 
 	return c.JSON(http.StatusOK, order)
 }
 
+// MachineGetOrder shows the authenticated machine an order assigned to it,
+// without the delivery PIN.
+func (h *Handler) MachineGetOrder(c echo.Context) error {
+	machineID, _ := c.Get("machineID").(string)
+
+	order, err := h.svc.GetOrderDetails(c.Request().Context(), c.Param("orderId"), machineID, models.RoleMachine)
+	if err != nil {
+		return fmt.Errorf("Handler.MachineGetOrder: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+// GetOrderHistory returns the status changes of an order, oldest first.
+func (h *Handler) GetOrderHistory(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	orderID := c.Param("orderId")
+
+	events, err := h.svc.GetOrderHistory(c.Request().Context(), orderID, userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.GetOrderHistory: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, events)
+}
+
+// ListPayments returns the charges and refunds of an order, failed attempts
+// included, oldest first.
+func (h *Handler) ListPayments(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	payments, err := h.svc.ListPayments(c.Request().Context(), c.Param("orderId"), userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.ListPayments: %w", err)
+	}
+	return c.JSON(http.StatusOK, payments)
+}
+
+// CancelOrder cancels the customer's order, charging the cancellation fee of
+// a paid order and refunding the rest.
 func (h *Handler) CancelOrder(c echo.Context) error {
 	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
 
 	orderID := c.Param("orderId")
 
-	if err := h.svc.CancelOrder(c.Request().Context(), orderID, userID); err != nil {
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "Order not found"})
-		}
-		if err == models.ErrForbidden {
-			return c.JSON(http.StatusForbidden, models.ErrorResponse{Message: "Cannot cancel this order"})
-		}
-		c.Logger().Error("Handler.CancelOrder: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to cancel order"})
+	result, err := h.svc.CancelOrder(c.Request().Context(), orderID, userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.CancelOrder: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// CancellationQuote shows the fee and refund of cancelling the order now.
+func (h *Handler) CancellationQuote(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	quote, err := h.svc.CancellationQuote(c.Request().Context(), c.Param("orderId"), userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.CancellationQuote: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, quote)
+}
+
+// AdminCancelOrder cancels an order as an operator with a reason and
+// refunds it if it was paid (admin only).
+func (h *Handler) AdminCancelOrder(c echo.Context) error {
+	adminID := c.Get("userID").(string)
+
+	var req models.AdminCancelRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	result, err := h.svc.AdminCancelOrder(c.Request().Context(), c.Param("orderId"), adminID, req)
+	if err != nil {
+		return fmt.Errorf("Handler.AdminCancelOrder: %w", err)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func (h *Handler) ConfirmDelivery(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	orderID := c.Param("orderId")
+
+	var req models.HandoffRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	if err := h.svc.ConfirmDelivery(c.Request().Context(), orderID, userID, role, req); err != nil {
+		return fmt.Errorf("Handler.ConfirmDelivery: %w", err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// MachineHandoff completes the delivery of an order carried by the
+// authenticated machine with the PIN the recipient gave it.
+func (h *Handler) MachineHandoff(c echo.Context) error {
+	machineID, _ := c.Get("machineID").(string)
+
+	var req models.HandoffRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	if err := h.svc.MachineHandoff(c.Request().Context(), c.Param("orderId"), machineID, req); err != nil {
+		return fmt.Errorf("Handler.MachineHandoff: %w", err)
 	}
 
 	return c.NoContent(http.StatusNoContent)
 }
 
+// GetReceipt downloads the PDF receipt of a paid order.
+func (h *Handler) GetReceipt(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	orderID := c.Param("orderId")
+	receipt, err := h.svc.ReceiptPDF(c.Request().Context(), orderID, userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.GetReceipt: %w", err)
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="receipt-`+orderID+`.pdf"`)
+	return c.Blob(http.StatusOK, "application/pdf", receipt)
+}
+
+// GetReturnQuote quotes a return of a delivered order and whether it is free.
+func (h *Handler) GetReturnQuote(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	quote, err := h.svc.GetReturnQuote(c.Request().Context(), c.Param("orderId"), userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.GetReturnQuote: %w", err)
+	}
+	return c.JSON(http.StatusOK, quote)
+}
+
+// CreateReturn creates a return of a delivered order from its quote and
+// returns the new reverse order.
+func (h *Handler) CreateReturn(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	var req models.CreateReturnRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	ret, err := h.svc.CreateReturn(c.Request().Context(), c.Param("orderId"), userID, role, req)
+	if err != nil {
+		return fmt.Errorf("Handler.CreateReturn: %w", err)
+	}
+	return c.JSON(http.StatusCreated, ret)
+}
+
+// Reorder creates a new order like a past one, priced with a fresh quote,
+// and returns it awaiting payment. The body is optional.
+func (h *Handler) Reorder(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	var req models.ReorderRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	key, err := idempotencyKey(c)
+	if err != nil {
+		return err
+	}
+	req.IdempotencyKey = key
+
+	order, err := h.svc.Reorder(c.Request().Context(), c.Param("orderId"), userID, role, req)
+	if err != nil {
+		return fmt.Errorf("Handler.Reorder: %w", err)
+	}
+	return c.JSON(http.StatusCreated, order)
+}
+
 func (h *Handler) ConfirmAndPay(c echo.Context) error {
 	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
 
 	orderID := c.Param("orderId")
 
 	var req models.PaymentRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body"})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
+	key, err := idempotencyKey(c)
+	if err != nil {
+		return err
+	}
+	req.IdempotencyKey = key
 
-	order, err := h.svc.ConfirmAndPay(c.Request().Context(), userID, orderID, req)
+	order, err := h.svc.ConfirmAndPay(c.Request().Context(), userID, orderID, role, req)
 	if err != nil {
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "Order not found"})
-		}
-		if err == models.ErrForbidden {
-			return c.JSON(http.StatusForbidden, models.ErrorResponse{Message: "Cannot pay for this order"})
-		}
-		c.Logger().Error("Handler.ConfirmAndPay: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to process payment"})
+		return fmt.Errorf("Handler.ConfirmAndPay: %w", err)
 	}
 
 	return c.JSON(http.StatusOK, order)
 }
 
+// RetryPayment pays for an order whose payment failed, e.g. with another card.
+func (h *Handler) RetryPayment(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	orderID := c.Param("orderId")
+
+	var req models.PaymentRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	key, err := idempotencyKey(c)
+	if err != nil {
+		return err
+	}
+	req.IdempotencyKey = key
+
+	order, err := h.svc.RetryPayment(c.Request().Context(), userID, orderID, role, req)
+	if err != nil {
+		return fmt.Errorf("Handler.RetryPayment: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+// ConfirmPayment completes a payment after the customer authenticated it
+// with the payment_action returned when paying or tipping.
+func (h *Handler) ConfirmPayment(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	order, err := h.svc.ConfirmPayment(c.Request().Context(), c.Param("orderId"), userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.ConfirmPayment: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+// AddTip tips a delivered order, charged to a new or saved card.
+func (h *Handler) AddTip(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	var req models.TipRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+	key, err := idempotencyKey(c)
+	if err != nil {
+		return err
+	}
+	req.IdempotencyKey = key
+
+	order, err := h.svc.AddTip(c.Request().Context(), c.Param("orderId"), userID, role, req)
+	if err != nil {
+		return fmt.Errorf("Handler.AddTip: %w", err)
+	}
+	return c.JSON(http.StatusOK, order)
+}
+
 func (h *Handler) SubmitFeedback(c echo.Context) error {
 	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
 
 	orderID := c.Param("orderId")
 
 	var req models.FeedbackRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body"})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
-	if err := h.svc.SubmitFeedback(c.Request().Context(), userID, orderID, req); err != nil {
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "Order not found"})
-		}
-		if err == models.ErrForbidden {
-			return c.JSON(http.StatusForbidden, models.ErrorResponse{Message: "Cannot submit feedback for this order"})
+	fb, err := h.svc.SubmitFeedback(c.Request().Context(), userID, orderID, role, req)
+	if err != nil {
+		return fmt.Errorf("Handler.SubmitFeedback: %w", err)
+	}
+
+	return c.JSON(http.StatusCreated, fb)
+}
+
+// ListFeedback returns one page of all feedback, newest first, optionally
+// only that of ?machine_id= or with ?rating=. Admin only.
+func (h *Handler) ListFeedback(c echo.Context) error {
+	q := models.FeedbackQuery{Page: 1, Limit: 50, MachineID: c.QueryParam("machine_id")}
+	if p, err := strconv.Atoi(c.QueryParam("page")); err == nil && p > 0 {
+		q.Page = p
+	}
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 100 {
+		q.Limit = l
+	}
+	if raw := c.QueryParam("rating"); raw != "" {
+		rating, err := strconv.Atoi(raw)
+		if err != nil || rating < 1 || rating > 5 {
+			return models.ValidationFailed(models.FieldError{
+				Field:   "rating",
+				Rule:    "oneof",
+				Param:   "1 2 3 4 5",
+				Message: "rating must be between 1 and 5",
+			})
 		}
-		c.Logger().Error("Handler.SubmitFeedback: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to submit feedback"})
+		q.Rating = rating
+	}
+
+	page, err := h.svc.ListFeedback(c.Request().Context(), q)
+	if err != nil {
+		return fmt.Errorf("Handler.ListFeedback: %w", err)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// MachineRatings returns the average rating of every rated machine, lowest
+// first. Admin only.
+func (h *Handler) MachineRatings(c echo.Context) error {
+	ratings, err := h.svc.MachineRatings(c.Request().Context())
+	if err != nil {
+		return fmt.Errorf("Handler.MachineRatings: %w", err)
+	}
+	return c.JSON(http.StatusOK, ratings)
+}
+
+// CreatePromoCode creates a promo code (admin only).
+func (h *Handler) CreatePromoCode(c echo.Context) error {
+	adminID := c.Get("userID").(string)
+
+	var req models.CreatePromoCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	promo, err := h.svc.CreatePromoCode(c.Request().Context(), adminID, req)
+	if err != nil {
+		return fmt.Errorf("Handler.CreatePromoCode: %w", err)
+	}
+	return c.JSON(http.StatusCreated, promo)
+}
+
+// ListPromoCodes returns one page of promo codes, newest first. Admin only.
+func (h *Handler) ListPromoCodes(c echo.Context) error {
+	q := models.PromoCodeQuery{Page: 1, Limit: 50}
+	if p, err := strconv.Atoi(c.QueryParam("page")); err == nil && p > 0 {
+		q.Page = p
+	}
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 100 {
+		q.Limit = l
+	}
+
+	page, err := h.svc.ListPromoCodes(c.Request().Context(), q)
+	if err != nil {
+		return fmt.Errorf("Handler.ListPromoCodes: %w", err)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// DisablePromoCode stops a promo code from being redeemed and returns it.
+// Admin only.
+func (h *Handler) DisablePromoCode(c echo.Context) error {
+	promo, err := h.svc.DisablePromoCode(c.Request().Context(), c.Param("promoCodeId"))
+	if err != nil {
+		return fmt.Errorf("Handler.DisablePromoCode: %w", err)
+	}
+	return c.JSON(http.StatusOK, promo)
+}
+
+// ListOrderMessages returns an order's message thread, oldest first, and
+// marks it read for the caller.
+func (h *Handler) ListOrderMessages(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	messages, err := h.svc.ListOrderMessages(c.Request().Context(), c.Param("orderId"), userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.ListOrderMessages: %w", err)
+	}
+	return c.JSON(http.StatusOK, messages)
+}
+
+// PostOrderMessage adds a message to an order's thread.
+func (h *Handler) PostOrderMessage(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	var req models.OrderMessageRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	msg, err := h.svc.PostOrderMessage(c.Request().Context(), c.Param("orderId"), userID, role, req)
+	if err != nil {
+		return fmt.Errorf("Handler.PostOrderMessage: %w", err)
+	}
+	return c.JSON(http.StatusCreated, msg)
+}
+
+// HideOrderMessage hides a message from the order's customer. Admin only.
+func (h *Handler) HideOrderMessage(c echo.Context) error {
+	adminID := c.Get("userID").(string)
+
+	if err := h.svc.HideOrderMessage(c.Request().Context(), c.Param("orderId"), c.Param("messageId"), adminID); err != nil {
+		return fmt.Errorf("Handler.HideOrderMessage: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// UnreadMessages returns the caller's unread message counts per order.
+func (h *Handler) UnreadMessages(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	unread, err := h.svc.UnreadMessages(c.Request().Context(), userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.UnreadMessages: %w", err)
+	}
+	return c.JSON(http.StatusOK, unread)
+}
+
+// FileClaim files a claim for a lost or damaged package on the caller's order.
+func (h *Handler) FileClaim(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	var req models.CreateClaimRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	claim, err := h.svc.FileClaim(c.Request().Context(), c.Param("orderId"), userID, role, req)
+	if err != nil {
+		return fmt.Errorf("Handler.FileClaim: %w", err)
+	}
+	return c.JSON(http.StatusCreated, claim)
+}
+
+// GetClaim returns the claim on an order with links to its photos.
+func (h *Handler) GetClaim(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	claim, err := h.svc.GetClaim(c.Request().Context(), c.Param("orderId"), userID, role)
+	if err != nil {
+		return fmt.Errorf("Handler.GetClaim: %w", err)
+	}
+	return c.JSON(http.StatusOK, claim)
+}
+
+// AddClaimPhoto uploads a photo to the open claim on the caller's order, as
+// the "photo" file of a multipart form.
+func (h *Handler) AddClaimPhoto(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	role, _ := c.Get("userRole").(string)
+
+	file, err := c.FormFile("photo")
+	if err != nil {
+		return models.ValidationFailed(models.FieldError{
+			Field:   "photo",
+			Rule:    "required",
+			Message: "photo must be uploaded as a multipart file",
+		})
+	}
+	f, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("Handler.AddClaimPhoto: %w", err)
+	}
+	defer f.Close()
+
+	photo, err := h.svc.AddClaimPhoto(c.Request().Context(), c.Param("orderId"), userID, role, f, file.Size, file.Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return fmt.Errorf("Handler.AddClaimPhoto: %w", err)
+	}
+	return c.JSON(http.StatusCreated, photo)
+}
+
+// ListClaims returns one page of claims, oldest first, optionally filtered
+// by ?status=. Admin only.
+func (h *Handler) ListClaims(c echo.Context) error {
+	q := models.ClaimQuery{Page: 1, Limit: 50}
+	if p, err := strconv.Atoi(c.QueryParam("page")); err == nil && p > 0 {
+		q.Page = p
+	}
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 100 {
+		q.Limit = l
+	}
+	switch s := models.ClaimStatus(c.QueryParam("status")); s {
+	case "":
+	case models.ClaimStatusOpen, models.ClaimStatusApproved, models.ClaimStatusRejected:
+		q.Status = &s
+	default:
+		return models.ValidationFailed(models.FieldError{
+			Field:   "status",
+			Rule:    "oneof",
+			Param:   "OPEN APPROVED REJECTED",
+			Message: "status must be OPEN, APPROVED or REJECTED",
+		})
+	}
+
+	page, err := h.svc.ListClaims(c.Request().Context(), q)
+	if err != nil {
+		return fmt.Errorf("Handler.ListClaims: %w", err)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// DecideClaim approves or rejects an open claim. Admin only.
+func (h *Handler) DecideClaim(c echo.Context) error {
+	adminID := c.Get("userID").(string)
+
+	var req models.ClaimDecisionRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
 	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	claim, err := h.svc.DecideClaim(c.Request().Context(), c.Param("claimId"), adminID, req)
+	if err != nil {
+		return fmt.Errorf("Handler.DecideClaim: %w", err)
+	}
+	return c.JSON(http.StatusOK, claim)
+}
+
+// GetWallet returns the caller's credit balance and latest credits.
+func (h *Handler) GetWallet(c echo.Context) error {
+	userID := c.Get("userID").(string)
 
-	return c.NoContent(http.StatusAccepted)
+	wallet, err := h.svc.Wallet(c.Request().Context(), userID)
+	if err != nil {
+		return fmt.Errorf("Handler.GetWallet: %w", err)
+	}
+	return c.JSON(http.StatusOK, wallet)
 }
 
 func (h *Handler) ListAllOrders(c echo.Context) error {
 	// Role check is done in middleware
-	page := 1
-	limit := 10
-	if pageStr := c.QueryParam("page"); pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
+	q, err := listQuery(c)
+	if err != nil {
+		return err
+	}
+
+	page, err := h.svc.ListAllOrders(c.Request().Context(), q)
+	if err != nil {
+		return fmt.Errorf("Handler.ListAllOrders: %w", err)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// ExportOrders streams the orders created between ?from= and ?to= (RFC3339;
+// the last 30 days by default, at most 366) as a CSV attachment for
+// accounting, optionally only those with ?status=. Admin only.
+func (h *Handler) ExportOrders(c echo.Context) error {
+	q, err := exportQuery(c)
+	if err != nil {
+		return err
+	}
+
+	// A large export can outlast the server's write timeout; the request
+	// context still ends when the client goes away.
+	_ = http.NewResponseController(c.Response()).SetWriteDeadline(time.Time{})
+
+	filename := fmt.Sprintf("orders-%s-%s.csv", q.From.UTC().Format(time.DateOnly), q.To.UTC().Format(time.DateOnly))
+	w := &csvAttachment{res: c.Response(), filename: filename}
+	if err := h.svc.ExportOrders(c.Request().Context(), q, w); err != nil {
+		if c.Response().Committed {
+			// Too late for an error response; the client gets a truncated file.
+			log.Printf("Handler.ExportOrders: export aborted after %d bytes: %v", c.Response().Size, err)
 		}
+		return fmt.Errorf("Handler.ExportOrders: %w", err)
 	}
-	if limitStr := c.QueryParam("limit"); limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
-			limit = l
+	return nil
+}
+
+// exportQuery reads the time range and status filter of an order export.
+func exportQuery(c echo.Context) (models.OrderExportQuery, error) {
+	q := models.OrderExportQuery{To: time.Now()}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		raw := c.QueryParam(p.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return q, models.ValidationFailed(models.FieldError{
+				Field:   p.name,
+				Rule:    "datetime",
+				Param:   time.RFC3339,
+				Message: p.name + " must be an RFC3339 timestamp",
+			})
 		}
+		*p.dst = t
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-models.DefaultReportRange)
+	}
+	if !q.From.Before(q.To) {
+		return q, models.ValidationFailed(models.FieldError{
+			Field:   "from",
+			Rule:    "ltfield",
+			Param:   "to",
+			Message: "from must be before to",
+		})
 	}
+	if q.To.Sub(q.From) > models.MaxReportRange {
+		return q, models.ValidationFailed(models.FieldError{
+			Field:   "from",
+			Rule:    "max",
+			Param:   models.MaxReportRange.String(),
+			Message: "exports cover at most 366 days",
+		})
+	}
+	if raw := c.QueryParam("status"); raw != "" {
+		status := models.OrderStatus(raw)
+		if !status.Valid() {
+			return q, models.ValidationFailed(models.FieldError{
+				Field:   "status",
+				Rule:    "oneof",
+				Message: "status must be an order status",
+			})
+		}
+		q.Status = &status
+	}
+	return q, nil
+}
+
+// csvAttachment sends the CSV attachment headers with the first write, so an
+// export that fails before producing any output still gets an error response.
+type csvAttachment struct {
+	res      *echo.Response
+	filename string
+}
+
+func (a *csvAttachment) Write(p []byte) (int, error) {
+	if !a.res.Committed {
+		a.res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+		a.res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+a.filename+`"`)
+		a.res.WriteHeader(http.StatusOK)
+	}
+	return a.res.Write(p)
+}
+
+// CreateWebhook registers a URL that receives the user's order status
+// changes. The response includes the signing secret, which is not shown again.
+func (h *Handler) CreateWebhook(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	var req models.CreateWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	ep, err := h.svc.CreateWebhook(c.Request().Context(), userID, req)
+	if err != nil {
+		return fmt.Errorf("Handler.CreateWebhook: %w", err)
+	}
+	return c.JSON(http.StatusCreated, ep)
+}
+
+func (h *Handler) ListWebhooks(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	endpoints, err := h.svc.ListWebhooks(c.Request().Context(), userID)
+	if err != nil {
+		return fmt.Errorf("Handler.ListWebhooks: %w", err)
+	}
+	return c.JSON(http.StatusOK, endpoints)
+}
+
+func (h *Handler) DeleteWebhook(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	if err := h.svc.DeleteWebhook(c.Request().Context(), userID, c.Param("webhookId")); err != nil {
+		return fmt.Errorf("Handler.DeleteWebhook: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListWebhookDeliveries returns the delivery log of a webhook, newest first:
+// ?limit= (default 50, at most 100) and optionally ?status=PENDING,
+// SUCCEEDED or FAILED.
+func (h *Handler) ListWebhookDeliveries(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	limit := 50
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+	var status *models.WebhookDeliveryStatus
+	switch s := models.WebhookDeliveryStatus(c.QueryParam("status")); s {
+	case "":
+	case models.WebhookPending, models.WebhookSucceeded, models.WebhookFailed:
+		status = &s
+	default:
+		return models.ValidationFailed(models.FieldError{
+			Field:   "status",
+			Rule:    "oneof",
+			Param:   "PENDING SUCCEEDED FAILED",
+			Message: "status must be PENDING, SUCCEEDED or FAILED",
+		})
+	}
+
+	deliveries, err := h.svc.ListWebhookDeliveries(c.Request().Context(), userID, c.Param("webhookId"), status, limit)
+	if err != nil {
+		return fmt.Errorf("Handler.ListWebhookDeliveries: %w", err)
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+// GetWebhookDelivery returns one delivery with every attempt made for it.
+func (h *Handler) GetWebhookDelivery(c echo.Context) error {
+	userID := c.Get("userID").(string)
 
-	orders, total, err := h.svc.ListAllOrders(c.Request().Context(), page, limit)
+	d, err := h.svc.GetWebhookDelivery(c.Request().Context(), userID, c.Param("webhookId"), c.Param("deliveryId"))
 	if err != nil {
-		c.Logger().Error("Handler.ListAllOrders: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to list all orders"})
+		return fmt.Errorf("Handler.GetWebhookDelivery: %w", err)
 	}
-	return c.JSON(http.StatusOK, map[string]interface{}{"orders": orders, "total": total})
+	return c.JSON(http.StatusOK, d)
 }
@@ -3,49 +3,173 @@ package order
 import (
 	"context"
 	"database/sql"
+	"dispatch-and-delivery/internal/database"
 	"dispatch-and-delivery/internal/models"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
-	"github.com/jackc/pgconn" // 新增
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // RepositoryInterface defines the contract for the order repository.
 type RepositoryInterface interface {
-	Create(ctx context.Context, userID string, req models.CreateOrderRequest, pickupAddressID, dropoffAddressID string) (*models.Order, error)
+	Create(ctx context.Context, userID string, req models.CreateOrderRequest, option *models.RouteOption, pickupAddressID, dropoffAddressID string) (*models.Order, error)
+	CreateReturn(ctx context.Context, ret *models.Order, reason string) (*models.Order, error)
+	SaveRouteQuotes(ctx context.Context, userID string, options []models.RouteOption, expiresAt time.Time) error
+	TakeRouteQuote(ctx context.Context, userID, optionID string) (*models.RouteOption, error)
+	DeleteExpiredRouteQuotes(ctx context.Context, before time.Time) (int64, error)
+	HasReturn(ctx context.Context, orderID string) (bool, error)
 	FindByID(ctx context.Context, orderID string) (*models.Order, error)
 	ListByUserID(ctx context.Context, userID string, page, limit int) ([]*models.Order, int, error)
 	ListAll(ctx context.Context, page, limit int) ([]*models.Order, int, error)
-	UpdateStatusForUser(ctx context.Context, orderID string, userID string, status string) error
+	ListByUserIDAfter(ctx context.Context, userID string, after *models.OrderCursor, limit int) ([]*models.Order, error)
+	ListAllAfter(ctx context.Context, after *models.OrderCursor, limit int) ([]*models.Order, error)
+	ExportOrders(ctx context.Context, q models.OrderExportQuery, fn func(row *models.OrderExportRow) error) error
+	UpdateStatusForUser(ctx context.Context, orderID string, userID string, from, to models.OrderStatus) error
+	InsertStatusEvent(ctx context.Context, ev *models.OrderStatusEvent) error
+	SetPaymentID(ctx context.Context, orderID, paymentID string) error
+	SetRefundID(ctx context.Context, orderID, refundID string) error
+	SetCancellationFee(ctx context.Context, orderID string, fee float64) error
+	SetPrice(ctx context.Context, orderID string, cost float64, breakdown *models.CostBreakdown) error
+	SetTip(ctx context.Context, orderID string, tip float64, breakdown *models.CostBreakdown) error
+	SetPaymentFailure(ctx context.Context, orderID string, reason *string) error
+	FindSavedPaymentMethod(ctx context.Context, userID, paymentMethodID string) (customerID, providerID string, err error)
+	GetPaymentRefs(ctx context.Context, orderID string) (paymentID, refundID string, err error)
+	ListStatusEvents(ctx context.Context, orderID string) ([]*models.OrderStatusEvent, error)
+	InsertPayment(ctx context.Context, p *models.Payment) error
+	ListPayments(ctx context.Context, orderID string) ([]*models.Payment, error)
+	SettlePayments(ctx context.Context, orderID, providerRef string, status models.PaymentStatus, reason *string) (bool, error)
 	InsertAddress(ctx context.Context, addr *models.Address) (string, error)
-	InsertFeedback(ctx context.Context, orderID string, req models.FeedbackRequest) error // 新增
+	CheckDeliveryPIN(ctx context.Context, orderID, pin string) (bool, error)
+	InsertFeedback(ctx context.Context, orderID string, req models.FeedbackRequest) (*models.Feedback, error)
+	ListFeedback(ctx context.Context, q models.FeedbackQuery) ([]*models.Feedback, int, error)
+	MachineRatings(ctx context.Context) ([]models.MachineRating, error)
+	InsertOutboxEvent(ctx context.Context, aggregateID, eventType string, payload any) error
+	ListDueScheduled(ctx context.Context, due time.Time, limit int) ([]*models.Order, error)
+	ListUnpaid(ctx context.Context, createdBefore time.Time, limit int) ([]*models.Order, error)
+	ListAwaitingPaymentAction(ctx context.Context, limit int) ([]*models.Order, error)
+	CancelUnpaid(ctx context.Context, orderID string) (bool, error)
+	InsertNotification(ctx context.Context, userID, message string) error
+	InsertOrderMessage(ctx context.Context, msg *models.OrderMessage) error
+	ListOrderMessages(ctx context.Context, orderID string, includeHidden bool) ([]*models.OrderMessage, error)
+	HideOrderMessage(ctx context.Context, orderID, messageID, adminID string) error
+	MarkOrderMessagesRead(ctx context.Context, orderID, userID string, at time.Time) error
+	ListUnreadOrderMessages(ctx context.Context, userID string, staff bool, limit int) ([]models.UnreadOrderMessages, error)
+	InsertClaim(ctx context.Context, claim *models.Claim) error
+	FindClaim(ctx context.Context, claimID string) (*models.Claim, error)
+	FindClaimByOrder(ctx context.Context, orderID string) (*models.Claim, error)
+	ListClaims(ctx context.Context, q models.ClaimQuery) ([]*models.Claim, int, error)
+	DecideClaim(ctx context.Context, claim *models.Claim) error
+	InsertClaimPhoto(ctx context.Context, claimID string, photo *models.ClaimPhoto) error
+	ListClaimPhotos(ctx context.Context, claimID string) ([]models.ClaimPhoto, error)
+	InsertWalletCredit(ctx context.Context, userID string, credit *models.WalletCredit) error
+	GetWallet(ctx context.Context, userID string, limit int) (*models.Wallet, error)
+	InsertPromoCode(ctx context.Context, p *models.PromoCode) error
+	FindPromoCode(ctx context.Context, code string) (*models.PromoCode, error)
+	ListPromoCodes(ctx context.Context, q models.PromoCodeQuery) ([]*models.PromoCode, int, error)
+	DisablePromoCode(ctx context.Context, promoCodeID string) (*models.PromoCode, error)
+	FindPromoRedemption(ctx context.Context, orderID string) (*models.PromoRedemption, error)
+	RedeemPromoCode(ctx context.Context, pr *models.PromoRedemption) error
+	ReleasePromoRedemption(ctx context.Context, orderID string) error
+	EnqueueAssignment(ctx context.Context, orderID, reason string) error
+	ListDueAssignments(ctx context.Context, limit int) ([]models.PendingAssignment, error)
+	RescheduleAssignment(ctx context.Context, orderID string, delay time.Duration, reason string) error
+	LockAssignment(ctx context.Context, orderID string) (bool, error)
+	DeleteAssignment(ctx context.Context, orderID string) error
+	ClaimIdempotencyKey(ctx context.Context, k *models.IdempotencyKey, lease time.Duration) (*models.IdempotencyKey, error)
+	CompleteIdempotencyKey(ctx context.Context, k *models.IdempotencyKey, orderID string) error
+	ReleaseIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error)
+	CreateWebhookEndpoint(ctx context.Context, ep *models.WebhookEndpoint) error
+	ListWebhookEndpoints(ctx context.Context, userID string) ([]*models.WebhookEndpoint, error)
+	FindWebhookEndpoint(ctx context.Context, endpointID string) (*models.WebhookEndpoint, error)
+	DeleteWebhookEndpoint(ctx context.Context, endpointID, userID string) error
+	CreateWebhookDeliveries(ctx context.Context, since time.Time) (int64, error)
+	ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.PendingWebhook, error)
+	RecordWebhookAttempt(ctx context.Context, deliveryID string, attempt models.WebhookAttempt, status models.WebhookDeliveryStatus, next *time.Time) error
+	ListWebhookDeliveries(ctx context.Context, endpointID string, status *models.WebhookDeliveryStatus, limit int) ([]*models.WebhookDelivery, error)
+	FindWebhookDelivery(ctx context.Context, endpointID, deliveryID string) (*models.WebhookDelivery, error)
+	DeleteOldWebhookDeliveries(ctx context.Context, before time.Time) (int64, error)
 }
 
 // Repository implements the RepositoryInterface.
 type Repository struct {
-	db *pgxpool.Pool
+	db *pgxpool.Pool // primary: all writes and read-your-own-writes lookups
+	// replica serves the heavy listings: admin pages, exports and webhook
+	// delivery history. They tolerate replication lag, so reading them from
+	// the replica keeps that load off the primary; anything a request reads
+	// back after writing it goes to db.
+	replica *pgxpool.Pool
 }
 
-// NewRepository creates a new order repository.
-func NewRepository(db *pgxpool.Pool) RepositoryInterface {
-	return &Repository{db: db}
+// NewRepository creates a new order repository. replica may be the same pool
+// as db (or nil) when no read replica is configured.
+func NewRepository(db, replica *pgxpool.Pool) RepositoryInterface {
+	if replica == nil {
+		replica = db
+	}
+	return &Repository{db: db, replica: replica}
+}
+
+// conn returns the unit-of-work transaction carried by ctx, or the primary pool.
+func (r *Repository) conn(ctx context.Context) database.Executor {
+	return database.Conn(ctx, r.db)
+}
+
+// pageTotal returns the total of a page listed with COUNT(*) OVER(), which
+// every row of the page carries. A page past the end has no rows to carry
+// it; only then is countQuery run on db.
+func pageTotal(ctx context.Context, db database.Executor, rows, offset, total int, countQuery string, args ...any) (int, error) {
+	if rows > 0 || offset == 0 {
+		return total, nil
+	}
+	err := db.QueryRow(ctx, countQuery, args...).Scan(&total)
+	return total, err
 }
 
-// Create inserts a new order into the database.
-func (r *Repository) Create(ctx context.Context, userID string, req models.CreateOrderRequest, pickupAddressID, dropoffAddressID string) (*models.Order, error) {
+// Create inserts a new order created from option into the database, together
+// with the first entry of its status history. The order costs the option's
+// price, keeps its cost breakdown and takes its priority.
+func (r *Repository) Create(ctx context.Context, userID string, req models.CreateOrderRequest, option *models.RouteOption, pickupAddressID, dropoffAddressID string) (*models.Order, error) {
 	query := `
-		INSERT INTO orders (user_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost)
-		VALUES ($1, $2, $3, 'PENDING_PAYMENT', $4, $5, $6, $7, $8)
-		RETURNING id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at`
+		WITH o AS (
+			INSERT INTO orders (user_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, priority, cost_breakdown, delivery_pin, insured_value)
+			VALUES ($1, $2, $3, 'PENDING_PAYMENT', $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+			RETURNING id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason
+		), ev AS (
+			INSERT INTO order_status_events (order_id, to_status, actor_type, actor_id, reason, created_at)
+			SELECT id, status, 'USER', user_id, 'order created', created_at FROM o
+		)
+		SELECT * FROM o`
 
-	// For now, using default values for weight and cost
-	// In a real implementation, these would come from the route option
+	// For now, using a default weight; route options do not carry it.
 	const defaultWeight = 1.0
-	const defaultCost = 15.75
 
-	row := r.db.QueryRow(ctx, query, userID, pickupAddressID, dropoffAddressID, req.Dimensions.Length, req.Dimensions.Width, req.Dimensions.Height, defaultWeight, defaultCost)
+	// Quotes stored before priorities existed have none.
+	priority := option.Priority
+	if priority == "" {
+		priority = models.PriorityStandard
+	}
+	// Nor do those stored before they were itemized.
+	var breakdown *models.CostBreakdown
+	if option.CostBreakdown != (models.CostBreakdown{}) {
+		breakdown = &option.CostBreakdown
+	}
+
+	var windowStart, windowEnd *time.Time
+	if w := req.DeliveryWindow; w != nil {
+		windowStart, windowEnd = &w.Start, &w.End
+	}
+	var insuredValue *float64
+	if option.InsuredValue > 0 {
+		insuredValue = &option.InsuredValue
+	}
+
+	row := r.conn(ctx).QueryRow(ctx, query, userID, pickupAddressID, dropoffAddressID, req.Dimensions.Length, req.Dimensions.Width, req.Dimensions.Height, defaultWeight, option.EstimatedCost, req.ScheduledPickupTime, windowStart, windowEnd, req.RecipientName, req.RecipientPhone, req.DeliveryInstructions, priority, breakdown, req.DeliveryPIN, insuredValue)
 	order, err := r.scanOrder(row)
 	if err != nil {
 		return nil, fmt.Errorf("repository.CreateOrder: %w", err)
@@ -53,11 +177,107 @@ func (r *Repository) Create(ctx context.Context, userID string, req models.Creat
 	return order, nil
 }
 
+// CreateReturn inserts ret, a return of the order ret.ReturnOfOrderID, in
+// ret.Status and records its creation with reason. It fails with
+// ErrReturnAlreadyExists when that order already has a live return.
+func (r *Repository) CreateReturn(ctx context.Context, ret *models.Order, reason string) (*models.Order, error) {
+	query := `
+		WITH o AS (
+			INSERT INTO orders (user_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, cost_breakdown, return_of_order_id, delivery_pin)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			RETURNING id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason
+		), ev AS (
+			INSERT INTO order_status_events (order_id, to_status, actor_type, actor_id, reason, created_at)
+			SELECT id, status, 'USER', user_id, $13, created_at FROM o
+		)
+		SELECT * FROM o`
+	row := r.conn(ctx).QueryRow(ctx, query, ret.UserID, ret.PickupAddressID, ret.DropoffAddressID, ret.Status,
+		ret.Dimensions.Length, ret.Dimensions.Width, ret.Dimensions.Height, ret.ItemWeightKg, ret.Cost, ret.CostBreakdown, ret.ReturnOfOrderID, ret.DeliveryPIN, reason)
+	order, err := r.scanOrder(row)
+	if err != nil {
+		// A concurrent request created the live return first.
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_orders_return_of" {
+			return nil, models.ErrReturnAlreadyExists
+		}
+		return nil, fmt.Errorf("repository.CreateReturn: %w", err)
+	}
+	return order, nil
+}
+
+// HasReturn reports whether orderID has a return that is not cancelled.
+func (r *Repository) HasReturn(ctx context.Context, orderID string) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM orders WHERE return_of_order_id = $1 AND status <> 'CANCELLED')`
+	var exists bool
+	if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("repository.HasReturn: %w", err)
+	}
+	return exists, nil
+}
+
+// SaveRouteQuotes stores quoted options of userID until expiresAt.
+func (r *Repository) SaveRouteQuotes(ctx context.Context, userID string, options []models.RouteOption, expiresAt time.Time) error {
+	ids := make([]string, len(options))
+	docs := make([][]byte, len(options))
+	for i := range options {
+		doc, err := json.Marshal(options[i])
+		if err != nil {
+			return fmt.Errorf("repository.SaveRouteQuotes: %w", err)
+		}
+		ids[i], docs[i] = options[i].ID, doc
+	}
+	query := `
+		INSERT INTO route_quotes (id, user_id, option, expires_at)
+		SELECT id, $1, option, $4
+		FROM unnest($2::text[], $3::jsonb[]) AS q(id, option)`
+	if _, err := r.conn(ctx).Exec(ctx, query, userID, ids, docs, expiresAt); err != nil {
+		return fmt.Errorf("repository.SaveRouteQuotes: %w", err)
+	}
+	return nil
+}
+
+// TakeRouteQuote deletes and returns an unexpired option quoted for userID.
+// It returns ErrRouteOptionExpired for an expired one and
+// ErrRouteOptionNotFound when there is none. Take it in the unit of work that
+// uses it, so a rolled back order leaves the quote in place.
+func (r *Repository) TakeRouteQuote(ctx context.Context, userID, optionID string) (*models.RouteOption, error) {
+	query := `
+		DELETE FROM route_quotes
+		WHERE id = $1 AND user_id = $2
+		RETURNING option, expires_at > now()`
+	var doc []byte
+	var fresh bool
+	if err := r.conn(ctx).QueryRow(ctx, query, optionID, userID).Scan(&doc, &fresh); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrRouteOptionNotFound
+		}
+		return nil, fmt.Errorf("repository.TakeRouteQuote: %w", err)
+	}
+	if !fresh {
+		return nil, models.ErrRouteOptionExpired
+	}
+	var option models.RouteOption
+	if err := json.Unmarshal(doc, &option); err != nil {
+		return nil, fmt.Errorf("repository.TakeRouteQuote: %w", err)
+	}
+	return &option, nil
+}
+
+// DeleteExpiredRouteQuotes deletes quotes that expired before before.
+func (r *Repository) DeleteExpiredRouteQuotes(ctx context.Context, before time.Time) (int64, error) {
+	cmd, err := r.conn(ctx).Exec(ctx, `DELETE FROM route_quotes WHERE expires_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("repository.DeleteExpiredRouteQuotes: %w", err)
+	}
+	return cmd.RowsAffected(), nil
+}
+
 // scanOrder is a helper function to scan a row into an Order model.
 func (r *Repository) scanOrder(row pgx.Row) (*models.Order, error) {
 	var order models.Order
 	var machineIDFromDB sql.NullString
 	var lengthCm, widthCm, heightCm float64
+	var windowStart, windowEnd *time.Time
 	err := row.Scan(
 		&order.ID,
 		&order.UserID,
@@ -72,6 +292,20 @@ func (r *Repository) scanOrder(row pgx.Row) (*models.Order, error) {
 		&order.Cost,
 		&order.CreatedAt,
 		&order.UpdatedAt,
+		&order.ScheduledPickupTime,
+		&windowStart,
+		&windowEnd,
+		&order.RecipientName,
+		&order.RecipientPhone,
+		&order.DeliveryInstructions,
+		&order.ReturnOfOrderID,
+		&order.Priority,
+		&order.CostBreakdown,
+		&order.DeliveryPIN,
+		&order.CancellationFee,
+		&order.InsuredValue,
+		&order.Tip,
+		&order.PaymentFailureReason,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -92,102 +326,232 @@ func (r *Repository) scanOrder(row pgx.Row) (*models.Order, error) {
 		Width:  widthCm,
 		Height: heightCm,
 	}
-
-	// Fetch feedback for this order
-	feedback, err := r.getFeedbackByOrderID(context.Background(), order.ID)
-	if err == nil {
-		order.Feedback = feedback
-	}
-	// If feedback not found, just leave as nil
+	order.DeliveryWindow = deliveryWindow(windowStart, windowEnd)
 
 	return &order, nil
 }
 
-// getFeedbackByOrderID fetches feedback for a given order ID
-func (r *Repository) getFeedbackByOrderID(ctx context.Context, orderID string) (*models.Feedback, error) {
-	query := `SELECT id, order_id, rating, comment, created_at, updated_at FROM feedback WHERE order_id = $1`
-	row := r.db.QueryRow(ctx, query, orderID)
-	var fb models.Feedback
-	if err := row.Scan(&fb.ID, &fb.OrderID, &fb.Rating, &fb.Comment, &fb.CreatedAt, &fb.UpdatedAt); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, nil // No feedback for this order
+// deliveryWindow builds an order's delivery window from its nullable columns.
+func deliveryWindow(start, end *time.Time) *models.DeliveryWindow {
+	if start == nil || end == nil {
+		return nil
+	}
+	return &models.DeliveryWindow{Start: *start, End: *end}
+}
+
+// attachFeedback loads the feedback of all orders with a single query.
+// Orders without feedback keep a nil Feedback.
+func (r *Repository) attachFeedback(ctx context.Context, q database.Executor, orders []*models.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	ids := make([]string, len(orders))
+	for i, o := range orders {
+		ids[i] = o.ID
+	}
+
+	query := `SELECT id, order_id, machine_id, rating, comment, created_at, updated_at FROM feedback WHERE order_id = ANY($1)`
+	rows, err := q.Query(ctx, query, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	byOrder := make(map[string]*models.Feedback, len(orders))
+	for rows.Next() {
+		var fb models.Feedback
+		if err := rows.Scan(&fb.ID, &fb.OrderID, &fb.MachineID, &fb.Rating, &fb.Comment, &fb.CreatedAt, &fb.UpdatedAt); err != nil {
+			return err
 		}
-		return nil, err
+		byOrder[fb.OrderID] = &fb
 	}
-	return &fb, nil
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		o.Feedback = byOrder[o.ID]
+	}
+	return nil
 }
 
-func (r *Repository) getAddressByID(ctx context.Context, addressID string) (*models.Address, error) {
-	query := `SELECT id, user_id, label, street_address, is_default, created_at, updated_at FROM addresses WHERE id = $1`
-	row := r.db.QueryRow(ctx, query, addressID)
-	var addr models.Address
-	err := row.Scan(
-		&addr.ID,
-		&addr.UserID,
-		&addr.Label,
-		&addr.StreetAddress,
-		&addr.IsDefault,
-		&addr.CreatedAt,
-		&addr.UpdatedAt,
-	)
+// attachAddresses loads the pickup and dropoff addresses of all orders with a
+// single query. It deliberately does not filter soft-deleted addresses: an
+// order must keep showing the pickup/dropoff address it was placed with.
+func (r *Repository) attachAddresses(ctx context.Context, q database.Executor, orders []*models.Order) error {
+	ids := make([]string, 0, 2*len(orders))
+	for _, o := range orders {
+		if o.PickupAddressID != "" {
+			ids = append(ids, o.PickupAddressID)
+		}
+		if o.DropoffAddressID != "" {
+			ids = append(ids, o.DropoffAddressID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := `SELECT id, user_id, label, street_address, is_default, created_at, updated_at FROM addresses WHERE id = ANY($1)`
+	rows, err := q.Query(ctx, query, ids)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer rows.Close()
+
+	byID := make(map[string]*models.Address, len(ids))
+	for rows.Next() {
+		var addr models.Address
+		if err := rows.Scan(
+			&addr.ID,
+			&addr.UserID,
+			&addr.Label,
+			&addr.StreetAddress,
+			&addr.IsDefault,
+			&addr.CreatedAt,
+			&addr.UpdatedAt,
+		); err != nil {
+			return err
+		}
+		byID[addr.ID] = &addr
 	}
-	return &addr, nil
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		o.PickupAddress = byID[o.PickupAddressID]
+		o.DropoffAddress = byID[o.DropoffAddressID]
+	}
+	return nil
 }
 
 // InsertAddress inserts a new address into the database and returns its ID.
 func (r *Repository) InsertAddress(ctx context.Context, addr *models.Address) (string, error) {
 	query := `INSERT INTO addresses (user_id, label, street_address, is_default) VALUES ($1, $2, $3, $4) RETURNING id`
 	var id string
-	err := r.db.QueryRow(ctx, query, addr.UserID, addr.Label, addr.StreetAddress, addr.IsDefault).Scan(&id)
+	err := r.conn(ctx).QueryRow(ctx, query, addr.UserID, addr.Label, addr.StreetAddress, addr.IsDefault).Scan(&id)
 	if err != nil {
 		return "", fmt.Errorf("repository.InsertAddress: %w", err)
 	}
 	return id, nil
 }
 
-// InsertFeedback inserts feedback for an order.
-func (r *Repository) InsertFeedback(ctx context.Context, orderID string, req models.FeedbackRequest) error {
+// InsertFeedback inserts feedback for an order, recording the machine that
+// delivered it. The unique order_id makes a second submission fail with
+// ErrFeedbackAlreadySubmitted.
+func (r *Repository) InsertFeedback(ctx context.Context, orderID string, req models.FeedbackRequest) (*models.Feedback, error) {
 	query := `
-		INSERT INTO feedback (order_id, rating, comment)
-		VALUES ($1, $2, $3)
+		INSERT INTO feedback (order_id, machine_id, rating, comment)
+		SELECT id, machine_id, $2, $3 FROM orders WHERE id = $1
+		RETURNING id, order_id, machine_id, rating, comment, created_at, updated_at
 	`
-	_, err := r.db.Exec(ctx, query, orderID, req.Rating, req.Comment)
+	var fb models.Feedback
+	err := r.conn(ctx).QueryRow(ctx, query, orderID, req.Rating, req.Comment).Scan(
+		&fb.ID, &fb.OrderID, &fb.MachineID, &fb.Rating, &fb.Comment, &fb.CreatedAt, &fb.UpdatedAt,
+	)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
 		// 唯一索引冲突，说明已评价
-		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
-			return models.ErrFeedbackAlreadySubmitted
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, models.ErrFeedbackAlreadySubmitted
 		}
-		return fmt.Errorf("repository.InsertFeedback: %w", err)
+		return nil, fmt.Errorf("repository.InsertFeedback: %w", err)
 	}
-	return nil
+	return &fb, nil
+}
+
+// ListFeedback returns one page of all feedback, newest first, and the
+// number of entries matching the query.
+func (r *Repository) ListFeedback(ctx context.Context, q models.FeedbackQuery) ([]*models.Feedback, int, error) {
+	offset := (q.Page - 1) * q.Limit
+	query := `
+		SELECT id, order_id, machine_id, rating, comment, created_at, updated_at,
+			COUNT(*) OVER() AS total
+		FROM feedback
+		WHERE ($1 = '' OR machine_id::text = $1) AND ($2 = 0 OR rating = $2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`
+
+	rows, err := r.replica.Query(ctx, query, q.MachineID, q.Rating, q.Limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("repository.ListFeedback.Query: %w", err)
+	}
+	defer rows.Close()
+
+	feedback := []*models.Feedback{}
+	var total int
+	for rows.Next() {
+		var fb models.Feedback
+		if err := rows.Scan(&fb.ID, &fb.OrderID, &fb.MachineID, &fb.Rating, &fb.Comment, &fb.CreatedAt, &fb.UpdatedAt, &total); err != nil {
+			return nil, 0, fmt.Errorf("repository.ListFeedback.scan: %w", err)
+		}
+		feedback = append(feedback, &fb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListFeedback.rows: %w", err)
+	}
+
+	total, err = pageTotal(ctx, r.replica, len(feedback), offset, total, `
+		SELECT COUNT(*) FROM feedback
+		WHERE ($1 = '' OR machine_id::text = $1) AND ($2 = 0 OR rating = $2)`,
+		q.MachineID, q.Rating,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("repository.ListFeedback.Count: %w", err)
+	}
+	return feedback, total, nil
+}
+
+// MachineRatings averages the feedback ratings of every machine that has
+// any, lowest average first so the machines customers like least lead.
+func (r *Repository) MachineRatings(ctx context.Context) ([]models.MachineRating, error) {
+	query := `
+		SELECT machine_id, AVG(rating)::float8, COUNT(*)
+		FROM feedback
+		WHERE machine_id IS NOT NULL
+		GROUP BY machine_id
+		ORDER BY 2, machine_id`
+	rows, err := r.replica.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("repository.MachineRatings: %w", err)
+	}
+	defer rows.Close()
+
+	ratings := []models.MachineRating{}
+	for rows.Next() {
+		var mr models.MachineRating
+		if err := rows.Scan(&mr.MachineID, &mr.AverageRating, &mr.RatingCount); err != nil {
+			return nil, fmt.Errorf("repository.MachineRatings.scan: %w", err)
+		}
+		ratings = append(ratings, mr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.MachineRatings.rows: %w", err)
+	}
+	return ratings, nil
 }
 
 // FindByID retrieves a single order by its ID.
 func (r *Repository) FindByID(ctx context.Context, orderID string) (*models.Order, error) {
 	query := `
-		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at
+		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason
 		FROM orders
 		WHERE id = $1`
-	row := r.db.QueryRow(ctx, query, orderID)
+	row := r.conn(ctx).QueryRow(ctx, query, orderID)
 	order, err := r.scanOrder(row)
 	if err != nil {
 		return nil, fmt.Errorf("repository.FindByID: %w", err)
 	}
 
-	if order.PickupAddressID != "" {
-		addr, err := r.getAddressByID(ctx, order.PickupAddressID)
-		if err == nil {
-			order.PickupAddress = addr
-		}
+	if err := r.attachAddresses(ctx, r.conn(ctx), []*models.Order{order}); err != nil {
+		return nil, fmt.Errorf("repository.FindByID.addresses: %w", err)
 	}
-	// 查询并赋值 DropoffAddress
-	if order.DropoffAddressID != "" {
-		addr, err := r.getAddressByID(ctx, order.DropoffAddressID)
-		if err == nil {
-			order.DropoffAddress = addr
-		}
+	if err := r.attachFeedback(ctx, r.conn(ctx), []*models.Order{order}); err != nil {
+		return nil, fmt.Errorf("repository.FindByID.feedback: %w", err)
 	}
 
 	return order, nil
@@ -197,23 +561,26 @@ func (r *Repository) FindByID(ctx context.Context, orderID string) (*models.Orde
 func (r *Repository) ListByUserID(ctx context.Context, userID string, page, limit int) ([]*models.Order, int, error) {
 	offset := (page - 1) * limit
 	query := `
-		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at
+		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason,
+			COUNT(*) OVER() AS total
 		FROM orders
 		WHERE user_id = $1
 		ORDER BY created_at DESC
 		LIMIT $2 OFFSET $3`
 
-	rows, err := r.db.Query(ctx, query, userID, limit, offset)
+	rows, err := r.conn(ctx).Query(ctx, query, userID, limit, offset)
 	if err != nil {
 		return nil, 0, fmt.Errorf("repository.ListByUserID.Query: %w", err)
 	}
 	defer rows.Close()
 
 	var orders []*models.Order
+	var total int
 	for rows.Next() {
 		order := &models.Order{}
 		var machineIDFromDB sql.NullString
 		var lengthCm, widthCm, heightCm float64
+		var windowStart, windowEnd *time.Time
 		err := rows.Scan(
 			&order.ID,
 			&order.UserID,
@@ -228,6 +595,21 @@ func (r *Repository) ListByUserID(ctx context.Context, userID string, page, limi
 			&order.Cost,
 			&order.CreatedAt,
 			&order.UpdatedAt,
+			&order.ScheduledPickupTime,
+			&windowStart,
+			&windowEnd,
+			&order.RecipientName,
+			&order.RecipientPhone,
+			&order.DeliveryInstructions,
+			&order.ReturnOfOrderID,
+			&order.Priority,
+			&order.CostBreakdown,
+			&order.DeliveryPIN,
+			&order.CancellationFee,
+			&order.InsuredValue,
+			&order.Tip,
+			&order.PaymentFailureReason,
+			&total,
 		)
 		if err != nil {
 			return nil, 0, fmt.Errorf("repository.ListByUserID.scan: %w", err)
@@ -243,15 +625,21 @@ func (r *Repository) ListByUserID(ctx context.Context, userID string, page, limi
 			Width:  widthCm,
 			Height: heightCm,
 		}
-		feedback, err := r.getFeedbackByOrderID(context.Background(), order.ID)
-		if err == nil {
-			order.Feedback = feedback
-		}
+		order.DeliveryWindow = deliveryWindow(windowStart, windowEnd)
 		orders = append(orders, order)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListByUserID.rows: %w", err)
+	}
+	rows.Close()
+	if err := r.attachAddresses(ctx, r.conn(ctx), orders); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListByUserID.addresses: %w", err)
+	}
+	if err := r.attachFeedback(ctx, r.conn(ctx), orders); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListByUserID.feedback: %w", err)
+	}
 
-	var total int
-	err = r.db.QueryRow(ctx, "SELECT COUNT(*) FROM orders WHERE user_id = $1", userID).Scan(&total)
+	total, err = pageTotal(ctx, r.conn(ctx), len(orders), offset, total, "SELECT COUNT(*) FROM orders WHERE user_id = $1", userID)
 	if err != nil {
 		return nil, 0, fmt.Errorf("repository.ListByUserID.Count: %w", err)
 	}
@@ -263,22 +651,25 @@ func (r *Repository) ListByUserID(ctx context.Context, userID string, page, limi
 func (r *Repository) ListAll(ctx context.Context, page, limit int) ([]*models.Order, int, error) {
 	offset := (page - 1) * limit
 	query := `
-		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at
+		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason,
+			COUNT(*) OVER() AS total
 		FROM orders
 		ORDER BY created_at DESC
 		LIMIT $1 OFFSET $2`
 
-	rows, err := r.db.Query(ctx, query, limit, offset)
+	rows, err := r.replica.Query(ctx, query, limit, offset)
 	if err != nil {
 		return nil, 0, fmt.Errorf("repository.ListAll.Query: %w", err)
 	}
 	defer rows.Close()
 
 	var orders []*models.Order
+	var total int
 	for rows.Next() {
 		order := &models.Order{}
 		var machineIDFromDB sql.NullString
 		var lengthCm, widthCm, heightCm float64
+		var windowStart, windowEnd *time.Time
 		err := rows.Scan(
 			&order.ID,
 			&order.UserID,
@@ -293,6 +684,21 @@ func (r *Repository) ListAll(ctx context.Context, page, limit int) ([]*models.Or
 			&order.Cost,
 			&order.CreatedAt,
 			&order.UpdatedAt,
+			&order.ScheduledPickupTime,
+			&windowStart,
+			&windowEnd,
+			&order.RecipientName,
+			&order.RecipientPhone,
+			&order.DeliveryInstructions,
+			&order.ReturnOfOrderID,
+			&order.Priority,
+			&order.CostBreakdown,
+			&order.DeliveryPIN,
+			&order.CancellationFee,
+			&order.InsuredValue,
+			&order.Tip,
+			&order.PaymentFailureReason,
+			&total,
 		)
 		if err != nil {
 			return nil, 0, fmt.Errorf("repository.ListAll.scan: %w", err)
@@ -308,15 +714,21 @@ func (r *Repository) ListAll(ctx context.Context, page, limit int) ([]*models.Or
 			Width:  widthCm,
 			Height: heightCm,
 		}
-		feedback, err := r.getFeedbackByOrderID(context.Background(), order.ID)
-		if err == nil {
-			order.Feedback = feedback
-		}
+		order.DeliveryWindow = deliveryWindow(windowStart, windowEnd)
 		orders = append(orders, order)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListAll.rows: %w", err)
+	}
+	rows.Close()
+	if err := r.attachAddresses(ctx, r.replica, orders); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListAll.addresses: %w", err)
+	}
+	if err := r.attachFeedback(ctx, r.replica, orders); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListAll.feedback: %w", err)
+	}
 
-	var total int
-	err = r.db.QueryRow(ctx, "SELECT COUNT(*) FROM orders").Scan(&total)
+	total, err = pageTotal(ctx, r.replica, len(orders), offset, total, "SELECT COUNT(*) FROM orders")
 	if err != nil {
 		return nil, 0, fmt.Errorf("repository.ListAll.Count: %w", err)
 	}
@@ -324,21 +736,1412 @@ func (r *Repository) ListAll(ctx context.Context, page, limit int) ([]*models.Or
 	return orders, total, nil
 }
 
-// UpdateStatusForUser updates the status of an order for a specific user.
+// ListByUserIDAfter returns up to limit of the user's orders created before
+// after, newest first; a nil cursor starts at the newest order. Unlike
+// ListByUserID it seeks with the (user_id, created_at, id) index instead of
+// skipping rows, so deep pages cost the same as the first one.
+func (r *Repository) ListByUserIDAfter(ctx context.Context, userID string, after *models.OrderCursor, limit int) ([]*models.Order, error) {
+	query := `
+		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason
+		FROM orders
+		WHERE user_id = $1
+			AND ($2::timestamptz IS NULL OR (created_at, id) < ($2, $3::uuid))
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4`
+	afterTime, afterID := cursorArgs(after)
+	orders, err := r.listOrders(ctx, r.conn(ctx), query, userID, afterTime, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListByUserIDAfter: %w", err)
+	}
+	return orders, nil
+}
+
+// ListAllAfter is ListByUserIDAfter across all users, served by the replica.
+func (r *Repository) ListAllAfter(ctx context.Context, after *models.OrderCursor, limit int) ([]*models.Order, error) {
+	query := `
+		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason
+		FROM orders
+		WHERE $1::timestamptz IS NULL OR (created_at, id) < ($1, $2::uuid)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3`
+	afterTime, afterID := cursorArgs(after)
+	orders, err := r.listOrders(ctx, r.replica, query, afterTime, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListAllAfter: %w", err)
+	}
+	return orders, nil
+}
+
+// cursorArgs returns the query arguments for an optional keyset cursor.
+func cursorArgs(after *models.OrderCursor) (*time.Time, *string) {
+	if after == nil {
+		return nil, nil
+	}
+	return &after.CreatedAt, &after.ID
+}
+
+// listOrders runs a query selecting full order rows on q and attaches their
+// addresses and feedback.
+func (r *Repository) listOrders(ctx context.Context, q database.Executor, query string, args ...any) ([]*models.Order, error) {
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*models.Order{}
+	for rows.Next() {
+		order, err := r.scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := r.attachAddresses(ctx, q, orders); err != nil {
+		return nil, fmt.Errorf("addresses: %w", err)
+	}
+	if err := r.attachFeedback(ctx, q, orders); err != nil {
+		return nil, fmt.Errorf("feedback: %w", err)
+	}
+	return orders, nil
+}
+
+// ExportOrders calls fn for every order matching q, oldest first, with the
+// customer's email and the address text joined in. Rows come from the
+// replica one at a time as fn consumes them, so memory use does not grow
+// with the size of the export. fn must not keep row; it is reused. An error
+// from fn stops the export and is returned as is.
+func (r *Repository) ExportOrders(ctx context.Context, q models.OrderExportQuery, fn func(row *models.OrderExportRow) error) error {
+	query := `
+		SELECT o.id, o.user_id, COALESCE(u.email, ''), o.machine_id, o.status, o.item_weight_kg, o.cost, o.tip,
+			COALESCE(pa.street_address, ''), COALESCE(da.street_address, ''),
+			o.scheduled_pickup_time, o.delivery_window_start, o.delivery_window_end, o.created_at, o.updated_at
+		FROM orders o
+		LEFT JOIN users u ON u.id = o.user_id
+		LEFT JOIN addresses pa ON pa.id = o.pickup_address_id
+		LEFT JOIN addresses da ON da.id = o.dropoff_address_id
+		WHERE o.created_at >= $1 AND o.created_at < $2
+			AND ($3::order_status IS NULL OR o.status = $3)
+		ORDER BY o.created_at, o.id`
+	rows, err := r.replica.Query(ctx, query, q.From, q.To, q.Status)
+	if err != nil {
+		return fmt.Errorf("repository.ExportOrders: %w", err)
+	}
+	defer rows.Close()
+
+	var row models.OrderExportRow
+	for rows.Next() {
+		var machineID sql.NullString
+		var windowStart, windowEnd *time.Time
+		err := rows.Scan(
+			&row.ID, &row.UserID, &row.CustomerEmail, &machineID, &row.Status, &row.ItemWeightKg, &row.Cost, &row.Tip,
+			&row.PickupStreet, &row.DropoffStreet,
+			&row.ScheduledPickupTime, &windowStart, &windowEnd, &row.CreatedAt, &row.UpdatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("repository.ExportOrders: %w", err)
+		}
+		row.MachineID = nil
+		if machineID.Valid {
+			row.MachineID = &machineID.String
+		}
+		row.DeliveryWindow = deliveryWindow(windowStart, windowEnd)
+		if err := fn(&row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("repository.ExportOrders: %w", err)
+	}
+	return nil
+}
+
+// UpdateStatusForUser moves an order of a specific user from status from to
+// to. It fails with ErrOrderStatusChanged if the order is no longer in from,
+// so a change based on a stale read never overwrites a concurrent one.
 // This is used for actions like cancelling an order.
-func (r *Repository) UpdateStatusForUser(ctx context.Context, orderID string, userID string, status string) error {
+func (r *Repository) UpdateStatusForUser(ctx context.Context, orderID string, userID string, from, to models.OrderStatus) error {
 	query := `
 		UPDATE orders
 		SET status = $1, updated_at = NOW()
-		WHERE id = $2 AND user_id = $3`
+		WHERE id = $2 AND user_id = $3 AND status = $4`
 
-	cmdTag, err := r.db.Exec(ctx, query, status, orderID, userID)
+	cmdTag, err := r.conn(ctx).Exec(ctx, query, to, orderID, userID, from)
 	if err != nil {
 		return fmt.Errorf("repository.UpdateStatusForUser: %w", err)
 	}
 	if cmdTag.RowsAffected() == 0 {
-		return models.ErrNotFound // Order not found or not owned by the user
+		return models.ErrOrderStatusChanged
+	}
+
+	return nil
+}
+
+// InsertStatusEvent appends a status change to the order's history. Call it
+// inside the same unit of work as the change itself.
+func (r *Repository) InsertStatusEvent(ctx context.Context, ev *models.OrderStatusEvent) error {
+	query := `
+		INSERT INTO order_status_events (order_id, from_status, to_status, actor_type, actor_id, reason)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid, NULLIF($6, ''))
+		RETURNING id, created_at`
+	err := r.conn(ctx).QueryRow(ctx, query, ev.OrderID, ev.FromStatus, ev.ToStatus, ev.ActorType, ev.ActorID, ev.Reason).
+		Scan(&ev.ID, &ev.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("repository.InsertStatusEvent: %w", err)
+	}
+	return nil
+}
+
+// ListStatusEvents returns the status history of an order, oldest first.
+func (r *Repository) ListStatusEvents(ctx context.Context, orderID string) ([]*models.OrderStatusEvent, error) {
+	query := `
+		SELECT id, order_id, from_status, to_status, actor_type, COALESCE(actor_id::text, ''), COALESCE(reason, ''), created_at
+		FROM order_status_events
+		WHERE order_id = $1
+		ORDER BY created_at, id`
+	rows, err := r.conn(ctx).Query(ctx, query, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListStatusEvents: %w", err)
+	}
+	defer rows.Close()
+
+	events := []*models.OrderStatusEvent{}
+	for rows.Next() {
+		var ev models.OrderStatusEvent
+		if err := rows.Scan(&ev.ID, &ev.OrderID, &ev.FromStatus, &ev.ToStatus, &ev.ActorType, &ev.ActorID, &ev.Reason, &ev.CreatedAt); err != nil {
+			return nil, fmt.Errorf("repository.ListStatusEvents: scan: %w", err)
+		}
+		events = append(events, &ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListStatusEvents: %w", err)
+	}
+	return events, nil
+}
+
+// InsertPayment records a payment attempt and sets its ID and CreatedAt.
+func (r *Repository) InsertPayment(ctx context.Context, p *models.Payment) error {
+	query := `
+		INSERT INTO payments (order_id, user_id, kind, amount, provider, provider_ref, status, failure_reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+	err := r.conn(ctx).QueryRow(ctx, query, p.OrderID, p.UserID, p.Kind, p.Amount, p.Provider, p.ProviderRef, p.Status, p.FailureReason).
+		Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("repository.InsertPayment: %w", err)
+	}
+	return nil
+}
+
+// ListPayments returns the payment attempts of an order, oldest first.
+func (r *Repository) ListPayments(ctx context.Context, orderID string) ([]*models.Payment, error) {
+	query := `
+		SELECT id, order_id, user_id, kind, amount, provider, provider_ref, status, failure_reason, created_at
+		FROM payments
+		WHERE order_id = $1
+		ORDER BY created_at, id`
+	rows, err := r.conn(ctx).Query(ctx, query, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListPayments: %w", err)
+	}
+	defer rows.Close()
+
+	payments := []*models.Payment{}
+	for rows.Next() {
+		var p models.Payment
+		if err := rows.Scan(&p.ID, &p.OrderID, &p.UserID, &p.Kind, &p.Amount, &p.Provider, &p.ProviderRef, &p.Status, &p.FailureReason, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("repository.ListPayments: scan: %w", err)
+		}
+		payments = append(payments, &p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListPayments: %w", err)
+	}
+	return payments, nil
+}
+
+// SettlePayments records the outcome of the order's charge providerRef once
+// the customer has authenticated it, for each of its records still
+// REQUIRES_ACTION. It reports false if there were none, e.g. because a
+// concurrent request settled them first.
+func (r *Repository) SettlePayments(ctx context.Context, orderID, providerRef string, status models.PaymentStatus, reason *string) (bool, error) {
+	query := `
+		UPDATE payments SET status = $3, failure_reason = $4
+		WHERE order_id = $1 AND provider_ref = $2 AND status = 'REQUIRES_ACTION'`
+	tag, err := r.conn(ctx).Exec(ctx, query, orderID, providerRef, status, reason)
+	if err != nil {
+		return false, fmt.Errorf("repository.SettlePayments: %w", err)
 	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// CheckDeliveryPIN reports whether pin is the order's delivery PIN, counting
+// wrong PINs. It returns ErrDeliveryPINLocked without checking once
+// MaxDeliveryPINAttempts wrong PINs were given. Orders without a PIN accept
+// any. Call it outside the unit of work completing the handover, so a wrong
+// PIN is counted even though the handover fails.
+func (r *Repository) CheckDeliveryPIN(ctx context.Context, orderID, pin string) (bool, error) {
+	query := `
+		UPDATE orders
+		SET delivery_pin_attempts = delivery_pin_attempts + CASE WHEN COALESCE(delivery_pin = $2, true) THEN 0 ELSE 1 END
+		WHERE id = $1 AND delivery_pin_attempts < $3
+		RETURNING COALESCE(delivery_pin = $2, true)`
+	var ok bool
+	err := r.conn(ctx).QueryRow(ctx, query, orderID, pin, models.MaxDeliveryPINAttempts).Scan(&ok)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, models.ErrDeliveryPINLocked
+	}
+	if err != nil {
+		return false, fmt.Errorf("repository.CheckDeliveryPIN: %w", err)
+	}
+	return ok, nil
+}
+
+// SetPaymentID records the payment provider's ID for the order's charge.
+func (r *Repository) SetPaymentID(ctx context.Context, orderID, paymentID string) error {
+	if _, err := r.conn(ctx).Exec(ctx, `UPDATE orders SET payment_id = $2 WHERE id = $1`, orderID, paymentID); err != nil {
+		return fmt.Errorf("repository.SetPaymentID: %w", err)
+	}
+	return nil
+}
+
+// SetRefundID records the payment provider's ID for the refund of the
+// order's charge.
+func (r *Repository) SetRefundID(ctx context.Context, orderID, refundID string) error {
+	if _, err := r.conn(ctx).Exec(ctx, `UPDATE orders SET refund_id = $2 WHERE id = $1`, orderID, refundID); err != nil {
+		return fmt.Errorf("repository.SetRefundID: %w", err)
+	}
+	return nil
+}
 
+// SetCancellationFee records the fee kept when the customer cancelled a paid
+// order.
+func (r *Repository) SetCancellationFee(ctx context.Context, orderID string, fee float64) error {
+	if _, err := r.conn(ctx).Exec(ctx, `UPDATE orders SET cancellation_fee = $2 WHERE id = $1`, orderID, fee); err != nil {
+		return fmt.Errorf("repository.SetCancellationFee: %w", err)
+	}
+	return nil
+}
+
+// FindSavedPaymentMethod returns the payment provider's customer and card IDs
+// of one of the user's saved cards, or ErrPaymentMethodNotFound.
+func (r *Repository) FindSavedPaymentMethod(ctx context.Context, userID, paymentMethodID string) (customerID, providerID string, err error) {
+	query := `
+		SELECT u.payment_customer_id, pm.provider_id
+		FROM payment_methods pm
+		JOIN users u ON u.id = pm.user_id
+		WHERE pm.id = $1 AND pm.user_id = $2 AND u.payment_customer_id IS NOT NULL`
+	err = r.conn(ctx).QueryRow(ctx, query, paymentMethodID, userID).Scan(&customerID, &providerID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", models.ErrPaymentMethodNotFound
+		}
+		return "", "", fmt.Errorf("repository.FindSavedPaymentMethod: %w", err)
+	}
+	return customerID, providerID, nil
+}
+
+// SetPrice sets what an order costs and its itemization, e.g. after a
+// discount.
+func (r *Repository) SetPrice(ctx context.Context, orderID string, cost float64, breakdown *models.CostBreakdown) error {
+	if _, err := r.conn(ctx).Exec(ctx, `UPDATE orders SET cost = $2, cost_breakdown = $3 WHERE id = $1`, orderID, cost, breakdown); err != nil {
+		return fmt.Errorf("repository.SetPrice: %w", err)
+	}
 	return nil
 }
+
+// SetTip records the tip on an order with the breakdown showing it. An order
+// takes one tip: if it has one already, it fails with ErrTipAlreadyAdded.
+func (r *Repository) SetTip(ctx context.Context, orderID string, tip float64, breakdown *models.CostBreakdown) error {
+	cmdTag, err := r.conn(ctx).Exec(ctx, `UPDATE orders SET tip = $2, cost_breakdown = $3 WHERE id = $1 AND tip = 0`, orderID, tip, breakdown)
+	if err != nil {
+		return fmt.Errorf("repository.SetTip: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return models.ErrTipAlreadyAdded
+	}
+	return nil
+}
+
+// SetPaymentFailure records why the order's last charge failed, or clears it
+// when reason is nil. A reason is only recorded while the order is unpaid;
+// otherwise it fails with ErrOrderStatusChanged.
+func (r *Repository) SetPaymentFailure(ctx context.Context, orderID string, reason *string) error {
+	query := `
+		UPDATE orders SET payment_failure_reason = $2
+		WHERE id = $1 AND ($2::text IS NULL OR status IN ('PENDING_PAYMENT', 'PAYMENT_FAILED'))`
+	cmdTag, err := r.conn(ctx).Exec(ctx, query, orderID, reason)
+	if err != nil {
+		return fmt.Errorf("repository.SetPaymentFailure: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 && reason != nil {
+		return models.ErrOrderStatusChanged
+	}
+	return nil
+}
+
+// GetPaymentRefs returns the IDs of the order's charge and refund; each is
+// empty when there is none.
+func (r *Repository) GetPaymentRefs(ctx context.Context, orderID string) (string, string, error) {
+	query := `SELECT COALESCE(payment_id, ''), COALESCE(refund_id, '') FROM orders WHERE id = $1`
+	var paymentID, refundID string
+	if err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&paymentID, &refundID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", models.ErrNotFound
+		}
+		return "", "", fmt.Errorf("repository.GetPaymentRefs: %w", err)
+	}
+	return paymentID, refundID, nil
+}
+
+// InsertOutboxEvent records a domain event in the outbox table. Call it inside
+// the same unit of work as the state change so both commit or roll back together.
+func (r *Repository) InsertOutboxEvent(ctx context.Context, aggregateID, eventType string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("repository.InsertOutboxEvent: marshal payload: %w", err)
+	}
+	query := `
+		INSERT INTO outbox_events (aggregate_type, aggregate_id, event_type, payload)
+		VALUES ('order', $1, $2, $3)`
+	if _, err := r.conn(ctx).Exec(ctx, query, aggregateID, eventType, body); err != nil {
+		return fmt.Errorf("repository.InsertOutboxEvent: %w", err)
+	}
+	return nil
+}
+
+// ListDueScheduled returns up to limit paid orders in SCHEDULED whose pickup
+// time is at or before due, earliest pickup first.
+func (r *Repository) ListDueScheduled(ctx context.Context, due time.Time, limit int) ([]*models.Order, error) {
+	query := `
+		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason
+		FROM orders
+		WHERE status = 'SCHEDULED' AND scheduled_pickup_time <= $1
+		ORDER BY scheduled_pickup_time
+		LIMIT $2`
+	rows, err := r.conn(ctx).Query(ctx, query, due, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListDueScheduled: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []*models.Order
+	for rows.Next() {
+		order, err := r.scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("repository.ListDueScheduled: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListDueScheduled: %w", err)
+	}
+	return orders, nil
+}
+
+// ListUnpaid returns up to limit orders still in PENDING_PAYMENT or
+// PAYMENT_FAILED that were created at or before createdBefore, oldest first.
+// Orders with a charge awaiting authentication are left out.
+func (r *Repository) ListUnpaid(ctx context.Context, createdBefore time.Time, limit int) ([]*models.Order, error) {
+	query := `
+		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason
+		FROM orders
+		WHERE status IN ('PENDING_PAYMENT', 'PAYMENT_FAILED') AND created_at <= $1
+			AND NOT EXISTS (SELECT 1 FROM payments p WHERE p.order_id = orders.id AND p.status = 'REQUIRES_ACTION')
+		ORDER BY created_at
+		LIMIT $2`
+	rows, err := r.conn(ctx).Query(ctx, query, createdBefore, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListUnpaid: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []*models.Order
+	for rows.Next() {
+		order, err := r.scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("repository.ListUnpaid: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListUnpaid: %w", err)
+	}
+	return orders, nil
+}
+
+// ListAwaitingPaymentAction returns up to limit orders with a charge
+// awaiting authentication, oldest first.
+func (r *Repository) ListAwaitingPaymentAction(ctx context.Context, limit int) ([]*models.Order, error) {
+	query := `
+		SELECT id, user_id, machine_id, pickup_address_id, dropoff_address_id, status, item_length_cm, item_width_cm, item_height_cm, item_weight_kg, cost, created_at, updated_at, scheduled_pickup_time, delivery_window_start, delivery_window_end, recipient_name, recipient_phone, delivery_instructions, return_of_order_id, priority, cost_breakdown, COALESCE(delivery_pin, ''), cancellation_fee, insured_value, tip, payment_failure_reason
+		FROM orders
+		WHERE EXISTS (SELECT 1 FROM payments p WHERE p.order_id = orders.id AND p.status = 'REQUIRES_ACTION')
+		ORDER BY created_at
+		LIMIT $1`
+	rows, err := r.conn(ctx).Query(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListAwaitingPaymentAction: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []*models.Order
+	for rows.Next() {
+		order, err := r.scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("repository.ListAwaitingPaymentAction: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListAwaitingPaymentAction: %w", err)
+	}
+	return orders, nil
+}
+
+// CancelUnpaid cancels an order only if it is still in PENDING_PAYMENT or
+// PAYMENT_FAILED and reports whether it did, so an order paid or cancelled in
+// the meantime is left alone.
+func (r *Repository) CancelUnpaid(ctx context.Context, orderID string) (bool, error) {
+	query := `
+		UPDATE orders
+		SET status = 'CANCELLED', updated_at = NOW()
+		WHERE id = $1 AND status IN ('PENDING_PAYMENT', 'PAYMENT_FAILED')
+			AND NOT EXISTS (SELECT 1 FROM payments p WHERE p.order_id = orders.id AND p.status = 'REQUIRES_ACTION')`
+	tag, err := r.conn(ctx).Exec(ctx, query, orderID)
+	if err != nil {
+		return false, fmt.Errorf("repository.CancelUnpaid: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// InsertNotification adds a message to the user's notifications.
+func (r *Repository) InsertNotification(ctx context.Context, userID, message string) error {
+	query := `INSERT INTO notifications (user_id, message) VALUES ($1, $2)`
+	if _, err := r.conn(ctx).Exec(ctx, query, userID, message); err != nil {
+		return fmt.Errorf("repository.InsertNotification: %w", err)
+	}
+	return nil
+}
+
+// InsertOrderMessage adds msg to its order's thread and sets its ID and
+// CreatedAt.
+func (r *Repository) InsertOrderMessage(ctx context.Context, msg *models.OrderMessage) error {
+	query := `
+		INSERT INTO order_messages (order_id, sender_id, sender_role, body)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+	err := r.conn(ctx).QueryRow(ctx, query, msg.OrderID, msg.SenderID, msg.SenderRole, msg.Body).Scan(&msg.ID, &msg.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("repository.InsertOrderMessage: %w", err)
+	}
+	return nil
+}
+
+// ListOrderMessages returns an order's thread, oldest first. Hidden messages
+// are left out unless includeHidden is set.
+func (r *Repository) ListOrderMessages(ctx context.Context, orderID string, includeHidden bool) ([]*models.OrderMessage, error) {
+	query := `
+		SELECT id, order_id, sender_id, sender_role, body, hidden_at, hidden_by, created_at
+		FROM order_messages
+		WHERE order_id = $1 AND ($2 OR hidden_at IS NULL)
+		ORDER BY created_at, id`
+	rows, err := r.conn(ctx).Query(ctx, query, orderID, includeHidden)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListOrderMessages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []*models.OrderMessage{}
+	for rows.Next() {
+		var m models.OrderMessage
+		if err := rows.Scan(&m.ID, &m.OrderID, &m.SenderID, &m.SenderRole, &m.Body, &m.HiddenAt, &m.HiddenBy, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("repository.ListOrderMessages: %w", err)
+		}
+		messages = append(messages, &m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListOrderMessages: %w", err)
+	}
+	return messages, nil
+}
+
+// HideOrderMessage hides a message of an order's thread on behalf of
+// adminID. Hiding a hidden message keeps who hid it first. It returns
+// ErrNotFound when the order has no such message.
+func (r *Repository) HideOrderMessage(ctx context.Context, orderID, messageID, adminID string) error {
+	query := `
+		UPDATE order_messages
+		SET hidden_at = COALESCE(hidden_at, now()), hidden_by = COALESCE(hidden_by, $3)
+		WHERE id = $1 AND order_id = $2`
+	tag, err := r.conn(ctx).Exec(ctx, query, messageID, orderID, adminID)
+	if err != nil {
+		return fmt.Errorf("repository.HideOrderMessage: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+// MarkOrderMessagesRead records that userID has read an order's thread up to
+// at. The mark never moves back.
+func (r *Repository) MarkOrderMessagesRead(ctx context.Context, orderID, userID string, at time.Time) error {
+	query := `
+		INSERT INTO order_message_reads (order_id, user_id, read_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (order_id, user_id) DO UPDATE
+		SET read_at = GREATEST(order_message_reads.read_at, EXCLUDED.read_at)`
+	if _, err := r.conn(ctx).Exec(ctx, query, orderID, userID, at); err != nil {
+		return fmt.Errorf("repository.MarkOrderMessagesRead: %w", err)
+	}
+	return nil
+}
+
+// ListUnreadOrderMessages counts, per order, the visible messages userID has
+// not read: staff messages on the customer's own orders, or customer messages
+// on any order when staff is set. Up to limit orders are returned, the one
+// with the latest unread message first.
+func (r *Repository) ListUnreadOrderMessages(ctx context.Context, userID string, staff bool, limit int) ([]models.UnreadOrderMessages, error) {
+	query := `
+		SELECT m.order_id, COUNT(*)
+		FROM order_messages m
+		JOIN orders o ON o.id = m.order_id
+		LEFT JOIN order_message_reads rd ON rd.order_id = m.order_id AND rd.user_id = $1
+		WHERE m.hidden_at IS NULL
+			AND (rd.read_at IS NULL OR m.created_at > rd.read_at)
+			AND CASE WHEN $2 THEN m.sender_role = 'CUSTOMER'
+				ELSE o.user_id = $1 AND m.sender_role <> 'CUSTOMER' END
+		GROUP BY m.order_id
+		ORDER BY MAX(m.created_at) DESC
+		LIMIT $3`
+	rows, err := r.conn(ctx).Query(ctx, query, userID, staff, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListUnreadOrderMessages: %w", err)
+	}
+	defer rows.Close()
+
+	unread := []models.UnreadOrderMessages{}
+	for rows.Next() {
+		var u models.UnreadOrderMessages
+		if err := rows.Scan(&u.OrderID, &u.Unread); err != nil {
+			return nil, fmt.Errorf("repository.ListUnreadOrderMessages: %w", err)
+		}
+		unread = append(unread, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListUnreadOrderMessages: %w", err)
+	}
+	return unread, nil
+}
+
+// claimColumns are the claim columns scanned by scanClaim, with the insured
+// value of the claimed order.
+const claimColumns = `id, order_id, user_id, type, description, amount_claimed, status, resolution,
+	amount_approved, COALESCE(refund_id, ''), decision_note, decided_by, decided_at, created_at,
+	(SELECT o.insured_value FROM orders o WHERE o.id = claims.order_id)`
+
+func scanClaim(row pgx.Row, extra ...any) (*models.Claim, error) {
+	c := &models.Claim{Photos: []models.ClaimPhoto{}}
+	dest := append([]any{
+		&c.ID, &c.OrderID, &c.UserID, &c.Type, &c.Description, &c.AmountClaimed, &c.Status, &c.Resolution,
+		&c.AmountApproved, &c.RefundID, &c.DecisionNote, &c.DecidedBy, &c.DecidedAt, &c.CreatedAt,
+		&c.InsuredValue,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// InsertClaim files claim and sets its ID, Status and CreatedAt. An order
+// takes one claim: a second fails with ErrClaimAlreadyExists.
+func (r *Repository) InsertClaim(ctx context.Context, claim *models.Claim) error {
+	query := `
+		INSERT INTO claims (order_id, user_id, type, description, amount_claimed)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, status, created_at`
+	err := r.conn(ctx).QueryRow(ctx, query, claim.OrderID, claim.UserID, claim.Type, claim.Description, claim.AmountClaimed).
+		Scan(&claim.ID, &claim.Status, &claim.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return models.ErrClaimAlreadyExists
+		}
+		return fmt.Errorf("repository.InsertClaim: %w", err)
+	}
+	return nil
+}
+
+// FindClaim returns a claim without its photos.
+func (r *Repository) FindClaim(ctx context.Context, claimID string) (*models.Claim, error) {
+	claim, err := scanClaim(r.conn(ctx).QueryRow(ctx, `SELECT `+claimColumns+` FROM claims WHERE id = $1`, claimID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, fmt.Errorf("repository.FindClaim: %w", err)
+	}
+	return claim, nil
+}
+
+// FindClaimByOrder returns the claim filed against an order, without its
+// photos.
+func (r *Repository) FindClaimByOrder(ctx context.Context, orderID string) (*models.Claim, error) {
+	claim, err := scanClaim(r.conn(ctx).QueryRow(ctx, `SELECT `+claimColumns+` FROM claims WHERE order_id = $1`, orderID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, fmt.Errorf("repository.FindClaimByOrder: %w", err)
+	}
+	return claim, nil
+}
+
+// ListClaims returns one page of claims, oldest first, and the number of
+// claims matching the query.
+func (r *Repository) ListClaims(ctx context.Context, q models.ClaimQuery) ([]*models.Claim, int, error) {
+	offset := (q.Page - 1) * q.Limit
+	var status *string
+	if q.Status != nil {
+		s := string(*q.Status)
+		status = &s
+	}
+	query := `
+		SELECT ` + claimColumns + `, COUNT(*) OVER() AS total
+		FROM claims
+		WHERE $1::text IS NULL OR status = $1
+		ORDER BY created_at, id
+		LIMIT $2 OFFSET $3`
+
+	rows, err := r.replica.Query(ctx, query, status, q.Limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("repository.ListClaims.Query: %w", err)
+	}
+	defer rows.Close()
+
+	claims := []*models.Claim{}
+	var total int
+	for rows.Next() {
+		claim, err := scanClaim(rows, &total)
+		if err != nil {
+			return nil, 0, fmt.Errorf("repository.ListClaims.scan: %w", err)
+		}
+		claims = append(claims, claim)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListClaims.rows: %w", err)
+	}
+
+	total, err = pageTotal(ctx, r.replica, len(claims), offset, total, `SELECT COUNT(*) FROM claims WHERE $1::text IS NULL OR status = $1`, status)
+	if err != nil {
+		return nil, 0, fmt.Errorf("repository.ListClaims.Count: %w", err)
+	}
+	return claims, total, nil
+}
+
+// DecideClaim records the decision set on claim and sets its DecidedAt. Only
+// open claims can be decided; a decided one fails with ErrClaimAlreadyDecided.
+func (r *Repository) DecideClaim(ctx context.Context, claim *models.Claim) error {
+	query := `
+		UPDATE claims
+		SET status = $2, resolution = $3, amount_approved = $4, refund_id = NULLIF($5, ''),
+			decision_note = $6, decided_by = $7, decided_at = now()
+		WHERE id = $1 AND status = 'OPEN'
+		RETURNING decided_at`
+	err := r.conn(ctx).QueryRow(ctx, query, claim.ID, claim.Status, claim.Resolution, claim.AmountApproved,
+		claim.RefundID, claim.DecisionNote, claim.DecidedBy).Scan(&claim.DecidedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.ErrClaimAlreadyDecided
+		}
+		return fmt.Errorf("repository.DecideClaim: %w", err)
+	}
+	return nil
+}
+
+// InsertClaimPhoto attaches a stored photo to a claim and sets its ID and
+// CreatedAt.
+func (r *Repository) InsertClaimPhoto(ctx context.Context, claimID string, photo *models.ClaimPhoto) error {
+	query := `
+		INSERT INTO claim_photos (claim_id, storage_key, content_type, size)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+	err := r.conn(ctx).QueryRow(ctx, query, claimID, photo.Key, photo.ContentType, photo.Size).Scan(&photo.ID, &photo.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("repository.InsertClaimPhoto: %w", err)
+	}
+	return nil
+}
+
+// ListClaimPhotos returns a claim's photos in the order they were added.
+func (r *Repository) ListClaimPhotos(ctx context.Context, claimID string) ([]models.ClaimPhoto, error) {
+	query := `
+		SELECT id, storage_key, content_type, size, created_at
+		FROM claim_photos
+		WHERE claim_id = $1
+		ORDER BY created_at, id`
+	rows, err := r.conn(ctx).Query(ctx, query, claimID)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListClaimPhotos: %w", err)
+	}
+	defer rows.Close()
+
+	photos := []models.ClaimPhoto{}
+	for rows.Next() {
+		var p models.ClaimPhoto
+		if err := rows.Scan(&p.ID, &p.Key, &p.ContentType, &p.Size, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("repository.ListClaimPhotos: %w", err)
+		}
+		photos = append(photos, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListClaimPhotos: %w", err)
+	}
+	return photos, nil
+}
+
+// InsertWalletCredit adds an entry to the user's wallet and sets its ID and
+// CreatedAt.
+func (r *Repository) InsertWalletCredit(ctx context.Context, userID string, credit *models.WalletCredit) error {
+	query := `
+		INSERT INTO wallet_credits (user_id, amount, reason, claim_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+	err := r.conn(ctx).QueryRow(ctx, query, userID, credit.Amount, credit.Reason, credit.ClaimID).Scan(&credit.ID, &credit.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("repository.InsertWalletCredit: %w", err)
+	}
+	return nil
+}
+
+// GetWallet returns the user's credit balance and its latest limit entries.
+func (r *Repository) GetWallet(ctx context.Context, userID string, limit int) (*models.Wallet, error) {
+	wallet := &models.Wallet{Credits: []models.WalletCredit{}}
+	err := r.conn(ctx).QueryRow(ctx, `SELECT COALESCE(SUM(amount), 0) FROM wallet_credits WHERE user_id = $1`, userID).Scan(&wallet.Balance)
+	if err != nil {
+		return nil, fmt.Errorf("repository.GetWallet: %w", err)
+	}
+	query := `
+		SELECT id, amount, reason, claim_id, created_at
+		FROM wallet_credits
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`
+	rows, err := r.conn(ctx).Query(ctx, query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.GetWallet: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c models.WalletCredit
+		if err := rows.Scan(&c.ID, &c.Amount, &c.Reason, &c.ClaimID, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("repository.GetWallet: %w", err)
+		}
+		wallet.Credits = append(wallet.Credits, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.GetWallet: %w", err)
+	}
+	return wallet, nil
+}
+
+// promoCodeColumns are the promo code columns scanned by scanPromoCode.
+const promoCodeColumns = `id, code, discount_type, value, max_redemptions, max_per_user, redemptions,
+	valid_from, valid_until, disabled_at, created_by, created_at`
+
+func scanPromoCode(row pgx.Row, extra ...any) (*models.PromoCode, error) {
+	p := &models.PromoCode{}
+	dest := append([]any{
+		&p.ID, &p.Code, &p.DiscountType, &p.Value, &p.MaxRedemptions, &p.MaxPerUser, &p.Redemptions,
+		&p.ValidFrom, &p.ValidUntil, &p.DisabledAt, &p.CreatedBy, &p.CreatedAt,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// InsertPromoCode creates p and sets its ID and CreatedAt. A code that is
+// already taken fails with ErrPromoCodeTaken.
+func (r *Repository) InsertPromoCode(ctx context.Context, p *models.PromoCode) error {
+	query := `
+		INSERT INTO promo_codes (code, discount_type, value, max_redemptions, max_per_user, valid_from, valid_until, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+	err := r.conn(ctx).QueryRow(ctx, query, p.Code, p.DiscountType, p.Value, p.MaxRedemptions, p.MaxPerUser,
+		p.ValidFrom, p.ValidUntil, p.CreatedBy).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return models.ErrPromoCodeTaken
+		}
+		return fmt.Errorf("repository.InsertPromoCode: %w", err)
+	}
+	return nil
+}
+
+// FindPromoCode returns the promo code with code, which must be upper case.
+func (r *Repository) FindPromoCode(ctx context.Context, code string) (*models.PromoCode, error) {
+	p, err := scanPromoCode(r.conn(ctx).QueryRow(ctx, `SELECT `+promoCodeColumns+` FROM promo_codes WHERE code = $1`, code))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, fmt.Errorf("repository.FindPromoCode: %w", err)
+	}
+	return p, nil
+}
+
+// ListPromoCodes returns one page of promo codes, newest first, and the
+// number of promo codes.
+func (r *Repository) ListPromoCodes(ctx context.Context, q models.PromoCodeQuery) ([]*models.PromoCode, int, error) {
+	offset := (q.Page - 1) * q.Limit
+	query := `
+		SELECT ` + promoCodeColumns + `, COUNT(*) OVER() AS total
+		FROM promo_codes
+		ORDER BY created_at DESC, id
+		LIMIT $1 OFFSET $2`
+
+	rows, err := r.replica.Query(ctx, query, q.Limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("repository.ListPromoCodes.Query: %w", err)
+	}
+	defer rows.Close()
+
+	codes := []*models.PromoCode{}
+	var total int
+	for rows.Next() {
+		p, err := scanPromoCode(rows, &total)
+		if err != nil {
+			return nil, 0, fmt.Errorf("repository.ListPromoCodes.scan: %w", err)
+		}
+		codes = append(codes, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("repository.ListPromoCodes.rows: %w", err)
+	}
+
+	total, err = pageTotal(ctx, r.replica, len(codes), offset, total, `SELECT COUNT(*) FROM promo_codes`)
+	if err != nil {
+		return nil, 0, fmt.Errorf("repository.ListPromoCodes.Count: %w", err)
+	}
+	return codes, total, nil
+}
+
+// DisablePromoCode stops a promo code from being redeemed and returns it.
+// Disabling it again keeps the first DisabledAt.
+func (r *Repository) DisablePromoCode(ctx context.Context, promoCodeID string) (*models.PromoCode, error) {
+	query := `
+		UPDATE promo_codes SET disabled_at = COALESCE(disabled_at, now())
+		WHERE id = $1
+		RETURNING ` + promoCodeColumns
+	p, err := scanPromoCode(r.conn(ctx).QueryRow(ctx, query, promoCodeID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, fmt.Errorf("repository.DisablePromoCode: %w", err)
+	}
+	return p, nil
+}
+
+// FindPromoRedemption returns the promo code redeemed on an order, or
+// ErrNotFound.
+func (r *Repository) FindPromoRedemption(ctx context.Context, orderID string) (*models.PromoRedemption, error) {
+	query := `
+		SELECT pr.promo_code_id, pc.code, pr.order_id, pr.user_id, pr.discount, pr.created_at
+		FROM promo_redemptions pr
+		JOIN promo_codes pc ON pc.id = pr.promo_code_id
+		WHERE pr.order_id = $1`
+	var pr models.PromoRedemption
+	err := r.conn(ctx).QueryRow(ctx, query, orderID).
+		Scan(&pr.PromoCodeID, &pr.Code, &pr.OrderID, &pr.UserID, &pr.Discount, &pr.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrNotFound
+		}
+		return nil, fmt.Errorf("repository.FindPromoRedemption: %w", err)
+	}
+	return &pr, nil
+}
+
+// RedeemPromoCode records pr and counts it against its promo code's limits,
+// setting pr.CreatedAt. It fails with ErrPromoCodeExhausted when the code has
+// reached its limit in all or for the customer.
+func (r *Repository) RedeemPromoCode(ctx context.Context, pr *models.PromoRedemption) error {
+	// Taking the row lock first serializes redemptions of the same code, so
+	// the per-customer count cannot be raced past its limit.
+	query := `
+		UPDATE promo_codes SET redemptions = redemptions + 1
+		WHERE id = $1
+			AND (max_redemptions IS NULL OR redemptions < max_redemptions)
+			AND (max_per_user IS NULL OR max_per_user > (
+				SELECT COUNT(*) FROM promo_redemptions WHERE promo_code_id = $1 AND user_id = $2))`
+	if _, err := r.conn(ctx).Exec(ctx, `SELECT 1 FROM promo_codes WHERE id = $1 FOR UPDATE`, pr.PromoCodeID); err != nil {
+		return fmt.Errorf("repository.RedeemPromoCode.Lock: %w", err)
+	}
+	tag, err := r.conn(ctx).Exec(ctx, query, pr.PromoCodeID, pr.UserID)
+	if err != nil {
+		return fmt.Errorf("repository.RedeemPromoCode: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrPromoCodeExhausted
+	}
+	err = r.conn(ctx).QueryRow(ctx, `
+		INSERT INTO promo_redemptions (order_id, promo_code_id, user_id, discount)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at`, pr.OrderID, pr.PromoCodeID, pr.UserID, pr.Discount).Scan(&pr.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return models.ErrPromoCodeAlreadyApplied
+		}
+		return fmt.Errorf("repository.RedeemPromoCode: %w", err)
+	}
+	return nil
+}
+
+// ReleasePromoRedemption removes the promo code redeemed on an order, if
+// any, and gives the redemption back to the code.
+func (r *Repository) ReleasePromoRedemption(ctx context.Context, orderID string) error {
+	query := `
+		WITH pr AS (DELETE FROM promo_redemptions WHERE order_id = $1 RETURNING promo_code_id)
+		UPDATE promo_codes SET redemptions = redemptions - 1
+		WHERE id IN (SELECT promo_code_id FROM pr)`
+	if _, err := r.conn(ctx).Exec(ctx, query, orderID); err != nil {
+		return fmt.Errorf("repository.ReleasePromoRedemption: %w", err)
+	}
+	return nil
+}
+
+// EnqueueAssignment parks an order in the assignment queue, due immediately.
+// Enqueueing an order that is already queued is a no-op.
+func (r *Repository) EnqueueAssignment(ctx context.Context, orderID, reason string) error {
+	query := `
+		INSERT INTO assignment_queue (order_id, last_error)
+		VALUES ($1, NULLIF($2, ''))
+		ON CONFLICT (order_id) DO NOTHING`
+	if _, err := r.conn(ctx).Exec(ctx, query, orderID, reason); err != nil {
+		return fmt.Errorf("repository.EnqueueAssignment: %w", err)
+	}
+	return nil
+}
+
+// ListDueAssignments returns up to limit queued orders whose next attempt is
+// due: EXPRESS orders first, then oldest first so long-waiting orders get the
+// first idle machines.
+func (r *Repository) ListDueAssignments(ctx context.Context, limit int) ([]models.PendingAssignment, error) {
+	query := `
+		SELECT q.order_id, o.priority, q.attempts, q.enqueued_at
+		FROM assignment_queue q
+		JOIN orders o ON o.id = q.order_id
+		WHERE q.next_attempt_at <= NOW()
+		ORDER BY o.priority = 'EXPRESS' DESC, q.enqueued_at
+		LIMIT $1`
+	rows, err := r.conn(ctx).Query(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListDueAssignments: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []models.PendingAssignment
+	for rows.Next() {
+		var p models.PendingAssignment
+		if err := rows.Scan(&p.OrderID, &p.Priority, &p.Attempts, &p.EnqueuedAt); err != nil {
+			return nil, fmt.Errorf("repository.ListDueAssignments: scan: %w", err)
+		}
+		pending = append(pending, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListDueAssignments: %w", err)
+	}
+	return pending, nil
+}
+
+// RescheduleAssignment records a failed attempt and pushes the next one delay into the future.
+func (r *Repository) RescheduleAssignment(ctx context.Context, orderID string, delay time.Duration, reason string) error {
+	query := `
+		UPDATE assignment_queue
+		SET attempts = attempts + 1,
+			next_attempt_at = NOW() + make_interval(secs => $2),
+			last_error = NULLIF($3, '')
+		WHERE order_id = $1`
+	if _, err := r.conn(ctx).Exec(ctx, query, orderID, delay.Seconds(), reason); err != nil {
+		return fmt.Errorf("repository.RescheduleAssignment: %w", err)
+	}
+	return nil
+}
+
+// LockAssignment locks a queued order for the rest of the unit of work. It
+// returns false if the order is no longer queued or another transaction holds it.
+func (r *Repository) LockAssignment(ctx context.Context, orderID string) (bool, error) {
+	query := `SELECT 1 FROM assignment_queue WHERE order_id = $1 FOR UPDATE SKIP LOCKED`
+	var one int
+	err := r.conn(ctx).QueryRow(ctx, query, orderID).Scan(&one)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("repository.LockAssignment: %w", err)
+	}
+	return true, nil
+}
+
+// DeleteAssignment removes an order from the assignment queue.
+func (r *Repository) DeleteAssignment(ctx context.Context, orderID string) error {
+	if _, err := r.conn(ctx).Exec(ctx, `DELETE FROM assignment_queue WHERE order_id = $1`, orderID); err != nil {
+		return fmt.Errorf("repository.DeleteAssignment: %w", err)
+	}
+	return nil
+}
+
+// ClaimIdempotencyKey records k as in progress and returns nil, or returns
+// the existing record when the key was already used. A claim that was never
+// completed can be taken over with the same request once lease has passed
+// (its request died before finishing), and a key older than
+// models.IdempotencyKeyTTL is reused as if it were new.
+func (r *Repository) ClaimIdempotencyKey(ctx context.Context, k *models.IdempotencyKey, lease time.Duration) (*models.IdempotencyKey, error) {
+	query := `
+		INSERT INTO idempotency_keys (user_id, operation, key, request_hash)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, operation, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, order_id = NULL, completed_at = NULL, created_at = now()
+		WHERE (idempotency_keys.completed_at IS NULL
+				AND idempotency_keys.request_hash = EXCLUDED.request_hash
+				AND idempotency_keys.created_at < now() - make_interval(secs => $5))
+			OR idempotency_keys.created_at < now() - make_interval(secs => $6)
+		RETURNING created_at`
+	err := r.conn(ctx).QueryRow(ctx, query, k.UserID, k.Operation, k.Key, k.RequestHash, lease.Seconds(), models.IdempotencyKeyTTL.Seconds()).
+		Scan(&k.CreatedAt)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("repository.ClaimIdempotencyKey: %w", err)
+	}
+
+	existing := models.IdempotencyKey{UserID: k.UserID, Operation: k.Operation, Key: k.Key}
+	err = r.conn(ctx).QueryRow(ctx, `
+		SELECT request_hash, order_id::text, created_at, completed_at
+		FROM idempotency_keys
+		WHERE user_id = $1 AND operation = $2 AND key = $3`,
+		k.UserID, k.Operation, k.Key,
+	).Scan(&existing.RequestHash, &existing.OrderID, &existing.CreatedAt, &existing.CompletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Released by a failed request between the two statements.
+		return nil, models.ErrIdempotencyKeyInUse
+	}
+	if err != nil {
+		return nil, fmt.Errorf("repository.ClaimIdempotencyKey: %w", err)
+	}
+	return &existing, nil
+}
+
+// CompleteIdempotencyKey stores the order a claimed key produced. Call it
+// inside the same unit of work as the request's own writes.
+func (r *Repository) CompleteIdempotencyKey(ctx context.Context, k *models.IdempotencyKey, orderID string) error {
+	query := `
+		UPDATE idempotency_keys
+		SET order_id = $4, completed_at = now()
+		WHERE user_id = $1 AND operation = $2 AND key = $3`
+	if _, err := r.conn(ctx).Exec(ctx, query, k.UserID, k.Operation, k.Key, orderID); err != nil {
+		return fmt.Errorf("repository.CompleteIdempotencyKey: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes a claim whose request failed, so the client
+// can retry with the same key. Completed keys are kept.
+func (r *Repository) ReleaseIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND operation = $2 AND key = $3 AND completed_at IS NULL`
+	if _, err := r.conn(ctx).Exec(ctx, query, k.UserID, k.Operation, k.Key); err != nil {
+		return fmt.Errorf("repository.ReleaseIdempotencyKey: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes keys created before before and
+// returns how many were deleted.
+func (r *Repository) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := r.conn(ctx).Exec(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("repository.DeleteExpiredIdempotencyKeys: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// CreateWebhookEndpoint registers ep and fills in its ID and creation time.
+func (r *Repository) CreateWebhookEndpoint(ctx context.Context, ep *models.WebhookEndpoint) error {
+	query := `
+		INSERT INTO webhook_endpoints (user_id, url, description, secret)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+		RETURNING id, created_at`
+	if err := r.conn(ctx).QueryRow(ctx, query, ep.UserID, ep.URL, ep.Description, ep.Secret).Scan(&ep.ID, &ep.CreatedAt); err != nil {
+		return fmt.Errorf("repository.CreateWebhookEndpoint: %w", err)
+	}
+	return nil
+}
+
+// ListWebhookEndpoints returns the user's webhook endpoints, oldest first,
+// without their secrets.
+func (r *Repository) ListWebhookEndpoints(ctx context.Context, userID string) ([]*models.WebhookEndpoint, error) {
+	query := `
+		SELECT id, user_id, url, COALESCE(description, ''), created_at
+		FROM webhook_endpoints
+		WHERE user_id = $1
+		ORDER BY created_at, id`
+	rows, err := r.conn(ctx).Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListWebhookEndpoints: %w", err)
+	}
+	defer rows.Close()
+
+	endpoints := []*models.WebhookEndpoint{}
+	for rows.Next() {
+		var ep models.WebhookEndpoint
+		if err := rows.Scan(&ep.ID, &ep.UserID, &ep.URL, &ep.Description, &ep.CreatedAt); err != nil {
+			return nil, fmt.Errorf("repository.ListWebhookEndpoints: %w", err)
+		}
+		endpoints = append(endpoints, &ep)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListWebhookEndpoints: %w", err)
+	}
+	return endpoints, nil
+}
+
+// FindWebhookEndpoint returns an endpoint, without its secret, or
+// models.ErrNotFound.
+func (r *Repository) FindWebhookEndpoint(ctx context.Context, endpointID string) (*models.WebhookEndpoint, error) {
+	query := `
+		SELECT id, user_id, url, COALESCE(description, ''), created_at
+		FROM webhook_endpoints
+		WHERE id = $1`
+	var ep models.WebhookEndpoint
+	err := r.conn(ctx).QueryRow(ctx, query, endpointID).Scan(&ep.ID, &ep.UserID, &ep.URL, &ep.Description, &ep.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("repository.FindWebhookEndpoint: %w", err)
+	}
+	return &ep, nil
+}
+
+// DeleteWebhookEndpoint removes the user's endpoint together with its
+// delivery log.
+func (r *Repository) DeleteWebhookEndpoint(ctx context.Context, endpointID, userID string) error {
+	tag, err := r.conn(ctx).Exec(ctx, `DELETE FROM webhook_endpoints WHERE id = $1 AND user_id = $2`, endpointID, userID)
+	if err != nil {
+		return fmt.Errorf("repository.DeleteWebhookEndpoint: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+// CreateWebhookDeliveries queues a delivery for every status change after
+// the fan-out cursor, and every one since since, to every endpoint its
+// order's owner had registered by then, and moves the cursor to the latest
+// change. The cursor catches up on changes made while the job was not
+// running. since covers changes that commit after the cursor passed them:
+// an event's ID is taken when it is inserted, not when it commits, so since
+// should reach back further than any transaction stays open. Changes already
+// queued are skipped, and the cursor is locked, so overlapping calls are
+// safe.
+func (r *Repository) CreateWebhookDeliveries(ctx context.Context, since time.Time) (int64, error) {
+	query := `
+		WITH cur AS (
+			SELECT last_status_event_id FROM webhook_fanout_cursor FOR UPDATE
+		), ev AS (
+			SELECT ev.id, ev.order_id, ev.from_status, ev.to_status, ev.actor_type, ev.reason, ev.created_at
+			FROM order_status_events ev, cur
+			WHERE ev.id > cur.last_status_event_id OR ev.created_at >= $1
+		), queued AS (
+			INSERT INTO webhook_deliveries (endpoint_id, status_event_id, order_id, event_type, payload)
+			SELECT w.id, ev.id, ev.order_id, $2,
+				jsonb_build_object(
+					'order_id', ev.order_id,
+					'from_status', ev.from_status,
+					'to_status', ev.to_status,
+					'actor_type', ev.actor_type,
+					'reason', ev.reason,
+					'changed_at', ev.created_at)
+			FROM ev
+			JOIN orders o ON o.id = ev.order_id
+			JOIN webhook_endpoints w ON w.user_id = o.user_id AND w.created_at <= ev.created_at
+			ON CONFLICT (endpoint_id, status_event_id) DO NOTHING
+			RETURNING 1
+		), advanced AS (
+			UPDATE webhook_fanout_cursor
+			SET last_status_event_id = (SELECT MAX(id) FROM ev)
+			WHERE last_status_event_id < (SELECT MAX(id) FROM ev)
+		)
+		SELECT count(*) FROM queued`
+	var queued int64
+	if err := r.conn(ctx).QueryRow(ctx, query, since, models.WebhookEventOrderStatusChanged).Scan(&queued); err != nil {
+		return 0, fmt.Errorf("repository.CreateWebhookDeliveries: %w", err)
+	}
+	return queued, nil
+}
+
+// ClaimDueWebhookDeliveries claims up to limit PENDING deliveries whose next
+// attempt is due, oldest due first, and returns them with their endpoint's
+// URL and secret. A claimed delivery is not due again for lease, so another
+// run does not send it meanwhile; RecordWebhookAttempt then sets its real
+// next attempt. Rows another run is claiming are skipped.
+func (r *Repository) ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]models.PendingWebhook, error) {
+	query := `
+		WITH due AS (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'PENDING' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), claimed AS (
+			UPDATE webhook_deliveries d
+			SET next_attempt_at = now() + make_interval(secs => $2)
+			FROM due
+			WHERE d.id = due.id
+			RETURNING d.id, d.endpoint_id, d.order_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at, d.created_at
+		)
+		SELECT c.id, c.endpoint_id, c.order_id, c.event_type, c.payload, c.status, c.attempts, c.next_attempt_at, c.created_at, w.url, w.secret
+		FROM claimed c
+		JOIN webhook_endpoints w ON w.id = c.endpoint_id
+		ORDER BY c.created_at`
+	rows, err := r.conn(ctx).Query(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("repository.ClaimDueWebhookDeliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var due []models.PendingWebhook
+	for rows.Next() {
+		var p models.PendingWebhook
+		if err := rows.Scan(&p.ID, &p.EndpointID, &p.OrderID, &p.EventType, &p.Payload, &p.Status, &p.Attempts, &p.NextAttemptAt, &p.CreatedAt, &p.URL, &p.Secret); err != nil {
+			return nil, fmt.Errorf("repository.ClaimDueWebhookDeliveries: %w", err)
+		}
+		due = append(due, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ClaimDueWebhookDeliveries: %w", err)
+	}
+	return due, nil
+}
+
+// RecordWebhookAttempt logs an attempt and moves the delivery to status; a
+// PENDING delivery is tried again at next.
+func (r *Repository) RecordWebhookAttempt(ctx context.Context, deliveryID string, attempt models.WebhookAttempt, status models.WebhookDeliveryStatus, next *time.Time) error {
+	query := `
+		WITH a AS (
+			INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, duration_ms)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		)
+		UPDATE webhook_deliveries
+		SET attempts = $2, status = $6, next_attempt_at = COALESCE($7, next_attempt_at),
+			last_status_code = $3, last_error = NULLIF($4, ''), last_attempt_at = now()
+		WHERE id = $1`
+	_, err := r.conn(ctx).Exec(ctx, query, deliveryID, attempt.Attempt, attempt.StatusCode, attempt.Error, attempt.DurationMS, status, next)
+	if err != nil {
+		return fmt.Errorf("repository.RecordWebhookAttempt: %w", err)
+	}
+	return nil
+}
+
+// webhookDeliveryColumns are the columns scanned by scanWebhookDelivery.
+const webhookDeliveryColumns = `id, endpoint_id, order_id, event_type, payload, status, attempts, next_attempt_at, last_status_code, COALESCE(last_error, ''), last_attempt_at, created_at`
+
+func scanWebhookDelivery(row pgx.Row) (*models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	var next time.Time
+	err := row.Scan(&d.ID, &d.EndpointID, &d.OrderID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &next,
+		&d.LastStatusCode, &d.LastError, &d.LastAttemptAt, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if d.Status == models.WebhookPending {
+		d.NextAttemptAt = &next
+	}
+	return &d, nil
+}
+
+// ListWebhookDeliveries returns up to limit deliveries of an endpoint, newest
+// first, optionally only those in status.
+func (r *Repository) ListWebhookDeliveries(ctx context.Context, endpointID string, status *models.WebhookDeliveryStatus, limit int) ([]*models.WebhookDelivery, error) {
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE endpoint_id = $1 AND ($2::text IS NULL OR status = $2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3`
+	rows, err := r.replica.Query(ctx, query, endpointID, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListWebhookDeliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []*models.WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("repository.ListWebhookDeliveries: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListWebhookDeliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// FindWebhookDelivery returns a delivery of an endpoint with its attempt
+// log, or models.ErrNotFound.
+func (r *Repository) FindWebhookDelivery(ctx context.Context, endpointID, deliveryID string) (*models.WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = $1 AND endpoint_id = $2`
+	d, err := scanWebhookDelivery(r.replica.QueryRow(ctx, query, deliveryID, endpointID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("repository.FindWebhookDelivery: %w", err)
+	}
+
+	rows, err := r.replica.Query(ctx, `
+		SELECT attempt, status_code, COALESCE(error, ''), duration_ms, created_at
+		FROM webhook_attempts
+		WHERE delivery_id = $1
+		ORDER BY attempt`, deliveryID)
+	if err != nil {
+		return nil, fmt.Errorf("repository.FindWebhookDelivery: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a models.WebhookAttempt
+		if err := rows.Scan(&a.Attempt, &a.StatusCode, &a.Error, &a.DurationMS, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("repository.FindWebhookDelivery: %w", err)
+		}
+		d.AttemptLog = append(d.AttemptLog, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.FindWebhookDelivery: %w", err)
+	}
+	return d, nil
+}
+
+// DeleteOldWebhookDeliveries deletes finished deliveries created before
+// before, with their attempts, and returns how many were deleted.
+func (r *Repository) DeleteOldWebhookDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := r.conn(ctx).Exec(ctx, `DELETE FROM webhook_deliveries WHERE created_at < $1 AND status <> 'PENDING'`, before)
+	if err != nil {
+		return 0, fmt.Errorf("repository.DeleteOldWebhookDeliveries: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
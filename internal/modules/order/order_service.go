@@ -2,208 +2,893 @@ package order
 
 import (
 	"context"
+	"dispatch-and-delivery/internal/database"
 	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/payment"
+	"dispatch-and-delivery/pkg/storage"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"sync"
+	"net/http"
+	"strings"
+	"time"
 )
 
 // LogisticsServiceInterface defines the contract for the logistics service.
 type LogisticsServiceInterface interface {
 	CalculateRouteOptions(ctx context.Context, req models.RouteRequest) ([]models.RouteOption, error)
 	AssignOrder(ctx context.Context, orderID string) (*models.Machine, error)
+	// ReleaseMachine sends the machine of a cancelled order back to base,
+	// within the cancellation's unit of work; RecallMachine pushes its
+	// command once that is committed.
+	ReleaseMachine(ctx context.Context, machineID string) error
+	RecallMachine(ctx context.Context, machineID string) error
 }
 
 // ServiceInterface defines the contract for the order service.
 type ServiceInterface interface {
 	CreateOrder(ctx context.Context, userID string, req models.CreateOrderRequest) (*models.Order, error)
 	GetOrderDetails(ctx context.Context, orderID string, userID string, role string) (*models.Order, error)
-	ListUserOrders(ctx context.Context, userID string, page, limit int) ([]*models.Order, int, error)
-	ListAllOrders(ctx context.Context, page, limit int) ([]*models.Order, int, error)
-	CancelOrder(ctx context.Context, orderID string, userID string) error
-	ConfirmAndPay(ctx context.Context, userID string, orderID string, req models.PaymentRequest) (*models.Order, error)
-	SubmitFeedback(ctx context.Context, userID string, orderID string, req models.FeedbackRequest) error
-	GetDeliveryQuote(ctx context.Context, req models.RouteRequest) ([]models.RouteOption, error)
+	GetOrderHistory(ctx context.Context, orderID string, userID string, role string) ([]*models.OrderStatusEvent, error)
+	ListPayments(ctx context.Context, orderID, userID, role string) ([]*models.Payment, error)
+	ConfirmPayment(ctx context.Context, orderID, userID, role string) (*models.Order, error)
+	ReceiptPDF(ctx context.Context, orderID, userID, role string) ([]byte, error)
+	ListUserOrders(ctx context.Context, userID string, q models.OrderListQuery) (*models.OrderPage, error)
+	ListAllOrders(ctx context.Context, q models.OrderListQuery) (*models.OrderPage, error)
+	ExportOrders(ctx context.Context, q models.OrderExportQuery, w io.Writer) error
+	CancelOrder(ctx context.Context, orderID string, userID string, role string) (*models.OrderCancellation, error)
+	CancellationQuote(ctx context.Context, orderID string, userID string, role string) (*models.CancellationQuote, error)
+	AdminCancelOrder(ctx context.Context, orderID, adminID string, req models.AdminCancelRequest) (*models.OrderCancellation, error)
+	ConfirmDelivery(ctx context.Context, orderID string, userID string, role string, req models.HandoffRequest) error
+	MachineHandoff(ctx context.Context, orderID, machineID string, req models.HandoffRequest) error
+	ConfirmAndPay(ctx context.Context, userID string, orderID string, role string, req models.PaymentRequest) (*models.Order, error)
+	RetryPayment(ctx context.Context, userID string, orderID string, role string, req models.PaymentRequest) (*models.Order, error)
+	AddTip(ctx context.Context, orderID, userID, role string, req models.TipRequest) (*models.Order, error)
+	SubmitFeedback(ctx context.Context, userID string, orderID string, role string, req models.FeedbackRequest) (*models.Feedback, error)
+	ListFeedback(ctx context.Context, q models.FeedbackQuery) (*models.FeedbackPage, error)
+	MachineRatings(ctx context.Context) ([]models.MachineRating, error)
+	ListOrderMessages(ctx context.Context, orderID, userID, role string) ([]*models.OrderMessage, error)
+	PostOrderMessage(ctx context.Context, orderID, userID, role string, req models.OrderMessageRequest) (*models.OrderMessage, error)
+	HideOrderMessage(ctx context.Context, orderID, messageID, adminID string) error
+	UnreadMessages(ctx context.Context, userID, role string) (*models.UnreadMessages, error)
+	GetReturnQuote(ctx context.Context, orderID, userID, role string) (*models.ReturnQuote, error)
+	CreateReturn(ctx context.Context, orderID, userID, role string, req models.CreateReturnRequest) (*models.Order, error)
+	Reorder(ctx context.Context, orderID, userID, role string, req models.ReorderRequest) (*models.Order, error)
+	FileClaim(ctx context.Context, orderID, userID, role string, req models.CreateClaimRequest) (*models.Claim, error)
+	GetClaim(ctx context.Context, orderID, userID, role string) (*models.Claim, error)
+	AddClaimPhoto(ctx context.Context, orderID, userID, role string, r io.Reader, size int64, contentType string) (*models.ClaimPhoto, error)
+	ListClaims(ctx context.Context, q models.ClaimQuery) (*models.ClaimPage, error)
+	DecideClaim(ctx context.Context, claimID, adminID string, req models.ClaimDecisionRequest) (*models.Claim, error)
+	Wallet(ctx context.Context, userID string) (*models.Wallet, error)
+	CreatePromoCode(ctx context.Context, adminID string, req models.CreatePromoCodeRequest) (*models.PromoCode, error)
+	ListPromoCodes(ctx context.Context, q models.PromoCodeQuery) (*models.PromoCodePage, error)
+	DisablePromoCode(ctx context.Context, promoCodeID string) (*models.PromoCode, error)
+	GetDeliveryQuote(ctx context.Context, userID string, req models.RouteRequest) ([]models.RouteOption, error)
+	PurgeRouteQuotes(ctx context.Context) error
+	RetryPendingAssignments(ctx context.Context) error
+	PromoteScheduledOrders(ctx context.Context, lead time.Duration) error
+	CancelUnpaidOrders(ctx context.Context, ttl time.Duration) error
+	PurgeIdempotencyKeys(ctx context.Context) error
+	CreateWebhook(ctx context.Context, userID string, req models.CreateWebhookRequest) (*models.WebhookEndpoint, error)
+	ListWebhooks(ctx context.Context, userID string) ([]*models.WebhookEndpoint, error)
+	DeleteWebhook(ctx context.Context, userID, endpointID string) error
+	ListWebhookDeliveries(ctx context.Context, userID, endpointID string, status *models.WebhookDeliveryStatus, limit int) ([]*models.WebhookDelivery, error)
+	GetWebhookDelivery(ctx context.Context, userID, endpointID, deliveryID string) (*models.WebhookDelivery, error)
+	DeliverWebhooks(ctx context.Context) error
+	PruneWebhookDeliveries(ctx context.Context) error
 }
 
 // PaymentServiceInterface defines the contract for a payment processing service.
 type PaymentServiceInterface interface {
-	ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID string) (string, error)
+	ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID, idempotencyKey string) (string, error)
+	RefundPayment(ctx context.Context, paymentID string, amount float64, idempotencyKey string) (string, error)
+	ChargeCustomer(ctx context.Context, customerID string, amount float64, paymentMethodID, idempotencyKey string) (string, error)
+	PaymentStatus(ctx context.Context, paymentID string) (string, error)
+	CancelPayment(ctx context.Context, paymentID string) error
+	Provider() string
 }
 
 // Service implements the order service logic.
 type Service struct {
 	repo RepositoryInterface
 	// mapsService    MapsServiceInterface // For interacting with an external maps API. (remove)
-	routeCache       map[string]*models.RouteOption // In-memory cache for route options
-	routeCacheLock   sync.RWMutex
+	quoteTTL         time.Duration // How long quoted route options can be ordered
 	paymentService   PaymentServiceInterface
 	logisticsService LogisticsServiceInterface // Inject logistics service
+	txManager        database.Transactor       // Unit of work spanning order and logistics repositories
+	paid             chan struct{}             // Wakes the Dispatcher when an order has been paid
+	webhookClient    *http.Client              // Sends webhook deliveries; see NewWebhookClient
+	storage          storage.Storage           // Claim photos; nil when no storage is configured
+	cancellation     models.CancellationPolicy // Fees for customer cancellations; free when zero
+	insurance        models.InsurancePolicy    // Premiums for declared package values; none offered when zero
 }
 
+// Option configures optional Service collaborators.
+type Option func(*Service)
+
 // NewService creates a new order service.
-func NewService(repo RepositoryInterface /*mapsService MapsServiceInterface,*/, paymentService PaymentServiceInterface, logisticsService LogisticsServiceInterface) *Service {
-	return &Service{
+func NewService(repo RepositoryInterface /*mapsService MapsServiceInterface,*/, paymentService PaymentServiceInterface, logisticsService LogisticsServiceInterface, txManager database.Transactor, opts ...Option) *Service {
+	s := &Service{
 		repo: repo,
 		// mapsService:      mapsService, // remove
-		routeCache:       make(map[string]*models.RouteOption),
+		quoteTTL:         DefaultQuoteTTL,
 		paymentService:   paymentService,
 		logisticsService: logisticsService,
+		txManager:        txManager,
+		paid:             make(chan struct{}, 1),
+		webhookClient:    NewWebhookClient(false),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // CreateOrder creates a new order based on a user's selected route option.
+// With ScheduledPickupTime set the order is booked for a later pickup, and
+// with DeliveryWindow for delivery within a window; see checkSchedule and
+// checkWindow for how they must relate to the option's quote. A request
+// repeated with the same IdempotencyKey returns the order it created.
 func (s *Service) CreateOrder(ctx context.Context, userID string, req models.CreateOrderRequest) (*models.Order, error) {
-	s.routeCacheLock.RLock()
-	routeOption, ok := s.routeCache[req.RouteOptionID]
-	s.routeCacheLock.RUnlock()
-
-	if !ok {
-		return nil, models.ErrRouteOptionExpired
-	}
-
-	// Insert pickup and dropoff addresses, get their IDs
-	pickupAddr := routeOption.PickupLocation
-	pickupAddr.UserID = userID
-	pickupID, err := s.repo.InsertAddress(ctx, &pickupAddr)
+	claim, replay, err := s.claimIdempotencyKey(ctx, userID, opCreateOrder, req.IdempotencyKey, req)
 	if err != nil {
-		return nil, fmt.Errorf("service.CreateOrder: failed to insert pickup address: %w", err)
+		return nil, fmt.Errorf("service.CreateOrder: %w", err)
+	}
+	if replay != nil {
+		return replay, nil
 	}
-	dropoffAddr := routeOption.DeliveryLocation
-	dropoffAddr.UserID = userID
-	dropoffID, err := s.repo.InsertAddress(ctx, &dropoffAddr)
+	order, err := s.createOrder(ctx, userID, req, claim)
 	if err != nil {
-		return nil, fmt.Errorf("service.CreateOrder: failed to insert dropoff address: %w", err)
+		s.releaseIdempotencyKey(ctx, claim)
+		return nil, err
 	}
+	return order, nil
+}
 
-	order, err := s.repo.Create(ctx, userID, req, pickupID, dropoffID)
+// createOrder creates the order for CreateOrder and completes its claimed
+// idempotency key, if any, in the same unit of work.
+func (s *Service) createOrder(ctx context.Context, userID string, req models.CreateOrderRequest, claim *models.IdempotencyKey) (*models.Order, error) {
+	pin, err := newDeliveryPIN()
 	if err != nil {
 		return nil, fmt.Errorf("service.CreateOrder: %w", err)
 	}
+	req.DeliveryPIN = pin
+	var order *models.Order
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		// The quote is used up with the order, or stays if the order fails.
+		routeOption, err := s.repo.TakeRouteQuote(ctx, userID, req.RouteOptionID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := checkSchedule(req.ScheduledPickupTime, routeOption, now); err != nil {
+			return err
+		}
+		if err := checkWindow(req.DeliveryWindow, req.ScheduledPickupTime, routeOption, now); err != nil {
+			return err
+		}
 
-	// Remove the route option from the cache after it has been used.
-	s.routeCacheLock.Lock()
-	delete(s.routeCache, req.RouteOptionID)
-	s.routeCacheLock.Unlock()
+		// Insert pickup and dropoff addresses, get their IDs
+		pickupAddr := routeOption.PickupLocation
+		pickupAddr.UserID = userID
+		pickupID, err := s.repo.InsertAddress(ctx, &pickupAddr)
+		if err != nil {
+			return fmt.Errorf("failed to insert pickup address: %w", err)
+		}
+		dropoffAddr := routeOption.DeliveryLocation
+		dropoffAddr.UserID = userID
+		dropoffID, err := s.repo.InsertAddress(ctx, &dropoffAddr)
+		if err != nil {
+			return fmt.Errorf("failed to insert dropoff address: %w", err)
+		}
 
+		order, err = s.repo.Create(ctx, userID, req, routeOption, pickupID, dropoffID)
+		if err != nil {
+			return err
+		}
+		return s.completeIdempotencyKey(ctx, claim, order.ID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("service.CreateOrder: %w", err)
+	}
 	return order, nil
 }
 
 // GetOrderDetails retrieves a single order's details.
+// Owners can see their orders, admins and support staff any order, the
+// latter read-only, and a machine (RoleMachine) the orders assigned to it.
+// Everyone else gets ErrNotFound so order IDs are not leaked. Only the owner
+// is shown the delivery PIN.
 func (s *Service) GetOrderDetails(ctx context.Context, orderID string, userID string, role string) (*models.Order, error) {
 	order, err := s.repo.FindByID(ctx, orderID)
 	if err != nil {
 		return nil, fmt.Errorf("service.GetOrderDetails: %w", err)
 	}
 
-	// Security check: ensure the user requesting the order is the one who owns it.
-	if order.UserID != userID {
+	if !canView(order, userID, role) {
 		return nil, models.ErrNotFound // Return NotFound to avoid leaking information
 	}
-
+	redactPIN(order, userID)
 	return order, nil
 }
 
-// ListUserOrders retrieves all orders for a specific user.
-func (s *Service) ListUserOrders(ctx context.Context, userID string, page, limit int) ([]*models.Order, int, error) {
-	if page < 1 {
-		page = 1
+// canView reports whether userID, acting in role, may see order.
+func canView(order *models.Order, userID, role string) bool {
+	switch role {
+	case models.RoleAdmin, models.RoleSupport:
+		return true
+	case models.RoleMachine:
+		return order.MachineID != nil && *order.MachineID == userID
 	}
-	if limit < 1 || limit > 100 {
-		limit = 20 // Default/max limit
+	return order.UserID == userID
+}
+
+// GetOrderHistory returns every status change of an order, oldest first. It
+// is visible to the same users as the order itself.
+func (s *Service) GetOrderHistory(ctx context.Context, orderID string, userID string, role string) ([]*models.OrderStatusEvent, error) {
+	if _, err := s.GetOrderDetails(ctx, orderID, userID, role); err != nil {
+		return nil, err
+	}
+	events, err := s.repo.ListStatusEvents(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.GetOrderHistory: %w", err)
+	}
+	return events, nil
+}
+
+// setStatus moves order from the status it was read with to status and
+// appends the change to its history. Call it inside a unit of work so the two
+// cannot diverge. It fails with ErrOrderStatusChanged if the order's status
+// changed since it was read.
+func (s *Service) setStatus(ctx context.Context, order *models.Order, status models.OrderStatus, actor models.StatusActor, actorID, reason string) error {
+	if err := s.repo.UpdateStatusForUser(ctx, order.ID, order.UserID, order.Status, status); err != nil {
+		return err
 	}
-	orders, total, err := s.repo.ListByUserID(ctx, userID, page, limit)
+	from := order.Status
+	return s.repo.InsertStatusEvent(ctx, &models.OrderStatusEvent{
+		OrderID:    order.ID,
+		FromStatus: &from,
+		ToStatus:   status,
+		ActorType:  actor,
+		ActorID:    actorID,
+		Reason:     reason,
+	})
+}
+
+// ownedOrder loads an order for a change made by userID. Staff who can see
+// the order but do not own it get ErrForbidden; other users get ErrNotFound.
+func (s *Service) ownedOrder(ctx context.Context, orderID, userID, role string) (*models.Order, error) {
+	order, err := s.GetOrderDetails(ctx, orderID, userID, role)
 	if err != nil {
-		return nil, 0, fmt.Errorf("service.ListUserOrders: %w", err)
+		return nil, err
 	}
-	return orders, total, nil
+	if order.UserID != userID {
+		return nil, models.ErrForbidden
+	}
+	return order, nil
 }
 
-// ListAllOrders lists all orders in the system.
-func (s *Service) ListAllOrders(ctx context.Context, page, limit int) ([]*models.Order, int, error) {
-	if page < 1 {
-		page = 1
+// ListUserOrders retrieves one page of a user's orders, newest first.
+func (s *Service) ListUserOrders(ctx context.Context, userID string, q models.OrderListQuery) (*models.OrderPage, error) {
+	q = normalizeListQuery(q, 20)
+	if q.After != nil {
+		orders, err := s.repo.ListByUserIDAfter(ctx, userID, q.After, q.Limit+1)
+		if err != nil {
+			return nil, fmt.Errorf("service.ListUserOrders: %w", err)
+		}
+		return keysetPage(orders, q.Limit), nil
 	}
-	if limit < 1 || limit > 100 {
-		limit = 50
+	orders, total, err := s.repo.ListByUserID(ctx, userID, q.Page, q.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("service.ListUserOrders: %w", err)
 	}
-	return s.repo.ListAll(ctx, page, limit)
+	return offsetPage(orders, total, q), nil
 }
 
-// CancelOrder cancels an order for a user.
-func (s *Service) CancelOrder(ctx context.Context, orderID string, userID string) error {
-	// First, retrieve the order to check its current status.
-	order, err := s.GetOrderDetails(ctx, orderID, userID, "user") // This already checks ownership
+// ListAllOrders lists one page of all orders in the system, newest first.
+func (s *Service) ListAllOrders(ctx context.Context, q models.OrderListQuery) (*models.OrderPage, error) {
+	q = normalizeListQuery(q, 50)
+	if q.After != nil {
+		orders, err := s.repo.ListAllAfter(ctx, q.After, q.Limit+1)
+		if err != nil {
+			return nil, fmt.Errorf("service.ListAllOrders: %w", err)
+		}
+		redactPINs(orders)
+		return keysetPage(orders, q.Limit), nil
+	}
+	orders, total, err := s.repo.ListAll(ctx, q.Page, q.Limit)
 	if err != nil {
-		return err // Either not found or another DB error
+		return nil, fmt.Errorf("service.ListAllOrders: %w", err)
 	}
+	redactPINs(orders)
+	return offsetPage(orders, total, q), nil
+}
 
-	// Business logic: an order can only be cancelled if it's in a 'PENDING_PAYMENT' state.
-	if order.Status != "PENDING_PAYMENT" {
-		return models.ErrOrderCannotBeCancelled
+// normalizeListQuery clamps the page number and size; out-of-range limits
+// fall back to defaultLimit.
+func normalizeListQuery(q models.OrderListQuery, defaultLimit int) models.OrderListQuery {
+	if q.Page < 1 {
+		q.Page = 1
 	}
+	if q.Limit < 1 || q.Limit > 100 {
+		q.Limit = defaultLimit
+	}
+	return q
+}
 
-	return s.repo.UpdateStatusForUser(ctx, orderID, userID, "CANCELLED")
+// keysetPage builds a cursor page from up to limit+1 orders: the extra order
+// only tells that there is a next page.
+func keysetPage(orders []*models.Order, limit int) *models.OrderPage {
+	if orders == nil {
+		orders = []*models.Order{}
+	}
+	page := &models.OrderPage{Orders: orders}
+	if len(orders) > limit {
+		page.Orders = orders[:limit]
+		page.NextCursor = orderCursor(page.Orders[limit-1]).Encode()
+	}
+	return page
 }
 
-// ConfirmAndPay confirms and pays for an order.
-func (s *Service) ConfirmAndPay(ctx context.Context, userID string, orderID string, req models.PaymentRequest) (*models.Order, error) {
-	// 1. Get the order details, ensuring it belongs to the user.
-	order, err := s.GetOrderDetails(ctx, orderID, userID, "user")
+// offsetPage builds an offset page. It also carries a cursor to the next
+// page, so clients can switch to keyset paging after the first request.
+func offsetPage(orders []*models.Order, total int, q models.OrderListQuery) *models.OrderPage {
+	if orders == nil {
+		orders = []*models.Order{}
+	}
+	page := &models.OrderPage{Orders: orders, Total: &total}
+	if n := len(orders); n > 0 && (q.Page-1)*q.Limit+n < total {
+		page.NextCursor = orderCursor(orders[n-1]).Encode()
+	}
+	return page
+}
+
+func orderCursor(o *models.Order) models.OrderCursor {
+	return models.OrderCursor{CreatedAt: o.CreatedAt, ID: o.ID}
+}
+
+// WithCancellationPolicy sets the fees customers pay to cancel paid orders.
+// Without it they cancel free of charge.
+func WithCancellationPolicy(p models.CancellationPolicy) Option {
+	return func(s *Service) { s.cancellation = p }
+}
+
+// CancelOrder cancels the customer's order. An unpaid order is cancelled free
+// of charge. A paid order that no machine has reached the dropoff with yet is
+// cancelled for the fee of the service's CancellationPolicy: it leaves the
+// assignment queue, its machine is released and, if it was carrying the
+// order, sent back to base, and the payment less the fee is refunded.
+//
+// As in AdminCancelOrder the refund happens after the cancellation has been
+// committed; if it fails the order stays cancelled with ErrRefundFailed and
+// cancelling it again retries the refund.
+func (s *Service) CancelOrder(ctx context.Context, orderID string, userID string, role string) (*models.OrderCancellation, error) {
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
 	if err != nil {
-		return nil, err // Handles not found or not authorized
+		return nil, err
+	}
+	paymentID, refundID, err := s.repo.GetPaymentRefs(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.CancelOrder: %w", err)
 	}
+	refundDue := paymentID != "" && refundID == ""
 
-	// 2. Check if the order can be paid for.
-	if order.Status != "PENDING_PAYMENT" {
-		return nil, models.ErrOrderCannotBePaid
+	var fee float64
+	if order.Status == models.OrderStatusCancelled {
+		if !refundDue {
+			return nil, models.ErrOrderCannotBeCancelled
+		}
+		if order.CancellationFee != nil {
+			fee = *order.CancellationFee
+		}
+	} else {
+		var ok bool
+		fee, ok = s.cancellation.Fee(order.Status, order.Cost)
+		if !ok {
+			return nil, models.ErrOrderCannotBeCancelled
+		}
+		if !refundDue {
+			fee = 0
+		}
+		if order.Status == models.OrderStatusPendingPayment || order.Status == models.OrderStatusPaymentFailed {
+			if err := s.abandonPaymentAction(ctx, order, "cancelled with the order"); err != nil {
+				if errors.Is(err, models.ErrPaymentActionPending) {
+					return nil, err
+				}
+				return nil, fmt.Errorf("service.CancelOrder: %w", err)
+			}
+		}
+		reason := "cancelled by customer"
+		if fee > 0 {
+			reason = fmt.Sprintf("cancelled by customer for a fee of %.2f", fee)
+		}
+		err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+			if err := s.setStatus(ctx, order, models.OrderStatusCancelled, models.ActorUser, userID, reason); err != nil {
+				return err
+			}
+			if order.Status == models.OrderStatusPendingPayment || order.Status == models.OrderStatusPaymentFailed {
+				return nil
+			}
+			if refundDue {
+				if err := s.repo.SetCancellationFee(ctx, orderID, fee); err != nil {
+					return err
+				}
+			}
+			if err := s.repo.DeleteAssignment(ctx, orderID); err != nil {
+				return err
+			}
+			if order.MachineID != nil {
+				if err := s.logisticsService.ReleaseMachine(ctx, *order.MachineID); err != nil {
+					return err
+				}
+			}
+			event := map[string]any{
+				"order_id": orderID,
+				"user_id":  order.UserID,
+				"reason":   reason,
+				"fee":      fee,
+			}
+			return s.repo.InsertOutboxEvent(ctx, orderID, "order.cancelled", event)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("service.CancelOrder: %w", err)
+		}
+		// The released machine returns to base with the package, and is
+		// dispatched again once it reports back there. Its command was
+		// queued with the cancellation and is pushed now; failing to push it
+		// does not undo the cancellation, as the machine also polls for it.
+		if order.MachineID != nil {
+			if err := s.logisticsService.RecallMachine(ctx, *order.MachineID); err != nil {
+				log.Printf("CancelOrder: recalling machine %s for order %s failed: %v", *order.MachineID, orderID, err)
+			}
+		}
 	}
 
-	// 3. Process payment through the payment service.
-	_, err = s.paymentService.ProcessPayment(ctx, userID, order.Cost, req.PaymentMethodID)
+	// A tip given at payment time is refunded in full.
+	result := &models.OrderCancellation{Fee: fee}
+	if amount := roundCents(order.Cost - fee + order.Tip); refundDue && amount > 0 {
+		result.RefundID, err = s.refundOrder(ctx, order, paymentID, amount)
+		if err != nil {
+			return nil, fmt.Errorf("service.CancelOrder: %w", err)
+		}
+		result.RefundAmount = amount
+	}
+
+	result.Order, err = s.repo.FindByID(ctx, orderID)
 	if err != nil {
-		return nil, fmt.Errorf("payment processing failed: %w", err)
+		return nil, fmt.Errorf("service.CancelOrder: %w", err)
 	}
+	return result, nil
+}
 
-	// 4. Update order status to 'CONFIRMED' after successful payment.
-	err = s.repo.UpdateStatusForUser(ctx, orderID, userID, "CONFIRMED")
+// CancellationQuote returns the fee and refund that cancelling the customer's
+// order now would come to, or ErrOrderCannotBeCancelled.
+func (s *Service) CancellationQuote(ctx context.Context, orderID string, userID string, role string) (*models.CancellationQuote, error) {
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
 	if err != nil {
-		log.Printf("CRITICAL: Payment processed for order %s but failed to update status: %v", orderID, err)
-		return nil, fmt.Errorf("failed to update order status after successful payment: %w", err)
+		return nil, err
 	}
+	fee, ok := s.cancellation.Fee(order.Status, order.Cost)
+	if !ok {
+		return nil, models.ErrOrderCannotBeCancelled
+	}
+	paymentID, refundID, err := s.repo.GetPaymentRefs(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.CancellationQuote: %w", err)
+	}
+	if paymentID == "" || refundID != "" {
+		return &models.CancellationQuote{}, nil
+	}
+	return &models.CancellationQuote{Fee: fee, RefundAmount: roundCents(order.Cost - fee + order.Tip)}, nil
+}
 
-	// 5. 查出最新订单
-	updatedOrder, err := s.repo.FindByID(ctx, orderID)
+// AdminCancelOrder cancels an order that is not finished yet on behalf of an
+// operator, recording req.Reason in its history. The order leaves the
+// assignment queue, and its machine, if any, returns to IDLE unless it is
+// still carrying other orders. A paid order is then refunded in full.
+//
+// The refund is an external call and happens after the cancellation has been
+// committed. If it fails the order stays cancelled with ErrRefundFailed;
+// calling AdminCancelOrder again retries the refund, which the provider
+// deduplicates by order.
+func (s *Service) AdminCancelOrder(ctx context.Context, orderID, adminID string, req models.AdminCancelRequest) (*models.OrderCancellation, error) {
+	order, err := s.repo.FindByID(ctx, orderID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch updated order after payment: %w", err)
+		return nil, fmt.Errorf("service.AdminCancelOrder: %w", err)
+	}
+	paymentID, refundID, err := s.repo.GetPaymentRefs(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.AdminCancelOrder: %w", err)
+	}
+	refundDue := paymentID != "" && refundID == ""
+
+	switch order.Status {
+	case models.OrderStatusDelivered, models.OrderStatusFailed:
+		return nil, models.ErrOrderCannotBeCancelled
+	case models.OrderStatusCancelled:
+		if !refundDue {
+			return nil, models.ErrOrderCannotBeCancelled
+		}
+	default:
+		if order.Status == models.OrderStatusPendingPayment || order.Status == models.OrderStatusPaymentFailed {
+			if err := s.abandonPaymentAction(ctx, order, "cancelled with the order"); err != nil {
+				if errors.Is(err, models.ErrPaymentActionPending) {
+					return nil, err
+				}
+				return nil, fmt.Errorf("service.AdminCancelOrder: %w", err)
+			}
+		}
+		err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+			if err := s.setStatus(ctx, order, models.OrderStatusCancelled, models.ActorAdmin, adminID, req.Reason); err != nil {
+				return err
+			}
+			if err := s.repo.DeleteAssignment(ctx, orderID); err != nil {
+				return err
+			}
+			if order.MachineID != nil {
+				if err := s.logisticsService.ReleaseMachine(ctx, *order.MachineID); err != nil {
+					return err
+				}
+			}
+			event := map[string]string{
+				"order_id": orderID,
+				"user_id":  order.UserID,
+				"admin_id": adminID,
+				"reason":   req.Reason,
+			}
+			return s.repo.InsertOutboxEvent(ctx, orderID, "order.cancelled", event)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("service.AdminCancelOrder: %w", err)
+		}
+		if order.MachineID != nil {
+			if err := s.logisticsService.RecallMachine(ctx, *order.MachineID); err != nil {
+				log.Printf("AdminCancelOrder: recalling machine %s for order %s failed: %v", *order.MachineID, orderID, err)
+			}
+		}
 	}
 
-	// 6. Call logisticsService.AssignOrder after payment and status update
-	_, err = s.logisticsService.AssignOrder(ctx, updatedOrder.ID)
+	result := &models.OrderCancellation{}
+	// A customer who cancelled still pays their fee when the refund is retried
+	// from here.
+	amount := roundCents(order.Cost + order.Tip)
+	if order.CancellationFee != nil {
+		amount = roundCents(amount - *order.CancellationFee)
+	}
+	if refundDue && amount > 0 {
+		result.RefundID, err = s.refundOrder(ctx, order, paymentID, amount)
+		if err != nil {
+			return nil, fmt.Errorf("service.AdminCancelOrder: %w", err)
+		}
+		result.RefundAmount = amount
+	}
+
+	result.Order, err = s.repo.FindByID(ctx, orderID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to assign delivery after payment: %w", err)
+		return nil, fmt.Errorf("service.AdminCancelOrder: %w", err)
 	}
+	redactPIN(result.Order, adminID)
+	return result, nil
+}
 
-	return updatedOrder, nil
+// refundOrder refunds amount of the order's payment and records the refund
+// with an "order.refunded" event. The provider deduplicates refunds by order,
+// so a failed attempt can be retried.
+func (s *Service) refundOrder(ctx context.Context, order *models.Order, paymentID string, amount float64) (string, error) {
+	refundID, err := s.paymentService.RefundPayment(ctx, paymentID, amount, "order-refund-"+order.ID)
+	s.recordPayment(ctx, order, models.PaymentKindRefund, amount, refundID, err)
+	if err != nil {
+		log.Printf("refund of payment %s for order %s failed: %v", paymentID, order.ID, err)
+		return "", fmt.Errorf("%w: %w", models.ErrRefundFailed, err)
+	}
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.SetRefundID(ctx, order.ID, refundID); err != nil {
+			return err
+		}
+		event := map[string]any{
+			"order_id":   order.ID,
+			"user_id":    order.UserID,
+			"payment_id": paymentID,
+			"refund_id":  refundID,
+			"amount":     amount,
+		}
+		return s.repo.InsertOutboxEvent(ctx, order.ID, "order.refunded", event)
+	})
+	if err != nil {
+		log.Printf("CRITICAL: Refund %s issued for order %s but was not recorded: %v", refundID, order.ID, err)
+		return "", err
+	}
+	return refundID, nil
+}
+
+// ConfirmAndPay confirms and pays for an order. A request repeated with the
+// same IdempotencyKey returns the paid order without charging again. If the
+// charge is declined the order moves to PAYMENT_FAILED and RetryPayment pays
+// for it; if the provider fails otherwise it stays as it is.
+// If the customer has to authenticate the charge, the order is returned
+// unpaid with a PaymentAction and ConfirmPayment completes it.
+func (s *Service) ConfirmAndPay(ctx context.Context, userID string, orderID string, role string, req models.PaymentRequest) (*models.Order, error) {
+	return s.payOrder(ctx, opPayOrder, models.OrderStatusPendingPayment, userID, orderID, role, req)
 }
 
-// SubmitFeedback allows a user to submit feedback for a completed order.
-// Note: This functionality is not available in the current database schema
-// as there are no feedback fields in the orders table.
-func (s *Service) SubmitFeedback(ctx context.Context, userID string, orderID string, req models.FeedbackRequest) error {
-	order, err := s.GetOrderDetails(ctx, orderID, userID, "user")
+// RetryPayment pays for an order in PAYMENT_FAILED, typically with another
+// payment method, like ConfirmAndPay. Its Idempotency-Keys are separate from
+// those of ConfirmAndPay.
+func (s *Service) RetryPayment(ctx context.Context, userID string, orderID string, role string, req models.PaymentRequest) (*models.Order, error) {
+	return s.payOrder(ctx, opRetryPayment, models.OrderStatusPaymentFailed, userID, orderID, role, req)
+}
+
+// payOrder claims the request's idempotency key for op and pays for an order
+// in status from.
+func (s *Service) payOrder(ctx context.Context, op string, from models.OrderStatus, userID string, orderID string, role string, req models.PaymentRequest) (*models.Order, error) {
+	request := struct {
+		OrderID string `json:"order_id"`
+		models.PaymentRequest
+	}{orderID, req}
+	claim, replay, err := s.claimIdempotencyKey(ctx, userID, op, req.IdempotencyKey, request)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("service.ConfirmAndPay: %w", err)
 	}
-	if order.Status != "DELIVERED" {
-		return models.ErrCannotSubmitFeedback
+	if replay != nil {
+		return replay, nil
 	}
-	if order.Feedback != nil {
-		return models.ErrFeedbackAlreadySubmitted
+	order, err := s.confirmAndPay(ctx, userID, orderID, role, from, req, claim)
+	if err != nil {
+		s.releaseIdempotencyKey(ctx, claim)
+		return nil, err
 	}
-	return s.repo.InsertFeedback(ctx, orderID, req)
+	// A payment waiting for authentication is not complete: a retry with
+	// the key gets the provider's same answer, and the same action.
+	if order.PaymentAction != nil {
+		s.releaseIdempotencyKey(ctx, claim)
+	}
+	return order, nil
 }
 
-func (s *Service) GetDeliveryQuote(ctx context.Context, req models.RouteRequest) ([]models.RouteOption, error) {
-	return s.logisticsService.CalculateRouteOptions(ctx, req)
+// confirmAndPay pays for the order for payOrder and completes its claimed
+// idempotency key, if any, together with the confirmation.
+func (s *Service) confirmAndPay(ctx context.Context, userID string, orderID string, role string, from models.OrderStatus, req models.PaymentRequest, claim *models.IdempotencyKey) (*models.Order, error) {
+	// 1. Get the order details, ensuring it belongs to the user.
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err // Handles not found or not authorized
+	}
+
+	// 2. Check if the order can be paid for: ConfirmAndPay pays for new
+	// orders, RetryPayment for those whose payment failed.
+	if order.Status != from {
+		return nil, models.ErrOrderCannotBePaid
+	}
+
+	// 3. A saved card is charged on behalf of the user's provider customer.
+	customerID, paymentMethodID, err := s.paymentMethod(ctx, userID, req.PaymentMethodID, req.SavedPaymentMethodID)
+	if err != nil {
+		if errors.Is(err, models.ErrPaymentMethodNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("service.ConfirmAndPay: %w", err)
+	}
+
+	// 4. Apply the promo code, if any, so the discounted cost is charged.
+	// It is released again if the charge fails.
+	promoCode := strings.ToUpper(strings.TrimSpace(req.PromoCode))
+	releasePromo := func() {}
+	if promoCode != "" {
+		discounted, applied, err := s.applyPromoCode(ctx, order, promoCode)
+		if err != nil {
+			return nil, err
+		}
+		if applied {
+			original := order
+			releasePromo = func() { s.releasePromoCode(context.WithoutCancel(ctx), original) }
+		}
+		order = discounted
+	}
+
+	// 5. Process payment through the payment service.
+	// The charge is an external call and cannot take part in the database
+	// transaction, so it happens first; everything after it is atomic.
+	// With an idempotency key the provider deduplicates the charge too, so a
+	// retry after a failed confirmation does not charge twice.
+	// A tip is charged together with the order but recorded apart from it.
+	// An order a promo code discounted to nothing is confirmed without a
+	// charge, unless it is tipped.
+	tip := roundCents(req.Tip)
+	free := promoCode != "" && order.Cost == 0 && tip == 0
+	var paymentID string
+	if !free {
+		paymentID, err = s.charge(ctx, userID, customerID, paymentMethodID, roundCents(order.Cost+tip), paymentIdempotencyKey(claim))
+		s.recordPayment(ctx, order, models.PaymentKindCharge, order.Cost, paymentID, err)
+		if tip > 0 {
+			s.recordPayment(ctx, order, models.PaymentKindTip, tip, paymentID, err)
+		}
+		// The customer authenticates the charge and then confirms the payment
+		// with ConfirmPayment; until then the order, and any promo code
+		// applied to it, stay as they are.
+		var action *payment.ActionRequiredError
+		if errors.As(err, &action) {
+			order.PaymentAction = &models.PaymentAction{
+				Status:       payment.StatusRequiresAction,
+				PaymentID:    action.PaymentID,
+				ClientSecret: action.ClientSecret,
+			}
+			return order, nil
+		}
+		// Only a declined charge fails the order's payment. After any other
+		// error the order stays as it is, and the client retries the request
+		// with the same key to learn whether the charge went through.
+		if err != nil {
+			releasePromo()
+			var declined *payment.DeclinedError
+			if errors.As(err, &declined) {
+				s.markPaymentFailed(ctx, order, userID, err)
+			}
+			return nil, chargeError(err)
+		}
+	}
+	var reason string
+	switch {
+	case free:
+		reason = "paid in full with promo code " + promoCode
+	case promoCode != "":
+		reason = "paid with promo code " + promoCode + " and payment " + paymentID
+	default:
+		reason = "paid with payment " + paymentID
+	}
+
+	// 6. Confirm the order. If it was cancelled while it was being charged,
+	// e.g. by CancelUnpaidOrders, the charge pays for nothing.
+	var paid *models.Order
+	if paymentID != "" {
+		paid, err = s.confirmCharged(ctx, order, userID, paymentID, tip, reason, claim)
+	} else {
+		paid, err = s.completePayment(ctx, order, userID, paymentID, tip, reason, claim, nil)
+	}
+	if errors.Is(err, models.ErrOrderStatusChanged) {
+		if paymentID != "" {
+			s.refundCharge(ctx, order, paymentID, roundCents(order.Cost+tip))
+		}
+		return nil, models.ErrOrderCannotBePaid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("service.ConfirmAndPay: %w", err)
+	}
+	return paid, nil
+}
+
+// confirmAttempts is how many times confirmCharged tries to confirm an order
+// before it refunds the charge, waiting confirmRetryDelay after the first
+// failure and twice as long after each next one.
+const (
+	confirmAttempts   = 3
+	confirmRetryDelay = 50 * time.Millisecond
+)
+
+// confirmCharged confirms an order charged with paymentID like
+// completePayment. The money is already taken, so a confirmation that fails
+// is retried, even if the request is cancelled meanwhile. If it keeps failing
+// the charge is refunded and claim is completed with the unpaid order: a
+// retry with the same key would get the refunded charge back from the
+// provider, so it gets the unpaid order instead, and the customer pays with
+// a new key. An order that left its status fails with ErrOrderStatusChanged
+// as with completePayment, unless an attempt that seemed to fail confirmed it.
+func (s *Service) confirmCharged(ctx context.Context, order *models.Order, userID, paymentID string, tip float64, reason string, claim *models.IdempotencyKey) (*models.Order, error) {
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	for attempt := 0; attempt < confirmAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(confirmRetryDelay << (attempt - 1))
+		}
+		var paid *models.Order
+		paid, err = s.completePayment(ctx, order, userID, paymentID, tip, reason, claim, nil)
+		if err == nil {
+			return paid, nil
+		}
+		if errors.Is(err, models.ErrOrderStatusChanged) {
+			if attempt == 0 {
+				return nil, err
+			}
+			// The commit of an earlier attempt may have failed only to
+			// report back.
+			current, findErr := s.repo.FindByID(ctx, order.ID)
+			if findErr == nil && (current.Status == models.OrderStatusConfirmed || current.Status == models.OrderStatusScheduled) {
+				return current, nil
+			}
+			return nil, err
+		}
+	}
+	s.refundCharge(ctx, order, paymentID, roundCents(order.Cost+tip))
+	if claim != nil {
+		if err := s.repo.CompleteIdempotencyKey(ctx, claim, order.ID); err != nil {
+			log.Printf("confirmCharged: completing key %s of order %s: %v", claim.Key, order.ID, err)
+		}
+	}
+	return nil, err
+}
+
+// completePayment confirms an order paid with paymentID, or at no charge when
+// it is empty, queues it for dispatch and records the "order.paid" and
+// "order.confirmed" events in one unit of work: either all of them are
+// committed or none is. Scheduled orders wait in SCHEDULED instead of being
+// queued, and PromoteScheduledOrders queues them shortly before their pickup
+// time. Machine selection and maps calls happen in the background
+// Dispatcher, so payment latency does not depend on them and failed
+// assignments are retried. "order.confirmed" is kept for consumers written
+// before payment and assignment were split; it no longer carries a machine.
+// settle, if set, runs first in the same unit of work. It fails with
+// ErrOrderStatusChanged if the order left the status it was read with.
+func (s *Service) completePayment(ctx context.Context, order *models.Order, userID, paymentID string, tip float64, reason string, claim *models.IdempotencyKey, settle func(ctx context.Context) error) (*models.Order, error) {
+	orderID := order.ID
+	scheduled := order.ScheduledPickupTime != nil
+	var updatedOrder *models.Order
+	err := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if settle != nil {
+			if err := settle(ctx); err != nil {
+				return err
+			}
+		}
+		status := models.OrderStatusConfirmed
+		if scheduled {
+			status = models.OrderStatusScheduled
+		}
+		if err := s.setStatus(ctx, order, status, models.ActorUser, userID, reason); err != nil {
+			return fmt.Errorf("failed to update order status: %w", err)
+		}
+		if paymentID != "" {
+			if err := s.repo.SetPaymentID(ctx, orderID, paymentID); err != nil {
+				return err
+			}
+		}
+		if order.PaymentFailureReason != nil {
+			if err := s.repo.SetPaymentFailure(ctx, orderID, nil); err != nil {
+				return err
+			}
+		}
+		if tip > 0 {
+			if err := s.repo.SetTip(ctx, orderID, tip, tipBreakdown(order.CostBreakdown, tip)); err != nil {
+				return err
+			}
+		}
+		if !scheduled {
+			if err := s.repo.EnqueueAssignment(ctx, orderID, ""); err != nil {
+				return err
+			}
+		}
+
+		event := map[string]string{
+			"order_id":   orderID,
+			"user_id":    userID,
+			"payment_id": paymentID,
+		}
+		if err := s.repo.InsertOutboxEvent(ctx, orderID, "order.paid", event); err != nil {
+			return err
+		}
+		if err := s.repo.InsertOutboxEvent(ctx, orderID, "order.confirmed", event); err != nil {
+			return err
+		}
+		if err := s.completeIdempotencyKey(ctx, claim, orderID); err != nil {
+			return err
+		}
+
+		var err error
+		updatedOrder, err = s.repo.FindByID(ctx, orderID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch updated order: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		if paymentID != "" {
+			log.Printf("CRITICAL: Payment %s processed for order %s but confirmation was rolled back: %v", paymentID, orderID, err)
+		}
+		return nil, err
+	}
+
+	// The order is committed; wake this instance's dispatcher instead of
+	// waiting for its next poll.
+	if !scheduled {
+		s.notifyPaid()
+	}
+	return updatedOrder, nil
 }
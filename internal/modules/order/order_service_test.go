@@ -0,0 +1,1958 @@
+package order
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/payment"
+	"dispatch-and-delivery/pkg/storage"
+)
+
+func TestConfirmDelivery(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusInProgress, DeliveryPIN: "123456"}
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	pin := models.HandoffRequest{PIN: "123456"}
+
+	// The machine has not reached the dropoff geofence yet.
+	if err := svc.ConfirmDelivery(ctx, "o1", "u1", models.RoleCustomer, pin); !errors.Is(err, models.ErrOrderCannotBeConfirmed) {
+		t.Fatalf("ConfirmDelivery before arrival error = %v; want ErrOrderCannotBeConfirmed", err)
+	}
+
+	repo.orders["o1"].Status = models.OrderStatusArrived
+	if err := svc.ConfirmDelivery(ctx, "o1", "u2", models.RoleCustomer, pin); err == nil {
+		t.Fatal("ConfirmDelivery by another user succeeded")
+	}
+	if err := svc.ConfirmDelivery(ctx, "o1", "u1", models.RoleCustomer, models.HandoffRequest{PIN: "654321"}); !errors.Is(err, models.ErrInvalidDeliveryPIN) {
+		t.Fatalf("ConfirmDelivery with wrong PIN error = %v; want ErrInvalidDeliveryPIN", err)
+	}
+	if got := repo.orders["o1"].Status; got != models.OrderStatusArrived {
+		t.Fatalf("status after wrong PIN = %s; want ARRIVED", got)
+	}
+	if err := svc.ConfirmDelivery(ctx, "o1", "u1", models.RoleCustomer, pin); err != nil {
+		t.Fatalf("ConfirmDelivery error: %v", err)
+	}
+	if got := repo.orders["o1"].Status; got != models.OrderStatusDelivered {
+		t.Errorf("status = %s; want DELIVERED", got)
+	}
+	if !slices.Equal(repo.events, []string{"order.delivered"}) {
+		t.Errorf("outbox events = %v; want [order.delivered]", repo.events)
+	}
+
+	// An order cancelled while the PIN was checked is not delivered.
+	repo.orders["o2"] = &models.Order{ID: "o2", UserID: "u1", Status: models.OrderStatusArrived, DeliveryPIN: "123456"}
+	racing := NewService(cancellingPINRepo{repo}, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	if err := racing.ConfirmDelivery(ctx, "o2", "u1", models.RoleCustomer, pin); !errors.Is(err, models.ErrOrderCannotBeConfirmed) {
+		t.Errorf("ConfirmDelivery of a cancelled order error = %v; want ErrOrderCannotBeConfirmed", err)
+	}
+	if got := repo.orders["o2"].Status; got != models.OrderStatusCancelled || len(repo.events) != 1 {
+		t.Errorf("status = %s with %d events; want CANCELLED and no new event", got, len(repo.events))
+	}
+}
+
+// cancellingPINRepo cancels each order while its delivery PIN is checked.
+type cancellingPINRepo struct{ *fakeRepo }
+
+func (r cancellingPINRepo) CheckDeliveryPIN(ctx context.Context, orderID, pin string) (bool, error) {
+	r.orders[orderID].Status = models.OrderStatusCancelled
+	return r.fakeRepo.CheckDeliveryPIN(ctx, orderID, pin)
+}
+
+func TestGetOrderDetailsRoles(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	m1 := "m1"
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusInProgress, MachineID: &m1, DeliveryPIN: "123456"}
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+
+	for _, tc := range []struct {
+		name, userID, role string
+		visible, pin       bool
+	}{
+		{"owner", "u1", models.RoleCustomer, true, true},
+		{"other customer", "u2", models.RoleCustomer, false, false},
+		{"admin", "a1", models.RoleAdmin, true, false},
+		{"support", "s1", models.RoleSupport, true, false},
+		{"assigned machine", "m1", models.RoleMachine, true, false},
+		{"other machine", "m2", models.RoleMachine, false, false},
+		{"customer posing as the machine", "m1", models.RoleCustomer, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order, err := svc.GetOrderDetails(ctx, "o1", tc.userID, tc.role)
+			if !tc.visible {
+				if !errors.Is(err, models.ErrNotFound) {
+					t.Errorf("error = %v; want ErrNotFound", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetOrderDetails error: %v", err)
+			}
+			if got := order.DeliveryPIN != ""; got != tc.pin {
+				t.Errorf("DeliveryPIN shown = %v; want %v", got, tc.pin)
+			}
+		})
+	}
+}
+
+func TestDeliveryPIN(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	options, err := svc.GetDeliveryQuote(ctx, "u1", models.RouteRequest{})
+	if err != nil {
+		t.Fatalf("GetDeliveryQuote error: %v", err)
+	}
+	order, err := svc.CreateOrder(ctx, "u1", models.CreateOrderRequest{RouteOptionID: options[0].ID})
+	if err != nil {
+		t.Fatalf("CreateOrder error: %v", err)
+	}
+	if len(order.DeliveryPIN) != models.DeliveryPINLength {
+		t.Fatalf("DeliveryPIN = %q; want %d digits", order.DeliveryPIN, models.DeliveryPINLength)
+	}
+	// Only the customer is shown the PIN.
+	if got, _ := svc.GetOrderDetails(ctx, order.ID, "admin", models.RoleAdmin); got.DeliveryPIN != "" {
+		t.Errorf("admin sees DeliveryPIN %q", got.DeliveryPIN)
+	}
+	if got, _ := svc.GetOrderDetails(ctx, order.ID, "u1", models.RoleCustomer); got.DeliveryPIN != order.DeliveryPIN {
+		t.Errorf("customer sees DeliveryPIN %q; want %q", got.DeliveryPIN, order.DeliveryPIN)
+	}
+
+	machine := "m1"
+	repo.orders[order.ID].MachineID = &machine
+	repo.orders[order.ID].Status = models.OrderStatusInProgress
+	pin := models.HandoffRequest{PIN: order.DeliveryPIN}
+	if err := svc.MachineHandoff(ctx, order.ID, "m2", pin); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("MachineHandoff by another machine error = %v; want ErrNotFound", err)
+	}
+	wrong := models.HandoffRequest{PIN: "000000"}
+	if order.DeliveryPIN == wrong.PIN {
+		wrong.PIN = "111111"
+	}
+	for i := 0; i < models.MaxDeliveryPINAttempts; i++ {
+		if err := svc.MachineHandoff(ctx, order.ID, machine, wrong); !errors.Is(err, models.ErrInvalidDeliveryPIN) {
+			t.Fatalf("MachineHandoff with wrong PIN error = %v; want ErrInvalidDeliveryPIN", err)
+		}
+	}
+	// Too many wrong PINs lock the handover, even with the right one.
+	if err := svc.MachineHandoff(ctx, order.ID, machine, pin); !errors.Is(err, models.ErrDeliveryPINLocked) {
+		t.Fatalf("MachineHandoff after %d wrong PINs error = %v; want ErrDeliveryPINLocked", models.MaxDeliveryPINAttempts, err)
+	}
+
+	repo.pins[order.ID] = 0
+	if err := svc.MachineHandoff(ctx, order.ID, machine, pin); err != nil {
+		t.Fatalf("MachineHandoff error: %v", err)
+	}
+	last := repo.history[len(repo.history)-1]
+	if last.ToStatus != models.OrderStatusDelivered || last.ActorType != models.ActorMachine || last.ActorID != machine {
+		t.Errorf("last history event = %+v; want DELIVERED by machine %s", last, machine)
+	}
+}
+
+func TestOrderHistory(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment}
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+
+	if _, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm"}); err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	// No idle machine: the dispatcher parks the order.
+	if err := svc.RetryPendingAssignments(ctx); err != nil {
+		t.Fatalf("RetryPendingAssignments error: %v", err)
+	}
+
+	history, err := svc.GetOrderHistory(ctx, "o1", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("GetOrderHistory error: %v", err)
+	}
+	want := []struct {
+		from, to models.OrderStatus
+		actor    models.StatusActor
+	}{
+		{models.OrderStatusPendingPayment, models.OrderStatusConfirmed, models.ActorUser},
+		{models.OrderStatusConfirmed, models.OrderStatusAssignmentPending, models.ActorSystem},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("history has %d events; want %d", len(history), len(want))
+	}
+	for i, w := range want {
+		ev := history[i]
+		if ev.FromStatus == nil || *ev.FromStatus != w.from || ev.ToStatus != w.to || ev.ActorType != w.actor {
+			t.Errorf("history[%d] = %v -> %s by %s; want %s -> %s by %s", i, ev.FromStatus, ev.ToStatus, ev.ActorType, w.from, w.to, w.actor)
+		}
+	}
+	if history[0].ActorID != "u1" || history[0].Reason != "paid with payment pay-1" {
+		t.Errorf("payment event actor = %q, reason = %q", history[0].ActorID, history[0].Reason)
+	}
+
+	// Support staff can read the history; other customers cannot see the order.
+	if _, err := svc.GetOrderHistory(ctx, "o1", "s1", models.RoleSupport); err != nil {
+		t.Errorf("GetOrderHistory by support error: %v", err)
+	}
+	if _, err := svc.GetOrderHistory(ctx, "o1", "u2", models.RoleCustomer); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetOrderHistory by another user error = %v; want ErrNotFound", err)
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 10, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time { v := now.Add(d); return &v }
+	quotedNow := &models.RouteOption{PickupTime: now}
+	quotedLater := &models.RouteOption{PickupTime: now.Add(3 * time.Hour)} // 15:10
+
+	tests := []struct {
+		name      string
+		scheduled *time.Time
+		option    *models.RouteOption
+		wantRule  string
+	}{
+		{"immediate", nil, quotedNow, ""},
+		{"quote for later without schedule", nil, quotedLater, "required"},
+		{"too soon", at(10 * time.Minute), quotedNow, "min"},
+		{"too far ahead", at(models.MaxScheduleAhead + time.Hour), quotedNow, "max"},
+		{"other hour than quoted", at(2 * time.Hour), quotedLater, "quote_hour"},
+		{"same hour as quoted", at(3*time.Hour + 40*time.Minute), quotedLater, ""},
+	}
+	for _, tt := range tests {
+		err := checkSchedule(tt.scheduled, tt.option, now)
+		if tt.wantRule == "" {
+			if err != nil {
+				t.Errorf("%s: error = %v; want nil", tt.name, err)
+			}
+			continue
+		}
+		var apiErr *models.APIError
+		if !errors.As(err, &apiErr) || len(apiErr.Fields) != 1 || apiErr.Fields[0].Rule != tt.wantRule {
+			t.Errorf("%s: error = %v; want validation rule %q", tt.name, err, tt.wantRule)
+		}
+	}
+}
+
+func TestScheduledOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	pickup := time.Now().Add(2 * time.Hour)
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment, ScheduledPickupTime: &pickup}
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo, machine: "m1"}, fakeTx{})
+
+	// Paying a scheduled order does not queue it for dispatch.
+	order, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm"})
+	if err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	if order.Status != models.OrderStatusScheduled {
+		t.Errorf("status = %s; want SCHEDULED", order.Status)
+	}
+	if _, ok := repo.queue["o1"]; ok {
+		t.Error("scheduled order was queued at payment")
+	}
+
+	// Not yet within the dispatch lead.
+	if err := svc.PromoteScheduledOrders(ctx, 15*time.Minute); err != nil {
+		t.Fatalf("PromoteScheduledOrders error: %v", err)
+	}
+	if repo.orders["o1"].Status != models.OrderStatusScheduled {
+		t.Errorf("status = %s before the lead; want SCHEDULED", repo.orders["o1"].Status)
+	}
+
+	// Within the lead: released to the queue and assigned by the next dispatch.
+	if err := svc.PromoteScheduledOrders(ctx, 3*time.Hour); err != nil {
+		t.Fatalf("PromoteScheduledOrders error: %v", err)
+	}
+	if repo.orders["o1"].Status != models.OrderStatusConfirmed {
+		t.Errorf("status = %s after promotion; want CONFIRMED", repo.orders["o1"].Status)
+	}
+	if _, ok := repo.queue["o1"]; !ok {
+		t.Fatal("promoted order was not queued")
+	}
+	if err := svc.RetryPendingAssignments(ctx); err != nil {
+		t.Fatalf("RetryPendingAssignments error: %v", err)
+	}
+	if repo.orders["o1"].Status != models.OrderStatusInProgress {
+		t.Errorf("status = %s; want IN_PROGRESS", repo.orders["o1"].Status)
+	}
+	if last := repo.history[len(repo.history)-1]; last.ActorType != models.ActorSystem || last.ToStatus != models.OrderStatusConfirmed {
+		t.Errorf("last history event = %s by %s; want CONFIRMED by SYSTEM", last.ToStatus, last.ActorType)
+	}
+}
+
+// cancellingRepo cancels every scheduled order as soon as it is listed, as a
+// customer cancelling it while PromoteScheduledOrders runs would.
+type cancellingRepo struct {
+	*fakeRepo
+}
+
+func (r cancellingRepo) ListDueScheduled(ctx context.Context, due time.Time, limit int) ([]*models.Order, error) {
+	orders, err := r.fakeRepo.ListDueScheduled(ctx, due, limit)
+	for _, o := range orders {
+		r.orders[o.ID].Status = models.OrderStatusCancelled
+	}
+	return orders, err
+}
+
+func TestPromoteCancelledScheduledOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	pickup := time.Now().Add(10 * time.Minute)
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusScheduled, ScheduledPickupTime: &pickup}
+	svc := NewService(cancellingRepo{repo}, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+
+	if err := svc.PromoteScheduledOrders(ctx, time.Hour); err != nil {
+		t.Fatalf("PromoteScheduledOrders error: %v", err)
+	}
+	if o := repo.orders["o1"]; o.Status != models.OrderStatusCancelled || repo.queue["o1"] != nil || len(repo.history) != 0 {
+		t.Errorf("order %s, queued %v, history %v; want it left CANCELLED", o.Status, repo.queue["o1"] != nil, repo.history)
+	}
+}
+
+func TestCancelUnpaidOrders(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	now := time.Now()
+	repo.orders["stale"] = &models.Order{ID: "stale", UserID: "u1", Status: models.OrderStatusPendingPayment, CreatedAt: now.Add(-2 * time.Hour)}
+	repo.orders["fresh"] = &models.Order{ID: "fresh", UserID: "u1", Status: models.OrderStatusPendingPayment, CreatedAt: now.Add(-10 * time.Minute)}
+	repo.orders["paid"] = &models.Order{ID: "paid", UserID: "u1", Status: models.OrderStatusConfirmed, CreatedAt: now.Add(-2 * time.Hour)}
+	// The customer is still authenticating the charge of this one, but gave
+	// up on that of expired.
+	repo.orders["authenticating"] = &models.Order{ID: "authenticating", UserID: "u1", Status: models.OrderStatusPendingPayment, CreatedAt: now.Add(-2 * time.Hour)}
+	repo.orders["expired"] = &models.Order{ID: "expired", UserID: "u1", Status: models.OrderStatusPendingPayment, CreatedAt: now.Add(-2 * time.Hour)}
+	ref1, ref2 := "pi_1", "pi_2"
+	repo.paymentLog = append(repo.paymentLog,
+		&models.Payment{OrderID: "authenticating", Kind: models.PaymentKindCharge, ProviderRef: &ref1, Status: models.PaymentStatusRequiresAction, CreatedAt: now.Add(-10 * time.Minute)},
+		&models.Payment{OrderID: "expired", Kind: models.PaymentKindCharge, ProviderRef: &ref2, Status: models.PaymentStatusRequiresAction, CreatedAt: now.Add(-2 * time.Hour)})
+	payments := &countingPayments{status: payment.StatusRequiresAction}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+
+	if err := svc.CancelUnpaidOrders(ctx, time.Hour); err != nil {
+		t.Fatalf("CancelUnpaidOrders error: %v", err)
+	}
+	for id, want := range map[string]models.OrderStatus{
+		"stale":          models.OrderStatusCancelled,
+		"fresh":          models.OrderStatusPendingPayment,
+		"paid":           models.OrderStatusConfirmed,
+		"authenticating": models.OrderStatusPendingPayment,
+		"expired":        models.OrderStatusCancelled,
+	} {
+		if got := repo.orders[id].Status; got != want {
+			t.Errorf("%s: status = %s; want %s", id, got, want)
+		}
+	}
+	// The expired charge is cancelled with the provider before its order.
+	if !slices.Equal(payments.cancelled, []string{"pi_2"}) || repo.paymentLog[1].Status != models.PaymentStatusFailed {
+		t.Errorf("cancelled %v, expired charge %s; want pi_2 cancelled and FAILED", payments.cancelled, repo.paymentLog[1].Status)
+	}
+	var cancelled []string
+	for _, e := range repo.history {
+		if e.ToStatus == models.OrderStatusCancelled && e.ActorType == models.ActorSystem {
+			cancelled = append(cancelled, e.OrderID)
+		}
+	}
+	slices.Sort(cancelled)
+	if !slices.Equal(cancelled, []string{"expired", "stale"}) {
+		t.Errorf("SYSTEM cancellations = %v; want expired and stale", cancelled)
+	}
+	if n := len(repo.notes["u1"]); n < 2 {
+		t.Errorf("%d notifications; want one per cancellation", n)
+	}
+}
+
+func TestAbandonedPaymentAction(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	for _, id := range []string{"o1", "o2", "o3"} {
+		repo.orders[id] = &models.Order{ID: id, UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20}
+	}
+	payments := &countingPayments{status: payment.StatusRequiresAction}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+	authenticate := func(orderID, ref string) {
+		t.Helper()
+		payments.fail = &payment.ActionRequiredError{PaymentID: ref, ClientSecret: ref + "_secret"}
+		if _, err := svc.ConfirmAndPay(ctx, "u1", orderID, models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_1"}); err != nil {
+			t.Fatalf("ConfirmAndPay %s error: %v", orderID, err)
+		}
+		payments.fail = nil
+	}
+
+	// Cancelling the order cancels the charge the customer has not
+	// authenticated, so it cannot succeed afterwards.
+	authenticate("o1", "pi_1")
+	if _, err := svc.CancelOrder(ctx, "o1", "u1", models.RoleCustomer); err != nil {
+		t.Fatalf("CancelOrder error: %v", err)
+	}
+	if !slices.Equal(payments.cancelled, []string{"pi_1"}) || repo.awaitingAction("o1") {
+		t.Errorf("cancelled %v; want pi_1 cancelled and settled", payments.cancelled)
+	}
+
+	// A charge authenticated after its order was cancelled is refunded.
+	authenticate("o2", "pi_2")
+	repo.orders["o2"].Status = models.OrderStatusCancelled
+	payments.status = payment.StatusSucceeded
+	if _, err := svc.ConfirmPayment(ctx, "o2", "u1", models.RoleCustomer); !errors.Is(err, models.ErrOrderCannotBePaid) {
+		t.Errorf("confirming for a cancelled order: error = %v; want ErrOrderCannotBePaid", err)
+	}
+	records, _ := svc.ListPayments(ctx, "o2", "u1", models.RoleCustomer)
+	if last := records[len(records)-1]; last.Kind != models.PaymentKindRefund || last.Amount != 20 {
+		t.Errorf("last payment of o2 = %s %.2f; want a REFUND of 20", last.Kind, last.Amount)
+	}
+
+	// A charge authenticated but never confirmed by the client is confirmed
+	// by the unpaid order job.
+	authenticate("o3", "pi_3")
+	if err := svc.CancelUnpaidOrders(ctx, time.Hour); err != nil {
+		t.Fatalf("CancelUnpaidOrders error: %v", err)
+	}
+	if o := repo.orders["o3"]; o.Status != models.OrderStatusConfirmed || repo.payments["o3"] != "pi_3" {
+		t.Errorf("o3: %s paid by %q; want CONFIRMED by pi_3", o.Status, repo.payments["o3"])
+	}
+}
+
+func TestCheckWindow(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	option := &models.RouteOption{DurationSeconds: 1800}
+	window := &models.DeliveryWindow{Start: now.Add(2 * time.Hour), End: now.Add(4 * time.Hour)}
+
+	// Picked up now, the option arrives at 12:30, before the window opens.
+	if err := checkWindow(window, nil, option, now); err == nil {
+		t.Error("checkWindow for an early arrival succeeded")
+	}
+	// Scheduled for 14:00, it arrives at 14:30.
+	pickup := now.Add(2 * time.Hour)
+	if err := checkWindow(window, &pickup, option, now); err != nil {
+		t.Errorf("checkWindow for a scheduled pickup error = %v", err)
+	}
+	short := &models.DeliveryWindow{Start: now, End: now.Add(10 * time.Minute)}
+	if err := checkWindow(short, nil, option, now); err == nil {
+		t.Error("checkWindow accepted a 10 minute window")
+	}
+	if err := checkWindow(nil, nil, option, now); err != nil {
+		t.Errorf("checkWindow without a window error = %v", err)
+	}
+}
+
+func TestListUserOrdersPaging(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		id := string(rune('a' + i))
+		repo.orders[id] = &models.Order{ID: id, UserID: "u1", CreatedAt: base.Add(time.Duration(i) * time.Hour)}
+	}
+	// Two orders created in the same instant are ordered by ID.
+	repo.orders["f"] = &models.Order{ID: "f", UserID: "u1", CreatedAt: base.Add(4 * time.Hour)}
+	repo.orders["x"] = &models.Order{ID: "x", UserID: "u2", CreatedAt: base}
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+
+	ids := func(p *models.OrderPage) string {
+		var s string
+		for _, o := range p.Orders {
+			s += o.ID
+		}
+		return s
+	}
+
+	// The first page is an offset page with a total and a cursor to continue.
+	page, err := svc.ListUserOrders(ctx, "u1", models.OrderListQuery{Page: 1, Limit: 2})
+	if err != nil {
+		t.Fatalf("ListUserOrders error: %v", err)
+	}
+	if ids(page) != "fe" || page.Total == nil || *page.Total != 6 || page.NextCursor == "" {
+		t.Fatalf("first page = %q, total %v, cursor %q; want fe, 6 and a cursor", ids(page), page.Total, page.NextCursor)
+	}
+
+	var got string
+	for page.NextCursor != "" {
+		after, err := models.DecodeOrderCursor(page.NextCursor)
+		if err != nil {
+			t.Fatalf("DecodeOrderCursor error: %v", err)
+		}
+		page, err = svc.ListUserOrders(ctx, "u1", models.OrderListQuery{Limit: 2, After: after})
+		if err != nil {
+			t.Fatalf("ListUserOrders error: %v", err)
+		}
+		if page.Total != nil {
+			t.Error("keyset page has a total")
+		}
+		got += ids(page)
+	}
+	if got != "dcba" {
+		t.Errorf("keyset pages = %q; want dcba", got)
+	}
+}
+
+func TestExportOrders(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	base := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	machine := "m1"
+	repo.orders["b"] = &models.Order{ID: "b", UserID: "u1", Status: models.OrderStatusDelivered, MachineID: &machine,
+		PickupAddressID: "p1", DropoffAddressID: "d1", ItemWeightKg: 1.5, Cost: 12.5, Tip: 2, CreatedAt: base.Add(time.Hour), UpdatedAt: base.Add(2 * time.Hour)}
+	repo.orders["a"] = &models.Order{ID: "a", UserID: "u2", Status: models.OrderStatusCancelled, Cost: 8, CreatedAt: base, UpdatedAt: base,
+		DeliveryWindow: &models.DeliveryWindow{Start: base.Add(3 * time.Hour), End: base.Add(4 * time.Hour)}}
+	repo.orders["old"] = &models.Order{ID: "old", UserID: "u1", Status: models.OrderStatusDelivered, CreatedAt: base.AddDate(0, -2, 0)}
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+
+	export := func(q models.OrderExportQuery) [][]string {
+		t.Helper()
+		var buf strings.Builder
+		if err := svc.ExportOrders(ctx, q, &buf); err != nil {
+			t.Fatalf("ExportOrders error: %v", err)
+		}
+		records, err := csv.NewReader(strings.NewReader(buf.String())).ReadAll()
+		if err != nil {
+			t.Fatalf("export is not valid CSV: %v", err)
+		}
+		if !slices.Equal(records[0], orderExportHeader) {
+			t.Fatalf("header = %v; want %v", records[0], orderExportHeader)
+		}
+		return records[1:]
+	}
+
+	q := models.OrderExportQuery{From: base.AddDate(0, 0, -1), To: base.AddDate(0, 0, 1)}
+	rows := export(q)
+	if len(rows) != 2 || rows[0][0] != "a" || rows[1][0] != "b" {
+		t.Fatalf("rows = %v; want orders a and b, oldest first", rows)
+	}
+	want := []string{"b", "u1", "u1@example.com", "DELIVERED", "m1", "from p1", "to d1", "1.5", "12.50", "2.00",
+		"", "", "", "2026-03-01T10:00:00Z", "2026-03-01T11:00:00Z"}
+	if !slices.Equal(rows[1], want) {
+		t.Errorf("row b = %v; want %v", rows[1], want)
+	}
+	if rows[0][4] != "" || rows[0][11] != "2026-03-01T12:00:00Z" || rows[0][12] != "2026-03-01T13:00:00Z" {
+		t.Errorf("row a = %v; want no machine and the delivery window", rows[0])
+	}
+
+	delivered := models.OrderStatusDelivered
+	q.Status = &delivered
+	if rows := export(q); len(rows) != 1 || rows[0][0] != "b" {
+		t.Errorf("DELIVERED rows = %v; want only order b", rows)
+	}
+}
+
+func TestExportOrdersEscapesFormulas(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"=HYPERLINK(\"http://evil\")", "'=HYPERLINK(\"http://evil\")"},
+		{"+1 555 0100", "'+1 555 0100"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"1 Main St", "1 Main St"},
+		{"", ""},
+	} {
+		rec := orderExportRecord(&models.OrderExportRow{CustomerEmail: tc.in, PickupStreet: tc.in, DropoffStreet: tc.in})
+		if rec[2] != tc.want || rec[5] != tc.want || rec[6] != tc.want {
+			t.Errorf("%q exported as %q, %q, %q; want %q", tc.in, rec[2], rec[5], rec[6], tc.want)
+		}
+	}
+}
+
+// countingPayments records the idempotency key of every charge and refund,
+// and the amount and card of every charge, and fails while fail is set.
+// PaymentStatus reports status. onCharge, if set, runs during every charge.
+// CancelPayment records the charges it cancels.
+type countingPayments struct {
+	keys      []string
+	charged   []float64
+	cards     []string // "customer/card", or the card for one-off charges.
+	fail      error
+	status    string
+	onCharge  func()
+	cancelled []string // PaymentIntents cancelled
+}
+
+func (p *countingPayments) ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID, idempotencyKey string) (string, error) {
+	if p.onCharge != nil {
+		p.onCharge()
+	}
+	if p.fail != nil {
+		return "", p.fail
+	}
+	p.keys = append(p.keys, idempotencyKey)
+	p.charged = append(p.charged, amount)
+	p.cards = append(p.cards, paymentMethodID)
+	return "pay-" + idempotencyKey, nil
+}
+
+func (p *countingPayments) ChargeCustomer(ctx context.Context, customerID string, amount float64, paymentMethodID, idempotencyKey string) (string, error) {
+	if p.onCharge != nil {
+		p.onCharge()
+	}
+	if p.fail != nil {
+		return "", p.fail
+	}
+	p.keys = append(p.keys, idempotencyKey)
+	p.charged = append(p.charged, amount)
+	p.cards = append(p.cards, customerID+"/"+paymentMethodID)
+	return "pay-" + idempotencyKey, nil
+}
+
+func (p *countingPayments) PaymentStatus(ctx context.Context, paymentID string) (string, error) {
+	return p.status, nil
+}
+
+func (p *countingPayments) CancelPayment(ctx context.Context, paymentID string) error {
+	p.cancelled = append(p.cancelled, paymentID)
+	return nil
+}
+
+func (p *countingPayments) Provider() string {
+	return "counting"
+}
+
+func (p *countingPayments) RefundPayment(ctx context.Context, paymentID string, amount float64, idempotencyKey string) (string, error) {
+	if p.fail != nil {
+		return "", p.fail
+	}
+	p.keys = append(p.keys, idempotencyKey)
+	return "re-" + paymentID, nil
+}
+
+func TestIdempotentPayment(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment}
+	repo.orders["o2"] = &models.Order{ID: "o2", UserID: "u1", Status: models.OrderStatusPendingPayment}
+	payments := &countingPayments{fail: errors.New("card network down")}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+	pay := func(orderID, key string) (*models.Order, error) {
+		return svc.ConfirmAndPay(ctx, "u1", orderID, models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm", IdempotencyKey: key})
+	}
+	retry := func(orderID, key string) (*models.Order, error) {
+		return svc.RetryPayment(ctx, "u1", orderID, models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm", IdempotencyKey: key})
+	}
+
+	// An attempt the provider could not answer leaves the order unpaid, and
+	// the key free for a retry.
+	if _, err := pay("o1", "k1"); !errors.Is(err, models.ErrPaymentUnavailable) {
+		t.Fatalf("payment while the provider was down: error = %v; want ErrPaymentUnavailable", err)
+	}
+	if o := repo.orders["o1"]; o.Status != models.OrderStatusPendingPayment || o.PaymentFailureReason != nil {
+		t.Fatalf("order %s with reason %v; want it still PENDING_PAYMENT", o.Status, o.PaymentFailureReason)
+	}
+
+	// A declined attempt moves the order to PAYMENT_FAILED, and the client
+	// retries the payment with the same key.
+	payments.fail = &payment.DeclinedError{Err: errors.New("card declined")}
+	if _, err := pay("o1", "k1"); !errors.Is(err, models.ErrPaymentFailed) {
+		t.Fatalf("declined payment: error = %v; want ErrPaymentFailed", err)
+	}
+	payments.fail = nil
+	first, err := retry("o1", "k1")
+	if err != nil {
+		t.Fatalf("RetryPayment error: %v", err)
+	}
+	if len(payments.keys) != 1 || payments.keys[0] == "" {
+		t.Fatalf("charges = %q; want one with a provider idempotency key", payments.keys)
+	}
+
+	// The retry returns the paid order without charging again.
+	again, err := retry("o1", "k1")
+	if err != nil {
+		t.Fatalf("repeated ConfirmAndPay error: %v", err)
+	}
+	if again.ID != first.ID || again.Status != models.OrderStatusConfirmed || len(payments.keys) != 1 {
+		t.Errorf("retry = %s %s after %d charge(s); want o1 CONFIRMED after 1", again.ID, again.Status, len(payments.keys))
+	}
+
+	// Without a key a second payment is rejected by the order's status instead.
+	if _, err := pay("o1", ""); !errors.Is(err, models.ErrOrderCannotBePaid) {
+		t.Errorf("keyless retry error = %v; want ErrOrderCannotBePaid", err)
+	}
+	if _, err := retry("o2", "k1"); !errors.Is(err, models.ErrIdempotencyKeyReused) {
+		t.Errorf("key reused for o2: error = %v; want ErrIdempotencyKeyReused", err)
+	}
+
+	// A request still holding its key blocks the same request.
+	req := models.PaymentRequest{PaymentMethodID: "pm"}
+	claim, _, err := svc.claimIdempotencyKey(ctx, "u1", opPayOrder, "k2", struct {
+		OrderID string `json:"order_id"`
+		models.PaymentRequest
+	}{"o2", req})
+	if err != nil || claim == nil {
+		t.Fatalf("claimIdempotencyKey = %v, %v; want a claim", claim, err)
+	}
+	if _, err := pay("o2", "k2"); !errors.Is(err, models.ErrIdempotencyKeyInUse) {
+		t.Errorf("concurrent request error = %v; want ErrIdempotencyKeyInUse", err)
+	}
+
+	// All attempts on o1 are recorded, the failed ones with their reason.
+	records, err := svc.ListPayments(ctx, "o1", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("ListPayments error: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("payment records = %+v; want two failed attempts, then the charge", records)
+	}
+	for _, failed := range records[:2] {
+		if failed.Status != models.PaymentStatusFailed || failed.FailureReason == nil || failed.ProviderRef != nil {
+			t.Errorf("failed attempt = %+v; want FAILED with a reason", failed)
+		}
+	}
+	charge := records[2]
+	if charge.Kind != models.PaymentKindCharge || charge.Status != models.PaymentStatusSucceeded || charge.Provider != "counting" ||
+		charge.ProviderRef == nil || *charge.ProviderRef != "pay-"+payments.keys[0] {
+		t.Errorf("charge = %+v; want a SUCCEEDED CHARGE by counting referencing the payment", charge)
+	}
+	if _, err := svc.ListPayments(ctx, "o1", "u2", models.RoleCustomer); err == nil {
+		t.Error("another customer listed the payments of o1")
+	}
+}
+
+// flakyStatusRepo fails the next failures status updates, as a database
+// that is briefly unreachable does.
+type flakyStatusRepo struct {
+	*fakeRepo
+	failures *int
+}
+
+func (r flakyStatusRepo) UpdateStatusForUser(ctx context.Context, orderID, userID string, from, to models.OrderStatus) error {
+	if *r.failures > 0 {
+		*r.failures--
+		return errors.New("connection reset")
+	}
+	return r.fakeRepo.UpdateStatusForUser(ctx, orderID, userID, from, to)
+}
+
+func TestConfirmAfterCharge(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 10}
+	repo.orders["o2"] = &models.Order{ID: "o2", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 10}
+	payments := &countingPayments{}
+	var failures int
+	svc := NewService(flakyStatusRepo{repo, &failures}, payments, &fakeLogistics{repo: repo}, fakeTx{})
+	pay := func(orderID, key string) (*models.Order, error) {
+		return svc.ConfirmAndPay(ctx, "u1", orderID, models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm", IdempotencyKey: key})
+	}
+
+	// A confirmation that fails after the charge is retried.
+	failures = confirmAttempts - 1
+	paid, err := pay("o1", "k1")
+	if err != nil || paid.Status != models.OrderStatusConfirmed {
+		t.Fatalf("ConfirmAndPay = %+v, %v; want o1 confirmed on the last attempt", paid, err)
+	}
+	if len(payments.charged) != 1 || len(payments.keys) != 1 {
+		t.Errorf("charged %v with keys %v; want one charge and no refund", payments.charged, payments.keys)
+	}
+
+	// One that keeps failing refunds the charge, and the key replays the
+	// unpaid order rather than charging again.
+	failures = confirmAttempts
+	if _, err := pay("o2", "k2"); err == nil {
+		t.Fatal("ConfirmAndPay succeeded with every confirmation failing")
+	}
+	charge := payments.keys[1]
+	if len(payments.keys) != 3 || payments.keys[2] != "payment-refund-pay-"+charge {
+		t.Fatalf("provider calls = %v; want the second charge refunded", payments.keys)
+	}
+	again, err := pay("o2", "k2")
+	if err != nil || again.Status != models.OrderStatusPendingPayment || len(payments.keys) != 3 {
+		t.Errorf("retry with the key = %+v, %v after %d provider calls; want the unpaid order and no new call", again, err, len(payments.keys))
+	}
+}
+
+func TestRetryPayment(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20}
+	payments := &countingPayments{fail: &payment.DeclinedError{Err: errors.New("card declined")}}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+
+	// An order that was never charged cannot be retried.
+	if _, err := svc.RetryPayment(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_1"}); !errors.Is(err, models.ErrOrderCannotBePaid) {
+		t.Errorf("retrying a PENDING_PAYMENT order: error = %v; want ErrOrderCannotBePaid", err)
+	}
+
+	// Once a charge failed the order is only paid through RetryPayment. Each
+	// failed charge keeps the provider's reason; the status changes once.
+	if _, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_1"}); !errors.Is(err, models.ErrPaymentFailed) {
+		t.Fatalf("ConfirmAndPay error = %v; want ErrPaymentFailed", err)
+	}
+	if _, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_1"}); !errors.Is(err, models.ErrOrderCannotBePaid) {
+		t.Errorf("paying a PAYMENT_FAILED order again: error = %v; want ErrOrderCannotBePaid", err)
+	}
+	// The customer is told the provider's reason, not its whole error.
+	payments.fail = &payment.DeclinedError{Reason: "insufficient funds", Err: errors.New(`{"code":"card_declined","decline_code":"insufficient_funds","status":402}`)}
+	if _, err := svc.RetryPayment(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_2"}); !errors.Is(err, models.ErrPaymentFailed) {
+		t.Errorf("failed retry: error = %v; want ErrPaymentFailed", err)
+	}
+	failed := repo.orders["o1"]
+	if failed.Status != models.OrderStatusPaymentFailed || failed.PaymentFailureReason == nil || *failed.PaymentFailureReason != "insufficient funds" {
+		t.Errorf("order %s with reason %v; want PAYMENT_FAILED for insufficient funds", failed.Status, failed.PaymentFailureReason)
+	}
+	var changes, events int
+	for _, ev := range repo.history {
+		if ev.ToStatus == models.OrderStatusPaymentFailed {
+			changes++
+		}
+	}
+	for _, ev := range repo.events {
+		if ev == "order.payment_failed" {
+			events++
+		}
+	}
+	if changes != 1 || events != 1 {
+		t.Errorf("%d status change(s) and %d event(s) to PAYMENT_FAILED; want 1 each", changes, events)
+	}
+
+	// Retrying with another card confirms the order and clears the reason.
+	payments.fail = nil
+	paid, err := svc.RetryPayment(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_3"})
+	if err != nil {
+		t.Fatalf("RetryPayment error: %v", err)
+	}
+	if paid.Status != models.OrderStatusConfirmed || paid.PaymentFailureReason != nil || !slices.Equal(payments.cards, []string{"pm_3"}) {
+		t.Errorf("order %s with reason %v after charges on %q; want CONFIRMED after one on pm_3", paid.Status, paid.PaymentFailureReason, payments.cards)
+	}
+}
+
+func TestMarkPaymentFailedAfterStatusChange(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusConfirmed}
+	repo.orders["o2"] = &models.Order{ID: "o2", UserID: "u1", Status: models.OrderStatusCancelled}
+	repo.orders["o3"] = &models.Order{ID: "o3", UserID: "u1", Status: models.OrderStatusDelivered}
+	svc := NewService(repo, &countingPayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+
+	// Read while unpaid, o1 was paid and o2 cancelled before their failed
+	// charges were recorded; o3 was never unpaid.
+	svc.markPaymentFailed(ctx, &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment}, "u1", errors.New("declined"))
+	svc.markPaymentFailed(ctx, &models.Order{ID: "o2", UserID: "u1", Status: models.OrderStatusPaymentFailed}, "u1", errors.New("declined"))
+	svc.markPaymentFailed(ctx, repo.orders["o3"], "u1", errors.New("declined"))
+	for id, want := range map[string]models.OrderStatus{
+		"o1": models.OrderStatusConfirmed,
+		"o2": models.OrderStatusCancelled,
+		"o3": models.OrderStatusDelivered,
+	} {
+		if o := repo.orders[id]; o.Status != want || o.PaymentFailureReason != nil {
+			t.Errorf("%s: %s with reason %v; want %s without one", id, o.Status, o.PaymentFailureReason, want)
+		}
+	}
+	if len(repo.events) != 0 {
+		t.Errorf("events = %v; want none", repo.events)
+	}
+}
+
+func TestPaymentRacingCancellation(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20}
+	payments := &countingPayments{}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+
+	// CancelUnpaidOrders cancels the order while it is being charged.
+	payments.onCharge = func() { repo.orders["o1"].Status = models.OrderStatusCancelled }
+	_, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_1", Tip: 2, IdempotencyKey: "k1"})
+	if !errors.Is(err, models.ErrOrderCannotBePaid) {
+		t.Fatalf("ConfirmAndPay error = %v; want ErrOrderCannotBePaid", err)
+	}
+	if o := repo.orders["o1"]; o.Status != models.OrderStatusCancelled || slices.Contains(repo.events, "order.paid") {
+		t.Errorf("order %s after events %v; want it to stay CANCELLED without order.paid", o.Status, repo.events)
+	}
+	// The charge, tip included, is refunded.
+	records, _ := svc.ListPayments(ctx, "o1", "u1", models.RoleCustomer)
+	last := records[len(records)-1]
+	if last.Kind != models.PaymentKindRefund || last.Status != models.PaymentStatusSucceeded || last.Amount != 22 {
+		t.Errorf("last payment = %s %s %.2f; want a SUCCEEDED REFUND of 22", last.Kind, last.Status, last.Amount)
+	}
+	if key := payments.keys[len(payments.keys)-1]; !strings.HasPrefix(key, "payment-refund-") {
+		t.Errorf("refund key = %q; want one per charge", key)
+	}
+}
+
+func TestPaymentAuthentication(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20}
+	repo.orders["o2"] = &models.Order{ID: "o2", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20}
+	repo.orders["o3"] = &models.Order{ID: "o3", UserID: "u1", Status: models.OrderStatusDelivered, Cost: 20}
+	payments := &countingPayments{status: payment.StatusRequiresAction}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+	statuses := func(orderID string) []models.PaymentStatus {
+		records, _ := svc.ListPayments(ctx, orderID, "u1", models.RoleCustomer)
+		var out []models.PaymentStatus
+		for _, p := range records {
+			out = append(out, p.Status)
+		}
+		return out
+	}
+
+	// Nothing awaits authentication before the charge asks for it.
+	if _, err := svc.ConfirmPayment(ctx, "o1", "u1", models.RoleCustomer); !errors.Is(err, models.ErrNoPaymentAction) {
+		t.Errorf("confirming an unpaid order: error = %v; want ErrNoPaymentAction", err)
+	}
+
+	// The order stays unpaid with the action the client has to take.
+	payments.fail = &payment.ActionRequiredError{PaymentID: "pi_1", ClientSecret: "pi_1_secret"}
+	pending, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_1", Tip: 3})
+	if err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	want := &models.PaymentAction{Status: payment.StatusRequiresAction, PaymentID: "pi_1", ClientSecret: "pi_1_secret"}
+	if pending.Status != models.OrderStatusPendingPayment || pending.PaymentAction == nil || *pending.PaymentAction != *want {
+		t.Fatalf("order %s with action %+v; want PENDING_PAYMENT with %+v", pending.Status, pending.PaymentAction, want)
+	}
+	if got := statuses("o1"); !slices.Equal(got, []models.PaymentStatus{models.PaymentStatusRequiresAction, models.PaymentStatusRequiresAction}) {
+		t.Errorf("payment statuses = %v; want the charge and the tip REQUIRES_ACTION", got)
+	}
+	if _, err := svc.ConfirmPayment(ctx, "o1", "u1", models.RoleCustomer); !errors.Is(err, models.ErrPaymentActionPending) {
+		t.Errorf("confirming before authentication: error = %v; want ErrPaymentActionPending", err)
+	}
+
+	// Once authenticated, the order is confirmed with its tip, once.
+	payments.status = payment.StatusSucceeded
+	paid, err := svc.ConfirmPayment(ctx, "o1", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("ConfirmPayment error: %v", err)
+	}
+	if paid.Status != models.OrderStatusConfirmed || paid.Tip != 3 || repo.payments["o1"] != "pi_1" {
+		t.Errorf("order %s with tip %.2f and payment %q; want CONFIRMED with a tip of 3 paid by pi_1", paid.Status, paid.Tip, repo.payments["o1"])
+	}
+	if got := statuses("o1"); !slices.Equal(got, []models.PaymentStatus{models.PaymentStatusSucceeded, models.PaymentStatusSucceeded}) {
+		t.Errorf("payment statuses = %v; want both SUCCEEDED", got)
+	}
+	if _, err := svc.ConfirmPayment(ctx, "o1", "u1", models.RoleCustomer); !errors.Is(err, models.ErrNoPaymentAction) {
+		t.Errorf("confirming twice: error = %v; want ErrNoPaymentAction", err)
+	}
+
+	// A failed authentication fails the order's payment.
+	payments.fail = &payment.ActionRequiredError{PaymentID: "pi_2", ClientSecret: "pi_2_secret"}
+	if _, err := svc.ConfirmAndPay(ctx, "u1", "o2", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_1"}); err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	payments.status = "requires_payment_method"
+	if _, err := svc.ConfirmPayment(ctx, "o2", "u1", models.RoleCustomer); !errors.Is(err, models.ErrPaymentFailed) {
+		t.Errorf("confirming a failed authentication: error = %v; want ErrPaymentFailed", err)
+	}
+	if o := repo.orders["o2"]; o.Status != models.OrderStatusPaymentFailed || !slices.Equal(statuses("o2"), []models.PaymentStatus{models.PaymentStatusFailed}) {
+		t.Errorf("order %s with payments %v; want PAYMENT_FAILED with the charge FAILED", o.Status, statuses("o2"))
+	}
+
+	// A tip can need authentication too.
+	payments.fail = &payment.ActionRequiredError{PaymentID: "pi_3", ClientSecret: "pi_3_secret"}
+	if o, err := svc.AddTip(ctx, "o3", "u1", models.RoleCustomer, models.TipRequest{Amount: 5, PaymentMethodID: "pm_1"}); err != nil || o.PaymentAction == nil || o.Tip != 0 {
+		t.Fatalf("AddTip = %+v, %v; want the untipped order with an action", o, err)
+	}
+	payments.status = payment.StatusSucceeded
+	if o, err := svc.ConfirmPayment(ctx, "o3", "u1", models.RoleCustomer); err != nil || o.Tip != 5 {
+		t.Errorf("ConfirmPayment = %+v, %v; want a tip of 5", o, err)
+	}
+}
+
+func TestPayWithSavedCard(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20}
+	repo.orders["o2"] = &models.Order{ID: "o2", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20}
+	repo.savedCards["s1"] = fakeCard{userID: "u1", customerID: "cus_1", providerID: "pm_1"}
+	repo.savedCards["s2"] = fakeCard{userID: "u2", customerID: "cus_2", providerID: "pm_2"}
+	payments := &countingPayments{}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+
+	// Another user's card is not found, and nothing is charged.
+	if _, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{SavedPaymentMethodID: "s2"}); !errors.Is(err, models.ErrPaymentMethodNotFound) {
+		t.Errorf("paying with another user's card: error = %v; want ErrPaymentMethodNotFound", err)
+	}
+	paid, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{SavedPaymentMethodID: "s1"})
+	if err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	if paid.Status != models.OrderStatusConfirmed || len(payments.cards) != 1 || payments.cards[0] != "cus_1/pm_1" {
+		t.Errorf("order %s after charges on %q; want CONFIRMED after one on cus_1/pm_1", paid.Status, payments.cards)
+	}
+	if _, err := svc.ConfirmAndPay(ctx, "u1", "o2", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm_new"}); err != nil || payments.cards[1] != "pm_new" {
+		t.Errorf("one-off card: charges on %q, error %v; want pm_new charged", payments.cards, err)
+	}
+}
+
+func TestTips(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20,
+		CostBreakdown: &models.CostBreakdown{BaseFare: 20, Total: 20}}
+	repo.orders["o2"] = &models.Order{ID: "o2", UserID: "u1", Status: models.OrderStatusDelivered, Cost: 10}
+	payments := &countingPayments{}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+
+	// A tip at payment time is charged with the order but recorded apart.
+	paid, err := svc.ConfirmAndPay(ctx, "u1", "o1", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm", Tip: 3})
+	if err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	if !slices.Equal(payments.charged, []float64{23}) || paid.Tip != 3 || paid.CostBreakdown.Tip != 3 || paid.CostBreakdown.Total != 20 {
+		t.Errorf("charged %v, tip %.2f, breakdown %+v; want 23 charged with a 3.00 tip on top of 20", payments.charged, paid.Tip, paid.CostBreakdown)
+	}
+	records, err := svc.ListPayments(ctx, "o1", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("ListPayments error: %v", err)
+	}
+	if len(records) != 2 || records[0].Kind != models.PaymentKindCharge || records[0].Amount != 20 ||
+		records[1].Kind != models.PaymentKindTip || records[1].Amount != 3 || *records[1].ProviderRef != *records[0].ProviderRef {
+		t.Errorf("payment records = %+v; want a 20.00 CHARGE and a 3.00 TIP of the same payment", records)
+	}
+	// Cancelling refunds the tip too.
+	if quote, err := svc.CancellationQuote(ctx, "o1", "u1", models.RoleCustomer); err != nil || quote.Fee+quote.RefundAmount != 23 {
+		t.Errorf("cancellation quote = %+v, %v; want fee and refund to add up to 23", quote, err)
+	}
+
+	// After payment, only a delivered order without a tip can be tipped.
+	tip := models.TipRequest{Amount: 5, PaymentMethodID: "pm"}
+	if _, err := svc.AddTip(ctx, "o1", "u1", models.RoleCustomer, tip); !errors.Is(err, models.ErrCannotTip) {
+		t.Errorf("tipping a CONFIRMED order: error = %v; want ErrCannotTip", err)
+	}
+	repo.orders["o1"].Status = models.OrderStatusDelivered
+	if _, err := svc.AddTip(ctx, "o1", "u1", models.RoleCustomer, tip); !errors.Is(err, models.ErrTipAlreadyAdded) {
+		t.Errorf("tipping o1 again: error = %v; want ErrTipAlreadyAdded", err)
+	}
+	if _, err := svc.AddTip(ctx, "o2", "u2", models.RoleCustomer, tip); err == nil {
+		t.Error("another customer tipped o2")
+	}
+	tipped, err := svc.AddTip(ctx, "o2", "u1", models.RoleCustomer, tip)
+	if err != nil {
+		t.Fatalf("AddTip error: %v", err)
+	}
+	if tipped.Tip != 5 || tipped.Cost != 10 || payments.charged[1] != 5 || payments.keys[1] != "order-tip-o2-pm-500" {
+		t.Errorf("tip %.2f on cost %.2f after charges %v with keys %q; want 5.00 charged on its own", tipped.Tip, tipped.Cost, payments.charged, payments.keys)
+	}
+	if records, _ := svc.ListPayments(ctx, "o2", "u1", models.RoleCustomer); len(records) != 1 || records[0].Kind != models.PaymentKindTip || records[0].Amount != 5 {
+		t.Errorf("o2 payment records = %+v; want one 5.00 TIP", records)
+	}
+	if _, err := svc.AddTip(ctx, "o2", "u1", models.RoleCustomer, tip); !errors.Is(err, models.ErrTipAlreadyAdded) {
+		t.Errorf("tipping o2 again: error = %v; want ErrTipAlreadyAdded", err)
+	}
+
+	// Another request tips o3 with another card while this tip is charged:
+	// this charge is refunded.
+	repo.orders["o3"] = &models.Order{ID: "o3", UserID: "u1", Status: models.OrderStatusDelivered, Cost: 10}
+	payments.onCharge = func() { repo.orders["o3"].Tip = 4 }
+	if _, err := svc.AddTip(ctx, "o3", "u1", models.RoleCustomer, tip); !errors.Is(err, models.ErrTipAlreadyAdded) {
+		t.Errorf("tip that lost the race: error = %v; want ErrTipAlreadyAdded", err)
+	}
+	if last := payments.keys[len(payments.keys)-1]; last != "payment-refund-pay-order-tip-o3-pm-500" || repo.orders["o3"].Tip != 4 {
+		t.Errorf("last key %q, tip %.2f; want the losing charge refunded and the 4.00 tip kept", last, repo.orders["o3"].Tip)
+	}
+}
+
+func TestTipRetries(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	for _, id := range []string{"o1", "o2"} {
+		repo.orders[id] = &models.Order{ID: id, UserID: "u1", Status: models.OrderStatusDelivered, Cost: 10}
+	}
+	payments := &countingPayments{}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+
+	// The card is declined; the retry with another amount and a new key
+	// charges the same card again under another provider key.
+	payments.fail = &payment.DeclinedError{Reason: "Your card has insufficient funds.", Err: errors.New("card declined")}
+	if _, err := svc.AddTip(ctx, "o1", "u1", models.RoleCustomer, models.TipRequest{Amount: 5, PaymentMethodID: "pm", IdempotencyKey: "t1"}); err == nil {
+		t.Fatal("declined tip succeeded")
+	}
+	if _, ok := repo.keys["u1/"+opAddTip+"/t1"]; ok {
+		t.Error("declined tip kept its idempotency key")
+	}
+	payments.fail = nil
+	retry := models.TipRequest{Amount: 3, PaymentMethodID: "pm", IdempotencyKey: "t2"}
+	tipped, err := svc.AddTip(ctx, "o1", "u1", models.RoleCustomer, retry)
+	if err != nil {
+		t.Fatalf("retried AddTip error: %v", err)
+	}
+	first := payments.keys[0]
+	if tipped.Tip != 3 || !slices.Equal(payments.charged, []float64{3}) || !strings.HasPrefix(first, "order-pay-") {
+		t.Errorf("tip %.2f after charges %v with keys %q; want 3.00 charged under a key derived from t2", tipped.Tip, payments.charged, payments.keys)
+	}
+	// Repeating the request returns the tipped order without a charge; the
+	// key cannot be reused for another amount.
+	if again, err := svc.AddTip(ctx, "o1", "u1", models.RoleCustomer, retry); err != nil || again.Tip != 3 || len(payments.charged) != 1 {
+		t.Errorf("repeated AddTip = %+v, %v after %d charges; want the tipped order, charged once", again, err, len(payments.charged))
+	}
+	retry.Amount = 4
+	if _, err := svc.AddTip(ctx, "o1", "u1", models.RoleCustomer, retry); !errors.Is(err, models.ErrIdempotencyKeyReused) {
+		t.Errorf("AddTip reusing t2 for another amount: error = %v; want ErrIdempotencyKeyReused", err)
+	}
+
+	// Without a key, the provider key follows the amount, so a changed tip on
+	// the same card is a new charge rather than a mismatch.
+	payments.fail = errors.New("stripe payment failed: timeout")
+	svc.AddTip(ctx, "o2", "u1", models.RoleCustomer, models.TipRequest{Amount: 5, PaymentMethodID: "pm"})
+	payments.fail = nil
+	if _, err := svc.AddTip(ctx, "o2", "u1", models.RoleCustomer, models.TipRequest{Amount: 6, PaymentMethodID: "pm"}); err != nil {
+		t.Fatalf("AddTip with a changed amount error: %v", err)
+	}
+	if last := payments.keys[len(payments.keys)-1]; last != "order-tip-o2-pm-600" {
+		t.Errorf("provider key %q; want order-tip-o2-pm-600", last)
+	}
+}
+
+func TestIdempotentCreateOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	if err := svc.saveQuotes(ctx, "u1", []models.RouteOption{{ID: "r1", PickupTime: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	req := models.CreateOrderRequest{RouteOptionID: "r1", IdempotencyKey: "k1"}
+
+	first, err := svc.CreateOrder(ctx, "u1", req)
+	if err != nil {
+		t.Fatalf("CreateOrder error: %v", err)
+	}
+	// The route option is used up, but the retry returns the same order.
+	again, err := svc.CreateOrder(ctx, "u1", req)
+	if err != nil {
+		t.Fatalf("repeated CreateOrder error: %v", err)
+	}
+	if again.ID != first.ID || len(repo.orders) != 1 {
+		t.Errorf("retry created %s with %d order(s); want %s and 1", again.ID, len(repo.orders), first.ID)
+	}
+
+	// Another user's identical key is theirs alone.
+	if _, err := svc.CreateOrder(ctx, "u2", req); !errors.Is(err, models.ErrRouteOptionNotFound) {
+		t.Errorf("u2 error = %v; want ErrRouteOptionNotFound", err)
+	}
+	if _, ok := repo.keys["u2/"+opCreateOrder+"/k1"]; ok {
+		t.Error("failed request kept its idempotency key")
+	}
+}
+
+func TestAdminCancelOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	m1 := "m1"
+	repo.orders["paid"] = &models.Order{ID: "paid", UserID: "u1", Status: models.OrderStatusInProgress, MachineID: &m1, Cost: 20}
+	repo.orders["unpaid"] = &models.Order{ID: "unpaid", UserID: "u1", Status: models.OrderStatusPendingPayment}
+	repo.orders["done"] = &models.Order{ID: "done", UserID: "u1", Status: models.OrderStatusDelivered}
+	repo.payments["paid"] = "pay-1"
+	repo.queue["unpaid"] = &models.PendingAssignment{OrderID: "unpaid"}
+	payments := &countingPayments{fail: errors.New("stripe down")}
+	logistics := &fakeLogistics{repo: repo}
+	svc := NewService(repo, payments, logistics, fakeTx{})
+	req := models.AdminCancelRequest{Reason: "customer called support"}
+
+	// The refund fails, but the cancellation stands.
+	if _, err := svc.AdminCancelOrder(ctx, "paid", "admin1", req); !errors.Is(err, models.ErrRefundFailed) {
+		t.Fatalf("AdminCancelOrder error = %v; want ErrRefundFailed", err)
+	}
+	if got := repo.orders["paid"].Status; got != models.OrderStatusCancelled {
+		t.Errorf("status = %s; want CANCELLED", got)
+	}
+	if !slices.Equal(logistics.released, []string{"m1"}) || !slices.Equal(logistics.recalled, []string{"m1"}) {
+		t.Errorf("released %v, recalled %v; want [m1] each", logistics.released, logistics.recalled)
+	}
+	last := repo.history[len(repo.history)-1]
+	if last.ActorType != models.ActorAdmin || last.ActorID != "admin1" || last.Reason != req.Reason {
+		t.Errorf("history entry = %+v; want the admin and reason", last)
+	}
+
+	// Cancelling again retries the refund only.
+	payments.fail = nil
+	res, err := svc.AdminCancelOrder(ctx, "paid", "admin1", req)
+	if err != nil {
+		t.Fatalf("retried AdminCancelOrder error: %v", err)
+	}
+	if res.RefundID != "re-pay-1" || res.RefundAmount != 20 || repo.refunds["paid"] != "re-pay-1" {
+		t.Errorf("result = %+v, stored refund %q; want re-pay-1 for 20", res, repo.refunds["paid"])
+	}
+	if !slices.Equal(payments.keys, []string{"order-refund-paid"}) || len(logistics.released) != 1 {
+		t.Errorf("refund keys %v, released %v; want one keyed refund and no second release", payments.keys, logistics.released)
+	}
+	if _, err := svc.AdminCancelOrder(ctx, "paid", "admin1", req); !errors.Is(err, models.ErrOrderCannotBeCancelled) {
+		t.Errorf("third cancel error = %v; want ErrOrderCannotBeCancelled", err)
+	}
+
+	res, err = svc.AdminCancelOrder(ctx, "unpaid", "admin1", req)
+	if err != nil {
+		t.Fatalf("AdminCancelOrder(unpaid) error: %v", err)
+	}
+	if res.Order.Status != models.OrderStatusCancelled || res.RefundID != "" || repo.queue["unpaid"] != nil {
+		t.Errorf("unpaid result = %+v, queued %v; want cancelled without refund and dequeued", res, repo.queue["unpaid"] != nil)
+	}
+	if _, err := svc.AdminCancelOrder(ctx, "done", "admin1", req); !errors.Is(err, models.ErrOrderCannotBeCancelled) {
+		t.Errorf("delivered order error = %v; want ErrOrderCannotBeCancelled", err)
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	m1 := "m1"
+	repo.orders["queued"] = &models.Order{ID: "queued", UserID: "u1", Status: models.OrderStatusConfirmed, Cost: 30}
+	repo.orders["moving"] = &models.Order{ID: "moving", UserID: "u1", Status: models.OrderStatusInProgress, MachineID: &m1, Cost: 20}
+	repo.orders["unpaid"] = &models.Order{ID: "unpaid", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 20}
+	repo.orders["arrived"] = &models.Order{ID: "arrived", UserID: "u1", Status: models.OrderStatusArrived, Cost: 20}
+	repo.payments["queued"] = "pay-q"
+	repo.payments["moving"] = "pay-m"
+	repo.queue["queued"] = &models.PendingAssignment{OrderID: "queued"}
+	payments := &countingPayments{}
+	logistics := &fakeLogistics{repo: repo}
+	svc := NewService(repo, payments, logistics, fakeTx{}, WithCancellationPolicy(models.CancellationPolicy{
+		QueuedFeeRate:     0.1,
+		InProgressFeeRate: 0.5,
+		MinFee:            5,
+	}))
+
+	// A queued order pays the minimum fee, over 10% of 30.
+	quote, err := svc.CancellationQuote(ctx, "queued", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("CancellationQuote error: %v", err)
+	}
+	if quote.Fee != 5 || quote.RefundAmount != 25 {
+		t.Errorf("quote = %+v; want fee 5, refund 25", quote)
+	}
+	res, err := svc.CancelOrder(ctx, "queued", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("CancelOrder(queued) error: %v", err)
+	}
+	if res.Fee != 5 || res.RefundAmount != 25 || res.RefundID != "re-pay-q" || res.Order.Status != models.OrderStatusCancelled {
+		t.Errorf("result = %+v; want cancelled, fee 5, re-pay-q for 25", res)
+	}
+	if fee := repo.orders["queued"].CancellationFee; fee == nil || *fee != 5 || repo.queue["queued"] != nil {
+		t.Errorf("stored fee %v, queued %v; want 5 and dequeued", fee, repo.queue["queued"] != nil)
+	}
+	last := repo.history[len(repo.history)-1]
+	if last.ActorType != models.ActorUser || last.ActorID != "u1" {
+		t.Errorf("history entry = %+v; want the customer", last)
+	}
+
+	// A moving order pays half; its machine is released and recalled even
+	// though the refund fails, and cancelling again retries the refund.
+	payments.fail = errors.New("stripe down")
+	if _, err := svc.CancelOrder(ctx, "moving", "u1", models.RoleCustomer); !errors.Is(err, models.ErrRefundFailed) {
+		t.Fatalf("CancelOrder(moving) error = %v; want ErrRefundFailed", err)
+	}
+	if !slices.Equal(logistics.released, []string{"m1"}) || !slices.Equal(logistics.recalled, []string{"m1"}) {
+		t.Errorf("released %v, recalled %v; want [m1] each", logistics.released, logistics.recalled)
+	}
+	payments.fail = nil
+	res, err = svc.CancelOrder(ctx, "moving", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("retried CancelOrder error: %v", err)
+	}
+	if res.Fee != 10 || res.RefundAmount != 10 || repo.refunds["moving"] != "re-pay-m" || len(logistics.recalled) != 1 {
+		t.Errorf("result = %+v, recalled %v; want re-pay-m for 10 and no second recall", res, logistics.recalled)
+	}
+	if _, err := svc.CancelOrder(ctx, "moving", "u1", models.RoleCustomer); !errors.Is(err, models.ErrOrderCannotBeCancelled) {
+		t.Errorf("third cancel error = %v; want ErrOrderCannotBeCancelled", err)
+	}
+
+	// Unpaid orders are cancelled free; arrived ones not at all.
+	res, err = svc.CancelOrder(ctx, "unpaid", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("CancelOrder(unpaid) error: %v", err)
+	}
+	if res.Fee != 0 || res.RefundID != "" || repo.orders["unpaid"].CancellationFee != nil {
+		t.Errorf("unpaid result = %+v; want no fee or refund", res)
+	}
+	if _, err := svc.CancellationQuote(ctx, "arrived", "u1", models.RoleCustomer); !errors.Is(err, models.ErrOrderCannotBeCancelled) {
+		t.Errorf("arrived quote error = %v; want ErrOrderCannotBeCancelled", err)
+	}
+	if _, err := svc.CancelOrder(ctx, "arrived", "u1", models.RoleCustomer); !errors.Is(err, models.ErrOrderCannotBeCancelled) {
+		t.Errorf("arrived cancel error = %v; want ErrOrderCannotBeCancelled", err)
+	}
+}
+
+func TestCreateReturn(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	delivered := func(id string, ago time.Duration) {
+		repo.orders[id] = &models.Order{
+			ID: id, UserID: "u1", Status: models.OrderStatusDelivered, ItemWeightKg: 2,
+			PickupAddressID: "a-home", DropoffAddressID: "a-shop",
+			PickupAddress: &models.Address{ID: "a-home"}, DropoffAddress: &models.Address{ID: "a-shop"},
+		}
+		repo.history = append(repo.history, &models.OrderStatusEvent{OrderID: id, ToStatus: models.OrderStatusDelivered, CreatedAt: time.Now().Add(-ago)})
+	}
+	delivered("recent", 24*time.Hour)
+	delivered("older", 10*24*time.Hour)
+	delivered("old", 31*24*time.Hour)
+
+	quote, err := svc.GetReturnQuote(ctx, "recent", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("GetReturnQuote error: %v", err)
+	}
+	if !quote.Free || len(quote.Options) != 1 || quote.Options[0].PickupLocation.ID != "a-shop" {
+		t.Fatalf("quote = %+v; want one free option from the dropoff", quote)
+	}
+	ret, err := svc.CreateReturn(ctx, "recent", "u1", models.RoleCustomer, models.CreateReturnRequest{RouteOptionID: quote.Options[0].ID})
+	if err != nil {
+		t.Fatalf("CreateReturn error: %v", err)
+	}
+	if ret.Status != models.OrderStatusConfirmed || ret.Cost != 0 || ret.PickupAddressID != "a-shop" || ret.DropoffAddressID != "a-home" {
+		t.Errorf("free return = %+v; want a CONFIRMED reverse order at no cost", ret)
+	}
+	if b := ret.CostBreakdown; b == nil || b.Discount != 12.5 || b.Total != 0 {
+		t.Errorf("free return breakdown = %+v; want 12.50 discounted to 0", b)
+	}
+	if ret.ReturnOfOrderID == nil || *ret.ReturnOfOrderID != "recent" || repo.queue[ret.ID] == nil {
+		t.Errorf("free return linked to %v, queued %v; want linked to recent and queued", ret.ReturnOfOrderID, repo.queue[ret.ID] != nil)
+	}
+	if _, err := svc.GetReturnQuote(ctx, "recent", "u1", models.RoleCustomer); !errors.Is(err, models.ErrReturnAlreadyExists) {
+		t.Errorf("second return error = %v; want ErrReturnAlreadyExists", err)
+	}
+	if _, err := svc.GetReturnQuote(ctx, ret.ID, "u1", models.RoleCustomer); !errors.Is(err, models.ErrOrderCannotBeReturned) {
+		t.Errorf("return of a return error = %v; want ErrOrderCannotBeReturned", err)
+	}
+
+	// A concurrent request that passed the check too loses on the unique
+	// index, and gets a conflict rather than a server error.
+	racing := NewService(racingReturnRepo{repo}, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	quote, err = racing.GetReturnQuote(ctx, "recent", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("racing GetReturnQuote error: %v", err)
+	}
+	_, err = racing.CreateReturn(ctx, "recent", "u1", models.RoleCustomer, models.CreateReturnRequest{RouteOptionID: quote.Options[0].ID})
+	if !errors.Is(err, models.ErrReturnAlreadyExists) || models.ToAPIError(err).Status != http.StatusConflict {
+		t.Errorf("racing return error = %v; want ErrReturnAlreadyExists as a 409", err)
+	}
+
+	// Past the free window the return is quoted and paid like an order.
+	quote, err = svc.GetReturnQuote(ctx, "older", "u1", models.RoleCustomer)
+	if err != nil || quote.Free {
+		t.Fatalf("GetReturnQuote(older) = %+v, %v; want a paid quote", quote, err)
+	}
+	ret, err = svc.CreateReturn(ctx, "older", "u1", models.RoleCustomer, models.CreateReturnRequest{RouteOptionID: quote.Options[0].ID})
+	if err != nil {
+		t.Fatalf("CreateReturn(older) error: %v", err)
+	}
+	if ret.Status != models.OrderStatusPendingPayment || ret.Cost != 12.5 || repo.queue[ret.ID] != nil {
+		t.Errorf("paid return = %+v; want PENDING_PAYMENT at the quoted 12.50, not queued", ret)
+	}
+	if b := ret.CostBreakdown; b == nil || b.Discount != 0 || b.Total != 12.5 {
+		t.Errorf("paid return breakdown = %+v; want the quoted 12.50", b)
+	}
+
+	if _, err := svc.GetReturnQuote(ctx, "old", "u1", models.RoleCustomer); !errors.Is(err, models.ErrOrderCannotBeReturned) {
+		t.Errorf("return after 31 days error = %v; want ErrOrderCannotBeReturned", err)
+	}
+	if _, err := svc.CreateReturn(ctx, "old", "u2", models.RoleCustomer, models.CreateReturnRequest{RouteOptionID: "r-a-shop-a-home"}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("another customer's return error = %v; want ErrNotFound", err)
+	}
+}
+
+// racingReturnRepo misses the live returns of its orders, as a request
+// racing the one that creates them does.
+type racingReturnRepo struct{ *fakeRepo }
+
+func (racingReturnRepo) HasReturn(ctx context.Context, orderID string) (bool, error) {
+	return false, nil
+}
+
+func TestReorder(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	repo.orders["past"] = &models.Order{
+		ID: "past", UserID: "u1", Status: models.OrderStatusDelivered, Priority: models.PriorityExpress, Cost: 30,
+		PickupAddressID: "a-home", DropoffAddressID: "a-shop",
+		PickupAddress: &models.Address{ID: "a-home"}, DropoffAddress: &models.Address{ID: "a-shop"},
+		Dimensions: models.Dimensions{Length: 0.3, Width: 0.2, Height: 0.1}, RecipientName: "Ada",
+	}
+
+	order, err := svc.Reorder(ctx, "past", "u1", models.RoleCustomer, models.ReorderRequest{IdempotencyKey: "k1"})
+	if err != nil {
+		t.Fatalf("Reorder error: %v", err)
+	}
+	if order.ID == "past" || order.Status != models.OrderStatusPendingPayment || order.PickupAddressID != "a-home" || order.DropoffAddressID != "a-shop" {
+		t.Errorf("reorder = %+v; want a new PENDING_PAYMENT order between the same addresses", order)
+	}
+	if order.Priority != models.PriorityExpress || order.Cost != 18.75 || order.RecipientName != "Ada" {
+		t.Errorf("reorder priority = %s, cost = %.2f, recipient = %q; want EXPRESS freshly quoted at 18.75 for Ada", order.Priority, order.Cost, order.RecipientName)
+	}
+	again, err := svc.Reorder(ctx, "past", "u1", models.RoleCustomer, models.ReorderRequest{IdempotencyKey: "k1"})
+	if err != nil || again.ID != order.ID {
+		t.Errorf("repeated reorder = %v, %v; want the first order %s", again, err, order.ID)
+	}
+
+	order, err = svc.Reorder(ctx, "past", "u1", models.RoleCustomer, models.ReorderRequest{Priority: models.PriorityStandard})
+	if err != nil || order.Priority != models.PriorityStandard || order.Cost != 12.5 {
+		t.Errorf("standard reorder = %+v, %v; want STANDARD at 12.50", order, err)
+	}
+	if _, err := svc.Reorder(ctx, "past", "u2", models.RoleCustomer, models.ReorderRequest{}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("another customer's reorder error = %v; want ErrNotFound", err)
+	}
+}
+
+func TestOrderMessages(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", Status: models.OrderStatusInProgress}
+
+	if _, err := svc.PostOrderMessage(ctx, "o1", "u1", models.RoleCustomer, models.OrderMessageRequest{Body: "Is it on its way?"}); err != nil {
+		t.Fatalf("customer PostOrderMessage error: %v", err)
+	}
+	if _, err := svc.PostOrderMessage(ctx, "o1", "u2", models.RoleCustomer, models.OrderMessageRequest{Body: "hi"}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("another customer's message error = %v; want ErrNotFound", err)
+	}
+	var apiErr *models.APIError
+	if _, err := svc.PostOrderMessage(ctx, "o1", "u1", models.RoleCustomer, models.OrderMessageRequest{Body: "  "}); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+		t.Errorf("blank message error = %v; want a validation error", err)
+	}
+
+	unread, err := svc.UnreadMessages(ctx, "s1", models.RoleSupport)
+	if err != nil || unread.Total != 1 || unread.Orders[0].OrderID != "o1" {
+		t.Errorf("support unread = %+v, %v; want the customer's message on o1", unread, err)
+	}
+	if _, err := svc.ListOrderMessages(ctx, "o1", "s1", models.RoleSupport); err != nil {
+		t.Fatalf("support ListOrderMessages error: %v", err)
+	}
+	reply, err := svc.PostOrderMessage(ctx, "o1", "s1", models.RoleSupport, models.OrderMessageRequest{Body: "Yes, arriving in 10 minutes."})
+	if err != nil || reply.SenderRole != models.RoleSupport {
+		t.Fatalf("support PostOrderMessage = %+v, %v; want a SUPPORT message", reply, err)
+	}
+	spam, _ := svc.PostOrderMessage(ctx, "o1", "s1", models.RoleSupport, models.OrderMessageRequest{Body: "spam"})
+	if unread, _ := svc.UnreadMessages(ctx, "s1", models.RoleSupport); unread.Total != 0 {
+		t.Errorf("support unread after reading = %+v; want none", unread)
+	}
+	if len(repo.notes["u1"]) != 2 {
+		t.Errorf("customer notifications = %v; want one per staff message", repo.notes["u1"])
+	}
+
+	if err := svc.HideOrderMessage(ctx, "o1", spam.ID, "admin"); err != nil {
+		t.Fatalf("HideOrderMessage error: %v", err)
+	}
+	if err := svc.HideOrderMessage(ctx, "o2", spam.ID, "admin"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("hiding through another order error = %v; want ErrNotFound", err)
+	}
+	unread, _ = svc.UnreadMessages(ctx, "u1", models.RoleCustomer)
+	if unread.Total != 1 {
+		t.Errorf("customer unread = %+v; want only the visible reply", unread)
+	}
+	thread, err := svc.ListOrderMessages(ctx, "o1", "u1", models.RoleCustomer)
+	if err != nil || len(thread) != 2 || thread[1].ID != reply.ID {
+		t.Errorf("customer thread = %v, %v; want the question and the reply", thread, err)
+	}
+	if unread, _ := svc.UnreadMessages(ctx, "u1", models.RoleCustomer); unread.Total != 0 {
+		t.Errorf("customer unread after reading = %+v; want none", unread)
+	}
+	if thread, _ := svc.ListOrderMessages(ctx, "o1", "admin", models.RoleAdmin); len(thread) != 3 || thread[2].HiddenAt == nil {
+		t.Errorf("admin thread = %v; want all three with the hidden one marked", thread)
+	}
+}
+
+func TestReceiptPDF(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	repo.orders["o1"] = &models.Order{
+		ID: "o1", UserID: "u1", Status: models.OrderStatusPendingPayment, Cost: 13.5,
+		PickupAddress: &models.Address{StreetAddress: "1 Market St"}, DropoffAddress: &models.Address{StreetAddress: "(rear) 9 Pine St"},
+		CostBreakdown: &models.CostBreakdown{BaseFare: 2, DistanceCharge: 10.5, Tax: 1, Total: 13.5},
+	}
+	if _, err := svc.ReceiptPDF(ctx, "o1", "u1", models.RoleCustomer); !errors.Is(err, models.ErrReceiptNotAvailable) {
+		t.Errorf("unpaid receipt error = %v; want ErrReceiptNotAvailable", err)
+	}
+
+	repo.history = append(repo.history, &models.OrderStatusEvent{OrderID: "o1", ToStatus: models.OrderStatusConfirmed, CreatedAt: time.Now()})
+	repo.payments["o1"] = "pi_123"
+	receipt, err := svc.ReceiptPDF(ctx, "o1", "u1", models.RoleCustomer)
+	if err != nil {
+		t.Fatalf("ReceiptPDF error: %v", err)
+	}
+	if !bytes.HasPrefix(receipt, []byte("%PDF-")) || !bytes.HasSuffix(receipt, []byte("%%EOF\n")) {
+		t.Errorf("receipt is not a PDF file: %q...", receipt[:min(len(receipt), 16)])
+	}
+	for _, want := range []string{"(pi_123)", "(1 Market St)", `(\(rear\) 9 Pine St)`, "(10.50)", "(13.50)"} {
+		if !bytes.Contains(receipt, []byte(want)) {
+			t.Errorf("receipt does not contain %s", want)
+		}
+	}
+	if _, err := svc.ReceiptPDF(ctx, "o1", "u2", models.RoleCustomer); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("another customer's receipt error = %v; want ErrNotFound", err)
+	}
+}
+
+func TestInsurance(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	logistics := &fakeLogistics{repo: repo}
+	svc := NewService(repo, fakePayments{}, logistics, fakeTx{}, WithInsurancePolicy(models.InsurancePolicy{
+		Rate:             0.02,
+		MinPremium:       1,
+		MaxDeclaredValue: 1000,
+	}))
+	insured := func(value float64) models.RouteRequest {
+		return models.RouteRequest{Insurance: &models.InsuranceRequest{DeclaredValue: value}}
+	}
+
+	options, err := svc.GetDeliveryQuote(ctx, "u1", insured(500))
+	if err != nil {
+		t.Fatalf("GetDeliveryQuote error: %v", err)
+	}
+	o := options[0]
+	if o.InsuredValue != 500 || o.CostBreakdown.Insurance != 10 || o.CostBreakdown.Total != 22.5 || o.EstimatedCost != 22.5 {
+		t.Errorf("insured option = %+v; want 500 insured for a premium of 10, 22.50 in all", o)
+	}
+	order, err := svc.CreateOrder(ctx, "u1", models.CreateOrderRequest{RouteOptionID: o.ID})
+	if err != nil {
+		t.Fatalf("CreateOrder error: %v", err)
+	}
+	if order.InsuredValue == nil || *order.InsuredValue != 500 || order.Cost != 22.5 {
+		t.Errorf("order insured for %v at %.2f; want 500 at 22.50", order.InsuredValue, order.Cost)
+	}
+	if cheap, err := svc.GetDeliveryQuote(ctx, "u1", insured(20)); err != nil || cheap[0].CostBreakdown.Insurance != 1 {
+		t.Errorf("premium for 20 = %+v, %v; want the minimum of 1", cheap, err)
+	}
+	var apiErr *models.APIError
+	if _, err := svc.GetDeliveryQuote(ctx, "u1", insured(1000.01)); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+		t.Errorf("declared value over the maximum: error = %v; want a validation error", err)
+	}
+	uninsurable := NewService(repo, fakePayments{}, logistics, fakeTx{})
+	if _, err := uninsurable.GetDeliveryQuote(ctx, "u1", insured(100)); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+		t.Errorf("insurance without a policy: error = %v; want a validation error", err)
+	}
+
+	// Claims on an insured order are for at most its insured value.
+	repo.orders[order.ID].Status = models.OrderStatusDelivered
+	repo.history = append(repo.history, &models.OrderStatusEvent{OrderID: order.ID, ToStatus: models.OrderStatusDelivered, CreatedAt: time.Now()})
+	lost := models.CreateClaimRequest{Type: models.ClaimTypeLost, Description: "never arrived", Amount: 600}
+	if _, err := svc.FileClaim(ctx, order.ID, "u1", models.RoleCustomer, lost); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+		t.Errorf("claim over the insured value: error = %v; want a validation error", err)
+	}
+	lost.Amount = 500
+	claim, err := svc.FileClaim(ctx, order.ID, "u1", models.RoleCustomer, lost)
+	if err != nil {
+		t.Fatalf("FileClaim error: %v", err)
+	}
+	if claim.InsuredValue == nil || *claim.InsuredValue != 500 {
+		t.Errorf("claim insured value = %v; want 500", claim.InsuredValue)
+	}
+
+	// Reordering keeps the insurance.
+	repo.orders[order.ID].PickupAddress = &models.Address{ID: order.PickupAddressID}
+	repo.orders[order.ID].DropoffAddress = &models.Address{ID: order.DropoffAddressID}
+	again, err := svc.Reorder(ctx, order.ID, "u1", models.RoleCustomer, models.ReorderRequest{})
+	if err != nil {
+		t.Fatalf("Reorder error: %v", err)
+	}
+	if again.InsuredValue == nil || *again.InsuredValue != 500 || again.Cost != 22.5 {
+		t.Errorf("reorder insured for %v at %.2f; want 500 at 22.50", again.InsuredValue, again.Cost)
+	}
+}
+
+func TestPromoCodes(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	for _, o := range []struct{ id, user string }{{"o1", "u1"}, {"o2", "u1"}, {"o3", "u2"}, {"o4", "u2"}} {
+		repo.orders[o.id] = &models.Order{ID: o.id, UserID: o.user, Status: models.OrderStatusPendingPayment, Cost: 20,
+			CostBreakdown: &models.CostBreakdown{BaseFare: 20, Total: 20}}
+	}
+	payments := &countingPayments{}
+	svc := NewService(repo, payments, &fakeLogistics{repo: repo}, fakeTx{})
+	one := 1
+	tomorrow := time.Now().Add(24 * time.Hour)
+	for _, req := range []models.CreatePromoCodeRequest{
+		{Code: "save10", DiscountType: models.PromoDiscountPercent, Value: 10, MaxPerUser: &one},
+		{Code: "FIVE", DiscountType: models.PromoDiscountFixed, Value: 5, MaxRedemptions: &one},
+		{Code: "FREE", DiscountType: models.PromoDiscountFixed, Value: 50},
+		{Code: "SOON", DiscountType: models.PromoDiscountFixed, Value: 5, ValidFrom: &tomorrow},
+		{Code: "GONE", DiscountType: models.PromoDiscountFixed, Value: 5},
+	} {
+		if _, err := svc.CreatePromoCode(ctx, "admin", req); err != nil {
+			t.Fatalf("CreatePromoCode(%s) error: %v", req.Code, err)
+		}
+	}
+	var apiErr *models.APIError
+	if _, err := svc.CreatePromoCode(ctx, "admin", models.CreatePromoCodeRequest{Code: "HALF", DiscountType: models.PromoDiscountPercent, Value: 150}); !errors.As(err, &apiErr) || apiErr.Code != models.CodeValidationFailed {
+		t.Errorf("percentage over 100: error = %v; want a validation error", err)
+	}
+	if _, err := svc.CreatePromoCode(ctx, "admin", models.CreatePromoCodeRequest{Code: "Save10", DiscountType: models.PromoDiscountFixed, Value: 1}); !errors.Is(err, models.ErrPromoCodeTaken) {
+		t.Errorf("duplicate code: error = %v; want ErrPromoCodeTaken", err)
+	}
+	if page, err := svc.ListPromoCodes(ctx, models.PromoCodeQuery{}); err != nil || page.Total != 5 || page.PromoCodes[0].Code != "GONE" {
+		t.Errorf("ListPromoCodes = %+v, %v; want 5 codes, newest first", page, err)
+	}
+	if _, err := svc.DisablePromoCode(ctx, repo.promos[4].ID); err != nil {
+		t.Fatalf("DisablePromoCode error: %v", err)
+	}
+
+	pay := func(orderID, userID, code string) (*models.Order, error) {
+		return svc.ConfirmAndPay(ctx, userID, orderID, models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm", PromoCode: code})
+	}
+	for _, code := range []string{"NOPE", "SOON", "GONE"} {
+		if _, err := pay("o1", "u1", code); !errors.Is(err, models.ErrPromoCodeInvalid) {
+			t.Errorf("pay with %s: error = %v; want ErrPromoCodeInvalid", code, err)
+		}
+	}
+
+	// The discount is taken off the amount charged and shown in the breakdown.
+	paid, err := pay("o1", "u1", " save10 ")
+	if err != nil {
+		t.Fatalf("ConfirmAndPay error: %v", err)
+	}
+	if paid.Cost != 18 || paid.CostBreakdown.Discount != 2 || paid.CostBreakdown.Total != 18 || payments.charged[0] != 18 {
+		t.Errorf("paid %v for cost %.2f, breakdown %+v; want 18 with a discount of 2", payments.charged, paid.Cost, paid.CostBreakdown)
+	}
+	if _, err := pay("o2", "u1", "SAVE10"); !errors.Is(err, models.ErrPromoCodeExhausted) {
+		t.Errorf("second use by the same customer: error = %v; want ErrPromoCodeExhausted", err)
+	}
+
+	// A failed charge gives the code back and restores the price.
+	payments.fail = &payment.DeclinedError{Err: errors.New("card declined")}
+	if _, err := pay("o2", "u1", "FIVE"); err == nil {
+		t.Fatal("payment succeeded while the provider was failing")
+	}
+	if o := repo.orders["o2"]; o.Cost != 20 || o.CostBreakdown.Discount != 0 || repo.promos[1].Redemptions != 0 {
+		t.Errorf("after a failed charge cost = %.2f, discount = %.2f, redemptions = %d; want 20, 0, 0", o.Cost, o.CostBreakdown.Discount, repo.promos[1].Redemptions)
+	}
+	payments.fail = nil
+	if paid, err := svc.RetryPayment(ctx, "u1", "o2", models.RoleCustomer, models.PaymentRequest{PaymentMethodID: "pm", PromoCode: "FIVE"}); err != nil || paid.Cost != 15 || payments.charged[1] != 15 {
+		t.Errorf("retry with FIVE = %+v, %v after charges %v; want 15 charged", paid, err, payments.charged)
+	}
+	if _, err := pay("o3", "u2", "FIVE"); !errors.Is(err, models.ErrPromoCodeExhausted) {
+		t.Errorf("use past the total limit: error = %v; want ErrPromoCodeExhausted", err)
+	}
+
+	// An order discounted to nothing is confirmed without a charge.
+	free, err := pay("o3", "u2", "FREE")
+	if err != nil {
+		t.Fatalf("ConfirmAndPay with FREE error: %v", err)
+	}
+	if free.Status != models.OrderStatusConfirmed || free.Cost != 0 || len(payments.charged) != 2 || repo.payments["o3"] != "" {
+		t.Errorf("free order %s at %.2f after charges %v, payment %q; want CONFIRMED at 0 without a charge", free.Status, free.Cost, payments.charged, repo.payments["o3"])
+	}
+}
+
+func TestClaims(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	files, err := storage.NewLocalStorage(t.TempDir(), "http://files.test/files", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{}, WithStorage(files))
+	delivered := time.Now().Add(-time.Hour)
+	for _, id := range []string{"o1", "o2"} {
+		repo.orders[id] = &models.Order{ID: id, UserID: "u1", Status: models.OrderStatusDelivered, Cost: 20}
+		repo.history = append(repo.history, &models.OrderStatusEvent{OrderID: id, ToStatus: models.OrderStatusDelivered, CreatedAt: delivered})
+	}
+	repo.orders["o3"] = &models.Order{ID: "o3", UserID: "u1", Status: models.OrderStatusInProgress}
+	repo.payments["o1"] = "pi_1"
+	damaged := models.CreateClaimRequest{Type: models.ClaimTypeDamaged, Description: " cracked screen ", Amount: 50}
+
+	if _, err := svc.FileClaim(ctx, "o3", "u1", models.RoleCustomer, damaged); !errors.Is(err, models.ErrClaimNotAllowed) {
+		t.Errorf("claim on order in progress: error = %v; want ErrClaimNotAllowed", err)
+	}
+	claim, err := svc.FileClaim(ctx, "o1", "u1", models.RoleCustomer, damaged)
+	if err != nil {
+		t.Fatalf("FileClaim error: %v", err)
+	}
+	if claim.Status != models.ClaimStatusOpen || claim.Description != "cracked screen" {
+		t.Errorf("claim = %+v; want an OPEN claim for the trimmed description", claim)
+	}
+	if _, err := svc.FileClaim(ctx, "o1", "u1", models.RoleCustomer, damaged); !errors.Is(err, models.ErrClaimAlreadyExists) {
+		t.Errorf("second claim: error = %v; want ErrClaimAlreadyExists", err)
+	}
+
+	photo, err := svc.AddClaimPhoto(ctx, "o1", "u1", models.RoleCustomer, strings.NewReader("jpeg"), 4, "image/jpeg")
+	if err != nil {
+		t.Fatalf("AddClaimPhoto error: %v", err)
+	}
+	if !strings.HasPrefix(photo.Key, "claims/photos/"+claim.ID+"/") || !strings.HasSuffix(photo.Key, ".jpg") || photo.URL == "" {
+		t.Errorf("photo = %+v; want a .jpg under the claim with a download link", photo)
+	}
+	if _, err := svc.AddClaimPhoto(ctx, "o1", "u1", models.RoleCustomer, strings.NewReader("%PDF"), 4, "application/pdf"); !errors.Is(err, storage.ErrUnsupportedContent) {
+		t.Errorf("PDF photo: error = %v; want ErrUnsupportedContent", err)
+	}
+	got, err := svc.GetClaim(ctx, "o1", "admin", models.RoleAdmin)
+	if err != nil || len(got.Photos) != 1 || got.Photos[0].URL == "" {
+		t.Fatalf("GetClaim = %+v, %v; want the claim with its photo", got, err)
+	}
+
+	// Refunds are capped at what was paid, and keyed by the claim.
+	refund := models.ClaimDecisionRequest{Approve: true, Resolution: models.ClaimResolutionRefund}
+	if _, err := svc.DecideClaim(ctx, claim.ID, "admin", refund); err == nil {
+		t.Error("refunding 50 of a 20 payment succeeded")
+	}
+	refund.Amount = 15
+	decided, err := svc.DecideClaim(ctx, claim.ID, "admin", refund)
+	if err != nil {
+		t.Fatalf("DecideClaim error: %v", err)
+	}
+	if decided.Status != models.ClaimStatusApproved || decided.RefundID != "re-pi_1" || *decided.AmountApproved != 15 {
+		t.Errorf("decided claim = %+v; want APPROVED with refund re-pi_1 of 15", decided)
+	}
+	if _, err := svc.DecideClaim(ctx, claim.ID, "admin", models.ClaimDecisionRequest{}); !errors.Is(err, models.ErrClaimAlreadyDecided) {
+		t.Errorf("deciding again: error = %v; want ErrClaimAlreadyDecided", err)
+	}
+	if _, err := svc.AddClaimPhoto(ctx, "o1", "u1", models.RoleCustomer, strings.NewReader("jpeg"), 4, "image/jpeg"); !errors.Is(err, models.ErrClaimAlreadyDecided) {
+		t.Errorf("photo on decided claim: error = %v; want ErrClaimAlreadyDecided", err)
+	}
+
+	// o2 was never paid, so it can only be credited, by default in full.
+	lost, err := svc.FileClaim(ctx, "o2", "u1", models.RoleCustomer, models.CreateClaimRequest{Type: models.ClaimTypeLost, Description: "never arrived", Amount: 30})
+	if err != nil {
+		t.Fatalf("FileClaim error: %v", err)
+	}
+	if _, err := svc.DecideClaim(ctx, lost.ID, "admin", models.ClaimDecisionRequest{Approve: true, Resolution: models.ClaimResolutionRefund}); !errors.Is(err, models.ErrClaimNotRefundable) {
+		t.Errorf("refunding unpaid order: error = %v; want ErrClaimNotRefundable", err)
+	}
+	if _, err := svc.DecideClaim(ctx, lost.ID, "admin", models.ClaimDecisionRequest{Approve: true, Resolution: models.ClaimResolutionCredit}); err != nil {
+		t.Fatalf("DecideClaim error: %v", err)
+	}
+	wallet, err := svc.Wallet(ctx, "u1")
+	if err != nil || wallet.Balance != 30 || len(wallet.Credits) != 1 || *wallet.Credits[0].ClaimID != lost.ID {
+		t.Errorf("Wallet = %+v, %v; want 30 credited for claim %s", wallet, err, lost.ID)
+	}
+	if n := len(repo.notes["u1"]); n != 2 {
+		t.Errorf("customer got %d notification(s); want one per decision", n)
+	}
+
+	open := models.ClaimStatusOpen
+	if page, err := svc.ListClaims(ctx, models.ClaimQuery{Status: &open}); err != nil || page.Total != 0 {
+		t.Errorf("open claims = %+v, %v; want none", page, err)
+	}
+}
+
+func TestRouteQuotes(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	logistics := &fakeLogistics{repo: repo}
+	quoting := NewService(repo, fakePayments{}, logistics, fakeTx{}, WithQuoteTTL(time.Minute))
+
+	options, err := quoting.GetDeliveryQuote(ctx, "u1", models.RouteRequest{})
+	if err != nil || len(options) != 1 {
+		t.Fatalf("GetDeliveryQuote = %v, %v; want one option", options, err)
+	}
+	if q := repo.quotes[options[0].ID]; time.Until(q.expiresAt) > time.Minute || q.userID != "u1" {
+		t.Errorf("stored quote = %+v; want u1's, expiring within a minute", q)
+	}
+	if got := options[0].ExpiresAt; !got.Equal(repo.quotes[options[0].ID].expiresAt) {
+		t.Errorf("option expires_at = %v; want the stored expiry", got)
+	}
+
+	// Another instance, e.g. after a restart, can order the stored quote, but
+	// only for the customer who asked for it.
+	ordering := NewService(repo, fakePayments{}, logistics, fakeTx{})
+	req := models.CreateOrderRequest{RouteOptionID: options[0].ID}
+	if _, err := ordering.CreateOrder(ctx, "u2", req); !errors.Is(err, models.ErrRouteOptionNotFound) {
+		t.Errorf("u2 ordering u1's quote: error = %v; want ErrRouteOptionNotFound", err)
+	}
+	if _, err := ordering.CreateOrder(ctx, "u1", req); err != nil {
+		t.Fatalf("CreateOrder error: %v", err)
+	}
+	if _, err := ordering.CreateOrder(ctx, "u1", req); !errors.Is(err, models.ErrRouteOptionNotFound) {
+		t.Errorf("reusing a quote: error = %v; want ErrRouteOptionNotFound", err)
+	}
+
+	repo.quotes["old"] = fakeQuote{userID: "u1", option: models.RouteOption{ID: "old"}, expiresAt: time.Now().Add(-time.Second)}
+	if _, err := ordering.CreateOrder(ctx, "u1", models.CreateOrderRequest{RouteOptionID: "old"}); !errors.Is(err, models.ErrRouteOptionExpired) {
+		t.Errorf("expired quote: error = %v; want ErrRouteOptionExpired", err)
+	}
+	if err := ordering.PurgeRouteQuotes(ctx); err != nil || len(repo.quotes) != 0 {
+		t.Errorf("PurgeRouteQuotes left %d quote(s), error %v; want none", len(repo.quotes), err)
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	ctx := context.Background()
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{})
+	m1, m2 := "m1", "m2"
+	repo.orders["o1"] = &models.Order{ID: "o1", UserID: "u1", MachineID: &m1, Status: models.OrderStatusDelivered}
+	repo.orders["o2"] = &models.Order{ID: "o2", UserID: "u1", MachineID: &m1, Status: models.OrderStatusDelivered}
+	repo.orders["o3"] = &models.Order{ID: "o3", UserID: "u2", MachineID: &m2, Status: models.OrderStatusDelivered}
+	repo.orders["o4"] = &models.Order{ID: "o4", UserID: "u1", Status: models.OrderStatusInProgress}
+
+	fb, err := svc.SubmitFeedback(ctx, "u1", "o1", models.RoleCustomer, models.FeedbackRequest{Rating: 5, Comment: "quick"})
+	if err != nil {
+		t.Fatalf("SubmitFeedback error: %v", err)
+	}
+	if fb.MachineID == nil || *fb.MachineID != "m1" || fb.Rating != 5 {
+		t.Errorf("feedback = %+v; want rating 5 for m1", fb)
+	}
+	if _, err := svc.SubmitFeedback(ctx, "u1", "o1", models.RoleCustomer, models.FeedbackRequest{Rating: 1}); !errors.Is(err, models.ErrFeedbackAlreadySubmitted) {
+		t.Errorf("second feedback error = %v; want ErrFeedbackAlreadySubmitted", err)
+	}
+	if _, err := svc.SubmitFeedback(ctx, "u1", "o4", models.RoleCustomer, models.FeedbackRequest{Rating: 4}); !errors.Is(err, models.ErrCannotSubmitFeedback) {
+		t.Errorf("feedback before delivery error = %v; want ErrCannotSubmitFeedback", err)
+	}
+	if _, err := svc.SubmitFeedback(ctx, "u1", "o3", models.RoleCustomer, models.FeedbackRequest{Rating: 4}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("feedback on another customer's order error = %v; want ErrNotFound", err)
+	}
+	if order, err := svc.GetOrderDetails(ctx, "o1", "u1", models.RoleCustomer); err != nil || order.Feedback == nil || order.Feedback.Comment != "quick" {
+		t.Errorf("GetOrderDetails = %+v, %v; want it to include the feedback", order, err)
+	}
+
+	if _, err := svc.SubmitFeedback(ctx, "u1", "o2", models.RoleCustomer, models.FeedbackRequest{Rating: 2}); err != nil {
+		t.Fatalf("SubmitFeedback(o2) error: %v", err)
+	}
+	if _, err := svc.SubmitFeedback(ctx, "u2", "o3", models.RoleCustomer, models.FeedbackRequest{Rating: 4}); err != nil {
+		t.Fatalf("SubmitFeedback(o3) error: %v", err)
+	}
+	page, err := svc.ListFeedback(ctx, models.FeedbackQuery{MachineID: "m1"})
+	if err != nil || page.Total != 2 || len(page.Feedback) != 2 {
+		t.Errorf("ListFeedback(m1) = %+v, %v; want both of m1's", page, err)
+	}
+	ratings, err := svc.MachineRatings(ctx)
+	if err != nil {
+		t.Fatalf("MachineRatings error: %v", err)
+	}
+	want := []models.MachineRating{{MachineID: "m1", AverageRating: 3.5, RatingCount: 2}, {MachineID: "m2", AverageRating: 4, RatingCount: 1}}
+	if !slices.Equal(ratings, want) {
+		t.Errorf("MachineRatings = %+v; want %+v", ratings, want)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	ctx := context.Background()
+	var (
+		fail     = true
+		received []models.WebhookEvent
+		sigOK    bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sig := r.Header.Get(HeaderWebhookSignature)
+		ts, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(sig, ",")[0], "t="), 10, 64)
+		sigOK = sig == WebhookSignature(testSecret, time.Unix(ts, 0), body)
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev models.WebhookEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Errorf("webhook body is not an event: %v", err)
+		}
+		received = append(received, ev)
+	}))
+	defer srv.Close()
+
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{}, WithWebhookClient(srv.Client()))
+	ep, err := svc.CreateWebhook(ctx, "u1", models.CreateWebhookRequest{URL: srv.URL + "/hook"})
+	if err != nil {
+		t.Fatalf("CreateWebhook error: %v", err)
+	}
+	if !strings.HasPrefix(ep.Secret, "whsec_") {
+		t.Errorf("secret = %q; want a whsec_ secret", ep.Secret)
+	}
+	if _, err := svc.CreateWebhook(ctx, "u1", models.CreateWebhookRequest{URL: "ftp://example.com/hook"}); err == nil {
+		t.Error("CreateWebhook accepted an ftp URL")
+	}
+
+	past := time.Now().Add(-time.Second)
+	d := &models.PendingWebhook{
+		WebhookDelivery: models.WebhookDelivery{
+			ID: "d1", EndpointID: ep.ID, OrderID: "o1", EventType: models.WebhookEventOrderStatusChanged,
+			Payload: json.RawMessage(`{"order_id":"o1","to_status":"DELIVERED"}`), Status: models.WebhookPending, NextAttemptAt: &past,
+		},
+		URL: ep.URL, Secret: testSecret,
+	}
+	repo.deliveries = append(repo.deliveries, d)
+
+	// A 503 keeps the delivery pending and backs off.
+	if err := svc.DeliverWebhooks(ctx); err != nil {
+		t.Fatalf("DeliverWebhooks error: %v", err)
+	}
+	if d.Status != models.WebhookPending || d.Attempts != 1 || d.LastStatusCode == nil || *d.LastStatusCode != 503 {
+		t.Fatalf("after a 503: status %s, %d attempt(s), code %v; want PENDING after 1 with 503", d.Status, d.Attempts, d.LastStatusCode)
+	}
+	if wait := time.Until(*d.NextAttemptAt); wait < 25*time.Second || wait > webhookRetryBase {
+		t.Errorf("next attempt in %s; want about %s", wait, webhookRetryBase)
+	}
+	if !sigOK {
+		t.Error("signature does not verify")
+	}
+
+	// Not due yet: nothing is sent.
+	fail = false
+	if err := svc.DeliverWebhooks(ctx); err != nil {
+		t.Fatalf("DeliverWebhooks error: %v", err)
+	}
+	if len(received) != 0 {
+		t.Fatal("delivery was retried before its backoff")
+	}
+
+	d.NextAttemptAt = &past
+	if err := svc.DeliverWebhooks(ctx); err != nil {
+		t.Fatalf("DeliverWebhooks error: %v", err)
+	}
+	if d.Status != models.WebhookSucceeded || len(repo.attempts["d1"]) != 2 {
+		t.Errorf("after a 200: status %s with %d logged attempt(s); want SUCCEEDED with 2", d.Status, len(repo.attempts["d1"]))
+	}
+	if len(received) != 1 || received[0].ID != "d1" || received[0].Type != models.WebhookEventOrderStatusChanged {
+		t.Errorf("received %+v; want one order.status_changed event with ID d1", received)
+	}
+}
+
+func TestWebhookClaim(t *testing.T) {
+	ctx := context.Background()
+	sent := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { sent++ }))
+	defer srv.Close()
+
+	repo := newFakeRepo()
+	svc := NewService(repo, fakePayments{}, &fakeLogistics{repo: repo}, fakeTx{}, WithWebhookClient(srv.Client()))
+	past := time.Now().Add(-time.Second)
+	d := &models.PendingWebhook{
+		WebhookDelivery: models.WebhookDelivery{
+			ID: "d1", EndpointID: "wh-1", OrderID: "o1", EventType: models.WebhookEventOrderStatusChanged,
+			Payload: json.RawMessage(`{"order_id":"o1"}`), Status: models.WebhookPending, NextAttemptAt: &past,
+		},
+		URL: srv.URL, Secret: testSecret,
+	}
+	repo.deliveries = append(repo.deliveries, d)
+
+	// Another run claimed it and is sending it: this one leaves it alone.
+	claimed, err := repo.ClaimDueWebhookDeliveries(ctx, webhookBatchSize, webhookClaimLease)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("ClaimDueWebhookDeliveries = %d, %v; want the delivery", len(claimed), err)
+	}
+	if err := svc.DeliverWebhooks(ctx); err != nil {
+		t.Fatalf("DeliverWebhooks error: %v", err)
+	}
+	if sent != 0 || d.Attempts != 0 {
+		t.Errorf("claimed delivery sent %d time(s); want it left to its claimant", sent)
+	}
+}
+
+// testSecret signs the deliveries of TestWebhookDelivery.
+const testSecret = "whsec_test"
+
+func TestWebhookRetry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		attempt int
+		wait    time.Duration
+	}{{1, 30 * time.Second}, {2, time.Minute}, {4, 4 * time.Minute}, {7, 32 * time.Minute}} {
+		status, next := webhookRetry(tc.attempt, now)
+		if status != models.WebhookPending || next == nil || next.Sub(now) != tc.wait {
+			t.Errorf("webhookRetry(%d) = %s, %v; want PENDING in %s", tc.attempt, status, next, tc.wait)
+		}
+	}
+	if status, next := webhookRetry(models.MaxWebhookAttempts, now); status != models.WebhookFailed || next != nil {
+		t.Errorf("webhookRetry(%d) = %s, %v; want FAILED", models.MaxWebhookAttempts, status, next)
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	_, err := NewWebhookClient(false).Post(srv.URL, "application/json", strings.NewReader("{}"))
+	if !errors.Is(err, errPrivateAddress) {
+		t.Errorf("POST to %s error = %v; want errPrivateAddress", srv.URL, err)
+	}
+	resp, err := NewWebhookClient(true).Post(srv.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("POST with private networks allowed: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,264 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/payment"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// paymentAction is a charge of an order awaiting authentication, e.g. with
+// 3-D Secure: the order's own charge, a tip, or both.
+type paymentAction struct {
+	ref       string  // The provider's ID of the charge
+	charged   bool    // Whether it pays for the order, not only a tip
+	amount    float64 // Charged in all, tip included
+	tip       float64
+	createdAt time.Time
+}
+
+// findPaymentAction returns the order's latest charge awaiting
+// authentication, or nil. A tip given with the order is recorded under the
+// same ref as its charge.
+func (s *Service) findPaymentAction(ctx context.Context, orderID string) (*paymentAction, error) {
+	payments, err := s.repo.ListPayments(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	var a *paymentAction
+	for i := len(payments) - 1; i >= 0 && a == nil; i-- {
+		if payments[i].Status == models.PaymentStatusRequiresAction && payments[i].ProviderRef != nil {
+			a = &paymentAction{ref: *payments[i].ProviderRef, createdAt: payments[i].CreatedAt}
+		}
+	}
+	if a == nil {
+		return nil, nil
+	}
+	for _, p := range payments {
+		if p.Status != models.PaymentStatusRequiresAction || p.ProviderRef == nil || *p.ProviderRef != a.ref {
+			continue
+		}
+		switch p.Kind {
+		case models.PaymentKindCharge:
+			a.charged = true
+		case models.PaymentKindTip:
+			a.tip = p.Amount
+		}
+		a.amount = roundCents(a.amount + p.Amount)
+	}
+	return a, nil
+}
+
+// ConfirmPayment completes a charge the customer had to authenticate, e.g.
+// with 3-D Secure: ConfirmAndPay and RetryPayment then return the order with
+// a PaymentAction, as does AddTip. Once the provider reports the charge
+// succeeded, the order is confirmed, or the tip added, as if it had
+// succeeded right away. It fails with ErrNoPaymentAction if no charge of the
+// order awaits authentication and with ErrPaymentActionPending while the
+// provider still waits for the customer. If authentication failed it fails
+// with ErrPaymentFailed and an order charge moves the order to
+// PAYMENT_FAILED; a promo code applied to it stays applied for the retry.
+// A charge that succeeded for an order that can no longer be paid, e.g.
+// because it was cancelled meanwhile, is refunded.
+func (s *Service) ConfirmPayment(ctx context.Context, orderID, userID, role string) (*models.Order, error) {
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.findPaymentAction(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.ConfirmPayment: %w", err)
+	}
+	if a == nil {
+		return nil, models.ErrNoPaymentAction
+	}
+	status, err := s.paymentService.PaymentStatus(ctx, a.ref)
+	if err != nil {
+		return nil, fmt.Errorf("service.ConfirmPayment: %w", err)
+	}
+	switch status {
+	case payment.StatusSucceeded:
+	case payment.StatusRequiresAction, payment.StatusProcessing:
+		return nil, models.ErrPaymentActionPending
+	default:
+		reason := "payment " + a.ref + " was not authenticated (" + status + ")"
+		if err := s.failPaymentAction(ctx, order, a, reason); err != nil {
+			return nil, fmt.Errorf("service.ConfirmPayment: %w", err)
+		}
+		return nil, fmt.Errorf("%w: %s", models.ErrPaymentFailed, reason)
+	}
+
+	confirmed, err := s.completePaymentAction(ctx, order, userID, a)
+	if err != nil {
+		if errors.Is(err, models.ErrNoPaymentAction) || errors.Is(err, models.ErrOrderCannotBePaid) ||
+			errors.Is(err, models.ErrCannotTip) || errors.Is(err, models.ErrTipAlreadyAdded) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("service.ConfirmPayment: %w", err)
+	}
+	return confirmed, nil
+}
+
+// completePaymentAction confirms the order, or adds the tip, that the
+// succeeded charge a pays for. The charge's records are settled in the same
+// unit of work, so of two concurrent confirmations only one completes it. If
+// the order can no longer be paid or tipped, e.g. because another request
+// tipped it meanwhile, the charge is refunded instead.
+func (s *Service) completePaymentAction(ctx context.Context, order *models.Order, userID string, a *paymentAction) (*models.Order, error) {
+	settle := func(ctx context.Context) error {
+		settled, err := s.repo.SettlePayments(ctx, order.ID, a.ref, models.PaymentStatusSucceeded, nil)
+		if err != nil {
+			return err
+		}
+		if !settled {
+			return models.ErrNoPaymentAction
+		}
+		return nil
+	}
+
+	if a.charged {
+		if order.Status != models.OrderStatusPendingPayment && order.Status != models.OrderStatusPaymentFailed {
+			return nil, s.refundPaymentAction(ctx, order, a, models.ErrOrderCannotBePaid)
+		}
+		confirmed, err := s.completePayment(ctx, order, userID, a.ref, a.tip, "paid with payment "+a.ref+" after authentication", nil, settle)
+		if errors.Is(err, models.ErrOrderStatusChanged) {
+			return nil, s.refundPaymentAction(ctx, order, a, models.ErrOrderCannotBePaid)
+		}
+		return confirmed, err
+	}
+
+	switch {
+	case order.Status != models.OrderStatusDelivered:
+		return nil, s.refundPaymentAction(ctx, order, a, models.ErrCannotTip)
+	case order.Tip > 0:
+		return nil, s.refundPaymentAction(ctx, order, a, models.ErrTipAlreadyAdded)
+	}
+	tipped, err := s.completeTip(ctx, order, userID, a.ref, a.tip, settle)
+	if errors.Is(err, models.ErrTipAlreadyAdded) {
+		return nil, s.refundPaymentAction(ctx, order, a, models.ErrTipAlreadyAdded)
+	}
+	return tipped, err
+}
+
+// refundPaymentAction settles the succeeded charge a that pays for nothing
+// and refunds it, returning cause. Unless another request settled it first;
+// then ErrNoPaymentAction is returned and nothing is refunded twice.
+func (s *Service) refundPaymentAction(ctx context.Context, order *models.Order, a *paymentAction, cause error) error {
+	settled, err := s.repo.SettlePayments(context.WithoutCancel(ctx), order.ID, a.ref, models.PaymentStatusSucceeded, nil)
+	if err != nil {
+		return err
+	}
+	if !settled {
+		return models.ErrNoPaymentAction
+	}
+	s.refundCharge(ctx, order, a.ref, a.amount)
+	return cause
+}
+
+// failPaymentAction records that the charge a did not go through. An order
+// charge moves the order to PAYMENT_FAILED, unless it has moved on.
+func (s *Service) failPaymentAction(ctx context.Context, order *models.Order, a *paymentAction, reason string) error {
+	settled, err := s.repo.SettlePayments(ctx, order.ID, a.ref, models.PaymentStatusFailed, &reason)
+	if err != nil {
+		return err
+	}
+	if settled && a.charged {
+		s.markPaymentFailed(ctx, order, order.UserID, errors.New(reason))
+	}
+	return nil
+}
+
+// abandonPaymentAction stops a charge of an order being cancelled that the
+// customer has not authenticated yet, so it cannot succeed afterwards: the
+// PaymentIntent is cancelled with the provider. One that already succeeded
+// is refunded. It fails with ErrPaymentActionPending while the provider is
+// still processing the charge; the order can be cancelled once it is done.
+func (s *Service) abandonPaymentAction(ctx context.Context, order *models.Order, reason string) error {
+	a, err := s.findPaymentAction(ctx, order.ID)
+	if err != nil || a == nil {
+		return err
+	}
+	status, err := s.paymentService.PaymentStatus(ctx, a.ref)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case payment.StatusSucceeded:
+		if err := s.refundPaymentAction(ctx, order, a, nil); err != nil && !errors.Is(err, models.ErrNoPaymentAction) {
+			return err
+		}
+		return nil
+	case payment.StatusProcessing:
+		return models.ErrPaymentActionPending
+	case payment.StatusRequiresAction:
+		if err := s.paymentService.CancelPayment(ctx, a.ref); err != nil {
+			return err
+		}
+	}
+	_, err = s.repo.SettlePayments(ctx, order.ID, a.ref, models.PaymentStatusFailed, &reason)
+	return err
+}
+
+// reconcilePaymentActions resolves charges customers were asked to
+// authenticate but did not confirm with ConfirmPayment, e.g. because they
+// closed the page after authenticating. With the status the provider reports:
+//
+//   - a succeeded charge completes its payment as ConfirmPayment would, or is
+//     refunded if its order can no longer be paid;
+//   - a failed charge is recorded as failed, and its order moves to
+//     PAYMENT_FAILED;
+//   - a charge still not authenticated ttl after it was made is cancelled
+//     with the provider, so CancelUnpaidOrders can cancel its order.
+//
+// CancelUnpaidOrders runs it first. Failures are logged per order.
+func (s *Service) reconcilePaymentActions(ctx context.Context, ttl time.Duration) error {
+	orders, err := s.repo.ListAwaitingPaymentAction(ctx, unpaidBatchSize)
+	if err != nil {
+		return fmt.Errorf("service.reconcilePaymentActions: %w", err)
+	}
+	cutoff := time.Now().Add(-ttl)
+	for _, order := range orders {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := s.reconcilePaymentAction(ctx, order, cutoff); err != nil {
+			log.Printf("reconcilePaymentActions: order %s: %v", order.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) reconcilePaymentAction(ctx context.Context, order *models.Order, cutoff time.Time) error {
+	a, err := s.findPaymentAction(ctx, order.ID)
+	if err != nil || a == nil {
+		return err
+	}
+	status, err := s.paymentService.PaymentStatus(ctx, a.ref)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case payment.StatusSucceeded:
+		_, err := s.completePaymentAction(ctx, order, order.UserID, a)
+		if errors.Is(err, models.ErrNoPaymentAction) || errors.Is(err, models.ErrOrderCannotBePaid) ||
+			errors.Is(err, models.ErrCannotTip) || errors.Is(err, models.ErrTipAlreadyAdded) {
+			return nil // Confirmed by the customer meanwhile, or refunded.
+		}
+		return err
+	case payment.StatusProcessing:
+		return nil
+	case payment.StatusRequiresAction:
+		if a.createdAt.After(cutoff) {
+			return nil // The customer may still be authenticating.
+		}
+		if err := s.paymentService.CancelPayment(ctx, a.ref); err != nil {
+			return err
+		}
+		return s.failPaymentAction(ctx, order, a, "payment "+a.ref+" was not authenticated in time")
+	default:
+		return s.failPaymentAction(ctx, order, a, "payment "+a.ref+" was not authenticated ("+status+")")
+	}
+}
@@ -0,0 +1,149 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/payment"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ListPayments returns every attempt to charge or refund an order, oldest
+// first. It is visible to the same users as the order itself.
+func (s *Service) ListPayments(ctx context.Context, orderID, userID, role string) ([]*models.Payment, error) {
+	if _, err := s.GetOrderDetails(ctx, orderID, userID, role); err != nil {
+		return nil, err
+	}
+	payments, err := s.repo.ListPayments(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.ListPayments: %w", err)
+	}
+	return payments, nil
+}
+
+// paymentMethod resolves what a payment is charged to: the card tokenized by
+// the client, or the user's saved card with the provider customer it is
+// attached to. It fails with ErrPaymentMethodNotFound if the saved card is not
+// the user's.
+func (s *Service) paymentMethod(ctx context.Context, userID, paymentMethodID, savedID string) (customerID, providerID string, err error) {
+	if savedID == "" {
+		return "", paymentMethodID, nil
+	}
+	return s.repo.FindSavedPaymentMethod(ctx, userID, savedID)
+}
+
+// charge charges amount to a card resolved by paymentMethod, returning the
+// provider's ID of the charge.
+func (s *Service) charge(ctx context.Context, userID, customerID, paymentMethodID string, amount float64, idempotencyKey string) (string, error) {
+	if customerID != "" {
+		return s.paymentService.ChargeCustomer(ctx, customerID, amount, paymentMethodID, idempotencyKey)
+	}
+	return s.paymentService.ProcessPayment(ctx, userID, amount, paymentMethodID, idempotencyKey)
+}
+
+// chargeError is the error a failed charge returns: ErrPaymentFailed if the
+// provider declined it, ErrPaymentUnavailable if it could not tell, e.g.
+// because it timed out or its circuit breaker is open.
+func chargeError(err error) error {
+	var declined *payment.DeclinedError
+	if errors.As(err, &declined) {
+		return fmt.Errorf("%w: %w", models.ErrPaymentFailed, err)
+	}
+	return fmt.Errorf("%w: %w", models.ErrPaymentUnavailable, err)
+}
+
+// failureReason is what a customer is told about the failed charge err: the
+// provider's reason for a decline, or the error itself.
+func failureReason(err error) string {
+	var declined *payment.DeclinedError
+	if errors.As(err, &declined) && declined.Reason != "" {
+		return declined.Reason
+	}
+	return err.Error()
+}
+
+// refundCharge refunds amount of a charge that pays for nothing, e.g. because
+// its order was cancelled while the charge was in flight, and records the
+// refund. The provider deduplicates it by charge. A failure is only logged,
+// for an operator to refund by hand: the caller's error is what the customer
+// needs to see.
+func (s *Service) refundCharge(ctx context.Context, order *models.Order, paymentID string, amount float64) {
+	ctx = context.WithoutCancel(ctx)
+	refundID, err := s.paymentService.RefundPayment(ctx, paymentID, amount, "payment-refund-"+paymentID)
+	s.recordPayment(ctx, order, models.PaymentKindRefund, amount, refundID, err)
+	if err != nil {
+		log.Printf("CRITICAL: charge %s of %.2f for order %s pays for nothing and could not be refunded: %v", paymentID, amount, order.ID, err)
+		return
+	}
+	log.Printf("charge %s of %.2f for order %s refunded as %s: the order could not be paid for", paymentID, amount, order.ID, refundID)
+}
+
+// markPaymentFailed moves an order whose charge failed to PAYMENT_FAILED,
+// emitting "order.payment_failed", and keeps the provider's reason on it.
+// An order already there only gets the new reason. Only an unpaid order is
+// changed, and only if it still is: one paid or cancelled meanwhile is left
+// as it is. Like recordPayment it only logs its own failure, as the payment
+// error is what the customer needs to see.
+func (s *Service) markPaymentFailed(ctx context.Context, order *models.Order, userID string, callErr error) {
+	if order.Status != models.OrderStatusPendingPayment && order.Status != models.OrderStatusPaymentFailed {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	reason := failureReason(callErr)
+	err := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if order.Status == models.OrderStatusPaymentFailed {
+			return s.repo.SetPaymentFailure(ctx, order.ID, &reason)
+		}
+		if err := s.setStatus(ctx, order, models.OrderStatusPaymentFailed, models.ActorSystem, "", "payment failed: "+reason); err != nil {
+			return err
+		}
+		if err := s.repo.SetPaymentFailure(ctx, order.ID, &reason); err != nil {
+			return err
+		}
+		event := map[string]string{
+			"order_id": order.ID,
+			"user_id":  userID,
+			"reason":   reason,
+		}
+		return s.repo.InsertOutboxEvent(ctx, order.ID, "order.payment_failed", event)
+	})
+	if errors.Is(err, models.ErrOrderStatusChanged) {
+		return
+	}
+	if err != nil {
+		log.Printf("failed to mark the payment of order %s as failed: %v", order.ID, err)
+	}
+}
+
+// recordPayment records the outcome of a charge or refund of order: ref is
+// the provider's ID of it on success, callErr the provider's error
+// otherwise. A charge waiting for the customer to authenticate it is
+// recorded as REQUIRES_ACTION under the provider's ID. It is called right
+// after the provider call, outside any unit of work, so an attempt is kept
+// even if what follows it is rolled back. A failure to record is only
+// logged; the money has moved either way.
+func (s *Service) recordPayment(ctx context.Context, order *models.Order, kind models.PaymentKind, amount float64, ref string, callErr error) {
+	p := &models.Payment{
+		OrderID:  order.ID,
+		UserID:   order.UserID,
+		Kind:     kind,
+		Amount:   amount,
+		Provider: s.paymentService.Provider(),
+		Status:   models.PaymentStatusSucceeded,
+	}
+	var action *payment.ActionRequiredError
+	switch {
+	case errors.As(callErr, &action):
+		p.Status, p.ProviderRef = models.PaymentStatusRequiresAction, &action.PaymentID
+	case callErr != nil:
+		reason := failureReason(callErr)
+		p.Status, p.FailureReason = models.PaymentStatusFailed, &reason
+	default:
+		p.ProviderRef = &ref
+	}
+	// The request may have been cancelled by the time the provider answers.
+	if err := s.repo.InsertPayment(context.WithoutCancel(ctx), p); err != nil {
+		log.Printf("failed to record %s of %.2f for order %s (%s): %v", kind, amount, order.ID, ref, err)
+	}
+}
@@ -0,0 +1,149 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// CreatePromoCode creates a promo code. For admin use.
+func (s *Service) CreatePromoCode(ctx context.Context, adminID string, req models.CreatePromoCodeRequest) (*models.PromoCode, error) {
+	if req.DiscountType == models.PromoDiscountPercent && req.Value > 100 {
+		return nil, models.ValidationFailed(models.FieldError{
+			Field: "value", Rule: "lte", Param: "100", Message: "a percentage discount must be at most 100",
+		})
+	}
+	if req.ValidFrom != nil && req.ValidUntil != nil && !req.ValidUntil.After(*req.ValidFrom) {
+		return nil, models.ValidationFailed(models.FieldError{
+			Field: "valid_until", Rule: "gtfield", Param: "valid_from", Message: "valid_until must be after valid_from",
+		})
+	}
+	p := &models.PromoCode{
+		Code:           strings.ToUpper(req.Code),
+		DiscountType:   req.DiscountType,
+		Value:          roundCents(req.Value),
+		MaxRedemptions: req.MaxRedemptions,
+		MaxPerUser:     req.MaxPerUser,
+		ValidFrom:      req.ValidFrom,
+		ValidUntil:     req.ValidUntil,
+		CreatedBy:      &adminID,
+	}
+	if err := s.repo.InsertPromoCode(ctx, p); err != nil {
+		if errors.Is(err, models.ErrPromoCodeTaken) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("service.CreatePromoCode: %w", err)
+	}
+	return p, nil
+}
+
+// ListPromoCodes returns one page of promo codes, newest first. For admin
+// use.
+func (s *Service) ListPromoCodes(ctx context.Context, q models.PromoCodeQuery) (*models.PromoCodePage, error) {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.Limit < 1 || q.Limit > 100 {
+		q.Limit = 50
+	}
+	codes, total, err := s.repo.ListPromoCodes(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("service.ListPromoCodes: %w", err)
+	}
+	return &models.PromoCodePage{PromoCodes: codes, Total: total}, nil
+}
+
+// DisablePromoCode stops a promo code from being redeemed. Orders it was
+// already applied to keep their discount. For admin use.
+func (s *Service) DisablePromoCode(ctx context.Context, promoCodeID string) (*models.PromoCode, error) {
+	p, err := s.repo.DisablePromoCode(ctx, promoCodeID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("service.DisablePromoCode: %w", err)
+	}
+	return p, nil
+}
+
+// applyPromoCode redeems code, in upper case, on an unpaid order and lowers
+// its cost and breakdown by the discount, returning the discounted order and
+// whether the code was redeemed now. A code already applied to the order,
+// e.g. by a payment whose confirmation was rolled back, is kept rather than
+// redeemed twice; another code fails with ErrPromoCodeAlreadyApplied. The
+// code must exist and be redeemable now, or it fails with
+// ErrPromoCodeInvalid; it fails with ErrPromoCodeExhausted once it has
+// reached its limits.
+func (s *Service) applyPromoCode(ctx context.Context, order *models.Order, code string) (*models.Order, bool, error) {
+	applied, err := s.repo.FindPromoRedemption(ctx, order.ID)
+	switch {
+	case err == nil && applied.Code == code:
+		return order, false, nil
+	case err == nil:
+		return nil, false, models.ErrPromoCodeAlreadyApplied
+	case !errors.Is(err, models.ErrNotFound):
+		return nil, false, fmt.Errorf("service.applyPromoCode: %w", err)
+	}
+
+	promo, err := s.repo.FindPromoCode(ctx, code)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, false, models.ErrPromoCodeInvalid
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("service.applyPromoCode: %w", err)
+	}
+	if !promo.Redeemable(time.Now()) {
+		return nil, false, models.ErrPromoCodeInvalid
+	}
+
+	discount := promo.Discount(order.Cost)
+	var discounted *models.Order
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		err := s.repo.RedeemPromoCode(ctx, &models.PromoRedemption{
+			PromoCodeID: promo.ID,
+			OrderID:     order.ID,
+			UserID:      order.UserID,
+			Discount:    discount,
+		})
+		if err != nil {
+			return err
+		}
+		var breakdown *models.CostBreakdown
+		if order.CostBreakdown != nil {
+			b := order.CostBreakdown.WithDiscount(discount)
+			breakdown = &b
+		}
+		if err := s.repo.SetPrice(ctx, order.ID, roundCents(order.Cost-discount), breakdown); err != nil {
+			return err
+		}
+		discounted, err = s.repo.FindByID(ctx, order.ID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrPromoCodeExhausted) || errors.Is(err, models.ErrPromoCodeAlreadyApplied) {
+			return nil, false, err
+		}
+		return nil, false, fmt.Errorf("service.applyPromoCode: %w", err)
+	}
+	return discounted, true, nil
+}
+
+// releasePromoCode undoes applyPromoCode after the discounted order could not
+// be paid: the redemption is given back to the code and the order's price
+// restored to that of original. Failures are only logged, as the payment
+// error is what the customer needs to see.
+func (s *Service) releasePromoCode(ctx context.Context, original *models.Order) {
+	err := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.ReleasePromoRedemption(ctx, original.ID); err != nil {
+			return err
+		}
+		return s.repo.SetPrice(ctx, original.ID, original.Cost, original.CostBreakdown)
+	})
+	if err != nil {
+		log.Printf("failed to release promo code of order %s: %v", original.ID, err)
+	}
+}
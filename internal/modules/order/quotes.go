@@ -0,0 +1,67 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultQuoteTTL is how long a quoted route option can be ordered.
+const DefaultQuoteTTL = 15 * time.Minute
+
+// WithQuoteTTL sets how long quoted route options can be ordered; d <= 0
+// keeps DefaultQuoteTTL.
+func WithQuoteTTL(d time.Duration) Option {
+	return func(s *Service) {
+		if d > 0 {
+			s.quoteTTL = d
+		}
+	}
+}
+
+// GetDeliveryQuote prices route options for req and stores them for userID,
+// who can order one of them by its ID until its ExpiresAt. With
+// req.Insurance the options include the premium, and orders created from
+// them are insured.
+func (s *Service) GetDeliveryQuote(ctx context.Context, userID string, req models.RouteRequest) ([]models.RouteOption, error) {
+	if err := s.checkInsurance(req.Insurance); err != nil {
+		return nil, err
+	}
+	options, err := s.logisticsService.CalculateRouteOptions(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	s.insure(options, req.Insurance)
+	if err := s.saveQuotes(ctx, userID, options); err != nil {
+		return nil, fmt.Errorf("service.GetDeliveryQuote: %w", err)
+	}
+	return options, nil
+}
+
+// saveQuotes sets the ExpiresAt of options and stores them so that any
+// instance can take them with repo.TakeRouteQuote until then.
+func (s *Service) saveQuotes(ctx context.Context, userID string, options []models.RouteOption) error {
+	if len(options) == 0 {
+		return nil
+	}
+	expiresAt := time.Now().Add(s.quoteTTL).UTC().Truncate(time.Second)
+	for i := range options {
+		options[i].ExpiresAt = expiresAt
+	}
+	return s.repo.SaveRouteQuotes(ctx, userID, options, expiresAt)
+}
+
+// PurgeRouteQuotes deletes expired quotes. It is run periodically by the
+// scheduler.
+func (s *Service) PurgeRouteQuotes(ctx context.Context) error {
+	n, err := s.repo.DeleteExpiredRouteQuotes(ctx, time.Now())
+	if err != nil {
+		return fmt.Errorf("service.PurgeRouteQuotes: %w", err)
+	}
+	if n > 0 {
+		log.Printf("PurgeRouteQuotes: deleted %d expired quote(s)", n)
+	}
+	return nil
+}
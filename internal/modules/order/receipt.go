@@ -0,0 +1,135 @@
+package order
+
+import (
+	"bytes"
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/pdf"
+	"fmt"
+	"time"
+)
+
+// receiptTimeFormat is how times are printed on receipts, in UTC.
+const receiptTimeFormat = "2 Jan 2006 15:04 MST"
+
+// ReceiptPDF renders the receipt of a paid order as a PDF: its addresses and
+// package, the itemized charges and any tip, when it was ordered, paid and delivered, and
+// the payment reference. It is available to the users who can see the order
+// once it has been paid, or confirmed at no charge as a free return; before
+// that it fails with ErrReceiptNotAvailable.
+func (s *Service) ReceiptPDF(ctx context.Context, orderID, userID, role string) ([]byte, error) {
+	order, err := s.GetOrderDetails(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	events, err := s.repo.ListStatusEvents(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.ReceiptPDF: %w", err)
+	}
+	var paidAt, deliveredAt time.Time
+	for _, ev := range events {
+		switch ev.ToStatus {
+		case models.OrderStatusConfirmed, models.OrderStatusScheduled:
+			if paidAt.IsZero() {
+				paidAt = ev.CreatedAt
+			}
+		case models.OrderStatusDelivered:
+			deliveredAt = ev.CreatedAt
+		}
+	}
+	if paidAt.IsZero() {
+		return nil, models.ErrReceiptNotAvailable
+	}
+	paymentID, refundID, err := s.repo.GetPaymentRefs(ctx, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("service.ReceiptPDF: %w", err)
+	}
+
+	doc := pdf.New("Receipt for order " + order.ID)
+	doc.Title("Circuit delivery receipt")
+	doc.Space()
+	doc.Row("Order", order.ID)
+	doc.Row("Status", string(order.Status))
+	doc.Row("Ordered", receiptTime(order.CreatedAt))
+	doc.Row("Paid", receiptTime(paidAt))
+	if !deliveredAt.IsZero() {
+		doc.Row("Delivered", receiptTime(deliveredAt))
+	}
+	switch {
+	case paymentID != "":
+		doc.Row("Payment reference", paymentID)
+	case order.Cost == 0:
+		doc.Row("Payment reference", "none, no charge")
+	}
+	if refundID != "" {
+		doc.Row("Refund reference", refundID)
+	}
+
+	doc.Heading("Delivery")
+	if order.PickupAddress != nil {
+		doc.Row("From", order.PickupAddress.StreetAddress)
+	}
+	if order.DropoffAddress != nil {
+		doc.Row("To", order.DropoffAddress.StreetAddress)
+	}
+	if order.RecipientName != "" {
+		doc.Row("Recipient", order.RecipientName)
+	}
+	d := order.Dimensions
+	doc.Row("Package", fmt.Sprintf("%.2f × %.2f × %.2f m, %.2f kg", d.Length, d.Width, d.Height, order.ItemWeightKg))
+	if order.Priority != "" {
+		doc.Row("Priority", string(order.Priority))
+	}
+	if order.InsuredValue != nil {
+		doc.Row("Insured value", receiptAmount(*order.InsuredValue))
+	}
+	if order.ReturnOfOrderID != nil {
+		doc.Row("Return of order", *order.ReturnOfOrderID)
+	}
+
+	doc.Heading("Charges")
+	if b := order.CostBreakdown; b != nil {
+		doc.Row("Base fare", receiptAmount(b.BaseFare))
+		for _, item := range []struct {
+			label  string
+			amount float64
+		}{
+			{"Distance", b.DistanceCharge},
+			{"Peak hours", b.PeakSurcharge},
+			{"High demand", b.Surge},
+			{"Express", b.PrioritySurcharge},
+			{"Weather", b.WeatherSurcharge},
+			{"Tax", b.Tax},
+			{"Insurance", b.Insurance},
+			{"Discount", -b.Discount},
+		} {
+			if item.amount != 0 {
+				doc.Row(item.label, receiptAmount(item.amount))
+			}
+		}
+	}
+	doc.BoldRow("Total", receiptAmount(order.Cost))
+	if order.Tip > 0 {
+		doc.Row("Tip", receiptAmount(order.Tip))
+		doc.BoldRow("Total paid", receiptAmount(order.Cost+order.Tip))
+	}
+	doc.Space()
+	doc.Note("Amounts in USD. Times in UTC.")
+
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("service.ReceiptPDF: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func receiptTime(t time.Time) string {
+	return t.UTC().Format(receiptTimeFormat)
+}
+
+func receiptAmount(amount float64) string {
+	if amount < 0 {
+		return fmt.Sprintf("-%.2f", -amount)
+	}
+	return fmt.Sprintf("%.2f", amount)
+}
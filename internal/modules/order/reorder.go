@@ -0,0 +1,100 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"fmt"
+)
+
+// Reorder creates a new order like one of the customer's past orders: the
+// same addresses, package, recipient and insurance, priced with a fresh quote. The
+// cheapest option quoted is taken. The new order waits in PENDING_PAYMENT
+// and is paid with ConfirmAndPay like any order. A request repeated with the
+// same IdempotencyKey returns the first new order.
+func (s *Service) Reorder(ctx context.Context, orderID, userID, role string, req models.ReorderRequest) (*models.Order, error) {
+	request := struct {
+		OrderID string `json:"order_id"`
+		models.ReorderRequest
+	}{orderID, req}
+	claim, replay, err := s.claimIdempotencyKey(ctx, userID, opReorder, req.IdempotencyKey, request)
+	if err != nil {
+		return nil, fmt.Errorf("service.Reorder: %w", err)
+	}
+	if replay != nil {
+		return replay, nil
+	}
+	order, err := s.reorder(ctx, orderID, userID, role, req, claim)
+	if err != nil {
+		s.releaseIdempotencyKey(ctx, claim)
+		return nil, err
+	}
+	return order, nil
+}
+
+// reorder creates the order for Reorder and completes its claimed
+// idempotency key, if any, in the same unit of work.
+func (s *Service) reorder(ctx context.Context, orderID, userID, role string, req models.ReorderRequest, claim *models.IdempotencyKey) (*models.Order, error) {
+	past, err := s.ownedOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	if past.PickupAddress == nil || past.DropoffAddress == nil {
+		return nil, fmt.Errorf("service.Reorder: order %s has no addresses", orderID)
+	}
+	priority := req.Priority
+	if priority == "" {
+		priority = past.Priority
+	}
+	var insurance *models.InsuranceRequest
+	if past.InsuredValue != nil {
+		insurance = &models.InsuranceRequest{DeclaredValue: *past.InsuredValue}
+		if err := s.checkInsurance(insurance); err != nil {
+			return nil, err
+		}
+	}
+	options, err := s.logisticsService.CalculateRouteOptions(ctx, models.RouteRequest{
+		PickupLocation:   *past.PickupAddress,
+		DeliveryLocation: *past.DropoffAddress,
+		WeightKG:         past.ItemWeightKg,
+		Dimensions:       past.Dimensions,
+		Priority:         priority,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("service.Reorder: %w", err)
+	}
+	if len(options) == 0 {
+		return nil, fmt.Errorf("service.Reorder: %w", models.ErrNoPricingRule)
+	}
+	s.insure(options, insurance)
+	cheapest := &options[0]
+	for i := range options {
+		if options[i].EstimatedCost < cheapest.EstimatedCost {
+			cheapest = &options[i]
+		}
+	}
+
+	pin, err := newDeliveryPIN()
+	if err != nil {
+		return nil, fmt.Errorf("service.Reorder: %w", err)
+	}
+	create := models.CreateOrderRequest{
+		RouteOptionID:        cheapest.ID,
+		Dimensions:           past.Dimensions,
+		RecipientName:        past.RecipientName,
+		RecipientPhone:       past.RecipientPhone,
+		DeliveryInstructions: past.DeliveryInstructions,
+		DeliveryPIN:          pin,
+	}
+	var order *models.Order
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		order, err = s.repo.Create(ctx, userID, create, cheapest, past.PickupAddressID, past.DropoffAddressID)
+		if err != nil {
+			return err
+		}
+		return s.completeIdempotencyKey(ctx, claim, order.ID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("service.Reorder: %w", err)
+	}
+	return order, nil
+}
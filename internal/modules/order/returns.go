@@ -0,0 +1,154 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"fmt"
+	"time"
+)
+
+// GetReturnQuote quotes a return of a delivered order: options from its
+// dropoff back to its pickup for the same package. The options are stored
+// like any quote, to be chosen with CreateReturn.
+func (s *Service) GetReturnQuote(ctx context.Context, orderID, userID, role string) (*models.ReturnQuote, error) {
+	order, deliveredAt, err := s.returnableOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	if order.PickupAddress == nil || order.DropoffAddress == nil {
+		return nil, fmt.Errorf("service.GetReturnQuote: order %s has no addresses", orderID)
+	}
+	options, err := s.logisticsService.CalculateRouteOptions(ctx, models.RouteRequest{
+		PickupLocation:   *order.DropoffAddress,
+		DeliveryLocation: *order.PickupAddress,
+		WeightKG:         order.ItemWeightKg,
+		Dimensions:       order.Dimensions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("service.GetReturnQuote: %w", err)
+	}
+
+	if err := s.saveQuotes(ctx, userID, options); err != nil {
+		return nil, fmt.Errorf("service.GetReturnQuote: %w", err)
+	}
+
+	freeUntil := deliveredAt.Add(models.FreeReturnWindow)
+	return &models.ReturnQuote{
+		Options:   options,
+		Free:      time.Now().Before(freeUntil),
+		FreeUntil: freeUntil,
+		ReturnBy:  deliveredAt.Add(models.ReturnWindow),
+	}, nil
+}
+
+// CreateReturn creates the return of a delivered order from an option of
+// its return quote. The return reuses the order's addresses in reverse and
+// is linked to it by ReturnOfOrderID. A free return is confirmed and queued
+// for dispatch right away; otherwise it waits in PENDING_PAYMENT and is paid
+// with ConfirmAndPay like any order. Either way it is tracked as an order of
+// its own.
+func (s *Service) CreateReturn(ctx context.Context, orderID, userID, role string, req models.CreateReturnRequest) (*models.Order, error) {
+	order, deliveredAt, err := s.returnableOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	free := time.Now().Before(deliveredAt.Add(models.FreeReturnWindow))
+	pin, err := newDeliveryPIN()
+	if err != nil {
+		return nil, fmt.Errorf("service.CreateReturn: %w", err)
+	}
+	ret := &models.Order{
+		UserID:           userID,
+		PickupAddressID:  order.DropoffAddressID,
+		DropoffAddressID: order.PickupAddressID,
+		Status:           models.OrderStatusPendingPayment,
+		Dimensions:       order.Dimensions,
+		ItemWeightKg:     order.ItemWeightKg,
+		DeliveryPIN:      pin,
+		ReturnOfOrderID:  &order.ID,
+	}
+	reason := "return of order " + order.ID
+	if free {
+		ret.Status = models.OrderStatusConfirmed
+		reason = "free return of order " + order.ID
+	}
+
+	var created *models.Order
+	err = s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		option, err := s.repo.TakeRouteQuote(ctx, userID, req.RouteOptionID)
+		if err != nil {
+			return err
+		}
+		// Only options quoted for this order's return will do.
+		if option.PickupLocation.ID != order.DropoffAddressID || option.DeliveryLocation.ID != order.PickupAddressID {
+			return models.ErrRouteOptionNotFound
+		}
+		// A free return shows the option's price taken off in full.
+		breakdown := option.CostBreakdown
+		if free {
+			breakdown = breakdown.WithDiscount(breakdown.Total)
+		} else {
+			ret.Cost = option.EstimatedCost
+		}
+		if breakdown != (models.CostBreakdown{}) {
+			ret.CostBreakdown = &breakdown
+		}
+		created, err = s.repo.CreateReturn(ctx, ret, reason)
+		if err != nil {
+			return err
+		}
+		if free {
+			if err := s.repo.EnqueueAssignment(ctx, created.ID, ""); err != nil {
+				return err
+			}
+		}
+		event := map[string]string{
+			"order_id":          created.ID,
+			"user_id":           userID,
+			"original_order_id": order.ID,
+		}
+		return s.repo.InsertOutboxEvent(ctx, created.ID, "order.return_created", event)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("service.CreateReturn: %w", err)
+	}
+
+	if free {
+		s.notifyPaid()
+	}
+	return created, nil
+}
+
+// returnableOrder loads an order of userID that can be returned now and the
+// time it was delivered. Returns cannot themselves be returned, and an order
+// has at most one live return.
+func (s *Service) returnableOrder(ctx context.Context, orderID, userID, role string) (*models.Order, time.Time, error) {
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if order.Status != models.OrderStatusDelivered || order.ReturnOfOrderID != nil {
+		return nil, time.Time{}, models.ErrOrderCannotBeReturned
+	}
+	events, err := s.repo.ListStatusEvents(ctx, orderID)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("service.returnableOrder: %w", err)
+	}
+	var deliveredAt time.Time
+	for _, ev := range events {
+		if ev.ToStatus == models.OrderStatusDelivered {
+			deliveredAt = ev.CreatedAt
+		}
+	}
+	if time.Since(deliveredAt) > models.ReturnWindow {
+		return nil, time.Time{}, models.ErrOrderCannotBeReturned
+	}
+	exists, err := s.repo.HasReturn(ctx, orderID)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("service.returnableOrder: %w", err)
+	}
+	if exists {
+		return nil, time.Time{}, models.ErrReturnAlreadyExists
+	}
+	return order, deliveredAt, nil
+}
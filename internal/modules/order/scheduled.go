@@ -0,0 +1,112 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// scheduledBatchSize bounds how many scheduled orders one promotion run releases.
+const scheduledBatchSize = 100
+
+// checkSchedule validates the pickup time of a new order against the route
+// option it was created from. Options are priced for the hour of their
+// PickupTime, so a scheduled order must fall in that hour, and an order
+// without a schedule cannot use an option quoted for a later pickup.
+func checkSchedule(scheduled *time.Time, option *models.RouteOption, now time.Time) error {
+	if scheduled == nil {
+		if option.PickupTime.After(now.Add(models.MinScheduleLead)) {
+			return models.ValidationFailed(models.FieldError{
+				Field:   "scheduled_pickup_time",
+				Rule:    "required",
+				Message: "the route option was quoted for a later pickup; schedule the order for that time",
+			})
+		}
+		return nil
+	}
+	switch {
+	case scheduled.Before(now.Add(models.MinScheduleLead)):
+		return models.ValidationFailed(models.FieldError{
+			Field:   "scheduled_pickup_time",
+			Rule:    "min",
+			Param:   models.MinScheduleLead.String(),
+			Message: "must be at least " + models.MinScheduleLead.String() + " from now",
+		})
+	case scheduled.After(now.Add(models.MaxScheduleAhead)):
+		return models.ValidationFailed(models.FieldError{
+			Field:   "scheduled_pickup_time",
+			Rule:    "max",
+			Param:   models.MaxScheduleAhead.String(),
+			Message: "must be at most " + models.MaxScheduleAhead.String() + " from now",
+		})
+	case !scheduled.Truncate(time.Hour).Equal(option.PickupTime.Truncate(time.Hour)):
+		return models.ValidationFailed(models.FieldError{
+			Field:   "scheduled_pickup_time",
+			Rule:    "quote_hour",
+			Message: "must fall in the hour the route option was priced for; request a new quote for this time",
+		})
+	}
+	return nil
+}
+
+// checkWindow validates the delivery window of a new order. The option must
+// reach the dropoff inside it when picked up at the order's pickup time: the
+// scheduled one, or now. Like the quote, this leaves out the machine's trip to
+// the pickup.
+func checkWindow(window *models.DeliveryWindow, scheduled *time.Time, option *models.RouteOption, now time.Time) error {
+	if window == nil {
+		return nil
+	}
+	if err := window.Validate(now); err != nil {
+		return err
+	}
+	pickup := now
+	if scheduled != nil {
+		pickup = *scheduled
+	}
+	if !window.Contains(pickup.Add(time.Duration(option.DurationSeconds) * time.Second)) {
+		return models.ValidationFailed(models.FieldError{
+			Field:   "delivery_window",
+			Rule:    "feasible",
+			Message: "the route option cannot arrive inside the window at this pickup time",
+		})
+	}
+	return nil
+}
+
+// PromoteScheduledOrders releases paid scheduled orders whose pickup is at
+// most lead away: each moves from SCHEDULED to CONFIRMED and joins the
+// assignment queue, where the Dispatcher picks a machine as for any paid
+// order. An order cancelled since it was listed is skipped. It runs as a
+// scheduler job.
+func (s *Service) PromoteScheduledOrders(ctx context.Context, lead time.Duration) error {
+	due, err := s.repo.ListDueScheduled(ctx, time.Now().Add(lead), scheduledBatchSize)
+	if err != nil {
+		return fmt.Errorf("service.PromoteScheduledOrders: %w", err)
+	}
+	promoted := 0
+	for _, order := range due {
+		reason := "scheduled pickup at " + order.ScheduledPickupTime.UTC().Format(time.RFC3339)
+		err := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+			if err := s.setStatus(ctx, order, models.OrderStatusConfirmed, models.ActorSystem, "", reason); err != nil {
+				return err
+			}
+			return s.repo.EnqueueAssignment(ctx, order.ID, "")
+		})
+		if errors.Is(err, models.ErrOrderStatusChanged) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("service.PromoteScheduledOrders: order %s: %w", order.ID, err)
+		}
+		promoted++
+		log.Printf("order %s released for dispatch (%s)", order.ID, reason)
+	}
+	if promoted > 0 {
+		s.notifyPaid()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"dispatch-and-delivery/pkg/payment"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+)
+
+// AddTip charges a tip for a delivered order and records it on the order. An
+// order takes one tip, given here or when paying for it; another fails with
+// ErrTipAlreadyAdded, and if another request added one while the tip was
+// being charged, the charge is refunded. A request repeated with the same
+// IdempotencyKey returns the tipped order without charging again.
+// A charge the customer has to authenticate returns the order with a
+// PaymentAction, and ConfirmPayment adds the tip.
+func (s *Service) AddTip(ctx context.Context, orderID, userID, role string, req models.TipRequest) (*models.Order, error) {
+	request := struct {
+		OrderID string `json:"order_id"`
+		models.TipRequest
+	}{orderID, req}
+	claim, replay, err := s.claimIdempotencyKey(ctx, userID, opAddTip, req.IdempotencyKey, request)
+	if err != nil {
+		return nil, fmt.Errorf("service.AddTip: %w", err)
+	}
+	if replay != nil {
+		return replay, nil
+	}
+	order, err := s.addTip(ctx, orderID, userID, role, req, claim)
+	if err != nil || order.PaymentAction != nil {
+		s.releaseIdempotencyKey(ctx, claim)
+	}
+	return order, err
+}
+
+// addTip charges and records the tip for AddTip and completes its claimed
+// idempotency key, if any, together with the tip.
+func (s *Service) addTip(ctx context.Context, orderID, userID, role string, req models.TipRequest, claim *models.IdempotencyKey) (*models.Order, error) {
+	order, err := s.ownedOrder(ctx, orderID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != models.OrderStatusDelivered {
+		return nil, models.ErrCannotTip
+	}
+	if order.Tip > 0 {
+		return nil, models.ErrTipAlreadyAdded
+	}
+	customerID, paymentMethodID, err := s.paymentMethod(ctx, userID, req.PaymentMethodID, req.SavedPaymentMethodID)
+	if err != nil {
+		if errors.Is(err, models.ErrPaymentMethodNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("service.AddTip: %w", err)
+	}
+
+	tip := roundCents(req.Amount)
+	paymentID, err := s.charge(ctx, userID, customerID, paymentMethodID, tip, tipIdempotencyKey(orderID, paymentMethodID, tip, claim))
+	s.recordPayment(ctx, order, models.PaymentKindTip, tip, paymentID, err)
+	var action *payment.ActionRequiredError
+	if errors.As(err, &action) {
+		order.PaymentAction = &models.PaymentAction{
+			Status:       payment.StatusRequiresAction,
+			PaymentID:    action.PaymentID,
+			ClientSecret: action.ClientSecret,
+		}
+		return order, nil
+	}
+	if err != nil {
+		return nil, chargeError(err)
+	}
+
+	tipped, err := s.completeTip(ctx, order, userID, paymentID, tip, func(ctx context.Context) error {
+		return s.completeIdempotencyKey(ctx, claim, order.ID)
+	})
+	if errors.Is(err, models.ErrTipAlreadyAdded) {
+		if err := s.refundLostTip(ctx, order, paymentID, tip); err != nil {
+			return nil, fmt.Errorf("service.AddTip: %w", err)
+		}
+		return nil, models.ErrTipAlreadyAdded
+	}
+	if err != nil {
+		return nil, fmt.Errorf("service.AddTip: %w", err)
+	}
+	return tipped, nil
+}
+
+// tipIdempotencyKey is the provider's idempotency key for a tip charge. It is
+// derived from the claimed Idempotency-Key, so a new key tries the card again,
+// e.g. after a decline. Without one it covers the order, card and amount: a
+// retry of the same tip shares its charge, while a different amount is a new
+// charge rather than a mismatch the provider rejects.
+func tipIdempotencyKey(orderID, paymentMethodID string, tip float64, claim *models.IdempotencyKey) string {
+	if claim != nil {
+		return paymentIdempotencyKey(claim)
+	}
+	return fmt.Sprintf("order-tip-%s-%s-%d", orderID, paymentMethodID, int64(math.Round(tip*100)))
+}
+
+// refundLostTip refunds the tip charged with paymentID after another request
+// tipped the order first. A request with the same provider idempotency key
+// shares its charge, as the provider deduplicates it; then both recorded it
+// and it is kept.
+func (s *Service) refundLostTip(ctx context.Context, order *models.Order, paymentID string, tip float64) error {
+	payments, err := s.repo.ListPayments(context.WithoutCancel(ctx), order.ID)
+	if err != nil {
+		return err
+	}
+	recorded := 0
+	for _, p := range payments {
+		if p.Kind == models.PaymentKindTip && p.Status == models.PaymentStatusSucceeded && p.ProviderRef != nil && *p.ProviderRef == paymentID {
+			recorded++
+		}
+	}
+	if recorded < 2 {
+		s.refundCharge(ctx, order, paymentID, tip)
+	}
+	return nil
+}
+
+// completeTip adds a tip charged with paymentID to order and emits
+// "order.tipped" in one unit of work. settle, if set, runs first in it.
+func (s *Service) completeTip(ctx context.Context, order *models.Order, userID, paymentID string, tip float64, settle func(ctx context.Context) error) (*models.Order, error) {
+	var tipped *models.Order
+	err := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+		if settle != nil {
+			if err := settle(ctx); err != nil {
+				return err
+			}
+		}
+		if err := s.repo.SetTip(ctx, order.ID, tip, tipBreakdown(order.CostBreakdown, tip)); err != nil {
+			return err
+		}
+		event := map[string]any{
+			"order_id":   order.ID,
+			"user_id":    userID,
+			"payment_id": paymentID,
+			"amount":     tip,
+		}
+		if err := s.repo.InsertOutboxEvent(ctx, order.ID, "order.tipped", event); err != nil {
+			return err
+		}
+		var err error
+		tipped, err = s.repo.FindByID(ctx, order.ID)
+		return err
+	})
+	if errors.Is(err, models.ErrTipAlreadyAdded) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("CRITICAL: Tip %s charged for order %s but was not recorded: %v", paymentID, order.ID, err)
+		return nil, err
+	}
+	return tipped, nil
+}
+
+// tipBreakdown returns a copy of b showing tip; orders priced before
+// breakdowns were kept have none.
+func tipBreakdown(b *models.CostBreakdown, tip float64) *models.CostBreakdown {
+	if b == nil {
+		return nil
+	}
+	tipped := *b
+	tipped.Tip = tip
+	return &tipped
+}
@@ -0,0 +1,77 @@
+package order
+
+import (
+	"context"
+	"dispatch-and-delivery/internal/models"
+	"fmt"
+	"log"
+	"time"
+)
+
+// unpaidBatchSize bounds how many unpaid orders one run cancels.
+const unpaidBatchSize = 100
+
+// CancelUnpaidOrders cancels orders still in PENDING_PAYMENT or
+// PAYMENT_FAILED ttl after they were created, so abandoned checkouts do not
+// pile up. Each cancellation is recorded in the order's history as a SYSTEM
+// change, emits "order.cancelled" and leaves the customer a notification.
+// Nothing else is held for an unpaid order: its route quote was consumed when
+// it was created, and it has no machine or queue entry yet. Charges awaiting
+// authentication are reconciled with the provider first; orders with one the
+// customer may still be authenticating are skipped. It runs as a scheduler
+// job.
+func (s *Service) CancelUnpaidOrders(ctx context.Context, ttl time.Duration) error {
+	if err := s.reconcilePaymentActions(ctx, ttl); err != nil {
+		return fmt.Errorf("service.CancelUnpaidOrders: %w", err)
+	}
+	unpaid, err := s.repo.ListUnpaid(ctx, time.Now().Add(-ttl), unpaidBatchSize)
+	if err != nil {
+		return fmt.Errorf("service.CancelUnpaidOrders: %w", err)
+	}
+	minutes := int(ttl.Minutes())
+	reason := fmt.Sprintf("not paid within %d minutes", minutes)
+	for _, order := range unpaid {
+		var cancelled bool
+		err := s.txManager.WithinTx(ctx, func(ctx context.Context) error {
+			// The customer may have paid since the order was listed.
+			ok, err := s.repo.CancelUnpaid(ctx, order.ID)
+			if err != nil || !ok {
+				return err
+			}
+			cancelled = true
+			// A promo code is only left redeemed on an unpaid order if its
+			// payment failed and releasing the code did too.
+			if err := s.repo.ReleasePromoRedemption(ctx, order.ID); err != nil {
+				return err
+			}
+			from := order.Status
+			err = s.repo.InsertStatusEvent(ctx, &models.OrderStatusEvent{
+				OrderID:    order.ID,
+				FromStatus: &from,
+				ToStatus:   models.OrderStatusCancelled,
+				ActorType:  models.ActorSystem,
+				Reason:     reason,
+			})
+			if err != nil {
+				return err
+			}
+			event := map[string]string{
+				"order_id": order.ID,
+				"user_id":  order.UserID,
+				"reason":   reason,
+			}
+			if err := s.repo.InsertOutboxEvent(ctx, order.ID, "order.cancelled", event); err != nil {
+				return err
+			}
+			msg := fmt.Sprintf("Your order %s was cancelled because it was not paid within %d minutes. Request a new quote to order again.", order.ID, minutes)
+			return s.repo.InsertNotification(ctx, order.UserID, msg)
+		})
+		if err != nil {
+			return fmt.Errorf("service.CancelUnpaidOrders: order %s: %w", order.ID, err)
+		}
+		if cancelled {
+			log.Printf("order %s cancelled (%s)", order.ID, reason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package order
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"dispatch-and-delivery/internal/models"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Webhook request headers.
+const (
+	HeaderWebhookEvent     = "X-Circuit-Event"
+	HeaderWebhookDelivery  = "X-Circuit-Delivery"
+	HeaderWebhookSignature = "X-Circuit-Signature"
+)
+
+const (
+	// webhookFanOutWindow is how far back each run looks for status changes
+	// besides those after the fan-out cursor. It spans many runs, so a change
+	// committed late is still picked up.
+	webhookFanOutWindow = 10 * time.Minute
+	// webhookClaimLease is how long a run holds the deliveries it claimed;
+	// it outlasts a batch of sends at the client's timeout.
+	webhookClaimLease = 5 * time.Minute
+	// webhookBatchSize bounds the deliveries one run sends.
+	webhookBatchSize = 100
+	// webhookConcurrency bounds the POSTs in flight at once.
+	webhookConcurrency = 8
+	// webhookRetryBase is the wait after the first failure; it doubles per
+	// attempt up to webhookRetryMax.
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = time.Hour
+	// webhookLogRetention is how long finished deliveries stay in the log.
+	webhookLogRetention = 30 * 24 * time.Hour
+)
+
+// errPrivateAddress is returned when a webhook URL resolves to an address
+// that is not on the public internet.
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// NewWebhookClient returns the HTTP client used for webhook deliveries. It
+// does not follow redirects and, unless allowPrivate is set, refuses to
+// connect to loopback, private and link-local addresses, so webhooks cannot
+// reach internal services. The check runs on the resolved address at
+// connect time, which also covers DNS names that resolve to such addresses.
+func NewWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 5 * time.Second},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// cgnat is the shared address space of carrier-grade NAT (RFC 6598).
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether ip is a globally routable unicast address.
+func publicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnat.Contains(ip)
+}
+
+// WithWebhookClient replaces the client used for webhook deliveries.
+func WithWebhookClient(c *http.Client) Option {
+	return func(s *Service) { s.webhookClient = c }
+}
+
+// CreateWebhook registers a webhook URL for the user's order status changes.
+// The returned endpoint carries the signing secret, which is not shown again.
+func (s *Service) CreateWebhook(ctx context.Context, userID string, req models.CreateWebhookRequest) (*models.WebhookEndpoint, error) {
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, models.ValidationFailed(models.FieldError{
+			Field:   "url",
+			Rule:    "url",
+			Message: "url must be an http or https URL",
+		})
+	}
+	existing, err := s.repo.ListWebhookEndpoints(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("service.CreateWebhook: %w", err)
+	}
+	if len(existing) >= models.MaxWebhookEndpoints {
+		return nil, models.ValidationFailed(models.FieldError{
+			Field:   "url",
+			Rule:    "max",
+			Param:   strconv.Itoa(models.MaxWebhookEndpoints),
+			Message: "at most " + strconv.Itoa(models.MaxWebhookEndpoints) + " webhooks can be registered",
+		})
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("service.CreateWebhook: %w", err)
+	}
+	ep := &models.WebhookEndpoint{
+		UserID:      userID,
+		URL:         req.URL,
+		Description: req.Description,
+		Secret:      "whsec_" + hex.EncodeToString(secret),
+	}
+	if err := s.repo.CreateWebhookEndpoint(ctx, ep); err != nil {
+		return nil, fmt.Errorf("service.CreateWebhook: %w", err)
+	}
+	return ep, nil
+}
+
+// ListWebhooks returns the user's webhook endpoints without their secrets.
+func (s *Service) ListWebhooks(ctx context.Context, userID string) ([]*models.WebhookEndpoint, error) {
+	endpoints, err := s.repo.ListWebhookEndpoints(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("service.ListWebhooks: %w", err)
+	}
+	return endpoints, nil
+}
+
+// DeleteWebhook removes one of the user's webhook endpoints and its delivery log.
+func (s *Service) DeleteWebhook(ctx context.Context, userID, endpointID string) error {
+	if err := s.repo.DeleteWebhookEndpoint(ctx, endpointID, userID); err != nil {
+		return fmt.Errorf("service.DeleteWebhook: %w", err)
+	}
+	return nil
+}
+
+// ownedWebhook returns the endpoint if it belongs to userID; other users'
+// endpoints are reported as not found.
+func (s *Service) ownedWebhook(ctx context.Context, userID, endpointID string) (*models.WebhookEndpoint, error) {
+	ep, err := s.repo.FindWebhookEndpoint(ctx, endpointID)
+	if err != nil {
+		return nil, err
+	}
+	if ep.UserID != userID {
+		return nil, models.ErrNotFound
+	}
+	return ep, nil
+}
+
+// ListWebhookDeliveries returns the newest deliveries of one of the user's
+// endpoints, optionally only those in status.
+func (s *Service) ListWebhookDeliveries(ctx context.Context, userID, endpointID string, status *models.WebhookDeliveryStatus, limit int) ([]*models.WebhookDelivery, error) {
+	if _, err := s.ownedWebhook(ctx, userID, endpointID); err != nil {
+		return nil, fmt.Errorf("service.ListWebhookDeliveries: %w", err)
+	}
+	deliveries, err := s.repo.ListWebhookDeliveries(ctx, endpointID, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("service.ListWebhookDeliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// GetWebhookDelivery returns one delivery of the user's endpoint with every
+// attempt made for it.
+func (s *Service) GetWebhookDelivery(ctx context.Context, userID, endpointID, deliveryID string) (*models.WebhookDelivery, error) {
+	if _, err := s.ownedWebhook(ctx, userID, endpointID); err != nil {
+		return nil, fmt.Errorf("service.GetWebhookDelivery: %w", err)
+	}
+	d, err := s.repo.FindWebhookDelivery(ctx, endpointID, deliveryID)
+	if err != nil {
+		return nil, fmt.Errorf("service.GetWebhookDelivery: %w", err)
+	}
+	return d, nil
+}
+
+// DeliverWebhooks queues deliveries for new status changes and sends the
+// ones that are due. Each due delivery is claimed by one run, so instances
+// running it side by side do not send it twice. A delivery that fails is
+// retried with exponential
+// backoff and marked FAILED after models.MaxWebhookAttempts. It is run
+// periodically by the scheduler.
+func (s *Service) DeliverWebhooks(ctx context.Context) error {
+	if _, err := s.repo.CreateWebhookDeliveries(ctx, time.Now().Add(-webhookFanOutWindow)); err != nil {
+		return fmt.Errorf("service.DeliverWebhooks: %w", err)
+	}
+	due, err := s.repo.ClaimDueWebhookDeliveries(ctx, webhookBatchSize, webhookClaimLease)
+	if err != nil {
+		return fmt.Errorf("service.DeliverWebhooks: %w", err)
+	}
+
+	var g errgroup.Group
+	g.SetLimit(webhookConcurrency)
+	for _, p := range due {
+		g.Go(func() error {
+			attempt := s.sendWebhook(ctx, p)
+			status, next := models.WebhookSucceeded, (*time.Time)(nil)
+			if attempt.Error != "" {
+				status, next = webhookRetry(attempt.Attempt, time.Now())
+			}
+			if err := s.repo.RecordWebhookAttempt(ctx, p.ID, attempt, status, next); err != nil {
+				return err
+			}
+			if status == models.WebhookFailed {
+				log.Printf("DeliverWebhooks: delivery %s to endpoint %s failed after %d attempts: %s", p.ID, p.EndpointID, attempt.Attempt, attempt.Error)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("service.DeliverWebhooks: %w", err)
+	}
+	return nil
+}
+
+// webhookRetry returns what happens to a delivery after its attempt-th try
+// failed at now: another try after the backoff, or FAILED.
+func webhookRetry(attempt int, now time.Time) (models.WebhookDeliveryStatus, *time.Time) {
+	if attempt >= models.MaxWebhookAttempts {
+		return models.WebhookFailed, nil
+	}
+	wait := webhookRetryMax
+	if attempt < 20 {
+		wait = min(webhookRetryBase<<(attempt-1), webhookRetryMax)
+	}
+	next := now.Add(wait)
+	return models.WebhookPending, &next
+}
+
+// sendWebhook POSTs a delivery once and reports how it went; any answer but
+// 2xx is a failure.
+func (s *Service) sendWebhook(ctx context.Context, p models.PendingWebhook) models.WebhookAttempt {
+	attempt := models.WebhookAttempt{Attempt: p.Attempts + 1}
+	body, err := json.Marshal(models.WebhookEvent{ID: p.ID, Type: p.EventType, CreatedAt: p.CreatedAt, Data: p.Payload})
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Circuit-Webhooks/1")
+	req.Header.Set(HeaderWebhookEvent, p.EventType)
+	req.Header.Set(HeaderWebhookDelivery, p.ID)
+	req.Header.Set(HeaderWebhookSignature, WebhookSignature(p.Secret, time.Now(), body))
+
+	start := time.Now()
+	resp, err := s.webhookClient.Do(req)
+	attempt.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	// Drain a little so the connection can be reused; the body is not logged.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	attempt.StatusCode = &resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = "unexpected status " + resp.Status
+	}
+	return attempt
+}
+
+// WebhookSignature returns the X-Circuit-Signature header for body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">". Receivers
+// recompute v1 with their endpoint's secret and reject stale timestamps.
+func WebhookSignature(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// PruneWebhookDeliveries deletes finished deliveries older than 30 days. It
+// is run periodically by the scheduler.
+func (s *Service) PruneWebhookDeliveries(ctx context.Context) error {
+	n, err := s.repo.DeleteOldWebhookDeliveries(ctx, time.Now().Add(-webhookLogRetention))
+	if err != nil {
+		return fmt.Errorf("service.PruneWebhookDeliveries: %w", err)
+	}
+	if n > 0 {
+		log.Printf("PruneWebhookDeliveries: deleted %d delivery log entries", n)
+	}
+	return nil
+}
@@ -21,26 +21,25 @@ type Handler struct {
 func NewHandler(service ServiceInterface) *Handler {
 	return &Handler{
 		service:  service,
-		validate: validator.New(),
+		validate: utils.NewValidator(),
 	}
 }
 
 func (h *Handler) Signup(c echo.Context) error {
 	var req models.SignupRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body"})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
 	authResponse, err := h.service.Signup(c.Request().Context(), req)
 	if err != nil {
 		if errors.Is(err, models.ErrConflict) {
-			return c.JSON(http.StatusConflict, models.ErrorResponse{Message: "Email address is already in use"})
+			return models.NewAPIError(http.StatusConflict, models.CodeEmailTaken, "Email address is already in use")
 		}
-		c.Logger().Error("Handler.Signup: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to create user"})
+		return fmt.Errorf("Handler.Signup: %w", err)
 	}
 
 	return c.JSON(http.StatusCreated, authResponse)
@@ -49,19 +48,18 @@ func (h *Handler) Signup(c echo.Context) error {
 func (h *Handler) Login(c echo.Context) error {
 	var req models.LoginRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body"})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
 	authResponse, err := h.service.Login(c.Request().Context(), req)
 	if err != nil {
-		if errors.Is(err, models.ErrInvalidCredentials) { // Define this error in models
-			return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: "Invalid email or password"})
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			return models.NewAPIError(http.StatusUnauthorized, models.CodeInvalidCredentials, "Invalid email or password")
 		}
-		c.Logger().Error("Handler.Login: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to log in"})
+		return fmt.Errorf("Handler.Login: %w", err)
 	}
 
 	return c.JSON(http.StatusOK, authResponse)
@@ -74,8 +72,7 @@ func (h *Handler) GoogleLogin(c echo.Context) error {
 	// This URL includes the client ID and a state parameter for security.
 	authURL, state, err := h.service.HandleGoogleLogin()
 	if err != nil {
-		c.Logger().Error("Handler.GoogleLogin: failed to generate auth URL: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Could not initiate Google login"})
+		return fmt.Errorf("Handler.GoogleLogin: failed to generate auth URL: %w", err)
 	}
 
 	// Create a new secure cookie to store the state parameter
@@ -102,13 +99,13 @@ func (h *Handler) GoogleCallback(c echo.Context) error {
 	if err != nil {
 		// If the cookie expired or was never set
 		c.Logger().Error("Handler.GoogleCallback: could not read state cookie: ", err)
-		return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: "Invalid or missing state cookie"})
+		return models.NewAPIError(http.StatusUnauthorized, models.CodeUnauthorized, "Invalid or missing state cookie")
 	}
 
 	// 2. Compare the state from the cookie with the state from the query parameter.
 	if c.QueryParam("state") != oauthStateCookie.Value {
 		c.Logger().Error("Handler.GoogleCallback: state parameter mismatch")
-		return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: "Invalid state parameter"})
+		return models.NewAPIError(http.StatusUnauthorized, models.CodeUnauthorized, "Invalid state parameter")
 	}
 
 	// 3. Delete the cookie after it has been used once.
@@ -119,7 +116,7 @@ func (h *Handler) GoogleCallback(c echo.Context) error {
 	// 4. Get the authorization code from the query parameters.
 	code := c.QueryParam("code")
 	if code == "" {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Authorization code not provided"})
+		return models.NewAPIError(http.StatusBadRequest, models.CodeInvalidRequest, "Authorization code not provided")
 	}
 
 	// 5. Call the service to exchange the code for a token, fetch user info,
@@ -140,10 +137,10 @@ func (h *Handler) GoogleCallback(c echo.Context) error {
 func (h *Handler) ActivateAccount(c echo.Context) error {
 	var req models.ActivationRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request: missing token"})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: err.Error()})
+		return models.NewValidationError(err)
 	}
 
 	// After activation, automatically log the user in by issuing a JWT
@@ -151,10 +148,9 @@ func (h *Handler) ActivateAccount(c echo.Context) error {
 	authResponse, err := h.service.ActivateUserAndLogin(c.Request().Context(), req.Token)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidToken) {
-			return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid or expired activation token"})
+			return models.NewAPIError(http.StatusBadRequest, models.CodeInvalidToken, "Invalid or expired activation token")
 		}
-		c.Logger().Error("Handler.ActivateAccount: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to activate account"})
+		return fmt.Errorf("Handler.ActivateAccount: %w", err)
 	}
 
 	return c.JSON(http.StatusOK, authResponse)
@@ -164,10 +160,10 @@ func (h *Handler) ActivateAccount(c echo.Context) error {
 func (h *Handler) ResendActivation(c echo.Context) error {
 	var req models.ResendActivationRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request: " + err.Error()})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
 	err := h.service.ResendActivationEmail(c.Request().Context(), req.Email)
@@ -191,10 +187,10 @@ func (h *Handler) ResendActivation(c echo.Context) error {
 func (h *Handler) RequestPasswordReset(c echo.Context) error {
 	var req models.RequestPasswordResetRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request: " + err.Error()})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
 	err := h.service.RequestPasswordReset(c.Request().Context(), req.Email)
@@ -216,12 +212,12 @@ func (h *Handler) ResetPassword(c echo.Context) error {
 	// 1. Bind the incoming JSON request body to our ResetPasswordRequest struct.
 	var req models.ResetPasswordRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body: " + err.Error()})
+		return models.NewBindError(err)
 	}
 
 	// 2. Validate the request data using the struct tags
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
 	// 3. Call the corresponding service method to perform the core logic.
@@ -233,12 +229,11 @@ func (h *Handler) ResetPassword(c echo.Context) error {
 		// 4. Handle specific errors returned from the service layer.
 		if errors.Is(err, models.ErrInvalidToken) {
 			// This error is returned if the token doesn't exist, is expired, or is otherwise invalid.
-			return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid or expired password reset token"})
+			return models.NewAPIError(http.StatusBadRequest, models.CodeInvalidToken, "Invalid or expired password reset token")
 		}
 
-		// For all other unexpected errors, log them and return a generic server error.
-		c.Logger().Error("Handler.ResetPassword: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "An internal error occurred while resetting the password"})
+		// All other unexpected errors are logged by the central error handler as a generic 500.
+		return fmt.Errorf("Handler.ResetPassword: %w", err)
 	}
 
 	// 5. On success, the service returns a new AuthResponse.
@@ -249,16 +244,12 @@ func (h *Handler) ResetPassword(c echo.Context) error {
 func (h *Handler) GetProfile(c echo.Context) error {
 	userID, err := utils.GetUserIDFromContext(c)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: err.Error()})
+		return models.NewAPIError(http.StatusUnauthorized, models.CodeUnauthorized, err.Error())
 	}
 
 	user, err := h.service.GetUserProfile(c.Request().Context(), userID)
 	if err != nil {
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "User profile not found"})
-		}
-		c.Logger().Error("Handler.GetProfile: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to retrieve profile"})
+		return fmt.Errorf("Handler.GetProfile: %w", err)
 	}
 	return c.JSON(http.StatusOK, user)
 }
@@ -266,37 +257,48 @@ func (h *Handler) GetProfile(c echo.Context) error {
 func (h *Handler) UpdateProfile(c echo.Context) error {
 	userID, err := utils.GetUserIDFromContext(c)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, models.ErrorResponse{Message: err.Error()})
+		return models.NewAPIError(http.StatusUnauthorized, models.CodeUnauthorized, err.Error())
 	}
 
 	var req models.UserUpdateData
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body: " + err.Error()})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
 	user, err := h.service.UpdateUserProfile(c.Request().Context(), userID, req)
 	if err != nil {
-		if err == models.ErrNotFound {
-			return c.JSON(http.StatusNotFound, models.ErrorResponse{Message: "User profile not found"})
-		}
-		c.Logger().Error("Handler.UpdateProfile: ", err)
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: "Failed to update profile"})
+		return fmt.Errorf("Handler.UpdateProfile: %w", err)
 	}
 	return c.JSON(http.StatusOK, user)
 }
 
 // --- User Address Routes ---
-// ListAddresses retrieves all addresses for the authenticated user.
+// ListAddresses retrieves the authenticated user's addresses; deleted ones
+// are left out.
 func (h *Handler) ListAddresses(c echo.Context) error {
 	userID := c.Get("userID").(string)
 
 	ctx := c.Request().Context()
-	addresses, err := h.service.ListAddresses(ctx, userID)
+	addresses, err := h.service.ListAddresses(ctx, userID, false)
+	if err != nil {
+		return fmt.Errorf("Handler.ListAddresses: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, addresses)
+}
+
+// AdminListAddresses retrieves the addresses of the user in the path for an
+// administrator. ?include_deleted=true also returns soft-deleted addresses.
+func (h *Handler) AdminListAddresses(c echo.Context) error {
+	includeDeleted := c.QueryParam("include_deleted") == "true"
+
+	ctx := c.Request().Context()
+	addresses, err := h.service.ListAddresses(ctx, c.Param("userId"), includeDeleted)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: err.Error()})
+		return fmt.Errorf("Handler.AdminListAddresses: %w", err)
 	}
 
 	return c.JSON(http.StatusOK, addresses)
@@ -308,16 +310,16 @@ func (h *Handler) AddAddress(c echo.Context) error {
 
 	var req models.AddAddressRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body"})
+		return models.NewBindError(err)
 	}
 	if err := h.validate.Struct(req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Validation failed: " + err.Error()})
+		return models.NewValidationError(err)
 	}
 
 	ctx := c.Request().Context()
-	newAddress, err := h.service.AddAddress(ctx, userID, req.StreetAddress, req.Label, req.IsDefault)
+	newAddress, err := h.service.AddAddress(ctx, userID, req.StreetAddress, req.Label, req.IsDefault, req.Location)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: err.Error()})
+		return fmt.Errorf("Handler.AddAddress: %w", err)
 	}
 
 	return c.JSON(http.StatusCreated, newAddress)
@@ -330,7 +332,10 @@ func (h *Handler) UpdateAddress(c echo.Context) error {
 
 	var req models.UpdateAddressRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid request body"})
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
 	}
 
 	ctx := c.Request().Context()
@@ -338,8 +343,8 @@ func (h *Handler) UpdateAddress(c echo.Context) error {
 	// before performing the update.
 	updatedAddress, err := h.service.UpdateAddress(ctx, userID, addressID, req)
 	if err != nil {
-		// The service should return a specific error for not found or forbidden
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: err.Error()})
+		// The service returns models.ErrNotFound for addresses the user does not own
+		return fmt.Errorf("Handler.UpdateAddress: %w", err)
 	}
 
 	return c.JSON(http.StatusOK, updatedAddress)
@@ -354,8 +359,49 @@ func (h *Handler) DeleteAddress(c echo.Context) error {
 	// The service layer will ensure the user can only delete their own address.
 	err := h.service.DeleteAddress(ctx, userID, addressID)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, models.ErrorResponse{Message: err.Error()})
+		return fmt.Errorf("Handler.DeleteAddress: %w", err)
 	}
 
 	return c.NoContent(http.StatusNoContent)
 }
+
+// --- Saved Payment Methods ---
+// ListPaymentMethods returns the authenticated user's saved cards, newest first.
+func (h *Handler) ListPaymentMethods(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	methods, err := h.service.ListPaymentMethods(c.Request().Context(), userID)
+	if err != nil {
+		return fmt.Errorf("Handler.ListPaymentMethods: %w", err)
+	}
+	return c.JSON(http.StatusOK, methods)
+}
+
+// AddPaymentMethod saves a card the client tokenized with the payment provider.
+func (h *Handler) AddPaymentMethod(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	var req models.AddPaymentMethodRequest
+	if err := c.Bind(&req); err != nil {
+		return models.NewBindError(err)
+	}
+	if err := h.validate.Struct(req); err != nil {
+		return models.NewValidationError(err)
+	}
+
+	pm, err := h.service.AddPaymentMethod(c.Request().Context(), userID, req)
+	if err != nil {
+		return fmt.Errorf("Handler.AddPaymentMethod: %w", err)
+	}
+	return c.JSON(http.StatusCreated, pm)
+}
+
+// DeletePaymentMethod removes one of the authenticated user's saved cards.
+func (h *Handler) DeletePaymentMethod(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	if err := h.service.DeletePaymentMethod(c.Request().Context(), userID, c.Param("paymentMethodId")); err != nil {
+		return fmt.Errorf("Handler.DeletePaymentMethod: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,76 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"dispatch-and-delivery/internal/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// addressService records the ListAddresses calls it answers.
+type addressService struct {
+	ServiceInterface
+	calls []string
+}
+
+func (s *addressService) ListAddresses(ctx context.Context, userID string, includeDeleted bool) ([]models.Address, error) {
+	if includeDeleted {
+		s.calls = append(s.calls, userID+" with deleted")
+	} else {
+		s.calls = append(s.calls, userID)
+	}
+	return []models.Address{{ID: "a1", UserID: userID}}, nil
+}
+
+func TestListAddresses(t *testing.T) {
+	svc := &addressService{}
+	h := NewHandler(svc)
+	e := echo.New()
+	get := func(target string, handler echo.HandlerFunc, setup func(c echo.Context)) []models.Address {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+		setup(c)
+		if err := handler(c); err != nil {
+			t.Fatalf("GET %s error: %v", target, err)
+		}
+		var out []models.Address
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatalf("GET %s body: %v", target, err)
+		}
+		return out
+	}
+
+	// An administrator sees the customer's addresses, deleted ones on request.
+	admin := func(c echo.Context) {
+		c.Set("userID", "admin-1")
+		c.Set("userRole", models.RoleAdmin)
+		c.SetParamNames("userId")
+		c.SetParamValues("u2")
+	}
+	if got := get("/admin/users/u2/addresses?include_deleted=true", h.AdminListAddresses, admin); len(got) != 1 || got[0].ID != "a1" {
+		t.Errorf("admin listing = %+v; want u2's address a1", got)
+	}
+	get("/admin/users/u2/addresses", h.AdminListAddresses, admin)
+
+	// The profile only lists the caller's live addresses.
+	get("/profile/addresses?include_deleted=true", h.ListAddresses, func(c echo.Context) {
+		c.Set("userID", "admin-1")
+		c.Set("userRole", models.RoleAdmin)
+	})
+
+	want := []string{"u2 with deleted", "u2", "admin-1"}
+	if len(svc.calls) != len(want) {
+		t.Fatalf("ListAddresses calls = %q; want %q", svc.calls, want)
+	}
+	for i := range want {
+		if svc.calls[i] != want[i] {
+			t.Errorf("ListAddresses call %d = %q; want %q", i, svc.calls[i], want[i])
+		}
+	}
+}
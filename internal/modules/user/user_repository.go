@@ -36,10 +36,17 @@ type RepositoryInterface interface {
 
 	ClearDefaultAddress(ctx context.Context, userID string) error
 	VerifyAddressOwner(ctx context.Context, userID, addressID string) error
-	ListAddresses(ctx context.Context, userID string) ([]models.Address, error)
-	AddAddress(ctx context.Context, userID, streetAddress string, label *string, isDefault bool) (*models.Address, error)
+	ListAddresses(ctx context.Context, userID string, includeDeleted bool) ([]models.Address, error)
+	AddAddress(ctx context.Context, userID, streetAddress string, label *string, isDefault bool, location *models.GeoPoint) (*models.Address, error)
 	UpdateAddress(ctx context.Context, addressID string, req models.UpdateAddressRequest) (*models.Address, error)
 	DeleteAddress(ctx context.Context, userID, addressID string) error
+
+	GetPaymentCustomerID(ctx context.Context, userID string) (string, error)
+	SetPaymentCustomerID(ctx context.Context, userID, customerID string) (string, error)
+	ListPaymentMethods(ctx context.Context, userID string) ([]*models.PaymentMethod, error)
+	AddPaymentMethod(ctx context.Context, pm *models.PaymentMethod) error
+	FindPaymentMethod(ctx context.Context, userID, paymentMethodID string) (*models.PaymentMethod, error)
+	DeletePaymentMethod(ctx context.Context, userID, paymentMethodID string) error
 }
 
 // This interface represents anything that can execute a SQL query,
@@ -86,6 +93,7 @@ func (r *Repository) scanUser(row pgx.Row) (*models.User, error) {
 		&user.Email,
 		&avatarURL,
 		&user.AuthProvider,
+		&user.Role,
 		&user.IsActive,
 		&user.CreatedAt,
 		&user.UpdatedAt,
@@ -114,6 +122,7 @@ func (r *Repository) scanUserWithPasswordHash(row pgx.Row) (*models.User, error)
 		&passwordHash,
 		&avatarURL,
 		&user.AuthProvider,
+		&user.Role,
 		&user.IsActive,
 		&user.CreatedAt,
 		&user.UpdatedAt,
@@ -139,7 +148,7 @@ func (r *Repository) scanUserWithPasswordHash(row pgx.Row) (*models.User, error)
 
 func (r *Repository) FindByID(ctx context.Context, userID string) (*models.User, error) {
 	user := &models.User{}
-	query := `SELECT id, nickname, email, avatar_url, auth_provider, is_active, created_at, updated_at FROM users WHERE id = $1`
+	query := `SELECT id, nickname, email, avatar_url, auth_provider, role, is_active, created_at, updated_at FROM users WHERE id = $1`
 
 	row := r.executor.QueryRow(ctx, query, userID)
 	user, err := r.scanUser(row)
@@ -157,7 +166,7 @@ func (r *Repository) FindByEmail(ctx context.Context, email string) (*models.Use
 	// Similar to FindByID, but queries by email
 	// Important for checking if email exists during signup if you implement it
 	user := &models.User{}
-	query := `SELECT id, nickname, email, password_hash, avatar_url, auth_provider, is_active, created_at, updated_at FROM users WHERE email = $1`
+	query := `SELECT id, nickname, email, password_hash, avatar_url, auth_provider, role, is_active, created_at, updated_at FROM users WHERE email = $1`
 
 	row := r.executor.QueryRow(ctx, query, email)
 	user, err := r.scanUserWithPasswordHash(row)
@@ -173,7 +182,7 @@ func (r *Repository) FindByEmail(ctx context.Context, email string) (*models.Use
 
 func (r *Repository) FindByNickname(ctx context.Context, nickname string) (*models.User, error) {
 	user := &models.User{}
-	query := `SELECT id, nickname, email, avatar_url, auth_provider, is_active, created_at, updated_at FROM users WHERE nickname = $1`
+	query := `SELECT id, nickname, email, avatar_url, auth_provider, role, is_active, created_at, updated_at FROM users WHERE nickname = $1`
 
 	row := r.executor.QueryRow(ctx, query, nickname)
 	user, err := r.scanUser(row)
@@ -191,7 +200,7 @@ func (r *Repository) FindByPasswordResetToken(ctx context.Context, token string)
 	user := &models.User{}
 
 	query := `
-	SELECT id, nickname, email, password_hash, avatar_url, auth_provider, is_active, created_at, updated_at
+	SELECT id, nickname, email, password_hash, avatar_url, auth_provider, role, is_active, created_at, updated_at
 	FROM users
 	WHERE password_reset_token = $1 AND password_reset_expires_at > NOW()
 	`
@@ -265,10 +274,10 @@ func (r *Repository) CreateInactiveUser(ctx context.Context, user *models.User,
 	query := `
         INSERT INTO users (nickname, email, password_hash, activation_token, activation_token_expires_at, auth_provider)
 	VALUES ($1, $2, $3, $4, $5, $6)
-        RETURNING id, is_active, auth_provider, created_at, updated_at`
+        RETURNING id, is_active, auth_provider, role, created_at, updated_at`
 	err := r.executor.QueryRow(ctx, query,
 		user.Nickname, user.Email, passwordHash, activationToken, expiresAt, "EMAIL",
-	).Scan(&user.ID, &user.IsActive, &user.AuthProvider, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.IsActive, &user.AuthProvider, &user.Role, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("repository.CreateInactiveUser: %w", err)
 	}
@@ -282,7 +291,7 @@ func (r *Repository) ActivateUser(ctx context.Context, token string) (*models.Us
         UPDATE users
         SET is_active = TRUE, activation_token = NULL, activation_token_expires_at = NULL, updated_at = NOW()
         WHERE activation_token = $1 AND activation_token_expires_at > NOW() AND is_active = FALSE
-        RETURNING id, nickname, email, avatar_url, auth_provider, is_active, created_at, updated_at`
+        RETURNING id, nickname, email, avatar_url, auth_provider, role, is_active, created_at, updated_at`
 	row := r.executor.QueryRow(ctx, query, token)
 	user, err := r.scanUser(row)
 	if err != nil {
@@ -299,10 +308,10 @@ func (r *Repository) CreateOAuthUser(ctx context.Context, user *models.User) (*m
 	query := `
         INSERT INTO users (nickname, email, auth_provider, auth_provider_id, is_active)
         VALUES ($1, $2, $3, $4, $5, TRUE)
-        RETURNING id, created_at, updated_at`
+        RETURNING id, role, created_at, updated_at`
 	err := r.executor.QueryRow(ctx, query,
 		user.Nickname, user.Email, user.AuthProvider, user.AuthProviderID,
-	).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Role, &user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
 		// Handle potential duplicate email error (unique constraint)
@@ -339,7 +348,7 @@ func (r *Repository) Update(ctx context.Context, userID string, data models.User
 
 	args = append(args, userID) // For WHERE clause
 
-	query := fmt.Sprintf(`UPDATE users SET %s WHERE id = $%d RETURNING id, nickname, email, avatar_url, auth_provider, is_active, created_at, updated_at`,
+	query := fmt.Sprintf(`UPDATE users SET %s WHERE id = $%d RETURNING id, nickname, email, avatar_url, auth_provider, role, is_active, created_at, updated_at`,
 		strings.Join(setClauses, ", "), argIdx)
 
 	updatedUser := &models.User{}
@@ -353,7 +362,7 @@ func (r *Repository) Update(ctx context.Context, userID string, data models.User
 
 // ClearDefaultAddress sets is_default to false for all of a user's addresses.
 func (r *Repository) ClearDefaultAddress(ctx context.Context, userID string) error {
-	query := `UPDATE addresses SET is_default = false WHERE user_id = $1 AND is_default = true;`
+	query := `UPDATE addresses SET is_default = false WHERE user_id = $1 AND is_default = true AND deleted_at IS NULL;`
 
 	_, err := r.executor.Exec(ctx, query, userID)
 	return err
@@ -362,21 +371,27 @@ func (r *Repository) ClearDefaultAddress(ctx context.Context, userID string) err
 // VerifyAddressOwner checks if a given addressID belongs to the userID.
 func (r *Repository) VerifyAddressOwner(ctx context.Context, userID, addressID string) error {
 	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM addresses WHERE id = $1 AND user_id = $2);`
+	query := `SELECT EXISTS(SELECT 1 FROM addresses WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL);`
 	err := r.executor.QueryRow(ctx, query, addressID, userID).Scan(&exists)
 	if err != nil {
 		return err
 	}
 	if !exists {
 		// Use a standard error type for "not found"
-		return pgx.ErrNoRows
+		return models.ErrNotFound
 	}
 	return nil
 }
 
+// addressColumns is the column list scanAddress expects; the location is
+// split into nullable latitude and longitude.
+const addressColumns = `id, user_id, label, street_address, is_default,
+	ST_Y(location::geometry), ST_X(location::geometry), created_at, updated_at`
+
 func (r *Repository) scanAddress(row pgx.Row) (*models.Address, error) {
 	var addr models.Address
 	var label sql.NullString
+	var lat, lon *float64
 
 	err := row.Scan(
 		&addr.ID,
@@ -384,6 +399,8 @@ func (r *Repository) scanAddress(row pgx.Row) (*models.Address, error) {
 		&label,
 		&addr.StreetAddress,
 		&addr.IsDefault,
+		&lat,
+		&lon,
 		&addr.CreatedAt,
 		&addr.UpdatedAt,
 	)
@@ -395,19 +412,39 @@ func (r *Repository) scanAddress(row pgx.Row) (*models.Address, error) {
 	} else {
 		addr.Label = nil
 	}
+	addr.Location = geoPoint(lat, lon)
 
 	return &addr, nil
 }
 
-func (r *Repository) ListAddresses(ctx context.Context, userID string) ([]models.Address, error) {
+func geoPoint(lat, lon *float64) *models.GeoPoint {
+	if lat == nil || lon == nil {
+		return nil
+	}
+	return &models.GeoPoint{Latitude: *lat, Longitude: *lon}
+}
+
+// pointArgs returns the (longitude, latitude) query arguments for p; both are
+// NULL when p is nil, which ST_MakePoint turns into a NULL location.
+func pointArgs(p *models.GeoPoint) (lon, lat *float64) {
+	if p == nil {
+		return nil, nil
+	}
+	return &p.Longitude, &p.Latitude
+}
+
+// ListAddresses returns a user's active addresses. Soft-deleted addresses are
+// only included when includeDeleted is set (admin access).
+func (r *Repository) ListAddresses(ctx context.Context, userID string, includeDeleted bool) ([]models.Address, error) {
 	var addresses []models.Address
 
 	query := `
-	SELECT id, user_id, label, street_address, is_default, created_at, updated_at 
+	SELECT id, user_id, label, street_address, is_default,
+	       ST_Y(location::geometry), ST_X(location::geometry), created_at, updated_at, deleted_at
 	FROM addresses
-	WHERE user_id = $1
+	WHERE user_id = $1 AND ($2 OR deleted_at IS NULL)
 	`
-	rows, err := r.executor.Query(ctx, query, userID)
+	rows, err := r.executor.Query(ctx, query, userID, includeDeleted)
 	if err != nil {
 		return nil, fmt.Errorf("repository.ListAddresses: %w", err)
 	}
@@ -416,9 +453,11 @@ func (r *Repository) ListAddresses(ctx context.Context, userID string) ([]models
 	for rows.Next() {
 		var addr models.Address
 		var label sql.NullString
-		if err := rows.Scan(&addr.ID, &addr.UserID, &label, &addr.StreetAddress, &addr.IsDefault, &addr.CreatedAt, &addr.UpdatedAt); err != nil {
+		var lat, lon *float64
+		if err := rows.Scan(&addr.ID, &addr.UserID, &label, &addr.StreetAddress, &addr.IsDefault, &lat, &lon, &addr.CreatedAt, &addr.UpdatedAt, &addr.DeletedAt); err != nil {
 			return nil, fmt.Errorf("repository.ListAddresses.Scan: %w", err)
 		}
+		addr.Location = geoPoint(lat, lon)
 		if label.Valid {
 			addr.Label = &label.String
 		} else {
@@ -431,13 +470,13 @@ func (r *Repository) ListAddresses(ctx context.Context, userID string) ([]models
 }
 
 // AddAddress creates a new address record. It will run within a transaction if the repository was created using WithTx().
-func (r *Repository) AddAddress(ctx context.Context, userID, streetAddress string, label *string, isDefault bool) (*models.Address, error) {
+func (r *Repository) AddAddress(ctx context.Context, userID, streetAddress string, label *string, isDefault bool, location *models.GeoPoint) (*models.Address, error) {
 	query := `
-        INSERT INTO addresses (user_id, label, street_address, is_default)
-        VALUES ($1, $2, $3, $4)
-        RETURNING id, user_id, label, street_address, is_default, created_at, updated_at;
-	`
-	row := r.executor.QueryRow(ctx, query, userID, label, streetAddress, isDefault)
+        INSERT INTO addresses (user_id, label, street_address, is_default, location)
+        VALUES ($1, $2, $3, $4, ST_SetSRID(ST_MakePoint($5, $6), 4326))
+        RETURNING ` + addressColumns
+	lon, lat := pointArgs(location)
+	row := r.executor.QueryRow(ctx, query, userID, label, streetAddress, isDefault, lon, lat)
 	addr, err := r.scanAddress(row)
 	if err != nil {
 		return nil, err
@@ -467,10 +506,15 @@ func (r *Repository) UpdateAddress(ctx context.Context, addressID string, req mo
 		args = append(args, *req.IsDefault)
 		argCount++
 	}
+	if req.Location != nil {
+		setClauses = append(setClauses, fmt.Sprintf("location = ST_SetSRID(ST_MakePoint($%d, $%d), 4326)", argCount, argCount+1))
+		args = append(args, req.Location.Longitude, req.Location.Latitude)
+		argCount += 2
+	}
 
 	// If no fields were provided to update, we can return early.
 	if len(setClauses) == 0 {
-		return nil, fmt.Errorf("no fields to update")
+		return nil, models.ErrNoFieldsToUpdate
 	}
 
 	// Always update the updated_at timestamp
@@ -483,15 +527,14 @@ func (r *Repository) UpdateAddress(ctx context.Context, addressID string, req mo
 	query := fmt.Sprintf(`
         UPDATE addresses
         SET %s
-        WHERE id = $%d
-        RETURNING id, user_id, label, street_address, is_default, created_at, updated_at;
-	`, strings.Join(setClauses, ", "), argCount)
+        WHERE id = $%d AND deleted_at IS NULL
+        RETURNING %s`, strings.Join(setClauses, ", "), argCount, addressColumns)
 
 	row := r.executor.QueryRow(ctx, query, args...)
 	addr, err := r.scanAddress(row)
 
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, models.ErrNotFound
 		}
 		return nil, err
@@ -500,8 +543,13 @@ func (r *Repository) UpdateAddress(ctx context.Context, addressID string, req mo
 	return addr, nil
 }
 
+// DeleteAddress soft deletes an address. The row is kept because historical
+// orders still reference it as their pickup or dropoff address.
 func (r *Repository) DeleteAddress(ctx context.Context, userID, addressID string) error {
-	query := `DELETE FROM addresses WHERE id = $1 AND user_id = $2`
+	query := `
+		UPDATE addresses
+		SET deleted_at = now(), is_default = false, updated_at = now()
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL`
 	cmdTag, err := r.executor.Exec(ctx, query, addressID, userID)
 	if err != nil {
 		return fmt.Errorf("repository.DeleteAddress: %w", err)
@@ -511,3 +559,120 @@ func (r *Repository) DeleteAddress(ctx context.Context, userID, addressID string
 	}
 	return nil
 }
+
+// GetPaymentCustomerID returns the payment provider's customer ID of the
+// user, or "" if none has been created yet.
+func (r *Repository) GetPaymentCustomerID(ctx context.Context, userID string) (string, error) {
+	var customerID *string
+	err := r.executor.QueryRow(ctx, `SELECT payment_customer_id FROM users WHERE id = $1`, userID).Scan(&customerID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", models.ErrNotFound
+		}
+		return "", fmt.Errorf("repository.GetPaymentCustomerID: %w", err)
+	}
+	if customerID == nil {
+		return "", nil
+	}
+	return *customerID, nil
+}
+
+// SetPaymentCustomerID records the user's payment provider customer unless
+// one is recorded already, and returns the one recorded.
+func (r *Repository) SetPaymentCustomerID(ctx context.Context, userID, customerID string) (string, error) {
+	query := `
+		UPDATE users SET payment_customer_id = COALESCE(payment_customer_id, $2)
+		WHERE id = $1
+		RETURNING payment_customer_id`
+	var recorded string
+	if err := r.executor.QueryRow(ctx, query, userID, customerID).Scan(&recorded); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", models.ErrNotFound
+		}
+		return "", fmt.Errorf("repository.SetPaymentCustomerID: %w", err)
+	}
+	return recorded, nil
+}
+
+// paymentMethodColumns is the column list scanPaymentMethod expects.
+const paymentMethodColumns = `id, user_id, provider_id, brand, last4, exp_month, exp_year, created_at`
+
+func scanPaymentMethod(row pgx.Row) (*models.PaymentMethod, error) {
+	var pm models.PaymentMethod
+	err := row.Scan(&pm.ID, &pm.UserID, &pm.ProviderID, &pm.Brand, &pm.Last4, &pm.ExpMonth, &pm.ExpYear, &pm.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &pm, nil
+}
+
+// ListPaymentMethods returns the user's saved cards, newest first.
+func (r *Repository) ListPaymentMethods(ctx context.Context, userID string) ([]*models.PaymentMethod, error) {
+	query := `SELECT ` + paymentMethodColumns + ` FROM payment_methods WHERE user_id = $1 ORDER BY created_at DESC, id`
+	rows, err := r.executor.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("repository.ListPaymentMethods: %w", err)
+	}
+	defer rows.Close()
+
+	methods := []*models.PaymentMethod{}
+	for rows.Next() {
+		pm, err := scanPaymentMethod(rows)
+		if err != nil {
+			return nil, fmt.Errorf("repository.ListPaymentMethods.Scan: %w", err)
+		}
+		methods = append(methods, pm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("repository.ListPaymentMethods: %w", err)
+	}
+	return methods, nil
+}
+
+// AddPaymentMethod saves a card and sets its ID and CreatedAt. Saving a card
+// again returns the saved one; a card another user saved fails with
+// ErrConflict.
+func (r *Repository) AddPaymentMethod(ctx context.Context, pm *models.PaymentMethod) error {
+	query := `
+		INSERT INTO payment_methods (user_id, provider_id, brand, last4, exp_month, exp_year)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (provider_id) DO UPDATE SET brand = EXCLUDED.brand
+		WHERE payment_methods.user_id = EXCLUDED.user_id
+		RETURNING id, created_at`
+	err := r.executor.QueryRow(ctx, query, pm.UserID, pm.ProviderID, pm.Brand, pm.Last4, pm.ExpMonth, pm.ExpYear).
+		Scan(&pm.ID, &pm.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The card is saved by another user.
+			return models.ErrConflict
+		}
+		return fmt.Errorf("repository.AddPaymentMethod: %w", err)
+	}
+	return nil
+}
+
+// FindPaymentMethod returns one of the user's saved cards, or
+// ErrPaymentMethodNotFound.
+func (r *Repository) FindPaymentMethod(ctx context.Context, userID, paymentMethodID string) (*models.PaymentMethod, error) {
+	query := `SELECT ` + paymentMethodColumns + ` FROM payment_methods WHERE id = $1 AND user_id = $2`
+	pm, err := scanPaymentMethod(r.executor.QueryRow(ctx, query, paymentMethodID, userID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, models.ErrPaymentMethodNotFound
+		}
+		return nil, fmt.Errorf("repository.FindPaymentMethod: %w", err)
+	}
+	return pm, nil
+}
+
+// DeletePaymentMethod removes one of the user's saved cards.
+func (r *Repository) DeletePaymentMethod(ctx context.Context, userID, paymentMethodID string) error {
+	cmdTag, err := r.executor.Exec(ctx, `DELETE FROM payment_methods WHERE id = $1 AND user_id = $2`, paymentMethodID, userID)
+	if err != nil {
+		return fmt.Errorf("repository.DeletePaymentMethod: %w", err)
+	}
+	if cmdTag.RowsAffected() == 0 {
+		return models.ErrPaymentMethodNotFound
+	}
+	return nil
+}
@@ -4,13 +4,13 @@ import (
 	"context"
 	"dispatch-and-delivery/internal/models"
 	emailSvc "dispatch-and-delivery/pkg/email"
+	"dispatch-and-delivery/pkg/payment"
 	"dispatch-and-delivery/pkg/utils"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -18,6 +18,9 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// emailSendTimeout bounds background email delivery, which outlives the request.
+const emailSendTimeout = 15 * time.Second
+
 // ServiceInterface defines methods for user business logic.
 type ServiceInterface interface {
 	GetClientOrigin() string
@@ -34,15 +37,20 @@ type ServiceInterface interface {
 	GetUserProfile(ctx context.Context, userID string) (*models.User, error)
 	UpdateUserProfile(ctx context.Context, userID string, data models.UserUpdateData) (*models.User, error)
 
-	ListAddresses(ctx context.Context, userID string) ([]models.Address, error)
-	AddAddress(ctx context.Context, userID, streetAddress string, label *string, isDefault bool) (*models.Address, error)
+	ListAddresses(ctx context.Context, userID string, includeDeleted bool) ([]models.Address, error)
+	AddAddress(ctx context.Context, userID, streetAddress string, label *string, isDefault bool, location *models.GeoPoint) (*models.Address, error)
 	UpdateAddress(ctx context.Context, userID, addressID string, req models.UpdateAddressRequest) (*models.Address, error)
 	DeleteAddress(ctx context.Context, userID, addressID string) error
+
+	ListPaymentMethods(ctx context.Context, userID string) ([]*models.PaymentMethod, error)
+	AddPaymentMethod(ctx context.Context, userID string, req models.AddPaymentMethodRequest) (*models.PaymentMethod, error)
+	DeletePaymentMethod(ctx context.Context, userID, paymentMethodID string) error
 }
 
 type Service struct {
 	userRepo          RepositoryInterface
 	emailer           emailSvc.ServiceInterface // For sending emails
+	payments          payment.ServiceInterface  // For saved cards
 	templateManager   *emailSvc.TemplateManager
 	jwtSecret         string
 	clientOrigin      string // For sending activation and password reset emails (domain name)
@@ -56,10 +64,12 @@ func NewService(
 	JWTSecretFromConfig string,
 	clientOriginFromConfig string,
 	googleOAuthConfig *oauth2.Config,
+	payments payment.ServiceInterface,
 ) ServiceInterface {
 	return &Service{
 		userRepo:          userRepo,
 		emailer:           emailer,
+		payments:          payments,
 		templateManager:   tm,
 		jwtSecret:         JWTSecretFromConfig,
 		clientOrigin:      clientOriginFromConfig,
@@ -133,13 +143,7 @@ func (s *Service) Signup(ctx context.Context, req models.SignupRequest) (*models
 	emailSubject := "[Circuit] Welcome! Please Activate Your Account"
 	plainTextContent := fmt.Sprintf("Thank you for signing up! Please click the following link in 30 minutes to activate your account: %s", activationURL)
 
-	go func() {
-		// Run in a goroutine so it doesn't block the user's signup response
-		err := s.emailer.SendEmail(context.Background(), createdUser.Email, emailSubject, plainTextContent, htmlContent)
-		if err != nil {
-			log.Printf("Failed to send activation email to %s: %v", createdUser.Email, err)
-		}
-	}()
+	s.sendEmailDetached(createdUser.Email, emailSubject, plainTextContent, htmlContent, "activation")
 
 	return createdUser, nil
 }
@@ -150,6 +154,7 @@ func (s *Service) generateAuthResponse(user *models.User) (*models.AuthResponse,
 	claims := &models.JwtCustomClaims{
 		UserID: user.ID,
 		Email:  user.Email,
+		Role:   user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24 * 30)), // 30 days expiry
 		},
@@ -258,13 +263,7 @@ func (s *Service) ResendActivationEmail(ctx context.Context, email string) error
 	emailSubject := "[Circuit] Activate Your Account (New Link)"
 	plainTextContent := fmt.Sprintf("Please click the following link in 30 minutes to activate your account: %s", activationURL)
 
-	go func() {
-		// Run in a goroutine so it doesn't block the user's signup response
-		err := s.emailer.SendEmail(context.Background(), email, emailSubject, plainTextContent, htmlContent)
-		if err != nil {
-			log.Printf("Failed to send re-activation email to %s: %v", email, err)
-		}
-	}()
+	s.sendEmailDetached(email, emailSubject, plainTextContent, htmlContent, "re-activation")
 
 	return nil
 }
@@ -307,13 +306,7 @@ func (s *Service) RequestPasswordReset(ctx context.Context, email string) error
 	emailSubject := "[Circuit] Reset Your Password"
 	plainTextContent := fmt.Sprintf("Please click the following link in 15 minutes to reset your password: %s", resetURL)
 
-	go func() {
-		// Run in a goroutine so it doesn't block the user's signup response
-		err := s.emailer.SendEmail(context.Background(), email, emailSubject, plainTextContent, htmlContent)
-		if err != nil {
-			log.Printf("Failed to send password resetting email to %s: %v", email, err)
-		}
-	}()
+	s.sendEmailDetached(email, emailSubject, plainTextContent, htmlContent, "password resetting")
 
 	return nil
 }
@@ -366,7 +359,8 @@ func (s *Service) HandleGoogleCallback(ctx context.Context, code string) (*model
 	}
 
 	// 2. Use the token to get the user's info from Google's API.
-	response, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
+	// The oauth2 client sends the token in the Authorization header and honors ctx.
+	response, err := s.googleOAuthConfig.Client(ctx, token).Get("https://www.googleapis.com/oauth2/v2/userinfo")
 	if err != nil {
 		return nil, fmt.Errorf("failed getting user info from google: %w", err)
 	}
@@ -440,15 +434,15 @@ func (s *Service) UpdateUserProfile(ctx context.Context, userID string, data mod
 	return updatedUser, nil
 }
 
-func (s *Service) ListAddresses(ctx context.Context, userID string) ([]models.Address, error) {
-	allAddresses, err := s.userRepo.ListAddresses(ctx, userID)
+func (s *Service) ListAddresses(ctx context.Context, userID string, includeDeleted bool) ([]models.Address, error) {
+	allAddresses, err := s.userRepo.ListAddresses(ctx, userID, includeDeleted)
 	if err != nil {
 		return nil, fmt.Errorf("service.ListAddresses: %w", err)
 	}
 	return allAddresses, nil
 }
 
-func (s *Service) AddAddress(ctx context.Context, userID, streetAddress string, label *string, isDefault bool) (*models.Address, error) {
+func (s *Service) AddAddress(ctx context.Context, userID, streetAddress string, label *string, isDefault bool, location *models.GeoPoint) (*models.Address, error) {
 	// If this new address is being set as the default, unset the current default.
 	if isDefault {
 		// This entire block should be executed in a single database transaction.
@@ -470,7 +464,7 @@ func (s *Service) AddAddress(ctx context.Context, userID, streetAddress string,
 		}
 
 		// Create the new address within the same transaction.
-		newAddress, err := txRepo.AddAddress(ctx, userID, streetAddress, label, isDefault)
+		newAddress, err := txRepo.AddAddress(ctx, userID, streetAddress, label, isDefault, location)
 		if err != nil {
 			return nil, err
 		}
@@ -482,7 +476,7 @@ func (s *Service) AddAddress(ctx context.Context, userID, streetAddress string,
 	}
 
 	// If not default, add it directly
-	return s.userRepo.AddAddress(ctx, userID, streetAddress, label, isDefault)
+	return s.userRepo.AddAddress(ctx, userID, streetAddress, label, isDefault, location)
 }
 
 func (s *Service) UpdateAddress(ctx context.Context, userID, addressID string, req models.UpdateAddressRequest) (*models.Address, error) {
@@ -529,3 +523,83 @@ func (s *Service) DeleteAddress(ctx context.Context, userID, addressID string) e
 	}
 	return nil
 }
+
+// ListPaymentMethods returns the user's saved cards, newest first.
+func (s *Service) ListPaymentMethods(ctx context.Context, userID string) ([]*models.PaymentMethod, error) {
+	methods, err := s.userRepo.ListPaymentMethods(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("service.ListPaymentMethods: %w", err)
+	}
+	return methods, nil
+}
+
+// AddPaymentMethod saves a card the client tokenized with the payment
+// provider to the user's provider customer, creating the customer with the
+// user's first card.
+func (s *Service) AddPaymentMethod(ctx context.Context, userID string, req models.AddPaymentMethodRequest) (*models.PaymentMethod, error) {
+	customerID, err := s.userRepo.GetPaymentCustomerID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("service.AddPaymentMethod: %w", err)
+	}
+	if customerID == "" {
+		user, err := s.userRepo.FindByID(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("service.AddPaymentMethod: %w", err)
+		}
+		created, err := s.payments.CreateCustomer(ctx, userID, user.Email)
+		if err != nil {
+			return nil, fmt.Errorf("service.AddPaymentMethod: %w", err)
+		}
+		// Creation is idempotent per user, so a concurrent request records the same customer.
+		if customerID, err = s.userRepo.SetPaymentCustomerID(ctx, userID, created); err != nil {
+			return nil, fmt.Errorf("service.AddPaymentMethod: %w", err)
+		}
+	}
+
+	card, err := s.payments.AttachPaymentMethod(ctx, customerID, req.PaymentMethodID)
+	if err != nil {
+		return nil, fmt.Errorf("service.AddPaymentMethod: %w", err)
+	}
+	pm := &models.PaymentMethod{
+		UserID:     userID,
+		ProviderID: card.ID,
+		Brand:      card.Brand,
+		Last4:      card.Last4,
+		ExpMonth:   card.ExpMonth,
+		ExpYear:    card.ExpYear,
+	}
+	if err := s.userRepo.AddPaymentMethod(ctx, pm); err != nil {
+		return nil, fmt.Errorf("service.AddPaymentMethod: %w", err)
+	}
+	return pm, nil
+}
+
+// DeletePaymentMethod removes one of the user's saved cards from the payment
+// provider first, so a card that is no longer listed can no longer be charged.
+func (s *Service) DeletePaymentMethod(ctx context.Context, userID, paymentMethodID string) error {
+	pm, err := s.userRepo.FindPaymentMethod(ctx, userID, paymentMethodID)
+	if err != nil {
+		return fmt.Errorf("service.DeletePaymentMethod: %w", err)
+	}
+	if err := s.payments.DetachPaymentMethod(ctx, pm.ProviderID); err != nil {
+		return fmt.Errorf("service.DeletePaymentMethod: %w", err)
+	}
+	if err := s.userRepo.DeletePaymentMethod(ctx, userID, paymentMethodID); err != nil {
+		return fmt.Errorf("service.DeletePaymentMethod: %w", err)
+	}
+	return nil
+}
+
+// sendEmailDetached sends an email in a goroutine so it doesn't block the
+// response. The send is detached from the request, which has already
+// returned by the time it runs, but still bounded by emailSendTimeout;
+// failures are only logged, naming the email by kind.
+func (s *Service) sendEmailDetached(to, subject, plainTextContent, htmlContent, kind string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailSendTimeout)
+		defer cancel()
+		if err := s.emailer.SendEmail(ctx, to, subject, plainTextContent, htmlContent); err != nil {
+			log.Printf("Failed to send %s email to %s: %v", kind, to, err)
+		}
+	}()
+}
@@ -0,0 +1,191 @@
+// Package scheduler runs periodic background jobs (ETA refresh, stale-order
+// expiry, telemetry sweeps, reports) inside the API process. Every instance
+// runs a Scheduler, but a Postgres advisory lock per job plus the persisted
+// run history make sure each tick of a job executes on exactly one instance.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Job is a unit of periodic work.
+type Job struct {
+	// Name identifies the job in the lock key and in job_runs; keep it stable.
+	Name string
+	// Every is the interval between runs across the whole cluster.
+	Every time.Duration
+	// Timeout bounds a single run. Zero means Every.
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// Run statuses recorded in job_runs.
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Scheduler owns a set of jobs and the ticker loop that drives them.
+type Scheduler struct {
+	pool     *pgxpool.Pool
+	instance string
+	tick     time.Duration
+
+	mu   sync.Mutex
+	jobs []Job
+}
+
+// New creates a scheduler on the primary pool. Jobs are checked every 15s; a
+// job runs when its interval has elapsed since the last run on any instance.
+func New(pool *pgxpool.Pool) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		pool:     pool,
+		instance: fmt.Sprintf("%s:%d", host, os.Getpid()),
+		tick:     15 * time.Second,
+	}
+}
+
+// Register adds a job. It must be called before Run.
+func (s *Scheduler) Register(job Job) {
+	if job.Timeout <= 0 {
+		job.Timeout = job.Every
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, job)
+}
+
+// Run drives the registered jobs until ctx is cancelled and in-flight runs finish.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	jobs := append([]Job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			s.loop(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+	for {
+		if err := s.runOnce(ctx, job); err != nil && ctx.Err() == nil {
+			log.Printf("scheduler: job %s: %v", job.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce executes job if this instance wins its advisory lock and the job is due.
+func (s *Scheduler) runOnce(ctx context.Context, job Job) error {
+	// Session-level advisory locks belong to a connection, so hold one for the
+	// whole run and release the lock on that same connection.
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	key := lockKey(job.Name)
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked); err != nil {
+		return fmt.Errorf("advisory lock: %w", err)
+	}
+	if !locked {
+		return nil // Another instance is running this job right now.
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+
+	// The lock only prevents overlap; the history decides whether the job is
+	// due, so a run that just finished elsewhere is not repeated here.
+	var due bool
+	err = conn.QueryRow(ctx, `
+		SELECT COALESCE(MAX(started_at), '-infinity') <= now() - make_interval(secs => $2)
+		FROM job_runs WHERE job_name = $1`,
+		job.Name, job.Every.Seconds(),
+	).Scan(&due)
+	if err != nil {
+		return fmt.Errorf("check last run: %w", err)
+	}
+	if !due {
+		return nil
+	}
+
+	var runID int64
+	err = conn.QueryRow(ctx,
+		`INSERT INTO job_runs (job_name, instance, status) VALUES ($1, $2, $3) RETURNING id`,
+		job.Name, s.instance, StatusRunning,
+	).Scan(&runID)
+	if err != nil {
+		return fmt.Errorf("record run: %w", err)
+	}
+
+	runErr := s.execute(ctx, job)
+
+	status, errText := StatusSucceeded, ""
+	if runErr != nil {
+		status, errText = StatusFailed, runErr.Error()
+	}
+	// Record the outcome even if ctx was cancelled mid-run (shutdown).
+	_, err = conn.Exec(context.Background(),
+		`UPDATE job_runs SET status = $2, finished_at = now(), error = NULLIF($3, '') WHERE id = $1`,
+		runID, status, errText,
+	)
+	if err != nil {
+		return fmt.Errorf("record outcome: %w", err)
+	}
+	return runErr
+}
+
+func (s *Scheduler) execute(ctx context.Context, job Job) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, job.Timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("scheduler:" + name))
+	return int64(h.Sum64())
+}
+
+// PruneHistory returns a job that deletes job_runs older than retention.
+func (s *Scheduler) PruneHistory(retention time.Duration) Job {
+	return Job{
+		Name:  "scheduler.prune_history",
+		Every: 24 * time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := s.pool.Exec(ctx,
+				`DELETE FROM job_runs WHERE started_at < now() - make_interval(secs => $1)`,
+				retention.Seconds(),
+			)
+			return err
+		},
+	}
+}
@@ -0,0 +1,162 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"dispatch-and-delivery/internal/migrations"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestExecute(t *testing.T) {
+	s := &Scheduler{}
+	s.Register(Job{Name: "a", Every: time.Minute})
+	s.Register(Job{Name: "b", Every: time.Minute, Timeout: time.Second})
+	if s.jobs[0].Timeout != time.Minute || s.jobs[1].Timeout != time.Second {
+		t.Errorf("timeouts = %s, %s; want Every by default", s.jobs[0].Timeout, s.jobs[1].Timeout)
+	}
+
+	// A run is bounded by the job's timeout.
+	var deadline time.Time
+	err := s.execute(context.Background(), Job{Timeout: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+		deadline, _ = ctx.Deadline()
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Until(deadline) > 0 {
+		t.Errorf("execute = %v; want the run cut off at its timeout", err)
+	}
+	// A panic fails the run instead of the process.
+	err = s.execute(context.Background(), Job{Timeout: time.Second, Run: func(context.Context) error { panic("boom") }})
+	if err == nil || err.Error() != "panic: boom" {
+		t.Errorf("execute = %v; want panic: boom", err)
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	if lockKey("eta.refresh") != lockKey("eta.refresh") || lockKey("eta.refresh") == lockKey("orders.expire") {
+		t.Error("lockKey is not a stable, per-job key")
+	}
+}
+
+// testPool connects to TEST_DATABASE_URL with job_runs in a schema of its
+// own, dropped when the test ends. It skips the test without a database.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatalf("parse TEST_DATABASE_URL: %v", err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = "scheduler_test"
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() {
+		pool.Exec(context.Background(), `DROP SCHEMA IF EXISTS scheduler_test CASCADE`)
+		pool.Close()
+	})
+	ddl, err := migrations.FS.ReadFile("011_create_job_runs_table.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, `DROP SCHEMA IF EXISTS scheduler_test CASCADE; CREATE SCHEMA scheduler_test`); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	if _, err := pool.Exec(ctx, string(ddl)); err != nil {
+		t.Fatalf("create job_runs: %v", err)
+	}
+	return pool
+}
+
+func TestRunOnce(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	a, b := New(pool), New(pool)
+	b.instance = "other:1"
+	runs := 0
+	job := Job{Name: "test.count", Every: time.Hour, Timeout: time.Second, Run: func(context.Context) error {
+		runs++
+		return nil
+	}}
+	lastRun := func(name string) (instance, status, errText string) {
+		t.Helper()
+		err := pool.QueryRow(ctx, `
+			SELECT instance, status, COALESCE(error, '') FROM job_runs
+			WHERE job_name = $1 ORDER BY id DESC LIMIT 1`, name,
+		).Scan(&instance, &status, &errText)
+		if err != nil {
+			t.Fatalf("read job_runs: %v", err)
+		}
+		return instance, status, errText
+	}
+
+	if err := a.runOnce(ctx, job); err != nil || runs != 1 {
+		t.Fatalf("runOnce = %v with %d runs; want one run", err, runs)
+	}
+	if instance, status, _ := lastRun(job.Name); instance != a.instance || status != StatusSucceeded {
+		t.Errorf("run recorded by %s as %s; want %s, succeeded", instance, status, a.instance)
+	}
+	// The tick on another instance sees the run and skips the job.
+	if err := b.runOnce(ctx, job); err != nil || runs != 1 {
+		t.Errorf("second runOnce = %v with %d runs; want the job not due", err, runs)
+	}
+
+	// While another session holds the job's lock, the job is left to it.
+	due := Job{Name: "test.locked", Every: time.Hour, Timeout: time.Second, Run: job.Run}
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, lockKey(due.Name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.runOnce(ctx, due); err != nil || runs != 1 {
+		t.Errorf("runOnce on a locked job = %v with %d runs; want it skipped", err, runs)
+	}
+	conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, lockKey(due.Name))
+	if err := a.runOnce(ctx, due); err != nil || runs != 2 {
+		t.Errorf("runOnce after the unlock = %v with %d runs; want it run", err, runs)
+	}
+
+	// A failure is returned and kept in the history.
+	failing := Job{Name: "test.fail", Every: time.Hour, Timeout: time.Second, Run: func(context.Context) error {
+		return errors.New("geocoder down")
+	}}
+	if err := a.runOnce(ctx, failing); err == nil {
+		t.Error("runOnce hid the job's error")
+	}
+	if _, status, errText := lastRun(failing.Name); status != StatusFailed || errText != "geocoder down" {
+		t.Errorf("failed run recorded as %s %q; want failed with its error", status, errText)
+	}
+
+	// Pruning drops runs older than the retention only.
+	if _, err := pool.Exec(ctx, `INSERT INTO job_runs (job_name, instance, status, started_at)
+		VALUES ('test.old', 'x', 'succeeded', now() - interval '40 days')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.PruneHistory(30 * 24 * time.Hour).Run(ctx); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	var names []string
+	rows, _ := pool.Query(ctx, `SELECT DISTINCT job_name FROM job_runs ORDER BY job_name`)
+	for rows.Next() {
+		var n string
+		rows.Scan(&n)
+		names = append(names, n)
+	}
+	if got := strings.Join(names, ","); got != "test.count,test.fail,test.locked" {
+		t.Errorf("history after pruning has %s; want the old run gone", got)
+	}
+}
@@ -0,0 +1,76 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	apimiddleware "dispatch-and-delivery/internal/api/middleware"
+	"dispatch-and-delivery/internal/models"
+)
+
+// client calls the machine endpoints with one machine's API key.
+type client struct {
+	base   string
+	apiKey string
+	http   *http.Client
+}
+
+func (c *client) heartbeat(ctx context.Context, machineID string) error {
+	return c.do(ctx, http.MethodPost, "/logistics/fleet/"+machineID+"/heartbeat", nil, nil)
+}
+
+func (c *client) setStatus(ctx context.Context, machineID string, status models.MachineStatus, pos models.GeoPoint) error {
+	return c.do(ctx, http.MethodPut, "/logistics/fleet/"+machineID+"/status",
+		models.MachineStatusUpdateRequest{Status: status, Latitude: pos.Latitude, Longitude: pos.Longitude}, nil)
+}
+
+func (c *client) track(ctx context.Context, orderID string, pos models.GeoPoint) error {
+	return c.do(ctx, http.MethodPost, "/logistics/orders/"+orderID+"/track",
+		models.TrackingEventRequest{Latitude: pos.Latitude, Longitude: pos.Longitude}, nil)
+}
+
+func (c *client) assignments(ctx context.Context, machineID string) ([]models.MachineAssignment, error) {
+	var out []models.MachineAssignment
+	err := c.do(ctx, http.MethodGet, "/logistics/fleet/"+machineID+"/assignments", nil, &out)
+	return out, err
+}
+
+// do sends body as JSON (when non-nil) and decodes the response into out (when non-nil).
+func (c *client) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(apimiddleware.MachineKeyHeader, c.apiKey)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("%s %s: decode response: %w", method, path, err)
+		}
+	}
+	return nil
+}
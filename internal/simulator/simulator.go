@@ -0,0 +1,228 @@
+// Package simulator plays virtual drones and robots against a running API
+// server, so the whole dispatch flow can be exercised locally without
+// hardware. Each machine authenticates with its API key like real firmware:
+// it sends heartbeats, polls for the orders it has been assigned, travels to
+// the pickup and along the route to the dropoff, and reports a tracking event
+// every tick. When it has nothing left to deliver it reports IDLE again.
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+// DefaultSpeedKMH is the travel speed of each machine type, matching the
+// averages dispatch uses for its ETAs.
+var DefaultSpeedKMH = map[models.MachineType]float64{
+	models.MachineTypeDrone: 12,
+	models.MachineTypeRobot: 6,
+}
+
+// Machine is a registered machine the simulator drives.
+type Machine struct {
+	ID       string
+	APIKey   string
+	Type     models.MachineType
+	Position models.GeoPoint // Where the machine starts.
+}
+
+// Config controls how machines behave. Zero values select the defaults.
+type Config struct {
+	Server    string        // API base URL, e.g. http://localhost:8080.
+	Tick      time.Duration // Interval between tracking events (default 2s).
+	Speedup   float64       // Simulated seconds per real second (default 1).
+	Poll      time.Duration // How often idle machines ask for assignments (default 5s).
+	Heartbeat time.Duration // Interval between heartbeats (default 30s).
+	// SpeedKMH overrides DefaultSpeedKMH per machine type.
+	SpeedKMH map[models.MachineType]float64
+	// HTTPClient is used for all requests (default: a client with a 10s timeout).
+	HTTPClient *http.Client
+}
+
+func (c Config) withDefaults() Config {
+	c.Server = strings.TrimRight(c.Server, "/")
+	if c.Tick <= 0 {
+		c.Tick = 2 * time.Second
+	}
+	if c.Speedup <= 0 {
+		c.Speedup = 1
+	}
+	if c.Poll <= 0 {
+		c.Poll = 5 * time.Second
+	}
+	if c.Heartbeat <= 0 {
+		c.Heartbeat = 30 * time.Second
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return c
+}
+
+// stepMeters is how far a machine of type t moves in one tick.
+func (c Config) stepMeters(t models.MachineType) float64 {
+	kmh, ok := c.SpeedKMH[t]
+	if !ok {
+		kmh = DefaultSpeedKMH[t]
+	}
+	if kmh <= 0 {
+		kmh = DefaultSpeedKMH[models.MachineTypeRobot]
+	}
+	return kmh / 3.6 * c.Tick.Seconds() * c.Speedup
+}
+
+// Run drives every machine until ctx is cancelled, then returns nil. Request
+// failures are logged and retried on the next tick or poll, as firmware on a
+// flaky link would; they never stop a machine.
+func Run(ctx context.Context, cfg Config, machines []Machine) error {
+	cfg = cfg.withDefaults()
+	var wg sync.WaitGroup
+	for _, m := range machines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newSimMachine(cfg, m).run(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// simMachine is the state of one machine while it runs.
+type simMachine struct {
+	cfg       Config
+	machine   Machine
+	client    *client
+	pos       models.GeoPoint
+	delivered map[string]bool // Orders already taken to their dropoff.
+}
+
+func newSimMachine(cfg Config, m Machine) *simMachine {
+	return &simMachine{
+		cfg:       cfg,
+		machine:   m,
+		client:    &client{base: cfg.Server, apiKey: m.APIKey, http: cfg.HTTPClient},
+		pos:       m.Position,
+		delivered: make(map[string]bool),
+	}
+}
+
+func (m *simMachine) logf(format string, args ...any) {
+	log.Printf("%s %s: %s", m.machine.Type, shortID(m.machine.ID), fmt.Sprintf(format, args...))
+}
+
+func (m *simMachine) run(ctx context.Context) {
+	go m.heartbeats(ctx)
+	if err := m.client.setStatus(ctx, m.machine.ID, models.StatusIdle, m.pos); err != nil {
+		m.logf("report IDLE: %v", err)
+	}
+	for {
+		assignments, err := m.client.assignments(ctx, m.machine.ID)
+		if err != nil && ctx.Err() == nil {
+			m.logf("poll assignments: %v", err)
+		}
+		busy := false
+		for _, a := range assignments {
+			if m.delivered[a.OrderID] {
+				continue
+			}
+			busy = true
+			if err := m.deliver(ctx, a); err != nil {
+				return
+			}
+		}
+		if busy {
+			if err := m.client.setStatus(ctx, m.machine.ID, models.StatusIdle, m.pos); err != nil {
+				m.logf("report IDLE: %v", err)
+			} else {
+				m.logf("back to IDLE")
+			}
+		}
+		if !sleep(ctx, m.cfg.Poll) {
+			return
+		}
+	}
+}
+
+// heartbeats keeps the machine from being marked OFFLINE while it waits for work.
+func (m *simMachine) heartbeats(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.Heartbeat)
+	defer ticker.Stop()
+	for {
+		if err := m.client.heartbeat(ctx, m.machine.ID); err != nil && ctx.Err() == nil {
+			m.logf("heartbeat: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliver travels from the current position to the pickup, then along the
+// route to the dropoff, posting a tracking event for the order every tick.
+// It only returns an error when ctx is cancelled.
+func (m *simMachine) deliver(ctx context.Context, a models.MachineAssignment) error {
+	if a.Dropoff == nil {
+		m.logf("order %s has no dropoff coordinates, skipping", shortID(a.OrderID))
+		m.delivered[a.OrderID] = true
+		return nil
+	}
+	m.logf("delivering order %s", shortID(a.OrderID))
+	path := deliveryPath(m.pos, a)
+	w := &walker{path: path, pos: path[0]}
+	step := m.cfg.stepMeters(m.machine.Type)
+	for {
+		done := w.advance(step)
+		m.pos = w.pos
+		if err := m.client.track(ctx, a.OrderID, m.pos); err != nil && ctx.Err() == nil {
+			m.logf("track order %s: %v", shortID(a.OrderID), err)
+		}
+		if done {
+			break
+		}
+		if !sleep(ctx, m.cfg.Tick) {
+			return ctx.Err()
+		}
+	}
+	m.logf("order %s reached its dropoff", shortID(a.OrderID))
+	m.delivered[a.OrderID] = true
+	return nil
+}
+
+// deliveryPath is the path from `from` through the pickup to the dropoff,
+// following the route geometry when the server sent one.
+func deliveryPath(from models.GeoPoint, a models.MachineAssignment) []models.GeoPoint {
+	path := []models.GeoPoint{from}
+	if a.Pickup != nil {
+		path = append(path, *a.Pickup)
+	}
+	path = append(path, a.Path...)
+	return append(path, *a.Dropoff)
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
@@ -0,0 +1,95 @@
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	apimiddleware "dispatch-and-delivery/internal/api/middleware"
+	"dispatch-and-delivery/internal/models"
+)
+
+func TestWalker(t *testing.T) {
+	a := models.GeoPoint{Latitude: 37.77, Longitude: -122.41}
+	b := models.GeoPoint{Latitude: 37.78, Longitude: -122.41} // ~1112 m north
+	w := &walker{path: []models.GeoPoint{a, b}, pos: a}
+	if w.advance(500) {
+		t.Fatal("advance(500) reached the end of a 1.1 km path")
+	}
+	if d := distanceMeters(a, w.pos); d < 499 || d > 501 {
+		t.Errorf("after 500 m, distance from start = %.1f m", d)
+	}
+	if !w.advance(1000) || w.pos != b {
+		t.Errorf("advance past the end: pos = %v; want %v", w.pos, b)
+	}
+}
+
+func TestRunDeliversAssignment(t *testing.T) {
+	pickup := models.GeoPoint{Latitude: 37.771, Longitude: -122.41}
+	dropoff := models.GeoPoint{Latitude: 37.775, Longitude: -122.41}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		tracks   []models.GeoPoint
+		statuses []models.MachineStatus
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /logistics/fleet/m1/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /logistics/fleet/m1/assignments", func(w http.ResponseWriter, r *http.Request) {
+		// The order stays assigned: the machine must not deliver it twice.
+		json.NewEncoder(w).Encode([]models.MachineAssignment{{OrderID: "o1", Pickup: &pickup, Dropoff: &dropoff}})
+	})
+	mux.HandleFunc("PUT /logistics/fleet/m1/status", func(w http.ResponseWriter, r *http.Request) {
+		var req models.MachineStatusUpdateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		statuses = append(statuses, req.Status)
+		if len(tracks) > 0 && req.Status == models.StatusIdle {
+			cancel()
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /logistics/orders/o1/track", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(apimiddleware.MachineKeyHeader) != "key-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req models.TrackingEventRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		tracks = append(tracks, models.GeoPoint{Latitude: req.Latitude, Longitude: req.Longitude})
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := Config{Server: srv.URL, Tick: 2 * time.Millisecond, Poll: time.Millisecond, Speedup: 20000}
+	start := models.GeoPoint{Latitude: 37.77, Longitude: -122.41}
+	Run(ctx, cfg, []Machine{{ID: "m1", APIKey: "key-1", Type: models.MachineTypeDrone, Position: start}})
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("simulator did not report IDLE after delivering: %v", ctx.Err())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 12 km/h × 2 ms ticks × 20000 ≈ 133 m per event over ~550 m.
+	if len(tracks) < 3 || len(tracks) > 8 {
+		t.Errorf("got %d tracking events; want one every ~133 m", len(tracks))
+	}
+	if last := tracks[len(tracks)-1]; last != dropoff {
+		t.Errorf("last tracking event at %v; want the dropoff %v", last, dropoff)
+	}
+	if statuses[0] != models.StatusIdle || statuses[len(statuses)-1] != models.StatusIdle {
+		t.Errorf("statuses = %v; want IDLE at start and after delivery", statuses)
+	}
+}
@@ -0,0 +1,46 @@
+package simulator
+
+import (
+	"math"
+
+	"dispatch-and-delivery/internal/models"
+)
+
+const earthRadiusMeters = 6371000.0
+
+// walker moves a position along a path at a fixed distance per step.
+type walker struct {
+	path []models.GeoPoint
+	next int // Index of the path point being travelled towards.
+	pos  models.GeoPoint
+}
+
+// advance moves up to meters along the path and reports whether the end
+// has been reached.
+func (w *walker) advance(meters float64) bool {
+	for w.next < len(w.path) {
+		target := w.path[w.next]
+		d := distanceMeters(w.pos, target)
+		if d > meters {
+			f := meters / d
+			w.pos = models.GeoPoint{
+				Latitude:  w.pos.Latitude + (target.Latitude-w.pos.Latitude)*f,
+				Longitude: w.pos.Longitude + (target.Longitude-w.pos.Longitude)*f,
+			}
+			return false
+		}
+		meters -= d
+		w.pos = target
+		w.next++
+	}
+	return true
+}
+
+// distanceMeters is the great-circle distance between a and b.
+func distanceMeters(a, b models.GeoPoint) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,62 @@
+// Package cache is a small key/value cache with expiry, used to avoid repeat
+// calls to paid external APIs (e.g. route quotes). Redis is shared by every
+// instance; Memory keeps entries in-process and backs Redis up when it is
+// unreachable or not configured.
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// Store is implemented by Redis, Memory and Fallback. A miss is (nil, false, nil).
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key until ttl elapses.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// Fallback reads and writes through Primary and switches to Secondary for any
+// call that fails, so a Redis outage degrades to a per-instance cache instead
+// of failing or slowing down requests.
+type Fallback struct {
+	Primary   Store
+	Secondary Store
+}
+
+// WithFallback returns a Store that uses secondary whenever primary fails.
+func WithFallback(primary, secondary Store) *Fallback {
+	return &Fallback{Primary: primary, Secondary: secondary}
+}
+
+// Get implements Store.
+func (f *Fallback) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, ok, err := f.Primary.Get(ctx, key)
+	if err == nil {
+		return v, ok, nil
+	}
+	logFallback("get", err)
+	return f.Secondary.Get(ctx, key)
+}
+
+// Set implements Store.
+func (f *Fallback) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := f.Primary.Set(ctx, key, value, ttl)
+	if err == nil {
+		return nil
+	}
+	logFallback("set", err)
+	return f.Secondary.Set(ctx, key, value, ttl)
+}
+
+// logFallback logs a primary failure, except while its breaker is open: the
+// failure that opened it has already been logged.
+func logFallback(op string, err error) {
+	if !errors.Is(err, resilience.ErrCircuitOpen) {
+		log.Printf("cache: primary %s failed, using fallback: %v", op, err)
+	}
+}
@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// Redis is a Store backed by a Redis server. It speaks just enough RESP2 for
+// GET and SET (plus AUTH and SELECT on connect) over a small connection pool.
+type Redis struct {
+	addr     string
+	tls      *tls.Config
+	username string
+	password string
+	db       int
+	prefix   string
+
+	idle    chan *redisConn
+	breaker *resilience.Executor
+}
+
+// NewRedis creates a Redis store from a URL of the form
+// redis://[user:password@]host[:port][/db] (rediss:// for TLS). Every key is
+// prefixed with prefix, so several applications can share one server.
+// Connections are opened lazily.
+func NewRedis(rawURL, prefix string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("cache: redis URL: %w", err)
+	}
+	r := &Redis{prefix: prefix, idle: make(chan *redisConn, 16)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		r.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("cache: unsupported redis scheme %q", u.Scheme)
+	}
+	r.addr = u.Host
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("cache: redis database %q: %w", db, err)
+		}
+	}
+	r.breaker = resilience.New(resilience.Policy{
+		Name:             "redis",
+		Timeout:          250 * time.Millisecond,
+		MaxAttempts:      1, // A slow cache is worse than a miss.
+		FailureThreshold: 5,
+		OpenDuration:     10 * time.Second,
+	})
+	return r, nil
+}
+
+// errNil is the RESP null bulk string, i.e. a GET miss.
+var errNil = errors.New("redis: nil")
+
+// Get implements Store.
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	var v []byte
+	err := r.breaker.Do(ctx, func(ctx context.Context) error {
+		var err error
+		v, err = r.do(ctx, "GET", r.prefix+key)
+		if errors.Is(err, errNil) {
+			v, err = nil, nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return v, v != nil, nil
+}
+
+// Set implements Store.
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return r.breaker.Do(ctx, func(ctx context.Context) error {
+		_, err := r.do(ctx, "SET", r.prefix+key, string(value), "PX", strconv.FormatInt(ms, 10))
+		return err
+	})
+}
+
+// do runs one command on a pooled connection. A connection that fails at the
+// network level is closed instead of returned to the pool.
+func (r *Redis) do(ctx context.Context, args ...string) ([]byte, error) {
+	c, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	} else {
+		c.conn.SetDeadline(time.Now().Add(time.Second))
+	}
+	v, err := c.do(args...)
+	var serverErr redisError
+	if err != nil && !errors.Is(err, errNil) && !errors.As(err, &serverErr) {
+		c.conn.Close()
+		return nil, err
+	}
+	select {
+	case r.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return v, err
+}
+
+func (r *Redis) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+	d := &net.Dialer{Timeout: time.Second, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if r.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: d, Config: r.tls}).DialContext(ctx, "tcp", r.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply (-ERR ...); the connection is still usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// maxBulkSize rejects absurd bulk lengths before allocating.
+const maxBulkSize = 16 << 20
+
+func (c *redisConn) do(args ...string) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		if n > maxBulkSize {
+			return nil, fmt.Errorf("redis: bulk reply of %d bytes is too large", n)
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a RESP2 server that understands AUTH, SELECT, GET and SET and
+// records every command it receives. Replies for keys in replies are sent
+// verbatim instead.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	dials    int
+	commands []string
+	values   map[string]string
+	replies  map[string]string // By key, e.g. "-ERR wrong type\r\n".
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &fakeRedis{ln: ln, values: map[string]string{}, replies: map[string]string{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.dials++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) url(userinfo, path string) string {
+	return "redis://" + userinfo + s.ln.Addr().String() + path
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+		reply := "+OK\r\n"
+		if len(args) > 1 {
+			if canned, ok := s.replies[args[1]]; ok {
+				reply = canned
+				args = nil
+			}
+		}
+		switch {
+		case len(args) == 0:
+		case args[0] == "GET":
+			if v, ok := s.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case args[0] == "SET":
+			s.values[args[1]] = args[2]
+		}
+		s.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads one RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("not an array: %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (s *fakeRedis) log() ([]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...), s.dials
+}
+
+func TestRedisGetSet(t *testing.T) {
+	ctx := context.Background()
+	srv := newFakeRedis(t)
+	r, err := NewRedis(srv.url("app:secret@", "/2"), "circuit:")
+	if err != nil {
+		t.Fatalf("NewRedis error: %v", err)
+	}
+
+	// Values go over the wire as bulk strings, so CRLF and binary data survive.
+	value := []byte("line1\r\nline2\x00")
+	if err := r.Set(ctx, "quote", value, 1500*time.Millisecond); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	got, ok, err := r.Get(ctx, "quote")
+	if err != nil || !ok || string(got) != string(value) {
+		t.Errorf("Get = %q, %v, %v; want %q", got, ok, err, value)
+	}
+	if got, ok, err := r.Get(ctx, "missing"); err != nil || ok || got != nil {
+		t.Errorf("Get of a missing key = %q, %v, %v; want a miss", got, ok, err)
+	}
+
+	commands, dials := srv.log()
+	want := []string{
+		"AUTH app secret",
+		"SELECT 2",
+		"SET circuit:quote " + string(value) + " PX 1500",
+		"GET circuit:quote",
+		"GET circuit:missing",
+	}
+	if strings.Join(commands, "|") != strings.Join(want, "|") {
+		t.Errorf("commands = %q; want %q", commands, want)
+	}
+	if dials != 1 {
+		t.Errorf("dialled %d connections; want 1 reused from the pool", dials)
+	}
+}
+
+func TestRedisPasswordOnlyAndDefaultDB(t *testing.T) {
+	srv := newFakeRedis(t)
+	r, err := NewRedis(srv.url(":secret@", ""), "")
+	if err != nil {
+		t.Fatalf("NewRedis error: %v", err)
+	}
+	// A sub-millisecond TTL is rounded up: PX 0 is an error in Redis.
+	if err := r.Set(context.Background(), "k", []byte("v"), time.Microsecond); err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	if commands, _ := srv.log(); strings.Join(commands, "|") != "AUTH secret|SET k v PX 1" {
+		t.Errorf("commands = %q; want AUTH with the password only, no SELECT and PX 1", commands)
+	}
+}
+
+func TestRedisReplies(t *testing.T) {
+	ctx := context.Background()
+	srv := newFakeRedis(t)
+	srv.replies["wrongtype"] = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	srv.replies["huge"] = fmt.Sprintf("$%d\r\n", maxBulkSize+1)
+	srv.replies["odd"] = "%3\r\n"
+	r, err := NewRedis(srv.url("", ""), "")
+	if err != nil {
+		t.Fatalf("NewRedis error: %v", err)
+	}
+
+	// An error reply fails the call but keeps the connection.
+	var serverErr redisError
+	if _, _, err := r.Get(ctx, "wrongtype"); !errors.As(err, &serverErr) || !strings.HasPrefix(string(serverErr), "WRONGTYPE") {
+		t.Errorf("Get error = %v; want the server's WRONGTYPE error", err)
+	}
+	if _, dials := srv.log(); dials != 1 {
+		t.Errorf("dialled %d connections after an error reply; want 1", dials)
+	}
+
+	// A reply that cannot be parsed drops the connection.
+	if _, _, err := r.Get(ctx, "huge"); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Get of an oversized bulk reply error = %v; want it rejected", err)
+	}
+	if _, _, err := r.Get(ctx, "odd"); err == nil || !strings.Contains(err.Error(), "unexpected reply") {
+		t.Errorf("Get of an unknown reply type error = %v; want unexpected reply", err)
+	}
+	if _, dials := srv.log(); dials != 2 {
+		t.Errorf("dialled %d connections; want a new one after the first bad reply", dials)
+	}
+}
+
+func TestNewRedisURL(t *testing.T) {
+	for _, tc := range []struct {
+		url, addr string
+		tls       bool
+		db        int
+	}{
+		{"redis://cache.internal", "cache.internal:6379", false, 0},
+		{"rediss://cache.internal:6380/3", "cache.internal:6380", true, 3},
+	} {
+		r, err := NewRedis(tc.url, "")
+		if err != nil {
+			t.Errorf("NewRedis(%q) error: %v", tc.url, err)
+			continue
+		}
+		if r.addr != tc.addr || (r.tls != nil) != tc.tls || r.db != tc.db {
+			t.Errorf("NewRedis(%q) = %s, TLS %v, db %d; want %s, TLS %v, db %d", tc.url, r.addr, r.tls != nil, r.db, tc.addr, tc.tls, tc.db)
+		}
+	}
+	for _, bad := range []string{"http://cache.internal", "redis://cache.internal/zero"} {
+		if _, err := NewRedis(bad, ""); err == nil {
+			t.Errorf("NewRedis(%q) accepted the URL", bad)
+		}
+	}
+}
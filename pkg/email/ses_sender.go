@@ -3,6 +3,9 @@ package email
 import (
 	"context"
 	"log"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -14,6 +17,7 @@ import (
 type SESV2Sender struct {
 	client    *sesv2.Client
 	fromEmail string
+	breaker   *resilience.Executor
 }
 
 type ServiceInterface interface {
@@ -31,6 +35,13 @@ func NewSESV2Sender(ctx context.Context, region, fromEmail string) (*SESV2Sender
 	return &SESV2Sender{
 		client:    sesv2.NewFromConfig(cfg),
 		fromEmail: fromEmail,
+		breaker: resilience.New(resilience.Policy{
+			Name:             "ses",
+			Timeout:          5 * time.Second,
+			MaxAttempts:      3,
+			FailureThreshold: 5,
+			OpenDuration:     time.Minute,
+		}),
 	}, nil
 }
 
@@ -61,7 +72,10 @@ func (s *SESV2Sender) SendEmail(ctx context.Context, to, subject, plainTextConte
 		},
 	}
 
-	_, err := s.client.SendEmail(ctx, input)
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		_, err := s.client.SendEmail(ctx, input)
+		return err
+	})
 	if err != nil {
 		log.Printf("Failed to send email via SES: %v", err)
 		return err
@@ -0,0 +1,52 @@
+// Package errreport ships panics and unexpected server errors to an external
+// error tracker, so crashes are noticed before users start complaining.
+package errreport
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Event describes a single failure together with the request it happened in.
+// Everything in an Event must already be free of PII; use PseudonymizeID and
+// ScrubMessage before putting identifiers or free text into it.
+type Event struct {
+	Err       error
+	Panic     bool
+	Stack     []byte
+	Method    string
+	Route     string // Route template (e.g. /orders/:orderId), never the raw URL
+	Status    int
+	RequestID string
+	Tags      map[string]string
+}
+
+// Reporter is implemented by every error tracking backend.
+type Reporter interface {
+	// Report sends the event asynchronously; it must never block the request.
+	Report(ctx context.Context, ev Event)
+	// Flush waits up to timeout for in-flight events to be delivered.
+	Flush(timeout time.Duration)
+}
+
+// LogReporter writes events to the standard logger. It is used in development
+// and whenever no error tracker DSN is configured.
+type LogReporter struct{}
+
+// NewLogReporter creates a reporter that only logs.
+func NewLogReporter() *LogReporter {
+	return &LogReporter{}
+}
+
+// Report logs the event on a single line, followed by the stack for panics.
+func (r *LogReporter) Report(ctx context.Context, ev Event) {
+	log.Printf("ERROR REPORT: %s %s status=%d request_id=%s tags=%v: %s",
+		ev.Method, ev.Route, ev.Status, ev.RequestID, ev.Tags, ScrubMessage(ev.Err.Error()))
+	if ev.Panic && len(ev.Stack) > 0 {
+		log.Printf("%s", ev.Stack)
+	}
+}
+
+// Flush is a no-op because logging is synchronous.
+func (r *LogReporter) Flush(timeout time.Duration) {}
@@ -0,0 +1,33 @@
+package errreport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	uuidPattern  = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	// Activation and password reset tokens are 32+ byte hex strings.
+	tokenPattern = regexp.MustCompile(`\b[0-9a-fA-F]{32,}\b`)
+)
+
+// PseudonymizeID replaces a user or order ID with a stable, non-reversible
+// token. Events about the same entity can still be grouped together, but the
+// tracker never stores the real identifier.
+func PseudonymizeID(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return "anon-" + hex.EncodeToString(sum[:6])
+}
+
+// ScrubMessage removes e-mail addresses, UUIDs and secret tokens from free text
+// such as wrapped error messages.
+func ScrubMessage(msg string) string {
+	msg = emailPattern.ReplaceAllString(msg, "[email]")
+	msg = uuidPattern.ReplaceAllString(msg, "[id]")
+	return tokenPattern.ReplaceAllString(msg, "[token]")
+}
@@ -0,0 +1,168 @@
+package errreport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SentryReporter delivers events to Sentry through its HTTP store API.
+// It intentionally implements only what we need (exception, tags, stack,
+// release and environment) instead of pulling in the full SDK.
+type SentryReporter struct {
+	storeURL    string
+	authHeader  string
+	environment string
+	release     string
+	httpClient  *http.Client
+	inFlight    sync.WaitGroup
+}
+
+// NewSentryReporter parses a Sentry DSN of the form
+// https://<public_key>@<host>/<project_id> and returns a reporter for it.
+func NewSentryReporter(dsn, environment, release string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry DSN: %w", err)
+	}
+	publicKey := u.User.Username()
+	projectID := strings.Trim(u.Path, "/")
+	if publicKey == "" || projectID == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid sentry DSN: expected scheme://key@host/project")
+	}
+
+	return &SentryReporter{
+		storeURL: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, projectID),
+		authHeader: fmt.Sprintf("Sentry sentry_version=7, sentry_client=circuit-errreport/1.0, sentry_key=%s",
+			publicKey),
+		environment: environment,
+		release:     release,
+		httpClient:  &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// sentryEvent is the subset of the Sentry event payload we populate.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Transaction string            `json:"transaction,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Report converts the event to a Sentry payload and sends it in the background.
+func (r *SentryReporter) Report(ctx context.Context, ev Event) {
+	payload := r.buildEvent(ev)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("errreport: failed to encode sentry event: %v", err)
+		return
+	}
+
+	r.inFlight.Add(1)
+	go func() {
+		defer r.inFlight.Done()
+		// Detached from the request context: the response has usually been
+		// written (and the context cancelled) by the time this runs.
+		if err := r.send(body); err != nil {
+			log.Printf("errreport: failed to deliver sentry event %s: %v", payload.EventID, err)
+		}
+	}()
+}
+
+func (r *SentryReporter) buildEvent(ev Event) *sentryEvent {
+	out := &sentryEvent{
+		EventID:     strings.ReplaceAll(uuid.NewString(), "-", ""),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Platform:    "go",
+		Level:       "error",
+		Logger:      "circuit-api",
+		Environment: r.environment,
+		Release:     r.release,
+		Transaction: strings.TrimSpace(ev.Method + " " + ev.Route),
+		Tags:        map[string]string{},
+		Extra:       map[string]interface{}{},
+	}
+	if ev.Panic {
+		out.Level = "fatal"
+	}
+	for k, v := range ev.Tags {
+		out.Tags[k] = v
+	}
+	if ev.RequestID != "" {
+		out.Tags["request_id"] = ev.RequestID
+	}
+	if ev.Status != 0 {
+		out.Tags["status"] = fmt.Sprintf("%d", ev.Status)
+	}
+	if len(ev.Stack) > 0 {
+		out.Extra["stack"] = ScrubMessage(string(ev.Stack))
+	}
+
+	errType := "panic"
+	if !ev.Panic {
+		errType = reflect.TypeOf(ev.Err).String()
+	}
+	out.Exception.Values = []sentryException{{
+		Type:  errType,
+		Value: ScrubMessage(ev.Err.Error()),
+	}}
+	return out
+}
+
+func (r *SentryReporter) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, r.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.authHeader)
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Flush blocks until all queued events are sent or the timeout elapses.
+// Call it during shutdown so the last crash reports are not lost.
+func (r *SentryReporter) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		r.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("errreport: flush timed out after %s", timeout)
+	}
+}
@@ -0,0 +1,93 @@
+package errreport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrubMessage(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"user jane.doe+x@example.com not found", "user [email] not found"},
+		{"order a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11: no rows", "order [id]: no rows"},
+		{"reset token 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 expired", "reset token [token] expired"},
+		// Short hex such as a status code or a pseudonym is kept.
+		{"status 500 for anon-0123456789ab", "status 500 for anon-0123456789ab"},
+	} {
+		if got := ScrubMessage(tc.in); got != tc.want {
+			t.Errorf("ScrubMessage(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+
+	id := PseudonymizeID("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11")
+	if !strings.HasPrefix(id, "anon-") || len(id) != 17 || id != PseudonymizeID("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11") {
+		t.Errorf("PseudonymizeID = %q; want a stable anon- token", id)
+	}
+	if PseudonymizeID("other") == id || PseudonymizeID("") != "" {
+		t.Error("PseudonymizeID gives different IDs the same token, or the empty ID one")
+	}
+}
+
+func TestNewSentryReporter(t *testing.T) {
+	for _, dsn := range []string{"", "https://sentry.example.com/42", "https://key@sentry.example.com/", "%"} {
+		if _, err := NewSentryReporter(dsn, "test", ""); err == nil {
+			t.Errorf("NewSentryReporter accepted DSN %q", dsn)
+		}
+	}
+}
+
+func TestSentryReport(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	var event sentryEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		got <- r
+	}))
+	defer srv.Close()
+	r, err := NewSentryReporter(strings.Replace(srv.URL, "://", "://pubkey@", 1)+"/42", "staging", "v1.2.3")
+	if err != nil {
+		t.Fatalf("NewSentryReporter error: %v", err)
+	}
+
+	r.Report(context.Background(), Event{
+		Err:       errors.New("panic recovered: send to jane@example.com failed"),
+		Panic:     true,
+		Stack:     []byte("goroutine 1 [running]:\norder a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"),
+		Method:    http.MethodPost,
+		Route:     "/orders/:orderId/confirm",
+		Status:    http.StatusInternalServerError,
+		RequestID: "req-1",
+		Tags:      map[string]string{"user_id": PseudonymizeID("u1")},
+	})
+	r.Flush(5 * time.Second)
+
+	var req *http.Request
+	select {
+	case req = <-got:
+	default:
+		t.Fatal("the event was not sent before Flush returned")
+	}
+	if req.URL.Path != "/api/42/store/" || !strings.Contains(req.Header.Get("X-Sentry-Auth"), "sentry_key=pubkey") {
+		t.Errorf("sent to %s with auth %q; want the project's store API with the DSN key", req.URL.Path, req.Header.Get("X-Sentry-Auth"))
+	}
+	if event.Level != "fatal" || event.Environment != "staging" || event.Release != "v1.2.3" || event.Transaction != "POST /orders/:orderId/confirm" {
+		t.Errorf("event = %+v; want a fatal staging v1.2.3 event for POST /orders/:orderId/confirm", event)
+	}
+	if event.Tags["request_id"] != "req-1" || event.Tags["status"] != "500" || event.Tags["user_id"] != PseudonymizeID("u1") {
+		t.Errorf("tags = %v; want the request ID, status and pseudonymized user", event.Tags)
+	}
+	// Personal data is scrubbed from the message and the stack.
+	if len(event.Exception.Values) != 1 || event.Exception.Values[0].Value != "panic recovered: send to [email] failed" {
+		t.Errorf("exception = %+v; want the scrubbed message", event.Exception.Values)
+	}
+	if stack, _ := event.Extra["stack"].(string); strings.Contains(stack, "a0eebc99") || !strings.Contains(stack, "order [id]") {
+		t.Errorf("stack = %q; want the order ID scrubbed", stack)
+	}
+}
@@ -0,0 +1,113 @@
+package maps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// GoogleDirectionsURL is the default Google Directions API endpoint.
+const GoogleDirectionsURL = "https://maps.googleapis.com/maps/api/directions/json"
+
+// Google routes through the legacy Google Directions API, which geocodes
+// street addresses itself. It has no two-wheeler profile, so ModeTwoWheeler
+// is routed as driving. New deployments should use GoogleRoutes.
+type Google struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewGoogle creates a Google provider. baseURL (e.g. an httptest server or a
+// proxy) and client are optional.
+func NewGoogle(apiKey, baseURL string, client *http.Client) *Google {
+	if baseURL == "" {
+		baseURL = GoogleDirectionsURL
+	}
+	return &Google{apiKey: apiKey, baseURL: baseURL, httpClient: clientOrDefault(client)}
+}
+
+// Name implements RoutingProvider.
+func (g *Google) Name() string { return "google_maps" }
+
+// Route implements RoutingProvider. Addresses are preferred over coordinates
+// so the route starts at the building entrance Google resolves.
+func (g *Google) Route(ctx context.Context, origin, destination Place, mode TravelMode, waypoints ...Place) (*Route, error) {
+	params := url.Values{}
+	params.Set("origin", googlePlace(origin))
+	params.Set("destination", googlePlace(destination))
+	if len(waypoints) > 0 {
+		stops := make([]string, len(waypoints))
+		for i, w := range waypoints {
+			stops[i] = googlePlace(w)
+		}
+		params.Set("waypoints", strings.Join(stops, "|"))
+	}
+	if mode == ModeWalk {
+		params.Set("mode", "walking")
+	}
+	params.Set("key", g.apiKey)
+
+	var out struct {
+		Status       string `json:"status"`
+		ErrorMessage string `json:"error_message"`
+		Routes       []struct {
+			OverviewPolyline struct{ Points string } `json:"overview_polyline"`
+			Legs             []struct {
+				Distance struct{ Value int } `json:"distance"`
+				Duration struct{ Value int } `json:"duration"`
+				Steps    []struct {
+					Polyline struct{ Points string } `json:"polyline"`
+				} `json:"steps"`
+			} `json:"legs"`
+		} `json:"routes"`
+	}
+	if err := getJSON(ctx, g.httpClient, "maps API", g.baseURL+"?"+params.Encode(), &out); err != nil {
+		return nil, err
+	}
+	// Business errors also come back as 200; check the status field.
+	switch out.Status {
+	case "OK", "":
+	case "OVER_QUERY_LIMIT", "UNKNOWN_ERROR":
+		return nil, fmt.Errorf("maps API status %s: %s", out.Status, out.ErrorMessage)
+	default: // ZERO_RESULTS, NOT_FOUND, INVALID_REQUEST, REQUEST_DENIED: retrying will not help.
+		return nil, resilience.Permanent(fmt.Errorf("maps API status %s: %s", out.Status, out.ErrorMessage))
+	}
+	if len(out.Routes) == 0 || len(out.Routes[0].Legs) == 0 {
+		return nil, resilience.Permanent(errors.New("no route data"))
+	}
+	// Directions has no per-leg geometry; legs are built from their steps.
+	route := &Route{Polyline: out.Routes[0].OverviewPolyline.Points}
+	for _, leg := range out.Routes[0].Legs {
+		steps := make([]string, len(leg.Steps))
+		for i, step := range leg.Steps {
+			steps[i] = step.Polyline.Points
+		}
+		polyline, err := joinPolylines(steps)
+		if err != nil {
+			return nil, resilience.Permanent(fmt.Errorf("maps API: leg geometry: %w", err))
+		}
+		route.DistanceMeters += leg.Distance.Value
+		route.DurationSeconds += leg.Duration.Value
+		route.Legs = append(route.Legs, Leg{
+			DistanceMeters:  leg.Distance.Value,
+			DurationSeconds: leg.Duration.Value,
+			Polyline:        polyline,
+		})
+	}
+	return route, nil
+}
+
+// googlePlace formats a place as a Directions API origin or destination.
+func googlePlace(p Place) string {
+	if p.Address != "" || p.Point == nil {
+		return p.Address
+	}
+	return strconv.FormatFloat(p.Point.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(p.Point.Lng, 'f', -1, 64)
+}
@@ -0,0 +1,153 @@
+package maps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// GoogleRoutesURL is the default Google Routes API computeRoutes endpoint.
+const GoogleRoutesURL = "https://routes.googleapis.com/directions/v2:computeRoutes"
+
+// googleRoutesFieldMask limits the response to the fields Route reads; the
+// Routes API rejects requests without a field mask.
+const googleRoutesFieldMask = "routes.distanceMeters,routes.duration,routes.polyline.encodedPolyline," +
+	"routes.legs.distanceMeters,routes.legs.duration,routes.legs.polyline.encodedPolyline"
+
+// GoogleRoutes routes through the Google Routes API (v2). Driving and
+// two-wheeler routes are traffic-aware; walking routes cannot be.
+type GoogleRoutes struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewGoogleRoutes creates a Routes API provider. baseURL and client are optional.
+func NewGoogleRoutes(apiKey, baseURL string, client *http.Client) *GoogleRoutes {
+	if baseURL == "" {
+		baseURL = GoogleRoutesURL
+	}
+	return &GoogleRoutes{apiKey: apiKey, baseURL: baseURL, httpClient: clientOrDefault(client)}
+}
+
+// Name implements RoutingProvider.
+func (g *GoogleRoutes) Name() string { return "google_routes" }
+
+type routesWaypoint struct {
+	Address  string          `json:"address,omitempty"`
+	Location *routesLocation `json:"location,omitempty"`
+}
+
+type routesLocation struct {
+	LatLng struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	} `json:"latLng"`
+}
+
+// Route implements RoutingProvider.
+func (g *GoogleRoutes) Route(ctx context.Context, origin, destination Place, mode TravelMode, waypoints ...Place) (*Route, error) {
+	body := struct {
+		Origin            routesWaypoint   `json:"origin"`
+		Destination       routesWaypoint   `json:"destination"`
+		Intermediates     []routesWaypoint `json:"intermediates,omitempty"`
+		TravelMode        TravelMode       `json:"travelMode"`
+		RoutingPreference string           `json:"routingPreference,omitempty"`
+	}{
+		Origin:      routesPlace(origin),
+		Destination: routesPlace(destination),
+		TravelMode:  mode,
+	}
+	for _, w := range waypoints {
+		body.Intermediates = append(body.Intermediates, routesPlace(w))
+	}
+	if mode == "" {
+		body.TravelMode = ModeDrive
+	}
+	if body.TravelMode != ModeWalk {
+		body.RoutingPreference = "TRAFFIC_AWARE"
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Api-Key", g.apiKey)
+	req.Header.Set("X-Goog-FieldMask", googleRoutesFieldMask)
+
+	var out struct {
+		Routes []struct {
+			routesSection
+			Legs []routesSection `json:"legs"`
+		} `json:"routes"`
+	}
+	if err := doJSON(g.httpClient, "routes API", req, &out); err != nil {
+		return nil, err
+	}
+	// No route comes back as 200 with an empty body.
+	if len(out.Routes) == 0 {
+		return nil, resilience.Permanent(errors.New("no route data"))
+	}
+	r := out.Routes[0]
+	total, err := r.leg()
+	if err != nil {
+		return nil, err
+	}
+	route := &Route{
+		DistanceMeters:  total.DistanceMeters,
+		DurationSeconds: total.DurationSeconds,
+		Polyline:        total.Polyline,
+	}
+	for _, l := range r.Legs {
+		leg, err := l.leg()
+		if err != nil {
+			return nil, err
+		}
+		route.Legs = append(route.Legs, leg)
+	}
+	return route, nil
+}
+
+// routesSection is the part of a Routes API route or leg that Route reads.
+type routesSection struct {
+	DistanceMeters int    `json:"distanceMeters"`
+	Duration       string `json:"duration"` // e.g. "165s"
+	Polyline       struct {
+		EncodedPolyline string `json:"encodedPolyline"`
+	} `json:"polyline"`
+}
+
+func (s routesSection) leg() (Leg, error) {
+	d, err := time.ParseDuration(s.Duration)
+	if err != nil {
+		return Leg{}, fmt.Errorf("routes API: duration %q: %w", s.Duration, err)
+	}
+	return Leg{
+		DistanceMeters:  s.DistanceMeters,
+		DurationSeconds: int(math.Round(d.Seconds())),
+		Polyline:        s.Polyline.EncodedPolyline,
+	}, nil
+}
+
+// routesPlace prefers coordinates: the Routes API geocodes addresses too,
+// but a known point skips that step.
+func routesPlace(p Place) routesWaypoint {
+	if p.Point == nil {
+		return routesWaypoint{Address: p.Address}
+	}
+	loc := &routesLocation{}
+	loc.LatLng.Latitude = p.Point.Lat
+	loc.LatLng.Longitude = p.Point.Lng
+	return routesWaypoint{Location: loc}
+}
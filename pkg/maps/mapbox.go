@@ -0,0 +1,112 @@
+package maps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// MapboxBaseURL is the default Mapbox API host.
+const MapboxBaseURL = "https://api.mapbox.com"
+
+// Mapbox routes through the Mapbox Directions API. Places without coordinates
+// are geocoded first with the Mapbox Geocoding API. Mapbox has no two-wheeler
+// profile, so ModeTwoWheeler is routed as driving.
+type Mapbox struct {
+	accessToken string
+	baseURL     string
+	httpClient  *http.Client
+}
+
+// NewMapbox creates a Mapbox provider. baseURL and client are optional.
+func NewMapbox(accessToken, baseURL string, client *http.Client) *Mapbox {
+	if baseURL == "" {
+		baseURL = MapboxBaseURL
+	}
+	return &Mapbox{accessToken: accessToken, baseURL: strings.TrimRight(baseURL, "/"), httpClient: clientOrDefault(client)}
+}
+
+// Name implements RoutingProvider.
+func (m *Mapbox) Name() string { return "mapbox" }
+
+// Route implements RoutingProvider.
+func (m *Mapbox) Route(ctx context.Context, origin, destination Place, mode TravelMode, waypoints ...Place) (*Route, error) {
+	stops := make([]LatLng, 0, len(waypoints)+2)
+	for _, p := range append(append([]Place{origin}, waypoints...), destination) {
+		pt, err := m.locate(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		stops = append(stops, pt)
+	}
+	params := url.Values{}
+	params.Set("access_token", m.accessToken)
+	params.Set("geometries", "polyline")
+	params.Set("overview", "full")
+	params.Set("steps", "true")
+	profile := "driving"
+	if mode == ModeWalk {
+		profile = "walking"
+	}
+	u := m.baseURL + "/directions/v5/mapbox/" + profile + "/" + lngLatPath(stops...) + "?" + params.Encode()
+
+	var out struct {
+		Code    string      `json:"code"`
+		Message string      `json:"message"`
+		Routes  []osrmRoute `json:"routes"`
+	}
+	if err := getJSON(ctx, m.httpClient, "mapbox", u, &out); err != nil {
+		return nil, err
+	}
+	if out.Code != "Ok" {
+		return nil, resilience.Permanent(fmt.Errorf("mapbox directions %s: %s", out.Code, out.Message))
+	}
+	if len(out.Routes) == 0 {
+		return nil, resilience.Permanent(errors.New("no route data"))
+	}
+	return out.Routes[0].route("mapbox directions")
+}
+
+// locate returns the coordinates of p, geocoding its address when needed.
+func (m *Mapbox) locate(ctx context.Context, p Place) (LatLng, error) {
+	if p.Point != nil {
+		return *p.Point, nil
+	}
+	if p.Address == "" {
+		return LatLng{}, resilience.Permanent(ErrNoCoordinates)
+	}
+	params := url.Values{}
+	params.Set("access_token", m.accessToken)
+	params.Set("limit", "1")
+	u := m.baseURL + "/geocoding/v5/mapbox.places/" + url.PathEscape(p.Address) + ".json?" + params.Encode()
+
+	var out struct {
+		Features []struct {
+			Center []float64 `json:"center"` // [lng, lat]
+		} `json:"features"`
+	}
+	if err := getJSON(ctx, m.httpClient, "mapbox geocoding", u, &out); err != nil {
+		return LatLng{}, err
+	}
+	if len(out.Features) == 0 || len(out.Features[0].Center) != 2 {
+		return LatLng{}, resilience.Permanent(fmt.Errorf("mapbox geocoding: no match for %q", p.Address))
+	}
+	c := out.Features[0].Center
+	return LatLng{Lat: c[1], Lng: c[0]}, nil
+}
+
+// lngLatPath formats coordinates as "lng,lat;lng,lat", the waypoint syntax
+// shared by Mapbox and OSRM.
+func lngLatPath(points ...LatLng) string {
+	parts := make([]string, len(points))
+	for i, p := range points {
+		parts[i] = strconv.FormatFloat(p.Lng, 'f', -1, 64) + "," + strconv.FormatFloat(p.Lat, 'f', -1, 64)
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,134 @@
+package maps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// permanent reports whether err is marked resilience.Permanent, i.e. whether
+// an Executor gives up on it without retrying.
+func permanent(err error) bool {
+	calls := 0
+	p := resilience.Policy{Name: "maps_test", MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	resilience.New(p).Do(context.Background(), func(context.Context) error {
+		calls++
+		return err
+	})
+	return calls == 1
+}
+
+// mapboxRoute is a Directions response with one route of one leg made of
+// the given step geometries.
+func mapboxRoute(steps ...string) string {
+	quoted := make([]string, len(steps))
+	for i, s := range steps {
+		quoted[i] = fmt.Sprintf(`{"geometry":%q}`, s)
+	}
+	return fmt.Sprintf(`{"code":"Ok","routes":[{"distance":1234.4,"duration":300.6,"geometry":"overview",
+		"legs":[{"distance":1234.4,"duration":300.6,"steps":[%s]}]}]}`, strings.Join(quoted, ","))
+}
+
+func TestMapboxRoute(t *testing.T) {
+	first := encodePolyline([][2]int{{3777000, -12241000}, {3778000, -12240000}})
+	second := encodePolyline([][2]int{{3778000, -12240000}, {3779000, -12239000}})
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if got := r.URL.Query().Get("access_token"); got != "tok" {
+			t.Errorf("%s access_token = %q; want tok", r.URL.Path, got)
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/geocoding/"):
+			fmt.Fprint(w, `{"features":[{"center":[-122.41,37.77]}]}`)
+		case strings.HasPrefix(r.URL.Path, "/directions/"):
+			if q := r.URL.Query(); q.Get("geometries") != "polyline" || q.Get("steps") != "true" || q.Get("overview") != "full" {
+				t.Errorf("directions query = %s; want full polyline overview with steps", r.URL.RawQuery)
+			}
+			fmt.Fprint(w, mapboxRoute(first, second))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	m := NewMapbox("tok", srv.URL+"/", srv.Client())
+
+	// The address is geocoded first; coordinates go in as lng,lat.
+	dest := LatLng{Lat: 37.79, Lng: -122.39}
+	route, err := m.Route(context.Background(), Place{Address: "1 Main St"}, Place{Point: &dest}, ModeDrive)
+	if err != nil {
+		t.Fatalf("Route error: %v", err)
+	}
+	want := []string{"/geocoding/v5/mapbox.places/1 Main St.json", "/directions/v5/mapbox/driving/-122.41,37.77;-122.39,37.79"}
+	if strings.Join(paths, "|") != strings.Join(want, "|") {
+		t.Errorf("requested %q; want %q", paths, want)
+	}
+	if route.DistanceMeters != 1234 || route.DurationSeconds != 301 || route.Polyline != "overview" {
+		t.Errorf("route = %d m, %d s, %q; want 1234 m, 301 s and the overview", route.DistanceMeters, route.DurationSeconds, route.Polyline)
+	}
+	// The leg's polyline joins its steps without repeating the shared point.
+	joined := encodePolyline([][2]int{{3777000, -12241000}, {3778000, -12240000}, {3779000, -12239000}})
+	if len(route.Legs) != 1 || route.Legs[0].Polyline != joined || route.Legs[0].DistanceMeters != 1234 {
+		t.Errorf("legs = %+v; want one 1234 m leg with the steps joined", route.Legs)
+	}
+
+	paths = nil
+	if _, err := m.Route(context.Background(), Place{Point: &dest}, Place{Point: &dest}, ModeWalk); err != nil {
+		t.Fatalf("walking Route error: %v", err)
+	}
+	if len(paths) != 1 || !strings.HasPrefix(paths[0], "/directions/v5/mapbox/walking/") {
+		t.Errorf("walking route requested %q; want the walking profile only", paths)
+	}
+}
+
+func TestMapboxErrors(t *testing.T) {
+	here := LatLng{Lat: 37.77, Lng: -122.41}
+	at := Place{Point: &here}
+	for _, tc := range []struct {
+		name      string
+		status    int
+		body      string
+		origin    Place
+		want      string
+		permanent bool
+	}{
+		{"bad token", http.StatusUnauthorized, `{"message":"Not Authorized"}`, at, "status 401", true},
+		{"rate limited", http.StatusTooManyRequests, `{}`, at, "status 429", false},
+		{"server error", http.StatusBadGateway, ``, at, "status 502", false},
+		{"malformed body", http.StatusOK, `{"code":`, at, "decode response", false},
+		{"no route", http.StatusOK, `{"code":"NoRoute","message":"No route found"}`, at, "NoRoute: No route found", true},
+		{"empty routes", http.StatusOK, `{"code":"Ok","routes":[]}`, at, "no route data", true},
+		{"bad step geometry", http.StatusOK, mapboxRoute("?"), at, "leg geometry", true},
+		{"unknown address", http.StatusOK, `{"features":[]}`, Place{Address: "nowhere"}, `no match for "nowhere"`, true},
+		{"no address or coordinates", http.StatusOK, ``, Place{}, ErrNoCoordinates.Error(), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer srv.Close()
+			_, err := NewMapbox("tok", srv.URL, srv.Client()).Route(context.Background(), tc.origin, at, ModeDrive)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("Route error = %v; want one containing %q", err, tc.want)
+			}
+			if permanent(err) != tc.permanent {
+				t.Errorf("permanent = %v; want %v", !tc.permanent, tc.permanent)
+			}
+		})
+	}
+
+	// A cancelled request fails with the context's error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewMapbox("tok", "http://127.0.0.1:1", nil).Route(ctx, at, at, ModeDrive); !errors.Is(err, context.Canceled) {
+		t.Errorf("Route with a cancelled context error = %v; want context.Canceled", err)
+	}
+}
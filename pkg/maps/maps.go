@@ -0,0 +1,133 @@
+// Package maps computes routes behind a small RoutingProvider interface, with
+// implementations for the Google Routes API (v2), the legacy Google Directions
+// API, the Mapbox Directions API and a self-hosted OSRM server (for regions
+// Google does not cover). Retries and circuit breaking are left to the caller.
+package maps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// ErrNoCoordinates is returned by providers that cannot geocode (OSRM) when a
+// place has only a street address.
+var ErrNoCoordinates = errors.New("maps: place has no coordinates")
+
+// RoutingProvider is implemented by GoogleRoutes, Google, Mapbox and OSRM.
+type RoutingProvider interface {
+	// Name identifies the provider in errors and metrics (e.g. "google_maps").
+	Name() string
+	// Route returns the route from origin to destination for mode, stopping at
+	// each waypoint in order. Errors that retrying cannot fix (bad request, no
+	// route) are marked resilience.Permanent.
+	Route(ctx context.Context, origin, destination Place, mode TravelMode, waypoints ...Place) (*Route, error)
+}
+
+// TravelMode selects the routing profile. Providers without a matching
+// profile fall back to the closest one they have (see each provider).
+type TravelMode string
+
+const (
+	ModeDrive      TravelMode = "DRIVE"
+	ModeTwoWheeler TravelMode = "TWO_WHEELER"
+	ModeWalk       TravelMode = "WALK"
+)
+
+// LatLng is a WGS84 coordinate.
+type LatLng struct {
+	Lat float64
+	Lng float64
+}
+
+// Place is a route endpoint: a street address, its coordinates when known, or both.
+type Place struct {
+	Address string
+	Point   *LatLng
+}
+
+// Route is the first route returned by a provider.
+type Route struct {
+	DistanceMeters  int
+	DurationSeconds int
+	// Polyline is the route geometry as an encoded polyline with 1e-5 precision.
+	Polyline string
+	// Legs splits the route at its waypoints: one leg per stop-to-stop
+	// segment, in order, so a route without waypoints has a single leg.
+	Legs []Leg
+}
+
+// Leg is the part of a route between two consecutive stops.
+type Leg struct {
+	DistanceMeters  int
+	DurationSeconds int
+	Polyline        string
+}
+
+// defaultHTTPClient is shared by every provider built without a client: it
+// keeps connections alive so quoting peaks do not redo a TLS handshake per
+// request. Per-attempt timeouts belong to the caller; Timeout is a backstop.
+var defaultHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   2 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   3 * time.Second,
+		ResponseHeaderTimeout: 3 * time.Second,
+	},
+}
+
+func clientOrDefault(c *http.Client) *http.Client {
+	if c == nil {
+		return defaultHTTPClient
+	}
+	return c
+}
+
+// getJSON sends a GET request and decodes the JSON body into out.
+func getJSON(ctx context.Context, client *http.Client, name, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	return doJSON(client, name, req, out)
+}
+
+// doJSON sends req and decodes the JSON body into out. 4xx responses other
+// than 429 are permanent errors.
+func doJSON(client *http.Client, name string, req *http.Request, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Drain what is left so the connection goes back to the pool.
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s returned status %d", name, resp.StatusCode)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return resilience.Permanent(err)
+		}
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s: decode response: %w", name, err)
+	}
+	return nil
+}
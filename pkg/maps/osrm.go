@@ -0,0 +1,104 @@
+package maps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// OSRM routes through a self-hosted OSRM server (osrm-routed). OSRM has no
+// geocoder, so both places must carry coordinates. osrm-routed serves the one
+// profile its data was built with; the mode only picks the URL label, so run
+// a server per profile if walking routes must differ from driving ones.
+type OSRM struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewOSRM creates an OSRM provider for the server at baseURL, e.g.
+// "http://osrm:5000". client is optional.
+func NewOSRM(baseURL string, client *http.Client) (*OSRM, error) {
+	if baseURL == "" {
+		return nil, errors.New("maps: OSRM URL is required")
+	}
+	return &OSRM{baseURL: strings.TrimRight(baseURL, "/"), httpClient: clientOrDefault(client)}, nil
+}
+
+// Name implements RoutingProvider.
+func (o *OSRM) Name() string { return "osrm" }
+
+// Route implements RoutingProvider.
+func (o *OSRM) Route(ctx context.Context, origin, destination Place, mode TravelMode, waypoints ...Place) (*Route, error) {
+	stops := make([]LatLng, 0, len(waypoints)+2)
+	for _, p := range append(append([]Place{origin}, waypoints...), destination) {
+		if p.Point == nil {
+			return nil, resilience.Permanent(ErrNoCoordinates)
+		}
+		stops = append(stops, *p.Point)
+	}
+	profile := "driving"
+	if mode == ModeWalk {
+		profile = "foot"
+	}
+	u := o.baseURL + "/route/v1/" + profile + "/" + lngLatPath(stops...) + "?overview=full&geometries=polyline&steps=true"
+
+	var out struct {
+		Code    string      `json:"code"`
+		Message string      `json:"message"`
+		Routes  []osrmRoute `json:"routes"`
+	}
+	if err := getJSON(ctx, o.httpClient, "osrm", u, &out); err != nil {
+		return nil, err
+	}
+	if out.Code != "Ok" {
+		return nil, resilience.Permanent(fmt.Errorf("osrm %s: %s", out.Code, out.Message))
+	}
+	if len(out.Routes) == 0 {
+		return nil, resilience.Permanent(errors.New("no route data"))
+	}
+	return out.Routes[0].route("osrm")
+}
+
+// osrmRoute is a route in the OSRM response format, which the Mapbox
+// Directions API shares. Legs carry geometry only per step (steps=true).
+type osrmRoute struct {
+	Distance float64 `json:"distance"`
+	Duration float64 `json:"duration"`
+	Geometry string  `json:"geometry"`
+	Legs     []struct {
+		Distance float64 `json:"distance"`
+		Duration float64 `json:"duration"`
+		Steps    []struct {
+			Geometry string `json:"geometry"`
+		} `json:"steps"`
+	} `json:"legs"`
+}
+
+func (r osrmRoute) route(name string) (*Route, error) {
+	route := &Route{
+		DistanceMeters:  int(math.Round(r.Distance)),
+		DurationSeconds: int(math.Round(r.Duration)),
+		Polyline:        r.Geometry,
+	}
+	for _, leg := range r.Legs {
+		steps := make([]string, len(leg.Steps))
+		for i, step := range leg.Steps {
+			steps[i] = step.Geometry
+		}
+		polyline, err := joinPolylines(steps)
+		if err != nil {
+			return nil, resilience.Permanent(fmt.Errorf("%s: leg geometry: %w", name, err))
+		}
+		route.Legs = append(route.Legs, Leg{
+			DistanceMeters:  int(math.Round(leg.Distance)),
+			DurationSeconds: int(math.Round(leg.Duration)),
+			Polyline:        polyline,
+		})
+	}
+	return route, nil
+}
@@ -0,0 +1,82 @@
+package maps
+
+import (
+	"errors"
+	"strings"
+)
+
+// errBadPolyline is returned for a polyline cut off in the middle of a value.
+var errBadPolyline = errors.New("maps: malformed encoded polyline")
+
+// joinPolylines concatenates encoded polylines (1e-5 precision) into one,
+// dropping the point each part repeats from the end of the previous one.
+// Providers that only return geometry per step use it to build leg polylines.
+func joinPolylines(parts []string) (string, error) {
+	var points [][2]int
+	for _, p := range parts {
+		decoded, err := decodePolyline(p)
+		if err != nil {
+			return "", err
+		}
+		if len(points) > 0 && len(decoded) > 0 && decoded[0] == points[len(points)-1] {
+			decoded = decoded[1:]
+		}
+		points = append(points, decoded...)
+	}
+	return encodePolyline(points), nil
+}
+
+// decodePolyline returns the points of an encoded polyline as (lat, lng)
+// pairs in units of 1e-5 degrees.
+func decodePolyline(encoded string) ([][2]int, error) {
+	var points [][2]int
+	var cur [2]int
+	for i := 0; i < len(encoded); {
+		for k := range cur {
+			result, shift := 0, 0
+			for {
+				if i >= len(encoded) {
+					return nil, errBadPolyline
+				}
+				b := int(encoded[i]) - 63
+				i++
+				if b < 0 || b > 63 {
+					return nil, errBadPolyline
+				}
+				result |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if result&1 != 0 {
+				cur[k] += ^(result >> 1)
+			} else {
+				cur[k] += result >> 1
+			}
+		}
+		points = append(points, cur)
+	}
+	return points, nil
+}
+
+// encodePolyline is the inverse of decodePolyline.
+func encodePolyline(points [][2]int) string {
+	var b strings.Builder
+	var prev [2]int
+	for _, p := range points {
+		for k := range p {
+			v := (p[k] - prev[k]) << 1
+			if p[k]-prev[k] < 0 {
+				v = ^v
+			}
+			for v >= 0x20 {
+				b.WriteByte(byte((0x20 | (v & 0x1f)) + 63))
+				v >>= 5
+			}
+			b.WriteByte(byte(v + 63))
+		}
+		prev = p
+	}
+	return b.String()
+}
@@ -0,0 +1,429 @@
+// Package mqtt is a minimal MQTT 3.1.1 client: it connects to a broker,
+// subscribes to topic filters at QoS 0 or 1 and hands each PUBLISH to a
+// callback, or publishes single messages. It covers what telemetry ingestion
+// and machine commands need and nothing more; there is no QoS 2, no will
+// message and no in-flight persistence. Callers own reconnection (see
+// Subscribe) and retries (see Publish).
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Config describes the broker connection.
+type Config struct {
+	// BrokerURL is tcp://host:1883 (also mqtt://) or ssl://host:8883 (also
+	// tls://, mqtts://).
+	BrokerURL string
+	// ClientID must be unique per connection; brokers drop the older session
+	// when a second client connects with the same ID.
+	ClientID string
+	Username string
+	Password string
+	// KeepAlive is the ping interval; the connection is considered dead after
+	// 1.5x without any packet from the broker. Defaults to 30s.
+	KeepAlive time.Duration
+	// CleanSession discards the broker-side session on connect. Leave it false
+	// so QoS 1 messages published while disconnected are delivered on reconnect.
+	CleanSession bool
+	// DialTimeout bounds the TCP/TLS dial and the CONNECT/CONNACK exchange.
+	// Defaults to 10s.
+	DialTimeout time.Duration
+}
+
+// Message is one PUBLISH received from the broker.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Handler processes a message. QoS 1 messages are acknowledged after it
+// returns, so delivery is at-least-once: handlers must tolerate duplicates.
+type Handler func(Message)
+
+// Packet types (high nibble of the fixed header).
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePuback     = 4
+	typeSubscribe  = 8
+	typeSuback     = 9
+	typePingreq    = 12
+	typePingresp   = 13
+	typeDisconnect = 14
+)
+
+// maxPacketSize rejects absurd remaining lengths before allocating.
+const maxPacketSize = 1 << 20
+
+// ConnectError is a non-zero CONNACK return code.
+type ConnectError byte
+
+func (e ConnectError) Error() string {
+	switch e {
+	case 1:
+		return "mqtt: connection refused: unacceptable protocol version"
+	case 2:
+		return "mqtt: connection refused: identifier rejected"
+	case 3:
+		return "mqtt: connection refused: server unavailable"
+	case 4:
+		return "mqtt: connection refused: bad user name or password"
+	case 5:
+		return "mqtt: connection refused: not authorized"
+	}
+	return fmt.Sprintf("mqtt: connection refused: code %d", byte(e))
+}
+
+// Subscribe connects, subscribes to filters at qos (0 or 1) and calls h for
+// every message until ctx is cancelled or the connection fails. It always
+// returns a non-nil error: ctx.Err() after a clean shutdown, otherwise the
+// failure. Messages are handled one at a time, in order.
+func Subscribe(ctx context.Context, cfg Config, filters []string, qos byte, h Handler) error {
+	if len(filters) == 0 {
+		return errors.New("mqtt: no topic filters")
+	}
+	if qos > 1 {
+		return errors.New("mqtt: only QoS 0 and 1 are supported")
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 30 * time.Second
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+
+	conn, err := dial(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	c := &client{conn: conn, r: bufio.NewReader(conn)}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(cfg.DialTimeout))
+	if err := c.connect(cfg); err != nil {
+		return err
+	}
+	if err := c.subscribe(filters, qos); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Cancelling ctx unblocks the read loop by closing the connection.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(cfg.KeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				c.write(typeDisconnect<<4, nil)
+				conn.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := c.write(typePingreq<<4, nil); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	err = c.readLoop(cfg.KeepAlive*3/2, len(filters), h)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// publishPacketID identifies the single PUBLISH sent by Publish.
+const publishPacketID = 1
+
+// Publish connects, publishes payload to topic at qos (0 or 1) and
+// disconnects. At QoS 1 it returns once the broker has acknowledged the
+// message with PUBACK. Every call opens a new connection, so it suits
+// occasional messages; cfg.ClientID must differ from any subscriber's, or the
+// broker drops the subscriber when Publish connects.
+func Publish(ctx context.Context, cfg Config, topic string, payload []byte, qos byte) error {
+	if topic == "" {
+		return errors.New("mqtt: empty topic")
+	}
+	if qos > 1 {
+		return errors.New("mqtt: only QoS 0 and 1 are supported")
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 30 * time.Second
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+
+	conn, err := dial(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	c := &client{conn: conn, r: bufio.NewReader(conn)}
+	defer conn.Close()
+
+	deadline := time.Now().Add(cfg.DialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if err := c.connect(cfg); err != nil {
+		return err
+	}
+
+	body := appendString(nil, topic)
+	if qos == 1 {
+		body = binary.BigEndian.AppendUint16(body, publishPacketID)
+	}
+	body = append(body, payload...)
+	if err := c.write(typePublish<<4|qos<<1, body); err != nil {
+		return err
+	}
+	if qos == 1 {
+		header, p, err := c.read()
+		if err != nil {
+			return fmt.Errorf("mqtt: read PUBACK: %w", err)
+		}
+		if header>>4 != typePuback || len(p) != 2 || binary.BigEndian.Uint16(p) != publishPacketID {
+			return fmt.Errorf("mqtt: expected PUBACK, got packet type %d", header>>4)
+		}
+	}
+	return c.write(typeDisconnect<<4, nil)
+}
+
+func dial(ctx context.Context, cfg Config) (net.Conn, error) {
+	u, err := url.Parse(cfg.BrokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: broker URL: %w", err)
+	}
+	d := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return d.DialContext(ctx, "tcp", hostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		td := &tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}}
+		return td.DialContext(ctx, "tcp", hostPort(u, "8883"))
+	}
+	return nil, fmt.Errorf("mqtt: unsupported broker scheme %q", u.Scheme)
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	wmu sync.Mutex // PINGREQ and PUBACK are written from different goroutines
+}
+
+func (c *client) connect(cfg Config) error {
+	var flags byte
+	if cfg.Username != "" {
+		flags |= 0x80
+		if cfg.Password != "" {
+			flags |= 0x40
+		}
+	}
+	if cfg.CleanSession || cfg.ClientID == "" {
+		// Brokers reject persistent sessions without a client ID.
+		flags |= 0x02
+	}
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4, flags) // protocol level 4 = 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(cfg.KeepAlive/time.Second))
+	body = appendString(body, cfg.ClientID)
+	if flags&0x80 != 0 {
+		body = appendString(body, cfg.Username)
+	}
+	if flags&0x40 != 0 {
+		body = appendString(body, cfg.Password)
+	}
+	if err := c.write(typeConnect<<4, body); err != nil {
+		return err
+	}
+
+	header, payload, err := c.read()
+	if err != nil {
+		return fmt.Errorf("mqtt: read CONNACK: %w", err)
+	}
+	if header>>4 != typeConnack || len(payload) != 2 {
+		return fmt.Errorf("mqtt: expected CONNACK, got packet type %d", header>>4)
+	}
+	if payload[1] != 0 {
+		return ConnectError(payload[1])
+	}
+	return nil
+}
+
+// subscribePacketID identifies our single SUBSCRIBE; PUBLISH packet IDs are
+// chosen by the broker and live in a separate space.
+const subscribePacketID = 1
+
+func (c *client) subscribe(filters []string, qos byte) error {
+	body := binary.BigEndian.AppendUint16(nil, subscribePacketID)
+	for _, f := range filters {
+		body = appendString(body, f)
+		body = append(body, qos)
+	}
+	// SUBSCRIBE has reserved flag bits 0010.
+	return c.write(typeSubscribe<<4|0x02, body)
+}
+
+func (c *client) readLoop(idle time.Duration, filters int, h Handler) error {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idle))
+		header, payload, err := c.read()
+		if err != nil {
+			return err
+		}
+		switch header >> 4 {
+		case typePublish:
+			msg, packetID, err := parsePublish(header, payload)
+			if err != nil {
+				return err
+			}
+			h(msg)
+			if msg.QoS == 1 {
+				if err := c.write(typePuback<<4, binary.BigEndian.AppendUint16(nil, packetID)); err != nil {
+					return err
+				}
+			}
+		case typeSuback:
+			if len(payload) != 2+filters {
+				return errors.New("mqtt: malformed SUBACK")
+			}
+			for i, code := range payload[2:] {
+				if code == 0x80 {
+					return fmt.Errorf("mqtt: subscription %d rejected by broker", i)
+				}
+			}
+		case typePingresp:
+		default:
+			return fmt.Errorf("mqtt: unexpected packet type %d", header>>4)
+		}
+	}
+}
+
+func parsePublish(header byte, p []byte) (Message, uint16, error) {
+	msg := Message{QoS: header >> 1 & 0x03, Retain: header&0x01 != 0}
+	if msg.QoS > 1 {
+		return msg, 0, errors.New("mqtt: QoS 2 PUBLISH on a QoS 1 subscription")
+	}
+	topic, p, err := readString(p)
+	if err != nil {
+		return msg, 0, err
+	}
+	msg.Topic = topic
+	var packetID uint16
+	if msg.QoS > 0 {
+		if len(p) < 2 {
+			return msg, 0, errors.New("mqtt: malformed PUBLISH")
+		}
+		packetID = binary.BigEndian.Uint16(p)
+		p = p[2:]
+	}
+	msg.Payload = p
+	return msg, packetID, nil
+}
+
+// write sends one packet: fixed header byte, remaining length, body.
+func (c *client) write(header byte, body []byte) error {
+	pkt := append([]byte{header}, appendLength(nil, len(body))...)
+	pkt = append(pkt, body...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(pkt)
+	return err
+}
+
+// read returns one packet's fixed header byte and body.
+func (c *client) read() (byte, []byte, error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := readLength(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// appendLength encodes the variable-length "remaining length" field.
+func appendLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func readLength(r io.ByteReader) (int, error) {
+	n, mult := 0, 1
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(digit&0x7f) * mult
+		if digit&0x80 == 0 {
+			if n > maxPacketSize {
+				return 0, fmt.Errorf("mqtt: packet of %d bytes exceeds limit", n)
+			}
+			return n, nil
+		}
+		mult *= 128
+	}
+	return 0, errors.New("mqtt: malformed remaining length")
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readString(p []byte) (string, []byte, error) {
+	if len(p) < 2 {
+		return "", nil, errors.New("mqtt: malformed string")
+	}
+	n := int(binary.BigEndian.Uint16(p))
+	if len(p) < 2+n {
+		return "", nil, errors.New("mqtt: malformed string")
+	}
+	return string(p[2 : 2+n]), p[2+n:], nil
+}
@@ -0,0 +1,290 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// packet is one packet the fake broker received.
+type packet struct {
+	header byte
+	body   []byte
+}
+
+// fakeBroker accepts connections on a local port; tests speak the broker's
+// side of each one through a client.
+type fakeBroker struct {
+	ln    net.Listener
+	conns chan *client
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &fakeBroker{ln: ln, conns: make(chan *client, 4)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.conns <- &client{conn: conn, r: bufio.NewReader(conn)}
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) url() string { return "tcp://" + b.ln.Addr().String() }
+
+// accept waits for the next connection and reads its CONNECT.
+func (b *fakeBroker) accept(t *testing.T) (*client, packet) {
+	t.Helper()
+	select {
+	case c := <-b.conns:
+		t.Cleanup(func() { c.conn.Close() })
+		c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return c, expect(t, c, typeConnect)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection to the broker")
+		return nil, packet{}
+	}
+}
+
+// expect reads the next packet and checks its type.
+func expect(t *testing.T, c *client, typ byte) packet {
+	t.Helper()
+	header, body, err := c.read()
+	if err != nil {
+		t.Fatalf("broker read (want type %d): %v", typ, err)
+	}
+	if header>>4 != typ {
+		t.Fatalf("broker got packet type %d; want %d", header>>4, typ)
+	}
+	return packet{header, body}
+}
+
+func connack(t *testing.T, c *client, code byte) {
+	t.Helper()
+	if err := c.write(typeConnack<<4, []byte{0, code}); err != nil {
+		t.Fatalf("write CONNACK: %v", err)
+	}
+}
+
+func TestRemainingLength(t *testing.T) {
+	for _, tc := range []struct {
+		n       int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{maxPacketSize, []byte{0x80, 0x80, 0x40}},
+	} {
+		if got := appendLength(nil, tc.n); !bytes.Equal(got, tc.encoded) {
+			t.Errorf("appendLength(%d) = % x; want % x", tc.n, got, tc.encoded)
+		}
+		if n, err := readLength(bytes.NewReader(tc.encoded)); err != nil || n != tc.n {
+			t.Errorf("readLength(% x) = %d, %v; want %d", tc.encoded, n, err, tc.n)
+		}
+	}
+	if _, err := readLength(bytes.NewReader(appendLength(nil, maxPacketSize+1))); err == nil {
+		t.Error("readLength accepted a packet over the size limit")
+	}
+	if _, err := readLength(bytes.NewReader([]byte{0x80, 0x80, 0x80, 0x80, 0x01})); err == nil {
+		t.Error("readLength accepted a five-byte length")
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	body := appendString(nil, "fleet/m1/telemetry")
+	body = binary.BigEndian.AppendUint16(body, 7)
+	body = append(body, `{"battery":80}`...)
+	msg, id, err := parsePublish(typePublish<<4|1<<1|1, body)
+	if err != nil {
+		t.Fatalf("parsePublish error: %v", err)
+	}
+	if msg.Topic != "fleet/m1/telemetry" || string(msg.Payload) != `{"battery":80}` || msg.QoS != 1 || !msg.Retain || id != 7 {
+		t.Errorf("parsePublish = %+v, id %d; want a retained QoS 1 message with id 7", msg, id)
+	}
+
+	// At QoS 0 there is no packet ID: the payload follows the topic.
+	msg, id, err = parsePublish(typePublish<<4, append(appendString(nil, "t"), "hi"...))
+	if err != nil || msg.Topic != "t" || string(msg.Payload) != "hi" || msg.QoS != 0 || id != 0 {
+		t.Errorf("QoS 0 parsePublish = %+v, %d, %v; want topic t, payload hi", msg, id, err)
+	}
+
+	for name, p := range map[string]struct {
+		header byte
+		body   []byte
+	}{
+		"QoS 2":             {typePublish<<4 | 2<<1, appendString(nil, "t")},
+		"truncated topic":   {typePublish << 4, []byte{0, 5, 'a'}},
+		"missing packet ID": {typePublish<<4 | 1<<1, appendString(nil, "t")},
+	} {
+		if _, _, err := parsePublish(p.header, p.body); err == nil {
+			t.Errorf("parsePublish accepted a PUBLISH with %s", name)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	b := newFakeBroker(t)
+	cfg := Config{BrokerURL: b.url(), ClientID: "ingest-1", Username: "svc", Password: "pw", KeepAlive: time.Minute}
+	got := make(chan Message, 1)
+	errc := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { errc <- Subscribe(ctx, cfg, []string{"fleet/+/telemetry"}, 1, func(m Message) { got <- m }) }()
+
+	c, connect := b.accept(t)
+	want := appendString(nil, "MQTT")
+	want = append(want, 4, 0xc0, 0, 60) // 3.1.1, username and password, persistent session, 60s keep-alive
+	want = appendString(want, "ingest-1")
+	want = appendString(want, "svc")
+	want = appendString(want, "pw")
+	if !bytes.Equal(connect.body, want) {
+		t.Errorf("CONNECT body = % x; want % x", connect.body, want)
+	}
+	connack(t, c, 0)
+
+	sub := expect(t, c, typeSubscribe)
+	wantSub := binary.BigEndian.AppendUint16(nil, subscribePacketID)
+	wantSub = append(appendString(wantSub, "fleet/+/telemetry"), 1)
+	if sub.header&0x0f != 0x02 || !bytes.Equal(sub.body, wantSub) {
+		t.Errorf("SUBSCRIBE = %x % x; want flags 0010 and % x", sub.header, sub.body, wantSub)
+	}
+	if err := c.write(typeSuback<<4, []byte{0, subscribePacketID, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A QoS 1 message is handled, then acknowledged with its packet ID.
+	body := binary.BigEndian.AppendUint16(appendString(nil, "fleet/m1/telemetry"), 42)
+	if err := c.write(typePublish<<4|1<<1, append(body, "data"...)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-got:
+		if m.Topic != "fleet/m1/telemetry" || string(m.Payload) != "data" {
+			t.Errorf("handled %+v; want fleet/m1/telemetry with payload data", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+	if ack := expect(t, c, typePuback); binary.BigEndian.Uint16(ack.body) != 42 {
+		t.Errorf("PUBACK for packet %d; want 42", binary.BigEndian.Uint16(ack.body))
+	}
+
+	// The broker dropping the connection ends Subscribe with an error, so the
+	// caller reconnects.
+	c.conn.Close()
+	if err := <-errc; err == nil || errors.Is(err, context.Canceled) {
+		t.Fatalf("Subscribe after the connection dropped = %v; want a connection error", err)
+	}
+
+	// The reconnect resumes the session; cancelling ctx disconnects cleanly.
+	go func() { errc <- Subscribe(ctx, cfg, []string{"fleet/+/telemetry"}, 1, func(m Message) {}) }()
+	c, _ = b.accept(t)
+	connack(t, c, 0)
+	expect(t, c, typeSubscribe)
+	if err := c.write(typeSuback<<4, []byte{0, subscribePacketID, 1}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	expect(t, c, typeDisconnect)
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("Subscribe after cancel = %v; want context.Canceled", err)
+	}
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	b := newFakeBroker(t)
+	cfg := Config{BrokerURL: b.url(), ClientID: "ingest-1"}
+	errc := make(chan error, 1)
+	subscribe := func() {
+		go func() { errc <- Subscribe(context.Background(), cfg, []string{"a", "b"}, 0, func(Message) {}) }()
+	}
+
+	// Bad credentials fail the CONNECT.
+	subscribe()
+	c, _ := b.accept(t)
+	connack(t, c, 4)
+	var connErr ConnectError
+	if err := <-errc; !errors.As(err, &connErr) || connErr != 4 {
+		t.Errorf("Subscribe with CONNACK 4 = %v; want ConnectError(4)", err)
+	}
+
+	// A filter the broker refuses fails the subscription.
+	subscribe()
+	c, _ = b.accept(t)
+	connack(t, c, 0)
+	expect(t, c, typeSubscribe)
+	if err := c.write(typeSuback<<4, []byte{0, subscribePacketID, 0, 0x80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil || err.Error() != "mqtt: subscription 1 rejected by broker" {
+		t.Errorf("Subscribe with a rejected filter = %v; want subscription 1 rejected", err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	b := newFakeBroker(t)
+	cfg := Config{BrokerURL: b.url(), ClientID: "api-commands", CleanSession: true}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Publish(context.Background(), cfg, "fleet/m1/commands", []byte(`{"type":"RETURN"}`), 1)
+	}()
+
+	c, connect := b.accept(t)
+	if flags := connect.body[7]; flags != 0x02 {
+		t.Errorf("CONNECT flags = %#x; want clean session only", flags)
+	}
+	connack(t, c, 0)
+	pub := expect(t, c, typePublish)
+	msg, id, err := parsePublish(pub.header, pub.body)
+	if err != nil || msg.Topic != "fleet/m1/commands" || string(msg.Payload) != `{"type":"RETURN"}` || msg.QoS != 1 || id != publishPacketID {
+		t.Errorf("PUBLISH = %+v, id %d, %v; want the command at QoS 1 with id %d", msg, id, err, publishPacketID)
+	}
+	// Publish waits for the PUBACK before disconnecting.
+	select {
+	case err := <-errc:
+		t.Fatalf("Publish returned %v before the PUBACK", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := c.write(typePuback<<4, binary.BigEndian.AppendUint16(nil, publishPacketID)); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, typeDisconnect)
+	if err := <-errc; err != nil {
+		t.Errorf("Publish error: %v", err)
+	}
+
+	// A wrong acknowledgement fails the call.
+	go func() { errc <- Publish(context.Background(), cfg, "t", nil, 1) }()
+	c, _ = b.accept(t)
+	connack(t, c, 0)
+	expect(t, c, typePublish)
+	if err := c.write(typePuback<<4, binary.BigEndian.AppendUint16(nil, 9)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil {
+		t.Error("Publish accepted a PUBACK for another packet")
+	}
+
+	for _, bad := range []Config{{BrokerURL: "http://" + b.ln.Addr().String()}, {BrokerURL: "%"}} {
+		if err := Publish(context.Background(), bad, "t", nil, 0); err == nil {
+			t.Errorf("Publish to %q succeeded", bad.BrokerURL)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FakeMode selects how a FakeService answers.
+type FakeMode string
+
+const (
+	FakeSucceed FakeMode = "succeed" // Every call succeeds at once.
+	FakeFail    FakeMode = "fail"    // Charges and refunds are declined.
+	FakeDelay   FakeMode = "delay"   // Every call succeeds after the delay.
+)
+
+// ErrFakeDeclined is returned, as a DeclinedError, by charges and refunds of
+// a FakeService in FakeFail mode.
+var ErrFakeDeclined = errors.New("fake payment declined")
+
+// maxFakeKeys is how many idempotency keys a FakeService remembers; the
+// oldest is forgotten first, as Stripe forgets keys after 24 hours.
+const maxFakeKeys = 10000
+
+// FakeService is a ServiceInterface that moves no money, for staging and
+// integration tests that must not reach Stripe. Like Stripe, it returns the
+// first ID again for a call repeated with the same idempotency key, for its
+// last maxFakeKeys keys. Saved cards always succeed and are described as a
+// Visa ending in 4242.
+type FakeService struct {
+	mode  FakeMode
+	delay time.Duration
+
+	mu    sync.Mutex
+	seq   int
+	keys  map[string]string // idempotency key -> ID returned for it
+	order []string          // keys, oldest first
+}
+
+// NewFakeService returns a FakeService answering in mode; delay is only used
+// by FakeDelay.
+func NewFakeService(mode FakeMode, delay time.Duration) (*FakeService, error) {
+	switch mode {
+	case FakeSucceed, FakeFail:
+	case FakeDelay:
+		if delay <= 0 {
+			return nil, fmt.Errorf("payment: fake mode %q needs a positive delay", mode)
+		}
+	default:
+		return nil, fmt.Errorf("payment: unknown fake mode %q", mode)
+	}
+	return &FakeService{mode: mode, delay: delay, keys: map[string]string{}}, nil
+}
+
+// Provider returns "fake".
+func (s *FakeService) Provider() string {
+	return "fake"
+}
+
+// ProcessPayment returns the ID of a fake PaymentIntent.
+func (s *FakeService) ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID, idempotencyKey string) (string, error) {
+	return s.move(ctx, "pi", idempotencyKey)
+}
+
+// ChargeCustomer is ProcessPayment for a saved card.
+func (s *FakeService) ChargeCustomer(ctx context.Context, customerID string, amount float64, paymentMethodID, idempotencyKey string) (string, error) {
+	return s.move(ctx, "pi", idempotencyKey)
+}
+
+// RefundPayment returns the ID of a fake refund.
+func (s *FakeService) RefundPayment(ctx context.Context, paymentID string, amount float64, idempotencyKey string) (string, error) {
+	return s.move(ctx, "re", idempotencyKey)
+}
+
+// PaymentStatus reports every charge as succeeded, or as failed in FakeFail
+// mode.
+func (s *FakeService) PaymentStatus(ctx context.Context, paymentID string) (string, error) {
+	if err := s.wait(ctx); err != nil {
+		return "", err
+	}
+	if s.mode == FakeFail {
+		return "requires_payment_method", nil
+	}
+	return StatusSucceeded, nil
+}
+
+// CancelPayment does nothing.
+func (s *FakeService) CancelPayment(ctx context.Context, paymentID string) error {
+	return s.wait(ctx)
+}
+
+// CreateCustomer returns the ID of a fake customer.
+func (s *FakeService) CreateCustomer(ctx context.Context, userID, email string) (string, error) {
+	if err := s.wait(ctx); err != nil {
+		return "", err
+	}
+	return s.newID("cus"), nil
+}
+
+// AttachPaymentMethod describes paymentMethodID as a Visa ending in 4242
+// expiring at the end of next year.
+func (s *FakeService) AttachPaymentMethod(ctx context.Context, customerID, paymentMethodID string) (*Card, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &Card{
+		ID:       paymentMethodID,
+		Brand:    "visa",
+		Last4:    "4242",
+		ExpMonth: 12,
+		ExpYear:  time.Now().Year() + 1,
+	}, nil
+}
+
+// DetachPaymentMethod does nothing.
+func (s *FakeService) DetachPaymentMethod(ctx context.Context, paymentMethodID string) error {
+	return s.wait(ctx)
+}
+
+// move answers a charge or refund, returning a new ID with prefix or the one
+// already returned for idempotencyKey.
+func (s *FakeService) move(ctx context.Context, prefix, idempotencyKey string) (string, error) {
+	if err := s.wait(ctx); err != nil {
+		return "", err
+	}
+	if s.mode == FakeFail {
+		return "", &DeclinedError{Reason: ErrFakeDeclined.Error(), Err: ErrFakeDeclined}
+	}
+	if idempotencyKey == "" {
+		return s.newID(prefix), nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.keys[idempotencyKey]
+	if !ok {
+		if len(s.order) == maxFakeKeys {
+			delete(s.keys, s.order[0])
+			s.order = s.order[1:]
+		}
+		s.seq++
+		id = fmt.Sprintf("fake_%s_%d", prefix, s.seq)
+		s.keys[idempotencyKey] = id
+		s.order = append(s.order, idempotencyKey)
+	}
+	return id, nil
+}
+
+func (s *FakeService) newID(prefix string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return fmt.Sprintf("fake_%s_%d", prefix, s.seq)
+}
+
+// wait sleeps for the delay in FakeDelay mode, or until ctx is done.
+func (s *FakeService) wait(ctx context.Context) error {
+	if s.mode != FakeDelay {
+		return nil
+	}
+	t := time.NewTimer(s.delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,131 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewFakeService(t *testing.T) {
+	if _, err := NewFakeService("flaky", 0); err == nil {
+		t.Error("NewFakeService accepted an unknown mode")
+	}
+	if _, err := NewFakeService(FakeDelay, 0); err == nil {
+		t.Error("NewFakeService accepted delay mode without a delay")
+	}
+}
+
+func TestFakeSucceed(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFakeService(FakeSucceed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Provider() != "fake" {
+		t.Errorf("Provider = %q; want fake", s.Provider())
+	}
+
+	// A repeated idempotency key replays the first ID, as Stripe does.
+	first, err := s.ProcessPayment(ctx, "u1", 10, "pm", "order-pay-1")
+	if err != nil {
+		t.Fatalf("ProcessPayment error: %v", err)
+	}
+	again, _ := s.ChargeCustomer(ctx, "cus", 10, "pm", "order-pay-1")
+	other, _ := s.ProcessPayment(ctx, "u1", 10, "pm", "order-pay-2")
+	if first != "fake_pi_1" || again != first || other == first {
+		t.Errorf("charges = %s, %s, %s; want fake_pi_1 replayed for the same key only", first, again, other)
+	}
+	a, _ := s.ProcessPayment(ctx, "u1", 10, "pm", "")
+	b, _ := s.ProcessPayment(ctx, "u1", 10, "pm", "")
+	if a == b {
+		t.Errorf("charges without a key both got %s; want new IDs", a)
+	}
+	if refund, err := s.RefundPayment(ctx, first, 10, "payment-refund-"+first); err != nil || refund[:8] != "fake_re_" {
+		t.Errorf("RefundPayment = %s, %v; want a fake_re_ ID", refund, err)
+	}
+
+	if status, err := s.PaymentStatus(ctx, first); err != nil || status != StatusSucceeded {
+		t.Errorf("PaymentStatus = %s, %v; want succeeded", status, err)
+	}
+	card, err := s.AttachPaymentMethod(ctx, "cus", "pm_1")
+	if err != nil || card.ID != "pm_1" || card.Last4 != "4242" || card.ExpYear <= time.Now().Year() {
+		t.Errorf("AttachPaymentMethod = %+v, %v; want pm_1 as a Visa ending in 4242, not expired", card, err)
+	}
+	if err := s.CancelPayment(ctx, first); err != nil {
+		t.Errorf("CancelPayment error: %v", err)
+	}
+}
+
+func TestFakeFail(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewFakeService(FakeFail, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var declined *DeclinedError
+	if _, err := s.ProcessPayment(ctx, "u1", 10, "pm", "k"); !errors.As(err, &declined) || !errors.Is(err, ErrFakeDeclined) {
+		t.Errorf("ProcessPayment error = %v; want a DeclinedError wrapping ErrFakeDeclined", err)
+	}
+	if _, err := s.RefundPayment(ctx, "pi", 10, "r"); !errors.Is(err, ErrFakeDeclined) {
+		t.Errorf("RefundPayment error = %v; want ErrFakeDeclined", err)
+	}
+	if status, err := s.PaymentStatus(ctx, "pi"); err != nil || status == StatusSucceeded {
+		t.Errorf("PaymentStatus = %s, %v; want a failed status", status, err)
+	}
+	// Saved cards still work.
+	if _, err := s.CreateCustomer(ctx, "u1", "a@example.com"); err != nil {
+		t.Errorf("CreateCustomer error: %v", err)
+	}
+}
+
+func TestFakeDelay(t *testing.T) {
+	s, err := NewFakeService(FakeDelay, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := s.ProcessPayment(context.Background(), "u1", 10, "pm", "k"); err != nil {
+		t.Fatalf("ProcessPayment error: %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("answered after %s; want the 20ms delay", waited)
+	}
+
+	// A cancelled request stops waiting and records nothing.
+	slow, _ := NewFakeService(FakeDelay, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := slow.ProcessPayment(ctx, "u1", 10, "pm", "k"); !errors.Is(err, context.Canceled) {
+		t.Errorf("ProcessPayment error = %v; want context.Canceled", err)
+	}
+	if _, err := slow.AttachPaymentMethod(ctx, "cus", "pm"); !errors.Is(err, context.Canceled) {
+		t.Errorf("AttachPaymentMethod error = %v; want context.Canceled", err)
+	}
+	if len(slow.keys) != 0 {
+		t.Errorf("cancelled charge kept %d idempotency key(s)", len(slow.keys))
+	}
+}
+
+func TestFakeKeysBounded(t *testing.T) {
+	ctx := context.Background()
+	s, _ := NewFakeService(FakeSucceed, 0)
+	first, _ := s.ProcessPayment(ctx, "u1", 1, "pm", "key-0")
+	for i := 1; i <= maxFakeKeys; i++ {
+		s.ProcessPayment(ctx, "u1", 1, "pm", fmt.Sprintf("key-%d", i))
+	}
+	if len(s.keys) != maxFakeKeys || len(s.order) != maxFakeKeys {
+		t.Errorf("remembers %d keys (%d in order); want at most %d", len(s.keys), len(s.order), maxFakeKeys)
+	}
+	// The oldest key was forgotten; the newest still replays.
+	if again, _ := s.ProcessPayment(ctx, "u1", 1, "pm", "key-0"); again == first {
+		t.Error("the oldest key still replays its charge")
+	}
+	last := fmt.Sprintf("key-%d", maxFakeKeys)
+	if id, ok := s.keys[last]; !ok {
+		t.Error("the newest key was forgotten")
+	} else if again, _ := s.ProcessPayment(ctx, "u1", 1, "pm", last); again != id {
+		t.Errorf("newest key replayed %s; want %s", again, id)
+	}
+}
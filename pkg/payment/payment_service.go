@@ -2,38 +2,295 @@ package payment
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
 
 	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/customer"
 	"github.com/stripe/stripe-go/v74/paymentintent"
+	"github.com/stripe/stripe-go/v74/paymentmethod"
+	"github.com/stripe/stripe-go/v74/refund"
 )
 
 // ServiceInterface defines the contract for a payment processing service.
 type ServiceInterface interface {
-	ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID string) (string, error)
+	ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID, idempotencyKey string) (string, error)
+	RefundPayment(ctx context.Context, paymentID string, amount float64, idempotencyKey string) (string, error)
+	ChargeCustomer(ctx context.Context, customerID string, amount float64, paymentMethodID, idempotencyKey string) (string, error)
+	PaymentStatus(ctx context.Context, paymentID string) (string, error)
+	CancelPayment(ctx context.Context, paymentID string) error
+	CreateCustomer(ctx context.Context, userID, email string) (string, error)
+	AttachPaymentMethod(ctx context.Context, customerID, paymentMethodID string) (*Card, error)
+	DetachPaymentMethod(ctx context.Context, paymentMethodID string) error
+	// Provider names the payment provider, e.g. "stripe", for payment records.
+	Provider() string
+}
+
+// Statuses of a charge returned by PaymentStatus. Others, such as
+// "requires_payment_method" after a failed authentication, mean it failed.
+const (
+	StatusSucceeded      = "succeeded"
+	StatusProcessing     = "processing"
+	StatusRequiresAction = "requires_action"
+)
+
+// ActionRequiredError is returned by a charge that the customer has to
+// authenticate, e.g. with 3-D Secure, before it completes. The client
+// authenticates it with ClientSecret; PaymentStatus then tells whether it
+// succeeded.
+type ActionRequiredError struct {
+	PaymentID    string
+	ClientSecret string
+}
+
+func (e *ActionRequiredError) Error() string {
+	return "payment " + e.PaymentID + " requires authentication"
+}
+
+// DeclinedError is returned by a charge the card's issuer or the provider
+// declined, e.g. for insufficient funds. Charging the same card again will
+// not help. Other errors, such as a timeout, leave it open whether the charge
+// went through; repeating it with the same idempotency key tells. Reason is
+// the provider's explanation meant for the customer, e.g. "Your card has
+// insufficient funds.", or its decline code.
+type DeclinedError struct {
+	Reason string
+	Err    error
+}
+
+func (e *DeclinedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeclinedError) Unwrap() error {
+	return e.Err
+}
+
+// Card describes a card saved to a customer.
+type Card struct {
+	ID       string
+	Brand    string
+	Last4    string
+	ExpMonth int
+	ExpYear  int
 }
 
 // StripeService is a real implementation using Stripe.
 type StripeService struct {
-	apiKey string
+	apiKey  string
+	breaker *resilience.Executor
 }
 
 func NewStripeService(apiKey string) *StripeService {
 	stripe.Key = apiKey
-	return &StripeService{apiKey: apiKey}
+	return &StripeService{
+		apiKey: apiKey,
+		// One attempt per call: stripe-go already retries network errors,
+		// conflicts and 503s itself under the same idempotency key, and
+		// retrying its retries here would outlast the request's deadline.
+		breaker: resilience.New(resilience.Policy{
+			Name:             "stripe",
+			Timeout:          15 * time.Second,
+			MaxAttempts:      1,
+			FailureThreshold: 5,
+			OpenDuration:     30 * time.Second,
+		}),
+	}
+}
+
+// Provider returns "stripe".
+func (s *StripeService) Provider() string {
+	return "stripe"
+}
+
+// ProcessPayment creates and confirms a Stripe PaymentIntent. One the card
+// issuer wants authenticated fails with an ActionRequiredError, a declined
+// one with a DeclinedError. A non-empty
+// idempotencyKey is sent as Stripe's Idempotency-Key: repeating the call with
+// the same key within 24 hours returns the first PaymentIntent instead of
+// charging again.
+func (s *StripeService) ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID, idempotencyKey string) (string, error) {
+	return s.charge(ctx, &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(cents(amount)),
+		Currency:      stripe.String(string(stripe.CurrencyUSD)),
+		PaymentMethod: stripe.String(paymentMethodID),
+		Confirm:       stripe.Bool(true),
+	}, idempotencyKey)
 }
 
-// ProcessPayment creates and confirms a Stripe PaymentIntent.
-func (s *StripeService) ProcessPayment(ctx context.Context, userID string, amount float64, paymentMethodID string) (string, error) {
-	params := &stripe.PaymentIntentParams{
-		Amount:        stripe.Int64(int64(amount * 100)), // Stripe uses cents
+// ChargeCustomer is ProcessPayment for a card saved to the Stripe customer
+// customerID, which Stripe only charges on behalf of that customer.
+func (s *StripeService) ChargeCustomer(ctx context.Context, customerID string, amount float64, paymentMethodID, idempotencyKey string) (string, error) {
+	return s.charge(ctx, &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(cents(amount)),
 		Currency:      stripe.String(string(stripe.CurrencyUSD)),
+		Customer:      stripe.String(customerID),
 		PaymentMethod: stripe.String(paymentMethodID),
 		Confirm:       stripe.Bool(true),
+	}, idempotencyKey)
+}
+
+// cents converts a dollar amount to the integer cents Stripe charges. Most
+// cent amounts have no exact float64, e.g. 0.29*100 is 28.999..., so the
+// result is rounded rather than truncated.
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+func (s *StripeService) charge(ctx context.Context, params *stripe.PaymentIntentParams, idempotencyKey string) (string, error) {
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+	var pi *stripe.PaymentIntent
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		// Cancel the Stripe call when the request deadline expires.
+		params.Context = ctx
+		var err error
+		pi, err = paymentintent.New(params)
+		return permanentIfClientError(err)
+	})
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard {
+		reason := stripeErr.Msg
+		if reason == "" {
+			reason = string(stripeErr.DeclineCode)
+		}
+		return "", &DeclinedError{Reason: reason, Err: fmt.Errorf("stripe payment declined: %w", err)}
 	}
-	pi, err := paymentintent.New(params)
 	if err != nil {
 		return "", fmt.Errorf("stripe payment failed: %w", err)
 	}
+	if pi.Status == stripe.PaymentIntentStatusRequiresAction {
+		return "", &ActionRequiredError{PaymentID: pi.ID, ClientSecret: pi.ClientSecret}
+	}
 	return pi.ID, nil
-} 
\ No newline at end of file
+}
+
+// PaymentStatus returns the status of the PaymentIntent paymentID, e.g. to
+// learn whether the customer authenticated it.
+func (s *StripeService) PaymentStatus(ctx context.Context, paymentID string) (string, error) {
+	params := &stripe.PaymentIntentParams{}
+	var pi *stripe.PaymentIntent
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		params.Context = ctx
+		var err error
+		pi, err = paymentintent.Get(paymentID, params)
+		return permanentIfClientError(err)
+	})
+	if err != nil {
+		return "", fmt.Errorf("stripe payment lookup failed: %w", err)
+	}
+	return string(pi.Status), nil
+}
+
+// CancelPayment cancels the PaymentIntent paymentID that the customer has not
+// authenticated yet, so it can no longer succeed.
+func (s *StripeService) CancelPayment(ctx context.Context, paymentID string) error {
+	params := &stripe.PaymentIntentCancelParams{CancellationReason: stripe.String("abandoned")}
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		params.Context = ctx
+		_, err := paymentintent.Cancel(paymentID, params)
+		return permanentIfClientError(err)
+	})
+	if err != nil {
+		return fmt.Errorf("stripe payment cancellation failed: %w", err)
+	}
+	return nil
+}
+
+// RefundPayment refunds amount of the PaymentIntent paymentID and returns the
+// refund's ID. As with ProcessPayment, a non-empty idempotencyKey makes
+// repeating the call return the first refund.
+func (s *StripeService) RefundPayment(ctx context.Context, paymentID string, amount float64, idempotencyKey string) (string, error) {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(paymentID),
+		Amount:        stripe.Int64(cents(amount)),
+	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+	var re *stripe.Refund
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		params.Context = ctx
+		var err error
+		re, err = refund.New(params)
+		return permanentIfClientError(err)
+	})
+	if err != nil {
+		return "", fmt.Errorf("stripe refund failed: %w", err)
+	}
+	return re.ID, nil
+}
+
+// CreateCustomer creates the Stripe customer cards are saved to for the user
+// userID and returns its ID.
+func (s *StripeService) CreateCustomer(ctx context.Context, userID, email string) (string, error) {
+	params := &stripe.CustomerParams{Email: stripe.String(email)}
+	params.AddMetadata("user_id", userID)
+	// The user ID makes a retried creation return the first customer.
+	params.SetIdempotencyKey("customer-" + userID)
+	var c *stripe.Customer
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		params.Context = ctx
+		var err error
+		c, err = customer.New(params)
+		return permanentIfClientError(err)
+	})
+	if err != nil {
+		return "", fmt.Errorf("stripe customer creation failed: %w", err)
+	}
+	return c.ID, nil
+}
+
+// AttachPaymentMethod saves the card paymentMethodID, tokenized by the client
+// with Stripe.js, to the customer customerID and returns its details.
+func (s *StripeService) AttachPaymentMethod(ctx context.Context, customerID, paymentMethodID string) (*Card, error) {
+	params := &stripe.PaymentMethodAttachParams{Customer: stripe.String(customerID)}
+	var pm *stripe.PaymentMethod
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		params.Context = ctx
+		var err error
+		pm, err = paymentmethod.Attach(paymentMethodID, params)
+		return permanentIfClientError(err)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("stripe payment method attachment failed: %w", err)
+	}
+	card := &Card{ID: pm.ID}
+	if pm.Card != nil {
+		card.Brand = string(pm.Card.Brand)
+		card.Last4 = pm.Card.Last4
+		card.ExpMonth = int(pm.Card.ExpMonth)
+		card.ExpYear = int(pm.Card.ExpYear)
+	}
+	return card, nil
+}
+
+// DetachPaymentMethod removes a saved card from its customer; it cannot be
+// charged again.
+func (s *StripeService) DetachPaymentMethod(ctx context.Context, paymentMethodID string) error {
+	params := &stripe.PaymentMethodDetachParams{}
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		params.Context = ctx
+		_, err := paymentmethod.Detach(paymentMethodID, params)
+		return permanentIfClientError(err)
+	})
+	if err != nil {
+		return fmt.Errorf("stripe payment method detachment failed: %w", err)
+	}
+	return nil
+}
+
+// permanentIfClientError marks Stripe's 4xx errors as permanent: declines and
+// invalid requests mean Stripe is healthy, so they do not trip the breaker.
+func permanentIfClientError(err error) error {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode >= 400 && stripeErr.HTTPStatusCode < 500 {
+		return resilience.Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// fakeStripe points the Stripe client at a local server for the test and
+// returns the form of each request it received, keyed by path.
+func fakeStripe(t *testing.T) map[string][]map[string]string {
+	t.Helper()
+	requests := map[string][]map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse %s form: %v", r.URL.Path, err)
+		}
+		form := map[string]string{"Idempotency-Key": r.Header.Get("Idempotency-Key")}
+		for k := range r.PostForm {
+			form[k] = r.PostForm.Get(k)
+		}
+		requests[r.URL.Path] = append(requests[r.URL.Path], form)
+		switch r.URL.Path {
+		case "/v1/payment_intents":
+			fmt.Fprint(w, `{"id":"pi_1","object":"payment_intent","status":"succeeded"}`)
+		case "/v1/refunds":
+			fmt.Fprint(w, `{"id":"re_1","object":"refund","status":"succeeded"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	previous := stripe.GetBackend(stripe.APIBackend)
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(srv.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	}))
+	t.Cleanup(func() { stripe.SetBackend(stripe.APIBackend, previous) })
+	return requests
+}
+
+func TestCents(t *testing.T) {
+	for _, tc := range []struct {
+		amount float64
+		want   int64
+	}{
+		{0.29, 29}, {0.57, 57}, {1.13, 113}, {12.5, 1250}, {19.99, 1999}, {1000.01, 100001}, {0, 0},
+	} {
+		if got := cents(tc.amount); got != tc.want {
+			t.Errorf("cents(%v) = %d; want %d", tc.amount, got, tc.want)
+		}
+	}
+}
+
+func TestStripeChargeAmounts(t *testing.T) {
+	requests := fakeStripe(t)
+	s := NewStripeService("sk_test_123")
+	ctx := context.Background()
+
+	// Amounts without an exact float64 are charged to the cent.
+	if id, err := s.ProcessPayment(ctx, "u1", 0.29, "pm_card", "order-pay-1"); err != nil || id != "pi_1" {
+		t.Fatalf("ProcessPayment = %s, %v; want pi_1", id, err)
+	}
+	if _, err := s.ChargeCustomer(ctx, "cus_1", 1.13, "pm_card", "order-pay-2"); err != nil {
+		t.Fatalf("ChargeCustomer error: %v", err)
+	}
+	charges := requests["/v1/payment_intents"]
+	if len(charges) != 2 {
+		t.Fatalf("sent %d charges; want 2", len(charges))
+	}
+	for i, want := range []map[string]string{
+		{"amount": "29", "currency": "usd", "payment_method": "pm_card", "customer": "", "Idempotency-Key": "order-pay-1"},
+		{"amount": "113", "currency": "usd", "payment_method": "pm_card", "customer": "cus_1", "Idempotency-Key": "order-pay-2"},
+	} {
+		for k, v := range want {
+			if charges[i][k] != v {
+				t.Errorf("charge %d %s = %q; want %q", i+1, k, charges[i][k], v)
+			}
+		}
+	}
+}
+
+func TestStripeRefundAmounts(t *testing.T) {
+	requests := fakeStripe(t)
+	s := NewStripeService("sk_test_123")
+
+	// A partial refund of an amount without an exact float64 is refunded to the cent.
+	if id, err := s.RefundPayment(context.Background(), "pi_1", 0.57, "payment-refund-pi_1"); err != nil || id != "re_1" {
+		t.Fatalf("RefundPayment = %s, %v; want re_1", id, err)
+	}
+	refunds := requests["/v1/refunds"]
+	if len(refunds) != 1 {
+		t.Fatalf("sent %d refunds; want 1", len(refunds))
+	}
+	if r := refunds[0]; r["amount"] != "57" || r["payment_intent"] != "pi_1" || r["Idempotency-Key"] != "payment-refund-pi_1" {
+		t.Errorf("refund = %v; want 57 cents of pi_1 under its idempotency key", r)
+	}
+}
@@ -0,0 +1,216 @@
+// Package pdf renders simple text documents, such as receipts, as PDF. It
+// needs no third-party library: pages are A4 with left-aligned lines in the
+// standard Helvetica fonts, which every PDF reader has built in. Text outside
+// Windows-1252 is printed as "?".
+package pdf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Page geometry in points (1/72 inch).
+const (
+	pageWidth  = 595.28 // A4
+	pageHeight = 841.89
+	margin     = 56.0
+	// valueColumn is where Row prints its value.
+	valueColumn = 220.0
+)
+
+// Text sizes in points.
+const (
+	titleSize = 18.0
+	textSize  = 10.0
+)
+
+type line struct {
+	text  string
+	x     float64
+	y     float64
+	size  float64
+	bold  bool
+	color float64 // Gray level: 0 is black.
+}
+
+// Document is a PDF being built line by line; lines that do not fit on a
+// page start a new one. Write it out with WriteTo.
+type Document struct {
+	title string
+	pages [][]line
+	y     float64 // Baseline of the next line on the last page.
+}
+
+// New starts a document; title is its metadata title, not printed.
+func New(title string) *Document {
+	d := &Document{title: title}
+	d.newPage()
+	return d
+}
+
+func (d *Document) newPage() {
+	d.pages = append(d.pages, nil)
+	d.y = pageHeight - margin
+}
+
+// add places a line of the given size below the previous one.
+func (d *Document) add(size float64, parts ...line) {
+	lead := size * 1.4
+	if d.y-lead < margin {
+		d.newPage()
+	}
+	d.y -= lead
+	page := &d.pages[len(d.pages)-1]
+	for _, p := range parts {
+		p.y, p.size = d.y, size
+		*page = append(*page, p)
+	}
+}
+
+// Title prints a large bold line.
+func (d *Document) Title(text string) {
+	d.add(titleSize, line{text: text, x: margin, bold: true})
+}
+
+// Heading prints a bold line, set off from the text above it.
+func (d *Document) Heading(text string) {
+	d.Space()
+	d.add(textSize+2, line{text: text, x: margin, bold: true})
+}
+
+// Text prints a line of text.
+func (d *Document) Text(text string) {
+	d.add(textSize, line{text: text, x: margin})
+}
+
+// Note prints a line of gray text, e.g. a footnote.
+func (d *Document) Note(text string) {
+	d.add(textSize-1, line{text: text, x: margin, color: 0.4})
+}
+
+// Row prints a label and its value in two columns.
+func (d *Document) Row(label, value string) {
+	d.add(textSize, line{text: label, x: margin, color: 0.3}, line{text: value, x: valueColumn})
+}
+
+// BoldRow prints a label and its value in bold, e.g. a total.
+func (d *Document) BoldRow(label, value string) {
+	d.add(textSize, line{text: label, x: margin, bold: true}, line{text: value, x: valueColumn, bold: true})
+}
+
+// Space leaves a blank line.
+func (d *Document) Space() {
+	d.add(textSize)
+}
+
+// WriteTo writes the document to w as a PDF file.
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	var offsets []int64
+	obj := func(body string) {
+		offsets = append(offsets, cw.n)
+		fmt.Fprintf(cw, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1-4 are fixed; each page then takes a page and a content object.
+	const firstPage = 5
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	io.WriteString(cw, "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, firstPage+2*i+1))
+		content := pageContent(page)
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+	obj(fmt.Sprintf("<< /Title %s /Producer (dispatch-and-delivery) >>", literal(d.title)))
+	info := len(offsets)
+
+	xref := cw.n
+	fmt.Fprintf(cw, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(cw, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(cw, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, info, xref)
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// pageContent is the content stream drawing a page's lines.
+func pageContent(lines []line) string {
+	var b strings.Builder
+	for _, l := range lines {
+		font := "F1"
+		if l.bold {
+			font = "F2"
+		}
+		fmt.Fprintf(&b, "BT %.2f g /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", l.color, font, l.size, l.x, l.y, literal(l.text))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// literal encodes s as a PDF string in WinAnsiEncoding.
+func literal(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		c := winAnsi(r)
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// winAnsiExtra maps the characters Windows-1252 places in 0x80-0x9F.
+var winAnsiExtra = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// winAnsi returns the Windows-1252 byte for r, or '?' if it has none.
+// Control characters print as spaces.
+func winAnsi(r rune) byte {
+	switch {
+	case r < 0x20:
+		return ' '
+	case r < 0x7F || (r >= 0xA0 && r <= 0xFF):
+		return byte(r)
+	}
+	if c, ok := winAnsiExtra[r]; ok {
+		return c
+	}
+	return '?'
+}
+
+// countingWriter counts the bytes written, for the cross-reference table,
+// and keeps the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
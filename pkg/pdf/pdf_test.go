@@ -0,0 +1,99 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLiteral(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"Receipt", "(Receipt)"},
+		// Parentheses and backslashes are escaped, so they cannot end the string.
+		{`Fee (late) \ n`, `(Fee \(late\) \\ n)`},
+		{`) Tj ET BT (`, `(\) Tj ET BT \()`},
+		// Latin-1 keeps its byte; Windows-1252 extras map into 0x80-0x9F.
+		{"Café €5 — “ok”", "(Caf\xe9 \x805 \x97 \x93ok\x94)"},
+		// Anything else prints as "?", control characters as spaces.
+		{"北京 ✓", "(?? ?)"},
+		{"a\tb\nc", "(a b c)"},
+	} {
+		if got := literal(tc.in); got != tc.want {
+			t.Errorf("literal(%q) = %q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	d := New("Receipt (order 1)")
+	d.Title("Receipt")
+	for i := 0; i < 80; i++ { // More than a page.
+		d.Row(fmt.Sprintf("Line %d", i), "$1.00")
+	}
+	d.BoldRow("Total", "$80.00")
+	var buf bytes.Buffer
+	n, err := d.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo error: %v", err)
+	}
+	pdf := buf.Bytes()
+	if n != int64(len(pdf)) {
+		t.Errorf("WriteTo = %d; wrote %d bytes", n, len(pdf))
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatalf("missing PDF header or trailer")
+	}
+	if len(d.pages) != 2 || !bytes.Contains(pdf, []byte("/Count 2")) {
+		t.Errorf("%d pages; want the rows to spill onto a second page", len(d.pages))
+	}
+
+	// startxref points at the cross-reference table, and every entry at its
+	// object.
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d points at %q; want the xref table", xref, pdf[xref:min(xref+10, len(pdf))])
+	}
+	table := strings.Split(string(pdf[xref:]), "\n")
+	var size int
+	if _, err := fmt.Sscanf(table[1], "0 %d", &size); err != nil {
+		t.Fatalf("xref subsection %q: %v", table[1], err)
+	}
+	if size != 4+2*len(d.pages)+2 || table[2] != "0000000000 65535 f " {
+		t.Errorf("xref has %d entries starting %q; want %d starting with the free entry", size, table[2], 4+2*len(d.pages)+2)
+	}
+	for i := 1; i < size; i++ {
+		entry := table[2+i]
+		if len(entry) != 19 || !strings.HasSuffix(entry, " 00000 n ") {
+			t.Errorf("xref entry %d = %q; want 20 bytes with its newline", i, entry)
+			continue
+		}
+		off, _ := strconv.Atoi(entry[:10])
+		if want := fmt.Sprintf("%d 0 obj\n", i); !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q; want %q", i, pdf[off:min(off+12, len(pdf))], want)
+		}
+	}
+	if !bytes.Contains(pdf, []byte(fmt.Sprintf("/Size %d /Root 1 0 R /Info %d 0 R", size, size-1))) {
+		t.Error("trailer does not match the xref table")
+	}
+
+	// Each content stream is as long as its /Length says.
+	streams := regexp.MustCompile(`(?s)<< /Length (\d+) >>\nstream\n(.*?)\nendstream`).FindAllSubmatch(pdf, -1)
+	if len(streams) != len(d.pages) {
+		t.Fatalf("%d content streams; want %d", len(streams), len(d.pages))
+	}
+	for i, s := range streams {
+		if length, _ := strconv.Atoi(string(s[1])); length != len(s[2]) {
+			t.Errorf("page %d /Length %d; stream is %d bytes", i+1, length, len(s[2]))
+		}
+	}
+	if !bytes.Contains(pdf, []byte(`/Title (Receipt \(order 1\))`)) {
+		t.Error("title is not escaped in the document info")
+	}
+}
@@ -0,0 +1,119 @@
+package resilience
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics holds the counters for one dependency. They are exported through
+// expvar as resilience.<name>.{calls,successes,failures,retries,rejected,
+// timeouts,state,attempts,latency_ms_total,latency_ms}.
+type Metrics struct {
+	calls     expvar.Int
+	successes expvar.Int
+	failures  expvar.Int
+	retries   expvar.Int
+	rejected  expvar.Int // Calls short-circuited by an open breaker.
+	timeouts  expvar.Int // Attempts that hit the per-attempt timeout.
+	state     expvar.String
+
+	attempts     expvar.Int
+	latencyTotal expvar.Int  // Milliseconds across all attempts.
+	latency      *expvar.Map // Attempt counts per latency bucket (le_100, ..., inf).
+}
+
+// latencyBuckets are the upper bounds, in milliseconds, of the attempt latency histogram.
+var latencyBuckets = []int64{50, 100, 250, 500, 1000, 2500, 5000}
+
+func (m *Metrics) observe(d time.Duration) {
+	ms := d.Milliseconds()
+	m.attempts.Add(1)
+	m.latencyTotal.Add(ms)
+	for _, le := range latencyBuckets {
+		if ms <= le {
+			m.latency.Add("le_"+strconv.FormatInt(le, 10), 1)
+			return
+		}
+	}
+	m.latency.Add("inf", 1)
+}
+
+func (m *Metrics) setState(s State) {
+	m.state.Set(string(s))
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*Metrics{}
+	published  = expvar.NewMap("resilience")
+)
+
+// metricsFor returns the shared Metrics for name, creating and publishing it
+// on first use. Executors for the same dependency share counters.
+func metricsFor(name string) *Metrics {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if m, ok := registry[name]; ok {
+		return m
+	}
+	m := &Metrics{latency: new(expvar.Map).Init()}
+	m.setState(StateClosed)
+
+	vars := new(expvar.Map).Init()
+	vars.Set("calls", &m.calls)
+	vars.Set("successes", &m.successes)
+	vars.Set("failures", &m.failures)
+	vars.Set("retries", &m.retries)
+	vars.Set("rejected", &m.rejected)
+	vars.Set("timeouts", &m.timeouts)
+	vars.Set("state", &m.state)
+	vars.Set("attempts", &m.attempts)
+	vars.Set("latency_ms_total", &m.latencyTotal)
+	vars.Set("latency_ms", m.latency)
+	published.Set(name, vars)
+
+	registry[name] = m
+	return m
+}
+
+// Snapshot is a point-in-time copy of a dependency's counters.
+type Snapshot struct {
+	Calls     int64  `json:"calls"`
+	Successes int64  `json:"successes"`
+	Failures  int64  `json:"failures"`
+	Retries   int64  `json:"retries"`
+	Rejected  int64  `json:"rejected"`
+	Timeouts  int64  `json:"timeouts"`
+	State     string `json:"state"`
+	Attempts  int64  `json:"attempts"`
+	// AvgLatencyMs is the mean attempt latency, including failed attempts.
+	AvgLatencyMs int64 `json:"avg_latency_ms"`
+}
+
+// Stats returns a snapshot for every dependency seen so far, keyed by name.
+func Stats() map[string]Snapshot {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	out := make(map[string]Snapshot, len(registry))
+	for name, m := range registry {
+		var avg int64
+		if n := m.attempts.Value(); n > 0 {
+			avg = m.latencyTotal.Value() / n
+		}
+		out[name] = Snapshot{
+			Calls:     m.calls.Value(),
+			Successes: m.successes.Value(),
+			Failures:  m.failures.Value(),
+			Retries:   m.retries.Value(),
+			Rejected:  m.rejected.Value(),
+			Timeouts:  m.timeouts.Value(),
+			State:     m.state.Value(),
+			Attempts:  m.attempts.Value(),
+
+			AvgLatencyMs: avg,
+		}
+	}
+	return out
+}
@@ -0,0 +1,262 @@
+// Package resilience wraps calls to external dependencies (Google Maps, Stripe,
+// SES, SMS and geocoding providers) with a per-attempt timeout, bounded retries
+// with jittered backoff, and a circuit breaker. Every dependency gets its own
+// Executor and its own counters, published under the "resilience" expvar.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the dependency while its breaker is open.
+var ErrCircuitOpen = errors.New("dependency temporarily unavailable")
+
+// Policy configures an Executor.
+type Policy struct {
+	// Name identifies the dependency in errors and metrics (e.g. "google_maps").
+	Name string
+	// Timeout bounds a single attempt. Zero means the caller's deadline only.
+	Timeout time.Duration
+	// MaxAttempts is the total number of tries; 1 disables retries. Only retry
+	// operations that are idempotent (or carry an idempotency key).
+	MaxAttempts int
+	// BaseBackoff and MaxBackoff bound the exponential, jittered retry delay.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// FailureThreshold consecutive failures open the breaker for OpenDuration,
+	// after which a single trial call decides whether it closes again.
+	FailureThreshold int
+	OpenDuration     time.Duration
+	// Retryable reports whether an error is worth retrying. Nil retries every
+	// error except context cancellation.
+	Retryable func(error) bool
+}
+
+// Executor runs calls to one dependency under its Policy.
+type Executor struct {
+	policy  Policy
+	breaker *breaker
+	metrics *Metrics
+}
+
+// New creates an Executor, filling unset Policy fields with conservative defaults.
+func New(p Policy) *Executor {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	if p.BaseBackoff <= 0 {
+		p.BaseBackoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 2 * time.Second
+	}
+	if p.FailureThreshold < 1 {
+		p.FailureThreshold = 5
+	}
+	if p.OpenDuration <= 0 {
+		p.OpenDuration = 30 * time.Second
+	}
+	return &Executor{
+		policy:  p,
+		breaker: &breaker{threshold: p.FailureThreshold, openFor: p.OpenDuration},
+		metrics: metricsFor(p.Name),
+	}
+}
+
+// Do calls fn, retrying and short-circuiting according to the policy. The ctx
+// passed to fn carries the per-attempt timeout; the overall call never
+// outlives the caller's ctx.
+func (e *Executor) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	e.metrics.calls.Add(1)
+
+	var err error
+	for attempt := 1; attempt <= e.policy.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			e.metrics.retries.Add(1)
+			if werr := sleep(ctx, e.backoff(attempt)); werr != nil {
+				break // Keep the last dependency error; the caller's deadline is up.
+			}
+		}
+
+		if !e.breaker.allow() {
+			if err != nil {
+				break // Our own retries opened the breaker; report the real failure.
+			}
+			e.metrics.rejected.Add(1)
+			return fmt.Errorf("%s: %w", e.policy.Name, ErrCircuitOpen)
+		}
+
+		err = e.attempt(ctx, fn)
+		var perm *permanentError
+		if err == nil || errors.As(err, &perm) {
+			// A permanent error (e.g. card declined, bad request) means the
+			// dependency answered; it must not trip the breaker.
+			e.breaker.success()
+			e.metrics.setState(e.breaker.currentState())
+			if err != nil {
+				e.metrics.failures.Add(1)
+				return perm.err
+			}
+			e.metrics.successes.Add(1)
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			// The caller gave up; that says nothing about the dependency's health.
+			e.breaker.release()
+			break
+		}
+		e.breaker.failure()
+		e.metrics.setState(e.breaker.currentState())
+		if !e.retryable(err) {
+			break
+		}
+	}
+
+	e.metrics.failures.Add(1)
+	return err
+}
+
+func (e *Executor) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	defer func() { e.metrics.observe(time.Since(start)) }()
+	if e.policy.Timeout <= 0 {
+		return fn(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, e.policy.Timeout)
+	defer cancel()
+	err := fn(attemptCtx)
+	if err != nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		e.metrics.timeouts.Add(1)
+	}
+	return err
+}
+
+func (e *Executor) retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if e.policy.Retryable != nil {
+		return e.policy.Retryable(err)
+	}
+	return true
+}
+
+// backoff returns base*2^(attempt-2), capped, with full jitter.
+func (e *Executor) backoff(attempt int) time.Duration {
+	d := e.policy.BaseBackoff << (attempt - 2)
+	if d <= 0 || d > e.policy.MaxBackoff {
+		d = e.policy.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Permanent marks err as not worth retrying and not a sign of an unhealthy
+// dependency (e.g. a 4xx response). Do returns the unwrapped error.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+type permanentError struct{ err error }
+
+func (p *permanentError) Error() string { return p.err.Error() }
+func (p *permanentError) Unwrap() error { return p.err }
+
+// State is the breaker state.
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half_open"
+)
+
+// breaker is a consecutive-failure circuit breaker with a single half-open probe.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	openFor   time.Duration
+
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.state = StateHalfOpen
+		b.probing = true
+		return true
+	case StateHalfOpen:
+		if b.probing {
+			return false // Only one trial call at a time.
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = StateClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == StateHalfOpen || b.failures >= b.threshold {
+		b.state = StateOpen
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+}
+
+// release ends a half-open probe without judging the dependency.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *breaker) currentState() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == "" {
+		return StateClosed
+	}
+	return b.state
+}
@@ -0,0 +1,161 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("connection refused")
+
+// failing returns a call that fails with err the first n times, then succeeds.
+func failing(n int, err error, calls *int) func(context.Context) error {
+	return func(context.Context) error {
+		*calls++
+		if *calls <= n {
+			return err
+		}
+		return nil
+	}
+}
+
+// since returns the counters of name added after before was taken; the
+// registry outlives a single test run.
+func since(name string, before Snapshot) Snapshot {
+	s := Stats()[name]
+	return Snapshot{
+		Calls:     s.Calls - before.Calls,
+		Successes: s.Successes - before.Successes,
+		Failures:  s.Failures - before.Failures,
+		Retries:   s.Retries - before.Retries,
+		Rejected:  s.Rejected - before.Rejected,
+		Timeouts:  s.Timeouts - before.Timeouts,
+		State:     s.State,
+		Attempts:  s.Attempts - before.Attempts,
+	}
+}
+
+func TestDoRetries(t *testing.T) {
+	ctx := context.Background()
+	before := Stats()["test_retries"]
+	e := New(Policy{Name: "test_retries", MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	calls := 0
+	if err := e.Do(ctx, failing(2, errDown, &calls)); err != nil || calls != 3 {
+		t.Errorf("Do = %v after %d calls; want success on the third", err, calls)
+	}
+	calls = 0
+	if err := e.Do(ctx, failing(3, errDown, &calls)); !errors.Is(err, errDown) || calls != 3 {
+		t.Errorf("Do = %v after %d calls; want the last error after 3", err, calls)
+	}
+
+	// A permanent error is returned unwrapped, without a retry.
+	calls = 0
+	declined := errors.New("card declined")
+	if err := e.Do(ctx, failing(1, Permanent(declined), &calls)); err != declined || calls != 1 {
+		t.Errorf("Do = %v after %d calls; want the declined error once", err, calls)
+	}
+	// So is anything Retryable rejects.
+	strict := New(Policy{Name: "test_retries", MaxAttempts: 3, BaseBackoff: time.Millisecond,
+		Retryable: func(err error) bool { return !errors.Is(err, errDown) }})
+	calls = 0
+	if err := strict.Do(ctx, failing(1, errDown, &calls)); !errors.Is(err, errDown) || calls != 1 {
+		t.Errorf("Do = %v after %d calls; want no retry of a non-retryable error", err, calls)
+	}
+
+	s := since("test_retries", before)
+	if s.Calls != 4 || s.Successes != 1 || s.Failures != 3 || s.Retries != 4 || s.Attempts != 8 || s.State != string(StateClosed) {
+		t.Errorf("stats = %+v; want 4 calls, 1 success, 3 failures, 4 retries, 8 attempts, closed", s)
+	}
+}
+
+func TestDoTimeout(t *testing.T) {
+	before := Stats()["test_timeout"]
+	e := New(Policy{Name: "test_timeout", Timeout: 10 * time.Millisecond, MaxAttempts: 2, BaseBackoff: time.Millisecond})
+	calls := 0
+	err := e.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || calls != 2 {
+		t.Errorf("Do = %v after %d calls; want both attempts to time out", err, calls)
+	}
+	if s := since("test_timeout", before); s.Timeouts != 2 {
+		t.Errorf("%d timeouts counted; want 2", s.Timeouts)
+	}
+
+	// A caller that gives up stops the retries.
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = e.Do(ctx, func(context.Context) error {
+		calls++
+		cancel()
+		return context.Canceled
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("Do = %v after %d calls; want context.Canceled without a retry", err, calls)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	ctx := context.Background()
+	before := Stats()["test_breaker"]
+	e := New(Policy{Name: "test_breaker", FailureThreshold: 2, OpenDuration: 20 * time.Millisecond})
+	fail := func(context.Context) error { return errDown }
+	ok := func(context.Context) error { return nil }
+
+	// Permanent errors and cancelled calls do not count towards opening.
+	e.Do(ctx, fail)
+	e.Do(ctx, func(context.Context) error { return Permanent(errors.New("bad request")) })
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	e.Do(cancelled, func(ctx context.Context) error { return ctx.Err() })
+	if state := e.breaker.currentState(); state != StateClosed {
+		t.Fatalf("breaker %s after one failure; want closed", state)
+	}
+
+	// Two failures in a row open it; calls are then rejected without running.
+	e.Do(ctx, fail)
+	e.Do(ctx, fail)
+	calls := 0
+	if err := e.Do(ctx, failing(0, nil, &calls)); !errors.Is(err, ErrCircuitOpen) || calls != 0 {
+		t.Fatalf("Do on an open breaker = %v after %d calls; want ErrCircuitOpen without a call", err, calls)
+	}
+	if s := since("test_breaker", before); s.State != string(StateOpen) || s.Rejected != 1 {
+		t.Errorf("stats = %+v; want open with 1 rejected call", s)
+	}
+
+	// After OpenDuration one trial call goes through; a failure reopens it.
+	time.Sleep(25 * time.Millisecond)
+	if err := e.Do(ctx, fail); !errors.Is(err, errDown) {
+		t.Errorf("trial call = %v; want the dependency's error", err)
+	}
+	if err := e.Do(ctx, ok); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Do after a failed trial = %v; want ErrCircuitOpen", err)
+	}
+
+	// Only one trial at a time; a successful one closes the breaker.
+	time.Sleep(25 * time.Millisecond)
+	inTrial, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- e.Do(ctx, func(context.Context) error {
+			close(inTrial)
+			<-release
+			return nil
+		})
+	}()
+	<-inTrial
+	if err := e.Do(ctx, ok); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Do during the trial = %v; want ErrCircuitOpen", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("trial call = %v; want success", err)
+	}
+	if err := e.Do(ctx, ok); err != nil || e.breaker.currentState() != StateClosed {
+		t.Errorf("Do after a successful trial = %v with the breaker %s; want closed", err, e.breaker.currentState())
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStorage keeps objects on disk for development. Presigned URLs point at
+// Handler, which must be mounted at the path of baseURL.
+type LocalStorage struct {
+	root    string
+	baseURL string // e.g. http://localhost:8080/files
+	secret  []byte
+}
+
+// NewLocalStorage creates root if needed. secret signs download URLs.
+func NewLocalStorage(root, baseURL, secret string) (*LocalStorage, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("storage: create %s: %w", root, err)
+	}
+	return &LocalStorage{root: root, baseURL: strings.TrimRight(baseURL, "/"), secret: []byte(secret)}, nil
+}
+
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put implements Storage. The content type is kept in a sidecar file.
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("storage.Put %s: %w", key, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("storage.Put %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(r, size+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("storage.Put %s: %w", key, err)
+	}
+	if n != size {
+		return fmt.Errorf("storage.Put %s: got %d bytes, declared %d", key, n, size)
+	}
+	if err := os.WriteFile(p+".type", []byte(contentType), 0o644); err != nil {
+		return fmt.Errorf("storage.Put %s: %w", key, err)
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Get implements Storage.
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return nil, nil, err
+	}
+	p := s.path(key)
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("storage.Get %s: %w", key, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("storage.Get %s: %w", key, err)
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(p))
+	if b, err := os.ReadFile(p + ".type"); err == nil {
+		contentType = string(b)
+	}
+	return f, &ObjectInfo{Key: key, Size: st.Size(), ContentType: contentType}, nil
+}
+
+// Delete implements Storage. Deleting a missing object is not an error.
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	p := s.path(key)
+	for _, f := range []string{p, p + ".type"} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("storage.Delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// PresignGet implements Storage with an HMAC-signed URL served by Handler.
+func (s *LocalStorage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return fmt.Sprintf("%s/%s?expires=%s&sig=%s", s.baseURL, key, expires, s.sign(key, expires)), nil
+}
+
+func (s *LocalStorage) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handler serves presigned downloads. prefix is the path it is mounted at.
+func (s *LocalStorage) Handler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		expires, sig := r.URL.Query().Get("expires"), r.URL.Query().Get("sig")
+		exp, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || time.Now().Unix() > exp || !hmac.Equal([]byte(sig), []byte(s.sign(key, expires))) {
+			http.Error(w, "invalid or expired link", http.StatusForbidden)
+			return
+		}
+		body, info, err := s.Get(r.Context(), key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer body.Close()
+		w.Header().Set("Content-Type", info.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		io.Copy(w, body)
+	})
+}
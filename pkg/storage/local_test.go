@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStorage(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := NewLocalStorage(filepath.Join(root, "files"), "http://localhost/files/", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "invoices/o1/receipt.pdf"
+	if err := s.Put(ctx, key, strings.NewReader("%PDF-1.4"), 8, "application/pdf"); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	body, info, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "%PDF-1.4" || *info != (ObjectInfo{Key: key, Size: 8, ContentType: "application/pdf"}) {
+		t.Errorf("Get = %q, %+v; want the stored PDF", data, info)
+	}
+
+	// A body that does not match its declared size is not stored.
+	for _, n := range []int64{3, 20} {
+		if err := s.Put(ctx, "invoices/o1/short.pdf", strings.NewReader("%PDF-1.4"), n, "application/pdf"); err == nil {
+			t.Errorf("Put accepted 8 bytes declared as %d", n)
+		}
+	}
+	if _, _, err := s.Get(ctx, "invoices/o1/short.pdf"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after a failed Put = %v; want ErrNotFound", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(root, "files/invoices/o1/.upload-*")); len(leftovers) != 0 {
+		t.Errorf("failed uploads left %v behind", leftovers)
+	}
+	if err := s.Put(ctx, "../escape", strings.NewReader("x"), 1, "text/plain"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put outside the root = %v; want ErrInvalidKey", err)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "files", key+".type")); !os.IsNotExist(err) {
+		t.Error("Delete left the content type behind")
+	}
+	if _, _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete = %v; want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing object = %v; want nil", err)
+	}
+}
+
+func TestLocalPresign(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewLocalStorage(t.TempDir(), "http://localhost/files", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "pod/photos/o1/photo.png"
+	if err := s.Put(ctx, key, strings.NewReader("png"), 3, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler("/files")
+	get := func(link string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, link, nil))
+		return rec
+	}
+
+	link, err := s.PresignGet(ctx, key, time.Minute)
+	if err != nil || !strings.HasPrefix(link, "http://localhost/files/"+key+"?") {
+		t.Fatalf("PresignGet = %q, %v; want a link under the base URL", link, err)
+	}
+	rec := get(link)
+	if rec.Code != http.StatusOK || rec.Body.String() != "png" || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("download = %d %q (%s); want the PNG", rec.Code, rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+
+	// The signature covers the key and the expiry.
+	u, _ := url.Parse(link)
+	q := u.Query()
+	other := "/files/pod/photos/o2/photo.png?" + q.Encode()
+	q.Set("expires", "9999999999")
+	extended := u.Path + "?" + q.Encode()
+	expired, _ := s.PresignGet(ctx, key, -time.Minute)
+	for name, l := range map[string]string{"another key": other, "a later expiry": extended, "an expired link": expired, "no signature": "/files/" + key} {
+		if rec := get(l); rec.Code != http.StatusForbidden {
+			t.Errorf("download with %s = %d; want 403", name, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// unsignedPayload lets uploads stream without hashing the body first; the
+// request is still authenticated and TLS protects the content.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Storage talks to the S3 REST API directly with SigV4-signed requests.
+type S3Storage struct {
+	bucket   string
+	region   string
+	endpoint string // Custom endpoint (MinIO, LocalStack) uses path-style URLs.
+
+	creds      aws.CredentialsProvider
+	signer     *v4.Signer
+	httpClient *http.Client
+	breaker    *resilience.Executor
+}
+
+// NewS3Storage creates an S3 store. Credentials come from the default AWS
+// chain (environment, shared config, instance role). endpoint is optional.
+func NewS3Storage(ctx context.Context, region, bucket, endpoint string) (*S3Storage, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("storage: S3 bucket is required")
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{
+		bucket:     bucket,
+		region:     region,
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		creds:      cfg.Credentials,
+		signer:     v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true }),
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+		breaker: resilience.New(resilience.Policy{
+			Name:             "s3",
+			MaxAttempts:      1, // Bodies are streamed and cannot be replayed.
+			FailureThreshold: 5,
+			OpenDuration:     30 * time.Second,
+		}),
+	}, nil
+}
+
+func (s *S3Storage) objectURL(key string) string {
+	if s.endpoint != "" {
+		return s.endpoint + "/" + s.bucket + "/" + key
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, key)
+}
+
+func (s *S3Storage) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		creds, err := s.creds.Retrieve(ctx)
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+		if err := s.signer.SignHTTP(ctx, creds, req, unsignedPayload, "s3", s.region, time.Now()); err != nil {
+			return resilience.Permanent(err)
+		}
+		resp, err = s.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			return fmt.Errorf("s3: %s %s returned %d", req.Method, req.URL.Path, resp.StatusCode)
+		}
+		return nil
+	})
+	return resp, err
+}
+
+// Put implements Storage.
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return fmt.Errorf("storage.Put %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storage.Put %s: s3 returned %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+// Get implements Storage.
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("storage.Get %s: %w", key, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, nil, ErrNotFound
+	default:
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("storage.Get %s: s3 returned %d", key, resp.StatusCode)
+	}
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return resp.Body, &ObjectInfo{Key: key, Size: size, ContentType: resp.Header.Get("Content-Type")}, nil
+}
+
+// Delete implements Storage. Deleting a missing object is not an error.
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, req)
+	if err != nil {
+		return fmt.Errorf("storage.Delete %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storage.Delete %s: s3 returned %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+// PresignGet implements Storage. S3 caps presigned URLs at seven days.
+func (s *S3Storage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(ttl/time.Second), 10))
+	req.URL.RawQuery = q.Encode()
+
+	creds, err := s.creds.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("storage.PresignGet: %w", err)
+	}
+	url, _, err := s.signer.PresignHTTP(ctx, creds, req, unsignedPayload, "s3", s.region, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("storage.PresignGet: %w", err)
+	}
+	return url, nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// newTestS3 points an S3Storage with static credentials at endpoint.
+func newTestS3(endpoint string) *S3Storage {
+	return &S3Storage{
+		bucket:   "circuit",
+		region:   "us-west-2",
+		endpoint: endpoint,
+		creds: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		signer:     v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true }),
+		httpClient: http.DefaultClient,
+		breaker:    resilience.New(resilience.Policy{Name: "s3_test", MaxAttempts: 1}),
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-west-2/s3/aws4_request") {
+			t.Errorf("%s %s Authorization = %q; want a SigV4 signature for s3 in us-west-2", r.Method, r.URL.Path, auth)
+		}
+		if r.Header.Get("X-Amz-Content-Sha256") != unsignedPayload {
+			t.Errorf("%s %s payload hash = %q; want %s", r.Method, r.URL.Path, r.Header.Get("X-Amz-Content-Sha256"), unsignedPayload)
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = r.Header.Get("Content-Type") + "|" + string(body)
+		case http.MethodGet:
+			obj, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			contentType, body, _ := strings.Cut(obj, "|")
+			w.Header().Set("Content-Type", contentType)
+			io.WriteString(w, body)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+	s := newTestS3(srv.URL)
+
+	// A custom endpoint is addressed path-style.
+	key := "avatars/u1.png"
+	if err := s.Put(ctx, key, strings.NewReader("png"), 3, "image/png"); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	if objects["/circuit/"+key] != "image/png|png" {
+		t.Errorf("stored %v; want the PNG at /circuit/%s", objects, key)
+	}
+	body, info, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "png" || *info != (ObjectInfo{Key: key, Size: 3, ContentType: "image/png"}) {
+		t.Errorf("Get = %q, %+v; want the PNG", data, info)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+	if _, _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete = %v; want ErrNotFound", err)
+	}
+	if err := s.Put(ctx, "../x", strings.NewReader("x"), 1, "text/plain"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put with a bad key = %v; want ErrInvalidKey", err)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	ctx := context.Background()
+	status := http.StatusForbidden
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	s := newTestS3(srv.URL)
+
+	for _, code := range []int{http.StatusForbidden, http.StatusServiceUnavailable} {
+		status = code
+		if err := s.Put(ctx, "a/b", strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put answered %d succeeded", code)
+		}
+		if _, _, err := s.Get(ctx, "a/b"); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Get answered %d = %v; want an error other than ErrNotFound", code, err)
+		}
+		if err := s.Delete(ctx, "a/b"); err == nil {
+			t.Errorf("Delete answered %d succeeded", code)
+		}
+	}
+}
+
+func TestS3PresignGet(t *testing.T) {
+	link, err := newTestS3("").PresignGet(context.Background(), "invoices/o1/receipt.pdf", 15*time.Minute)
+	if err != nil {
+		t.Fatalf("PresignGet error: %v", err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Host != "circuit.s3.us-west-2.amazonaws.com" || u.Path != "/invoices/o1/receipt.pdf" {
+		t.Errorf("presigned %s%s; want the virtual-hosted object URL", u.Host, u.Path)
+	}
+	if q.Get("X-Amz-Expires") != "900" || q.Get("X-Amz-Signature") == "" || !strings.HasPrefix(q.Get("X-Amz-Credential"), "AKID/") {
+		t.Errorf("presigned query = %s; want a 900s signature with the access key", u.RawQuery)
+	}
+}
@@ -0,0 +1,100 @@
+// Package storage stores user and system files (proof-of-delivery photos,
+// signatures, claim photos, avatars, invoices, exports) behind a small
+// interface, with an S3 implementation for deployed environments and a
+// local-disk one for development.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound           = errors.New("storage: object not found")
+	ErrInvalidKey         = errors.New("storage: invalid object key")
+	ErrTooLarge           = errors.New("storage: object too large")
+	ErrUnsupportedContent = errors.New("storage: unsupported content type")
+)
+
+// Storage is implemented by S3Storage and LocalStorage.
+type Storage interface {
+	// Put stores size bytes from r under key. size must be known up front so
+	// limits are enforced before anything is uploaded.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object; the caller must close the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// PresignGet returns a URL that downloads the object without credentials until ttl elapses.
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+}
+
+// Policy bounds what may be stored for one kind of file.
+type Policy struct {
+	Prefix       string // Key prefix, e.g. "pod/photos".
+	MaxBytes     int64
+	ContentTypes []string
+}
+
+// Policies for each kind of file the application stores.
+var (
+	PolicyDeliveryPhoto = Policy{Prefix: "pod/photos", MaxBytes: 10 << 20, ContentTypes: []string{"image/jpeg", "image/png", "image/webp"}}
+	PolicySignature     = Policy{Prefix: "pod/signatures", MaxBytes: 1 << 20, ContentTypes: []string{"image/png", "image/svg+xml"}}
+	PolicyClaimPhoto    = Policy{Prefix: "claims/photos", MaxBytes: 10 << 20, ContentTypes: []string{"image/jpeg", "image/png", "image/webp"}}
+	PolicyAvatar        = Policy{Prefix: "avatars", MaxBytes: 2 << 20, ContentTypes: []string{"image/jpeg", "image/png", "image/webp"}}
+	PolicyInvoice       = Policy{Prefix: "invoices", MaxBytes: 5 << 20, ContentTypes: []string{"application/pdf"}}
+	PolicyExport        = Policy{Prefix: "exports", MaxBytes: 100 << 20, ContentTypes: []string{"text/csv", "application/json"}}
+)
+
+// Validate checks size and content type against the policy.
+func (p Policy) Validate(contentType string, size int64) error {
+	if size < 0 || (p.MaxBytes > 0 && size > p.MaxBytes) {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrTooLarge, size, p.MaxBytes)
+	}
+	mediaType := strings.TrimSpace(strings.ToLower(strings.SplitN(contentType, ";", 2)[0]))
+	for _, ct := range p.ContentTypes {
+		if mediaType == ct {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrUnsupportedContent, contentType)
+}
+
+// Key builds an object key under the policy prefix, e.g.
+// Key("order-id", "photo-1.jpg") -> "pod/photos/order-id/photo-1.jpg".
+func (p Policy) Key(parts ...string) string {
+	return strings.Join(append([]string{p.Prefix}, parts...), "/")
+}
+
+// PutValidated validates against p and stores the object.
+func PutValidated(ctx context.Context, s Storage, p Policy, key string, r io.Reader, size int64, contentType string) error {
+	if !strings.HasPrefix(key, p.Prefix+"/") {
+		return fmt.Errorf("%w: %q is outside %q", ErrInvalidKey, key, p.Prefix)
+	}
+	if err := p.Validate(contentType, size); err != nil {
+		return err
+	}
+	return s.Put(ctx, key, r, size, contentType)
+}
+
+// Keys are restricted to a URL- and filesystem-safe alphabet so they never
+// need escaping and can never climb out of the storage root.
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*(/[A-Za-z0-9][A-Za-z0-9._-]*)*$`)
+
+func validateKey(key string) error {
+	if len(key) > 1024 || !keyPattern.MatchString(key) || strings.Contains(key, "..") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
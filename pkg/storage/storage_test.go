@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateKey(t *testing.T) {
+	for _, key := range []string{"pod/photos/o1/photo-1.jpg", "avatars/u_1.png", "exports/2026-10-16.csv"} {
+		if err := validateKey(key); err != nil {
+			t.Errorf("validateKey(%q) = %v; want ok", key, err)
+		}
+	}
+	for _, key := range []string{"", "/etc/passwd", "pod/../../etc", "pod//x", "pod/.hidden", "a b", "pod/x?sig=1", strings.Repeat("a", 1025)} {
+		if err := validateKey(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("validateKey(%q) = %v; want ErrInvalidKey", key, err)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p := PolicyDeliveryPhoto
+	if key := p.Key("o1", "photo-1.jpg"); key != "pod/photos/o1/photo-1.jpg" {
+		t.Errorf("Key = %q; want pod/photos/o1/photo-1.jpg", key)
+	}
+	if err := p.Validate("Image/JPEG; charset=binary", 1024); err != nil {
+		t.Errorf("Validate jpeg = %v; want ok", err)
+	}
+	if err := p.Validate("image/jpeg", p.MaxBytes+1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Validate oversize = %v; want ErrTooLarge", err)
+	}
+	if err := p.Validate("image/gif", 1024); !errors.Is(err, ErrUnsupportedContent) {
+		t.Errorf("Validate gif = %v; want ErrUnsupportedContent", err)
+	}
+
+	// Nothing reaches the store unless it fits the policy.
+	s, err := NewLocalStorage(t.TempDir(), "http://localhost/files", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := PutValidated(ctx, s, p, "avatars/u1.jpg", strings.NewReader("x"), 1, "image/jpeg"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("PutValidated outside the prefix = %v; want ErrInvalidKey", err)
+	}
+	if err := PutValidated(ctx, s, p, p.Key("o1", "x.gif"), strings.NewReader("x"), 1, "image/gif"); !errors.Is(err, ErrUnsupportedContent) {
+		t.Errorf("PutValidated gif = %v; want ErrUnsupportedContent", err)
+	}
+	if err := PutValidated(ctx, s, p, p.Key("o1", "x.jpg"), strings.NewReader("x"), 1, "image/jpeg"); err != nil {
+		t.Errorf("PutValidated = %v; want ok", err)
+	}
+}
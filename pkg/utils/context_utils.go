@@ -23,6 +23,13 @@ func GetUserIDFromContext(c echo.Context) (string, error) {
 	return userID, nil
 }
 
+// IsAdmin reports whether the authenticated user carries the "ADMIN" role
+// (set by the JWT middleware as "userRole").
+func IsAdmin(c echo.Context) bool {
+	role, ok := c.Get("userRole").(string)
+	return ok && role == "ADMIN"
+}
+
 // GetPageLimit extracts page and limit query params for pagination
 func GetPageLimit(c echo.Context) (page int, limit int) {
 	pageStr := c.QueryParam("page")
@@ -0,0 +1,122 @@
+// Package weather reports current conditions at a coordinate behind a small
+// Provider interface, with an implementation for the Open-Meteo forecast API.
+// Retries and circuit breaking are left to the caller.
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"dispatch-and-delivery/pkg/resilience"
+)
+
+// Provider is implemented by OpenMeteo.
+type Provider interface {
+	// Name identifies the provider in errors and metrics (e.g. "open_meteo").
+	Name() string
+	// Current returns the conditions at (lat, lng) now. Errors that retrying
+	// cannot fix are marked resilience.Permanent.
+	Current(ctx context.Context, lat, lng float64) (*Conditions, error)
+}
+
+// Conditions are the current weather at one place.
+type Conditions struct {
+	WindSpeedMS      float64 `json:"wind_speed_ms"`     // Sustained wind 10 m above ground.
+	WindGustMS       float64 `json:"wind_gust_ms"`      // Strongest gust 10 m above ground.
+	PrecipitationMMH float64 `json:"precipitation_mmh"` // Rain, showers and snow, in mm per hour.
+}
+
+// Wind returns the stronger of the sustained wind and the gusts.
+func (c Conditions) Wind() float64 {
+	return max(c.WindSpeedMS, c.WindGustMS)
+}
+
+// Worse returns conditions that are at least as bad as both c and o in every field.
+func (c Conditions) Worse(o Conditions) Conditions {
+	return Conditions{
+		WindSpeedMS:      max(c.WindSpeedMS, o.WindSpeedMS),
+		WindGustMS:       max(c.WindGustMS, o.WindGustMS),
+		PrecipitationMMH: max(c.PrecipitationMMH, o.PrecipitationMMH),
+	}
+}
+
+// OpenMeteo reads current conditions from the Open-Meteo forecast API, which
+// needs no API key for non-commercial use. Self-hosted instances and the
+// commercial endpoint are selected with the base URL.
+type OpenMeteo struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// DefaultOpenMeteoURL is the public Open-Meteo forecast endpoint.
+const DefaultOpenMeteoURL = "https://api.open-meteo.com/v1/forecast"
+
+// NewOpenMeteo creates an Open-Meteo provider. baseURL and client are optional.
+func NewOpenMeteo(baseURL string, client *http.Client) *OpenMeteo {
+	if baseURL == "" {
+		baseURL = DefaultOpenMeteoURL
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &OpenMeteo{baseURL: strings.TrimRight(baseURL, "/"), httpClient: client}
+}
+
+// Name implements Provider.
+func (o *OpenMeteo) Name() string { return "open_meteo" }
+
+// Current implements Provider.
+func (o *OpenMeteo) Current(ctx context.Context, lat, lng float64) (*Conditions, error) {
+	q := url.Values{}
+	q.Set("latitude", strconv.FormatFloat(lat, 'f', 4, 64))
+	q.Set("longitude", strconv.FormatFloat(lng, 'f', 4, 64))
+	q.Set("current", "wind_speed_10m,wind_gusts_10m,precipitation")
+	q.Set("wind_speed_unit", "ms")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("open_meteo returned status %d", resp.StatusCode)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, resilience.Permanent(err)
+		}
+		return nil, err
+	}
+
+	var out struct {
+		Current *struct {
+			WindSpeed     float64 `json:"wind_speed_10m"`
+			WindGusts     float64 `json:"wind_gusts_10m"`
+			Precipitation float64 `json:"precipitation"`
+		} `json:"current"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("open_meteo: decode response: %w", err)
+	}
+	if out.Current == nil {
+		return nil, resilience.Permanent(errors.New("open_meteo: no current conditions"))
+	}
+	return &Conditions{
+		WindSpeedMS: out.Current.WindSpeed,
+		WindGustMS:  out.Current.WindGusts,
+		// Open-Meteo reports the precipitation of the preceding hour.
+		PrecipitationMMH: out.Current.Precipitation,
+	}, nil
+}